@@ -17,6 +17,7 @@ import (
 
 	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
 	. "github.com/carbonblack/cb-event-forwarder/pkg/forwarder"
+	"github.com/carbonblack/cb-event-forwarder/pkg/outputs"
 	"github.com/rcrowley/go-metrics"
 	log "github.com/sirupsen/logrus"
 	_ "net/http/pprof"
@@ -26,8 +27,14 @@ var (
 	pidFileLocation    = flag.String("pid-file", "", "PID file location")
 	checkConfiguration = flag.Bool("check", false, "Check the configuration file and exit")
 	debug              = flag.Bool("debug", false, "Enable debugging mode")
+	verify             = flag.Bool("verify", false, "Send a test event to every output and exit, failing if any output does not accept it")
+	golden             = flag.String("golden", "", "Check the output for the sample events in a golden set directory against what was recorded for them and exit, failing on any difference")
+	goldenUpdate       = flag.Bool("golden-update", false, "With -golden, record the current output for the sample events instead of checking it")
 )
 
+// how long each output has to accept the test event sent by -verify
+const verifyTimeout = 30 * time.Second
+
 var version = "3.7.5"
 
 var signals = make(chan os.Signal, 2)
@@ -49,6 +56,14 @@ func main() {
 		checkConfig(&forwarder)
 	}
 
+	if *verify {
+		verifyOutputs(&forwarder)
+	}
+
+	if len(*golden) > 0 {
+		checkGolden(&forwarder)
+	}
+
 	handleStartup(hostname, &forwarder)
 
 	handleExit(&forwarder)
@@ -80,6 +95,33 @@ func checkConfig(forwarder *EventForwarder) {
 	os.Exit(0)
 }
 
+func verifyOutputs(forwarder *EventForwarder) {
+	if err := forwarder.Verify(verifyTimeout); err != nil {
+		log.Fatal(err)
+	}
+	log.Info("Every output accepted the test event")
+	os.Exit(0)
+}
+
+func checkGolden(forwarder *EventForwarder) {
+	report, err := forwarder.CheckGolden(*golden, *goldenUpdate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *goldenUpdate {
+		log.Infof("Recorded %d golden outputs in %s", report.Updated, *golden)
+		os.Exit(0)
+	}
+	for _, failure := range report.Failures {
+		log.Errorf("Golden check failed for %s", failure)
+	}
+	if len(report.Failures) > 0 {
+		log.Fatalf("%d golden outputs in %s did not match", len(report.Failures), *golden)
+	}
+	log.Infof("All %d golden outputs in %s match", report.Checked, *golden)
+	os.Exit(0)
+}
+
 func handlePidFile() {
 	defaultPidFileLocation := "/run/cb/integrations/cb-event-forwarder/cb-event-forwarder.pid"
 	if *pidFileLocation == "" {
@@ -191,4 +233,10 @@ func hookSignals() {
 	signal.Notify(signals, syscall.SIGHUP)
 	signal.Notify(signals, syscall.SIGTERM)
 	signal.Notify(signals, syscall.SIGINT)
+	if outputs.FlushSignal != nil {
+		signal.Notify(signals, outputs.FlushSignal)
+	}
+	if ReloadSignal != nil {
+		signal.Notify(signals, ReloadSignal)
+	}
 }
@@ -0,0 +1,65 @@
+// Package customformatter is an example of a format added by a custom build. Importing it
+// registers the csv format, so that a build of the forwarder with this file in
+// cmd/cb-event-forwarder:
+//
+//	package main
+//
+//	import _ "github.com/carbonblack/cb-event-forwarder/examples/customformatter"
+//
+// accepts output_format=csv for any output.
+package customformatter
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/formatters"
+)
+
+// CSVColumns are the event fields written by the csv format, in order. Missing fields are
+// written as empty columns.
+var CSVColumns = []string{"type", "timestamp", "sensor_id", "computer_name", "process_name"}
+
+func init() {
+	formatters.RegisterFormatter("csv", func(*Configuration) (formatters.Formatter, error) {
+		return CSVFormatter{Columns: CSVColumns}, nil
+	})
+}
+
+// CSVFormatter writes every event as a single CSV record of some of its top level fields.
+type CSVFormatter struct {
+	Columns []string
+}
+
+func (f CSVFormatter) Format(event *formatters.Event) (string, error) {
+	fields, err := event.Fields()
+	if err != nil {
+		return "", err
+	}
+
+	record := make([]string, len(f.Columns))
+	for i, column := range f.Columns {
+		switch value := fields[column].(type) {
+		case nil:
+		case string:
+			record[i] = value
+		case json.Number:
+			record[i] = value.String()
+		default:
+			b, _ := json.Marshal(value)
+			record[i] = string(b)
+		}
+	}
+
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	if err := w.Write(record); err != nil {
+		return "", fmt.Errorf("could not write csv record: %s", err)
+	}
+	w.Flush()
+	// the outputs end every event with a newline of their own
+	return strings.TrimSuffix(b.String(), "\n"), w.Error()
+}
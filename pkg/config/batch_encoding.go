@@ -0,0 +1,29 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BatchEncoding controls how the http output puts together the events of a batch.
+type BatchEncoding string
+
+const (
+	// NDJSONBatch writes one event per line, as expected by line oriented collectors
+	NDJSONBatch BatchEncoding = "ndjson"
+	// JSONArrayBatch writes the events as the elements of a json array, as expected by bulk endpoints
+	JSONArrayBatch BatchEncoding = "json-array"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+func BatchEncodingFromString(encodingString string) (BatchEncoding, error) {
+	switch BatchEncoding(strings.ToLower(strings.TrimSpace(encodingString))) {
+	case NDJSONBatch:
+		return NDJSONBatch, nil
+	case JSONArrayBatch:
+		return JSONArrayBatch, nil
+	default:
+		return "", fmt.Errorf("batch encoding %s not recognized (ndjson or json-array)", encodingString)
+	}
+}
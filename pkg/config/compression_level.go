@@ -0,0 +1,144 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionLevel trades compression speed for ratio. Positive levels are those of the codec
+// the output compresses with; the named levels map to the fastest, balanced and best level of
+// whichever codec that is.
+type CompressionLevel int
+
+const (
+	// DefaultCompressionLevel is the balanced level of the codec
+	DefaultCompressionLevel CompressionLevel = 0
+	FastestCompressionLevel CompressionLevel = -1
+	BestCompressionLevel    CompressionLevel = -2
+	// NoCompressionLevel is what compression_level=0 used to mean, gzip storing the data as it
+	// is; codecs without such a level use their fastest one
+	NoCompressionLevel CompressionLevel = -3
+)
+
+// codecs that take a compression level, and the range of their numbered levels
+var compressionLevelRanges = map[string][2]int{
+	"gzip": {gzip.BestSpeed, gzip.BestCompression},
+	"lz4":  {1, 9},
+	// zstd levels are mapped to the closest level the encoder implements
+	"zstd": {1, 22},
+}
+
+func CompressionLevelFromString(levelString string) (CompressionLevel, error) {
+	switch strings.ToLower(strings.TrimSpace(levelString)) {
+	case "fastest":
+		return FastestCompressionLevel, nil
+	case "default":
+		return DefaultCompressionLevel, nil
+	case "best":
+		return BestCompressionLevel, nil
+	}
+	level, err := strconv.Atoi(strings.TrimSpace(levelString))
+	switch {
+	case err != nil || level < -1:
+		return DefaultCompressionLevel, fmt.Errorf("compression level %s not recognized (fastest, default, best or the level of the codec)", levelString)
+	case level == 0:
+		// the gzip levels compression_level used to take
+		return NoCompressionLevel, nil
+	case level == -1:
+		return DefaultCompressionLevel, nil
+	}
+	return CompressionLevel(level), nil
+}
+
+func (level CompressionLevel) String() string {
+	switch level {
+	case FastestCompressionLevel:
+		return "fastest"
+	case DefaultCompressionLevel:
+		return "default"
+	case BestCompressionLevel:
+		return "best"
+	case NoCompressionLevel:
+		return "0"
+	default:
+		return strconv.Itoa(int(level))
+	}
+}
+
+// validateFor checks that a numbered level is one of those of codec.
+func (level CompressionLevel) validateFor(codec string) error {
+	levels := compressionLevelRanges[codec]
+	if level > 0 && (int(level) < levels[0] || int(level) > levels[1]) {
+		return fmt.Errorf("compression_level %d is not a level of %s (%d to %d, fastest, default or best)", level, codec, levels[0], levels[1])
+	}
+	return nil
+}
+
+// CompressionCodecs returns the codecs the output compresses with, which CompressionLevel
+// applies to.
+func (cfg Configuration) CompressionCodecs() []string {
+	var codecs []string
+	switch cfg.CompressionType {
+	case GZIPCOMPRESSION:
+		codecs = append(codecs, "gzip")
+	case LZ4COMPRESSION:
+		codecs = append(codecs, "lz4")
+	}
+	if cfg.CompressHTTPPayload && cfg.CompressionType != GZIPCOMPRESSION {
+		codecs = append(codecs, "gzip")
+	}
+	switch cfg.FrameCompression {
+	case GzipFrameCompression:
+		codecs = append(codecs, "gzip")
+	case ZstdFrameCompression:
+		codecs = append(codecs, "zstd")
+	}
+	return codecs
+}
+
+// Gzip returns the level as a level of gzip.
+func (level CompressionLevel) Gzip() int {
+	switch level {
+	case FastestCompressionLevel:
+		return gzip.BestSpeed
+	case DefaultCompressionLevel:
+		return gzip.DefaultCompression
+	case BestCompressionLevel:
+		return gzip.BestCompression
+	case NoCompressionLevel:
+		return gzip.NoCompression
+	default:
+		return int(level)
+	}
+}
+
+// LZ4 returns the level as a level of lz4, where 0 is its fast compressor and the others the
+// depth of the search of its high compression one.
+func (level CompressionLevel) LZ4() int {
+	switch level {
+	case FastestCompressionLevel, DefaultCompressionLevel, NoCompressionLevel:
+		return 0
+	case BestCompressionLevel:
+		return compressionLevelRanges["lz4"][1]
+	default:
+		return int(level)
+	}
+}
+
+// Zstd returns the level as a level of the zstd encoder.
+func (level CompressionLevel) Zstd() zstd.EncoderLevel {
+	switch level {
+	case FastestCompressionLevel, NoCompressionLevel:
+		return zstd.SpeedFastest
+	case DefaultCompressionLevel:
+		return zstd.SpeedDefault
+	case BestCompressionLevel:
+		return zstd.SpeedBestCompression
+	default:
+		return zstd.EncoderLevelFromZstd(int(level))
+	}
+}
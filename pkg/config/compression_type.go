@@ -36,23 +36,33 @@ func (cfg Configuration) FileExtensionForCompressionType() string {
 	case GZIPCOMPRESSION:
 		return ".gz"
 	default:
-		switch cfg.OutputFormat {
-		case LEEFOutputFormat:
-			return ".leef"
-		case JSONOutputFormat:
-			return ".json"
-		default:
-			return ".json"
-		}
+		return "." + cfg.OutputFormatName()
+	}
+}
+
+// OutputFormatName returns the output_format of the output, the name its formatter is
+// registered under.
+func (cfg Configuration) OutputFormatName() string {
+	switch cfg.OutputFormat {
+	case LEEFOutputFormat:
+		return "leef"
+	case MsgPackOutputFormat:
+		return "msgpack"
+	case CustomOutputFormat:
+		return cfg.CustomOutputFormatName
+	default:
+		return "json"
 	}
 }
 
 func (cfg Configuration) WrapWriterWithCompressionSettings(writer io.WriteCloser) (FlushableWriteCloser, error) {
 	switch cfg.CompressionType {
 	case LZ4COMPRESSION:
-		return lz4.NewWriter(writer), nil
+		lz4Writer := lz4.NewWriter(writer)
+		lz4Writer.Header.CompressionLevel = cfg.CompressionLevel.LZ4()
+		return lz4Writer, nil
 	case GZIPCOMPRESSION:
-		return gzip.NewWriterLevel(writer, cfg.CompressionLevel)
+		return gzip.NewWriterLevel(writer, cfg.CompressionLevel.Gzip())
 	default:
 		return NOPFlushWrappedWriter{WriteCloser: writer}, nil
 	}
@@ -7,6 +7,9 @@ import (
 	_ "expvar"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -17,6 +20,8 @@ import (
 	"time"
 
 	"github.com/Showmax/go-fqdn"
+	"github.com/carbonblack/cb-event-forwarder/pkg/jsonschema"
+	"github.com/carbonblack/cb-event-forwarder/pkg/transforms"
 	"github.com/go-ini/ini"
 	log "github.com/sirupsen/logrus"
 )
@@ -31,16 +36,33 @@ const (
 	HTTPOutputType
 	SplunkOutputType
 	KafkaOutputType
+	JournaldOutputType
+	WebSocketOutputType
+	LocalSyslogOutputType
+	BucketFileOutputType
+	LokiOutputType
+	SQLOutputType
+	SplunkHECOutputType
+	NATSOutputType
+	OTLPOutputType
 )
 
 const (
 	LEEFOutputFormat = iota
 	JSONOutputFormat
+	MsgPackOutputFormat
+	// a format added to the formatters registry by a custom build, named by CustomOutputFormatName
+	CustomOutputFormat
 )
 
 const DEFAULTEXITTIMEOUT = 15
 
+const DEFAULTOUTPUTBUFFERSIZE = 1000000
+
 type Configuration struct {
+	// file the configuration was read from, read again to reload the event type filters
+	ConfigFile string
+
 	ServerName           string
 	AMQPHostname         string
 	DebugFlag            bool
@@ -48,7 +70,7 @@ type Configuration struct {
 	OutputType           int
 	OutputFormat         int
 	AMQPUsername         string
-	AMQPPassword         string
+	AMQPPassword         string `diff:"secret"`
 	AMQPPort             int
 	AMQPTLSEnabled       bool
 	AMQPTLSClientKey     string
@@ -56,13 +78,18 @@ type Configuration struct {
 	AMQPTLSCACert        string
 	AMQPQueueName        string
 	AMQPAutomaticAcking  bool
-	OutputParameters     string
+	AMQPPrefetchCount    int
+	OutputParameters     string `diff:"secret"`
+	OutputName           string
 	EventTypes           []string
 	EventMap             map[string]bool
 	HTTPServerPort       int
 	CbServerURL          string
 	UseRawSensorExchange bool
 
+	// output_format of a CustomOutputFormat output
+	CustomOutputFormatName string
+
 	// DRY RUN CONTROLS REAL OUTPUT - WHEN DRYRUN IS TRUE, REAL OUTPUT WILL NOT OCCUR
 	DryRun bool
 	// CannedInput bool CONTROLS REAL INPUT - WHEN CANNEDINPUT IS TRUE, bundles from stress_rabbit will be used instead
@@ -80,6 +107,18 @@ type Configuration struct {
 	S3Endpoint              *string
 	S3UseDualStack          bool
 	S3Concurrency           int
+	S3UploadRetries         int
+	S3UploadRetryBackoff    time.Duration
+	S3MultipartThreshold    int64
+
+	// when set, objects are written under the key prefix rendered from each event, such as
+	// Hive-style partitions
+	S3KeyTemplate   *template.Template
+	S3PartitionMode S3PartitionMode
+
+	// (region):(bucket-name) targets of the olds3 output that every file is also uploaded to,
+	// besides the bucket in s3out
+	S3Replicas []string
 
 	// SSL/TLS-specific configuration
 	TLSClientKey  *string
@@ -89,12 +128,22 @@ type Configuration struct {
 	TLSCName      *string
 	TLS12Only     bool
 
+	TLSMinVersion   uint16
+	TLSCipherSuites []uint16
+	// number of TLS sessions kept for resumption across reconnects, 0 disables resumption
+	TLSSessionCacheSize int
+
+	// SHA-256 hashes of the public keys accepted from TLS servers, empty disables pinning
+	TLSPinnedSHA256 [][]byte
+	// accept pinned keys without validating the certificate chain
+	TLSPinOnly bool
+
 	// HTTP-specific configuration
-	HTTPAuthorizationToken *string
+	HTTPAuthorizationToken *string `diff:"secret"`
 	HTTPPostTemplate       *template.Template
 	HTTPContentType        *string
 	OAuthJwtClientEmail    string
-	OAuthJwtPrivateKey     []byte
+	OAuthJwtPrivateKey     []byte `diff:"secret"`
 	OAuthJwtPrivateKeyId   string
 	OAuthJwtScopes         []string
 	OAuthJwtTokenUrl       string
@@ -103,15 +152,23 @@ type Configuration struct {
 
 	CompressHTTPPayload bool
 
+	// pause uploads for as long as a 429 or 503 response's Retry-After asks, up to
+	// HTTPRetryAfterMax when set
+	HTTPHonorRetryAfter bool
+	HTTPRetryAfterMax   time.Duration
+
 	// configuration options common to bundled outputs (S3, HTTP)
 	UploadEmptyFiles    bool
 	CommaSeparateEvents bool
 	BundleSendTimeout   time.Duration
 	BundleSizeMax       int64
+	// how the http output puts together the events of a bundle; empty keeps the
+	// historical behaviour, comma separated for json and one per line otherwise
+	BatchEncoding BatchEncoding
 
 	// Compress data on S3 or file output types
 	FileHandlerCompressData bool
-	CompressionLevel        int
+	CompressionLevel        CompressionLevel
 	CompressionType         CompressionType
 
 	TLSConfig *tls.Config
@@ -121,22 +178,258 @@ type Configuration struct {
 	KafkaTopicSuffix    string
 	KafkaTopic          string
 	KafkaUsername       string
-	KafkaPassword       string
+	KafkaPassword       string `diff:"secret"`
 	KafkaMaxRequestSize int32
 
 	KafkaCompressionType *string
 
+	KafkaRequiredAcks    string
+	KafkaMaxRetries      int
+	KafkaDeadLetterTopic string
+
 	KafkaSSLKeyLocation *string
 
 	KafkaSSLCertificateLocation *string
 	KafkaSSLCALocation          *string
 
 	// Splunkd
-	SplunkToken *string
+	SplunkToken *string `diff:"secret"`
+
+	// TCP-specific configuration
+	TCPUseTLS             bool
+	MaxConnectionLifetime time.Duration
+	// close connections without writes for this long, reconnecting on the next event
+	IdleTimeout time.Duration
+	// the wait before reconnecting doubles after every failed connection attempt up to
+	// ReconnectBackoffMax; connections dropped before MinHealthyConnection count as failed
+	ReconnectBackoffMax  time.Duration
+	MinHealthyConnection time.Duration
+	// written before closing a healthy connection, executed on DisconnectFooterData
+	DisconnectFooter *template.Template
+	// half-close connections before closing them, waiting up to TCPHalfCloseTimeout for the
+	// collector to close its side
+	TCPHalfClose        bool
+	TCPHalfCloseTimeout time.Duration
+	// written before a healthy connection is replaced on purpose, such as by a rotation, waiting
+	// RotationNoticeGrace for the collector to finalize before closing it
+	RotationNotice      string
+	RotationNoticeGrace time.Duration
+	// authenticate with a pre-shared key, read from HandshakePSKFile on every connection and sent
+	// as HandshakeFormat; the collector answers HandshakeAck when it is set
+	HandshakePSKFile string
+	HandshakeFormat  string
+	HandshakeAck     string
+	HandshakeTimeout time.Duration
+	// disable Nagle's algorithm on tcp connections, sending small writes right away rather than
+	// coalescing them; true by default, as in Go
+	TCPNoDelay bool
+	// with use_tls, connect in plaintext and send StartTLSCommand, starting TLS once the collector
+	// answers with a line beginning with StartTLSReply
+	StartTLSCommand string
+	StartTLSReply   string
+	StartTLSTimeout time.Duration
+	// dial the collector through an SSH server, authenticating as SSHTunnelUser with a key file
+	// and/or the SSH agent, and verifying the server against SSHTunnelKnownHostsFile
+	SSHTunnelHost           string
+	SSHTunnelUser           string
+	SSHTunnelKeyFile        string
+	SSHTunnelUseAgent       bool
+	SSHTunnelKnownHostsFile string
+	// dial the collector through an HTTP proxy with CONNECT, authenticating with Basic auth when
+	// the URL holds a user name and password
+	HTTPProxyURL *url.URL `diff:"secret"`
+	// send HeartbeatPing every HeartbeatInterval, replacing the connection when the collector
+	// doesn't answer with HeartbeatPong within HeartbeatTimeout
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+	HeartbeatPing     string
+	HeartbeatPong     string
+	// writes that don't complete within BackpressureWriteTimeout are retried every
+	// BackpressurePause for up to BackpressureMaxDuration before OverflowPolicy applies
+	BackpressureWriteTimeout time.Duration
+	BackpressurePause        time.Duration
+	BackpressureMaxDuration  time.Duration
+	// events are written in batches of up to BatchMaxEvents events and BatchMaxBytes bytes,
+	// waiting up to BatchMaxWait for a batch to fill; zero limits are not applied
+	BatchMaxEvents int
+	BatchMaxBytes  int
+	BatchMaxWait   time.Duration
+	// the last ReplayOnReconnect events sent are sent again, marked as replays, after a lost
+	// connection is reopened
+	ReplayOnReconnect int
+	// with a FrameCompression other than none, each event is sent after a header giving its codec
+	// and length, compressed when it is larger than FrameCompressionThreshold bytes
+	FrameCompression          FrameCompression
+	FrameCompressionThreshold int
+	// TLS connections are replaced, negotiating new keys, once they have been open for
+	// TLSRekeyInterval or have sent TLSRekeyBytes; zero limits are not applied
+	TLSRekeyInterval time.Duration
+	TLSRekeyBytes    int64
+	// a connected tcp or udp output that sends fewer than MinEventsPerWindow events during a
+	// ThroughputWindow reports low throughput; disabled when zero
+	MinEventsPerWindow int64
+	ThroughputWindow   time.Duration
+
+	// Syslog-specific configuration
+	SyslogFacility        int
+	SyslogDefaultSeverity int
+	SyslogSeverityRules   []SyslogSeverityRule
+
+	// the syslog output writes RFC 5424 messages, sized for RFC 5426 over udp and framed as
+	// RFC 5425 over tcp, with these event fields as structured data
+	SyslogRFC5424              bool
+	SyslogStructuredDataID     string
+	SyslogStructuredDataFields []string
+	SyslogMaxMessageSize       int
+	// tag of the messages written by the localsyslog output
+	LocalSyslogTag string
+
+	// the time S3 object key templates and the bucketfile output file events under
+	TimeSource TimeSource
+
+	// UDP-specific configuration
+	UDPSendTimeout time.Duration
+
+	// tcpout and udpout destinations of the form srv:(name) are looked up again every
+	// SRVRefreshInterval; SRVResolver replaces the system resolver when set
+	SRVRefreshInterval time.Duration
+	SRVResolver        *net.Resolver
+
+	// journald-specific configuration
+	JournaldPriority    int
+	JournaldIdentifier  string
+	JournaldFieldPrefix string
+
+	// WebSocket-specific configuration
+	WebSocketOrigin         string
+	WebSocketSubprotocols   []string
+	WebSocketHeaders        http.Header `diff:"secret"`
+	WebSocketBinaryMessages bool
+	WebSocketPingInterval   time.Duration
+
+	// Loki-specific configuration
+	LokiLabels       []LokiLabel
+	LokiStaticLabels map[string]string
+	LokiHeaders      http.Header `diff:"secret"`
+	// events are pushed in batches of up to LokiBatchSize, at most LokiBatchWait after the first
+	LokiBatchSize  int
+	LokiBatchWait  time.Duration
+	LokiMaxRetries int
+	// when set, LokiRetryAfterMax bounds how long a Retry-After header can delay a retry
+	LokiRetryAfterMax time.Duration
+
+	// SQL-specific configuration
+	SQLDriver string
+	SQLTable  string
+	// fields inserted into columns of their own, the others going to SQLExtraColumn when it is set
+	SQLColumns            []SQLColumn
+	SQLExtraColumn        string
+	SQLBatchSize          int
+	SQLBatchWait          time.Duration
+	SQLMaxRetries         int
+	SQLMaxOpenConnections int
+
+	// Splunk HEC-specific configuration
+	SplunkHECToken      string `diff:"secret"`
+	SplunkHECSource     string
+	SplunkHECSourceType string
+	SplunkHECIndex      string
+	// field of the event that the host of its envelope is taken from
+	SplunkHECHostField string
+	// sourcetypes and indexes of the events of some types, instead of the ones above
+	SplunkHECSourceTypes []EventTypeValue
+	SplunkHECIndexes     []EventTypeValue
+	SplunkHECBatchSize   int
+	SplunkHECBatchWait   time.Duration
+	SplunkHECMaxRetries  int
+	// with indexer acknowledgement, batches are polled for every SplunkHECAckInterval on channel
+	// SplunkHECChannel, and sent again when not acknowledged within SplunkHECAckTimeout
+	SplunkHECAck         bool
+	SplunkHECChannel     string
+	SplunkHECAckInterval time.Duration
+	SplunkHECAckTimeout  time.Duration
+
+	// NATS-specific configuration
+	// events are published to the subject NATSSubject renders from their fields
+	NATSSubject  *template.Template
+	NATSUser     string
+	NATSPassword string `diff:"secret"`
+	NATSToken    string `diff:"secret"`
+	// with JetStream, up to NATSMaxPendingAcks events wait for the acknowledgement of a stream at a
+	// time, optionally NATSStream, and are published again when not acknowledged within
+	// NATSAckTimeout, up to NATSMaxRetries times
+	NATSJetStream      bool
+	NATSStream         string
+	NATSMaxPendingAcks int
+	NATSAckTimeout     time.Duration
+	NATSMaxRetries     int
+
+	// OTLP-specific configuration
+	// OTLPProtocol is OTLPGRPCProtocol or OTLPHTTPProtocol
+	OTLPProtocol           string
+	OTLPAttributes         []OTLPAttribute
+	OTLPResourceAttributes map[string]string
+	OTLPHeaders            http.Header `diff:"secret"`
+	// events are exported in batches of up to OTLPBatchSize, at most OTLPBatchWait after the first
+	OTLPBatchSize  int
+	OTLPBatchWait  time.Duration
+	OTLPMaxRetries int
+
+	// tcp and udp outputs refuse to connect to addresses outside of these ranges
+	DestinationAllowCIDRs []*net.IPNet
+
+	// tcp and udp outputs apply OversizePolicy to events larger than MaxMessageSize bytes
+	MaxMessageSize int
+	OversizePolicy OversizePolicy
 
 	RemoveFromOutput []string
 	AuditLog         bool
 	NumProcessors    int
+	// when false, deliveries go to the least busy processor instead of the processor of their
+	// sensor, and events from a sensor may be forwarded out of order
+	PreserveOrder bool
+
+	// optional script applied to every event before it is sent to the outputs
+	Transform *transforms.Program
+	// optional type conversions applied to event fields after the transform
+	Coercions *transforms.Coercions
+
+	// resolves fields written by more than one stage of a pipeline; events failed by the error
+	// policy, and those failing the schema of an output with the dead-letter schema failure
+	// policy, are appended to DeadLetterFile, when set, and dropped
+	ConflictPolicy transforms.ConflictPolicy
+	DeadLetterFile string
+
+	// when DebugTeeFile is set, a DebugTeeSampleRate fraction of the events is appended to it as
+	// received, along with the message each output was handed; the file is rotated once it
+	// grows over DebugTeeMaxBytes
+	DebugTeeFile       string
+	DebugTeeSampleRate float64
+	DebugTeeMaxBytes   int64
+
+	// events whose type doesn't match the allowlist, when set, or matches the denylist are
+	// dropped as soon as they are received
+	EventTypeAllowlist []string
+	EventTypeDenylist  []string
+	// caps on the events per second of some event types, applied after the event type filters;
+	// the first limit matching an event's type applies to it
+	EventTypeRateLimits []EventTypeRateLimit
+
+	// every event gets an ID that identifies it in the logs; when set, the ID is also added
+	// to the event under this field
+	CorrelationIDField string
+
+	// when set, forwarded events are numbered under this field, counting on from the value
+	// saved in SequenceStateFile across restarts
+	SequenceField     string
+	SequenceStateFile string
+
+	// forward, buffer or drop events depending on their type and the time of day
+	ScheduleRules      []ScheduleRule
+	ScheduleLocation   *time.Location
+	ScheduleBufferSize int
+	// the time schedule rules are checked against
+	ScheduleTimeSource TimeSource
 
 	UseTimeFloat bool
 	ExitTimeoutSeconds time.Duration
@@ -145,6 +438,78 @@ type Configuration struct {
 	RunMetrics            bool
 	CarbonMetricsEndpoint *string
 	MetricTag             string
+
+	// additional outputs receive a copy of every event sent to the main output
+	AdditionalOutputs []Configuration
+	OutputBufferSize  int
+	OverflowPolicy    OverflowPolicy
+
+	// bounds the total size of the formatted events held in the output buffer, 0 for no bound
+	OutputBufferMaxBytes int64
+	// buffered events received longer ago than this by the time the output can take them are
+	// dropped rather than sent, 0 to send them however old
+	EventMaxAge time.Duration
+
+	// hand events over to the output evenly spaced, at no more than this many per second; 0 to
+	// hand them over as fast as the output takes them
+	PaceEPS float64
+
+	// when set, buffered events are kept in this bbolt file until they are delivered, bounded by
+	// DiskQueueMaxEvents events and DiskQueueMaxBytes bytes of events (0 for no bound)
+	DiskQueuePath      string
+	DiskQueueMaxEvents int64
+	DiskQueueMaxBytes  int64
+
+	// collapse nested objects into top level keys before formatting events for the output
+	Flatten *FlattenOptions
+	// order of the transform, coerce and flatten stages for the output, DefaultPipeline when empty
+	Pipeline []PipelineStage
+	// send a minimal record of events that can't be formatted instead of dropping them
+	FormatFallback bool
+	// what to do with events formatted as an empty or blank message
+	EmptyOutputPolicy EmptyOutputPolicy
+	// what to do with invalid UTF-8 in the strings of events, before any stage of the pipeline
+	UTF8Policy UTF8Policy
+	// events formatted as lines longer than MaxLineBytes, 0 for no limit, are truncated or dropped
+	// according to LongLinePolicy
+	MaxLineBytes   int
+	LongLinePolicy LongLinePolicy
+	// events that don't match EventSchema, compiled from SchemaFile, at SchemaStage are dropped or
+	// sent to the dead letter file according to SchemaFailurePolicy
+	SchemaFile          string
+	EventSchema         *jsonschema.Schema
+	SchemaStage         SchemaStage
+	SchemaFailurePolicy SchemaFailurePolicy
+
+	// outputs that must initialize at startup, by section name ("bridge" for the main output);
+	// nil when every output is required. Other outputs are retried in the background.
+	// Required outputs failing at startup are retried for up to RequiredOutputTimeout, first after
+	// RequiredOutputBackoff and then backing off exponentially.
+	RequiredOutputs       map[string]bool
+	RequiredOutputTimeout time.Duration
+	RequiredOutputBackoff time.Duration
+
+	// caps the connections open at once to each collector address, shared by every output; 0 for
+	// no cap
+	MaxConnectionsPerHost int
+
+	// with manual acking, the AMQP prefetch is reduced once the fullest output buffer is more
+	// than BackpressureThreshold full. Zero disables it.
+	BackpressureThreshold float64
+
+	// outputs log the first ErrorLogBurst errors, then at most one every ErrorLogInterval
+	ErrorLogBurst    int
+	ErrorLogInterval time.Duration
+
+	// statsd
+	StatsdEndpoint      *string
+	StatsdPrefix        string
+	StatsdTags          []string
+	StatsdFlushInterval time.Duration
+
+	// periodic dump of the output statistics to a json file
+	StatsFile         *string
+	StatsFileInterval time.Duration
 }
 
 type ConfigurationError struct {
@@ -274,6 +639,8 @@ func ParseConfig(fn string) (Configuration, error) {
 		return config, err
 	}
 
+	config.ConfigFile = fn
+
 	// defaults
 	config.DebugFlag = false
 	config.OutputFormat = JSONOutputFormat
@@ -443,6 +810,30 @@ func ParseConfig(fn string) (Configuration, error) {
 		}
 	}
 
+	config.AMQPPrefetchCount = 1000
+
+	if input.Section("bridge").HasKey("rabbit_mq_prefetch_count") {
+		key := input.Section("bridge").Key("rabbit_mq_prefetch_count")
+		prefetch, err := key.Int()
+		if err == nil && prefetch > 0 {
+			config.AMQPPrefetchCount = prefetch
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid rabbit_mq_prefetch_count: %s", key.Value()))
+		}
+	}
+
+	config.BackpressureThreshold = 0.8
+
+	if input.Section("bridge").HasKey("backpressure_threshold") {
+		key := input.Section("bridge").Key("backpressure_threshold")
+		threshold, err := key.Float64()
+		if err == nil && threshold >= 0 && threshold < 1 {
+			config.BackpressureThreshold = threshold
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid backpressure_threshold: %s (should be between 0 and 1, 0 disables it)", key.Value()))
+		}
+	}
+
 	config.DryRun = false
 
 	if input.Section("bridge").HasKey("dry_run") {
@@ -510,386 +901,2061 @@ func ParseConfig(fn string) (Configuration, error) {
 		}
 	}
 
-	if input.Section("bridge").HasKey("output_format") {
-		key := input.Section("bridge").Key("output_format")
-		val := key.Value()
-		val = strings.TrimSpace(val)
-		val = strings.ToLower(val)
-		if val == "leef" {
-			config.OutputFormat = LEEFOutputFormat
-		}
-	}
-
-	config.FileHandlerCompressData = false
+	config.AuditLog = false
 
-	if input.Section("bridge").HasKey("compress_data") {
-		key := input.Section("bridge").Key("compress_data")
+	if input.Section("bridge").HasKey("audit_log") {
+		key := input.Section("bridge").Key("audit_log")
 		b, err := key.Bool()
 		if err == nil {
-			config.FileHandlerCompressData = b
+			config.AuditLog = b
 		}
 	}
 
-	if config.FileHandlerCompressData {
-		if input.Section("bridge").HasKey("compression_type") {
-			key := input.Section("bridge").Key("compression_type")
-			keyString := key.String()
-			config.CompressionType, err = CompressionTypeFromString(keyString)
+	if input.Section("bridge").HasKey("use_raw_sensor_exchange") {
+		key := input.Section("bridge").Key("use_raw_sensor_exchange")
+		boolval, err := key.Bool()
+		if err == nil {
+			config.UseRawSensorExchange = boolval
+			if boolval {
+				log.Warn("Configured to listen on the VMware Carbon Black EDR raw sensor event feed.")
+				log.Warn("- This will result in a *large* number of messages output via the event forwarder!")
+				log.Warn("- Ensure that raw sensor events are enabled in your EDR server (primary & minion) via")
+				log.Warn("  the 'EnableRawSensorDataBroadcast' variable in /etc/cb/cb.conf")
+			}
 		} else {
-			config.CompressionType = GZIPCOMPRESSION
+			errs.addErrorString("Unknown value for 'use_raw_sensor_exchange': valid values are true, false, 1, 0")
 		}
-	} else {
-		config.CompressionType = NOCOMPRESSION
 	}
 
-	config.CompressionLevel = 1
-
-	if input.Section("bridge").HasKey("compression_level") {
-		key := input.Section("bridge").Key("compression_level")
-		level, err := key.Int()
-		if err == nil {
-			config.CompressionLevel = level
+	config.NumProcessors = runtime.NumCPU()
+	if input.Section("bridge").HasKey("message_processor_count") {
+		key := input.Section("bridge").Key("message_processor_count")
+		if numprocessors, err := key.Int(); err == nil && numprocessors > 0 {
+			config.NumProcessors = int(numprocessors)
 		}
 	}
 
-	config.AuditLog = false
-
-	if input.Section("bridge").HasKey("audit_log") {
-		key := input.Section("bridge").Key("audit_log")
-		b, err := key.Bool()
-		if err == nil {
-			config.AuditLog = b
+	config.PreserveOrder = true
+	if input.Section("bridge").HasKey("preserve_order") {
+		key := input.Section("bridge").Key("preserve_order")
+		if boolval, err := key.Bool(); err == nil {
+			config.PreserveOrder = boolval
+		} else {
+			errs.addErrorString("Unknown value for 'preserve_order': valid values are true, false, 1, 0")
 		}
 	}
 
-	var parameterKey string
-
-	if !input.Section("bridge").HasKey("output_type") {
-		errs.addErrorString("No output type specified")
-		return config, errs
-	}
-
-	key := input.Section("bridge").Key("output_type")
-	outType := key.Value()
-	outType = strings.TrimSpace(outType)
-	outType = strings.ToLower(outType)
-
-	handleS3 := func() {
-		if input.Section("s3").HasKey("credential_profile") {
-			key := input.Section("s3").Key("credential_profile")
-			profileName := key.Value()
-			config.S3CredentialProfileName = &profileName
-		}
-
-		config.S3Concurrency = 2
-
-		if input.Section("s3").HasKey("concurrency") {
-			key := input.Section("s3").Key("concurrency")
-			concurrency, err := key.Int()
-			if err == nil && concurrency > 0 && concurrency < 100 {
-				config.S3Concurrency = concurrency
+	if input.Section("bridge").HasKey("transform") {
+		transformEnabled := true
+		if input.Section("bridge").HasKey("transform_enabled") {
+			key := input.Section("bridge").Key("transform_enabled")
+			if boolval, err := key.Bool(); err == nil {
+				transformEnabled = boolval
 			} else {
-				errs.addErrorString("Invalid setting for s3 concurrency -- should be an integer number")
+				errs.addErrorString("Unknown value for 'transform_enabled': valid values are true, false, 1, 0")
 			}
 		}
 
-		if input.Section("s3").HasKey("acl_policy") {
-			key := input.Section("s3").Key("acl_policy")
-			aclPolicy := key.Value()
-			config.S3ACLPolicy = &aclPolicy
-		}
-
-		if input.Section("s3").HasKey("server_side_encryption") {
-			key := input.Section("s3").Key("server_side_encryption")
-			sseType := key.Value()
-			config.S3ServerSideEncryption = &sseType
+		if transformEnabled {
+			program, err := transforms.Compile(input.Section("bridge").Key("transform").Value())
+			if err != nil {
+				errs.addErrorString(fmt.Sprintf("Invalid transform: %s", err))
+			} else {
+				config.Transform = program
+			}
 		}
+	}
 
-		if input.Section("s3").HasKey("object_prefix") {
-			key = input.Section("s3").Key("object_prefix")
-			objectPrefix := key.Value()
-			config.S3ObjectPrefix = &objectPrefix
+	if input.Section("bridge").HasKey("coerce_fields") {
+		policy := transforms.KeepUncoercible
+		if input.Section("bridge").HasKey("coerce_failure_policy") {
+			key := input.Section("bridge").Key("coerce_failure_policy")
+			var err error
+			if policy, err = transforms.CoercionFailurePolicyFromString(key.Value()); err != nil {
+				errs.addError(err)
+			}
 		}
 
-		// Optional S3 Endpoint configuration for s3 output to s3-compatible storage like Minio
-		if input.Section("s3").HasKey("s3_endpoint") {
-			key = input.Section("s3").Key("s3_endpoint")
-			s3Endpoint := key.Value()
-			config.S3Endpoint = &s3Endpoint
+		coercions, err := transforms.ParseCoercions(input.Section("bridge").Key("coerce_fields").Value(), policy)
+		if err != nil {
+			errs.addErrorString(fmt.Sprintf("Invalid coerce_fields: %s", err))
+		} else {
+			config.Coercions = coercions
 		}
+	}
 
-		if input.Section("s3").HasKey("use_dual_stack") {
-			key := input.Section("s3").Key("use_dual_stack")
-			b, err := key.Bool()
-			if err == nil {
-				config.S3UseDualStack = b
-			}
+	config.ConflictPolicy = transforms.LastWriteWins
+	if input.Section("bridge").HasKey("conflict_policy") {
+		policy, err := transforms.ConflictPolicyFromString(input.Section("bridge").Key("conflict_policy").Value())
+		if err != nil {
+			errs.addError(err)
+		} else {
+			config.ConflictPolicy = policy
 		}
 	}
 
-	switch outType {
-	case "file":
-		parameterKey = "outfile"
-		config.OutputType = FileOutputType
-	case "tcp":
-		parameterKey = "tcpout"
-		config.OutputType = TCPOutputType
-	case "udp":
-		parameterKey = "udpout"
-		config.OutputType = UDPOutputType
-	case "olds3":
-		config.OutputType = OLDS3OutputType
-		parameterKey = "s3out"
-		handleS3()
-	case "news3", "s3":
-		parameterKey = "s3out"
-		config.OutputType = S3OutputType
-		handleS3()
-	case "http":
-		parameterKey = "httpout"
-		config.OutputType = HTTPOutputType
+	if input.Section("bridge").HasKey("dead_letter_file") {
+		config.DeadLetterFile = strings.TrimSpace(input.Section("bridge").Key("dead_letter_file").Value())
+	}
 
-		if input.Section("http").HasKey("authorization_token") {
-			key := input.Section("http").Key("authorization_token")
-			token := key.Value()
-			config.HTTPAuthorizationToken = &token
-		}
+	if input.Section("bridge").HasKey("debug_tee_file") {
+		config.DebugTeeFile = strings.TrimSpace(input.Section("bridge").Key("debug_tee_file").Value())
+	}
 
-		config.HTTPPostTemplate = template.New("http_post_output")
-		if input.Section("http").HasKey("http_post_template") {
-			key := input.Section("http").Key("http_post_template")
-			postTemplate := key.Value()
-			config.HTTPPostTemplate = template.Must(config.HTTPPostTemplate.Parse(postTemplate))
+	config.DebugTeeSampleRate = 0.01
+	if input.Section("bridge").HasKey("debug_tee_sample_rate") {
+		key := input.Section("bridge").Key("debug_tee_sample_rate")
+		rate, err := key.Float64()
+		if err == nil && rate > 0 && rate <= 1 {
+			config.DebugTeeSampleRate = rate
 		} else {
-			if config.OutputFormat == JSONOutputFormat {
-				config.HTTPPostTemplate = template.Must(config.HTTPPostTemplate.Parse(
-					`{"filename": "{{.FileName}}", "service": "carbonblack", "alerts":[{{range .Events}}{{.EventText}}{{end}}]}`))
-			} else {
-				config.HTTPPostTemplate = template.Must(config.HTTPPostTemplate.Parse(`{{range .Events}}{{.EventText}}{{end}}`))
-			}
+			errs.addErrorString(fmt.Sprintf("Invalid debug_tee_sample_rate: %s (should be more than 0 and at most 1)", key.Value()))
 		}
+	}
 
-		if input.Section("http").HasKey("content_type") {
-			key := input.Section("http").Key("content_type")
-			contentType := key.Value()
-			config.HTTPContentType = &contentType
+	config.DebugTeeMaxBytes = 100 * 1024 * 1024
+	if input.Section("bridge").HasKey("debug_tee_max_mb") {
+		key := input.Section("bridge").Key("debug_tee_max_mb")
+		size, err := key.Int64()
+		if err == nil && size > 0 {
+			config.DebugTeeMaxBytes = size * 1024 * 1024
 		} else {
-			jsonString := "application/json"
-			config.HTTPContentType = &jsonString
+			errs.addErrorString(fmt.Sprintf("Invalid debug_tee_max_mb: %s", key.Value()))
 		}
+	}
 
-		// Parse OAuth related configuration.
-		config.ParseOAuthConfiguration(input, &errs)
-
-		if input.Section("http").HasKey("event_text_as_json_byte_array") {
-			key := input.Section("http").Key("event_text_as_json_byte_array")
-			boolval, err := key.Bool()
-			if err == nil {
-				config.EventTextAsJsonByteArray = boolval
-			} else {
-				errs.addErrorString(fmt.Sprintf("Invalid event_text_as_json_byte_array: %s", key.Value()))
-			}
-		}
+	if input.Section("bridge").HasKey("correlation_id_field") {
+		key := input.Section("bridge").Key("correlation_id_field")
+		config.CorrelationIDField = strings.TrimSpace(key.Value())
+	}
 
-		config.CompressHTTPPayload = false
+	if input.Section("bridge").HasKey("sequence_field") {
+		key := input.Section("bridge").Key("sequence_field")
+		config.SequenceField = strings.TrimSpace(key.Value())
+	}
 
-		if input.Section("http").HasKey("compress_http_payload") {
-			key := input.Section("http").Key("compress_http_payload")
-			boolval, err := key.Bool()
-			if err == nil {
-				config.CompressHTTPPayload = boolval
-			} else {
-				errs.addErrorString(fmt.Sprintf("Invalid compress_http_payload: %s", key.Value()))
-			}
+	config.SequenceStateFile = "/var/cb/data/event-forwarder-sequence"
+	if input.Section("bridge").HasKey("sequence_state_file") {
+		key := input.Section("bridge").Key("sequence_state_file")
+		config.SequenceStateFile = strings.TrimSpace(key.Value())
+		if len(config.SequenceStateFile) == 0 {
+			errs.addErrorString("sequence_state_file cannot be empty")
 		}
+	}
+	if len(config.SequenceField) > 0 && config.SequenceField == config.CorrelationIDField {
+		errs.addErrorString("sequence_field and correlation_id_field must be different fields")
+	}
 
-	case "syslog":
-		parameterKey = "syslogout"
-		config.OutputType = SyslogOutputType
-	case "kafka":
-		config.OutputType = KafkaOutputType
-
-		if input.Section("kafka").HasKey("brokers") {
-			key := input.Section("kafka").Key("brokers")
-			kafkaBrokers := key.Value()
-			config.KafkaBrokers = &kafkaBrokers
+	if input.Section("bridge").HasKey("event_type_allowlist") {
+		key := input.Section("bridge").Key("event_type_allowlist")
+		patterns, err := ParseEventTypePatterns(key.Value())
+		if err == nil {
+			config.EventTypeAllowlist = patterns
+		} else {
+			errs.addError(err)
 		}
+	}
 
-		if input.Section("kafka").HasKey("topic_suffix") {
-			key := input.Section("kafka").Key("topic_suffix")
-			kafkaTopicSuffix := key.Value()
-			config.KafkaTopicSuffix = kafkaTopicSuffix
+	if input.Section("bridge").HasKey("event_type_denylist") {
+		key := input.Section("bridge").Key("event_type_denylist")
+		patterns, err := ParseEventTypePatterns(key.Value())
+		if err == nil {
+			config.EventTypeDenylist = patterns
+		} else {
+			errs.addError(err)
 		}
+	}
 
-		if input.Section("kafka").HasKey("topic") {
-			key := input.Section("kafka").Key("topic")
-			kafkaTopic := key.Value()
-			config.KafkaTopic = kafkaTopic
+	if input.Section("bridge").HasKey("event_type_rate_limits") {
+		key := input.Section("bridge").Key("event_type_rate_limits")
+		limits, err := ParseEventTypeRateLimits(key.Value())
+		if err == nil {
+			config.EventTypeRateLimits = limits
+		} else {
+			errs.addError(err)
 		}
+	}
 
-		if input.Section("kafka").HasKey("username") {
-			key := input.Section("kafka").Key("username")
-			kafkaUsername := key.Value()
-			config.KafkaUsername = kafkaUsername
+	if input.Section("bridge").HasKey("schedule_rules") {
+		key := input.Section("bridge").Key("schedule_rules")
+		rules, err := ParseScheduleRules(key.Value())
+		if err == nil {
+			config.ScheduleRules = rules
+		} else {
+			errs.addError(err)
 		}
+	}
 
-		if input.Section("kafka").HasKey("password") {
-			key := input.Section("kafka").Key("password")
-			kafkaPassword := key.Value()
-			config.KafkaPassword = kafkaPassword
+	config.ScheduleLocation = time.Local
+	if input.Section("bridge").HasKey("schedule_timezone") {
+		key := input.Section("bridge").Key("schedule_timezone")
+		location, err := time.LoadLocation(strings.TrimSpace(key.Value()))
+		if err == nil {
+			config.ScheduleLocation = location
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid schedule_timezone: %s", err))
 		}
+	}
 
-		if input.Section("kafka").HasKey("max_request_size") {
-			key := input.Section("kafka").Key("max_request_size")
-			if intKafkaMaxRequestSize, err := key.Int(); err == nil {
-				config.KafkaMaxRequestSize = int32(intKafkaMaxRequestSize)
-			}
+	// default to holding up to 100000 events outside of their forwarding window
+	config.ScheduleBufferSize = 100000
+	if input.Section("bridge").HasKey("schedule_buffer_size") {
+		key := input.Section("bridge").Key("schedule_buffer_size")
+		bufferSize, err := key.Int()
+		if err == nil && bufferSize >= 0 {
+			config.ScheduleBufferSize = bufferSize
 		} else {
-			config.KafkaMaxRequestSize = 1000000 // sane default from issue 959 on sarama github
+			errs.addErrorString(fmt.Sprintf("Invalid schedule_buffer_size: %s", key.Value()))
 		}
+	}
 
-		if input.Section("kafka").HasKey("compression_type") {
-			key := input.Section("kafka").Key("compression_type")
-			compressionType := key.Value()
-			config.KafkaCompressionType = &compressionType
+	// schedule rules were always checked against when events are handled
+	config.ScheduleTimeSource = IngestTimeSource
+	if input.Section("bridge").HasKey("schedule_time_source") {
+		key := input.Section("bridge").Key("schedule_time_source")
+		source, err := TimeSourceFromString(key.Value())
+		if err == nil {
+			config.ScheduleTimeSource = source
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid schedule_time_source: %s", err))
 		}
+	}
 
-		if input.Section("kafka").HasKey("ssl_ca_location") {
-			key := input.Section("kafka").Key("ssl_ca_location")
-			SSLCALocation := key.Value()
-			config.KafkaSSLCALocation = &SSLCALocation
+	if input.Section("bridge").HasKey("run_metrics") {
+		key := input.Section("bridge").Key("run_metrics")
+		if runMetrics, err := key.Bool(); err == nil {
+			config.RunMetrics = runMetrics
+		} else {
+			config.RunMetrics = false
 		}
+	} else {
+		config.RunMetrics = false
+	}
 
-		if input.Section("kafka").HasKey("ssl_cert_location") {
-			key := input.Section("kafka").Key("ssl_cert_location")
-			SSLCertLocation := key.Value()
-			config.KafkaSSLCertificateLocation = &SSLCertLocation
-		}
+	if input.Section("bridge").HasKey("carbon_metrics_endpoint") {
+		key := input.Section("bridge").Key("carbon_metrics_endpoint")
+		metricsEndpoint := key.Value()
+		config.CarbonMetricsEndpoint = &metricsEndpoint
+	} else {
+		config.CarbonMetricsEndpoint = nil
+	}
 
-		if input.Section("kafka").HasKey("ssl_key_location") {
-			key := input.Section("kafka").Key("ssl_key_location")
-			SSLKeyLocation := key.Value()
-			config.KafkaSSLKeyLocation = &SSLKeyLocation
-		}
+	config.MetricTag = "cb.eventforwarder"
+	metricTagEnv := os.Getenv("EF_METRIC_TAG")
+	if metricTagEnv != "" {
+		config.MetricTag = metricTagEnv
+	}
 
-	case "splunk":
-		parameterKey = "splunkout"
-		config.OutputType = SplunkOutputType
+	if input.Section("bridge").HasKey("statsd_endpoint") {
+		key := input.Section("bridge").Key("statsd_endpoint")
+		statsdEndpoint := key.Value()
+		config.StatsdEndpoint = &statsdEndpoint
+	}
 
-		if input.Section("splunk").HasKey("hec_token") {
-			key := input.Section("splunk").Key("hec_token")
-			token := key.Value()
-			config.SplunkToken = &token
+	config.StatsdPrefix = config.MetricTag
+	if input.Section("bridge").HasKey("statsd_prefix") {
+		key := input.Section("bridge").Key("statsd_prefix")
+		config.StatsdPrefix = strings.TrimSpace(key.Value())
+	}
+
+	if input.Section("bridge").HasKey("statsd_tags") {
+		key := input.Section("bridge").Key("statsd_tags")
+		for _, tag := range strings.Split(key.Value(), ",") {
+			tag = strings.TrimSpace(tag)
+			if len(tag) > 0 {
+				config.StatsdTags = append(config.StatsdTags, tag)
+			}
 		}
+	}
 
-		config.HTTPPostTemplate = template.New("http_post_output")
-		if input.Section("splunk").HasKey("http_post_template") {
-			key := input.Section("splunk").Key("http_post_template")
-			postTemplate := key.Value()
+	// default 10 second flush interval
+	config.StatsdFlushInterval = 10 * time.Second
+	if input.Section("bridge").HasKey("statsd_flush_interval") {
+		key := input.Section("bridge").Key("statsd_flush_interval")
+		flushInterval, err := key.Int64()
+		if err == nil && flushInterval > 0 {
+			config.StatsdFlushInterval = time.Duration(flushInterval) * time.Second
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid statsd_flush_interval: %s", key.Value()))
+		}
+	}
+
+	if input.Section("bridge").HasKey("stats_file") {
+		key := input.Section("bridge").Key("stats_file")
+		statsFile := key.Value()
+		config.StatsFile = &statsFile
+	}
+
+	// default 30 second write interval
+	config.StatsFileInterval = 30 * time.Second
+	if input.Section("bridge").HasKey("stats_file_interval") {
+		key := input.Section("bridge").Key("stats_file_interval")
+		interval, err := key.Int64()
+		if err == nil && interval > 0 {
+			config.StatsFileInterval = time.Duration(interval) * time.Second
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid stats_file_interval: %s", key.Value()))
+		}
+	}
+
+	if input.Section("bridge").HasKey("use_time_float") {
+		key := input.Section("bridge").Key("use_time_float")
+		usetimefloat, _ := key.Bool()
+		config.UseTimeFloat = usetimefloat
+	} else {
+		config.UseTimeFloat = false
+	}
+
+	config.parseEventTypes(input)
+
+	// every output starts from the general settings parsed so far
+	base := config
+
+	config.parseOutput(input, "", &errs)
+
+	// the outputs listed in additional_outputs come first, then those of the config_dir files
+	var outputNames []string
+	if input.Section("bridge").HasKey("additional_outputs") {
+		outputNames = strings.Split(input.Section("bridge").Key("additional_outputs").Value(), ",")
+	}
+	if dir := configDirPath(input, fn); len(dir) > 0 {
+		outputNames = append(outputNames, loadConfigDir(input, dir, &errs)...)
+	}
+
+	if len(outputNames) > 0 {
+		names := make(map[string]bool)
+		for _, name := range outputNames {
+			name = strings.TrimSpace(name)
+			if len(name) == 0 {
+				continue
+			}
+			if names[name] || name == "bridge" {
+				errs.addErrorString(fmt.Sprintf("Invalid additional output name: %s", name))
+				continue
+			}
+			names[name] = true
+			if _, err := input.GetSection(name); err != nil {
+				errs.addErrorString(fmt.Sprintf("Missing section [%s] for additional output %s", name, name))
+				continue
+			}
+
+			output := base
+			output.parseOutput(input, name, &errs)
+			config.AdditionalOutputs = append(config.AdditionalOutputs, output)
+		}
+	}
+
+	// a disk queue file is locked by the output using it
+	diskQueues := map[string]bool{config.DiskQueuePath: len(config.DiskQueuePath) > 0}
+	for _, output := range config.AdditionalOutputs {
+		if len(output.DiskQueuePath) == 0 {
+			continue
+		}
+		if diskQueues[output.DiskQueuePath] {
+			errs.addErrorString(fmt.Sprintf("disk_queue_path %s is used by more than one output", output.DiskQueuePath))
+		}
+		diskQueues[output.DiskQueuePath] = true
+	}
+
+	if len(config.DeadLetterFile) > 0 && !config.UsesDeadLetters() {
+		log.Warnf("dead_letter_file only receives events failed by the error conflict_policy or by a schema_file with schema_failure_policy=dead-letter, and neither is configured")
+	}
+
+	if input.Section("bridge").HasKey("required_outputs") {
+		key := input.Section("bridge").Key("required_outputs")
+		config.RequiredOutputs = make(map[string]bool)
+		for _, name := range strings.Split(key.Value(), ",") {
+			name = strings.TrimSpace(name)
+			if len(name) == 0 {
+				continue
+			}
+			if !config.hasOutput(name) {
+				errs.addErrorString(fmt.Sprintf("Unknown output in required_outputs: %s (use bridge for the main output)", name))
+				continue
+			}
+			config.RequiredOutputs[name] = true
+		}
+	}
+
+	if input.Section("bridge").HasKey("required_output_timeout") {
+		key := input.Section("bridge").Key("required_output_timeout")
+		timeout, err := key.Int64()
+		if err == nil && timeout >= 0 {
+			config.RequiredOutputTimeout = time.Duration(timeout) * time.Second
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid required_output_timeout: %s", key.Value()))
+		}
+	}
+
+	config.RequiredOutputBackoff = time.Second
+	if input.Section("bridge").HasKey("required_output_backoff") {
+		key := input.Section("bridge").Key("required_output_backoff")
+		backoff, err := key.Int64()
+		if err == nil && backoff > 0 {
+			config.RequiredOutputBackoff = time.Duration(backoff) * time.Second
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid required_output_backoff: %s", key.Value()))
+		}
+	}
+
+	if input.Section("bridge").HasKey("max_connections_per_host") {
+		key := input.Section("bridge").Key("max_connections_per_host")
+		limit, err := key.Int()
+		if err == nil && limit >= 0 {
+			config.MaxConnectionsPerHost = limit
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid max_connections_per_host: %s", key.Value()))
+		}
+	}
+
+	if !errs.Empty {
+		return config, errs
+	}
+	return config, nil
+
+}
+
+// validJournalFieldPrefix reports whether prefix can start a journal field name. An empty prefix
+// is valid, event keys that can't start a field name are then prefixed with "F_".
+func validJournalFieldPrefix(prefix string) bool {
+	for i, c := range prefix {
+		switch {
+		case c >= 'A' && c <= 'Z':
+		case (c >= '0' && c <= '9' || c == '_') && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// UsesDeadLetters reports whether any event can be sent to the dead letter file: with the error
+// conflict policy, or an output validating events with the dead-letter schema failure policy.
+func (config *Configuration) UsesDeadLetters() bool {
+	if config.ConflictPolicy == transforms.FailOnConflict {
+		return true
+	}
+	if config.EventSchema != nil && config.SchemaFailurePolicy == DeadLetterSchemaFailures {
+		return true
+	}
+	for _, output := range config.AdditionalOutputs {
+		if output.EventSchema != nil && output.SchemaFailurePolicy == DeadLetterSchemaFailures {
+			return true
+		}
+	}
+	return false
+}
+
+func (config *Configuration) hasOutput(name string) bool {
+	if name == "bridge" {
+		return true
+	}
+	for _, output := range config.AdditionalOutputs {
+		if output.OutputName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRequiredOutput reports whether output, the main output or one of its additional outputs,
+// has to initialize for the forwarder to start.
+func (config *Configuration) IsRequiredOutput(output *Configuration) bool {
+	if config.RequiredOutputs == nil {
+		return true
+	}
+	name := output.OutputName
+	if name == "" {
+		name = "bridge"
+	}
+	return config.RequiredOutputs[name]
+}
+
+// parseOutput reads the settings of a single output. The main output (name is empty) is
+// configured through the [bridge] section and the per-type sections ([s3], [http], ...), while
+// each named output listed in additional_outputs keeps all of its settings in its own section.
+func (config *Configuration) parseOutput(input *ini.File, name string, errs *ConfigurationError) {
+	outputSection := input.Section("bridge")
+	typeSection := func(typeName string) *ini.Section {
+		return input.Section(typeName)
+	}
+	if name != "" {
+		outputSection = input.Section(name)
+		typeSection = func(string) *ini.Section {
+			return outputSection
+		}
+	}
+
+	config.OutputName = name
+
+	var err error
+
+	if outputSection.HasKey("output_format") {
+		key := outputSection.Key("output_format")
+		val := key.Value()
+		val = strings.TrimSpace(val)
+		val = strings.ToLower(val)
+		switch val {
+		case "json", "":
+			config.OutputFormat = JSONOutputFormat
+		case "leef":
+			config.OutputFormat = LEEFOutputFormat
+		case "msgpack":
+			config.OutputFormat = MsgPackOutputFormat
+		default:
+			// checked against the registered formats when the output's formatter is created
+			config.OutputFormat = CustomOutputFormat
+			config.CustomOutputFormatName = val
+		}
+	}
+
+	config.FileHandlerCompressData = false
+
+	if outputSection.HasKey("compress_data") {
+		key := outputSection.Key("compress_data")
+		b, err := key.Bool()
+		if err == nil {
+			config.FileHandlerCompressData = b
+		}
+	}
+
+	if config.FileHandlerCompressData {
+		if outputSection.HasKey("compression_type") {
+			key := outputSection.Key("compression_type")
+			keyString := key.String()
+			config.CompressionType, err = CompressionTypeFromString(keyString)
+			if err != nil {
+				errs.addError(err)
+			}
+		} else {
+			config.CompressionType = GZIPCOMPRESSION
+		}
+	} else {
+		config.CompressionType = NOCOMPRESSION
+	}
+
+	config.CompressionLevel = DefaultCompressionLevel
+
+	if outputSection.HasKey("compression_level") {
+		key := outputSection.Key("compression_level")
+		level, err := CompressionLevelFromString(key.Value())
+		if err == nil {
+			config.CompressionLevel = level
+			switch level {
+			case NoCompressionLevel:
+				log.Warnf("compression_level=0 is deprecated: gzip stores the data without compressing it, other codecs use their fastest level")
+			case DefaultCompressionLevel:
+				if strings.TrimSpace(key.Value()) == "-1" {
+					log.Warnf("compression_level=-1 is deprecated, use compression_level=default")
+				}
+			}
+		} else {
+			errs.addError(err)
+		}
+	}
+
+	var parameterKey string
+
+	if !outputSection.HasKey("output_type") {
+		errs.addErrorString("No output type specified")
+		return
+	}
+
+	key := outputSection.Key("output_type")
+	outType := key.Value()
+	outType = strings.TrimSpace(outType)
+	outType = strings.ToLower(outType)
+
+	handleS3 := func() {
+		if typeSection("s3").HasKey("credential_profile") {
+			key := typeSection("s3").Key("credential_profile")
+			profileName := key.Value()
+			config.S3CredentialProfileName = &profileName
+		}
+
+		config.S3Concurrency = 2
+
+		if typeSection("s3").HasKey("concurrency") {
+			key := typeSection("s3").Key("concurrency")
+			concurrency, err := key.Int()
+			if err == nil && concurrency > 0 && concurrency < 100 {
+				config.S3Concurrency = concurrency
+			} else {
+				errs.addErrorString("Invalid setting for s3 concurrency -- should be an integer number")
+			}
+		}
+
+		if typeSection("s3").HasKey("acl_policy") {
+			key := typeSection("s3").Key("acl_policy")
+			aclPolicy := key.Value()
+			config.S3ACLPolicy = &aclPolicy
+		}
+
+		if typeSection("s3").HasKey("server_side_encryption") {
+			key := typeSection("s3").Key("server_side_encryption")
+			sseType := key.Value()
+			config.S3ServerSideEncryption = &sseType
+		}
+
+		if typeSection("s3").HasKey("object_prefix") {
+			key = typeSection("s3").Key("object_prefix")
+			objectPrefix := key.Value()
+			config.S3ObjectPrefix = &objectPrefix
+		}
+
+		// Optional S3 Endpoint configuration for s3 output to s3-compatible storage like Minio
+		if typeSection("s3").HasKey("s3_endpoint") {
+			key = typeSection("s3").Key("s3_endpoint")
+			s3Endpoint := key.Value()
+			config.S3Endpoint = &s3Endpoint
+		}
+
+		if typeSection("s3").HasKey("use_dual_stack") {
+			key := typeSection("s3").Key("use_dual_stack")
+			b, err := key.Bool()
+			if err == nil {
+				config.S3UseDualStack = b
+			}
+		}
+
+		config.S3UploadRetries = 3
+		if typeSection("s3").HasKey("upload_retries") {
+			key := typeSection("s3").Key("upload_retries")
+			retries, err := key.Int()
+			if err == nil && retries >= 0 {
+				config.S3UploadRetries = retries
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid upload_retries: %s", key.Value()))
+			}
+		}
+
+		// default 1 second before the first retry, doubling on every attempt
+		config.S3UploadRetryBackoff = time.Second
+		if typeSection("s3").HasKey("upload_retry_backoff_ms") {
+			key := typeSection("s3").Key("upload_retry_backoff_ms")
+			backoff, err := key.Int64()
+			if err == nil && backoff > 0 {
+				config.S3UploadRetryBackoff = time.Duration(backoff) * time.Millisecond
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid upload_retry_backoff_ms: %s", key.Value()))
+			}
+		}
+
+		// files of 64MB or more are uploaded in parts
+		config.S3MultipartThreshold = 64 * 1024 * 1024
+		if typeSection("s3").HasKey("multipart_threshold_mb") {
+			key := typeSection("s3").Key("multipart_threshold_mb")
+			threshold, err := key.Int64()
+			if err == nil && threshold >= 5 {
+				config.S3MultipartThreshold = threshold * 1024 * 1024
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid multipart_threshold_mb: %s (the minimum is 5)", key.Value()))
+			}
+		}
+
+		if typeSection("s3").HasKey("object_key_template") {
+			key := typeSection("s3").Key("object_key_template")
+			tmpl, err := ParseS3KeyTemplate(key.Value())
+			switch {
+			case err != nil:
+				errs.addErrorString(fmt.Sprintf("Invalid object_key_template: %s", err))
+			case outType == "olds3":
+				errs.addErrorString("object_key_template is not supported by olds3 outputs")
+			case config.OutputFormat != JSONOutputFormat:
+				// the template is rendered from the fields of the formatted event
+				errs.addErrorString("object_key_template requires output_format=json")
+			default:
+				config.S3KeyTemplate = tmpl
+			}
+		}
+
+		config.S3PartitionMode = BufferPerPartition
+		if typeSection("s3").HasKey("partition_mode") {
+			key := typeSection("s3").Key("partition_mode")
+			mode, err := S3PartitionModeFromString(key.Value())
+			if err == nil {
+				config.S3PartitionMode = mode
+			} else {
+				errs.addError(err)
+			}
+		}
+
+		if typeSection("s3").HasKey("replicas") {
+			key := typeSection("s3").Key("replicas")
+			replicas, err := ParseS3Replicas(key.Value())
+			switch {
+			case err != nil:
+				errs.addErrorString(fmt.Sprintf("Invalid replicas: %s", err))
+			case outType != "olds3":
+				errs.addErrorString("replicas is only supported by olds3 outputs")
+			default:
+				config.S3Replicas = replicas
+			}
+		}
+	}
+
+	if typeSection(outType).HasKey("batch_encoding") {
+		key := typeSection(outType).Key("batch_encoding")
+		encoding, err := BatchEncodingFromString(key.Value())
+		switch {
+		case err != nil:
+			errs.addError(err)
+		case outType != "http" && !(encoding == NDJSONBatch && (outType == "s3" || outType == "news3")):
+			// s3 bundles are always uploaded one event per line
+			errs.addErrorString(fmt.Sprintf("batch_encoding=%s is not supported by %s outputs", encoding, outType))
+		case encoding == JSONArrayBatch && config.OutputFormat != JSONOutputFormat:
+			errs.addErrorString("batch_encoding=json-array requires output_format=json")
+		default:
+			config.BatchEncoding = encoding
+		}
+	}
+
+	// msgpack events are binary and framed by their length, which only byte streams carry as-is
+	if config.OutputFormat == MsgPackOutputFormat && outType != "file" && outType != "bucketfile" && outType != "tcp" && outType != "udp" {
+		errs.addErrorString(fmt.Sprintf("output_format=msgpack is not supported by %s outputs", outType))
+	}
+
+	switch outType {
+	case "file":
+		parameterKey = "outfile"
+		config.OutputType = FileOutputType
+	case "bucketfile":
+		parameterKey = "bucketdir"
+		config.OutputType = BucketFileOutputType
+
+		// bucket_time is the name time_source had in this section
+		if typeSection("bucketfile").HasKey("bucket_time") && !typeSection("bucketfile").HasKey("time_source") {
+			key := typeSection("bucketfile").Key("bucket_time")
+			source, err := TimeSourceFromString(key.Value())
+			if err == nil {
+				config.TimeSource = source
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid bucket_time: %s (event or received)", key.Value()))
+			}
+		}
+	case "tcp":
+		parameterKey = "tcpout"
+		config.OutputType = TCPOutputType
+	case "udp":
+		parameterKey = "udpout"
+		config.OutputType = UDPOutputType
+	case "olds3":
+		config.OutputType = OLDS3OutputType
+		parameterKey = "s3out"
+		handleS3()
+	case "news3", "s3":
+		parameterKey = "s3out"
+		config.OutputType = S3OutputType
+		handleS3()
+	case "http":
+		parameterKey = "httpout"
+		config.OutputType = HTTPOutputType
+
+		if typeSection("http").HasKey("authorization_token") {
+			key := typeSection("http").Key("authorization_token")
+			token := key.Value()
+			config.HTTPAuthorizationToken = &token
+		}
+
+		config.HTTPPostTemplate = template.New("http_post_output")
+		if typeSection("http").HasKey("http_post_template") {
+			key := typeSection("http").Key("http_post_template")
+			postTemplate := key.Value()
 			config.HTTPPostTemplate = template.Must(config.HTTPPostTemplate.Parse(postTemplate))
 		} else {
-			if config.OutputFormat == JSONOutputFormat {
+			if config.BatchEncoding == JSONArrayBatch {
+				config.HTTPPostTemplate = template.Must(config.HTTPPostTemplate.Parse(`[{{range .Events}}{{.EventText}}{{end}}]`))
+			} else if config.OutputFormat == JSONOutputFormat && config.BatchEncoding != NDJSONBatch {
 				config.HTTPPostTemplate = template.Must(config.HTTPPostTemplate.Parse(
-					`{{range .Events}}{"sourcetype":"bit9:carbonblack:json","event":{{.EventText}}}{{end}}`))
+					`{"filename": "{{.FileName}}", "service": "carbonblack", "alerts":[{{range .Events}}{{.EventText}}{{end}}]}`))
 			} else {
 				config.HTTPPostTemplate = template.Must(config.HTTPPostTemplate.Parse(`{{range .Events}}{{.EventText}}{{end}}`))
 			}
 		}
 
-		if input.Section("http").HasKey("content_type") {
-			key := input.Section("http").Key("content_type")
-			contentType := key.Value()
-			config.HTTPContentType = &contentType
+		if typeSection("http").HasKey("content_type") {
+			key := typeSection("http").Key("content_type")
+			contentType := key.Value()
+			config.HTTPContentType = &contentType
+		} else if config.BatchEncoding == NDJSONBatch {
+			ndjsonString := ndjsonContentType
+			config.HTTPContentType = &ndjsonString
+		} else {
+			jsonString := "application/json"
+			config.HTTPContentType = &jsonString
+		}
+
+		// Parse OAuth related configuration.
+		config.parseOAuthConfiguration(typeSection("http"), errs)
+
+		if typeSection("http").HasKey("event_text_as_json_byte_array") {
+			key := typeSection("http").Key("event_text_as_json_byte_array")
+			boolval, err := key.Bool()
+			if err == nil {
+				config.EventTextAsJsonByteArray = boolval
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid event_text_as_json_byte_array: %s", key.Value()))
+			}
+		}
+
+		config.CompressHTTPPayload = false
+
+		if typeSection("http").HasKey("compress_http_payload") {
+			key := typeSection("http").Key("compress_http_payload")
+			boolval, err := key.Bool()
+			if err == nil {
+				config.CompressHTTPPayload = boolval
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid compress_http_payload: %s", key.Value()))
+			}
+		}
+
+		config.HTTPHonorRetryAfter = true
+		if typeSection("http").HasKey("honor_retry_after") {
+			key := typeSection("http").Key("honor_retry_after")
+			boolval, err := key.Bool()
+			if err == nil {
+				config.HTTPHonorRetryAfter = boolval
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid honor_retry_after: %s", key.Value()))
+			}
+		}
+
+		if typeSection("http").HasKey("retry_after_max") {
+			key := typeSection("http").Key("retry_after_max")
+			seconds, err := key.Int64()
+			if err == nil && seconds >= 0 {
+				config.HTTPRetryAfterMax = time.Duration(seconds) * time.Second
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid retry_after_max: %s", key.Value()))
+			}
+		}
+
+	case "syslog", "localsyslog":
+		if outType == "syslog" {
+			parameterKey = "syslogout"
+			config.OutputType = SyslogOutputType
+
+			// default to kern.info, the priority used before these options existed
+			config.SyslogFacility = 0
+
+			if typeSection(outType).HasKey("format") {
+				key := typeSection(outType).Key("format")
+				switch strings.ToLower(strings.TrimSpace(key.Value())) {
+				case "legacy":
+					config.SyslogRFC5424 = false
+				case "rfc5424":
+					config.SyslogRFC5424 = true
+				default:
+					errs.addErrorString(fmt.Sprintf("Invalid syslog format: %s (legacy or rfc5424)", key.Value()))
+				}
+			}
+
+			config.SyslogStructuredDataID = DefaultSyslogStructuredDataID
+			if typeSection(outType).HasKey("structured_data_id") {
+				key := typeSection(outType).Key("structured_data_id")
+				if id := strings.TrimSpace(key.Value()); ValidSyslogSDName(id) {
+					config.SyslogStructuredDataID = id
+				} else {
+					errs.addErrorString(fmt.Sprintf("Invalid structured_data_id: %s", key.Value()))
+				}
+			}
+
+			if typeSection(outType).HasKey("structured_data_fields") {
+				key := typeSection(outType).Key("structured_data_fields")
+				fields, err := ParseSyslogStructuredDataFields(key.Value())
+				if err == nil {
+					config.SyslogStructuredDataFields = fields
+				} else {
+					errs.addError(err)
+				}
+			}
+
+			config.SyslogMaxMessageSize = DefaultSyslogMaxMessageSize
+			if typeSection(outType).HasKey("max_message_size") {
+				key := typeSection(outType).Key("max_message_size")
+				size, err := key.Int()
+				if err == nil && size >= MinSyslogMaxMessageSize && size <= DefaultSyslogMaxMessageSize {
+					config.SyslogMaxMessageSize = size
+				} else {
+					errs.addErrorString(fmt.Sprintf("Invalid max_message_size: %s (%d to %d)", key.Value(), MinSyslogMaxMessageSize, DefaultSyslogMaxMessageSize))
+				}
+			}
+		} else {
+			config.OutputType = LocalSyslogOutputType
+
+			// kern is reserved for the kernel, local daemons rewrite it to user anyway
+			config.SyslogFacility = 1
+			config.LocalSyslogTag = "cb-event-forwarder"
+			if typeSection(outType).HasKey("tag") {
+				config.LocalSyslogTag = strings.TrimSpace(typeSection(outType).Key("tag").Value())
+			}
+		}
+		config.SyslogDefaultSeverity = 6
+
+		if typeSection(outType).HasKey("facility") {
+			key := typeSection(outType).Key("facility")
+			facility, err := ParseSyslogFacility(strings.TrimSpace(key.Value()))
+			if err == nil {
+				config.SyslogFacility = facility
+			} else {
+				errs.addError(err)
+			}
+		}
+
+		if typeSection(outType).HasKey("default_severity") {
+			key := typeSection(outType).Key("default_severity")
+			severity, err := ParseSyslogSeverity(strings.TrimSpace(key.Value()))
+			if err == nil {
+				config.SyslogDefaultSeverity = severity
+			} else {
+				errs.addError(err)
+			}
+		}
+
+		if typeSection(outType).HasKey("severity_rules") {
+			key := typeSection(outType).Key("severity_rules")
+			rules, err := ParseSyslogSeverityRules(key.Value())
+			if err == nil {
+				config.SyslogSeverityRules = rules
+			} else {
+				errs.addError(err)
+			}
+			// rules are matched against the type and score fields of the formatted event
+			if config.OutputFormat != JSONOutputFormat {
+				errs.addErrorString("severity_rules requires output_format=json")
+			}
+		}
+	case "kafka":
+		config.OutputType = KafkaOutputType
+
+		if typeSection("kafka").HasKey("brokers") {
+			key := typeSection("kafka").Key("brokers")
+			kafkaBrokers := key.Value()
+			config.KafkaBrokers = &kafkaBrokers
+		}
+
+		if typeSection("kafka").HasKey("topic_suffix") {
+			key := typeSection("kafka").Key("topic_suffix")
+			kafkaTopicSuffix := key.Value()
+			config.KafkaTopicSuffix = kafkaTopicSuffix
+		}
+
+		if typeSection("kafka").HasKey("topic") {
+			key := typeSection("kafka").Key("topic")
+			kafkaTopic := key.Value()
+			config.KafkaTopic = kafkaTopic
+		}
+
+		if typeSection("kafka").HasKey("username") {
+			key := typeSection("kafka").Key("username")
+			kafkaUsername := key.Value()
+			config.KafkaUsername = kafkaUsername
+		}
+
+		if typeSection("kafka").HasKey("password") {
+			key := typeSection("kafka").Key("password")
+			kafkaPassword := key.Value()
+			config.KafkaPassword = kafkaPassword
+		}
+
+		if typeSection("kafka").HasKey("max_request_size") {
+			key := typeSection("kafka").Key("max_request_size")
+			if intKafkaMaxRequestSize, err := key.Int(); err == nil {
+				config.KafkaMaxRequestSize = int32(intKafkaMaxRequestSize)
+			}
+		} else {
+			config.KafkaMaxRequestSize = 1000000 // sane default from issue 959 on sarama github
+		}
+
+		config.KafkaRequiredAcks = "all"
+		if typeSection("kafka").HasKey("required_acks") {
+			key := typeSection("kafka").Key("required_acks")
+			requiredAcks := strings.ToLower(strings.TrimSpace(key.Value()))
+			switch requiredAcks {
+			case "all", "local", "none":
+				config.KafkaRequiredAcks = requiredAcks
+			default:
+				errs.addErrorString(fmt.Sprintf("Invalid required_acks: %s (all, local or none)", key.Value()))
+			}
+		}
+
+		config.KafkaMaxRetries = 3
+		if typeSection("kafka").HasKey("max_retries") {
+			key := typeSection("kafka").Key("max_retries")
+			if maxRetries, err := key.Int(); err == nil && maxRetries >= 0 {
+				config.KafkaMaxRetries = maxRetries
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid max_retries: %s", key.Value()))
+			}
+		}
+
+		if typeSection("kafka").HasKey("dead_letter_topic") {
+			key := typeSection("kafka").Key("dead_letter_topic")
+			config.KafkaDeadLetterTopic = strings.TrimSpace(key.Value())
+		}
+
+		if typeSection("kafka").HasKey("compression_type") {
+			key := typeSection("kafka").Key("compression_type")
+			compressionType := key.Value()
+			config.KafkaCompressionType = &compressionType
+		}
+
+		if typeSection("kafka").HasKey("ssl_ca_location") {
+			key := typeSection("kafka").Key("ssl_ca_location")
+			SSLCALocation := key.Value()
+			config.KafkaSSLCALocation = &SSLCALocation
+		}
+
+		if typeSection("kafka").HasKey("ssl_cert_location") {
+			key := typeSection("kafka").Key("ssl_cert_location")
+			SSLCertLocation := key.Value()
+			config.KafkaSSLCertificateLocation = &SSLCertLocation
+		}
+
+		if typeSection("kafka").HasKey("ssl_key_location") {
+			key := typeSection("kafka").Key("ssl_key_location")
+			SSLKeyLocation := key.Value()
+			config.KafkaSSLKeyLocation = &SSLKeyLocation
+		}
+
+	case "splunk":
+		parameterKey = "splunkout"
+		config.OutputType = SplunkOutputType
+
+		if typeSection("splunk").HasKey("hec_token") {
+			key := typeSection("splunk").Key("hec_token")
+			token := key.Value()
+			config.SplunkToken = &token
+		}
+
+		config.HTTPPostTemplate = template.New("http_post_output")
+		if typeSection("splunk").HasKey("http_post_template") {
+			key := typeSection("splunk").Key("http_post_template")
+			postTemplate := key.Value()
+			config.HTTPPostTemplate = template.Must(config.HTTPPostTemplate.Parse(postTemplate))
+		} else {
+			if config.OutputFormat == JSONOutputFormat {
+				config.HTTPPostTemplate = template.Must(config.HTTPPostTemplate.Parse(
+					`{{range .Events}}{"sourcetype":"bit9:carbonblack:json","event":{{.EventText}}}{{end}}`))
+			} else {
+				config.HTTPPostTemplate = template.Must(config.HTTPPostTemplate.Parse(`{{range .Events}}{{.EventText}}{{end}}`))
+			}
+		}
+
+		if typeSection("http").HasKey("content_type") {
+			key := typeSection("http").Key("content_type")
+			contentType := key.Value()
+			config.HTTPContentType = &contentType
+		} else {
+			jsonString := "application/json"
+			config.HTTPContentType = &jsonString
+		}
+
+	case "journald":
+		config.OutputType = JournaldOutputType
+
+		// journaldout is optional, only needed when journald listens somewhere else
+		config.OutputParameters = "/run/systemd/journal/socket"
+		if outputSection.HasKey("journaldout") && len(outputSection.Key("journaldout").Value()) > 0 {
+			config.OutputParameters = outputSection.Key("journaldout").Value()
+		}
+
+		config.JournaldPriority = 6
+		if typeSection("journald").HasKey("priority") {
+			key := typeSection("journald").Key("priority")
+			priority, err := ParseSyslogSeverity(strings.TrimSpace(key.Value()))
+			if err == nil {
+				config.JournaldPriority = priority
+			} else {
+				errs.addError(err)
+			}
+		}
+
+		config.JournaldIdentifier = "cb-event-forwarder"
+		if typeSection("journald").HasKey("identifier") {
+			config.JournaldIdentifier = strings.TrimSpace(typeSection("journald").Key("identifier").Value())
+		}
+
+		config.JournaldFieldPrefix = "CB_"
+		if typeSection("journald").HasKey("field_prefix") {
+			key := typeSection("journald").Key("field_prefix")
+			prefix := strings.ToUpper(strings.TrimSpace(key.Value()))
+			if validJournalFieldPrefix(prefix) {
+				config.JournaldFieldPrefix = prefix
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid field_prefix: %s (letters, digits and underscores, not starting with an underscore or a digit)", key.Value()))
+			}
+		}
+
+	case "websocket":
+		parameterKey = "websocketout"
+		config.OutputType = WebSocketOutputType
+
+		if typeSection("websocket").HasKey("origin") {
+			config.WebSocketOrigin = strings.TrimSpace(typeSection("websocket").Key("origin").Value())
+		}
+
+		if typeSection("websocket").HasKey("subprotocols") {
+			key := typeSection("websocket").Key("subprotocols")
+			for _, protocol := range strings.Split(key.Value(), ",") {
+				if protocol = strings.TrimSpace(protocol); len(protocol) > 0 {
+					config.WebSocketSubprotocols = append(config.WebSocketSubprotocols, protocol)
+				}
+			}
+		}
+
+		config.WebSocketHeaders = http.Header{}
+		for _, key := range typeSection("websocket").Keys() {
+			if strings.HasPrefix(key.Name(), "header_") {
+				config.WebSocketHeaders.Add(strings.TrimPrefix(key.Name(), "header_"), key.Value())
+			}
+		}
+
+		if typeSection("websocket").HasKey("message_type") {
+			key := typeSection("websocket").Key("message_type")
+			switch strings.ToLower(strings.TrimSpace(key.Value())) {
+			case "text":
+				config.WebSocketBinaryMessages = false
+			case "binary":
+				config.WebSocketBinaryMessages = true
+			default:
+				errs.addErrorString(fmt.Sprintf("Invalid message_type: %s (text or binary)", key.Value()))
+			}
+		}
+
+		config.WebSocketPingInterval = 30 * time.Second
+		if typeSection("websocket").HasKey("ping_interval") {
+			key := typeSection("websocket").Key("ping_interval")
+			interval, err := key.Int64()
+			if err == nil && interval >= 0 {
+				config.WebSocketPingInterval = time.Duration(interval) * time.Second
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid ping_interval: %s", key.Value()))
+			}
+		}
+
+	case "loki":
+		parameterKey = "lokiout"
+		config.OutputType = LokiOutputType
+
+		config.LokiLabels = []LokiLabel{{Name: "event_type", Field: "type"}}
+		if typeSection("loki").HasKey("labels") {
+			key := typeSection("loki").Key("labels")
+			labels, err := ParseLokiLabels(key.Value())
+			if err == nil {
+				config.LokiLabels = labels
+			} else {
+				errs.addError(err)
+			}
+		}
+
+		config.LokiStaticLabels = map[string]string{"job": "cb-event-forwarder"}
+		if typeSection("loki").HasKey("static_labels") {
+			key := typeSection("loki").Key("static_labels")
+			labels, err := ParseLokiStaticLabels(key.Value())
+			if err == nil {
+				config.LokiStaticLabels = labels
+			} else {
+				errs.addError(err)
+			}
+		}
+		if len(config.LokiLabels) == 0 && len(config.LokiStaticLabels) == 0 {
+			errs.addErrorString("Loki streams need at least one label: set labels or static_labels")
+		}
+
+		config.LokiHeaders = http.Header{}
+		for _, key := range typeSection("loki").Keys() {
+			if strings.HasPrefix(key.Name(), "header_") {
+				config.LokiHeaders.Add(strings.TrimPrefix(key.Name(), "header_"), key.Value())
+			}
+		}
+		if typeSection("loki").HasKey("tenant_id") {
+			config.LokiHeaders.Set("X-Scope-OrgID", strings.TrimSpace(typeSection("loki").Key("tenant_id").Value()))
+		}
+
+		config.LokiBatchSize = 1000
+		if typeSection("loki").HasKey("batch_size") {
+			key := typeSection("loki").Key("batch_size")
+			size, err := key.Int()
+			if err == nil && size > 0 {
+				config.LokiBatchSize = size
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid batch_size: %s", key.Value()))
+			}
+		}
+
+		config.LokiBatchWait = time.Second
+		if typeSection("loki").HasKey("batch_wait_ms") {
+			key := typeSection("loki").Key("batch_wait_ms")
+			wait, err := key.Int64()
+			if err == nil && wait > 0 {
+				config.LokiBatchWait = time.Duration(wait) * time.Millisecond
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid batch_wait_ms: %s", key.Value()))
+			}
+		}
+
+		config.LokiMaxRetries = 5
+		if typeSection("loki").HasKey("max_retries") {
+			key := typeSection("loki").Key("max_retries")
+			if maxRetries, err := key.Int(); err == nil && maxRetries >= 0 {
+				config.LokiMaxRetries = maxRetries
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid max_retries: %s", key.Value()))
+			}
+		}
+
+		config.LokiRetryAfterMax = 30 * time.Second
+		if typeSection("loki").HasKey("retry_after_max") {
+			key := typeSection("loki").Key("retry_after_max")
+			seconds, err := key.Int64()
+			if err == nil && seconds >= 0 {
+				config.LokiRetryAfterMax = time.Duration(seconds) * time.Second
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid retry_after_max: %s", key.Value()))
+			}
+		}
+
+	case "sql":
+		parameterKey = "sqlout"
+		config.OutputType = SQLOutputType
+
+		if config.OutputFormat != JSONOutputFormat {
+			errs.addErrorString("The sql output requires output_format=json")
+		}
+
+		config.SQLDriver = "postgres"
+		if typeSection("sql").HasKey("driver") {
+			config.SQLDriver = strings.TrimSpace(typeSection("sql").Key("driver").Value())
+		}
+
+		if typeSection("sql").HasKey("table") {
+			key := typeSection("sql").Key("table")
+			if table := strings.TrimSpace(key.Value()); ValidSQLTableName(table) {
+				config.SQLTable = table
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid table: %s", key.Value()))
+			}
+		} else {
+			errs.addErrorString("Missing value for key table, required by output type sql")
+		}
+
+		if typeSection("sql").HasKey("columns") {
+			columns, err := ParseSQLColumns(typeSection("sql").Key("columns").Value())
+			if err == nil {
+				config.SQLColumns = columns
+			} else {
+				errs.addError(err)
+			}
+		}
+
+		config.SQLExtraColumn = "event"
+		if typeSection("sql").HasKey("extra_column") {
+			key := typeSection("sql").Key("extra_column")
+			config.SQLExtraColumn = strings.TrimSpace(key.Value())
+			if len(config.SQLExtraColumn) > 0 && !ValidSQLColumnName(config.SQLExtraColumn) {
+				errs.addErrorString(fmt.Sprintf("Invalid extra_column: %s", key.Value()))
+			}
+		}
+		for _, column := range config.SQLColumns {
+			if strings.EqualFold(column.Name, config.SQLExtraColumn) {
+				errs.addErrorString(fmt.Sprintf("Column %s is both mapped to a field and the extra_column", column.Name))
+			}
+		}
+		if len(config.SQLColumns) == 0 && len(config.SQLExtraColumn) == 0 {
+			errs.addErrorString("The sql output needs columns, an extra_column, or both")
+		}
+
+		config.SQLBatchSize = 500
+		if typeSection("sql").HasKey("batch_size") {
+			key := typeSection("sql").Key("batch_size")
+			size, err := key.Int()
+			if err == nil && size > 0 {
+				config.SQLBatchSize = size
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid batch_size: %s", key.Value()))
+			}
+		}
+
+		config.SQLBatchWait = time.Second
+		if typeSection("sql").HasKey("batch_wait_ms") {
+			key := typeSection("sql").Key("batch_wait_ms")
+			wait, err := key.Int64()
+			if err == nil && wait > 0 {
+				config.SQLBatchWait = time.Duration(wait) * time.Millisecond
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid batch_wait_ms: %s", key.Value()))
+			}
+		}
+
+		config.SQLMaxRetries = 5
+		if typeSection("sql").HasKey("max_retries") {
+			key := typeSection("sql").Key("max_retries")
+			if maxRetries, err := key.Int(); err == nil && maxRetries >= 0 {
+				config.SQLMaxRetries = maxRetries
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid max_retries: %s", key.Value()))
+			}
+		}
+
+		config.SQLMaxOpenConnections = 4
+		if typeSection("sql").HasKey("max_open_connections") {
+			key := typeSection("sql").Key("max_open_connections")
+			if connections, err := key.Int(); err == nil && connections > 0 {
+				config.SQLMaxOpenConnections = connections
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid max_open_connections: %s", key.Value()))
+			}
+		}
+
+	case "splunk_hec":
+		parameterKey = "splunkhecout"
+		config.OutputType = SplunkHECOutputType
+
+		if typeSection("splunk_hec").HasKey("hec_token") {
+			config.SplunkHECToken = strings.TrimSpace(typeSection("splunk_hec").Key("hec_token").Value())
+		}
+		if len(config.SplunkHECToken) == 0 {
+			errs.addErrorString("Missing value for key hec_token, required by output type splunk_hec")
+		}
+
+		if typeSection("splunk_hec").HasKey("source") {
+			config.SplunkHECSource = strings.TrimSpace(typeSection("splunk_hec").Key("source").Value())
+		}
+		config.SplunkHECSourceType = DefaultSplunkHECSourceType
+		if typeSection("splunk_hec").HasKey("sourcetype") {
+			config.SplunkHECSourceType = strings.TrimSpace(typeSection("splunk_hec").Key("sourcetype").Value())
+		}
+		if typeSection("splunk_hec").HasKey("index") {
+			config.SplunkHECIndex = strings.TrimSpace(typeSection("splunk_hec").Key("index").Value())
+		}
+		config.SplunkHECHostField = "computer_name"
+		if typeSection("splunk_hec").HasKey("host_field") {
+			config.SplunkHECHostField = strings.TrimSpace(typeSection("splunk_hec").Key("host_field").Value())
+		}
+
+		if typeSection("splunk_hec").HasKey("event_type_sourcetypes") {
+			sourceTypes, err := ParseEventTypeValues(typeSection("splunk_hec").Key("event_type_sourcetypes").Value())
+			if err == nil {
+				config.SplunkHECSourceTypes = sourceTypes
+			} else {
+				errs.addError(err)
+			}
+		}
+		if typeSection("splunk_hec").HasKey("event_type_indexes") {
+			indexes, err := ParseEventTypeValues(typeSection("splunk_hec").Key("event_type_indexes").Value())
+			if err == nil {
+				config.SplunkHECIndexes = indexes
+			} else {
+				errs.addError(err)
+			}
+		}
+
+		config.SplunkHECBatchSize = 100
+		if typeSection("splunk_hec").HasKey("batch_size") {
+			key := typeSection("splunk_hec").Key("batch_size")
+			size, err := key.Int()
+			if err == nil && size > 0 {
+				config.SplunkHECBatchSize = size
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid batch_size: %s", key.Value()))
+			}
+		}
+
+		config.SplunkHECBatchWait = time.Second
+		if typeSection("splunk_hec").HasKey("batch_wait_ms") {
+			key := typeSection("splunk_hec").Key("batch_wait_ms")
+			wait, err := key.Int64()
+			if err == nil && wait > 0 {
+				config.SplunkHECBatchWait = time.Duration(wait) * time.Millisecond
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid batch_wait_ms: %s", key.Value()))
+			}
+		}
+
+		config.SplunkHECMaxRetries = 5
+		if typeSection("splunk_hec").HasKey("max_retries") {
+			key := typeSection("splunk_hec").Key("max_retries")
+			if maxRetries, err := key.Int(); err == nil && maxRetries >= 0 {
+				config.SplunkHECMaxRetries = maxRetries
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid max_retries: %s", key.Value()))
+			}
+		}
+
+		if typeSection("splunk_hec").HasKey("indexer_ack") {
+			key := typeSection("splunk_hec").Key("indexer_ack")
+			if ack, err := key.Bool(); err == nil {
+				config.SplunkHECAck = ack
+			} else {
+				errs.addErrorString("Unknown value for 'indexer_ack': valid values are true, false, 1, 0")
+			}
+		}
+
+		if typeSection("splunk_hec").HasKey("channel") {
+			config.SplunkHECChannel = strings.TrimSpace(typeSection("splunk_hec").Key("channel").Value())
+		}
+
+		config.SplunkHECAckInterval = time.Second
+		if typeSection("splunk_hec").HasKey("ack_interval_ms") {
+			key := typeSection("splunk_hec").Key("ack_interval_ms")
+			interval, err := key.Int64()
+			if err == nil && interval > 0 {
+				config.SplunkHECAckInterval = time.Duration(interval) * time.Millisecond
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid ack_interval_ms: %s", key.Value()))
+			}
+		}
+
+		config.SplunkHECAckTimeout = time.Minute
+		if typeSection("splunk_hec").HasKey("ack_timeout") {
+			key := typeSection("splunk_hec").Key("ack_timeout")
+			timeout, err := key.Int64()
+			if err == nil && timeout > 0 {
+				config.SplunkHECAckTimeout = time.Duration(timeout) * time.Second
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid ack_timeout: %s", key.Value()))
+			}
+		}
+
+	case "nats":
+		parameterKey = "natsout"
+		config.OutputType = NATSOutputType
+
+		if typeSection("nats").HasKey("subject") {
+			key := typeSection("nats").Key("subject")
+			if tmpl, err := ParseNATSSubject(key.Value()); err == nil {
+				config.NATSSubject = tmpl
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid subject: %s", err))
+			}
+		} else {
+			errs.addErrorString("Missing value for key subject, required by output type nats")
+		}
+
+		if typeSection("nats").HasKey("user") {
+			config.NATSUser = strings.TrimSpace(typeSection("nats").Key("user").Value())
+		}
+		if typeSection("nats").HasKey("password") {
+			config.NATSPassword = typeSection("nats").Key("password").Value()
+		}
+		if typeSection("nats").HasKey("token") {
+			config.NATSToken = strings.TrimSpace(typeSection("nats").Key("token").Value())
+		}
+
+		if typeSection("nats").HasKey("jetstream") {
+			key := typeSection("nats").Key("jetstream")
+			if jetStream, err := key.Bool(); err == nil {
+				config.NATSJetStream = jetStream
+			} else {
+				errs.addErrorString("Unknown value for 'jetstream': valid values are true, false, 1, 0")
+			}
+		}
+
+		if typeSection("nats").HasKey("stream") {
+			config.NATSStream = strings.TrimSpace(typeSection("nats").Key("stream").Value())
+			if len(config.NATSStream) > 0 && !config.NATSJetStream {
+				errs.addErrorString("stream requires jetstream=true")
+			}
+		}
+
+		config.NATSMaxPendingAcks = 256
+		if typeSection("nats").HasKey("max_pending_acks") {
+			key := typeSection("nats").Key("max_pending_acks")
+			if pending, err := key.Int(); err == nil && pending > 0 {
+				config.NATSMaxPendingAcks = pending
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid max_pending_acks: %s", key.Value()))
+			}
+		}
+
+		config.NATSAckTimeout = 5 * time.Second
+		if typeSection("nats").HasKey("ack_timeout") {
+			key := typeSection("nats").Key("ack_timeout")
+			timeout, err := key.Int64()
+			if err == nil && timeout > 0 {
+				config.NATSAckTimeout = time.Duration(timeout) * time.Second
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid ack_timeout: %s", key.Value()))
+			}
+		}
+
+		config.NATSMaxRetries = 5
+		if typeSection("nats").HasKey("max_retries") {
+			key := typeSection("nats").Key("max_retries")
+			if maxRetries, err := key.Int(); err == nil && maxRetries >= 0 {
+				config.NATSMaxRetries = maxRetries
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid max_retries: %s", key.Value()))
+			}
+		}
+
+	case "otlp":
+		parameterKey = "otlpout"
+		config.OutputType = OTLPOutputType
+
+		config.OTLPProtocol = OTLPHTTPProtocol
+		if typeSection("otlp").HasKey("protocol") {
+			key := typeSection("otlp").Key("protocol")
+			switch protocol := strings.ToLower(strings.TrimSpace(key.Value())); protocol {
+			case OTLPGRPCProtocol, OTLPHTTPProtocol:
+				config.OTLPProtocol = protocol
+			case "http":
+				config.OTLPProtocol = OTLPHTTPProtocol
+			default:
+				errs.addErrorString(fmt.Sprintf("Invalid protocol: %s (grpc or http/protobuf)", key.Value()))
+			}
+		}
+
+		config.OTLPAttributes = []OTLPAttribute{{Name: "cb.event_type", Field: "type"}}
+		if typeSection("otlp").HasKey("attributes") {
+			key := typeSection("otlp").Key("attributes")
+			attributes, err := ParseOTLPAttributes(key.Value())
+			if err == nil {
+				config.OTLPAttributes = attributes
+			} else {
+				errs.addError(err)
+			}
+		}
+
+		config.OTLPResourceAttributes = map[string]string{"service.name": "cb-event-forwarder"}
+		if typeSection("otlp").HasKey("resource_attributes") {
+			key := typeSection("otlp").Key("resource_attributes")
+			attributes, err := ParseOTLPResourceAttributes(key.Value())
+			if err == nil {
+				config.OTLPResourceAttributes = attributes
+			} else {
+				errs.addError(err)
+			}
+		}
+
+		config.OTLPHeaders = http.Header{}
+		for _, key := range typeSection("otlp").Keys() {
+			if strings.HasPrefix(key.Name(), "header_") {
+				config.OTLPHeaders.Add(strings.TrimPrefix(key.Name(), "header_"), key.Value())
+			}
+		}
+
+		config.OTLPBatchSize = 512
+		if typeSection("otlp").HasKey("batch_size") {
+			key := typeSection("otlp").Key("batch_size")
+			size, err := key.Int()
+			if err == nil && size > 0 {
+				config.OTLPBatchSize = size
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid batch_size: %s", key.Value()))
+			}
+		}
+
+		config.OTLPBatchWait = time.Second
+		if typeSection("otlp").HasKey("batch_wait_ms") {
+			key := typeSection("otlp").Key("batch_wait_ms")
+			wait, err := key.Int64()
+			if err == nil && wait > 0 {
+				config.OTLPBatchWait = time.Duration(wait) * time.Millisecond
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid batch_wait_ms: %s", key.Value()))
+			}
+		}
+
+		config.OTLPMaxRetries = 5
+		if typeSection("otlp").HasKey("max_retries") {
+			key := typeSection("otlp").Key("max_retries")
+			if maxRetries, err := key.Int(); err == nil && maxRetries >= 0 {
+				config.OTLPMaxRetries = maxRetries
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid max_retries: %s", key.Value()))
+			}
+		}
+
+	default:
+		errs.addErrorString(fmt.Sprintf("Unknown output type: %s", outType))
+	}
+
+	if len(parameterKey) > 0 {
+		if !outputSection.HasKey(parameterKey) {
+			errs.addErrorString(fmt.Sprintf("Missing value for key %s, required by output type %s",
+				parameterKey, outType))
+		} else {
+			key := outputSection.Key(parameterKey)
+			config.OutputParameters = key.Value()
+		}
+	}
+
+	// TLS configuration
+
+	if typeSection(outType).HasKey("client_key") {
+		key := typeSection(outType).Key("client_key")
+		clientKeyFilename := key.Value()
+		config.TLSClientKey = &clientKeyFilename
+	}
+
+	if typeSection(outType).HasKey("client_cert") {
+		key := typeSection(outType).Key("client_cert")
+		clientCertFilename := key.Value()
+		config.TLSClientCert = &clientCertFilename
+	}
+
+	if typeSection(outType).HasKey("ca_cert") {
+		key := typeSection(outType).Key("ca_cert")
+		caCertFilename := key.Value()
+		config.TLSCACert = &caCertFilename
+	}
+
+	config.TLSVerify = true
+
+	if typeSection(outType).HasKey("tls_verify") {
+		key := typeSection(outType).Key("tls_verify")
+		boolval, err := key.Bool()
+		if err == nil {
+			if boolval == false {
+				config.TLSVerify = false
+			}
+		} else {
+			errs.addErrorString(fmt.Sprintf("%v", err))
+		}
+	}
+
+	config.TLS12Only = true
+
+	if typeSection(outType).HasKey("insecure_tls") {
+		key := typeSection(outType).Key("insecure_tls")
+		boolval, err := key.Bool()
+		if err == nil {
+			if boolval == true {
+				config.TLS12Only = false
+			}
+		} else {
+			errs.addErrorString("Unknown value for 'insecure_tls': ")
+		}
+	}
+
+	if typeSection(outType).HasKey("server_cname") {
+		key := typeSection(outType).Key("server_cname")
+		serverCName := key.Value()
+		config.TLSCName = &serverCName
+	}
+
+	if typeSection(outType).HasKey("tls_min_version") {
+		key := typeSection(outType).Key("tls_min_version")
+		version, err := TLSVersionFromString(key.Value())
+		if err == nil {
+			config.TLSMinVersion = version
+		} else {
+			errs.addError(err)
+		}
+	}
+
+	if typeSection(outType).HasKey("tls_cipher_suites") {
+		key := typeSection(outType).Key("tls_cipher_suites")
+		suites, err := TLSCipherSuitesFromString(key.Value())
+		if err == nil {
+			config.TLSCipherSuites = suites
+		} else {
+			errs.addError(err)
+		}
+	}
+
+	if typeSection(outType).HasKey("tls_pinned_sha256") {
+		key := typeSection(outType).Key("tls_pinned_sha256")
+		pins, err := TLSPinsFromString(key.Value())
+		if err == nil {
+			config.TLSPinnedSHA256 = pins
+		} else {
+			errs.addError(err)
+		}
+	}
+
+	if typeSection(outType).HasKey("tls_pin_only") {
+		key := typeSection(outType).Key("tls_pin_only")
+		boolval, err := key.Bool()
+		if err == nil {
+			config.TLSPinOnly = boolval
+		} else {
+			errs.addErrorString("Unknown value for 'tls_pin_only': valid values are true, false, 1, 0")
+		}
+		if config.TLSPinOnly && len(config.TLSPinnedSHA256) == 0 {
+			errs.addErrorString("tls_pin_only requires tls_pinned_sha256")
+		}
+	}
+
+	config.TLSSessionCacheSize = 64
+	if typeSection(outType).HasKey("tls_session_cache_size") {
+		key := typeSection(outType).Key("tls_session_cache_size")
+		cacheSize, err := key.Int()
+		if err == nil && cacheSize >= 0 {
+			config.TLSSessionCacheSize = cacheSize
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid tls_session_cache_size: %s", key.Value()))
+		}
+	}
+
+	if typeSection("tcp").HasKey("max_connection_lifetime") {
+		key := typeSection("tcp").Key("max_connection_lifetime")
+		lifetime, err := key.Int64()
+		if err == nil && lifetime >= 0 {
+			config.MaxConnectionLifetime = time.Duration(lifetime) * time.Second
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid max_connection_lifetime: %s", key.Value()))
+		}
+	}
+
+	if typeSection("tcp").HasKey("idle_timeout") {
+		key := typeSection("tcp").Key("idle_timeout")
+		timeout, err := key.Int64()
+		if err == nil && timeout >= 0 {
+			config.IdleTimeout = time.Duration(timeout) * time.Second
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid idle_timeout: %s", key.Value()))
+		}
+	}
+
+	if typeSection("tcp").HasKey("disconnect_footer") {
+		key := typeSection("tcp").Key("disconnect_footer")
+		footer, err := ParseDisconnectFooter(key.Value())
+		if err == nil {
+			config.DisconnectFooter = footer
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid disconnect_footer: %s", err))
+		}
+	}
+
+	config.ReconnectBackoffMax = 5 * time.Second
+	if typeSection("tcp").HasKey("reconnect_backoff_max") {
+		key := typeSection("tcp").Key("reconnect_backoff_max")
+		backoff, err := key.Int64()
+		if err == nil && backoff >= 5 {
+			config.ReconnectBackoffMax = time.Duration(backoff) * time.Second
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid reconnect_backoff_max: %s (the minimum is 5)", key.Value()))
+		}
+	}
+
+	if typeSection("tcp").HasKey("min_healthy_connection") {
+		key := typeSection("tcp").Key("min_healthy_connection")
+		duration, err := key.Int64()
+		if err == nil && duration >= 0 {
+			config.MinHealthyConnection = time.Duration(duration) * time.Second
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid min_healthy_connection: %s", key.Value()))
+		}
+	}
+
+	if typeSection("tcp").HasKey("half_close") {
+		key := typeSection("tcp").Key("half_close")
+		boolval, err := key.Bool()
+		if err == nil {
+			config.TCPHalfClose = boolval
+		} else {
+			errs.addErrorString("Unknown value for 'half_close': valid values are true, false, 1, 0")
+		}
+	}
+
+	config.TCPHalfCloseTimeout = 5 * time.Second
+
+	if typeSection("tcp").HasKey("half_close_timeout") {
+		key := typeSection("tcp").Key("half_close_timeout")
+		timeout, err := key.Int64()
+		if err == nil && timeout >= 0 {
+			config.TCPHalfCloseTimeout = time.Duration(timeout) * time.Second
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid half_close_timeout: %s", key.Value()))
+		}
+	}
+
+	if typeSection("tcp").HasKey("rotation_notice") {
+		config.RotationNotice = strings.TrimSpace(typeSection("tcp").Key("rotation_notice").Value())
+	}
+
+	config.RotationNoticeGrace = 2 * time.Second
+	if typeSection("tcp").HasKey("rotation_notice_grace") {
+		key := typeSection("tcp").Key("rotation_notice_grace")
+		grace, err := key.Int64()
+		if err == nil && grace >= 0 {
+			config.RotationNoticeGrace = time.Duration(grace) * time.Second
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid rotation_notice_grace: %s", key.Value()))
+		}
+	}
+	if len(config.RotationNotice) > 0 && config.OutputFormat == MsgPackOutputFormat {
+		errs.addErrorString("rotation_notice is not supported with msgpack, whose events are not lines")
+	}
+
+	if typeSection("tcp").HasKey("handshake_psk_file") {
+		config.HandshakePSKFile = strings.TrimSpace(typeSection("tcp").Key("handshake_psk_file").Value())
+	}
+
+	config.HandshakeFormat = "{psk}"
+	if typeSection("tcp").HasKey("handshake_format") {
+		key := typeSection("tcp").Key("handshake_format")
+		if strings.Contains(key.Value(), "{psk}") {
+			config.HandshakeFormat = key.Value()
+		} else {
+			errs.addErrorString("Invalid handshake_format: it should include {psk}")
+		}
+	}
+
+	if typeSection("tcp").HasKey("handshake_ack") {
+		config.HandshakeAck = strings.TrimSpace(typeSection("tcp").Key("handshake_ack").Value())
+	}
+
+	config.HandshakeTimeout = 10 * time.Second
+	if typeSection("tcp").HasKey("handshake_timeout") {
+		key := typeSection("tcp").Key("handshake_timeout")
+		timeout, err := key.Int64()
+		if err == nil && timeout > 0 {
+			config.HandshakeTimeout = time.Duration(timeout) * time.Second
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid handshake_timeout: %s", key.Value()))
+		}
+	}
+
+	if typeSection("tcp").HasKey("ssh_tunnel_host") {
+		host := strings.TrimSpace(typeSection("tcp").Key("ssh_tunnel_host").Value())
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, "22")
+		}
+		config.SSHTunnelHost = host
+
+		if typeSection("tcp").HasKey("ssh_tunnel_user") {
+			config.SSHTunnelUser = strings.TrimSpace(typeSection("tcp").Key("ssh_tunnel_user").Value())
+		}
+		if len(config.SSHTunnelUser) == 0 {
+			errs.addErrorString("ssh_tunnel_user is required when using ssh_tunnel_host")
+		}
+
+		if typeSection("tcp").HasKey("ssh_tunnel_key_file") {
+			config.SSHTunnelKeyFile = strings.TrimSpace(typeSection("tcp").Key("ssh_tunnel_key_file").Value())
+		}
+		if typeSection("tcp").HasKey("ssh_tunnel_agent") {
+			boolval, err := typeSection("tcp").Key("ssh_tunnel_agent").Bool()
+			if err == nil {
+				config.SSHTunnelUseAgent = boolval
+			} else {
+				errs.addErrorString("Unknown value for 'ssh_tunnel_agent': valid values are true, false, 1, 0")
+			}
+		}
+		if len(config.SSHTunnelKeyFile) == 0 && !config.SSHTunnelUseAgent {
+			errs.addErrorString("ssh_tunnel_host requires ssh_tunnel_key_file or ssh_tunnel_agent=true")
+		}
+
+		if typeSection("tcp").HasKey("ssh_tunnel_known_hosts") {
+			config.SSHTunnelKnownHostsFile = strings.TrimSpace(typeSection("tcp").Key("ssh_tunnel_known_hosts").Value())
+		}
+		if len(config.SSHTunnelKnownHostsFile) == 0 {
+			errs.addErrorString("ssh_tunnel_known_hosts is required when using ssh_tunnel_host")
+		}
+	}
+
+	if typeSection("tcp").HasKey("heartbeat_interval") {
+		key := typeSection("tcp").Key("heartbeat_interval")
+		interval, err := key.Int64()
+		if err == nil && interval >= 0 {
+			config.HeartbeatInterval = time.Duration(interval) * time.Second
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid heartbeat_interval: %s", key.Value()))
+		}
+	}
+
+	config.HeartbeatTimeout = 10 * time.Second
+	if typeSection("tcp").HasKey("heartbeat_timeout") {
+		key := typeSection("tcp").Key("heartbeat_timeout")
+		timeout, err := key.Int64()
+		if err == nil && timeout > 0 {
+			config.HeartbeatTimeout = time.Duration(timeout) * time.Second
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid heartbeat_timeout: %s", key.Value()))
+		}
+	}
+
+	config.HeartbeatPing = "PING"
+	if typeSection("tcp").HasKey("heartbeat_ping") {
+		config.HeartbeatPing = strings.TrimSpace(typeSection("tcp").Key("heartbeat_ping").Value())
+	}
+	config.HeartbeatPong = "PONG"
+	if typeSection("tcp").HasKey("heartbeat_pong") {
+		config.HeartbeatPong = strings.TrimSpace(typeSection("tcp").Key("heartbeat_pong").Value())
+	}
+
+	if config.HeartbeatInterval > 0 {
+		switch {
+		case len(config.HeartbeatPing) == 0 || len(config.HeartbeatPong) == 0:
+			errs.addErrorString("heartbeat_ping and heartbeat_pong can't be empty")
+		case config.OutputFormat == MsgPackOutputFormat:
+			errs.addErrorString("heartbeat_interval is not supported with msgpack, whose events are not lines")
+		case config.IdleTimeout > 0:
+			errs.addErrorString("heartbeat_interval can't be used with idle_timeout, heartbeats keep the connection busy")
+		}
+	}
+
+	if typeSection("tcp").HasKey("http_proxy_url") {
+		key := typeSection("tcp").Key("http_proxy_url")
+		proxyURL, err := ParseHTTPProxyURL(key.Value())
+		if err == nil {
+			config.HTTPProxyURL = proxyURL
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid http_proxy_url: %s", err))
+		}
+		if len(config.SSHTunnelHost) > 0 {
+			errs.addErrorString("http_proxy_url can't be used with ssh_tunnel_host")
+		}
+	}
+
+	if typeSection("tcp").HasKey("use_tls") {
+		key := typeSection("tcp").Key("use_tls")
+		boolval, err := key.Bool()
+		if err == nil {
+			config.TCPUseTLS = boolval
+		} else {
+			errs.addErrorString("Unknown value for 'use_tls': valid values are true, false, 1, 0")
+		}
+	}
+
+	config.TCPNoDelay = true
+	if typeSection("tcp").HasKey("tcp_nodelay") {
+		key := typeSection("tcp").Key("tcp_nodelay")
+		boolval, err := key.Bool()
+		if err == nil {
+			config.TCPNoDelay = boolval
+		} else {
+			errs.addErrorString("Unknown value for 'tcp_nodelay': valid values are true, false, 1, 0")
+		}
+	}
+
+	if typeSection("tcp").HasKey("starttls") {
+		config.StartTLSCommand = strings.TrimSpace(typeSection("tcp").Key("starttls").Value())
+		if len(config.StartTLSCommand) == 0 {
+			errs.addErrorString("Invalid starttls: it should be the line asking the collector to start TLS")
+		} else if !config.TCPUseTLS {
+			errs.addErrorString("starttls requires use_tls")
+		}
+	}
+
+	config.StartTLSReply = "OK"
+	if typeSection("tcp").HasKey("starttls_reply") {
+		config.StartTLSReply = strings.TrimSpace(typeSection("tcp").Key("starttls_reply").Value())
+		if len(config.StartTLSReply) == 0 {
+			errs.addErrorString("Invalid starttls_reply: it should be the start of the collector's answer")
+		}
+	}
+
+	config.StartTLSTimeout = 10 * time.Second
+	if typeSection("tcp").HasKey("starttls_timeout") {
+		key := typeSection("tcp").Key("starttls_timeout")
+		timeout, err := key.Int64()
+		if err == nil && timeout > 0 {
+			config.StartTLSTimeout = time.Duration(timeout) * time.Second
 		} else {
-			jsonString := "application/json"
-			config.HTTPContentType = &jsonString
+			errs.addErrorString(fmt.Sprintf("Invalid starttls_timeout: %s", key.Value()))
 		}
-
-	default:
-		errs.addErrorString(fmt.Sprintf("Unknown output type: %s", outType))
 	}
 
-	if len(parameterKey) > 0 {
-		if !input.Section("bridge").HasKey(parameterKey) {
-			errs.addErrorString(fmt.Sprintf("Missing value for key %s, required by output type %s",
-				parameterKey, outType))
+	if typeSection("tcp").HasKey("tls_rekey_interval") {
+		key := typeSection("tcp").Key("tls_rekey_interval")
+		interval, err := key.Int64()
+		if err == nil && interval >= 0 {
+			config.TLSRekeyInterval = time.Duration(interval) * time.Second
 		} else {
-			key := input.Section("bridge").Key(parameterKey)
-			config.OutputParameters = key.Value()
+			errs.addErrorString(fmt.Sprintf("Invalid tls_rekey_interval: %s", key.Value()))
 		}
 	}
 
-	if input.Section("bridge").HasKey("use_raw_sensor_exchange") {
-		key := input.Section("bridge").Key("use_raw_sensor_exchange")
-		boolval, err := key.Bool()
-		if err == nil {
-			config.UseRawSensorExchange = boolval
-			if boolval {
-				log.Warn("Configured to listen on the VMware Carbon Black EDR raw sensor event feed.")
-				log.Warn("- This will result in a *large* number of messages output via the event forwarder!")
-				log.Warn("- Ensure that raw sensor events are enabled in your EDR server (primary & minion) via")
-				log.Warn("  the 'EnableRawSensorDataBroadcast' variable in /etc/cb/cb.conf")
-			}
+	if typeSection("tcp").HasKey("tls_rekey_bytes") {
+		key := typeSection("tcp").Key("tls_rekey_bytes")
+		limit, err := key.Int64()
+		if err == nil && limit >= 0 {
+			config.TLSRekeyBytes = limit
 		} else {
-			errs.addErrorString("Unknown value for 'use_raw_sensor_exchange': valid values are true, false, 1, 0")
+			errs.addErrorString(fmt.Sprintf("Invalid tls_rekey_bytes: %s", key.Value()))
 		}
 	}
 
-	// TLS configuration
-
-	if input.Section(outType).HasKey("client_key") {
-		key := input.Section(outType).Key("client_key")
-		clientKeyFilename := key.Value()
-		config.TLSClientKey = &clientKeyFilename
+	if (config.TLSRekeyInterval > 0 || config.TLSRekeyBytes > 0) && !config.TCPUseTLS {
+		errs.addErrorString("tls_rekey_interval and tls_rekey_bytes require use_tls")
 	}
 
-	if input.Section(outType).HasKey("client_cert") {
-		key := input.Section(outType).Key("client_cert")
-		clientCertFilename := key.Value()
-		config.TLSClientCert = &clientCertFilename
+	if typeSection("tcp").HasKey("backpressure_write_timeout_ms") {
+		key := typeSection("tcp").Key("backpressure_write_timeout_ms")
+		timeout, err := key.Int64()
+		if err == nil && timeout >= 0 {
+			config.BackpressureWriteTimeout = time.Duration(timeout) * time.Millisecond
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid backpressure_write_timeout_ms: %s", key.Value()))
+		}
+		// a TLS connection can't be written to again once a write has timed out
+		if config.BackpressureWriteTimeout > 0 && config.TCPUseTLS {
+			errs.addErrorString("backpressure_write_timeout_ms is not supported with use_tls")
+		}
 	}
 
-	if input.Section(outType).HasKey("ca_cert") {
-		key := input.Section(outType).Key("ca_cert")
-		caCertFilename := key.Value()
-		config.TLSCACert = &caCertFilename
+	config.BackpressurePause = 100 * time.Millisecond
+	if typeSection("tcp").HasKey("backpressure_pause_ms") {
+		key := typeSection("tcp").Key("backpressure_pause_ms")
+		pause, err := key.Int64()
+		if err == nil && pause >= 0 {
+			config.BackpressurePause = time.Duration(pause) * time.Millisecond
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid backpressure_pause_ms: %s", key.Value()))
+		}
 	}
 
-	config.TLSVerify = true
+	config.BackpressureMaxDuration = 30 * time.Second
+	if typeSection("tcp").HasKey("backpressure_max_duration") {
+		key := typeSection("tcp").Key("backpressure_max_duration")
+		duration, err := key.Int64()
+		if err == nil && duration > 0 {
+			config.BackpressureMaxDuration = time.Duration(duration) * time.Second
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid backpressure_max_duration: %s", key.Value()))
+		}
+	}
 
-	if input.Section(outType).HasKey("tls_verify") {
-		key := input.Section(outType).Key("tls_verify")
-		boolval, err := key.Bool()
-		if err == nil {
-			if boolval == false {
-				config.TLSVerify = false
-			}
+	if typeSection("tcp").HasKey("batch_max_events") {
+		key := typeSection("tcp").Key("batch_max_events")
+		maxEvents, err := key.Int()
+		if err == nil && maxEvents >= 0 {
+			config.BatchMaxEvents = maxEvents
 		} else {
-			errs.addErrorString(fmt.Sprintf("%v", err))
+			errs.addErrorString(fmt.Sprintf("Invalid batch_max_events: %s", key.Value()))
 		}
 	}
 
-	config.TLS12Only = true
+	if typeSection("tcp").HasKey("batch_max_bytes") {
+		key := typeSection("tcp").Key("batch_max_bytes")
+		maxBytes, err := key.Int()
+		if err == nil && maxBytes >= 0 {
+			config.BatchMaxBytes = maxBytes
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid batch_max_bytes: %s", key.Value()))
+		}
+	}
 
-	if input.Section(outType).HasKey("insecure_tls") {
-		key := input.Section(outType).Key("insecure_tls")
-		boolval, err := key.Bool()
-		if err == nil {
-			if boolval == true {
-				config.TLS12Only = false
-			}
+	config.BatchMaxWait = time.Second
+	if typeSection("tcp").HasKey("batch_max_wait_ms") {
+		key := typeSection("tcp").Key("batch_max_wait_ms")
+		wait, err := key.Int64()
+		if err == nil && wait > 0 {
+			config.BatchMaxWait = time.Duration(wait) * time.Millisecond
 		} else {
-			errs.addErrorString("Unknown value for 'insecure_tls': ")
+			errs.addErrorString(fmt.Sprintf("Invalid batch_max_wait_ms: %s", key.Value()))
 		}
 	}
 
-	if input.Section(outType).HasKey("server_cname") {
-		key := input.Section(outType).Key("server_cname")
-		serverCName := key.Value()
-		config.TLSCName = &serverCName
+	if typeSection("tcp").HasKey("replay_on_reconnect") {
+		key := typeSection("tcp").Key("replay_on_reconnect")
+		count, err := key.Int()
+		if err == nil && count >= 0 {
+			config.ReplayOnReconnect = count
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid replay_on_reconnect: %s", key.Value()))
+		}
+		if config.ReplayOnReconnect > 0 && config.OutputFormat == MsgPackOutputFormat {
+			errs.addErrorString("replay_on_reconnect is not supported with output_format=msgpack")
+		}
 	}
 
-	config.TLSConfig = configureTLS(&config)
+	config.TLSConfig = configureTLS(config)
 
 	// Bundle configuration
 
@@ -901,8 +2967,8 @@ func ParseConfig(fn string) (Configuration, error) {
 		config.UploadEmptyFiles = true
 	}
 
-	if input.Section(outType).HasKey("upload_empty_files") {
-		key := input.Section(outType).Key("upload_empty_files")
+	if typeSection(outType).HasKey("upload_empty_files") {
+		key := typeSection(outType).Key("upload_empty_files")
 		boolval, err := key.Bool()
 		if err == nil {
 			if boolval == false {
@@ -913,7 +2979,9 @@ func ParseConfig(fn string) (Configuration, error) {
 		}
 	}
 
-	if config.OutputFormat == JSONOutputFormat {
+	if config.BatchEncoding != "" {
+		config.CommaSeparateEvents = config.BatchEncoding == JSONArrayBatch
+	} else if config.OutputFormat == JSONOutputFormat {
 		config.CommaSeparateEvents = true
 	} else {
 		config.CommaSeparateEvents = false
@@ -921,8 +2989,8 @@ func ParseConfig(fn string) (Configuration, error) {
 
 	// default 10MB bundle size max before forcing a send
 	config.BundleSizeMax = 10 * 1024 * 1024
-	if input.Section(outType).HasKey("bundle_size_max") {
-		key := input.Section(outType).Key("bundle_size_max")
+	if typeSection(outType).HasKey("bundle_size_max") {
+		key := typeSection(outType).Key("bundle_size_max")
 		bundleSizeMax, err := key.Int64()
 		if err == nil {
 			config.BundleSizeMax = bundleSizeMax
@@ -932,68 +3000,419 @@ func ParseConfig(fn string) (Configuration, error) {
 	// default 5 minute send interval
 	config.BundleSendTimeout = 5 * time.Minute
 
-	if input.Section(outType).HasKey("bundle_send_timeout") {
-		key := input.Section(outType).Key("bundle_send_timeout")
+	if typeSection(outType).HasKey("bundle_send_timeout") {
+		key := typeSection(outType).Key("bundle_send_timeout")
 		bundleSendTimeout, err := key.Int64()
 		if err == nil {
 			config.BundleSendTimeout = time.Duration(bundleSendTimeout) * time.Second
 		}
 	}
 
-	if input.Section("bridge").HasKey("message_processor_count") {
-		key := input.Section("bridge").Key("message_processor_count")
-		if numprocessors, err := key.Int(); err == nil {
-			config.NumProcessors = int(numprocessors)
+	if typeSection(outType).HasKey("destination_allow_cidrs") {
+		key := typeSection(outType).Key("destination_allow_cidrs")
+		allowed, err := ParseCIDRList(key.Value())
+		if err == nil {
+			config.DestinationAllowCIDRs = allowed
 		} else {
-			config.NumProcessors = runtime.NumCPU()
+			errs.addError(err)
 		}
 	}
 
-	if input.Section("bridge").HasKey("run_metrics") {
-		key := input.Section("bridge").Key("run_metrics")
-		if runMetrics, err := key.Bool(); err == nil {
-			config.RunMetrics = runMetrics
+	if len(config.TimeSource) == 0 {
+		config.TimeSource = EventTimeSource
+	}
+	if typeSection(outType).HasKey("time_source") {
+		key := typeSection(outType).Key("time_source")
+		source, err := TimeSourceFromString(key.Value())
+		if err == nil {
+			config.TimeSource = source
 		} else {
-			config.RunMetrics = false
+			errs.addError(err)
 		}
-	} else {
-		config.RunMetrics = false
 	}
 
-	if input.Section("bridge").HasKey("carbon_metrics_endpoint") {
-		key := input.Section("bridge").Key("carbon_metrics_endpoint")
-		metricsEndpoint := key.Value()
-		config.CarbonMetricsEndpoint = &metricsEndpoint
-	} else {
-		config.CarbonMetricsEndpoint = nil
+	if typeSection(outType).HasKey("max_message_size") {
+		key := typeSection(outType).Key("max_message_size")
+		maxSize, err := key.Int()
+		if err == nil && maxSize >= 0 {
+			config.MaxMessageSize = maxSize
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid max_message_size: %s", key.Value()))
+		}
 	}
 
-	config.MetricTag = "cb.eventforwarder"
-	metricTagEnv := os.Getenv("EF_METRIC_TAG")
-	if metricTagEnv != "" {
-		config.MetricTag = metricTagEnv
+	config.OversizePolicy = DropOversize
+	if typeSection(outType).HasKey("oversize_policy") {
+		key := typeSection(outType).Key("oversize_policy")
+		policy, err := OversizePolicyFromString(key.Value())
+		if err == nil {
+			config.OversizePolicy = policy
+		} else {
+			errs.addError(err)
+		}
+	}
+	if config.OversizePolicy == ChunkOversize && config.OutputFormat == MsgPackOutputFormat {
+		errs.addErrorString("oversize_policy=chunk is not supported with output_format=msgpack")
+	}
+	if config.OversizePolicy == ChunkOversize && config.MaxMessageSize > 0 && config.MaxMessageSize < minChunkedMessageSize {
+		errs.addErrorString(fmt.Sprintf("max_message_size should be at least %d bytes to split events into chunks", minChunkedMessageSize))
 	}
 
-	if input.Section("bridge").HasKey("use_time_float") {
-		key := input.Section("bridge").Key("use_time_float")
-		usetimefloat, _ := key.Bool()
-		config.UseTimeFloat = usetimefloat
-	} else {
-		config.UseTimeFloat = false
+	config.FrameCompression = NoFrameCompression
+	if typeSection("tcp").HasKey("frame_compression") {
+		key := typeSection("tcp").Key("frame_compression")
+		compression, err := FrameCompressionFromString(key.Value())
+		if err == nil {
+			config.FrameCompression = compression
+		} else {
+			errs.addError(err)
+		}
 	}
 
-	config.parseEventTypes(input)
+	config.FrameCompressionThreshold = DefaultFrameCompressionThreshold
+	if typeSection("tcp").HasKey("frame_compression_threshold") {
+		key := typeSection("tcp").Key("frame_compression_threshold")
+		threshold, err := key.Int()
+		if err == nil && threshold >= 0 {
+			config.FrameCompressionThreshold = threshold
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid frame_compression_threshold: %s", key.Value()))
+		}
+	}
+
+	// framed events are binary, so nothing else can be written to the connection as text
+	if config.FrameCompression != NoFrameCompression {
+		switch {
+		case config.OutputFormat == MsgPackOutputFormat:
+			errs.addErrorString("frame_compression is not supported with output_format=msgpack, whose events are already framed")
+		case config.OversizePolicy == ChunkOversize:
+			errs.addErrorString("frame_compression can't be used with oversize_policy=chunk")
+		case config.ReplayOnReconnect > 0:
+			errs.addErrorString("frame_compression can't be used with replay_on_reconnect")
+		case config.HeartbeatInterval > 0:
+			errs.addErrorString("frame_compression can't be used with heartbeat_interval")
+		case config.DisconnectFooter != nil:
+			errs.addErrorString("frame_compression can't be used with disconnect_footer")
+		case len(config.RotationNotice) > 0:
+			errs.addErrorString("frame_compression can't be used with rotation_notice")
+		}
+	}
+
+	// the level applies to every codec the output compresses with, so it has to be one of each
+	if outputSection.HasKey("compression_level") {
+		codecs := config.CompressionCodecs()
+		if len(codecs) == 0 {
+			log.Warnf("compression_level=%s has no effect, the output doesn't compress", config.CompressionLevel)
+		}
+		for _, codec := range codecs {
+			if err := config.CompressionLevel.validateFor(codec); err != nil {
+				errs.addError(err)
+				break
+			}
+		}
+	}
 
-	outputParameterError := config.validateOutputParameters()
-	if outputParameterError != nil {
-		errs.addError(outputParameterError)
+	// low throughput is checked for by the tcp and udp outputs, configured in their own section
+	if outType == "tcp" || outType == "udp" {
+		if typeSection(outType).HasKey("min_events_per_window") {
+			key := typeSection(outType).Key("min_events_per_window")
+			minEvents, err := key.Int64()
+			if err == nil && minEvents >= 0 {
+				config.MinEventsPerWindow = minEvents
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid min_events_per_window: %s", key.Value()))
+			}
+		}
+
+		config.ThroughputWindow = 5 * time.Minute
+		if typeSection(outType).HasKey("throughput_window") {
+			key := typeSection(outType).Key("throughput_window")
+			window, err := key.Int64()
+			if err == nil && window > 0 {
+				config.ThroughputWindow = time.Duration(window) * time.Second
+			} else {
+				errs.addErrorString(fmt.Sprintf("Invalid throughput_window: %s", key.Value()))
+			}
+		}
 	}
 
-	if !errs.Empty {
-		return config, errs
+	// UDP configuration
+
+	if typeSection("udp").HasKey("send_timeout_ms") {
+		key := typeSection("udp").Key("send_timeout_ms")
+		sendTimeout, err := key.Int64()
+		if err == nil && sendTimeout >= 0 {
+			config.UDPSendTimeout = time.Duration(sendTimeout) * time.Millisecond
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid send_timeout_ms: %s", key.Value()))
+		}
+	}
+
+	// SRV discovery of tcp and udp destinations
+	config.SRVRefreshInterval = 60 * time.Second
+	if (outType == "tcp" || outType == "udp") && typeSection(outType).HasKey("srv_refresh_interval") {
+		key := typeSection(outType).Key("srv_refresh_interval")
+		interval, err := key.Int64()
+		if err == nil && interval >= 0 {
+			config.SRVRefreshInterval = time.Duration(interval) * time.Second
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid srv_refresh_interval: %s", key.Value()))
+		}
+	}
+
+	if outputSection.HasKey("flatten") {
+		key := outputSection.Key("flatten")
+		if flatten, err := key.Bool(); err != nil {
+			errs.addErrorString("Unknown value for 'flatten': valid values are true, false, 1, 0")
+		} else if flatten {
+			config.Flatten = &FlattenOptions{Separator: ".", Arrays: FlattenArraysIndex, ArraySeparator: ",", Conflicts: config.ConflictPolicy}
+
+			if outputSection.HasKey("flatten_separator") {
+				config.Flatten.Separator = outputSection.Key("flatten_separator").Value()
+			}
+
+			if outputSection.HasKey("flatten_max_depth") {
+				key := outputSection.Key("flatten_max_depth")
+				depth, err := key.Int()
+				if err == nil && depth >= 0 {
+					config.Flatten.MaxDepth = depth
+				} else {
+					errs.addErrorString(fmt.Sprintf("Invalid flatten_max_depth: %s", key.Value()))
+				}
+			}
+
+			if outputSection.HasKey("flatten_arrays") {
+				arrays, err := FlattenArraysFromString(outputSection.Key("flatten_arrays").Value())
+				if err == nil {
+					config.Flatten.Arrays = arrays
+				} else {
+					errs.addError(err)
+				}
+			}
+
+			if outputSection.HasKey("flatten_array_separator") {
+				config.Flatten.ArraySeparator = outputSection.Key("flatten_array_separator").Value()
+			}
+		}
+	}
+
+	if outputSection.HasKey("pipeline") {
+		pipeline, err := ParsePipeline(outputSection.Key("pipeline").Value())
+		if err != nil {
+			errs.addError(err)
+		} else {
+			config.Pipeline = pipeline
+			// leaving out a stage that is configured would silently skip it
+			for _, stage := range config.configuredPipelineStages() {
+				if !pipelineHasStage(pipeline, stage) {
+					errs.addErrorString(fmt.Sprintf("pipeline is missing the %s stage, which is configured", stage))
+				}
+			}
+		}
+	}
+
+	if outputSection.HasKey("format_fallback") {
+		key := outputSection.Key("format_fallback")
+		boolval, err := key.Bool()
+		if err == nil {
+			config.FormatFallback = boolval
+		} else {
+			errs.addErrorString("Unknown value for 'format_fallback': valid values are true, false, 1, 0")
+		}
+	}
+
+	config.UTF8Policy = KeepInvalidUTF8
+	if outputSection.HasKey("utf8_policy") {
+		key := outputSection.Key("utf8_policy")
+		policy, err := UTF8PolicyFromString(key.Value())
+		if err == nil {
+			config.UTF8Policy = policy
+		} else {
+			errs.addError(err)
+		}
+	}
+
+	config.EmptyOutputPolicy = SkipEmptyOutput
+	if outputSection.HasKey("empty_output_policy") {
+		key := outputSection.Key("empty_output_policy")
+		policy, err := EmptyOutputPolicyFromString(key.Value())
+		if err == nil {
+			config.EmptyOutputPolicy = policy
+		} else {
+			errs.addError(err)
+		}
+	}
+
+	if outputSection.HasKey("max_line_bytes") {
+		key := outputSection.Key("max_line_bytes")
+		maxBytes, err := key.Int()
+		if err == nil && maxBytes >= 0 {
+			config.MaxLineBytes = maxBytes
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid max_line_bytes: %s", key.Value()))
+		}
+	}
+
+	config.LongLinePolicy = TruncateLongLines
+	if outputSection.HasKey("long_line_policy") {
+		key := outputSection.Key("long_line_policy")
+		policy, err := LongLinePolicyFromString(key.Value())
+		if err == nil {
+			config.LongLinePolicy = policy
+		} else {
+			errs.addError(err)
+		}
+	}
+	if config.MaxLineBytes > 0 && config.OutputFormat == MsgPackOutputFormat {
+		errs.addErrorString("max_line_bytes is not supported with output_format=msgpack")
+	}
+	if config.MaxLineBytes > 0 && config.LongLinePolicy == TruncateLongLines && config.OutputFormat == JSONOutputFormat {
+		errs.addErrorString("long_line_policy=truncate is not supported with output_format=json, which can't be cut and stay valid (use drop)")
+	}
+
+	// the schema is compiled once, here, rather than for every event
+	if outputSection.HasKey("schema_file") {
+		config.SchemaFile = strings.TrimSpace(outputSection.Key("schema_file").Value())
+		if len(config.SchemaFile) > 0 {
+			schema, err := jsonschema.CompileFile(config.SchemaFile)
+			if err != nil {
+				errs.addErrorString(fmt.Sprintf("Invalid schema_file: %s", err))
+			} else {
+				config.EventSchema = schema
+			}
+		}
+	}
+
+	config.SchemaStage = ValidateFormattedEvents
+	if outputSection.HasKey("schema_stage") {
+		stage, err := SchemaStageFromString(outputSection.Key("schema_stage").Value())
+		if err == nil {
+			config.SchemaStage = stage
+		} else {
+			errs.addError(err)
+		}
+	}
+	if len(config.SchemaFile) > 0 && config.SchemaStage == ValidateFormattedEvents && config.OutputFormat != JSONOutputFormat {
+		errs.addErrorString("schema_stage=formatted requires output_format=json (use schema_stage=event)")
+	}
+
+	config.SchemaFailurePolicy = DropSchemaFailures
+	if outputSection.HasKey("schema_failure_policy") {
+		policy, err := SchemaFailurePolicyFromString(outputSection.Key("schema_failure_policy").Value())
+		if err == nil {
+			config.SchemaFailurePolicy = policy
+		} else {
+			errs.addError(err)
+		}
+	}
+
+	config.ErrorLogBurst = 10
+	if outputSection.HasKey("error_log_burst") {
+		key := outputSection.Key("error_log_burst")
+		burst, err := key.Int()
+		if err == nil && burst >= 0 {
+			config.ErrorLogBurst = burst
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid error_log_burst: %s", key.Value()))
+		}
+	}
+
+	// default to one error per minute once the burst is exhausted
+	config.ErrorLogInterval = time.Minute
+	if outputSection.HasKey("error_log_interval") {
+		key := outputSection.Key("error_log_interval")
+		interval, err := key.Int64()
+		if err == nil && interval >= 0 {
+			config.ErrorLogInterval = time.Duration(interval) * time.Second
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid error_log_interval: %s", key.Value()))
+		}
+	}
+
+	// default to a buffer large enough to ride out short output stalls, blocking producers
+	// when full so that events are not lost
+	config.OutputBufferSize = DEFAULTOUTPUTBUFFERSIZE
+	if outputSection.HasKey("output_buffer_size") {
+		key := outputSection.Key("output_buffer_size")
+		bufferSize, err := key.Int()
+		if err == nil && bufferSize > 0 {
+			config.OutputBufferSize = bufferSize
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid output_buffer_size: %s", key.Value()))
+		}
+	}
+
+	if outputSection.HasKey("output_buffer_max_bytes") {
+		key := outputSection.Key("output_buffer_max_bytes")
+		maxBytes, err := key.Int64()
+		if err == nil && maxBytes >= 0 {
+			config.OutputBufferMaxBytes = maxBytes
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid output_buffer_max_bytes: %s", key.Value()))
+		}
+	}
+
+	if outputSection.HasKey("pace_eps") {
+		key := outputSection.Key("pace_eps")
+		eps, err := key.Float64()
+		// the spacing between events ranges from 100 seconds down to a nanosecond
+		if err == nil && (eps == 0 || eps >= 0.01 && eps <= 1e9) {
+			config.PaceEPS = eps
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid pace_eps: %s", key.Value()))
+		}
+	}
+
+	if outputSection.HasKey("event_max_age") {
+		key := outputSection.Key("event_max_age")
+		maxAge, err := key.Int64()
+		if err == nil && maxAge >= 0 {
+			config.EventMaxAge = time.Duration(maxAge) * time.Second
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid event_max_age: %s", key.Value()))
+		}
+	}
+
+	config.OverflowPolicy = BlockOnOverflow
+	if outputSection.HasKey("overflow_policy") {
+		key := outputSection.Key("overflow_policy")
+		policy, err := OverflowPolicyFromString(key.Value())
+		if err == nil {
+			config.OverflowPolicy = policy
+		} else {
+			errs.addError(err)
+		}
+	}
+
+	if outputSection.HasKey("disk_queue_path") {
+		config.DiskQueuePath = strings.TrimSpace(outputSection.Key("disk_queue_path").Value())
+	}
+	// default to ten million events and 1 GiB of events
+	config.DiskQueueMaxEvents = 10000000
+	if outputSection.HasKey("disk_queue_max_events") {
+		key := outputSection.Key("disk_queue_max_events")
+		maxEvents, err := key.Int64()
+		if err == nil && maxEvents >= 0 {
+			config.DiskQueueMaxEvents = maxEvents
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid disk_queue_max_events: %s", key.Value()))
+		}
+	}
+	config.DiskQueueMaxBytes = 1 << 30
+	if outputSection.HasKey("disk_queue_max_bytes") {
+		key := outputSection.Key("disk_queue_max_bytes")
+		maxBytes, err := key.Int64()
+		if err == nil && maxBytes >= 0 {
+			config.DiskQueueMaxBytes = maxBytes
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid disk_queue_max_bytes: %s", key.Value()))
+		}
 	}
-	return config, nil
 
+	outputParameterError := config.validateOutputParameters()
+	if outputParameterError != nil {
+		errs.addError(outputParameterError)
+	}
 }
 
 func configureTLS(config *Configuration) *tls.Config {
@@ -1039,6 +3458,30 @@ func configureTLS(config *Configuration) *tls.Config {
 		tlsConfig.MinVersion = tls.VersionTLS10
 	}
 
+	if config.TLSMinVersion != 0 {
+		log.Infof("Enforcing configured minimum TLS version %s", tls.VersionName(config.TLSMinVersion))
+		tlsConfig.MinVersion = config.TLSMinVersion
+	}
+
+	if len(config.TLSCipherSuites) > 0 {
+		log.Infof("Restricting TLS cipher suites to %d configured suites", len(config.TLSCipherSuites))
+		tlsConfig.CipherSuites = config.TLSCipherSuites
+	}
+
+	if len(config.TLSPinnedSHA256) > 0 {
+		if config.TLSPinOnly {
+			log.Infof("Accepting %d pinned TLS public keys without validating the certificate chain", len(config.TLSPinnedSHA256))
+			tlsConfig.InsecureSkipVerify = true
+		} else {
+			log.Infof("Requiring TLS servers to present one of %d pinned public keys", len(config.TLSPinnedSHA256))
+		}
+		tlsConfig.VerifyConnection = tlsPinVerifier(config.TLSPinnedSHA256)
+	}
+
+	if config.TLSSessionCacheSize > 0 {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(config.TLSSessionCacheSize)
+	}
+
 	return tlsConfig
 }
 
@@ -1057,14 +3500,19 @@ func (cfg *Configuration) validateOutputParameters() error {
 	return nil
 }
 
-// parseOAuthConfiguration parses OAuth related configuration from input and populates config with
-// relevant fields.
+// ParseOAuthConfiguration parses OAuth related configuration from the [http] section of input and
+// populates config with relevant fields.
 func (cfg *Configuration) ParseOAuthConfiguration(input *ini.File, errs *ConfigurationError) {
+	cfg.parseOAuthConfiguration(input.Section("http"), errs)
+}
+
+// parseOAuthConfiguration parses OAuth related configuration from the given section.
+func (cfg *Configuration) parseOAuthConfiguration(section *ini.Section, errs *ConfigurationError) {
 	// oAuthFieldsConfigured is used to track OAuth fields that have been configured.
 	oAuthFieldsConfigured := make(map[string]bool)
 
-	if input.Section("http").HasKey("oauth_jwt_client_email") {
-		key := input.Section("http").Key("oauth_jwt_client_email")
+	if section.HasKey("oauth_jwt_client_email") {
+		key := section.Key("oauth_jwt_client_email")
 		oAuthJwtClientEmail := key.Value()
 		if len(oAuthJwtClientEmail) > 0 {
 			oAuthFieldsConfigured["oauth_jwt_client_email"] = true
@@ -1074,8 +3522,8 @@ func (cfg *Configuration) ParseOAuthConfiguration(input *ini.File, errs *Configu
 		}
 	}
 
-	if input.Section("http").HasKey("oauth_jwt_private_key") {
-		key := input.Section("http").Key("oauth_jwt_private_key")
+	if section.HasKey("oauth_jwt_private_key") {
+		key := section.Key("oauth_jwt_private_key")
 		oAuthJwtPrivateKey := key.Value()
 		if len(oAuthJwtPrivateKey) > 0 {
 			oAuthFieldsConfigured["oauth_jwt_private_key"] = true
@@ -1089,8 +3537,8 @@ func (cfg *Configuration) ParseOAuthConfiguration(input *ini.File, errs *Configu
 		}
 	}
 
-	if input.Section("http").HasKey("oauth_jwt_private_key_id") {
-		key := input.Section("http").Key("oauth_jwt_private_key_id")
+	if section.HasKey("oauth_jwt_private_key_id") {
+		key := section.Key("oauth_jwt_private_key_id")
 		oAuthJwtPrivateKeyId := key.Value()
 		if len(oAuthJwtPrivateKeyId) > 0 {
 			oAuthFieldsConfigured["oauth_jwt_private_key_id"] = true
@@ -1100,8 +3548,8 @@ func (cfg *Configuration) ParseOAuthConfiguration(input *ini.File, errs *Configu
 		}
 	}
 
-	if input.Section("http").HasKey("oauth_jwt_scopes") {
-		key := input.Section("http").Key("oauth_jwt_scopes")
+	if section.HasKey("oauth_jwt_scopes") {
+		key := section.Key("oauth_jwt_scopes")
 		scopesStr := key.Value()
 		if len(scopesStr) > 0 {
 			oAuthFieldsConfigured["oauth_jwt_scopes"] = true
@@ -1122,8 +3570,8 @@ func (cfg *Configuration) ParseOAuthConfiguration(input *ini.File, errs *Configu
 
 	}
 
-	if input.Section("http").HasKey("oauth_jwt_token_url") {
-		key := input.Section("http").Key("oauth_jwt_token_url")
+	if section.HasKey("oauth_jwt_token_url") {
+		key := section.Key("oauth_jwt_token_url")
 		oAuthJwtTokenUrl := key.Value()
 		if len(oAuthJwtTokenUrl) > 0 {
 			oAuthFieldsConfigured["oauth_jwt_token_url"] = true
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+)
+
+// ConfigChange is a setting whose value differs between two configurations. The values of
+// secrets, the fields of Configuration tagged diff:"secret", are never included.
+type ConfigChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// fields left out of configuration diffs: derived from other fields, only set by code, or only
+// used at startup to find the configuration file
+var ignoredDiffFields = map[string]bool{
+	"ConfigFile":  true,
+	"TLSConfig":   true,
+	"EventMap":    true,
+	"SRVResolver": true,
+	"EventSchema": true,
+}
+
+const redactedValue = "<redacted>"
+
+// DiffConfigurations lists the settings that differ between old and updated, by field name. The
+// fields of additional outputs are prefixed with their position, as in AdditionalOutputs[0].
+func DiffConfigurations(old, updated *Configuration) []ConfigChange {
+	return diffConfigurations("", reflect.ValueOf(old).Elem(), reflect.ValueOf(updated).Elem())
+}
+
+func diffConfigurations(prefix string, old, updated reflect.Value) []ConfigChange {
+	var changes []ConfigChange
+	for i := 0; i < old.NumField(); i++ {
+		field := old.Type().Field(i)
+		if field.PkgPath != "" || ignoredDiffFields[field.Name] {
+			continue
+		}
+		oldValue, newValue := old.Field(i), updated.Field(i)
+		if reflect.DeepEqual(oldValue.Interface(), newValue.Interface()) {
+			continue
+		}
+
+		name := prefix + field.Name
+		if field.Name == "AdditionalOutputs" && oldValue.Len() == newValue.Len() {
+			for j := 0; j < oldValue.Len(); j++ {
+				changes = append(changes, diffConfigurations(fmt.Sprintf("%s[%d].", name, j), oldValue.Index(j), newValue.Index(j))...)
+			}
+			continue
+		}
+
+		if field.Name == "AdditionalOutputs" {
+			changes = append(changes, ConfigChange{
+				Field: name,
+				Old:   fmt.Sprintf("%d outputs", oldValue.Len()),
+				New:   fmt.Sprintf("%d outputs", newValue.Len()),
+			})
+			continue
+		}
+
+		// templates and other values holding functions are never deeply equal, even when parsed
+		// from the same text
+		change := ConfigChange{Field: name, Old: formatDiffValue(oldValue), New: formatDiffValue(newValue)}
+		if change.Old == change.New {
+			continue
+		}
+		if field.Tag.Get("diff") == "secret" {
+			change.Old, change.New = redactedValue, redactedValue
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// formatDiffValue prints a setting as close as possible to how it is written in the
+// configuration file.
+func formatDiffValue(value reflect.Value) string {
+	if (value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface) && value.IsNil() {
+		return ""
+	}
+
+	switch v := value.Interface().(type) {
+	case *template.Template:
+		if v.Tree == nil {
+			return v.Name()
+		}
+		return v.Tree.Root.String()
+	case []string:
+		return strings.Join(v, ",")
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	if value.Kind() == reflect.Ptr {
+		return formatDiffValue(value.Elem())
+	}
+	return fmt.Sprintf("%v", value.Interface())
+}
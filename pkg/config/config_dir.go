@@ -0,0 +1,88 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-ini/ini"
+	log "github.com/sirupsen/logrus"
+)
+
+// configDirPath returns the directory that additional outputs are loaded from, relative paths
+// being taken from the directory of the configuration file fn, or nothing when config_dir isn't
+// set.
+func configDirPath(input *ini.File, fn string) string {
+	dir := strings.TrimSpace(input.Section("bridge").Key("config_dir").Value())
+	if len(dir) > 0 && !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(fn), dir)
+	}
+	return dir
+}
+
+// loadConfigDir merges the outputs defined in the files of dir into input and returns their
+// names, in the order of the files. Each file holds the section of a single additional output,
+// named after it; files are read in lexical order, and only those ending in .conf or .ini that
+// aren't hidden. An output whose name is already used by a section of the configuration file or
+// of another file is an error, since the two would be merged silently otherwise.
+func loadConfigDir(input *ini.File, dir string, errs *ConfigurationError) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		errs.addErrorString(fmt.Sprintf("Could not read config_dir %s: %s", dir, err))
+		return nil
+	}
+
+	var names []string
+	definedIn := make(map[string]string)
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") || (ext != ".conf" && ext != ".ini") {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+
+		output, err := ini.Load(path)
+		if err != nil {
+			errs.addErrorString(fmt.Sprintf("Could not load %s: %s", path, err))
+			continue
+		}
+		var sections []*ini.Section
+		for _, section := range output.Sections() {
+			if section.Name() != ini.DEFAULT_SECTION || len(section.Keys()) > 0 {
+				sections = append(sections, section)
+			}
+		}
+		if len(sections) != 1 || sections[0].Name() == ini.DEFAULT_SECTION {
+			errs.addErrorString(fmt.Sprintf("%s should define a single output, in a section named after it", path))
+			continue
+		}
+
+		section := sections[0]
+		name := section.Name()
+		if other, ok := definedIn[name]; ok {
+			errs.addErrorString(fmt.Sprintf("Output %s is defined both in %s and in %s", name, other, path))
+			continue
+		}
+		if _, err := input.GetSection(name); err == nil {
+			errs.addErrorString(fmt.Sprintf("Output %s defined in %s conflicts with section [%s] of the configuration file", name, path, name))
+			continue
+		}
+		definedIn[name] = path
+
+		merged, err := input.NewSection(name)
+		if err != nil {
+			errs.addErrorString(fmt.Sprintf("Invalid output %s in %s: %s", name, path, err))
+			continue
+		}
+		for _, key := range section.Keys() {
+			if _, err := merged.NewKey(key.Name(), key.Value()); err != nil {
+				errs.addErrorString(fmt.Sprintf("Invalid %s in %s: %s", key.Name(), path, err))
+			}
+		}
+		log.Infof("Loaded output %s from %s", name, path)
+		names = append(names, name)
+	}
+	log.Infof("Loaded %d outputs from config_dir %s", len(names), dir)
+	return names
+}
@@ -0,0 +1,45 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseCIDRList parses a comma separated list of CIDR ranges. Plain IP addresses are accepted
+// and match only themselves.
+func ParseCIDRList(cidrString string) ([]*net.IPNet, error) {
+	var ret []*net.IPNet
+
+	for _, entry := range strings.Split(cidrString, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s in destination allowlist", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %s in destination allowlist", entry)
+		}
+		ret = append(ret, ipNet)
+	}
+
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("destination allowlist is empty")
+	}
+	return ret, nil
+}
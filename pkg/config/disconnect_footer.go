@@ -0,0 +1,28 @@
+package config
+
+import (
+	"io/ioutil"
+	"text/template"
+	"time"
+)
+
+// DisconnectFooterData is what disconnect footers are executed on, for example
+// BYE {{.EventCount}} events since {{.ConnectedAt.Unix}}
+type DisconnectFooterData struct {
+	// events sent over the connection being closed
+	EventCount  int64
+	ConnectedAt time.Time
+}
+
+// ParseDisconnectFooter parses a disconnect footer template, checking that it can be executed so
+// that mistakes are caught at startup.
+func ParseDisconnectFooter(text string) (*template.Template, error) {
+	tmpl, err := template.New("disconnect_footer").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(ioutil.Discard, DisconnectFooterData{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
@@ -0,0 +1,28 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EmptyOutputPolicy controls what happens to an event that an output's formatter reduces to
+// nothing, for example through a template that prints no text for it.
+type EmptyOutputPolicy string
+
+const (
+	// SkipEmptyOutput leaves the event out of the output, counting it as empty_output_count
+	SkipEmptyOutput EmptyOutputPolicy = "skip"
+	// ErrorOnEmptyOutput treats the event as one that could not be formatted
+	ErrorOnEmptyOutput EmptyOutputPolicy = "error"
+)
+
+func EmptyOutputPolicyFromString(policyString string) (EmptyOutputPolicy, error) {
+	switch EmptyOutputPolicy(strings.ToLower(strings.TrimSpace(policyString))) {
+	case SkipEmptyOutput:
+		return SkipEmptyOutput, nil
+	case ErrorOnEmptyOutput:
+		return ErrorOnEmptyOutput, nil
+	default:
+		return SkipEmptyOutput, fmt.Errorf("empty output policy %s not recognized (skip or error)", policyString)
+	}
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ParseEventTypePatterns parses a comma separated list of event type patterns, using the syntax
+// of filepath.Match, for example: watchlist.hit.*,alert.*
+func ParseEventTypePatterns(patternsString string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(patternsString, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if len(pattern) == 0 {
+			continue
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid event type pattern '%s': %s", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// EventTypeAllowed reports whether an event type passes the allowlist, when there is one, and
+// is not matched by the denylist.
+func EventTypeAllowed(allowlist, denylist []string, eventType string) bool {
+	if len(allowlist) > 0 && !matchesAnyPattern(allowlist, eventType) {
+		return false
+	}
+	return !matchesAnyPattern(denylist, eventType)
+}
+
+func matchesAnyPattern(patterns []string, eventType string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, eventType); matched {
+			return true
+		}
+	}
+	return false
+}
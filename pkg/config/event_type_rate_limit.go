@@ -0,0 +1,72 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// EventTypeRateLimit caps the events whose type matches TypePattern (a glob such as
+// ingress.event.filemod) at EventsPerSecond. Events over the limit are dropped, or with
+// SampleOneIn set one of every SampleOneIn of them is still forwarded.
+type EventTypeRateLimit struct {
+	TypePattern     string
+	EventsPerSecond float64
+	SampleOneIn     int
+}
+
+// ParseEventTypeRateLimits parses a comma separated list of limits in the form
+// <type pattern>:<events per second>[:drop|:sample=<n>], for example:
+// ingress.event.filemod:1000, ingress.event.netconn:500:sample=100
+func ParseEventTypeRateLimits(limitsString string) ([]EventTypeRateLimit, error) {
+	var limits []EventTypeRateLimit
+
+	for _, limitString := range strings.Split(limitsString, ",") {
+		limitString = strings.TrimSpace(limitString)
+		if len(limitString) == 0 {
+			continue
+		}
+
+		parts := strings.Split(limitString, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("Invalid event type rate limit '%s': expected <type pattern>:<events per second>[:drop|:sample=<n>]", limitString)
+		}
+
+		limit := EventTypeRateLimit{TypePattern: strings.TrimSpace(parts[0])}
+		if _, err := filepath.Match(limit.TypePattern, ""); err != nil || len(limit.TypePattern) == 0 {
+			return nil, fmt.Errorf("Invalid event type pattern in rate limit '%s'", limitString)
+		}
+
+		eps, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || eps <= 0 {
+			return nil, fmt.Errorf("Invalid events per second in rate limit '%s': must be a number above 0", limitString)
+		}
+		limit.EventsPerSecond = eps
+
+		if len(parts) == 3 {
+			action := strings.ToLower(strings.TrimSpace(parts[2]))
+			switch {
+			case action == "drop":
+			case strings.HasPrefix(action, "sample="):
+				n, err := strconv.Atoi(strings.TrimPrefix(action, "sample="))
+				if err != nil || n < 1 {
+					return nil, fmt.Errorf("Invalid sample rate in rate limit '%s': must be an integer of at least 1", limitString)
+				}
+				limit.SampleOneIn = n
+			default:
+				return nil, fmt.Errorf("Invalid action in rate limit '%s': expected drop or sample=<n>", limitString)
+			}
+		}
+
+		limits = append(limits, limit)
+	}
+
+	return limits, nil
+}
+
+// Matches reports whether the limit applies to events of the given type.
+func (limit EventTypeRateLimit) Matches(eventType string) bool {
+	matched, _ := filepath.Match(limit.TypePattern, eventType)
+	return matched
+}
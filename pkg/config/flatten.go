@@ -0,0 +1,43 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/carbonblack/cb-event-forwarder/pkg/transforms"
+)
+
+// FlattenArrays controls how flattening handles arrays.
+type FlattenArrays string
+
+const (
+	// FlattenArraysIndex gives every element its own key, suffixed with its index
+	FlattenArraysIndex FlattenArrays = "index"
+	// FlattenArraysJoin joins the elements into a single string
+	FlattenArraysJoin FlattenArrays = "join"
+)
+
+// FlattenOptions describe how nested objects are collapsed into top level keys before an
+// event is formatted, for destinations that can't handle nested json.
+type FlattenOptions struct {
+	// joins the keys of nested objects, as in process.cmdline
+	Separator string
+	// nesting levels flattened, values nested deeper are written as json strings; 0 is unlimited
+	MaxDepth       int
+	Arrays         FlattenArrays
+	ArraySeparator string
+
+	// resolves two fields flattened into the same key, as conflict_policy does for the stages
+	Conflicts transforms.ConflictPolicy
+}
+
+func FlattenArraysFromString(arraysString string) (FlattenArrays, error) {
+	switch FlattenArrays(strings.ToLower(strings.TrimSpace(arraysString))) {
+	case FlattenArraysIndex:
+		return FlattenArraysIndex, nil
+	case FlattenArraysJoin:
+		return FlattenArraysJoin, nil
+	default:
+		return FlattenArraysIndex, fmt.Errorf("flatten_arrays %s not recognized (index or join)", arraysString)
+	}
+}
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FrameCompression is the codec that tcp outputs compress events with when they frame each of
+// them with a header giving its codec and length.
+type FrameCompression string
+
+const (
+	// NoFrameCompression sends events as lines, without a header
+	NoFrameCompression   FrameCompression = "none"
+	GzipFrameCompression FrameCompression = "gzip"
+	ZstdFrameCompression FrameCompression = "zstd"
+)
+
+// default smallest event compressed, smaller ones gaining little or even growing
+const DefaultFrameCompressionThreshold = 256
+
+func FrameCompressionFromString(compressionString string) (FrameCompression, error) {
+	switch FrameCompression(strings.ToLower(strings.TrimSpace(compressionString))) {
+	case NoFrameCompression:
+		return NoFrameCompression, nil
+	case GzipFrameCompression:
+		return GzipFrameCompression, nil
+	case ZstdFrameCompression:
+		return ZstdFrameCompression, nil
+	default:
+		return NoFrameCompression, fmt.Errorf("frame compression %s not recognized (none, gzip or zstd)", compressionString)
+	}
+}
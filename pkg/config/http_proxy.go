@@ -0,0 +1,31 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// ParseHTTPProxyURL parses the URL of an HTTP proxy, as http://[user:password@]host[:port]. The
+// port defaults to 80.
+func ParseHTTPProxyURL(value string) (*url.URL, error) {
+	proxyURL, err := url.Parse(strings.TrimSpace(value))
+	if err != nil {
+		// the error quotes the URL, which may hold a password
+		return nil, fmt.Errorf("could not parse the URL")
+	}
+	if proxyURL.Scheme != "http" {
+		return nil, fmt.Errorf("%s proxies are not supported (only http)", proxyURL.Scheme)
+	}
+	if len(proxyURL.Hostname()) == 0 {
+		return nil, fmt.Errorf("the URL has no host")
+	}
+	if len(strings.Trim(proxyURL.Path, "/")) > 0 || len(proxyURL.RawQuery) > 0 {
+		return nil, fmt.Errorf("the URL should only hold the proxy's address and credentials")
+	}
+	if len(proxyURL.Port()) == 0 {
+		proxyURL.Host = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+	return proxyURL, nil
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// valid Loki label names; those starting with __ are reserved by Loki
+var lokiLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// LokiLabel names a label of the Loki stream an event is pushed to, taking its value from Field
+// of the event. Field may be a dotted path into nested objects.
+type LokiLabel struct {
+	Name  string
+	Field string
+}
+
+// ParseLokiLabels parses a comma separated list of labels taken from event fields, either as
+// <label>=<field> or as a bare field, labeled after the field with dots replaced by underscores,
+// for example: event_type=type, sensor_id, process.name
+func ParseLokiLabels(labelsString string) ([]LokiLabel, error) {
+	var labels []LokiLabel
+
+	for _, entry := range strings.Split(labelsString, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		var label LokiLabel
+		if equals := strings.IndexByte(entry, '='); equals >= 0 {
+			label = LokiLabel{Name: strings.TrimSpace(entry[:equals]), Field: strings.TrimSpace(entry[equals+1:])}
+		} else {
+			label = LokiLabel{Name: strings.Replace(entry, ".", "_", -1), Field: entry}
+		}
+		if err := validateLokiLabelName(label.Name); err != nil {
+			return nil, err
+		}
+		if len(label.Field) == 0 {
+			return nil, fmt.Errorf("Invalid Loki label '%s': no event field", entry)
+		}
+		labels = append(labels, label)
+	}
+
+	return labels, nil
+}
+
+// ParseLokiStaticLabels parses a comma separated list of labels with fixed values, added to every
+// stream, as <label>=<value>, for example: job=cb-event-forwarder, env=prod
+func ParseLokiStaticLabels(labelsString string) (map[string]string, error) {
+	labels := make(map[string]string)
+
+	for _, entry := range strings.Split(labelsString, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		equals := strings.IndexByte(entry, '=')
+		if equals < 0 || len(strings.TrimSpace(entry[equals+1:])) == 0 {
+			return nil, fmt.Errorf("Invalid Loki static label '%s': expected <label>=<value>", entry)
+		}
+		name := strings.TrimSpace(entry[:equals])
+		if err := validateLokiLabelName(name); err != nil {
+			return nil, err
+		}
+		labels[name] = strings.TrimSpace(entry[equals+1:])
+	}
+
+	return labels, nil
+}
+
+func validateLokiLabelName(name string) error {
+	if !lokiLabelName.MatchString(name) || strings.HasPrefix(name, "__") {
+		return fmt.Errorf("Invalid Loki label name '%s': letters, digits and underscores, not starting with a digit or __", name)
+	}
+	return nil
+}
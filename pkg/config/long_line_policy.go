@@ -0,0 +1,29 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// LongLinePolicy controls what happens to an event formatted as a line longer than an output's
+// max_line_bytes.
+type LongLinePolicy string
+
+const (
+	// TruncateLongLines cuts the line at a field boundary, keeping the header and the fields
+	// that fit. Lines that are not in LEEF or CEF can't be cut safely and are dropped instead.
+	TruncateLongLines LongLinePolicy = "truncate"
+	// DropLongLines leaves the event out of the output
+	DropLongLines LongLinePolicy = "drop"
+)
+
+func LongLinePolicyFromString(policyString string) (LongLinePolicy, error) {
+	switch LongLinePolicy(strings.ToLower(strings.TrimSpace(policyString))) {
+	case TruncateLongLines:
+		return TruncateLongLines, nil
+	case DropLongLines:
+		return DropLongLines, nil
+	default:
+		return TruncateLongLines, fmt.Errorf("long line policy %s not recognized (truncate or drop)", policyString)
+	}
+}
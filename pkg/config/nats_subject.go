@@ -0,0 +1,94 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// the subject token of missing and empty fields
+const natsDefaultSubjectToken = "unknown"
+
+// characters that can't appear in a subject token: whitespace separates the arguments of the
+// protocol, and * and > are wildcards
+var natsSubjectTokenEscaper = strings.NewReplacer(" ", "_", "\t", "_", "\r", "_", "\n", "_", "*", "_", ">", "_")
+
+// NATSSubjectData is what subject templates are executed on: {{.Field "type"}} is the value of a
+// top level field of the event, for example cb.{{.Field "type"}}. Dots in a value are kept, so
+// that event types such as ingress.event.procstart map to a hierarchy of subjects.
+type NATSSubjectData struct {
+	fields map[string]interface{}
+}
+
+// Field returns a field of the event made safe for a subject, or "unknown" when the event
+// doesn't have it.
+func (d NATSSubjectData) Field(name string) string {
+	var value string
+	switch v := d.fields[name].(type) {
+	case nil:
+	case string:
+		value = v
+	case json.Number:
+		value = v.String()
+	default:
+		b, _ := json.Marshal(v)
+		value = string(b)
+	}
+	if len(value) == 0 {
+		return natsDefaultSubjectToken
+	}
+	return natsSubjectTokenEscaper.Replace(value)
+}
+
+// ParseNATSSubject parses a subject template, checking that it renders a subject that events can
+// be published to so that mistakes are caught at startup.
+func ParseNATSSubject(text string) (*template.Template, error) {
+	text = strings.TrimSpace(text)
+	if len(text) == 0 {
+		return nil, fmt.Errorf("empty subject")
+	}
+	tmpl, err := template.New("nats_subject").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	subject, err := executeNATSSubject(tmpl, NATSSubjectData{})
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range strings.Split(subject, ".") {
+		if token == "*" || token == ">" || strings.ContainsAny(token, " \t\r\n") {
+			return nil, fmt.Errorf("events can't be published to subject %s", subject)
+		}
+	}
+	return tmpl, nil
+}
+
+// NATSSubject returns the subject that an event is published to. Events that are not json
+// objects have no fields.
+func NATSSubject(tmpl *template.Template, message string) (string, error) {
+	var data NATSSubjectData
+	decoder := json.NewDecoder(strings.NewReader(message))
+	decoder.UseNumber()
+	if decoder.Decode(&data.fields) != nil {
+		data.fields = nil
+	}
+	return executeNATSSubject(tmpl, data)
+}
+
+// executeNATSSubject renders a subject, replacing the empty tokens left by values starting or
+// ending with a dot, or by missing text around them.
+func executeNATSSubject(tmpl *template.Template, data NATSSubjectData) (string, error) {
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	tokens := strings.Split(b.String(), ".")
+	for i, token := range tokens {
+		if len(token) == 0 {
+			tokens[i] = natsDefaultSubjectToken
+		}
+	}
+	return strings.Join(tokens, "."), nil
+}
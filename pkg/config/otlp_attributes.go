@@ -0,0 +1,66 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// the protocols OTLP logs are exported with
+const (
+	OTLPGRPCProtocol = "grpc"
+	OTLPHTTPProtocol = "http/protobuf"
+)
+
+// OTLPAttribute names an attribute of the log records of events, taking its value from Field of
+// the event. Field may be a dotted path into nested objects.
+type OTLPAttribute struct {
+	Name  string
+	Field string
+}
+
+// ParseOTLPAttributes parses a comma separated list of attributes taken from event fields, either
+// as <attribute>=<field> or as a bare field, named after it, for example:
+// cb.event_type=type, sensor_id, process.name
+func ParseOTLPAttributes(attributesString string) ([]OTLPAttribute, error) {
+	var attributes []OTLPAttribute
+
+	for _, entry := range strings.Split(attributesString, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		attribute := OTLPAttribute{Name: entry, Field: entry}
+		if equals := strings.IndexByte(entry, '='); equals >= 0 {
+			attribute = OTLPAttribute{Name: strings.TrimSpace(entry[:equals]), Field: strings.TrimSpace(entry[equals+1:])}
+		}
+		if len(attribute.Name) == 0 || len(attribute.Field) == 0 {
+			return nil, fmt.Errorf("Invalid OTLP attribute '%s': expected <attribute>=<field> or <field>", entry)
+		}
+		attributes = append(attributes, attribute)
+	}
+
+	return attributes, nil
+}
+
+// ParseOTLPResourceAttributes parses a comma separated list of attributes of the resource the
+// events are exported as, with fixed values, as <attribute>=<value>, for example:
+// service.name=cb-event-forwarder, deployment.environment=prod
+func ParseOTLPResourceAttributes(attributesString string) (map[string]string, error) {
+	attributes := make(map[string]string)
+
+	for _, entry := range strings.Split(attributesString, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		equals := strings.IndexByte(entry, '=')
+		if equals < 0 || len(strings.TrimSpace(entry[:equals])) == 0 || len(strings.TrimSpace(entry[equals+1:])) == 0 {
+			return nil, fmt.Errorf("Invalid OTLP resource attribute '%s': expected <attribute>=<value>", entry)
+		}
+		attributes[strings.TrimSpace(entry[:equals])] = strings.TrimSpace(entry[equals+1:])
+	}
+
+	return attributes, nil
+}
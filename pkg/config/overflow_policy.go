@@ -0,0 +1,40 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OverflowPolicy controls what happens to an event when an output's buffer is full.
+type OverflowPolicy string
+
+const (
+	// BlockOnOverflow waits for the output to catch up, holding back every other output
+	BlockOnOverflow OverflowPolicy = "block"
+	// DropNewestOnOverflow discards the incoming event for this output only, keeping the
+	// buffered events in order
+	DropNewestOnOverflow OverflowPolicy = "drop-newest"
+	// DropOldestOnOverflow discards the oldest buffered event to make room for the incoming one,
+	// keeping the most recent events
+	DropOldestOnOverflow OverflowPolicy = "drop-oldest"
+	// DropOnOverflow is what drop-newest was called before drop-oldest was added
+	DropOnOverflow = DropNewestOnOverflow
+)
+
+func OverflowPolicyFromString(policyString string) (OverflowPolicy, error) {
+	switch OverflowPolicy(strings.ToLower(strings.TrimSpace(policyString))) {
+	case BlockOnOverflow:
+		return BlockOnOverflow, nil
+	case DropNewestOnOverflow, "drop":
+		return DropNewestOnOverflow, nil
+	case DropOldestOnOverflow:
+		return DropOldestOnOverflow, nil
+	default:
+		return BlockOnOverflow, fmt.Errorf("overflow policy %s not recognized (block, drop-newest or drop-oldest)", policyString)
+	}
+}
+
+// Drops tells if the policy drops events rather than waiting for the output.
+func (policy OverflowPolicy) Drops() bool {
+	return policy == DropNewestOnOverflow || policy == DropOldestOnOverflow
+}
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// smallest max_message_size that leaves room for chunk headers
+const minChunkedMessageSize = 128
+
+// OversizePolicy controls what a net output does with an event larger than its maximum
+// message size.
+type OversizePolicy string
+
+const (
+	// DropOversize discards the event
+	DropOversize OversizePolicy = "drop"
+	// ChunkOversize splits the event into numbered chunks that the collector reassembles
+	ChunkOversize OversizePolicy = "chunk"
+)
+
+func OversizePolicyFromString(policyString string) (OversizePolicy, error) {
+	switch OversizePolicy(strings.ToLower(strings.TrimSpace(policyString))) {
+	case DropOversize:
+		return DropOversize, nil
+	case ChunkOversize:
+		return ChunkOversize, nil
+	default:
+		return DropOversize, fmt.Errorf("oversize policy %s not recognized (drop or chunk)", policyString)
+	}
+}
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PipelineStage is a step that changes events on their way to an output, before they are
+// formatted.
+type PipelineStage string
+
+const (
+	// PipelineTransform runs the transform script
+	PipelineTransform PipelineStage = "transform"
+	// PipelineCoerce converts the fields listed in coerce_fields
+	PipelineCoerce PipelineStage = "coerce"
+	// PipelineFlatten collapses nested objects into top level keys
+	PipelineFlatten PipelineStage = "flatten"
+)
+
+// DefaultPipeline is the order of the stages of outputs that don't set pipeline.
+var DefaultPipeline = []PipelineStage{PipelineTransform, PipelineCoerce, PipelineFlatten}
+
+// ParsePipeline parses a comma separated list of stage names, each of which can only appear once.
+func ParsePipeline(pipelineString string) ([]PipelineStage, error) {
+	var stages []PipelineStage
+	seen := make(map[PipelineStage]bool)
+	for _, name := range strings.Split(pipelineString, ",") {
+		stage := PipelineStage(strings.ToLower(strings.TrimSpace(name)))
+		if len(stage) == 0 {
+			continue
+		}
+		switch stage {
+		case PipelineTransform, PipelineCoerce, PipelineFlatten:
+		default:
+			return nil, fmt.Errorf("pipeline stage %s not recognized (transform, coerce or flatten)", name)
+		}
+		if seen[stage] {
+			return nil, fmt.Errorf("pipeline stage %s is listed more than once", stage)
+		}
+		seen[stage] = true
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
+// PipelineStages returns the order of the output's stages.
+func (cfg *Configuration) PipelineStages() []PipelineStage {
+	if len(cfg.Pipeline) == 0 {
+		return DefaultPipeline
+	}
+	return cfg.Pipeline
+}
+
+// configuredPipelineStages returns the stages that have something to do for the output.
+func (cfg *Configuration) configuredPipelineStages() []PipelineStage {
+	var stages []PipelineStage
+	if cfg.Transform != nil {
+		stages = append(stages, PipelineTransform)
+	}
+	if cfg.Coercions != nil {
+		stages = append(stages, PipelineCoerce)
+	}
+	if cfg.Flatten != nil {
+		stages = append(stages, PipelineFlatten)
+	}
+	return stages
+}
+
+// SharedPipelineStages returns the stages that every output runs first, in the same order, and
+// that don't depend on the output: these run once for every event, before it is sent to the
+// outputs, rather than once per output.
+func (cfg *Configuration) SharedPipelineStages() []PipelineStage {
+	shared := cfg.PipelineStages()
+	for i := range cfg.AdditionalOutputs {
+		stages := cfg.AdditionalOutputs[i].PipelineStages()
+		n := 0
+		for n < len(shared) && n < len(stages) && shared[n] == stages[n] {
+			n++
+		}
+		shared = shared[:n]
+	}
+	for i, stage := range shared {
+		if stage == PipelineFlatten {
+			shared = shared[:i]
+			break
+		}
+	}
+
+	// the conflict policy follows the writes of an event through the stages of a single run of
+	// the pipeline, so the stages it tracks are either all shared or all run by each output
+	if cfg.ConflictPolicy.TracksWrites() {
+		for _, output := range cfg.pipelineConfigs() {
+			for _, stage := range output.PipelineStages()[len(shared):] {
+				if stage != PipelineFlatten && pipelineHasStage(cfg.configuredPipelineStages(), stage) {
+					return nil
+				}
+			}
+		}
+	}
+	return shared
+}
+
+// pipelineConfigs returns the configuration of the main output followed by the additional ones.
+func (cfg *Configuration) pipelineConfigs() []*Configuration {
+	configs := []*Configuration{cfg}
+	for i := range cfg.AdditionalOutputs {
+		configs = append(configs, &cfg.AdditionalOutputs[i])
+	}
+	return configs
+}
+
+func pipelineHasStage(pipeline []PipelineStage, stage PipelineStage) bool {
+	for _, s := range pipeline {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type S3PartitionMode string
+
+const (
+	// every partition seen by an upload worker has its own object, rolled independently
+	BufferPerPartition S3PartitionMode = "buffer"
+	// an upload worker has a single object, rolled whenever an event for another partition arrives
+	RollOnPartitionChange S3PartitionMode = "roll"
+)
+
+func S3PartitionModeFromString(modeString string) (S3PartitionMode, error) {
+	switch S3PartitionMode(strings.ToLower(strings.TrimSpace(modeString))) {
+	case BufferPerPartition:
+		return BufferPerPartition, nil
+	case RollOnPartitionChange:
+		return RollOnPartitionChange, nil
+	default:
+		return BufferPerPartition, fmt.Errorf("partition_mode %s not recognized (buffer or roll)", modeString)
+	}
+}
+
+// the partition value Hive uses for missing and empty values
+const s3DefaultPartitionValue = "__HIVE_DEFAULT_PARTITION__"
+
+// characters that can't appear in a partition value without changing the object key's layout
+var s3PartitionValueEscaper = strings.NewReplacer("%", "%25", "/", "%2F", "=", "%3D", "\\", "%5C")
+
+// S3PartitionData is what object key templates are executed on: {{.Field "type"}} is the value
+// of a top level field of the event and {{.Time}} the event's timestamp, for example
+// type={{.Field "type"}}/dt={{.Time.Format "2006-01-02"}}/hour={{.Time.Format "15"}}
+type S3PartitionData struct {
+	Time   time.Time
+	fields map[string]interface{}
+}
+
+// Field returns a field of the event escaped for use as a partition value, or Hive's default
+// partition value when the event doesn't have it.
+func (d S3PartitionData) Field(name string) string {
+	var value string
+	switch v := d.fields[name].(type) {
+	case nil:
+	case string:
+		value = v
+	case json.Number:
+		value = v.String()
+	default:
+		b, _ := json.Marshal(v)
+		value = string(b)
+	}
+	if len(value) == 0 {
+		return s3DefaultPartitionValue
+	}
+	return s3PartitionValueEscaper.Replace(value)
+}
+
+// ParseS3KeyTemplate parses an object key template, checking that it can be executed on an event
+// so that mistakes are caught at startup.
+func ParseS3KeyTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("s3_object_key").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := executeS3KeyTemplate(tmpl, S3PartitionData{Time: time.Unix(0, 0).UTC()}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// S3Partition returns the partition of the object key that an event belongs to, and whether the
+// time source fell back to the ingest time for it. Events that are not json objects have no
+// fields.
+func S3Partition(tmpl *template.Template, message string, source TimeSource, ingest time.Time) (string, bool, error) {
+	var data S3PartitionData
+	decoder := json.NewDecoder(strings.NewReader(message))
+	decoder.UseNumber()
+	if decoder.Decode(&data.fields) != nil {
+		data.fields = nil
+	}
+
+	eventTime, fellBack := source.EventTime(data.fields, ingest)
+	data.Time = eventTime.UTC()
+	partition, err := executeS3KeyTemplate(tmpl, data)
+	return partition, fellBack, err
+}
+
+func executeS3KeyTemplate(tmpl *template.Template, data S3PartitionData) (string, error) {
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return strings.Trim(b.String(), "/"), nil
+}
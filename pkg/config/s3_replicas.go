@@ -0,0 +1,39 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseS3Replicas parses a comma separated list of (region):(bucket-name) targets. A bucket name
+// alone is in the us-east-1 region, like in s3out.
+func ParseS3Replicas(value string) ([]string, error) {
+	var replicas []string
+	seen := make(map[string]bool)
+	for _, replica := range strings.Split(value, ",") {
+		replica = strings.TrimSpace(replica)
+		if len(replica) == 0 {
+			continue
+		}
+
+		parts := strings.Split(replica, ":")
+		switch {
+		case len(parts) > 2:
+			return nil, fmt.Errorf("%s should look like (region):(bucket-name)", replica)
+		case len(parts[0]) == 0 || len(parts[len(parts)-1]) == 0:
+			return nil, fmt.Errorf("%s is missing its region or bucket name", replica)
+		}
+		if len(parts) == 1 {
+			replica = "us-east-1:" + replica
+		}
+		if seen[replica] {
+			return nil, fmt.Errorf("%s is listed more than once", replica)
+		}
+		seen[replica] = true
+		replicas = append(replicas, replica)
+	}
+	if len(replicas) == 0 {
+		return nil, fmt.Errorf("no targets listed")
+	}
+	return replicas, nil
+}
@@ -0,0 +1,181 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ScheduleAction is what happens to an event matched by a schedule rule.
+type ScheduleAction string
+
+const (
+	ScheduleForward ScheduleAction = "forward"
+	// ScheduleBuffer holds the event until a rule allows forwarding it
+	ScheduleBuffer ScheduleAction = "buffer"
+	ScheduleDrop   ScheduleAction = "drop"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ScheduleRule applies Action to events whose type matches TypePattern (a glob such as
+// alert.watchlist.*) during a window. The window is limited to Days when HasDays is set, and to
+// the minutes of the day between Start and End when HasTime is set. Windows where End is before
+// Start span midnight.
+type ScheduleRule struct {
+	TypePattern string
+	Days        [7]bool
+	HasDays     bool
+	Start       int
+	End         int
+	HasTime     bool
+	Action      ScheduleAction
+}
+
+// ParseScheduleRules parses a comma separated list of rules in the form
+// <type pattern>[@[<days>] [<hh:mm>-<hh:mm>]]=<action>, where days is a '+' separated list of
+// days or day ranges, for example: alert.*@mon-fri 09:00-17:00=forward, alert.*=buffer
+func ParseScheduleRules(rulesString string) ([]ScheduleRule, error) {
+	var rules []ScheduleRule
+
+	for _, ruleString := range strings.Split(rulesString, ",") {
+		ruleString = strings.TrimSpace(ruleString)
+		if len(ruleString) == 0 {
+			continue
+		}
+
+		sep := strings.LastIndex(ruleString, "=")
+		if sep < 0 {
+			return nil, fmt.Errorf("Invalid schedule rule '%s': expected <type pattern>[@<window>]=<action>", ruleString)
+		}
+
+		rule := ScheduleRule{TypePattern: strings.TrimSpace(ruleString[:sep])}
+
+		switch action := ScheduleAction(strings.ToLower(strings.TrimSpace(ruleString[sep+1:]))); action {
+		case ScheduleForward, ScheduleBuffer, ScheduleDrop:
+			rule.Action = action
+		default:
+			return nil, fmt.Errorf("Invalid action in schedule rule '%s' (forward, buffer or drop)", ruleString)
+		}
+
+		if at := strings.Index(rule.TypePattern, "@"); at >= 0 {
+			if err := rule.parseWindow(rule.TypePattern[at+1:]); err != nil {
+				return nil, fmt.Errorf("Invalid window in schedule rule '%s': %s", ruleString, err)
+			}
+			rule.TypePattern = strings.TrimSpace(rule.TypePattern[:at])
+		}
+
+		if _, err := filepath.Match(rule.TypePattern, ""); err != nil || len(rule.TypePattern) == 0 {
+			return nil, fmt.Errorf("Invalid event type pattern in schedule rule '%s'", ruleString)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func (rule *ScheduleRule) parseWindow(window string) error {
+	fields := strings.Fields(window)
+	if len(fields) == 0 {
+		return fmt.Errorf("empty window")
+	}
+
+	for _, field := range fields {
+		if strings.Contains(field, ":") {
+			if rule.HasTime {
+				return fmt.Errorf("more than one time range")
+			}
+			times := strings.Split(field, "-")
+			if len(times) != 2 {
+				return fmt.Errorf("time range '%s' should look like hh:mm-hh:mm", field)
+			}
+			var err error
+			if rule.Start, err = parseTimeOfDay(times[0]); err != nil {
+				return err
+			}
+			if rule.End, err = parseTimeOfDay(times[1]); err != nil {
+				return err
+			}
+			rule.HasTime = true
+			continue
+		}
+
+		if rule.HasDays {
+			return fmt.Errorf("more than one list of days")
+		}
+		for _, days := range strings.Split(strings.ToLower(field), "+") {
+			bounds := strings.Split(days, "-")
+			first, ok := weekdays[bounds[0]]
+			last := first
+			if ok && len(bounds) == 2 {
+				last, ok = weekdays[bounds[1]]
+			}
+			if !ok || len(bounds) > 2 {
+				return fmt.Errorf("unknown days '%s' (use sun, mon, tue, wed, thu, fri, sat)", days)
+			}
+			for day := first; ; day = (day + 1) % 7 {
+				rule.Days[day] = true
+				if day == last {
+					break
+				}
+			}
+		}
+		rule.HasDays = true
+	}
+	return nil
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time '%s', expected hh:mm", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Matches reports whether the rule applies to an event of the given type at time now. For
+// windows spanning midnight, the days refer to the day the window starts.
+func (rule ScheduleRule) Matches(eventType string, now time.Time) bool {
+	if matched, _ := filepath.Match(rule.TypePattern, eventType); !matched {
+		return false
+	}
+
+	day := now.Weekday()
+	if rule.HasTime {
+		minute := now.Hour()*60 + now.Minute()
+		switch {
+		case rule.Start <= rule.End:
+			if minute < rule.Start || minute >= rule.End {
+				return false
+			}
+		case minute < rule.End:
+			// early morning part of a window that started the day before
+			day = (day + 6) % 7
+		case minute < rule.Start:
+			return false
+		}
+	}
+
+	return !rule.HasDays || rule.Days[day]
+}
+
+// ScheduleActionFor returns the action of the first rule matching the event, or forward when no
+// rule matches.
+func ScheduleActionFor(rules []ScheduleRule, eventType string, now time.Time) ScheduleAction {
+	for _, rule := range rules {
+		if rule.Matches(eventType, now) {
+			return rule.Action
+		}
+	}
+	return ScheduleForward
+}
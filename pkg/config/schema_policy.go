@@ -0,0 +1,50 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SchemaStage is the point of an output's pipeline at which events are validated against its
+// schema_file.
+type SchemaStage string
+
+const (
+	// ValidateFormattedEvents validates the message sent to the output, which has to be json
+	ValidateFormattedEvents SchemaStage = "formatted"
+	// ValidateEventsBeforeFormat validates the event once through the transform, coerce and
+	// flatten stages, right before it is formatted
+	ValidateEventsBeforeFormat SchemaStage = "event"
+)
+
+func SchemaStageFromString(stageString string) (SchemaStage, error) {
+	switch SchemaStage(strings.ToLower(strings.TrimSpace(stageString))) {
+	case ValidateFormattedEvents:
+		return ValidateFormattedEvents, nil
+	case ValidateEventsBeforeFormat:
+		return ValidateEventsBeforeFormat, nil
+	default:
+		return ValidateFormattedEvents, fmt.Errorf("schema stage %s not recognized (formatted or event)", stageString)
+	}
+}
+
+// SchemaFailurePolicy controls what happens to an event that doesn't match an output's schema.
+type SchemaFailurePolicy string
+
+const (
+	// DropSchemaFailures leaves the event out of the output
+	DropSchemaFailures SchemaFailurePolicy = "drop"
+	// DeadLetterSchemaFailures appends the event to the dead_letter_file instead of sending it
+	DeadLetterSchemaFailures SchemaFailurePolicy = "dead-letter"
+)
+
+func SchemaFailurePolicyFromString(policyString string) (SchemaFailurePolicy, error) {
+	switch SchemaFailurePolicy(strings.ToLower(strings.TrimSpace(policyString))) {
+	case DropSchemaFailures:
+		return DropSchemaFailures, nil
+	case DeadLetterSchemaFailures:
+		return DeadLetterSchemaFailures, nil
+	default:
+		return DropSchemaFailures, fmt.Errorf("schema failure policy %s not recognized (drop or dead-letter)", policyString)
+	}
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultSplunkHECSourceType is the sourcetype of the events sent to Splunk HEC, unless
+// sourcetype or an override of their event type says otherwise.
+const DefaultSplunkHECSourceType = "bit9:carbonblack:json"
+
+// EventTypeValue is a value given to the events whose type matches TypePattern.
+type EventTypeValue struct {
+	TypePattern string
+	Value       string
+}
+
+// ParseEventTypeValues parses a comma separated list of <type pattern>=<value> pairs, where the
+// patterns use the syntax of filepath.Match, for example: alert.*=alerts,ingress.event.*=raw
+func ParseEventTypeValues(valuesString string) ([]EventTypeValue, error) {
+	var values []EventTypeValue
+	for _, pair := range strings.Split(valuesString, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+
+		separator := strings.Index(pair, "=")
+		if separator < 0 {
+			return nil, fmt.Errorf("Invalid event type value '%s': expected <type pattern>=<value>", pair)
+		}
+		value := EventTypeValue{TypePattern: strings.TrimSpace(pair[:separator]), Value: strings.TrimSpace(pair[separator+1:])}
+		if _, err := filepath.Match(value.TypePattern, ""); err != nil || len(value.TypePattern) == 0 {
+			return nil, fmt.Errorf("Invalid event type pattern in '%s'", pair)
+		}
+		if len(value.Value) == 0 {
+			return nil, fmt.Errorf("Invalid event type value '%s': the value is empty", pair)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// MatchEventTypeValue returns the value of the first pattern that eventType matches.
+func MatchEventTypeValue(values []EventTypeValue, eventType string) (string, bool) {
+	for _, value := range values {
+		if matched, _ := filepath.Match(value.TypePattern, eventType); matched {
+			return value.Value, true
+		}
+	}
+	return "", false
+}
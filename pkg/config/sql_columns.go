@@ -0,0 +1,80 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// valid column and table names, unquoted; tables may be qualified with their schema
+var (
+	sqlIdentifier      = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	sqlTableIdentifier = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*\.)?[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// SQLColumn maps Field of the events, which may be a dotted path into nested objects, to a column
+// of the table the sql output inserts into. With Timestamp, the field holds seconds since the
+// epoch and is inserted as a timestamp.
+type SQLColumn struct {
+	Name      string
+	Field     string
+	Timestamp bool
+}
+
+// ParseSQLColumns parses a comma separated list of columns, either as <column>=<field>[:timestamp]
+// or as a bare field, inserted into the column named after it with dots replaced by underscores,
+// for example: event_type=type, sensor_id, event_time=timestamp:timestamp
+func ParseSQLColumns(columnsString string) ([]SQLColumn, error) {
+	var columns []SQLColumn
+	names := make(map[string]bool)
+
+	for _, entry := range strings.Split(columnsString, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		var column SQLColumn
+		field := entry
+		if equals := strings.IndexByte(entry, '='); equals >= 0 {
+			column.Name = strings.TrimSpace(entry[:equals])
+			field = strings.TrimSpace(entry[equals+1:])
+		}
+		if colon := strings.LastIndexByte(field, ':'); colon >= 0 {
+			if conversion := strings.ToLower(strings.TrimSpace(field[colon+1:])); conversion != "timestamp" {
+				return nil, fmt.Errorf("Invalid sql column '%s': unknown conversion %s (timestamp)", entry, conversion)
+			}
+			column.Timestamp = true
+			field = strings.TrimSpace(field[:colon])
+		}
+		column.Field = field
+		if len(column.Name) == 0 {
+			column.Name = strings.Replace(field, ".", "_", -1)
+		}
+
+		if len(column.Field) == 0 {
+			return nil, fmt.Errorf("Invalid sql column '%s': no event field", entry)
+		}
+		if !sqlIdentifier.MatchString(column.Name) {
+			return nil, fmt.Errorf("Invalid sql column name '%s': letters, digits and underscores, not starting with a digit", column.Name)
+		}
+		if names[strings.ToLower(column.Name)] {
+			return nil, fmt.Errorf("Duplicate sql column '%s'", column.Name)
+		}
+		names[strings.ToLower(column.Name)] = true
+		columns = append(columns, column)
+	}
+
+	return columns, nil
+}
+
+// ValidSQLColumnName tells if name can be used as a column name.
+func ValidSQLColumnName(name string) bool {
+	return sqlIdentifier.MatchString(name)
+}
+
+// ValidSQLTableName tells if name can be used as a table name, optionally qualified with its
+// schema as <schema>.<table>.
+func ValidSQLTableName(name string) bool {
+	return sqlTableIdentifier.MatchString(name)
+}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SyslogSeverityRule assigns Severity to events whose type matches TypePattern (a glob such
+// as alert.watchlist.*) and, when HasMinScore is set, whose score is at least MinScore.
+type SyslogSeverityRule struct {
+	TypePattern string
+	MinScore    float64
+	HasMinScore bool
+	Severity    int
+}
+
+// ParseSyslogSeverityRules parses a comma separated list of rules in the form
+// <type pattern>[@<min score>]:<severity>, for example: alert.*@80:2, alert.*:4, feed.*:5
+func ParseSyslogSeverityRules(rulesString string) ([]SyslogSeverityRule, error) {
+	var rules []SyslogSeverityRule
+
+	for _, ruleString := range strings.Split(rulesString, ",") {
+		ruleString = strings.TrimSpace(ruleString)
+		if len(ruleString) == 0 {
+			continue
+		}
+
+		sep := strings.LastIndex(ruleString, ":")
+		if sep < 0 {
+			return nil, fmt.Errorf("Invalid syslog severity rule '%s': expected <type pattern>[@<min score>]:<severity>", ruleString)
+		}
+
+		severity, err := ParseSyslogSeverity(strings.TrimSpace(ruleString[sep+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid syslog severity rule '%s': %s", ruleString, err)
+		}
+
+		rule := SyslogSeverityRule{TypePattern: strings.TrimSpace(ruleString[:sep]), Severity: severity}
+
+		if at := strings.Index(rule.TypePattern, "@"); at >= 0 {
+			rule.MinScore, err = strconv.ParseFloat(strings.TrimSpace(rule.TypePattern[at+1:]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid minimum score in syslog severity rule '%s'", ruleString)
+			}
+			rule.HasMinScore = true
+			rule.TypePattern = strings.TrimSpace(rule.TypePattern[:at])
+		}
+
+		if _, err := filepath.Match(rule.TypePattern, ""); err != nil || len(rule.TypePattern) == 0 {
+			return nil, fmt.Errorf("Invalid event type pattern in syslog severity rule '%s'", ruleString)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// Matches reports whether the rule applies to an event of the given type and score.
+func (rule SyslogSeverityRule) Matches(eventType string, score float64, hasScore bool) bool {
+	if matched, _ := filepath.Match(rule.TypePattern, eventType); !matched {
+		return false
+	}
+	if rule.HasMinScore {
+		return hasScore && score >= rule.MinScore
+	}
+	return true
+}
+
+func ParseSyslogSeverity(severityString string) (int, error) {
+	severity, err := strconv.Atoi(severityString)
+	if err != nil || severity < 0 || severity > 7 {
+		return 0, fmt.Errorf("syslog severity must be an integer between 0 and 7, got '%s'", severityString)
+	}
+	return severity, nil
+}
+
+func ParseSyslogFacility(facilityString string) (int, error) {
+	facility, err := strconv.Atoi(facilityString)
+	if err != nil || facility < 0 || facility > 23 {
+		return 0, fmt.Errorf("syslog facility must be an integer between 0 and 23, got '%s'", facilityString)
+	}
+	return facility, nil
+}
+
+// the default SD-ID of the structured data of RFC 5424 messages; 32473 is the private
+// enterprise number reserved for documentation
+const DefaultSyslogStructuredDataID = "cb@32473"
+
+// limits of the size of the RFC 5424 messages sent over udp: the largest payload of an IPv4
+// datagram, and the size RFC 5426 requires every receiver to accept
+const (
+	DefaultSyslogMaxMessageSize = 65507
+	MinSyslogMaxMessageSize     = 480
+)
+
+// ValidSyslogSDName reports whether name can be used as an SD-ID or PARAM-NAME in RFC 5424
+// structured data: 1 to 32 printable ASCII characters other than '=', ' ', ']' and '"'.
+func ValidSyslogSDName(name string) bool {
+	if len(name) == 0 || len(name) > 32 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c < 33 || c > 126 || c == '=' || c == ']' || c == '"' {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseSyslogStructuredDataFields parses a comma separated list of the top level event fields
+// copied into the structured data of RFC 5424 messages.
+func ParseSyslogStructuredDataFields(fieldsString string) ([]string, error) {
+	var fields []string
+	for _, field := range strings.Split(fieldsString, ",") {
+		if field = strings.TrimSpace(field); len(field) == 0 {
+			continue
+		}
+		if !ValidSyslogSDName(field) {
+			return nil, fmt.Errorf("'%s' can't be a structured data parameter name: it must have up to 32 printable characters other than '=', ']' and '\"'", field)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TimeSource controls which time the time based features file an event under: S3 object key
+// templates, bucket files and schedule rules.
+type TimeSource string
+
+const (
+	// EventTimeSource uses the event's timestamp field, falling back to the ingest time for
+	// events without a usable one
+	EventTimeSource TimeSource = "event"
+	// IngestTimeSource uses the time the forwarder handles the event
+	IngestTimeSource TimeSource = "ingest"
+)
+
+func TimeSourceFromString(sourceString string) (TimeSource, error) {
+	switch strings.ToLower(strings.TrimSpace(sourceString)) {
+	case string(EventTimeSource):
+		return EventTimeSource, nil
+	// received is what bucket_time called it
+	case string(IngestTimeSource), "received":
+		return IngestTimeSource, nil
+	default:
+		return "", fmt.Errorf("time source %s not recognized (event or ingest)", sourceString)
+	}
+}
+
+// EventTimestamp returns the timestamp field of a parsed event, in seconds since the epoch.
+func EventTimestamp(fields map[string]interface{}) (time.Time, bool) {
+	var seconds float64
+	switch timestamp := fields["timestamp"].(type) {
+	case json.Number:
+		var err error
+		if seconds, err = timestamp.Float64(); err != nil {
+			return time.Time{}, false
+		}
+	case float64:
+		seconds = timestamp
+	default:
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second))), true
+}
+
+// EventTime returns the time an event is filed under, and whether the event time source had to
+// fall back to the ingest time because the event has no usable timestamp.
+func (source TimeSource) EventTime(fields map[string]interface{}, ingest time.Time) (time.Time, bool) {
+	if source != EventTimeSource {
+		return ingest, false
+	}
+	if timestamp, ok := EventTimestamp(fields); ok {
+		return timestamp, false
+	}
+	return ingest, true
+}
+
+// MessageTime is EventTime for a formatted event, only decoding it when its timestamp is needed.
+// Events that are not json objects fall back to the ingest time.
+func (source TimeSource) MessageTime(message string, ingest time.Time) (time.Time, bool) {
+	if source != EventTimeSource {
+		return ingest, false
+	}
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(message))
+	decoder.UseNumber()
+	if decoder.Decode(&fields) != nil {
+		return ingest, true
+	}
+	return source.EventTime(fields, ingest)
+}
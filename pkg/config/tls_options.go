@@ -0,0 +1,117 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSVersionFromString accepts versions written as 1.2 or TLSv1.2
+func TLSVersionFromString(versionString string) (uint16, error) {
+	v := strings.ToLower(strings.TrimSpace(versionString))
+	v = strings.TrimPrefix(strings.TrimPrefix(v, "tls"), "v")
+	if version, ok := tlsVersions[v]; ok {
+		return version, nil
+	}
+	return 0, fmt.Errorf("TLS version %s not recognized (1.0, 1.1, 1.2 or 1.3)", versionString)
+}
+
+// TLSCipherSuitesFromString parses a comma separated list of cipher suite names, as
+// named by the crypto/tls package (for example TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)
+func TLSCipherSuitesFromString(suitesString string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	var names []string
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+		names = append(names, suite.Name)
+	}
+
+	var suites []uint16
+	for _, name := range strings.Split(suitesString, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if len(name) == 0 {
+			continue
+		}
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("TLS cipher suite %s not recognized, valid names are: %s", name, strings.Join(names, ", "))
+		}
+		suites = append(suites, id)
+	}
+
+	if len(suites) == 0 {
+		return nil, fmt.Errorf("No TLS cipher suites specified, valid names are: %s", strings.Join(names, ", "))
+	}
+	return suites, nil
+}
+
+// TLSPinsFromString parses a comma separated list of SHA-256 hashes of certificates' public keys
+// (their SubjectPublicKeyInfo), written in base64 as in HTTP public key pinning or in hex, with
+// or without colons
+func TLSPinsFromString(pinsString string) ([][]byte, error) {
+	var pins [][]byte
+	for _, pinString := range strings.Split(pinsString, ",") {
+		pinString = strings.TrimPrefix(strings.TrimSpace(pinString), "sha256/")
+		if len(pinString) == 0 {
+			continue
+		}
+		pin, err := hex.DecodeString(strings.Replace(pinString, ":", "", -1))
+		if err != nil {
+			pin, err = base64.StdEncoding.DecodeString(pinString)
+		}
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("TLS pin %s is not a SHA-256 hash in base64 or hex", pinString)
+		}
+		pins = append(pins, pin)
+	}
+
+	if len(pins) == 0 {
+		return nil, errors.New("No TLS pins specified")
+	}
+	return pins, nil
+}
+
+// TLSPublicKeyFingerprint is the SHA-256 hash of the certificate's public key, in base64 as
+// accepted by TLSPinsFromString
+func TLSPublicKeyFingerprint(cs tls.ConnectionState) string {
+	if len(cs.PeerCertificates) == 0 {
+		return ""
+	}
+	hash := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// tlsPinVerifier returns a tls.Config VerifyConnection callback that rejects servers whose leaf
+// certificate's public key doesn't match any of the pins. It runs after the usual certificate
+// validation, if that is enabled, and also on resumed sessions.
+func tlsPinVerifier(pins [][]byte) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("TLS server presented no certificate to check against the pinned keys")
+		}
+		hash := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(pin, hash[:]) {
+				return nil
+			}
+		}
+		fingerprint := TLSPublicKeyFingerprint(cs)
+		log.Errorf("Rejecting TLS server %s: its public key sha256/%s doesn't match any pinned key",
+			cs.ServerName, fingerprint)
+		return fmt.Errorf("TLS server public key sha256/%s doesn't match any pinned key", fingerprint)
+	}
+}
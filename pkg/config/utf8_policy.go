@@ -0,0 +1,36 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UTF8Policy controls what happens to invalid UTF-8 in the strings of an event before it is
+// formatted for an output.
+type UTF8Policy string
+
+const (
+	// KeepInvalidUTF8 leaves events as they are
+	KeepInvalidUTF8 UTF8Policy = "none"
+	// ReplaceInvalidUTF8 replaces each invalid byte, or unpaired surrogate escape, with U+FFFD
+	ReplaceInvalidUTF8 UTF8Policy = "replace"
+	// StripInvalidUTF8 removes invalid bytes and unpaired surrogate escapes
+	StripInvalidUTF8 UTF8Policy = "strip"
+	// RejectInvalidUTF8 treats events with invalid UTF-8 as events that can't be formatted
+	RejectInvalidUTF8 UTF8Policy = "reject"
+)
+
+func UTF8PolicyFromString(policyString string) (UTF8Policy, error) {
+	switch UTF8Policy(strings.ToLower(strings.TrimSpace(policyString))) {
+	case KeepInvalidUTF8:
+		return KeepInvalidUTF8, nil
+	case ReplaceInvalidUTF8:
+		return ReplaceInvalidUTF8, nil
+	case StripInvalidUTF8:
+		return StripInvalidUTF8, nil
+	case RejectInvalidUTF8:
+		return RejectInvalidUTF8, nil
+	default:
+		return KeepInvalidUTF8, fmt.Errorf("utf8 policy %s not recognized (none, replace, strip or reject)", policyString)
+	}
+}
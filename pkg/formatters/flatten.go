@@ -0,0 +1,146 @@
+package formatters
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/transforms"
+)
+
+// FlattenFormatter collapses nested objects and arrays into top level keys before handing the
+// event to the output's formatter. json encodes map keys in sorted order, so the same event
+// always produces the same output.
+type FlattenFormatter struct {
+	Options *FlattenOptions
+	Next    Formatter
+}
+
+func (f FlattenFormatter) Format(event *Event) (string, error) {
+	fields, err := event.Fields()
+	if err != nil {
+		return "", err
+	}
+
+	flat, err := Flatten(fields, f.Options)
+	if err != nil {
+		return "", err
+	}
+	raw, err := json.Marshal(flat)
+	if err != nil {
+		return "", err
+	}
+	return f.Next.Format(&Event{raw: string(raw), id: event.id, parsed: true, fields: flat, writes: event.writes})
+}
+
+// Flatten returns a copy of fields where nested values have been moved to the top level, under
+// their path joined with the separator. fields is left unchanged. Keys are visited in sorted
+// order so that when a flattened key collides with an existing one the result doesn't vary: the
+// value visited last is kept, or the first one under the first-wins conflict policy, while the
+// error policy fails with a ConflictError naming both fields.
+func Flatten(fields map[string]interface{}, options *FlattenOptions) (map[string]interface{}, error) {
+	f := flattener{options: options, flat: make(map[string]interface{}, len(fields))}
+	if options.Conflicts.TracksWrites() {
+		f.sources = make(map[string]string)
+	}
+	for _, key := range sortedKeys(fields) {
+		if err := f.flatten(key, "/"+key, fields[key], 0); err != nil {
+			return nil, err
+		}
+	}
+	return f.flat, nil
+}
+
+type flattener struct {
+	options *FlattenOptions
+	flat    map[string]interface{}
+	// the field each key was flattened from, as a json pointer, when collisions are tracked
+	sources map[string]string
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *flattener) flatten(key, source string, value interface{}, depth int) error {
+	options := f.options
+	canDescend := options.MaxDepth == 0 || depth < options.MaxDepth
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 || !canDescend {
+			return f.put(key, source, encodeFlattened(v))
+		}
+		for _, childKey := range sortedKeys(v) {
+			if err := f.flatten(key+options.Separator+childKey, source+"/"+childKey, v[childKey], depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case []interface{}:
+		if options.Arrays == FlattenArraysJoin {
+			elements := make([]string, len(v))
+			for i, element := range v {
+				elements[i] = scalarString(element)
+			}
+			return f.put(key, source, strings.Join(elements, options.ArraySeparator))
+		}
+		if len(v) == 0 || !canDescend {
+			return f.put(key, source, encodeFlattened(v))
+		}
+		for i, child := range v {
+			index := strconv.Itoa(i)
+			if err := f.flatten(key+options.Separator+index, source+"/"+index, child, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		return f.put(key, source, value)
+	}
+}
+
+// put writes the value flattened from source under key, resolving a collision with another
+// field flattened into the same key with the conflict policy.
+func (f *flattener) put(key, source string, value interface{}) error {
+	if f.sources == nil {
+		f.flat[key] = value
+		return nil
+	}
+	if first, ok := f.sources[key]; ok {
+		if f.options.Conflicts == transforms.FailOnConflict {
+			return &transforms.ConflictError{Field: key, First: first, Second: source}
+		}
+		return nil
+	}
+	f.flat[key] = value
+	f.sources[key] = source
+	return nil
+}
+
+// encodeFlattened writes a value that is not flattened any further as a json string.
+func encodeFlattened(value interface{}) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+// scalarString returns the text of a joined array element: strings as they are, everything
+// else as json.
+func scalarString(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return encodeFlattened(value)
+}
@@ -0,0 +1,263 @@
+// Package formatters turns events into the wire format of each output. An event is parsed at
+// most once, no matter how many outputs need its fields, and outputs that forward json as-is
+// never parse it at all.
+package formatters
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/jsonschema"
+	"github.com/carbonblack/cb-event-forwarder/pkg/leefencoder"
+	"github.com/carbonblack/cb-event-forwarder/pkg/msgpackencoder"
+	"github.com/carbonblack/cb-event-forwarder/pkg/transforms"
+)
+
+// last ID given to an event
+var lastEventID uint64
+
+// Event is a json event shared by every output it is sent to.
+type Event struct {
+	raw      string
+	id       uint64
+	received time.Time
+
+	parsed   bool
+	fields   map[string]interface{}
+	parseErr error
+
+	// the writes of the stages of the output's pipeline that the event went through, when the
+	// conflict policy tracks them
+	writes *transforms.FieldWrites
+}
+
+// NewEvent returns an event with the next correlation ID. IDs increase for as long as the
+// forwarder runs, so they identify an event in the logs of a single run.
+func NewEvent(raw string) *Event {
+	return &Event{raw: raw, id: atomic.AddUint64(&lastEventID, 1)}
+}
+
+// NewEventReceivedAt returns a new event that the forwarder received at the given time.
+func NewEventReceivedAt(raw string, received time.Time) *Event {
+	event := NewEvent(raw)
+	event.received = received
+	return event
+}
+
+// Received returns when the forwarder received the event, used to measure how long it takes to
+// deliver it. It is never part of the formatted event.
+func (e *Event) Received() time.Time {
+	return e.received
+}
+
+// ID returns the event's correlation ID.
+func (e *Event) ID() uint64 {
+	return e.id
+}
+
+// EmbedID adds the correlation ID to the event under the given field, so that outputs and
+// whoever receives the event can refer to it. Events that are not json objects are left
+// unchanged.
+func (e *Event) EmbedID(field string) {
+	e.embedNumber(field, e.id)
+}
+
+// EmbedSequence adds the forwarder's sequence number to the event under the given field.
+// Events that are not json objects are left unchanged.
+func (e *Event) EmbedSequence(field string, sequence uint64) {
+	e.embedNumber(field, sequence)
+}
+
+func (e *Event) embedNumber(field string, value uint64) {
+	body := strings.TrimSpace(e.raw)
+	if !strings.HasPrefix(body, "{") {
+		return
+	}
+	name, _ := json.Marshal(field)
+	prefix := "{" + string(name) + ":" + strconv.FormatUint(value, 10)
+
+	if rest := strings.TrimSpace(body[1:]); strings.HasPrefix(rest, "}") {
+		e.raw = prefix + rest
+	} else {
+		e.raw = prefix + "," + body[1:]
+	}
+	e.parsed = false
+	e.fields = nil
+}
+
+// EmbeddedID returns the correlation ID that EmbedID added to a formatted json event. It parses
+// the whole event, so it is meant for logging errors rather than for every event.
+func EmbeddedID(message string, field string) (string, bool) {
+	if len(field) == 0 {
+		return "", false
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(message), &fields); err != nil {
+		return "", false
+	}
+	id, ok := fields[field]
+	return string(id), ok
+}
+
+// Raw returns the event as json.
+func (e *Event) Raw() string {
+	return e.raw
+}
+
+// Fields returns the parsed event, parsing it on first use. The returned map is shared between
+// all the outputs and must not be modified; formatters that need to change it must copy it.
+// Fields is not safe for concurrent use.
+func (e *Event) Fields() (map[string]interface{}, error) {
+	if !e.parsed {
+		decoder := json.NewDecoder(bytes.NewReader([]byte(e.raw)))
+		decoder.UseNumber()
+		e.parseErr = decoder.Decode(&e.fields)
+		e.parsed = true
+	}
+	return e.fields, e.parseErr
+}
+
+type Formatter interface {
+	Format(event *Event) (string, error)
+}
+
+// ForConfig returns the formatter registered for the output format of cfg, flattening events
+// first when the output asks for it, and falling back to a minimal record of events that can't
+// be formatted when format_fallback is set. Any transform and coercions are expected to have been
+// applied to the events already.
+func ForConfig(cfg *Configuration) (Formatter, error) {
+	var stages []Stage
+	if cfg.Flatten != nil {
+		stages = append(stages, NewFlattenStage(cfg.Flatten))
+	}
+	return ForPipeline(cfg, stages)
+}
+
+// ForPipeline returns the formatter registered for the output format of cfg, running the events
+// through stages in order first, after fixing their invalid UTF-8 when utf8_policy asks for it.
+// With schema_stage=event, events are validated against the output's schema after the last stage.
+// With format_fallback, events that fail any stage or can't be formatted are sent as a minimal
+// record. With max_line_bytes, the lines formatted are kept within it, fallback records included.
+func ForPipeline(cfg *Configuration, stages []Stage) (Formatter, error) {
+	base, err := newBaseFormatter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	formatter := base
+	if cfg.EventSchema != nil && cfg.SchemaStage == ValidateEventsBeforeFormat {
+		formatter = SchemaValidator{Schema: cfg.EventSchema, Next: formatter}
+	}
+	for i := len(stages) - 1; i >= 0; i-- {
+		formatter = stages[i](formatter)
+	}
+	if cfg.UTF8Policy != "" && cfg.UTF8Policy != KeepInvalidUTF8 {
+		formatter = &UTF8Sanitizer{Policy: cfg.UTF8Policy, Next: formatter}
+	}
+	if cfg.FormatFallback {
+		formatter = &FallbackFormatter{Next: formatter, Fallback: base, IDField: cfg.CorrelationIDField}
+	}
+	if cfg.MaxLineBytes > 0 {
+		formatter = &LineLimiter{MaxBytes: cfg.MaxLineBytes, Policy: cfg.LongLinePolicy, Next: formatter}
+	}
+	return formatter, nil
+}
+
+type JSONFormatter struct{}
+
+func (JSONFormatter) Format(event *Event) (string, error) {
+	return event.Raw(), nil
+}
+
+type LEEFFormatter struct{}
+
+func (LEEFFormatter) Format(event *Event) (string, error) {
+	fields, err := event.Fields()
+	if err != nil {
+		return "", err
+	}
+
+	// the encoder rewrites top level keys, so give it its own copy
+	msg := make(map[string]interface{}, len(fields))
+	for key, value := range fields {
+		msg[key] = value
+	}
+	return leefencoder.Encode(msg)
+}
+
+// MsgPackFormatter encodes events as length prefixed MessagePack, see msgpackencoder.Frame.
+type MsgPackFormatter struct{}
+
+func (MsgPackFormatter) Format(event *Event) (string, error) {
+	fields, err := event.Fields()
+	if err != nil {
+		return "", err
+	}
+
+	encoded, err := msgpackencoder.Encode(fields)
+	if err != nil {
+		return "", err
+	}
+	return string(msgpackencoder.Frame(encoded)), nil
+}
+
+// FallbackFormatter formats the events that Next fails to format as a minimal record in the
+// same format, holding only the event's type, its correlation ID and the formatting error, so
+// that the collector still learns that the event existed.
+type FallbackFormatter struct {
+	Next     Formatter
+	Fallback Formatter
+	// field of the correlation ID, event_id when empty
+	IDField string
+
+	fallbackCount int64
+}
+
+func (f *FallbackFormatter) Format(event *Event) (string, error) {
+	formatted, err := f.Next.Format(event)
+	if err == nil {
+		return formatted, nil
+	}
+	// events failed by the conflict policy or the schema go to the dead letter file instead
+	var conflict *transforms.ConflictError
+	var invalid *jsonschema.ValidationError
+	if errors.As(err, &conflict) || errors.As(err, &invalid) {
+		return "", err
+	}
+
+	idField := f.IDField
+	if len(idField) == 0 {
+		idField = "event_id"
+	}
+	record := map[string]interface{}{
+		idField:        json.Number(strconv.FormatUint(event.id, 10)),
+		"format_error": err.Error(),
+	}
+	if fields, parseErr := event.Fields(); parseErr == nil {
+		if eventType, ok := fields["type"].(string); ok {
+			record["type"] = eventType
+		}
+	}
+
+	raw, marshalErr := json.Marshal(record)
+	if marshalErr != nil {
+		return "", err
+	}
+	formatted, fallbackErr := f.Fallback.Format(&Event{raw: string(raw), id: event.id, parsed: true, fields: record})
+	if fallbackErr != nil {
+		return "", err
+	}
+	atomic.AddInt64(&f.fallbackCount, 1)
+	return formatted, nil
+}
+
+// FallbackCount returns how many events were formatted as a minimal record.
+func (f *FallbackFormatter) FallbackCount() int64 {
+	return atomic.LoadInt64(&f.fallbackCount)
+}
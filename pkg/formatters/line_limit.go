@@ -0,0 +1,182 @@
+package formatters
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+)
+
+// LineLimiter keeps the lines formatted by Next within MaxBytes, not counting the line
+// terminator, for collectors that silently clip longer lines. Policy decides whether longer lines
+// are truncated at a field boundary or fail to format.
+type LineLimiter struct {
+	MaxBytes int
+	Policy   LongLinePolicy
+	Next     Formatter
+
+	truncatedCount int64
+	droppedCount   int64
+}
+
+func (f *LineLimiter) Format(event *Event) (string, error) {
+	formatted, err := f.Next.Format(event)
+	if err != nil {
+		return "", err
+	}
+	line := strings.TrimRight(formatted, "\r\n")
+	if len(line) <= f.MaxBytes {
+		return formatted, nil
+	}
+
+	if f.Policy == TruncateLongLines {
+		if truncated, ok := TruncateLine(line, f.MaxBytes); ok {
+			atomic.AddInt64(&f.truncatedCount, 1)
+			return truncated + formatted[len(line):], nil
+		}
+	}
+	atomic.AddInt64(&f.droppedCount, 1)
+	return "", fmt.Errorf("line of %d bytes is longer than max_line_bytes (%d)", len(line), f.MaxBytes)
+}
+
+// TruncatedCount returns how many lines were truncated to fit.
+func (f *LineLimiter) TruncatedCount() int64 {
+	return atomic.LoadInt64(&f.truncatedCount)
+}
+
+// DroppedCount returns how many lines were too long and could not be truncated, or were not to be.
+func (f *LineLimiter) DroppedCount() int64 {
+	return atomic.LoadInt64(&f.droppedCount)
+}
+
+// TruncateLine cuts a LEEF or CEF line to at most maxBytes. The header is always kept whole and
+// followed by the key=value fields that fit; the first one that doesn't is kept with as much of
+// its value as fits, cut before an escape sequence or a multi-byte character rather than through
+// it, so that the line stays valid. It returns false for lines in other formats, or whose header
+// alone is longer than maxBytes.
+func TruncateLine(line string, maxBytes int) (string, bool) {
+	if len(line) <= maxBytes {
+		return line, true
+	}
+
+	var headerEnd int
+	var nextField func(line string, start int) int
+	switch {
+	case strings.HasPrefix(line, "LEEF:2.0|"):
+		headerEnd = headerLength(line, 6)
+		separator := leefDelimiter(line, headerEnd)
+		nextField = func(line string, start int) int { return indexByteFrom(line, start, separator) }
+	case strings.HasPrefix(line, "LEEF:"):
+		headerEnd = headerLength(line, 5)
+		nextField = func(line string, start int) int { return indexByteFrom(line, start, '\t') }
+	case strings.HasPrefix(line, "CEF:"):
+		headerEnd = headerLength(line, 7)
+		nextField = nextCEFField
+	default:
+		return "", false
+	}
+	if headerEnd < 0 || headerEnd > maxBytes {
+		return "", false
+	}
+
+	end := headerEnd
+	for start := headerEnd; start < len(line); {
+		fieldEnd := nextField(line, start)
+		if fieldEnd <= maxBytes {
+			end = fieldEnd
+			start = fieldEnd + 1
+			continue
+		}
+		if equals := strings.IndexByte(line[start:fieldEnd], '='); equals >= 0 && start+equals+1 <= maxBytes {
+			end = safeCut(line, start+equals+1, maxBytes)
+		}
+		break
+	}
+	return line[:end], true
+}
+
+// headerLength returns the length of a header of fields separated by pipes, up to and including
+// the pipe that closes the last of them, or -1 when the line is shorter. Pipes escaped with a
+// backslash are part of the fields.
+func headerLength(line string, fields int) int {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '|':
+			if fields--; fields == 0 {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
+
+// leefDelimiter returns the attribute delimiter declared in the last field of a LEEF 2.0 header,
+// either as a character or in hex such as x5E, or a tab when none is.
+func leefDelimiter(line string, headerEnd int) byte {
+	if headerEnd < 0 {
+		return '\t'
+	}
+	field := line[:headerEnd-1]
+	field = field[strings.LastIndexByte(field, '|')+1:]
+	if len(field) == 1 {
+		return field[0]
+	}
+	hex := strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(field), "0"), "x")
+	if value, err := strconv.ParseUint(hex, 16, 8); err == nil && len(hex) > 0 && len(hex) < len(field) {
+		return byte(value)
+	}
+	return '\t'
+}
+
+func indexByteFrom(line string, start int, c byte) int {
+	if i := strings.IndexByte(line[start:], c); i >= 0 {
+		return start + i
+	}
+	return len(line)
+}
+
+// nextCEFField returns where the CEF extension field starting at start ends: at the space before
+// the next key, since values may hold unescaped spaces but not unescaped equal signs.
+func nextCEFField(line string, start int) int {
+	for i := start; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case ' ':
+			key := i + 1
+			for key < len(line) && isCEFKeyByte(line[key]) {
+				key++
+			}
+			if key > i+1 && key < len(line) && line[key] == '=' {
+				return i
+			}
+		}
+	}
+	return len(line)
+}
+
+func isCEFKeyByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.' || c == '-' || c == '[' || c == ']'
+}
+
+// safeCut returns the largest end of no more than maxBytes for the value starting at start that
+// doesn't split an escape sequence or a multi-byte character.
+func safeCut(line string, start, maxBytes int) int {
+	end := start
+	for end < len(line) {
+		size := 2
+		if line[end] != '\\' {
+			_, size = utf8.DecodeRuneInString(line[end:])
+		}
+		if end+size > maxBytes {
+			break
+		}
+		end += size
+	}
+	return end
+}
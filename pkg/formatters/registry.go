@@ -0,0 +1,73 @@
+package formatters
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+)
+
+// FormatterConstructor returns the formatter of an output, given the output's configuration. It
+// is called once for every output that uses its format.
+type FormatterConstructor func(cfg *Configuration) (Formatter, error)
+
+var (
+	registryMutex sync.RWMutex
+	registry      = make(map[string]FormatterConstructor)
+)
+
+func init() {
+	RegisterFormatter("json", func(*Configuration) (Formatter, error) { return JSONFormatter{}, nil })
+	RegisterFormatter("leef", func(*Configuration) (Formatter, error) { return LEEFFormatter{}, nil })
+	RegisterFormatter("msgpack", func(*Configuration) (Formatter, error) { return MsgPackFormatter{}, nil })
+}
+
+// RegisterFormatter makes a format selectable as output_format, by its case insensitive name.
+// Custom builds add their own formats by registering them from the init function of a package
+// they import. Registering an empty name, a nil constructor or the same name twice panics.
+func RegisterFormatter(name string, constructor FormatterConstructor) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if len(name) == 0 || constructor == nil {
+		panic("formatters: RegisterFormatter needs a name and a constructor")
+	}
+
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	if _, exists := registry[name]; exists {
+		panic("formatters: RegisterFormatter called twice for format " + name)
+	}
+	registry[name] = constructor
+}
+
+// RegisteredFormatters returns the names of the registered formats, sorted.
+func RegisteredFormatters() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newBaseFormatter returns the formatter registered under the output_format of cfg.
+func newBaseFormatter(cfg *Configuration) (Formatter, error) {
+	name := cfg.OutputFormatName()
+
+	registryMutex.RLock()
+	constructor, ok := registry[name]
+	registryMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("output_format %s is not a registered format (%s)", name, strings.Join(RegisteredFormatters(), ", "))
+	}
+
+	formatter, err := constructor(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not create the %s formatter: %s", name, err)
+	}
+	return formatter, nil
+}
@@ -0,0 +1,26 @@
+package formatters
+
+import (
+	"fmt"
+
+	"github.com/carbonblack/cb-event-forwarder/pkg/jsonschema"
+)
+
+// SchemaValidator fails the events that don't match Schema, with the *jsonschema.ValidationError
+// of the first constraint they fail, before Next formats them. Events that are not json fail as
+// well.
+type SchemaValidator struct {
+	Schema *jsonschema.Schema
+	Next   Formatter
+}
+
+func (f SchemaValidator) Format(event *Event) (string, error) {
+	fields, err := event.Fields()
+	if err != nil {
+		return "", &jsonschema.ValidationError{Keyword: "json", Message: fmt.Sprintf("invalid json: %s", err)}
+	}
+	if err := f.Schema.Validate(fields); err != nil {
+		return "", err
+	}
+	return f.Next.Format(event)
+}
@@ -0,0 +1,60 @@
+package formatters
+
+import (
+	"bytes"
+	"encoding/json"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/transforms"
+)
+
+// Stage wraps the formatter of an output with a step of the output's pipeline, which changes
+// events before next formats them.
+type Stage func(next Formatter) Formatter
+
+// NewFlattenStage returns the flatten stage of a pipeline.
+func NewFlattenStage(options *FlattenOptions) Stage {
+	return func(next Formatter) Formatter {
+		return FlattenFormatter{Options: options, Next: next}
+	}
+}
+
+// StageFormatter runs Apply on a private copy of the fields of the event, which the stage may
+// change as it likes, before Next formats it. Events that are not json objects, and events for
+// which Apply returns false, are passed on unmodified; events for which it returns an error
+// fail. Apply records its writes in writes, which is shared by the stages of the output that the
+// event goes through, and is nil unless the Conflicts policy needs it.
+type StageFormatter struct {
+	Apply     func(fields map[string]interface{}, writes *transforms.FieldWrites) (bool, error)
+	Conflicts transforms.ConflictPolicy
+	Next      Formatter
+}
+
+func (f StageFormatter) Format(event *Event) (string, error) {
+	writes := event.writes
+	if writes == nil {
+		writes = transforms.NewFieldWrites(f.Conflicts)
+	}
+
+	// the fields of the event are shared with the other outputs, so they are parsed again
+	// rather than modified
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(event.raw)))
+	decoder.UseNumber()
+	if decoder.Decode(&fields) != nil || fields == nil {
+		return f.Next.Format(event)
+	}
+	ok, err := f.Apply(fields, writes)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return f.Next.Format(event)
+	}
+
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	return f.Next.Format(&Event{raw: string(raw), id: event.id, received: event.received, parsed: true, fields: fields, writes: writes})
+}
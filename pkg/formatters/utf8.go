@@ -0,0 +1,145 @@
+package formatters
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+)
+
+// UTF8Sanitizer fixes the invalid UTF-8 in the strings of events before Next formats them,
+// according to Policy: invalid bytes and unpaired surrogate escapes such as \ud800, which strict
+// json parsers reject, are replaced with U+FFFD, stripped, or make the event fail to format.
+// Events are fixed as text, so those that are already valid pass through untouched.
+type UTF8Sanitizer struct {
+	Policy UTF8Policy
+	Next   Formatter
+
+	sanitizedFieldCount int64
+}
+
+func (f *UTF8Sanitizer) Format(event *Event) (string, error) {
+	if !mayHaveInvalidUTF8(event.raw) {
+		return f.Next.Format(event)
+	}
+
+	var replacement string
+	if f.Policy == ReplaceInvalidUTF8 {
+		replacement = string(utf8.RuneError)
+	}
+	sanitized, fields := sanitizeJSONStrings(event.raw, replacement)
+	if fields == 0 {
+		return f.Next.Format(event)
+	}
+	if f.Policy == RejectInvalidUTF8 {
+		return "", fmt.Errorf("invalid UTF-8 in %d fields", fields)
+	}
+
+	atomic.AddInt64(&f.sanitizedFieldCount, int64(fields))
+	return f.Next.Format(&Event{raw: sanitized, id: event.id, received: event.received})
+}
+
+// SanitizedFieldCount returns how many strings, keys included, had invalid UTF-8 fixed.
+func (f *UTF8Sanitizer) SanitizedFieldCount() int64 {
+	return atomic.LoadInt64(&f.sanitizedFieldCount)
+}
+
+// mayHaveInvalidUTF8 tells if raw has invalid bytes or escapes of surrogates, which are only
+// valid in pairs.
+func mayHaveInvalidUTF8(raw string) bool {
+	return !utf8.ValidString(raw) || strings.Contains(raw, `\ud`) || strings.Contains(raw, `\uD`)
+}
+
+// sanitizeJSONStrings replaces the invalid UTF-8 within the strings of raw, and their unpaired
+// surrogate escapes, with replacement. It returns the result and how many strings were changed.
+// Anything outside of strings is copied as is.
+func sanitizeJSONStrings(raw string, replacement string) (string, int) {
+	var sanitized strings.Builder
+	sanitized.Grow(len(raw))
+	fields := 0
+	inString, changed := false, false
+
+	for i := 0; i < len(raw); {
+		c := raw[i]
+		switch {
+		case !inString:
+			if c == '"' {
+				inString, changed = true, false
+			}
+			sanitized.WriteByte(c)
+			i++
+
+		case c == '"':
+			if changed {
+				fields++
+			}
+			inString = false
+			sanitized.WriteByte(c)
+			i++
+
+		case c == '\\' && i+1 < len(raw) && raw[i+1] == 'u':
+			r, ok := jsonEscapedRune(raw, i)
+			switch {
+			case !ok || !utf16.IsSurrogate(r):
+				sanitized.WriteString(raw[i:min(i+6, len(raw))])
+				i += 6
+			case r < 0xdc00:
+				// a high surrogate is only valid when followed by a low one
+				if low, ok := jsonEscapedRune(raw, i+6); ok && low >= 0xdc00 && low <= 0xdfff {
+					sanitized.WriteString(raw[i : i+12])
+					i += 12
+					break
+				}
+				sanitized.WriteString(replacement)
+				changed = true
+				i += 6
+			default:
+				sanitized.WriteString(replacement)
+				changed = true
+				i += 6
+			}
+
+		case c == '\\':
+			sanitized.WriteString(raw[i:min(i+2, len(raw))])
+			i += 2
+
+		case c < utf8.RuneSelf:
+			sanitized.WriteByte(c)
+			i++
+
+		default:
+			r, size := utf8.DecodeRuneInString(raw[i:])
+			if r == utf8.RuneError && size == 1 {
+				sanitized.WriteString(replacement)
+				changed = true
+			} else {
+				sanitized.WriteString(raw[i : i+size])
+			}
+			i += size
+		}
+	}
+	return sanitized.String(), fields
+}
+
+// jsonEscapedRune decodes the \uXXXX escape at raw[i:].
+func jsonEscapedRune(raw string, i int) (rune, bool) {
+	if i+6 > len(raw) || raw[i] != '\\' || raw[i+1] != 'u' {
+		return 0, false
+	}
+	value, err := strconv.ParseUint(raw[i+2:i+6], 16, 16)
+	if err != nil {
+		return 0, false
+	}
+	return rune(value), true
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,132 @@
+package forwarder
+
+import (
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// how often the output pressure is sampled to adjust the AMQP prefetch
+const backpressureCheckInterval = time.Second
+
+// backpressureMonitor slows down the AMQP consumer while the outputs can't keep up. The broker
+// only honours the prefetch count for manually acked deliveries, so it does nothing with
+// automatic acking.
+type backpressureMonitor struct {
+	threshold   float64
+	maxPrefetch int
+
+	prefetch      int64
+	throttleCount int64
+}
+
+type BackpressureStatistics struct {
+	PressureLevel float64 `json:"pressure_level"`
+	PrefetchCount int64   `json:"prefetch_count"`
+	ThrottleCount int64   `json:"throttle_count"`
+}
+
+func newBackpressureMonitor(threshold float64, maxPrefetch int) *backpressureMonitor {
+	return &backpressureMonitor{threshold: threshold, maxPrefetch: maxPrefetch, prefetch: int64(maxPrefetch)}
+}
+
+// prefetchFor returns the prefetch count for the given pressure. Below the threshold the
+// configured prefetch is used; above it the prefetch shrinks linearly down to a single
+// delivery when an output buffer is full.
+func (m *backpressureMonitor) prefetchFor(pressure float64) int {
+	if pressure <= m.threshold {
+		return m.maxPrefetch
+	}
+	prefetch := int(float64(m.maxPrefetch) * (1 - pressure) / (1 - m.threshold))
+	if prefetch < 1 {
+		prefetch = 1
+	}
+	return prefetch
+}
+
+// PressureLevel returns how full the route's buffer is, from 0.0 (empty) to 1.0 (full), by
+// event count or by size, whichever is closer to its bound.
+func (route *outputRoute) PressureLevel() float64 {
+	var pressure float64
+	if cap(route.messages) > 0 {
+		pressure = float64(len(route.messages)) / float64(cap(route.messages))
+	}
+	if maxBytes := route.config.OutputBufferMaxBytes; maxBytes > 0 {
+		bytesPressure := float64(atomic.LoadInt64(&route.bufferedBytes)) / float64(maxBytes)
+		if bytesPressure > 1 {
+			bytesPressure = 1
+		}
+		if bytesPressure > pressure {
+			pressure = bytesPressure
+		}
+	}
+	return pressure
+}
+
+// PressureLevel returns the pressure of the fullest buffer between the input workers and the
+// outputs, from 0.0 to 1.0.
+func (forwarder *EventForwarder) PressureLevel() float64 {
+	pressure := float64(len(forwarder.outputChan)) / float64(cap(forwarder.outputChan))
+	for _, route := range forwarder.outputs {
+		if routePressure := route.PressureLevel(); routePressure > pressure {
+			pressure = routePressure
+		}
+	}
+	return pressure
+}
+
+func (forwarder *EventForwarder) startBackpressureMonitor() {
+	if forwarder.backpressure == nil {
+		return
+	}
+
+	log.Infof("Reducing the AMQP prefetch count (%d) once output buffers are %.0f%% full",
+		forwarder.AMQPPrefetchCount, forwarder.BackpressureThreshold*100)
+	go func() {
+		ticker := time.NewTicker(backpressureCheckInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			forwarder.adjustPrefetch(forwarder.PressureLevel())
+		}
+	}()
+}
+
+func (forwarder *EventForwarder) adjustPrefetch(pressure float64) {
+	monitor := forwarder.backpressure
+	prefetch := monitor.prefetchFor(pressure)
+	previous := int(atomic.LoadInt64(&monitor.prefetch))
+	if prefetch == previous {
+		return
+	}
+
+	forwarder.RLock()
+	consumer := forwarder.consumer
+	forwarder.RUnlock()
+	if consumer == nil {
+		return
+	}
+
+	if err := consumer.SetPrefetch(prefetch); err != nil {
+		log.Errorf("Could not change the AMQP prefetch count to %d: %s", prefetch, err)
+		return
+	}
+	atomic.StoreInt64(&monitor.prefetch, int64(prefetch))
+
+	switch {
+	case previous == monitor.maxPrefetch:
+		atomic.AddInt64(&monitor.throttleCount, 1)
+		log.Warnf("Outputs are %.0f%% full, throttling the AMQP consumer", pressure*100)
+	case prefetch == monitor.maxPrefetch:
+		log.Infof("Outputs have caught up, no longer throttling the AMQP consumer")
+	}
+}
+
+func (forwarder *EventForwarder) backpressureStatistics() BackpressureStatistics {
+	return BackpressureStatistics{
+		PressureLevel: forwarder.PressureLevel(),
+		PrefetchCount: atomic.LoadInt64(&forwarder.backpressure.prefetch),
+		ThrottleCount: atomic.LoadInt64(&forwarder.backpressure.throttleCount),
+	}
+}
@@ -0,0 +1,60 @@
+package forwarder
+
+import (
+	"encoding/json"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// configReloadAudit is the audit record of a configuration reload, logged as a single entry
+// with the changes it applied and those waiting for a restart.
+type configReloadAudit struct {
+	Trigger    string
+	ConfigFile string
+}
+
+func (audit configReloadAudit) fields(outcome string) log.Fields {
+	return log.Fields{
+		"audit":       "config_reload",
+		"trigger":     audit.Trigger,
+		"config_file": audit.ConfigFile,
+		"outcome":     outcome,
+	}
+}
+
+// rejected records a reload that left the running configuration untouched.
+func (audit configReloadAudit) rejected(reason error) {
+	fields := audit.fields("rejected")
+	fields["reason"] = reason.Error()
+	log.WithFields(fields).Warn("Configuration reload rejected")
+}
+
+// applied records a reload, splitting the changes between those applied and those that need a
+// restart.
+func (audit configReloadAudit) applied(changes []ConfigChange, reloadable map[string]bool) {
+	applied, restartRequired := []ConfigChange{}, []ConfigChange{}
+	for _, change := range changes {
+		if reloadable[change.Field] {
+			applied = append(applied, change)
+		} else {
+			restartRequired = append(restartRequired, change)
+		}
+	}
+
+	fields := audit.fields("applied")
+	fields["applied_changes"] = changesJSON(applied)
+	fields["restart_required_changes"] = changesJSON(restartRequired)
+	log.WithFields(fields).Info("Configuration reloaded")
+	if len(restartRequired) > 0 {
+		log.Warnf("%d configuration changes in %s need a restart to take effect", len(restartRequired), audit.ConfigFile)
+	}
+}
+
+func changesJSON(changes []ConfigChange) string {
+	encoded, err := json.Marshal(changes)
+	if err != nil {
+		return err.Error()
+	}
+	return string(encoded)
+}
@@ -0,0 +1,108 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DeadLetterFile receives the events that the error conflict policy fails, appending each of
+// them to a file as a json record with the reason it failed, so that they can be inspected and
+// replayed. Without a file the events are only counted and logged, and are lost.
+type DeadLetterFile struct {
+	path string
+
+	mutex           sync.Mutex
+	file            *os.File
+	eventCount      int64
+	writeErrorCount int64
+}
+
+type DeadLetterStatistics struct {
+	File            string `json:"file"`
+	EventCount      int64  `json:"event_count"`
+	WriteErrorCount int64  `json:"write_error_count"`
+}
+
+// DeadLetterRecord is a line of the dead letter file.
+type DeadLetterRecord struct {
+	Time string `json:"time"`
+	// the section of the output that the event failed for, empty when it failed before being
+	// sent to the outputs
+	Output string          `json:"output,omitempty"`
+	Reason string          `json:"reason"`
+	Event  json.RawMessage `json:"event"`
+}
+
+// OpenDeadLetterFile opens the dead letter file at path for appending, creating it when it
+// doesn't exist. An empty path returns a DeadLetterFile that writes nothing.
+func OpenDeadLetterFile(path string) (*DeadLetterFile, error) {
+	deadLetters := &DeadLetterFile{path: path}
+	if len(path) == 0 {
+		return deadLetters, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open dead letter file %s: %s", path, err)
+	}
+	deadLetters.file = file
+	return deadLetters, nil
+}
+
+// Write records an event that failed for output, "" for events that failed before being sent to
+// the outputs, along with the reason.
+func (d *DeadLetterFile) Write(output, event string, reason error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.eventCount++
+	if d.file == nil {
+		log.Warnf("Dropped event%s without a dead_letter_file: %s", outputSuffix(output), reason)
+		return
+	}
+
+	record := DeadLetterRecord{Time: time.Now().UTC().Format(time.RFC3339Nano), Output: output, Reason: reason.Error(), Event: json.RawMessage(event)}
+	if !json.Valid(record.Event) {
+		record.Event, _ = json.Marshal(event)
+	}
+	line, err := json.Marshal(record)
+	if err == nil {
+		_, err = d.file.Write(append(line, '\n'))
+	}
+	if err != nil {
+		d.writeErrorCount++
+		log.Errorf("Could not write event%s to dead letter file %s: %s", outputSuffix(output), d.path, err)
+		return
+	}
+	log.Debugf("Wrote event%s to dead letter file %s: %s", outputSuffix(output), d.path, reason)
+}
+
+func (d *DeadLetterFile) Statistics() DeadLetterStatistics {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return DeadLetterStatistics{File: d.path, EventCount: d.eventCount, WriteErrorCount: d.writeErrorCount}
+}
+
+// Close closes the file, after which events are no longer written to it.
+func (d *DeadLetterFile) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.Close()
+	d.file = nil
+	return err
+}
+
+func outputSuffix(output string) string {
+	if len(output) == 0 {
+		return ""
+	}
+	return " for output " + output
+}
@@ -0,0 +1,187 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/carbonblack/cb-event-forwarder/pkg/formatters"
+	log "github.com/sirupsen/logrus"
+)
+
+// DebugTee appends a sample of the events to a file as they were received, along with the
+// message each output was handed for them, to compare the input of the outputs with what they
+// send when diagnosing formatting or filtering issues. Events are sampled evenly rather than at
+// random, so the cost is a counter per event plus one record for every sampled one; the file is
+// rotated to <file>.1 once it grows over its size bound.
+type DebugTee struct {
+	path       string
+	sampleRate float64
+	maxBytes   int64
+
+	// events seen, only touched by the goroutine handing events over to the outputs
+	eventCount uint64
+
+	mutex           sync.Mutex
+	file            *os.File
+	size            int64
+	sampledCount    int64
+	writeErrorCount int64
+	rotationCount   int64
+}
+
+type DebugTeeStatistics struct {
+	File              string  `json:"file"`
+	SampleRate        float64 `json:"sample_rate"`
+	SampledEventCount int64   `json:"sampled_event_count"`
+	WriteErrorCount   int64   `json:"write_error_count"`
+	RotationCount     int64   `json:"rotation_count"`
+}
+
+// DebugTeeRecord is a line of the debug tee file.
+type DebugTeeRecord struct {
+	Time string `json:"time"`
+	// the correlation ID of the event, as embedded by correlation_id_field
+	ID    uint64          `json:"id"`
+	Event json.RawMessage `json:"event"`
+	// what each output made of the event, by section name, "bridge" for the main output
+	Outputs map[string]DebugTeeOutput `json:"outputs"`
+}
+
+// DebugTeeOutput is the message an output was handed for an event, or why it was left out.
+// Messages are handed over to the output even when its buffer then drops them.
+type DebugTeeOutput struct {
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// OpenDebugTee opens the debug tee file at path for appending, creating it when it doesn't
+// exist. An empty path returns a DebugTee that samples nothing.
+func OpenDebugTee(path string, sampleRate float64, maxBytes int64) (*DebugTee, error) {
+	tee := &DebugTee{path: path, sampleRate: sampleRate, maxBytes: maxBytes}
+	if len(path) == 0 {
+		return tee, nil
+	}
+	if err := tee.open(); err != nil {
+		return nil, err
+	}
+	return tee, nil
+}
+
+func (t *DebugTee) open() error {
+	file, err := os.OpenFile(t.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("Could not open debug tee file %s: %s", t.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Could not open debug tee file %s: %s", t.path, err)
+	}
+	t.file = file
+	t.size = info.Size()
+	return nil
+}
+
+// Sample returns the record of an event when it is one of the sampled ones, nil otherwise. The
+// record is written once the outputs have been added to it.
+func (t *DebugTee) Sample(event *formatters.Event) *DebugTeeRecord {
+	if len(t.path) == 0 {
+		return nil
+	}
+	// sampled whenever the count of events times the rate reaches the next integer
+	t.eventCount++
+	if uint64(float64(t.eventCount)*t.sampleRate) == uint64(float64(t.eventCount-1)*t.sampleRate) {
+		return nil
+	}
+
+	record := &DebugTeeRecord{ID: event.ID(), Event: json.RawMessage(event.Raw()), Outputs: make(map[string]DebugTeeOutput)}
+	if !json.Valid(record.Event) {
+		record.Event, _ = json.Marshal(event.Raw())
+	}
+	return record
+}
+
+// Add records the message an output was handed for the event, or the error that left it out.
+func (r *DebugTeeRecord) Add(output, message string, err error) {
+	if r == nil {
+		return
+	}
+	if err != nil {
+		r.Outputs[output] = DebugTeeOutput{Error: err.Error()}
+		return
+	}
+	r.Outputs[output] = DebugTeeOutput{Message: message}
+}
+
+// Write appends a record to the file, rotating it first when the record would take it over its
+// size bound. Nil records, of events that were not sampled, are ignored.
+func (t *DebugTee) Write(record *DebugTeeRecord) {
+	if record == nil {
+		return
+	}
+	record.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	line, err := json.Marshal(record)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.sampledCount++
+	switch {
+	case err != nil:
+	case t.file == nil:
+		err = fmt.Errorf("file closed")
+	case t.size > 0 && t.size+int64(len(line))+1 > t.maxBytes:
+		err = t.rotate()
+	}
+	if err == nil {
+		var n int
+		n, err = t.file.Write(append(line, '\n'))
+		t.size += int64(n)
+	}
+	if err != nil {
+		t.writeErrorCount++
+		log.Errorf("Could not write event %d to debug tee file %s: %s", record.ID, t.path, err)
+	}
+}
+
+// rotate moves the file to <file>.1, replacing the previous one, and starts a new file.
+func (t *DebugTee) rotate() error {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+	if err := os.Rename(t.path, t.path+".1"); err != nil {
+		// keep appending to the file rather than losing every record
+		t.open()
+		return err
+	}
+	t.rotationCount++
+	return t.open()
+}
+
+func (t *DebugTee) Statistics() DebugTeeStatistics {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return DebugTeeStatistics{
+		File:              t.path,
+		SampleRate:        t.sampleRate,
+		SampledEventCount: t.sampledCount,
+		WriteErrorCount:   t.writeErrorCount,
+		RotationCount:     t.rotationCount,
+	}
+}
+
+// Close closes the file, after which events are no longer written to it.
+func (t *DebugTee) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
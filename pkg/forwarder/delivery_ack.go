@@ -0,0 +1,66 @@
+package forwarder
+
+import (
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// deliveryAck acknowledges a manually acked AMQP delivery once every event from it is done with:
+// filtered out, dropped, or handed over to every output, and confirmed by the outputs that
+// confirm writes. When a confirming output gives up on one of its events, the delivery is
+// rejected instead and the broker delivers it again, once: a delivery that fails again after
+// being redelivered is rejected for good, left to the dead letter exchange of the queue if it has
+// one, rather than redelivered over and over. A nil deliveryAck, of events that are not acked,
+// does nothing.
+type deliveryAck struct {
+	delivery amqp.Delivery
+	// the events and outputs that are not done yet, plus one for the input worker until it is
+	// done processing the delivery
+	pending int64
+	failed  int32
+}
+
+func newDeliveryAck(delivery amqp.Delivery) *deliveryAck {
+	return &deliveryAck{delivery: delivery, pending: 1}
+}
+
+// hold adds a holder that has to be done before the delivery is acknowledged.
+func (a *deliveryAck) hold() {
+	if a != nil {
+		atomic.AddInt64(&a.pending, 1)
+	}
+}
+
+// done releases a holder, acknowledging or rejecting the delivery once none is left.
+func (a *deliveryAck) done() {
+	if a == nil || atomic.AddInt64(&a.pending, -1) > 0 {
+		return
+	}
+
+	if atomic.LoadInt32(&a.failed) != 0 {
+		requeue := !a.delivery.Redelivered
+		if !requeue {
+			log.Warnf("Rejecting delivery %d for good: its events could not be written after it was redelivered", a.delivery.DeliveryTag)
+		}
+		if err := a.delivery.Nack(false, requeue); err != nil {
+			log.Debugf("Could not reject delivery: %s", err)
+		}
+		return
+	}
+	if err := a.delivery.Ack(false); err != nil {
+		log.Debugf("Could not ack delivery: %s", err)
+	}
+}
+
+// confirm releases the holder of a confirming output, which wrote its event or gave up on it.
+func (a *deliveryAck) confirm(written bool) {
+	if a == nil {
+		return
+	}
+	if !written {
+		atomic.StoreInt32(&a.failed, 1)
+	}
+	a.done()
+}
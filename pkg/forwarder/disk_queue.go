@@ -0,0 +1,281 @@
+package forwarder
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var diskQueueBucket = []byte("events")
+
+// ErrDiskQueueClosed is returned when adding events to a closed disk queue.
+var ErrDiskQueueClosed = errors.New("the disk queue is closed")
+
+// DiskQueue is an ordered, crash safe queue of formatted events in a bbolt database file. Events
+// are added and removed in batches, one transaction each. They are only removed once they have
+// been handed over to the output, so the events left in the file by a crash or a restart are
+// delivered first when the forwarder starts again; the last batch handed over before a crash
+// may be delivered twice.
+type DiskQueue struct {
+	path      string
+	db        *bolt.DB
+	maxEvents int64
+	maxBytes  int64
+
+	// serializes Push calls, so that batches are committed in the order of their keys
+	pushMutex sync.Mutex
+
+	mutex   sync.Mutex
+	changed *sync.Cond
+	// key of the next event added, and of the next event to read
+	nextKey uint64
+	readKey uint64
+	// events with keys below committedKey are in the file
+	committedKey uint64
+	// events in the file and the total size of their messages, including those being delivered
+	depth  int64
+	bytes  int64
+	closed bool
+}
+
+// DiskQueueEvent is a formatted event in a disk queue, with the times its delivery latency and
+// buffer age are measured from.
+type DiskQueueEvent struct {
+	Message  string
+	Enqueued time.Time
+	Received time.Time
+
+	key uint64
+}
+
+type DiskQueueStatistics struct {
+	Path      string `json:"path"`
+	Depth     int64  `json:"depth"`
+	Bytes     int64  `json:"queued_bytes"`
+	FileSize  int64  `json:"file_size"`
+	MaxEvents int64  `json:"max_events,omitempty"`
+	MaxBytes  int64  `json:"max_bytes,omitempty"`
+}
+
+// OpenDiskQueue opens the queue in the file at path, creating it if needed. The queue holds up to
+// maxEvents events and maxBytes bytes of messages, unbounded when zero. The file is locked while
+// it is open, so two outputs or two forwarders can't share it.
+func OpenDiskQueue(path string, maxEvents, maxBytes int64) (*DiskQueue, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Could not open disk queue %s (is it in use by another output?): %s", path, err)
+	}
+
+	q := &DiskQueue{path: path, db: db, maxEvents: maxEvents, maxBytes: maxBytes}
+	q.changed = sync.NewCond(&q.mutex)
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(diskQueueBucket)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			if q.depth == 0 {
+				q.readKey = binary.BigEndian.Uint64(key)
+			}
+			q.nextKey = binary.BigEndian.Uint64(key) + 1
+			q.depth++
+			q.bytes += int64(len(value) - diskQueueHeaderSize)
+		}
+		if q.depth == 0 {
+			q.readKey = q.nextKey
+		}
+		q.committedKey = q.nextKey
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Could not read disk queue %s: %s", path, err)
+	}
+	return q, nil
+}
+
+// Push adds events to the end of the queue. While the queue is full it waits for events to be
+// removed; an event is always let into an empty queue, however large it is.
+func (q *DiskQueue) Push(events []DiskQueueEvent) error {
+	q.pushMutex.Lock()
+	defer q.pushMutex.Unlock()
+
+	for len(events) > 0 {
+		q.mutex.Lock()
+		for !q.closed && q.depth > 0 && !q.fits(1, int64(len(events[0].Message))) {
+			q.changed.Wait()
+		}
+		if q.closed {
+			q.mutex.Unlock()
+			return ErrDiskQueueClosed
+		}
+		n, size := 1, int64(len(events[0].Message))
+		for ; n < len(events) && q.fits(int64(n+1), size+int64(len(events[n].Message))); n++ {
+			size += int64(len(events[n].Message))
+		}
+		firstKey := q.nextKey
+		q.nextKey += uint64(n)
+		q.mutex.Unlock()
+
+		err := q.db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(diskQueueBucket)
+			for i, event := range events[:n] {
+				if err := bucket.Put(diskQueueKey(firstKey+uint64(i)), encodeDiskQueueEvent(event)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		q.mutex.Lock()
+		q.depth += int64(n)
+		q.bytes += size
+		q.committedKey = firstKey + uint64(n)
+		q.changed.Broadcast()
+		q.mutex.Unlock()
+		events = events[n:]
+	}
+	return nil
+}
+
+// fits reports whether n more events of size bytes in total fit in the queue.
+func (q *DiskQueue) fits(n, size int64) bool {
+	return (q.maxEvents == 0 || q.depth+n <= q.maxEvents) && (q.maxBytes == 0 || q.bytes+size <= q.maxBytes)
+}
+
+// Next waits for events that were not read yet and returns up to max of them, oldest first. It
+// returns no events once the queue is closed.
+func (q *DiskQueue) Next(max int) ([]DiskQueueEvent, error) {
+	q.mutex.Lock()
+	for !q.closed && q.readKey >= q.committedKey {
+		q.changed.Wait()
+	}
+	if q.closed {
+		q.mutex.Unlock()
+		return nil, nil
+	}
+	readKey := q.readKey
+	q.mutex.Unlock()
+
+	var events []DiskQueueEvent
+	err := q.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(diskQueueBucket).Cursor()
+		for key, value := cursor.Seek(diskQueueKey(readKey)); key != nil && len(events) < max; key, value = cursor.Next() {
+			event, err := decodeDiskQueueEvent(value)
+			if err != nil {
+				return err
+			}
+			event.key = binary.BigEndian.Uint64(key)
+			events = append(events, event)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(events) > 0 {
+		q.mutex.Lock()
+		q.readKey = events[len(events)-1].key + 1
+		q.mutex.Unlock()
+	}
+	return events, nil
+}
+
+// Remove deletes events returned by Next, once they have been delivered.
+func (q *DiskQueue) Remove(events []DiskQueueEvent) error {
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(diskQueueBucket)
+		for _, event := range events {
+			if err := bucket.Delete(diskQueueKey(event.key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	var size int64
+	for _, event := range events {
+		size += int64(len(event.Message))
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if err == nil {
+		q.depth -= int64(len(events))
+		q.bytes -= size
+		q.changed.Broadcast()
+	}
+	return err
+}
+
+// Close wakes up every waiting Push and Next call and closes the file.
+func (q *DiskQueue) Close() error {
+	q.mutex.Lock()
+	q.closed = true
+	q.changed.Broadcast()
+	q.mutex.Unlock()
+	return q.db.Close()
+}
+
+func (q *DiskQueue) Statistics() DiskQueueStatistics {
+	q.mutex.Lock()
+	stats := DiskQueueStatistics{Path: q.path, Depth: q.depth, Bytes: q.bytes, MaxEvents: q.maxEvents, MaxBytes: q.maxBytes}
+	q.mutex.Unlock()
+
+	if info, err := os.Stat(q.path); err == nil {
+		stats.FileSize = info.Size()
+	}
+	return stats
+}
+
+func diskQueueKey(key uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, key)
+	return b
+}
+
+// events are stored as the UnixNano of their enqueue and receive times, 0 when unknown, followed
+// by the message
+const diskQueueHeaderSize = 16
+
+func encodeDiskQueueEvent(event DiskQueueEvent) []byte {
+	b := make([]byte, diskQueueHeaderSize+len(event.Message))
+	binary.BigEndian.PutUint64(b, uint64(unixNano(event.Enqueued)))
+	binary.BigEndian.PutUint64(b[8:], uint64(unixNano(event.Received)))
+	copy(b[diskQueueHeaderSize:], event.Message)
+	return b
+}
+
+func decodeDiskQueueEvent(b []byte) (DiskQueueEvent, error) {
+	if len(b) < diskQueueHeaderSize {
+		return DiskQueueEvent{}, fmt.Errorf("invalid disk queue record of %d bytes", len(b))
+	}
+	return DiskQueueEvent{
+		Enqueued: fromUnixNano(int64(binary.BigEndian.Uint64(b))),
+		Received: fromUnixNano(int64(binary.BigEndian.Uint64(b[8:]))),
+		Message:  string(b[diskQueueHeaderSize:]),
+	}, nil
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
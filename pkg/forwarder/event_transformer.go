@@ -0,0 +1,151 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/formatters"
+	"github.com/carbonblack/cb-event-forwarder/pkg/transforms"
+	log "github.com/sirupsen/logrus"
+)
+
+// minimum time between two logged transform errors
+const transformErrorLogInterval = 10 * time.Second
+
+// eventTransformer applies the configured transform and field coercions to events, in the order
+// of the pipeline. Events that the transform fails on are forwarded as they were before it;
+// fields that can't be coerced are kept or dropped depending on the coercion failure policy.
+// Fields written by both stages are resolved with the conflict policy, which fails events with a
+// ConflictError under the error policy.
+type eventTransformer struct {
+	program   *transforms.Program
+	coercions *transforms.Coercions
+	conflicts transforms.ConflictPolicy
+	// the configured stages among those asked for, in order
+	stages []PipelineStage
+
+	logMutex   sync.Mutex
+	lastLogged time.Time
+	suppressed int64
+}
+
+// newEventTransformer returns a transformer running the given stages, or nil when none of them
+// is configured. Stages other than transform and coerce are ignored.
+func newEventTransformer(program *transforms.Program, coercions *transforms.Coercions, conflicts transforms.ConflictPolicy, stages []PipelineStage) *eventTransformer {
+	t := &eventTransformer{program: program, coercions: coercions, conflicts: conflicts}
+	for _, stage := range stages {
+		if (stage == PipelineTransform && program != nil) || (stage == PipelineCoerce && coercions != nil) {
+			t.stages = append(t.stages, stage)
+		}
+	}
+	if len(t.stages) == 0 {
+		return nil
+	}
+	return t
+}
+
+// apply runs every stage of the transformer on a json event of the given type, returning it
+// along with its type once transformed. The only error returned is the ConflictError of an event
+// failed by the conflict policy.
+func (t *eventTransformer) apply(msg []byte, eventType string) ([]byte, string, error) {
+	var event map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(msg))
+	decoder.UseNumber()
+	if err := decoder.Decode(&event); err != nil {
+		t.reportError("Could not transform event, forwarding it unmodified", err)
+		return msg, eventType, nil
+	}
+
+	writes := transforms.NewFieldWrites(t.conflicts)
+	for _, stage := range t.stages {
+		ok, err := t.applyStage(stage, event, writes)
+		if err != nil {
+			return nil, "", err
+		}
+		if !ok {
+			return msg, eventType, nil
+		}
+	}
+
+	transformed, err := json.Marshal(event)
+	if err != nil {
+		t.reportError("Could not transform event, forwarding it unmodified", err)
+		return msg, eventType, nil
+	}
+	transformedType, _ := event["type"].(string)
+	return transformed, transformedType, nil
+}
+
+// applyStage runs a stage on a parsed event, recording its writes in writes, and reports whether
+// the event should be passed on modified, or the conflict that fails it.
+func (t *eventTransformer) applyStage(stage PipelineStage, event map[string]interface{}, writes *transforms.FieldWrites) (bool, error) {
+	writes.Stage(string(stage))
+	switch stage {
+	case PipelineTransform:
+		if err := t.program.ApplyTracked(event, writes); err != nil {
+			if isConflict(err) {
+				return false, err
+			}
+			t.reportError("Could not transform event, forwarding it unmodified", err)
+			return false, nil
+		}
+	case PipelineCoerce:
+		if err := t.coercions.ApplyTracked(event, writes); err != nil {
+			if isConflict(err) {
+				return false, err
+			}
+			t.reportError("Could not coerce event fields", err)
+		}
+	}
+	return true, nil
+}
+
+// isConflict reports whether err is the ConflictError of an event failed by the conflict policy.
+func isConflict(err error) bool {
+	var conflict *transforms.ConflictError
+	return errors.As(err, &conflict)
+}
+
+// formatterStage returns a stage of the transformer as a stage of an output's formatter, for the
+// outputs that run it after a stage of their own, or nil if the transformer doesn't run it.
+func (t *eventTransformer) formatterStage(stage PipelineStage) formatters.Stage {
+	if t == nil {
+		return nil
+	}
+	for _, s := range t.stages {
+		if s != stage {
+			continue
+		}
+		return func(next formatters.Formatter) formatters.Formatter {
+			return formatters.StageFormatter{
+				Apply: func(event map[string]interface{}, writes *transforms.FieldWrites) (bool, error) {
+					return t.applyStage(stage, event, writes)
+				},
+				Conflicts: t.conflicts,
+				Next:      next,
+			}
+		}
+	}
+	return nil
+}
+
+func (t *eventTransformer) reportError(message string, err error) {
+	t.logMutex.Lock()
+	defer t.logMutex.Unlock()
+
+	if time.Since(t.lastLogged) < transformErrorLogInterval {
+		t.suppressed++
+		return
+	}
+	if t.suppressed > 0 {
+		log.Errorf("%s: %s (%d similar errors suppressed)", message, err, t.suppressed)
+	} else {
+		log.Errorf("%s: %s", message, err)
+	}
+	t.lastLogged = time.Now()
+	t.suppressed = 0
+}
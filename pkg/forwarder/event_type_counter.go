@@ -0,0 +1,67 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// the type events without one are counted as, and the one the types over the cap are counted as
+const (
+	unknownEventType = "unknown"
+	otherEventType   = "other"
+)
+
+// EventTypeCounter counts events by type. It holds at most maxTypes counts, other included: the
+// first maxTypes-1 types seen get a count of their own, the events of any other type being
+// counted as other, so that events with pathological types can't grow it without bound.
+type EventTypeCounter struct {
+	maxTypes int
+
+	mutex  sync.Mutex
+	counts map[string]int64
+}
+
+func NewEventTypeCounter(maxTypes int) *EventTypeCounter {
+	return &EventTypeCounter{maxTypes: maxTypes, counts: make(map[string]int64)}
+}
+
+// Add counts an event of the given type, empty for events without one.
+func (c *EventTypeCounter) Add(eventType string) {
+	if len(eventType) == 0 {
+		eventType = unknownEventType
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// a slot is kept for other, so the counts never hold more than maxTypes types
+	if _, ok := c.counts[eventType]; !ok && len(c.counts) >= c.maxTypes-1 {
+		eventType = otherEventType
+	}
+	c.counts[eventType]++
+}
+
+// Counts returns a copy of the counts, nil when no event was counted.
+func (c *EventTypeCounter) Counts() map[string]int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.counts) == 0 {
+		return nil
+	}
+	counts := make(map[string]int64, len(c.counts))
+	for eventType, count := range c.counts {
+		counts[eventType] = count
+	}
+	return counts
+}
+
+// eventTypeOf returns the type field of a json event, empty for events without one or that are
+// not json. Only that field is decoded, for the events that the input worker didn't decode itself.
+func eventTypeOf(message []byte) string {
+	var event struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(message, &event)
+	return event.Type
+}
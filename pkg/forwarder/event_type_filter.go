@@ -0,0 +1,143 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// EventTypeFilter drops events by type as soon as they are received, so that events no output
+// wants are never transformed, formatted or queued. Its rules can be replaced while events are
+// being filtered; every event is checked against a single version of the rules.
+type EventTypeFilter struct {
+	rules atomic.Value // *eventTypeRules
+
+	mutex              sync.Mutex
+	filteredByType     map[string]int64
+	filteredEventCount int64
+}
+
+// eventTypeRules is one version of the filter's rules; it is never modified once in use.
+type eventTypeRules struct {
+	allowlist []string
+	denylist  []string
+	version   int64
+	loaded    time.Time
+
+	// event type -> bool, so that patterns are only matched once per type
+	decisions sync.Map
+}
+
+type EventTypeFilterStatistics struct {
+	FilteredEventCount int64            `json:"filtered_event_count"`
+	FilteredByType     map[string]int64 `json:"filtered_by_type"`
+	RuleSetVersion     int64            `json:"rule_set_version"`
+	RulesLoadedAt      time.Time        `json:"rules_loaded_at"`
+	Allowlist          []string         `json:"allowlist"`
+	Denylist           []string         `json:"denylist"`
+}
+
+// NewEventTypeFilter returns a filter with the given rules as version 1. Without patterns it
+// admits every event without decoding it.
+func NewEventTypeFilter(allowlist, denylist []string) *EventTypeFilter {
+	f := &EventTypeFilter{filteredByType: make(map[string]int64)}
+	f.rules.Store(&eventTypeRules{allowlist: allowlist, denylist: denylist, version: 1, loaded: time.Now()})
+	return f
+}
+
+// SetRules replaces the rules, returning the version of the new ones. Events being checked
+// keep the rules they started with.
+func (f *EventTypeFilter) SetRules(allowlist, denylist []string) int64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	version := f.rules.Load().(*eventTypeRules).version + 1
+	f.rules.Store(&eventTypeRules{allowlist: allowlist, denylist: denylist, version: version, loaded: time.Now()})
+	return version
+}
+
+// Admit reports whether an event is forwarded. Events without a type are only forwarded when
+// there is no allowlist.
+func (f *EventTypeFilter) Admit(msg []byte) bool {
+	rules := f.rules.Load().(*eventTypeRules)
+	if len(rules.allowlist) == 0 && len(rules.denylist) == 0 {
+		return true
+	}
+
+	var event struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(msg, &event); err != nil {
+		return true
+	}
+
+	allowed, ok := rules.decisions.Load(event.Type)
+	if !ok {
+		allowed = EventTypeAllowed(rules.allowlist, rules.denylist, event.Type)
+		rules.decisions.Store(event.Type, allowed)
+	}
+	if allowed.(bool) {
+		return true
+	}
+
+	atomic.AddInt64(&f.filteredEventCount, 1)
+	f.mutex.Lock()
+	f.filteredByType[event.Type]++
+	f.mutex.Unlock()
+	log.Debugf("Filtered out event of type %s", event.Type)
+	return false
+}
+
+func (f *EventTypeFilter) Statistics() EventTypeFilterStatistics {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	rules := f.rules.Load().(*eventTypeRules)
+
+	byType := make(map[string]int64, len(f.filteredByType))
+	for eventType, count := range f.filteredByType {
+		byType[eventType] = count
+	}
+	return EventTypeFilterStatistics{
+		FilteredEventCount: atomic.LoadInt64(&f.filteredEventCount),
+		FilteredByType:     byType,
+		RuleSetVersion:     rules.version,
+		RulesLoadedAt:      rules.loaded,
+		Allowlist:          rules.allowlist,
+		Denylist:           rules.denylist,
+	}
+}
+
+// ReloadFilters reads the configuration file again and switches to its event type filters. The
+// rest of the configuration is only checked, changes to it need a restart. When the file is
+// invalid the current filters are kept. Every reload is recorded in the audit trail, with the
+// trigger that caused it.
+func (forwarder *EventForwarder) ReloadFilters(trigger string) error {
+	audit := configReloadAudit{Trigger: trigger, ConfigFile: forwarder.ConfigFile}
+
+	cfg, err := ParseConfig(forwarder.ConfigFile)
+	if err != nil {
+		audit.rejected(err)
+		return err
+	}
+
+	// the running configuration is the one read at startup, with the filters last loaded
+	current := *forwarder.Configuration
+	rules := forwarder.typeFilter.Statistics()
+	current.EventTypeAllowlist, current.EventTypeDenylist = rules.Allowlist, rules.Denylist
+
+	version := forwarder.typeFilter.SetRules(cfg.EventTypeAllowlist, cfg.EventTypeDenylist)
+	log.Infof("Loaded event type filters version %d: allowlist %v, denylist %v", version, cfg.EventTypeAllowlist, cfg.EventTypeDenylist)
+	audit.applied(DiffConfigurations(&current, &cfg), reloadableFields)
+	return nil
+}
+
+// settings that take effect on reload, any other change needs a restart
+var reloadableFields = map[string]bool{
+	"EventTypeAllowlist": true,
+	"EventTypeDenylist":  true,
+}
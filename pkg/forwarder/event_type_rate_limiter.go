@@ -0,0 +1,152 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// EventTypeRateLimiter caps the rate of events of the types matched by its limits, each with a
+// token bucket of its own, so that noisy types can be throttled while others flow unhindered.
+// A limit whose pattern matches several types caps them together. Buckets hold up to a second
+// worth of events, allowing short bursts.
+type EventTypeRateLimiter struct {
+	limits  []EventTypeRateLimit
+	buckets []*tokenBucket
+
+	mutex sync.Mutex
+	// event type -> index of the limit that applies to it, -1 for none
+	limitByType     map[string]int
+	throttledByType map[string]int64
+	sampledByType   map[string]int64
+}
+
+type EventTypeRateLimitStatistics struct {
+	ThrottledEventCount int64 `json:"throttled_event_count"`
+	// events over their limit that were dropped, and those forwarded anyway with sample=<n>
+	ThrottledByType map[string]int64     `json:"throttled_by_type"`
+	SampledByType   map[string]int64     `json:"sampled_by_type,omitempty"`
+	Limits          []EventTypeRateLimit `json:"limits"`
+}
+
+// NewEventTypeRateLimiter returns a limiter applying limits. Without limits it admits every event
+// without decoding it.
+func NewEventTypeRateLimiter(limits []EventTypeRateLimit) *EventTypeRateLimiter {
+	l := &EventTypeRateLimiter{
+		limits:          limits,
+		limitByType:     make(map[string]int),
+		throttledByType: make(map[string]int64),
+		sampledByType:   make(map[string]int64),
+	}
+	for _, limit := range limits {
+		l.buckets = append(l.buckets, newTokenBucket(limit.EventsPerSecond))
+	}
+	return l
+}
+
+// Admit reports whether an event is forwarded. Events without a type are only limited by a
+// limit whose pattern matches the empty type.
+func (l *EventTypeRateLimiter) Admit(msg []byte) bool {
+	if len(l.limits) == 0 {
+		return true
+	}
+
+	var event struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(msg, &event); err != nil {
+		return true
+	}
+	return l.AdmitType(event.Type, time.Now())
+}
+
+// AdmitType reports whether an event of the given type, received at now, is forwarded.
+func (l *EventTypeRateLimiter) AdmitType(eventType string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	index, ok := l.limitByType[eventType]
+	if !ok {
+		index = -1
+		for i, limit := range l.limits {
+			if limit.Matches(eventType) {
+				index = i
+				break
+			}
+		}
+		l.limitByType[eventType] = index
+	}
+	if index < 0 || l.buckets[index].take(now) {
+		return true
+	}
+
+	// one of every SampleOneIn events of the type over the limit goes through
+	limit := l.limits[index]
+	over := l.throttledByType[eventType] + l.sampledByType[eventType] + 1
+	if limit.SampleOneIn > 0 && over%int64(limit.SampleOneIn) == 0 {
+		l.sampledByType[eventType]++
+		return true
+	}
+	l.throttledByType[eventType]++
+	log.Debugf("Throttled event of type %s over %g events per second", eventType, limit.EventsPerSecond)
+	return false
+}
+
+func (l *EventTypeRateLimiter) Statistics() EventTypeRateLimitStatistics {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	stats := EventTypeRateLimitStatistics{
+		ThrottledByType: make(map[string]int64, len(l.throttledByType)),
+		Limits:          l.limits,
+	}
+	for eventType, count := range l.throttledByType {
+		stats.ThrottledByType[eventType] = count
+		stats.ThrottledEventCount += count
+	}
+	if len(l.sampledByType) > 0 {
+		stats.SampledByType = make(map[string]int64, len(l.sampledByType))
+		for eventType, count := range l.sampledByType {
+			stats.SampledByType[eventType] = count
+		}
+	}
+	return stats
+}
+
+// tokenBucket refills at rate tokens per second, holding up to a second worth of them, and at
+// least one.
+type tokenBucket struct {
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	capacity := rate
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &tokenBucket{rate: rate, capacity: capacity, tokens: capacity}
+}
+
+// take takes a token at now, reporting whether there was one.
+func (b *tokenBucket) take(now time.Time) bool {
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+	}
+	if b.last.IsZero() || now.After(b.last) {
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
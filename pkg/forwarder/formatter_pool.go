@@ -0,0 +1,94 @@
+package forwarder
+
+import (
+	"sync/atomic"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// size of the queue in front of each formatter
+const FORMATTERQUEUESIZE = 100
+
+// formatterPool formats events for every output and hands them over on several workers, so that
+// formatting large events is not limited to what a single core can do. Events are spread over
+// the formatters like deliveries over the message processors: those from the same sensor always
+// go to the same formatter, so that every output gets the events from a sensor in order.
+type formatterPool struct {
+	shards  []chan formatterJob
+	workers []*formatterStatistics
+	shardPicker
+}
+
+// formatterJob is an event to format for the outputs, along with its debug tee record when it
+// was sampled.
+type formatterJob struct {
+	event  forwardedEvent
+	record *DebugTeeRecord
+}
+
+type formatterStatistics struct {
+	eventCount int64
+	eventRate  metrics.Meter
+}
+
+type FormatterStatistics struct {
+	EventCount      int64   `json:"event_count"`
+	EventsPerSecond float64 `json:"events_per_second"`
+	Backlog         int     `json:"backlog"`
+}
+
+type FormatterPoolStatistics struct {
+	Size          int                   `json:"size"`
+	PreserveOrder bool                  `json:"preserve_order"`
+	Workers       []FormatterStatistics `json:"workers"`
+}
+
+func newFormatterPool(size int, preserveOrder bool) *formatterPool {
+	pool := &formatterPool{shardPicker: shardPicker{preserveOrder: preserveOrder}}
+	for i := 0; i < size; i++ {
+		pool.shards = append(pool.shards, make(chan formatterJob, FORMATTERQUEUESIZE))
+		pool.workers = append(pool.workers, &formatterStatistics{eventRate: metrics.NewMeter()})
+	}
+	return pool
+}
+
+// start runs one formatter per shard, each calling format for the jobs of its shard.
+func (pool *formatterPool) start(format func(job formatterJob)) {
+	for i, shard := range pool.shards {
+		go func(shard <-chan formatterJob, stats *formatterStatistics) {
+			for job := range shard {
+				format(job)
+				atomic.AddInt64(&stats.eventCount, 1)
+				stats.eventRate.Mark(1)
+			}
+		}(shard, pool.workers[i])
+	}
+}
+
+// dispatch hands a job over to the formatter of its shard. It is only called from a single
+// goroutine.
+func (pool *formatterPool) dispatch(job formatterJob) {
+	shard := pool.pick(job.event.sensorID, len(pool.shards), func(shard int) int { return len(pool.shards[shard]) })
+	pool.shards[shard] <- job
+}
+
+// backlog returns how many events wait for a formatter, across all shards.
+func (pool *formatterPool) backlog() int {
+	backlog := 0
+	for _, shard := range pool.shards {
+		backlog += len(shard)
+	}
+	return backlog
+}
+
+func (pool *formatterPool) statistics() FormatterPoolStatistics {
+	ret := FormatterPoolStatistics{Size: len(pool.shards), PreserveOrder: pool.preserveOrder}
+	for i, worker := range pool.workers {
+		ret.Workers = append(ret.Workers, FormatterStatistics{
+			EventCount:      atomic.LoadInt64(&worker.eventCount),
+			EventsPerSecond: worker.eventRate.Rate1(),
+			Backlog:         len(pool.shards[i]),
+		})
+	}
+	return ret
+}
@@ -5,6 +5,7 @@ import (
 	"expvar"
 	"fmt"
 	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/formatters"
 	. "github.com/carbonblack/cb-event-forwarder/pkg/outputs"
 	"github.com/carbonblack/cb-event-forwarder/pkg/rabbitmq"
 	"github.com/rcrowley/go-metrics"
@@ -13,6 +14,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -24,21 +26,78 @@ type OutputWithParameters struct {
 
 type EventForwarder struct {
 	*Configuration
-	Output           OutputWithParameters
-	outputChan       chan string
-	signalChan       chan os.Signal
-	outputSignals    chan os.Signal
-	consumer         *rabbitmq.Consumer
-	workerWaitGroup  *sync.WaitGroup
-	outputHasStopped *sync.Cond
+	outputs            []*outputRoute
+	outputChan         chan inputEvent
+	signalChan         chan os.Signal
+	consumer           *rabbitmq.Consumer
+	workerWaitGroup    *sync.WaitGroup
+	outputsHaveStopped *sync.WaitGroup
+	processors         *processorPool
+	formatters         *formatterPool
+	schedule           *scheduleFilter
+	typeFilter         *EventTypeFilter
+	typeLimiter        *EventTypeRateLimiter
+	sequence           *SequenceCounter
+	backpressure       *backpressureMonitor
+	deadLetters        *DeadLetterFile
+	debugTee           *DebugTee
 	*Status
 }
 
 const OUTPUTCHANNELSIZE = 1000000
 
+// longest wait between attempts to initialize a required output at startup
+const maxOutputStartupBackoff = 30 * time.Second
+
+// how often optional outputs that were unavailable at startup are retried
+const pendingOutputRetryInterval = 30 * time.Second
+
 func NewEventForwarderFromConfig(signals chan os.Signal, cfg *Configuration) (EventForwarder, error) {
-	output, err := loadOutputFromConfig(cfg)
-	return EventForwarder{Status: NewStatus(), outputHasStopped: sync.NewCond(&sync.RWMutex{}), workerWaitGroup: &sync.WaitGroup{}, outputSignals: make(chan os.Signal), signalChan: signals, Configuration: cfg, Output: output, outputChan: make(chan string, OUTPUTCHANNELSIZE)}, err
+	forwarder := EventForwarder{Status: NewStatus(), outputsHaveStopped: &sync.WaitGroup{}, workerWaitGroup: &sync.WaitGroup{}, signalChan: signals, Configuration: cfg, outputChan: make(chan inputEvent, OUTPUTCHANNELSIZE)}
+
+	SharedHostConnectionLimiter().SetLimit(cfg.MaxConnectionsPerHost)
+	outputConfigs := []*Configuration{cfg}
+	for i := range cfg.AdditionalOutputs {
+		outputConfigs = append(outputConfigs, &cfg.AdditionalOutputs[i])
+	}
+
+	deadLetters, err := OpenDeadLetterFile(cfg.DeadLetterFile)
+	if err != nil {
+		return forwarder, err
+	}
+	forwarder.deadLetters = deadLetters
+
+	debugTee, err := OpenDebugTee(cfg.DebugTeeFile, cfg.DebugTeeSampleRate, cfg.DebugTeeMaxBytes)
+	if err != nil {
+		return forwarder, err
+	}
+	forwarder.debugTee = debugTee
+
+	shared := cfg.SharedPipelineStages()
+	for _, outputConfig := range outputConfigs {
+		route, err := newOutputRoute(outputConfig, shared)
+		if err != nil {
+			return forwarder, err
+		}
+		route.required = cfg.IsRequiredOutput(outputConfig)
+		route.deadLetters = deadLetters
+		forwarder.outputs = append(forwarder.outputs, route)
+	}
+
+	forwarder.schedule = newScheduleFilter(cfg)
+	forwarder.typeFilter = NewEventTypeFilter(cfg.EventTypeAllowlist, cfg.EventTypeDenylist)
+	forwarder.typeLimiter = NewEventTypeRateLimiter(cfg.EventTypeRateLimits)
+	if len(cfg.SequenceField) > 0 {
+		sequence, err := NewSequenceCounter(cfg.SequenceStateFile)
+		if err != nil {
+			return forwarder, err
+		}
+		forwarder.sequence = sequence
+	}
+	if !cfg.AMQPAutomaticAcking && cfg.BackpressureThreshold > 0 {
+		forwarder.backpressure = newBackpressureMonitor(cfg.BackpressureThreshold, cfg.AMQPPrefetchCount)
+	}
+	return forwarder, nil
 }
 
 func (forwarder *EventForwarder) Startup(hostname string) error {
@@ -48,7 +107,10 @@ func (forwarder *EventForwarder) Startup(hostname string) error {
 		return err
 	}
 	forwarder.outputMetrics()
+	forwarder.startStatsdEmitter()
+	forwarder.startStatsFileWriter()
 	forwarder.startAMQPConsumer(hostname)
+	forwarder.startBackpressureMonitor()
 	forwarder.handleAuditLogs()
 	return nil
 }
@@ -64,18 +126,170 @@ func (forwarder *EventForwarder) StartOutput() error {
 }
 
 func (forwarder *EventForwarder) startOutput() error {
-	return forwarder.Output.Go(forwarder.outputChan, forwarder.outputSignals, forwarder.outputHasStopped)
+	for _, route := range forwarder.outputs {
+		if err := route.openDiskQueue(); err != nil {
+			return err
+		}
+		if route.pending {
+			route.startWhenAvailable(forwarder.outputsHaveStopped)
+			continue
+		}
+		if err := route.start(forwarder.outputsHaveStopped); err != nil {
+			return err
+		}
+	}
+
+	// sequence numbers are added before formatting, a single formatter keeps them in order
+	numFormatters := forwarder.NumProcessors
+	if forwarder.sequence != nil {
+		numFormatters = 1
+	}
+	log.Infof("Starting %d formatters", numFormatters)
+	pool := newFormatterPool(numFormatters, forwarder.PreserveOrder)
+	pool.start(forwarder.format)
+
+	forwarder.Lock()
+	forwarder.formatters = pool
+	forwarder.Unlock()
+
+	go forwarder.dispatchOutput(pool)
+	return nil
 }
 
 func (forwarder *EventForwarder) initializeOutput() error {
-	err := forwarder.Output.Initialize(forwarder.Output.Parameters)
-	if err != nil {
-		return err
+	for _, route := range forwarder.outputs {
+		if !route.required {
+			if err := route.initialize(); err != nil {
+				log.Warnf("Optional output %s is unavailable, will keep retrying every %s: %s",
+					route.String(), pendingOutputRetryInterval, err)
+				route.pending = true
+			}
+			continue
+		}
+		if err := route.initializeWithin(forwarder.RequiredOutputTimeout, forwarder.RequiredOutputBackoff); err != nil {
+			return fmt.Errorf("Required output %s is unavailable at startup: %s", route.String(), err)
+		}
 	}
-	log.Infof("Initialized output: %s\n", forwarder.Output.String())
+	forwarder.assignOutputKeys()
 	return nil
 }
 
+// assignOutputKeys makes sure every route has its own key, so that their statistics don't
+// overwrite each other. Outputs only know their key once initialized.
+func (forwarder *EventForwarder) assignOutputKeys() {
+	routesByKey := make(map[string][]*outputRoute)
+	for _, route := range forwarder.outputs {
+		route.keySuffix = ""
+		routesByKey[route.Key()] = append(routesByKey[route.Key()], route)
+	}
+
+	for key, routes := range routesByKey {
+		if len(routes) < 2 {
+			continue
+		}
+		for _, route := range routes {
+			name := route.config.OutputName
+			if name == "" {
+				name = "main"
+			}
+			route.keySuffix = "[" + name + "]"
+			log.Infof("More than one output uses %s, reporting statistics for %s as %s", key, name, route.Key())
+		}
+	}
+}
+
+// forwardedEvent is an event on its way to the outputs, along with the sensor it comes from, 0
+// when not known, and the acknowledgement of the delivery it came in, done with once the event
+// is handed over to every output.
+type forwardedEvent struct {
+	*formatters.Event
+	eventType string
+	sensorID  int64
+	ack       *deliveryAck
+}
+
+// dispatchOutput hands every event produced by the input workers to the formatters, holding back
+// the events that the schedule does not allow yet.
+func (forwarder *EventForwarder) dispatchOutput(pool *formatterPool) {
+	var scheduleCheck <-chan time.Time
+	if forwarder.schedule != nil {
+		ticker := time.NewTicker(scheduleCheckInterval)
+		defer ticker.Stop()
+		scheduleCheck = ticker.C
+	}
+
+	for {
+		select {
+		case input, ok := <-forwarder.outputChan:
+			if !ok {
+				return
+			}
+			if event, ok := forwarder.scheduled(input, time.Now()); ok {
+				forwarder.enqueue(pool, event)
+			}
+
+		case now := <-scheduleCheck:
+			for _, event := range forwarder.schedule.release(now) {
+				forwarder.enqueue(pool, event)
+			}
+		}
+	}
+}
+
+// scheduled returns the event for an input event, with its correlation ID, unless the schedule
+// holds it back or drops it at the given time.
+func (forwarder *EventForwarder) scheduled(input inputEvent, now time.Time) (forwardedEvent, bool) {
+	// parsed at most once, by the first output or filter that needs the event's fields
+	event := forwardedEvent{
+		Event:     formatters.NewEventReceivedAt(input.message, input.received),
+		eventType: input.eventType,
+		sensorID:  input.sensorID,
+		ack:       input.ack,
+	}
+	if len(forwarder.CorrelationIDField) > 0 {
+		event.EmbedID(forwarder.CorrelationIDField)
+	}
+	if forwarder.schedule != nil && !forwarder.schedule.admit(event, now) {
+		return forwardedEvent{}, false
+	}
+	return event, true
+}
+
+// enqueue numbers events as they are handed to the formatters, so that events held back by the
+// schedule get their number when they are released, and picks the events sampled by the debug
+// tee.
+func (forwarder *EventForwarder) enqueue(pool *formatterPool, event forwardedEvent) {
+	if forwarder.sequence != nil {
+		event.EmbedSequence(forwarder.SequenceField, forwarder.sequence.Next())
+	}
+	pool.dispatch(formatterJob{event: event, record: forwarder.debugTee.Sample(event.Event)})
+}
+
+// format formats an event for each output and hands it over. Sampled events are written to the
+// debug tee along with what each output made of them.
+func (forwarder *EventForwarder) format(job formatterJob) {
+	for _, route := range forwarder.outputs {
+		message, err := route.enqueue(job.event)
+		job.record.Add(route.outputName(), message, err)
+	}
+	job.event.ack.done()
+	forwarder.debugTee.Write(job.record)
+}
+
+func (forwarder *EventForwarder) signalOutputs(signal os.Signal) {
+	for _, route := range forwarder.outputs {
+		route.signals <- signal
+	}
+}
+
+func (forwarder *EventForwarder) outputKeys() []OutputKeys {
+	keys := make([]OutputKeys, len(forwarder.outputs))
+	for i, route := range forwarder.outputs {
+		keys[i] = route
+	}
+	return keys
+}
+
 func loadOutputFromConfig(cfg *Configuration) (output OutputWithParameters, err error) {
 	output.Parameters = cfg.OutputParameters
 
@@ -100,6 +314,24 @@ func loadOutputFromConfig(cfg *Configuration) (output OutputWithParameters, err
 		output.Output = NewSplunkOutputFromConfig(cfg)
 	case KafkaOutputType:
 		output.Output = NewKafkaOutputFromConfig(cfg)
+	case JournaldOutputType:
+		output.Output = NewJournaldOutputFromConfig(cfg)
+	case WebSocketOutputType:
+		output.Output = NewWebSocketOutputFromConfig(cfg)
+	case LocalSyslogOutputType:
+		output.Output = NewLocalSyslogOutputFromConfig(cfg)
+	case BucketFileOutputType:
+		output.Output = NewBucketFileOutputFromConfig(cfg)
+	case LokiOutputType:
+		output.Output = NewLokiOutputFromConfig(cfg)
+	case SQLOutputType:
+		output.Output = NewSQLOutputFromConfig(cfg)
+	case SplunkHECOutputType:
+		output.Output = NewSplunkHECOutputFromConfig(cfg)
+	case NATSOutputType:
+		output.Output = NewNATSOutputFromConfig(cfg)
+	case OTLPOutputType:
+		output.Output = NewOTLPOutputFromConfig(cfg)
 	default:
 		return output, fmt.Errorf("No valid output handler found (%d)", cfg.OutputType)
 	}
@@ -137,7 +369,19 @@ func (forwarder *EventForwarder) MessageProcessingLoop(uri, queueName, consumerT
 		dialer = rabbitmq.StreadwayAMQPDialer{}
 	}
 
-	forwarder.consumer = rabbitmq.NewConsumer(uri, queueName, consumerTag, forwarder.UseRawSensorExchange, forwarder.EventTypes, dialer, forwarder.GetAMQPTLSConfigFromConf())
+	consumer := rabbitmq.NewConsumer(uri, queueName, consumerTag, forwarder.UseRawSensorExchange, forwarder.EventTypes, dialer, forwarder.GetAMQPTLSConfigFromConf())
+	if !forwarder.AMQPAutomaticAcking {
+		prefetch := forwarder.AMQPPrefetchCount
+		if forwarder.backpressure != nil {
+			// keep throttling across reconnections
+			prefetch = int(atomic.LoadInt64(&forwarder.backpressure.prefetch))
+		}
+		consumer.UseManualAcking(prefetch)
+	}
+
+	forwarder.Lock()
+	forwarder.consumer = consumer
+	forwarder.Unlock()
 
 	deliveries, err := forwarder.consumer.Connect()
 
@@ -171,12 +415,25 @@ func (forwarder *EventForwarder) startInputWorkers(deliveries <-chan amqp.Delive
 	numProcessors := forwarder.NumProcessors
 
 	log.Infof("Starting %d message processors\n", numProcessors)
+	if !forwarder.PreserveOrder {
+		log.Info("Event order is not preserved, deliveries go to the least busy message processor")
+	}
 
-	inputWorker := NewInputWorker(forwarder.outputChan, forwarder.Configuration, forwarder.Status)
+	pool := newProcessorPool(numProcessors, forwarder.PreserveOrder)
+	pool.start(forwarder.newInputWorker(), forwarder.workerWaitGroup, deliveries)
 
-	for i := 0; i < numProcessors; i++ {
-		inputWorker.consume(forwarder.workerWaitGroup, deliveries)
-	}
+	forwarder.Lock()
+	forwarder.processors = pool
+	forwarder.Unlock()
+}
+
+// newInputWorker returns an input worker producing events for the outputs of the forwarder.
+func (forwarder *EventForwarder) newInputWorker() InputWorker {
+	inputWorker := NewInputWorker(forwarder.outputChan, forwarder.Configuration, forwarder.Status)
+	inputWorker.typeFilter = forwarder.typeFilter
+	inputWorker.typeLimiter = forwarder.typeLimiter
+	inputWorker.deadLetters = forwarder.deadLetters
+	return inputWorker
 }
 
 func (forwarder *EventForwarder) RunUntilExit() {
@@ -199,18 +456,88 @@ func (forwarder *EventForwarder) RunUntilExit() {
 				switch signal {
 				case syscall.SIGTERM, syscall.SIGINT:
 					handleExit(signal)
-					forwarder.outputSignals <- signal
+					forwarder.signalOutputs(signal)
 					return
+				case FlushSignal:
+					log.Infof("Received %s, flushing the outputs", signal)
+					forwarder.signalOutputs(signal)
+					forwarder.logFlushSummary()
+				case ReloadSignal:
+					log.Infof("Received %s, reloading the event type filters from %s", signal, forwarder.ConfigFile)
+					if err := forwarder.ReloadFilters(signal.String()); err != nil {
+						log.Errorf("Keeping the current event type filters: %s", err)
+					}
 				default:
-					forwarder.outputSignals <- signal
+					forwarder.signalOutputs(signal)
 				}
 			}
 		}
 	}()
 
-	forwarder.outputHasStopped.L.Lock()
-	forwarder.outputHasStopped.Wait()
-	forwarder.outputHasStopped.L.Unlock()
+	forwarder.outputsHaveStopped.Wait()
+
+	for _, route := range forwarder.outputs {
+		route.closeDiskQueue()
+	}
+	if forwarder.sequence != nil {
+		if err := forwarder.sequence.Close(); err != nil {
+			log.Errorf("Could not save sequence state file %s: %s", forwarder.SequenceStateFile, err)
+		}
+	}
+	if err := forwarder.deadLetters.Close(); err != nil {
+		log.Errorf("Could not close dead letter file %s: %s", forwarder.DeadLetterFile, err)
+	}
+	if err := forwarder.debugTee.Close(); err != nil {
+		log.Errorf("Could not close debug tee file %s: %s", forwarder.DebugTeeFile, err)
+	}
+	forwarder.logShutdownSummary()
+}
+
+// logFlushSummary reports how many events are still queued for each output after a flush. Those
+// are not forced out, they are written as each output catches up.
+func (forwarder *EventForwarder) logFlushSummary() {
+	for _, route := range forwarder.outputs {
+		log.WithFields(log.Fields{
+			"output":  route.String(),
+			"backlog": forwarder.backlog() + route.statistics().Backlog,
+		}).Info("Output flush summary")
+	}
+}
+
+// backlog returns how many events wait to be handed over to the outputs, produced by the input
+// workers but not formatted yet. Every output gets each of them.
+func (forwarder *EventForwarder) backlog() int {
+	backlog := len(forwarder.outputChan)
+	if forwarder.formatters != nil {
+		backlog += forwarder.formatters.backlog()
+	}
+	return backlog
+}
+
+// logShutdownSummary reports how many events each output delivered and lost, along with
+// the number of events still queued for it, to help estimate data loss across restarts.
+func (forwarder *EventForwarder) logShutdownSummary() {
+	for _, route := range forwarder.outputs {
+		log.WithFields(OutputShutdownSummary(route.String(), forwarder.backlog(), route.statistics(), route.Statistics())).Info("Output shutdown summary")
+	}
+}
+
+// OutputShutdownSummary returns the fields of the shutdown summary of an output, backlog being
+// the events not handed over to any output yet. The route's backlog includes its disk queue.
+func OutputShutdownSummary(name string, backlog int, routeStats OutputRouteStatistics, outputStats interface{}) log.Fields {
+	fields := log.Fields{
+		"output":           name,
+		"backlog":          backlog + routeStats.Backlog,
+		"overflow_dropped": routeStats.DroppedEventCount,
+	}
+	if stats, ok := outputStats.(DeliveryStatistics); ok {
+		fields["sent"] = stats.Sent()
+		fields["dropped"] = stats.Dropped()
+	}
+	if stats, ok := outputStats.(ReconnectStatistics); ok {
+		fields["reconnects"] = stats.Reconnects()
+	}
+	return fields
 }
 
 func (forwarder *EventForwarder) handleAuditLogs() {
@@ -292,41 +619,89 @@ func (forwarder *EventForwarder) setupMetrics() {
 	metrics.Register("subscribed_events", expvar.Func(func() interface{} {
 		return forwarder.EventTypes
 	}))
+	metrics.Register("processor_pool", expvar.Func(func() interface{} {
+		forwarder.RLock()
+		defer forwarder.RUnlock()
+
+		if forwarder.processors == nil {
+			return ProcessorPoolStatistics{Size: forwarder.NumProcessors, PreserveOrder: forwarder.PreserveOrder}
+		}
+		return forwarder.processors.statistics()
+	}))
+	metrics.Register("formatter_pool", expvar.Func(func() interface{} {
+		forwarder.RLock()
+		defer forwarder.RUnlock()
+
+		if forwarder.formatters == nil {
+			return FormatterPoolStatistics{PreserveOrder: forwarder.PreserveOrder}
+		}
+		return forwarder.formatters.statistics()
+	}))
+	if forwarder.schedule != nil {
+		metrics.Register("schedule", expvar.Func(func() interface{} {
+			return forwarder.schedule.statistics()
+		}))
+	}
+	metrics.Register("event_type_filter", expvar.Func(func() interface{} {
+		return forwarder.typeFilter.Statistics()
+	}))
+	if len(forwarder.EventTypeRateLimits) > 0 {
+		metrics.Register("event_type_rate_limits", expvar.Func(func() interface{} {
+			return forwarder.typeLimiter.Statistics()
+		}))
+	}
+	if forwarder.sequence != nil {
+		metrics.Register("sequence", expvar.Func(func() interface{} {
+			return forwarder.sequence.Statistics()
+		}))
+	}
+	if forwarder.backpressure != nil {
+		metrics.Register("backpressure", expvar.Func(func() interface{} {
+			return forwarder.backpressureStatistics()
+		}))
+	}
+	if forwarder.UsesDeadLetters() {
+		metrics.Register("dead_letters", expvar.Func(func() interface{} {
+			return forwarder.deadLetters.Statistics()
+		}))
+	}
+	if len(forwarder.DebugTeeFile) > 0 {
+		metrics.Register("debug_tee", expvar.Func(func() interface{} {
+			return forwarder.debugTee.Statistics()
+		}))
+	}
+	if forwarder.MaxConnectionsPerHost > 0 {
+		metrics.Register("host_connections", expvar.Func(func() interface{} {
+			return SharedHostConnectionLimiter().Statistics()
+		}))
+	}
 
 	forwarder.StartTime = time.Now()
 }
 
 func (forwarder *EventForwarder) outputMetrics() {
 	metrics.Register("output_status", expvar.Func(func() interface{} {
-		ret := make(map[string]interface{})
-		ret[forwarder.Output.Key()] = forwarder.Output.Statistics()
-
-		switch forwarder.OutputFormat {
-		case LEEFOutputFormat:
-			ret["format"] = "leef"
-		case JSONOutputFormat:
-			ret["format"] = "json"
-		}
+		return forwarder.outputStatus()
+	}))
+}
 
-		switch forwarder.OutputType {
-		case FileOutputType:
-			ret["type"] = "file"
-		case UDPOutputType:
-			ret["type"] = "net"
-		case TCPOutputType:
-			ret["type"] = "net"
-		case OLDS3OutputType:
-			fallthrough
-		case S3OutputType:
-			ret["type"] = "s3"
-		case HTTPOutputType:
-			ret["type"] = "http"
-		case SplunkOutputType:
-			ret["type"] = "splunk"
-		}
+// outputStatus returns the statistics of every output, keyed by output.
+func (forwarder *EventForwarder) outputStatus() map[string]interface{} {
+	ret := make(map[string]interface{})
+	delivery := make(map[string]interface{})
+	for _, route := range forwarder.outputs {
+		ret[route.Key()] = route.Statistics()
+		delivery[route.Key()] = route.statistics()
+	}
+	ret["delivery"] = delivery
 
-		return ret
-	}))
+	// format and type of the main output
+	ret["format"] = forwarder.Configuration.OutputFormatName()
+	if outputType := outputTypeName(forwarder.Configuration); outputType != "" {
+		ret["type"] = outputType
+	}
+
+	return ret
 }
 
 func (forwarder *EventForwarder) logFileProcessingLoop() <-chan error {
@@ -348,7 +723,7 @@ func (forwarder *EventForwarder) logFileProcessingLoop() <-chan error {
 			trimmedDelivery := strings.TrimSuffix(delivery, "\n")
 			auditLogEvent := NewAuditLogEvent(trimmedDelivery, label, forwarder.ServerName)
 			rawLogEvent, _ := auditLogEvent.asJson()
-			outputMessage(rawLogEvent, forwarder.outputChan, forwarder.Status)
+			outputMessage(rawLogEvent, auditLogEvent.Type, time.Now(), 0, nil, forwarder.outputChan, forwarder.Status)
 		}
 
 	}
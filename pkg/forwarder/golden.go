@@ -0,0 +1,132 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/carbonblack/cb-event-forwarder/pkg/formatters"
+	"github.com/google/go-cmp/cmp"
+)
+
+// GoldenFailure is a case whose output differs from what was recorded for it.
+type GoldenFailure struct {
+	Case    string
+	Output  string
+	Problem string
+}
+
+func (f GoldenFailure) String() string {
+	return fmt.Sprintf("%s for %s: %s", f.Case, f.Output, f.Problem)
+}
+
+// GoldenReport is the outcome of checking a golden set: how many case and output pairs were
+// compared, or written in update mode, and those that did not match.
+type GoldenReport struct {
+	Checked  int
+	Updated  int
+	Failures []GoldenFailure
+}
+
+// CheckGolden replays the sample events of a golden set through the configured pipeline and
+// compares what each output would be sent with what was recorded for it, without delivering
+// anything. Each case is a file <name>.json in dir holding a single event as received from the
+// bus, and <name>.<output>.golden holds its expected message for each output, named after its
+// section ("bridge" for the main output). An empty golden file means the event is not sent to
+// that output, because it was filtered out, held back by the schedule or formatted as an empty
+// message.
+//
+// Events go through the event type filter and rate limits, the transform, the schedule, the
+// pipeline and the formatter of each output on the same code path as live events, the schedule
+// as of when the check runs. Sequence numbers are not added, since they would differ on every
+// run. With update set the golden files are written from the current output instead of being
+// compared.
+func (forwarder *EventForwarder) CheckGolden(dir string, update bool) (GoldenReport, error) {
+	var report GoldenReport
+
+	cases, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return report, err
+	}
+	if len(cases) == 0 {
+		return report, fmt.Errorf("No golden cases (*.json) found in %s", dir)
+	}
+	sort.Strings(cases)
+
+	inputWorker := forwarder.newInputWorker()
+	for _, path := range cases {
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		input, err := ioutil.ReadFile(path)
+		if err != nil {
+			return report, err
+		}
+		msg := bytes.TrimSpace(input)
+
+		var event *formatters.Event
+		msg, eventType, ok, conflict := inputWorker.admit(msg, eventTypeOf(msg))
+		if ok {
+			if scheduled, ok := forwarder.scheduled(newInputEvent(string(msg), eventType, time.Now(), 0, nil), time.Now()); ok {
+				event = scheduled.Event
+			}
+		}
+
+		for _, route := range forwarder.outputs {
+			output := route.outputName()
+			goldenPath := filepath.Join(dir, name+"."+output+".golden")
+
+			if conflict != nil {
+				report.Failures = append(report.Failures, GoldenFailure{Case: name, Output: output, Problem: fmt.Sprintf("could not transform the event: %s", conflict)})
+				continue
+			}
+
+			var actual string
+			if event != nil {
+				message, ok, err := route.format(event)
+				if err != nil {
+					report.Failures = append(report.Failures, GoldenFailure{Case: name, Output: output, Problem: fmt.Sprintf("could not format the event: %s", err)})
+					continue
+				}
+				if ok {
+					actual = message
+				}
+			}
+
+			if update {
+				if err := ioutil.WriteFile(goldenPath, []byte(actual), 0644); err != nil {
+					return report, err
+				}
+				report.Updated++
+				continue
+			}
+
+			expected, err := ioutil.ReadFile(goldenPath)
+			if os.IsNotExist(err) {
+				report.Failures = append(report.Failures, GoldenFailure{Case: name, Output: output, Problem: "no golden file " + goldenPath})
+				continue
+			} else if err != nil {
+				return report, err
+			}
+			report.Checked++
+			if diff := goldenDiff(string(expected), actual); diff != "" {
+				report.Failures = append(report.Failures, GoldenFailure{Case: name, Output: output, Problem: "output differs (-golden +actual):\n" + diff})
+			}
+		}
+	}
+	return report, nil
+}
+
+// goldenDiff returns the differences between the expected and actual messages, or "" when they
+// match. JSON messages are compared by value, so that the order of their keys doesn't matter.
+func goldenDiff(expected, actual string) string {
+	var expectedValue, actualValue interface{}
+	if json.Unmarshal([]byte(expected), &expectedValue) == nil && json.Unmarshal([]byte(actual), &actualValue) == nil {
+		return cmp.Diff(expectedValue, actualValue)
+	}
+	return cmp.Diff(expected, actual)
+}
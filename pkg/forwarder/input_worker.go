@@ -17,13 +17,17 @@ import (
 	"io/ioutil"
 	"path"
 	"sync"
+	"time"
 )
 
-func (inputWorker InputWorker) processMessage(body []byte, routingKey, contentType string, headers amqp.Table, exchangeName string) {
+func (inputWorker InputWorker) processMessage(body []byte, routingKey, contentType string, headers amqp.Table, exchangeName string, ack *deliveryAck) {
+	received := time.Now()
 	inputWorker.InputEventCount.Mark(1)
 	inputWorker.InputByteCount.Mark(int64(len(body)))
 	var err error
 	var msgs [][]byte
+	// the types of msgs, when read from the events already decoded
+	var eventTypes []string
 
 	//
 	// Process message based on ContentType
@@ -68,10 +72,12 @@ func (inputWorker InputWorker) processMessage(body []byte, routingKey, contentTy
 
 		jsonMsgs, err := inputWorker.ProcessJSONMessage(msg, routingKey)
 		if err == nil {
-			for jsonMsg := range jsonMsgs {
+			for _, jsonMsg := range jsonMsgs {
 				jsonBytes, err := json.Marshal(jsonMsg)
 				if err == nil {
+					eventType, _ := jsonMsg["type"].(string)
 					msgs = append(msgs, jsonBytes)
+					eventTypes = append(eventTypes, eventType)
 				}
 			}
 		}
@@ -81,32 +87,95 @@ func (inputWorker InputWorker) processMessage(body []byte, routingKey, contentTy
 		return
 	}
 
-	for _, msg := range msgs {
-		outputMessage(msg, inputWorker.outputs, inputWorker.Status)
+	sensorID := sensorIDFromHeaders(headers)
+	for i, msg := range msgs {
+		var eventType string
+		if eventTypes != nil {
+			eventType = eventTypes[i]
+		} else {
+			eventType = eventTypeOf(msg)
+		}
+		admitted, eventType, ok, err := inputWorker.admit(msg, eventType)
+		if err != nil {
+			inputWorker.deadLetters.Write("", string(msg), err)
+			continue
+		}
+		if ok {
+			outputMessage(admitted, eventType, received, sensorID, ack, inputWorker.outputs, inputWorker.Status)
+		}
+	}
+
+	if inputWorker.stats != nil {
+		inputWorker.stats.record(len(msgs))
 	}
 }
 
-func outputMessage(msg []byte, results chan<- string, status *Status) {
+// admit runs an event through the stages shared by all outputs: the event type filter, the
+// event type rate limits and the transform. It returns the event along with its type, which the
+// transform may change, false for events left out by the filter or the rate limits, and the
+// ConflictError of events failed by the conflict policy.
+func (inputWorker InputWorker) admit(msg []byte, eventType string) ([]byte, string, bool, error) {
+	if inputWorker.typeFilter != nil && !inputWorker.typeFilter.Admit(msg) {
+		return nil, "", false, nil
+	}
+	if inputWorker.typeLimiter != nil && !inputWorker.typeLimiter.Admit(msg) {
+		return nil, "", false, nil
+	}
+	if inputWorker.transformer != nil {
+		transformed, transformedType, err := inputWorker.transformer.apply(msg, eventType)
+		if err != nil {
+			return nil, "", false, err
+		}
+		msg, eventType = transformed, transformedType
+	}
+	return msg, eventType, true, nil
+}
+
+// inputEvent is an event ready for the outputs, along with its type, when its message was
+// received, the sensor it comes from, 0 when not known, and the acknowledgement of the delivery it
+// came in, nil when not acked manually.
+type inputEvent struct {
+	message   string
+	eventType string
+	received  time.Time
+	sensorID  int64
+	ack       *deliveryAck
+}
+
+// newInputEvent returns an event along with its type, as the input worker read it, so that the
+// outputs can count their events by type without parsing them again.
+func newInputEvent(message, eventType string, received time.Time, sensorID int64, ack *deliveryAck) inputEvent {
+	return inputEvent{message: message, eventType: eventType, received: received, sensorID: sensorID, ack: ack}
+}
+
+func outputMessage(msg []byte, eventType string, received time.Time, sensorID int64, ack *deliveryAck, results chan<- inputEvent, status *Status) {
 	outmsg := string(msg)
 
 	if len(outmsg) > 0 {
 		status.OutputEventCount.Mark(1)
 		status.OutputByteCount.Mark(int64(len(outmsg)))
-		results <- outmsg
+		ack.hold()
+		results <- newInputEvent(outmsg, eventType, received, sensorID, ack)
 	}
 }
 
 type InputWorker struct {
-	outputs chan<- string
+	outputs chan<- inputEvent
 	protobufmessageprocessor.ProtobufMessageProcessor
 	jsonmessageprocessor.JsonMessageProcessor
 	*Status
-	DebugFlag  bool
-	DebugStore string
+	DebugFlag   bool
+	DebugStore  string
+	stats       *processorStatistics
+	transformer *eventTransformer
+	typeFilter  *EventTypeFilter
+	typeLimiter *EventTypeRateLimiter
+	deadLetters *DeadLetterFile
+	manualAck   bool
 }
 
-func NewInputWorker(outputs chan<- string, cfg *Configuration, status *Status) InputWorker {
-	return InputWorker{Status: status, outputs: outputs, ProtobufMessageProcessor: protobufmessageprocessor.NewProtobufMessageProcessor(cfg), JsonMessageProcessor: jsonmessageprocessor.NewJsonMessageProcessor(cfg), DebugStore: cfg.DebugStore, DebugFlag: cfg.DebugFlag}
+func NewInputWorker(outputs chan<- inputEvent, cfg *Configuration, status *Status) InputWorker {
+	return InputWorker{Status: status, outputs: outputs, ProtobufMessageProcessor: protobufmessageprocessor.NewProtobufMessageProcessor(cfg), JsonMessageProcessor: jsonmessageprocessor.NewJsonMessageProcessor(cfg), DebugStore: cfg.DebugStore, DebugFlag: cfg.DebugFlag, transformer: newEventTransformer(cfg.Transform, cfg.Coercions, cfg.ConflictPolicy, cfg.SharedPipelineStages()), manualAck: !cfg.AMQPAutomaticAcking}
 }
 
 func (inputWorker InputWorker) consume(wg *sync.WaitGroup, deliveries <-chan amqp.Delivery) {
@@ -115,11 +184,18 @@ func (inputWorker InputWorker) consume(wg *sync.WaitGroup, deliveries <-chan amq
 		defer wg.Done()
 
 		for delivery := range deliveries {
+			// acked once its events are done with
+			var ack *deliveryAck
+			if inputWorker.manualAck {
+				ack = newDeliveryAck(delivery)
+			}
 			inputWorker.processMessage(delivery.Body,
 				delivery.RoutingKey,
 				delivery.ContentType,
 				delivery.Headers,
-				delivery.Exchange)
+				delivery.Exchange,
+				ack)
+			ack.done()
 		}
 
 		log.Debug("AMQP INPUT Worker exiting")
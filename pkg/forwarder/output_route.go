@@ -0,0 +1,788 @@
+package forwarder
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/formatters"
+	"github.com/carbonblack/cb-event-forwarder/pkg/jsonschema"
+	. "github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+	log "github.com/sirupsen/logrus"
+)
+
+// outputRoute is one destination that every event is fanned out to. Each route has its own
+// buffer so that a slow output only holds back the others when its overflow policy is block.
+type outputRoute struct {
+	OutputWithParameters
+	config    *Configuration
+	formatter formatters.Formatter
+
+	// tells apart routes whose outputs have the same key, such as two outputs sending to the
+	// same destination in different formats
+	keySuffix string
+
+	// optional routes that failed to initialize at startup keep retrying in the background
+	required bool
+	pending  bool
+
+	// events wait in messages until handed over to the output through delivery. Only the time
+	// the oldest of them was queued is tracked, in UnixNano, or 0 when there is none.
+	messages          chan queuedMessage
+	delivery          chan string
+	oldestEnqueueTime int64
+	signals           chan os.Signal
+	// total size of the buffered events, bounded by OutputBufferMaxBytes when set. Events are
+	// counted until they are handed over to the output.
+	bufferedBytes     int64
+	bufferedBytesCond *sync.Cond
+	hasStopped        *sync.Cond
+	// with an output that confirms writes, the events are handed over through confirmed instead
+	// of delivery, along with the acknowledgement of their delivery
+	confirms  bool
+	confirmed chan ConfirmedMessage
+
+	// set when the output measures delivery latency
+	latency *DeliveryLatency
+	// with disk_queue_path, events move from messages to the disk queue, and are delivered
+	// from there
+	diskQueue *DiskQueue
+	// with pace_eps, spaces the events handed over to the output
+	pacer *Pacer
+	// receives the events failed by the error conflict policy, and with the dead-letter schema
+	// failure policy, those that don't match the output's schema
+	deadLetters *DeadLetterFile
+
+	queuedEventCount  int64
+	droppedEventCount int64
+	formatErrorCount  int64
+	emptyOutputCount  int64
+	deadLetterCount   int64
+	// events dropped for being older than event_max_age by the time the output could take them
+	expiredEventCount int64
+
+	// events dropped by the overflow policies, also counted in droppedEventCount: the incoming
+	// ones and the buffered ones evicted for them
+	droppedNewestCount int64
+	droppedOldestCount int64
+
+	// events that failed the output's schema, by the keyword of the constraint they failed
+	schemaFailureMutex sync.Mutex
+	schemaFailures     map[string]int64
+
+	// the events sent by their type
+	sentByType *EventTypeCounter
+}
+
+type OutputRouteStatistics struct {
+	Name              string `json:"name,omitempty"`
+	Type              string `json:"type"`
+	Format            string `json:"format"`
+	OverflowPolicy    string `json:"overflow_policy"`
+	QueuedEventCount  int64  `json:"queued_event_count"`
+	DroppedEventCount int64  `json:"overflow_dropped_event_count"`
+	FormatErrorCount  int64  `json:"format_error_count"`
+	Backlog           int    `json:"backlog"`
+	BufferedBytes     int64  `json:"buffered_bytes"`
+
+	// the events sent by their type field: handed over to the output, written for outputs that
+	// confirm writes, or persisted with a disk queue. Up to maxSentEventTypes types with other,
+	// the type any further one is counted as, and events without a type as unknown
+	SentByType map[string]int64 `json:"sent_by_type,omitempty"`
+
+	// of overflow_dropped_event_count, the incoming events dropped, and the buffered ones evicted
+	// with drop-oldest
+	DroppedNewestCount int64 `json:"overflow_dropped_newest_count"`
+	DroppedOldestCount int64 `json:"overflow_dropped_oldest_count"`
+
+	OldestBufferedEventAgeSeconds float64 `json:"oldest_buffered_event_age_seconds"`
+
+	// events sent as a minimal record because they could not be formatted, with format_fallback
+	FallbackFormattedCount int64 `json:"fallback_formatted_count,omitempty"`
+	// strings of events whose invalid UTF-8 was replaced or stripped, with utf8_policy
+	UTF8SanitizedFieldCount int64 `json:"utf8_sanitized_field_count,omitempty"`
+	// events left out because they were formatted as an empty message, with empty_output_policy=skip
+	EmptyOutputCount int64 `json:"empty_output_count"`
+	// with event_max_age, the events dropped for being too old by the time the output could take
+	// them, such as those buffered during an outage
+	ExpiredEventCount int64 `json:"expired_event_count,omitempty"`
+	// events sent to the dead letter file by the error conflict_policy or schema_failure_policy
+	DeadLetterCount int64 `json:"dead_letter_count,omitempty"`
+	// with schema_file, the events that failed the schema, in total and by the keyword of the
+	// constraint they failed, such as type or required; json for formatted events that are not json
+	SchemaFailureCount int64            `json:"schema_failure_count,omitempty"`
+	SchemaFailures     map[string]int64 `json:"schema_failures_by_reason,omitempty"`
+	// with max_line_bytes, events whose line was truncated to fit, and those dropped for being too
+	// long, which are also counted as format_error_count
+	MaxLineBytes         int   `json:"max_line_bytes,omitempty"`
+	TruncatedLineCount   int64 `json:"truncated_line_count,omitempty"`
+	LongLineDroppedCount int64 `json:"long_line_dropped_count,omitempty"`
+
+	DiskQueue *DiskQueueStatistics `json:"disk_queue,omitempty"`
+
+	// with pace_eps, the target and the events per second handed over to the output lately
+	PaceEPS      float64 `json:"pace_eps,omitempty"`
+	EffectiveEPS float64 `json:"effective_eps,omitempty"`
+}
+
+// most events written to or removed from a disk queue in one transaction
+const diskQueueBatchSize = 1000
+
+// most event types counted apart in the statistics of each output
+const maxSentEventTypes = 100
+
+type queuedMessage struct {
+	message   string
+	eventType string
+	enqueued  int64
+	received  time.Time
+	// held until the output confirms the event, nil unless the output confirms writes
+	ack *deliveryAck
+}
+
+// newOutputRoute returns the route of an output whose pipeline starts with the shared stages,
+// which were already applied to its events.
+func newOutputRoute(cfg *Configuration, shared []PipelineStage) (*outputRoute, error) {
+	formatter, err := formatters.ForPipeline(cfg, outputPipeline(cfg, shared))
+	if err != nil {
+		return nil, err
+	}
+	output, err := loadOutputFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	route := &outputRoute{
+		OutputWithParameters: output,
+		config:               cfg,
+		formatter:            formatter,
+		messages:             make(chan queuedMessage, cfg.OutputBufferSize),
+		delivery:             make(chan string),
+		signals:              make(chan os.Signal),
+		hasStopped:           sync.NewCond(&sync.Mutex{}),
+		bufferedBytesCond:    sync.NewCond(&sync.Mutex{}),
+		sentByType:           NewEventTypeCounter(maxSentEventTypes),
+	}
+	// events in a disk queue are done with once persisted, the queue keeps no acknowledgements
+	if _, ok := output.Output.(ConfirmingOutput); ok && len(cfg.DiskQueuePath) == 0 {
+		route.confirms = true
+		route.confirmed = make(chan ConfirmedMessage)
+	}
+	if reporter, ok := output.Output.(LatencyReporter); ok {
+		route.latency = reporter.DeliveryLatency()
+	}
+	if cfg.PaceEPS > 0 {
+		route.pacer = NewPacer(cfg.PaceEPS)
+	}
+
+	// routes with a disk queue start delivering once it is opened
+	if len(cfg.DiskQueuePath) == 0 {
+		go route.deliver()
+	}
+	return route, nil
+}
+
+// deliver hands the buffered events over to the output in order. Events leave the buffer in the
+// order they entered it, so the event being handed over is always the oldest one.
+func (route *outputRoute) deliver() {
+	for queued := range route.messages {
+		atomic.StoreInt64(&route.oldestEnqueueTime, queued.enqueued)
+		route.handOver(queued.message, queued.eventType, queued.received, time.Unix(0, queued.enqueued), queued.ack)
+		atomic.StoreInt64(&route.oldestEnqueueTime, 0)
+		route.releaseBytes(len(queued.message))
+	}
+}
+
+// handOver hands an event over to the output once it is its turn. With event_max_age, an event
+// received longer ago than that, counting from when it was queued when the receive time is
+// unknown, is dropped instead, including while it waits for an output that is disconnected.
+// Outputs that confirm writes are handed the event along with the acknowledgement it holds. The
+// event is counted by type once the output takes it, or once written for outputs that confirm
+// writes; routes with a disk queue count their events as they persist them instead.
+func (route *outputRoute) handOver(message, eventType string, received, enqueued time.Time, ack *deliveryAck) {
+	var expiry <-chan time.Time
+	ingest := received
+	if route.config.EventMaxAge > 0 {
+		if ingest.IsZero() {
+			ingest = enqueued
+		}
+		remaining := time.Until(ingest.Add(route.config.EventMaxAge))
+		if remaining <= 0 {
+			route.expired(ingest)
+			ack.done()
+			return
+		}
+		timer := time.NewTimer(remaining)
+		defer timer.Stop()
+		expiry = timer.C
+	}
+
+	if route.latency != nil {
+		route.latency.Received(received)
+	}
+	route.pace()
+	delivery, confirmed := route.delivery, route.confirmed
+	if route.confirms {
+		delivery = nil
+	} else {
+		confirmed = nil
+	}
+	select {
+	case delivery <- message:
+		if route.diskQueue == nil {
+			route.sentByType.Add(eventType)
+		}
+	case confirmed <- ConfirmedMessage{Message: message, Confirm: route.confirmSent(eventType, ack)}:
+	case <-expiry:
+		if route.latency != nil {
+			route.latency.Withdraw()
+		}
+		route.expired(ingest)
+		ack.done()
+	}
+}
+
+// confirmSent returns the function a confirming output calls once it wrote an event of the given
+// type, or gave up on it.
+func (route *outputRoute) confirmSent(eventType string, ack *deliveryAck) func(bool) {
+	return func(written bool) {
+		if written {
+			route.sentByType.Add(eventType)
+		}
+		ack.confirm(written)
+	}
+}
+
+func (route *outputRoute) expired(ingest time.Time) {
+	atomic.AddInt64(&route.expiredEventCount, 1)
+	log.Debugf("Dropped an event for %s received %s ago, older than event_max_age", route.String(), time.Since(ingest).Round(time.Second))
+}
+
+// outputName returns the name of the output's section, "bridge" for the main output.
+func (route *outputRoute) outputName() string {
+	if len(route.config.OutputName) == 0 {
+		return "bridge"
+	}
+	return route.config.OutputName
+}
+
+// pace waits for the next slot of the output when it is paced.
+func (route *outputRoute) pace() {
+	if route.pacer != nil {
+		route.pacer.Wait()
+	}
+}
+
+// outputPipeline returns the stages of the pipeline of an output that come after the shared
+// ones, skipping those that are not configured.
+func outputPipeline(cfg *Configuration, shared []PipelineStage) []formatters.Stage {
+	transformer := newEventTransformer(cfg.Transform, cfg.Coercions, cfg.ConflictPolicy, cfg.PipelineStages()[len(shared):])
+
+	var stages []formatters.Stage
+	for _, stage := range cfg.PipelineStages()[len(shared):] {
+		switch stage {
+		case PipelineFlatten:
+			if cfg.Flatten != nil {
+				stages = append(stages, formatters.NewFlattenStage(cfg.Flatten))
+			}
+		default:
+			if formatterStage := transformer.formatterStage(stage); formatterStage != nil {
+				stages = append(stages, formatterStage)
+			}
+		}
+	}
+	return stages
+}
+
+// openDiskQueue opens the disk queue of the route, if it has one, and starts moving buffered
+// events through it. Events left in the queue by the last run are delivered first.
+func (route *outputRoute) openDiskQueue() error {
+	if len(route.config.DiskQueuePath) == 0 {
+		return nil
+	}
+	diskQueue, err := OpenDiskQueue(route.config.DiskQueuePath, route.config.DiskQueueMaxEvents, route.config.DiskQueueMaxBytes)
+	if err != nil {
+		return err
+	}
+	if depth := diskQueue.Statistics().Depth; depth > 0 {
+		log.Infof("Delivering %d events left in disk queue %s to %s first", depth, route.config.DiskQueuePath, route.String())
+	}
+	route.diskQueue = diskQueue
+	go route.persist()
+	go route.deliverFromDisk()
+	return nil
+}
+
+// persist moves the buffered events to the disk queue, writing as many of them at once as are
+// waiting, up to diskQueueBatchSize. The disk queue being full holds events in the buffer, where
+// the overflow policy applies to them.
+func (route *outputRoute) persist() {
+	for queued := range route.messages {
+		batch := []queuedMessage{queued}
+	drain:
+		for len(batch) < diskQueueBatchSize {
+			select {
+			case queued := <-route.messages:
+				batch = append(batch, queued)
+			default:
+				break drain
+			}
+		}
+
+		events := make([]DiskQueueEvent, len(batch))
+		for i, queued := range batch {
+			events[i] = diskQueueEvent(queued)
+		}
+		// the disk queue keeps no event types, so events are counted as sent once persisted
+		if err := route.diskQueue.Push(events); err != nil {
+			atomic.AddInt64(&route.droppedEventCount, int64(len(batch)))
+			log.Errorf("Dropped %d events for %s: could not add them to disk queue %s: %s",
+				len(batch), route.String(), route.config.DiskQueuePath, err)
+		} else {
+			for _, queued := range batch {
+				route.sentByType.Add(queued.eventType)
+			}
+		}
+		for _, queued := range batch {
+			route.releaseBytes(len(queued.message))
+		}
+	}
+}
+
+func diskQueueEvent(queued queuedMessage) DiskQueueEvent {
+	return DiskQueueEvent{Message: queued.message, Enqueued: time.Unix(0, queued.enqueued), Received: queued.received}
+}
+
+// deliverFromDisk hands the events in the disk queue over to the output in order, removing
+// them from the queue after each batch.
+func (route *outputRoute) deliverFromDisk() {
+	for {
+		events, err := route.diskQueue.Next(diskQueueBatchSize)
+		if err != nil {
+			log.Errorf("Could not read disk queue %s: %s", route.config.DiskQueuePath, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if events == nil {
+			return
+		}
+
+		for _, event := range events {
+			atomic.StoreInt64(&route.oldestEnqueueTime, event.Enqueued.UnixNano())
+			route.handOver(event.Message, "", event.Received, event.Enqueued, nil)
+			atomic.StoreInt64(&route.oldestEnqueueTime, 0)
+		}
+		// events that can't be removed are delivered again after a restart
+		if err := route.diskQueue.Remove(events); err != nil {
+			log.Errorf("Could not remove delivered events from disk queue %s: %s", route.config.DiskQueuePath, err)
+		}
+	}
+}
+
+// closeDiskQueue closes the disk queue of the route, if it has one, once its output has stopped.
+// Events still in the memory buffer are lost, like without a disk queue.
+func (route *outputRoute) closeDiskQueue() {
+	if route.diskQueue == nil {
+		return
+	}
+	if err := route.diskQueue.Close(); err != nil {
+		log.Errorf("Could not close disk queue %s: %s", route.config.DiskQueuePath, err)
+	}
+}
+
+// reserveBytes accounts for an event entering the buffer. When the event doesn't fit within
+// OutputBufferMaxBytes it either waits for the output to catch up or, when wait is false,
+// reports that the event doesn't fit. An event is always let into an empty buffer, however
+// large it is.
+func (route *outputRoute) reserveBytes(size int, wait bool) bool {
+	maxBytes := route.config.OutputBufferMaxBytes
+
+	route.bufferedBytesCond.L.Lock()
+	defer route.bufferedBytesCond.L.Unlock()
+	for maxBytes > 0 && route.bufferedBytes > 0 && route.bufferedBytes+int64(size) > maxBytes {
+		if !wait {
+			return false
+		}
+		route.bufferedBytesCond.Wait()
+	}
+	atomic.AddInt64(&route.bufferedBytes, int64(size))
+	return true
+}
+
+func (route *outputRoute) releaseBytes(size int) {
+	route.bufferedBytesCond.L.Lock()
+	atomic.AddInt64(&route.bufferedBytes, -int64(size))
+	route.bufferedBytesCond.L.Unlock()
+	route.bufferedBytesCond.Broadcast()
+}
+
+// oldestBufferedEventAge returns how long the oldest event waiting for the output has been
+// queued, or 0 if there is none.
+func (route *outputRoute) oldestBufferedEventAge(now time.Time) time.Duration {
+	enqueued := atomic.LoadInt64(&route.oldestEnqueueTime)
+	if enqueued == 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, enqueued))
+}
+
+// Key identifies the route in the statistics. It is the key of its output unless another
+// route's output has the same one.
+func (route *outputRoute) Key() string {
+	return route.Output.Key() + route.keySuffix
+}
+
+func (route *outputRoute) initialize() error {
+	err := route.Initialize(route.Parameters)
+	if err != nil {
+		return err
+	}
+	log.Infof("Initialized output: %s\n", route.String())
+	return nil
+}
+
+// initializeWithin retries initializing the output at startup until it succeeds or timeout
+// expires, so that it doesn't matter whether the destination is started before the forwarder.
+// The wait between attempts starts at backoff and doubles after every failure, up to
+// maxOutputStartupBackoff. A zero timeout means a single attempt.
+func (route *outputRoute) initializeWithin(timeout, backoff time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for attempt := 1; ; attempt++ {
+		err := route.initialize()
+		if err == nil {
+			if attempt > 1 {
+				log.Infof("Output %s became available at startup after %d attempts", route.String(), attempt)
+			}
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return err
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+		log.Warnf("Output %s is not available yet at startup (attempt %d), retrying in %s: %s",
+			route.String(), attempt, backoff, err)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > maxOutputStartupBackoff {
+			backoff = maxOutputStartupBackoff
+		}
+	}
+}
+
+// startWhenAvailable keeps trying to initialize an optional output that could not be initialized
+// at startup, and runs it once it can. Events for it are buffered meanwhile according to its
+// overflow policy.
+func (route *outputRoute) startWhenAvailable(stopped *sync.WaitGroup) {
+	stopped.Add(1)
+	go func() {
+		defer stopped.Done()
+
+		ticker := time.NewTicker(pendingOutputRetryInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := route.initialize(); err != nil {
+					log.Debugf("Output %s is still unavailable: %s", route.String(), err)
+					continue
+				}
+				var routeStopped sync.WaitGroup
+				if err := route.start(&routeStopped); err != nil {
+					log.Errorf("Could not start output %s: %s", route.String(), err)
+					continue
+				}
+				routeStopped.Wait()
+				return
+
+			case signal := <-route.signals:
+				switch signal {
+				case syscall.SIGTERM, syscall.SIGINT:
+					return
+				}
+			}
+		}
+	}()
+}
+
+// start runs the output and marks stopped as done once it exits.
+func (route *outputRoute) start(stopped *sync.WaitGroup) error {
+	var err error
+	if route.confirms {
+		err = route.Output.(ConfirmingOutput).GoConfirmed(route.confirmed, route.signals, route.hasStopped)
+	} else {
+		err = route.Go(route.delivery, route.signals, route.hasStopped)
+	}
+	if err != nil {
+		return err
+	}
+
+	stopped.Add(1)
+	go func() {
+		defer stopped.Done()
+		route.hasStopped.L.Lock()
+		route.hasStopped.Wait()
+		route.hasStopped.L.Unlock()
+	}()
+	return nil
+}
+
+// errEmptyOutput is returned for events formatted as an empty message: by format with
+// empty_output_policy=error, and by enqueue whatever the policy.
+var errEmptyOutput = errors.New("the formatted message is empty")
+
+// format formats an event for the output. It returns false for events formatted as an empty
+// message that are to be skipped.
+func (route *outputRoute) format(event *formatters.Event) (string, bool, error) {
+	message, err := route.formatter.Format(event)
+	if err != nil {
+		return "", false, err
+	}
+	if isEmptyOutput(route.config, message) {
+		if route.config.EmptyOutputPolicy == ErrorOnEmptyOutput {
+			return "", false, errEmptyOutput
+		}
+		return "", false, nil
+	}
+	if route.config.EventSchema != nil && route.config.SchemaStage == ValidateFormattedEvents {
+		if invalid := route.config.EventSchema.ValidateJSON([]byte(message)); invalid != nil {
+			return "", false, invalid
+		}
+	}
+	return message, true, nil
+}
+
+// enqueue formats an event and buffers it for the output. It returns the message handed over
+// to the output, even when the overflow policy then drops it, or the error that left the event
+// out. Events buffered for an output that confirms writes hold the acknowledgement of their
+// delivery until the output confirms them.
+func (route *outputRoute) enqueue(event forwardedEvent) (string, error) {
+	message, ok, err := route.format(event.Event)
+	if err != nil && isConflict(err) && route.deadLetters != nil {
+		atomic.AddInt64(&route.deadLetterCount, 1)
+		route.deadLetters.Write(route.outputName(), event.Raw(), err)
+		return "", err
+	}
+	var invalid *jsonschema.ValidationError
+	if errors.As(err, &invalid) {
+		route.schemaFailed(event.Event, invalid)
+		return "", err
+	}
+	if err != nil {
+		atomic.AddInt64(&route.formatErrorCount, 1)
+		log.Debugf("Could not format event %d for %s: %s", event.ID(), route.String(), err)
+		return "", err
+	}
+	if !ok {
+		atomic.AddInt64(&route.emptyOutputCount, 1)
+		log.Debugf("Skipped event %d for %s: the formatted message is empty", event.ID(), route.String())
+		return "", errEmptyOutput
+	}
+
+	queued := queuedMessage{message: message, eventType: event.eventType, enqueued: time.Now().UnixNano(), received: event.Received()}
+	if route.confirms && event.ack != nil {
+		event.ack.hold()
+		queued.ack = event.ack
+	}
+	switch route.config.OverflowPolicy {
+	case DropNewestOnOverflow:
+		if !route.reserveBytes(len(message), false) {
+			route.dropNewest()
+			queued.ack.done()
+			log.Debugf("Dropped event %d for %s: the output buffer is over output_buffer_max_bytes", event.ID(), route.String())
+			return message, nil
+		}
+		select {
+		case route.messages <- queued:
+		default:
+			route.releaseBytes(len(message))
+			route.dropNewest()
+			queued.ack.done()
+			log.Debugf("Dropped event %d for %s: the output buffer is full", event.ID(), route.String())
+			return message, nil
+		}
+	case DropOldestOnOverflow:
+		if !route.enqueueEvictingOldest(queued) {
+			route.dropNewest()
+			queued.ack.done()
+			log.Debugf("Dropped event %d for %s: the output buffer is full with no buffered event to evict", event.ID(), route.String())
+			return message, nil
+		}
+	default:
+		route.reserveBytes(len(message), true)
+		route.messages <- queued
+	}
+	atomic.AddInt64(&route.queuedEventCount, 1)
+	return message, nil
+}
+
+// enqueueEvictingOldest buffers an event, evicting the oldest buffered events while there is no
+// room for it. It returns false when there is still no room with nothing left to evict, which
+// happens when the event being handed over to the output alone fills output_buffer_max_bytes.
+func (route *outputRoute) enqueueEvictingOldest(queued queuedMessage) bool {
+	for !route.reserveBytes(len(queued.message), false) {
+		if !route.evictOldest() {
+			return false
+		}
+	}
+	for {
+		select {
+		case route.messages <- queued:
+			return true
+		default:
+			// the output may take the oldest event meanwhile, making room
+			route.evictOldest()
+		}
+	}
+}
+
+// evictOldest drops the event at the head of the buffer, reporting whether there was one.
+func (route *outputRoute) evictOldest() bool {
+	select {
+	case oldest := <-route.messages:
+		route.releaseBytes(len(oldest.message))
+		oldest.ack.done()
+		atomic.AddInt64(&route.droppedEventCount, 1)
+		atomic.AddInt64(&route.droppedOldestCount, 1)
+		log.Debugf("Dropped the oldest buffered event for %s to make room for a new one", route.String())
+		return true
+	default:
+		return false
+	}
+}
+
+func (route *outputRoute) dropNewest() {
+	atomic.AddInt64(&route.droppedEventCount, 1)
+	atomic.AddInt64(&route.droppedNewestCount, 1)
+}
+
+// isEmptyOutput tells if message has nothing to deliver. Text formats are empty when they only
+// hold whitespace, which would show up as blank lines to line based collectors.
+func isEmptyOutput(cfg *Configuration, message string) bool {
+	if cfg.OutputFormat == MsgPackOutputFormat {
+		return len(message) == 0
+	}
+	return len(strings.TrimSpace(message)) == 0
+}
+
+// schemaFailed drops an event that doesn't match the output's schema, or sends it to the dead
+// letter file with the dead-letter schema failure policy.
+func (route *outputRoute) schemaFailed(event *formatters.Event, invalid *jsonschema.ValidationError) {
+	route.schemaFailureMutex.Lock()
+	if route.schemaFailures == nil {
+		route.schemaFailures = make(map[string]int64)
+	}
+	route.schemaFailures[invalid.Keyword]++
+	route.schemaFailureMutex.Unlock()
+
+	if route.config.SchemaFailurePolicy == DeadLetterSchemaFailures && route.deadLetters != nil {
+		atomic.AddInt64(&route.deadLetterCount, 1)
+		route.deadLetters.Write(route.outputName(), event.Raw(), invalid)
+		return
+	}
+	log.Debugf("Dropped event %d for %s: %s", event.ID(), route.String(), invalid)
+}
+
+func (route *outputRoute) statistics() OutputRouteStatistics {
+	stats := OutputRouteStatistics{
+		Name:              route.config.OutputName,
+		Type:              outputTypeName(route.config),
+		Format:            route.config.OutputFormatName(),
+		OverflowPolicy:    string(route.config.OverflowPolicy),
+		QueuedEventCount:  atomic.LoadInt64(&route.queuedEventCount),
+		SentByType:        route.sentByType.Counts(),
+		DroppedEventCount: atomic.LoadInt64(&route.droppedEventCount),
+		FormatErrorCount:  atomic.LoadInt64(&route.formatErrorCount),
+		EmptyOutputCount:  atomic.LoadInt64(&route.emptyOutputCount),
+		DeadLetterCount:   atomic.LoadInt64(&route.deadLetterCount),
+		ExpiredEventCount: atomic.LoadInt64(&route.expiredEventCount),
+		Backlog:           len(route.messages),
+		BufferedBytes:     atomic.LoadInt64(&route.bufferedBytes),
+
+		OldestBufferedEventAgeSeconds: route.oldestBufferedEventAge(time.Now()).Seconds(),
+
+		DroppedNewestCount: atomic.LoadInt64(&route.droppedNewestCount),
+		DroppedOldestCount: atomic.LoadInt64(&route.droppedOldestCount),
+	}
+	route.schemaFailureMutex.Lock()
+	if len(route.schemaFailures) > 0 {
+		stats.SchemaFailures = make(map[string]int64, len(route.schemaFailures))
+		for reason, count := range route.schemaFailures {
+			stats.SchemaFailures[reason] = count
+			stats.SchemaFailureCount += count
+		}
+	}
+	route.schemaFailureMutex.Unlock()
+	formatter := route.formatter
+	if limiter, ok := formatter.(*formatters.LineLimiter); ok {
+		stats.MaxLineBytes = route.config.MaxLineBytes
+		stats.TruncatedLineCount = limiter.TruncatedCount()
+		stats.LongLineDroppedCount = limiter.DroppedCount()
+		formatter = limiter.Next
+	}
+	if fallback, ok := formatter.(*formatters.FallbackFormatter); ok {
+		stats.FallbackFormattedCount = fallback.FallbackCount()
+		formatter = fallback.Next
+	}
+	if sanitizer, ok := formatter.(*formatters.UTF8Sanitizer); ok {
+		stats.UTF8SanitizedFieldCount = sanitizer.SanitizedFieldCount()
+	}
+	if route.diskQueue != nil {
+		diskQueue := route.diskQueue.Statistics()
+		stats.DiskQueue = &diskQueue
+		stats.Backlog += int(diskQueue.Depth)
+	}
+	if route.pacer != nil {
+		stats.PaceEPS = route.config.PaceEPS
+		stats.EffectiveEPS = route.pacer.EffectiveEPS()
+	}
+	return stats
+}
+
+func outputTypeName(cfg *Configuration) string {
+	switch cfg.OutputType {
+	case FileOutputType:
+		return "file"
+	case BucketFileOutputType:
+		return "bucketfile"
+	case LokiOutputType:
+		return "loki"
+	case SQLOutputType:
+		return "sql"
+	case SplunkHECOutputType:
+		return "splunk_hec"
+	case NATSOutputType:
+		return "nats"
+	case OTLPOutputType:
+		return "otlp"
+	case UDPOutputType, TCPOutputType:
+		return "net"
+	case OLDS3OutputType, S3OutputType:
+		return "s3"
+	case HTTPOutputType:
+		return "http"
+	case SplunkOutputType:
+		return "splunk"
+	case SyslogOutputType:
+		return "syslog"
+	case LocalSyslogOutputType:
+		return "localsyslog"
+	case KafkaOutputType:
+		return "kafka"
+	case JournaldOutputType:
+		return "journald"
+	case WebSocketOutputType:
+		return "websocket"
+	}
+	return ""
+}
@@ -0,0 +1,64 @@
+package forwarder
+
+import (
+	"sync"
+	"time"
+)
+
+// how long events are counted for to measure the effective rate
+const pacerRateWindow = time.Second
+
+// Pacer spaces events evenly so that they are handed over at no more than a number of events per
+// second. Unlike a token bucket it never lets a burst through after an idle period: each event
+// waits for the slot after the one before it, and events that arrive faster wait in the output
+// buffer meanwhile.
+type Pacer struct {
+	interval time.Duration
+	next     time.Time
+
+	mutex sync.Mutex
+	// events handed over since windowStart, and the rate measured over the last full window
+	windowStart  time.Time
+	windowEvents int64
+	rate         float64
+}
+
+func NewPacer(eventsPerSecond float64) *Pacer {
+	return &Pacer{interval: time.Duration(float64(time.Second) / eventsPerSecond)}
+}
+
+// Wait blocks until the next event may be handed over. It is only called from one goroutine.
+func (p *Pacer) Wait() {
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	} else {
+		time.Sleep(p.next.Sub(now))
+		now = p.next
+	}
+	p.next = p.next.Add(p.interval)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if elapsed := now.Sub(p.windowStart); elapsed >= pacerRateWindow {
+		if elapsed < 2*pacerRateWindow {
+			p.rate = float64(p.windowEvents) / elapsed.Seconds()
+		} else {
+			p.rate = 0
+		}
+		p.windowStart = now
+		p.windowEvents = 0
+	}
+	p.windowEvents++
+}
+
+// EffectiveEPS returns the events per second handed over during the last measured second, or 0
+// when no event has been handed over for a while.
+func (p *Pacer) EffectiveEPS() float64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if time.Since(p.windowStart) >= 2*pacerRateWindow {
+		return 0
+	}
+	return p.rate
+}
@@ -0,0 +1,147 @@
+package forwarder
+
+import (
+	"sync"
+	"sync/atomic"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/utils"
+	"github.com/rcrowley/go-metrics"
+	"github.com/streadway/amqp"
+)
+
+// size of the queue in front of each message processor
+const PROCESSORQUEUESIZE = 100
+
+// processorPool spreads deliveries over the message processors. Deliveries from the same
+// sensor always go to the same processor so that events from a sensor keep their order,
+// while deliveries without a sensor are handed out round-robin. Without preserveOrder every
+// delivery goes to the processor with the shortest queue, so that a few busy sensors can't
+// keep the other processors idle.
+type processorPool struct {
+	shards  []chan amqp.Delivery
+	workers []*processorStatistics
+	shardPicker
+}
+
+// shardPicker picks the worker of each item handed to a pool of workers: the worker of the
+// item's sensor, or the next one round-robin for items without a sensor, or with preserveOrder
+// unset the worker with the shortest queue.
+type shardPicker struct {
+	next          int
+	preserveOrder bool
+}
+
+type processorStatistics struct {
+	messageCount int64
+	eventCount   int64
+	eventRate    metrics.Meter
+}
+
+type ProcessorStatistics struct {
+	MessageCount    int64   `json:"message_count"`
+	EventCount      int64   `json:"event_count"`
+	EventsPerSecond float64 `json:"events_per_second"`
+	Backlog         int     `json:"backlog"`
+}
+
+type ProcessorPoolStatistics struct {
+	Size          int                   `json:"size"`
+	PreserveOrder bool                  `json:"preserve_order"`
+	Workers       []ProcessorStatistics `json:"workers"`
+}
+
+func newProcessorPool(size int, preserveOrder bool) *processorPool {
+	pool := &processorPool{shardPicker: shardPicker{preserveOrder: preserveOrder}}
+	for i := 0; i < size; i++ {
+		pool.shards = append(pool.shards, make(chan amqp.Delivery, PROCESSORQUEUESIZE))
+		pool.workers = append(pool.workers, &processorStatistics{eventRate: metrics.NewMeter()})
+	}
+	return pool
+}
+
+// start runs one processor per shard, and dispatches deliveries to them until deliveries is closed.
+func (pool *processorPool) start(inputWorker InputWorker, wg *sync.WaitGroup, deliveries <-chan amqp.Delivery) {
+	for i, shard := range pool.shards {
+		worker := inputWorker
+		worker.stats = pool.workers[i]
+		worker.consume(wg, shard)
+	}
+
+	go func() {
+		for delivery := range deliveries {
+			pool.shards[pool.shardFor(delivery.Headers)] <- delivery
+		}
+		for _, shard := range pool.shards {
+			close(shard)
+		}
+	}()
+}
+
+// NewProcessorShardPicker returns the function that picks the processor, out of size, of each
+// delivery, as the processor pool does.
+func NewProcessorShardPicker(size int, preserveOrder bool) func(headers amqp.Table) int {
+	return newProcessorPool(size, preserveOrder).shardFor
+}
+
+func (pool *processorPool) shardFor(headers amqp.Table) int {
+	return pool.pick(sensorIDFromHeaders(headers), len(pool.shards), func(shard int) int { return len(pool.shards[shard]) })
+}
+
+// sensorIDFromHeaders returns the ID of the sensor a delivery comes from, 0 when it has none.
+func sensorIDFromHeaders(headers amqp.Table) int64 {
+	if sensorID, ok := headers["sensorId"]; ok {
+		if id, err := ParseIntFromHeader(sensorID); err == nil {
+			return id
+		}
+	}
+	return 0
+}
+
+// pick returns the shard, out of size, of an item from the given sensor, 0 for items without
+// one. backlog returns the length of the queue of a shard.
+func (p *shardPicker) pick(sensorID int64, size int, backlog func(shard int) int) int {
+	if !p.preserveOrder {
+		return p.leastBusyShard(size, backlog)
+	}
+
+	if sensorID != 0 {
+		// taken as unsigned, so that no ID, math.MinInt64 included, makes a negative shard
+		return int(uint64(sensorID) % uint64(size))
+	}
+
+	p.next = (p.next + 1) % size
+	return p.next
+}
+
+// leastBusyShard returns the shard with the shortest queue, starting the search after the
+// previous choice so that idle workers take turns.
+func (p *shardPicker) leastBusyShard(size int, backlog func(shard int) int) int {
+	best := -1
+	for i := 0; i < size; i++ {
+		shard := (p.next + 1 + i) % size
+		if best < 0 || backlog(shard) < backlog(best) {
+			best = shard
+		}
+	}
+	p.next = best
+	return best
+}
+
+func (pool *processorPool) statistics() ProcessorPoolStatistics {
+	ret := ProcessorPoolStatistics{Size: len(pool.shards), PreserveOrder: pool.preserveOrder}
+	for i, worker := range pool.workers {
+		ret.Workers = append(ret.Workers, ProcessorStatistics{
+			MessageCount:    atomic.LoadInt64(&worker.messageCount),
+			EventCount:      atomic.LoadInt64(&worker.eventCount),
+			EventsPerSecond: worker.eventRate.Rate1(),
+			Backlog:         len(pool.shards[i]),
+		})
+	}
+	return ret
+}
+
+func (stats *processorStatistics) record(events int) {
+	atomic.AddInt64(&stats.messageCount, 1)
+	atomic.AddInt64(&stats.eventCount, int64(events))
+	stats.eventRate.Mark(int64(events))
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package forwarder
+
+import (
+	"os"
+	"syscall"
+)
+
+// ReloadSignal makes the forwarder read the event type filters from its configuration file
+// again, without reconnecting anything.
+var ReloadSignal os.Signal = syscall.SIGUSR2
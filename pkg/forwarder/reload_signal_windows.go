@@ -0,0 +1,6 @@
+package forwarder
+
+import "os"
+
+// ReloadSignal is nil on Windows, which has no SIGUSR2.
+var ReloadSignal os.Signal
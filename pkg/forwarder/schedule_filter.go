@@ -0,0 +1,156 @@
+package forwarder
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/formatters"
+	log "github.com/sirupsen/logrus"
+)
+
+// how often buffered events are checked against the schedule
+const scheduleCheckInterval = 30 * time.Second
+
+// scheduleFilter decides, before events reach the outputs, whether each event is forwarded,
+// held until its type is allowed again, or dropped.
+type scheduleFilter struct {
+	rules      []ScheduleRule
+	location   *time.Location
+	bufferSize int
+	timeSource TimeSource
+
+	mutex    sync.Mutex
+	buffered []forwardedEvent
+
+	bufferedEventCount   int64
+	releasedEventCount   int64
+	droppedEventCount    int64
+	overflowDroppedCount int64
+	// events checked at their ingest time because they had no usable timestamp
+	timeSourceFallbackCount int64
+}
+
+type ScheduleStatistics struct {
+	BufferedEventCount      int64      `json:"buffered_event_count"`
+	ReleasedEventCount      int64      `json:"released_event_count"`
+	DroppedEventCount       int64      `json:"dropped_event_count"`
+	OverflowDroppedCount    int64      `json:"buffer_overflow_dropped_event_count"`
+	Backlog                 int        `json:"backlog"`
+	TimeSource              TimeSource `json:"time_source"`
+	TimeSourceFallbackCount int64      `json:"time_source_fallback_count"`
+}
+
+func newScheduleFilter(cfg *Configuration) *scheduleFilter {
+	if len(cfg.ScheduleRules) == 0 {
+		return nil
+	}
+	location := cfg.ScheduleLocation
+	if location == nil {
+		location = time.Local
+	}
+	timeSource := cfg.ScheduleTimeSource
+	if len(timeSource) == 0 {
+		timeSource = IngestTimeSource
+	}
+	return &scheduleFilter{rules: cfg.ScheduleRules, location: location, bufferSize: cfg.ScheduleBufferSize, timeSource: timeSource}
+}
+
+// action returns what the schedule does with the event at the given time. With the event time
+// source, the time is the event's timestamp when admitting it, unless it has none.
+func (f *scheduleFilter) action(event *formatters.Event, now time.Time, useTimeSource bool) ScheduleAction {
+	fields, err := event.Fields()
+	if err != nil {
+		return ScheduleForward
+	}
+	if useTimeSource {
+		var fellBack bool
+		if now, fellBack = f.timeSource.EventTime(fields, now); fellBack {
+			atomic.AddInt64(&f.timeSourceFallbackCount, 1)
+		}
+	}
+	eventType, _ := fields["type"].(string)
+	return ScheduleActionFor(f.rules, eventType, now.In(f.location))
+}
+
+// admit reports whether the event can be forwarded now. Events that are not are either
+// buffered or dropped. Buffered events are done with as far as their delivery is concerned:
+// holding its acknowledgement until their window opens would soon stall the consumer, with
+// every prefetched delivery waiting on the schedule. Like dropped ones, they are lost if the
+// forwarder stops before they are released.
+func (f *scheduleFilter) admit(event forwardedEvent, now time.Time) bool {
+	switch f.action(event.Event, now, true) {
+	case ScheduleDrop:
+		atomic.AddInt64(&f.droppedEventCount, 1)
+		log.Debugf("Dropped event %d: its type is dropped by the schedule", event.ID())
+		event.ack.done()
+		return false
+	case ScheduleBuffer:
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		if len(f.buffered) >= f.bufferSize {
+			atomic.AddInt64(&f.overflowDroppedCount, 1)
+			log.Debugf("Dropped event %d: the schedule buffer is full", event.ID())
+			event.ack.done()
+			return false
+		}
+		event.ack.done()
+		event.ack = nil
+		f.buffered = append(f.buffered, event)
+		atomic.AddInt64(&f.bufferedEventCount, 1)
+		return false
+	}
+	return true
+}
+
+// release returns the buffered events that can be forwarded now, in the order they arrived.
+// Buffered events whose type is now dropped are discarded. Buffered events are always checked
+// against the current time, whatever the time source: they are held until their type is allowed
+// again, not until their own time is.
+func (f *scheduleFilter) release(now time.Time) []forwardedEvent {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var released []forwardedEvent
+	kept := f.buffered[:0]
+	for _, event := range f.buffered {
+		switch f.action(event.Event, now, false) {
+		case ScheduleForward:
+			released = append(released, event)
+		case ScheduleDrop:
+			atomic.AddInt64(&f.droppedEventCount, 1)
+			log.Debugf("Dropped buffered event %d: its type is now dropped by the schedule", event.ID())
+			event.ack.done()
+		default:
+			kept = append(kept, event)
+		}
+	}
+	for i := len(kept); i < len(f.buffered); i++ {
+		f.buffered[i] = forwardedEvent{}
+	}
+	f.buffered = kept
+
+	if len(released) > 0 {
+		atomic.AddInt64(&f.releasedEventCount, int64(len(released)))
+		log.Infof("Forwarding %d events held by the schedule", len(released))
+	}
+	return released
+}
+
+func (f *scheduleFilter) statistics() ScheduleStatistics {
+	f.mutex.Lock()
+	backlog := len(f.buffered)
+	f.mutex.Unlock()
+
+	return ScheduleStatistics{
+		BufferedEventCount:   atomic.LoadInt64(&f.bufferedEventCount),
+		ReleasedEventCount:   atomic.LoadInt64(&f.releasedEventCount),
+		DroppedEventCount:    atomic.LoadInt64(&f.droppedEventCount),
+		OverflowDroppedCount: atomic.LoadInt64(&f.overflowDroppedCount),
+		Backlog:              backlog,
+
+		TimeSource:              f.timeSource,
+		TimeSourceFallbackCount: atomic.LoadInt64(&f.timeSourceFallbackCount),
+	}
+}
@@ -0,0 +1,101 @@
+package forwarder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sequenceReservation is how many sequence numbers are saved ahead of the events that use them,
+// so that the state file is not written for every event. A crash skips at most this many
+// numbers; a clean shutdown saves the exact next number and skips none.
+const sequenceReservation = 10000
+
+// SequenceCounter numbers forwarded events, so that collectors can detect lost or reordered
+// events. The next number is kept in a state file, so numbers keep increasing across restarts
+// and are never reused.
+type SequenceCounter struct {
+	path string
+
+	mutex    sync.Mutex
+	next     uint64
+	reserved uint64
+}
+
+type SequenceStatistics struct {
+	StateFile string `json:"state_file"`
+	Next      uint64 `json:"next"`
+	Reserved  uint64 `json:"reserved"`
+}
+
+// NewSequenceCounter resumes counting from the number saved in the state file at path. When
+// the file doesn't exist counting starts from 0, which collectors will see as a restart of
+// the sequence.
+func NewSequenceCounter(path string) (*SequenceCounter, error) {
+	counter := &SequenceCounter{path: path}
+
+	contents, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		log.Warnf("Sequence state file %s does not exist, numbering events from 0", path)
+	case err != nil:
+		return nil, fmt.Errorf("Could not read sequence state file %s: %s", path, err)
+	default:
+		next, err := strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid sequence state file %s: %s", path, err)
+		}
+		counter.next = next
+		log.Infof("Numbering events from %d, as saved in %s", next, path)
+	}
+
+	counter.reserved = counter.next
+	return counter, nil
+}
+
+// Next returns the number of the next forwarded event, saving a new reservation first when the
+// previous one is used up.
+func (c *SequenceCounter) Next() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.next >= c.reserved {
+		// numbers are handed out even when the reservation can't be saved, a restart may then
+		// reuse them
+		c.reserved = c.next + sequenceReservation
+		if err := c.save(c.reserved); err != nil {
+			log.Errorf("Could not save sequence state file %s: %s", c.path, err)
+		}
+	}
+	sequence := c.next
+	c.next++
+	return sequence
+}
+
+// Close saves the next number, so that the next run continues without skipping numbers.
+func (c *SequenceCounter) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.save(c.next); err != nil {
+		return err
+	}
+	c.reserved = c.next
+	return nil
+}
+
+func (c *SequenceCounter) Statistics() SequenceStatistics {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return SequenceStatistics{StateFile: c.path, Next: c.next, Reserved: c.reserved}
+}
+
+func (c *SequenceCounter) save(next uint64) error {
+	return writeFileAtomically(c.path, []byte(strconv.FormatUint(next, 10)+"\n"))
+}
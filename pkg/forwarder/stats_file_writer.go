@@ -0,0 +1,88 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StatsFileWriter periodically replaces a file with a json document of the current statistics.
+// Readers never see a partially written file since every write goes to a temporary file in the
+// same directory that is then renamed over the previous one.
+type StatsFileWriter struct {
+	path string
+}
+
+type statsDocument struct {
+	Timestamp    string      `json:"timestamp"`
+	OutputStatus interface{} `json:"output_status"`
+}
+
+func NewStatsFileWriter(path string) *StatsFileWriter {
+	return &StatsFileWriter{path: path}
+}
+
+// Run writes the statistics returned by collect every interval. It never returns.
+func (w *StatsFileWriter) Run(interval time.Duration, collect func() interface{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := w.Write(collect()); err != nil {
+			log.Errorf("Error writing statistics to %s: %s", w.path, err)
+		}
+	}
+}
+
+func (w *StatsFileWriter) Write(stats interface{}) error {
+	b, err := json.MarshalIndent(statsDocument{
+		Timestamp:    time.Now().UTC().Format(time.RFC3339),
+		OutputStatus: stats,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(w.path, append(b, '\n'))
+}
+
+// writeFileAtomically replaces the file at path with data, writing it to a temporary file in
+// the same directory first so that readers never see a partially written file.
+func writeFileAtomically(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// TempFile creates files only readable by the owner
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (forwarder *EventForwarder) startStatsFileWriter() {
+	if forwarder.StatsFile == nil {
+		return
+	}
+
+	writer := NewStatsFileWriter(*forwarder.StatsFile)
+	log.Infof("Writing statistics to %s every %s", *forwarder.StatsFile, forwarder.StatsFileInterval)
+	go writer.Run(forwarder.StatsFileInterval, func() interface{} {
+		return forwarder.outputStatus()
+	})
+}
@@ -0,0 +1,163 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+	log "github.com/sirupsen/logrus"
+)
+
+// maximum payload of a single statsd datagram, small enough to avoid fragmentation
+const statsdMaxPacketSize = 1432
+
+// statsdOutputMetrics maps the json fields reported by an output's Statistics() to the statsd
+// metric names pushed for that output. Counters are sent as the delta since the last flush.
+var statsdOutputMetrics = []struct {
+	field   string
+	name    string
+	counter bool
+}{
+	{"connected", "connected", false},
+	{"dropped_event_count", "dropped", true},
+	{"sent_event_count", "sent", true},
+	{"bytes_sent", "bytes", true},
+	{"reconnect_count", "reconnects", true},
+}
+
+type StatsdEmitter struct {
+	conn     net.Conn
+	prefix   string
+	tags     string
+	previous map[string]int64
+}
+
+func NewStatsdEmitter(address, prefix string, tags []string) (*StatsdEmitter, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to statsd at '%s': %s", address, err)
+	}
+
+	emitter := &StatsdEmitter{conn: conn, prefix: prefix, previous: make(map[string]int64)}
+	if len(tags) > 0 {
+		emitter.tags = "|#" + strings.Join(tags, ",")
+	}
+	return emitter, nil
+}
+
+// Run flushes the statistics of the given outputs every interval. It never returns.
+func (e *StatsdEmitter) Run(interval time.Duration, outputs []OutputKeys) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := e.Flush(outputs); err != nil {
+			log.Debugf("Error sending metrics to statsd: %s", err)
+		}
+	}
+}
+
+func (e *StatsdEmitter) Flush(outputs []OutputKeys) error {
+	var packet bytes.Buffer
+
+	for _, output := range outputs {
+		stats, err := statisticsAsMap(output.Statistics())
+		if err != nil {
+			log.Debugf("Could not collect statistics for %s: %s", output.Key(), err)
+			continue
+		}
+
+		prefix := fmt.Sprintf("%s.output.%s.", e.prefix, statsdSanitize(output.Key()))
+
+		for _, metric := range statsdOutputMetrics {
+			raw, ok := stats[metric.field]
+			if !ok {
+				continue
+			}
+
+			var line string
+			name := prefix + metric.name
+
+			switch value := raw.(type) {
+			case bool:
+				gauge := 0
+				if value {
+					gauge = 1
+				}
+				line = fmt.Sprintf("%s:%d|g%s", name, gauge, e.tags)
+			case float64:
+				if metric.counter {
+					current := int64(value)
+					line = fmt.Sprintf("%s:%d|c%s", name, current-e.previous[name], e.tags)
+					e.previous[name] = current
+				} else {
+					line = fmt.Sprintf("%s:%g|g%s", name, value, e.tags)
+				}
+			default:
+				continue
+			}
+
+			if packet.Len() > 0 && packet.Len()+len(line)+1 > statsdMaxPacketSize {
+				if _, err := e.conn.Write(packet.Bytes()); err != nil {
+					return err
+				}
+				packet.Reset()
+			}
+			if packet.Len() > 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(line)
+		}
+	}
+
+	if packet.Len() > 0 {
+		_, err := e.conn.Write(packet.Bytes())
+		return err
+	}
+	return nil
+}
+
+func (e *StatsdEmitter) Close() error {
+	return e.conn.Close()
+}
+
+// statisticsAsMap converts the struct returned by Statistics() into its json representation
+// so that the same counters exposed in /debug/vars can be looked up by field name.
+func statisticsAsMap(stats interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(stats)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]interface{})
+	err = json.Unmarshal(b, &ret)
+	return ret, err
+}
+
+func statsdSanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', '.', '/', ' ':
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+func (forwarder *EventForwarder) startStatsdEmitter() {
+	if forwarder.StatsdEndpoint == nil {
+		return
+	}
+
+	emitter, err := NewStatsdEmitter(*forwarder.StatsdEndpoint, forwarder.StatsdPrefix, forwarder.StatsdTags)
+	if err != nil {
+		log.Errorf("Not sending metrics to statsd: %s", err)
+		return
+	}
+
+	log.Infof("Sending metrics to statsd at %s every %s", *forwarder.StatsdEndpoint, forwarder.StatsdFlushInterval)
+	go emitter.Run(forwarder.StatsdFlushInterval, forwarder.outputKeys())
+}
@@ -0,0 +1,107 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/carbonblack/cb-event-forwarder/pkg/formatters"
+	. "github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+	log "github.com/sirupsen/logrus"
+)
+
+// verificationEvent returns a process start event shaped like the ones sent by the EDR server,
+// so that every output filters, formats and frames it as it would in production. Its command
+// line tells where it comes from.
+func (forwarder *EventForwarder) verificationEvent(now time.Time) []byte {
+	hostname, _ := os.Hostname()
+	event := map[string]interface{}{
+		"type":                  "ingress.event.procstart",
+		"event_type":            "proc",
+		"timestamp":             float64(now.UnixNano()) / float64(time.Second),
+		"cb_server":             forwarder.ServerName,
+		"computer_name":         hostname,
+		"sensor_id":             0,
+		"pid":                   os.Getpid(),
+		"process_guid":          fmt.Sprintf("00000000-0000-%04x-%08x-000000000000", os.Getpid()&0xffff, now.Unix()),
+		"path":                  "/usr/share/cb/integrations/event-forwarder/cb-event-forwarder",
+		"process_path":          "/usr/share/cb/integrations/event-forwarder/cb-event-forwarder",
+		"command_line":          strings.Join(os.Args, " "),
+		"md5":                   "00000000000000000000000000000000",
+		"sha256":                "",
+		"username":              "root",
+		"uid":                   "0",
+		"parent_path":           "/usr/lib/systemd/systemd",
+		"parent_pid":            1,
+		"expect_followon_w_md5": false,
+	}
+	msg, _ := json.Marshal(event)
+	return msg
+}
+
+// Verify initializes every output and sends it a single test event, waiting up to timeout for
+// each of them to confirm it was written. The event goes through the event type filter and rate
+// limits, the transform, the schedule and each output's formatter, like any other event. It
+// returns an error listing the outputs that failed.
+func (forwarder *EventForwarder) Verify(timeout time.Duration) error {
+	msg := forwarder.verificationEvent(time.Now())
+	msg, eventType, ok, err := forwarder.newInputWorker().admit(msg, eventTypeOf(msg))
+	if err != nil {
+		return fmt.Errorf("Could not transform the test event: %s", err)
+	}
+	if !ok {
+		return errors.New("The test event is filtered out by the event type filter or rate limits")
+	}
+	event, ok := forwarder.scheduled(newInputEvent(string(msg), eventType, time.Now(), 0, nil), time.Now())
+	if !ok {
+		return errors.New("The test event is held back or dropped by the schedule")
+	}
+
+	var failed []string
+	for _, route := range forwarder.outputs {
+		if err := route.verify(event.Event, timeout); err != nil {
+			log.Errorf("Output %s failed verification: %s", route.String(), err)
+			failed = append(failed, route.String())
+			continue
+		}
+		log.Infof("Output %s accepted the test event", route.String())
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Verification failed for %d of %d outputs: %s",
+			len(failed), len(forwarder.outputs), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (route *outputRoute) verify(event *formatters.Event, timeout time.Duration) error {
+	verifier, ok := route.Output.(Verifier)
+	if !ok {
+		return fmt.Errorf("%s outputs can't be verified", outputTypeName(route.config))
+	}
+
+	if err := route.initialize(); err != nil {
+		return err
+	}
+	message, ok, err := route.format(event)
+	if err != nil {
+		return fmt.Errorf("Could not format the test event: %s", err)
+	}
+	if !ok {
+		return fmt.Errorf("The test event is formatted as an empty message")
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- verifier.Verify(message)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("No confirmation after %s", timeout)
+	}
+}
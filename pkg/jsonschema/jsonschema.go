@@ -0,0 +1,673 @@
+// Package jsonschema validates events against a JSON Schema. It implements the validation
+// keywords that describe the shape of an event: type, enum, const, the bounds of numbers,
+// strings, arrays and objects, pattern, properties, patternProperties, additionalProperties,
+// required, items, allOf, anyOf, oneOf, not and $ref to a location inside the same schema.
+// Annotations such as title and format are accepted and ignored; any other keyword is an error,
+// rather than a constraint silently left unchecked.
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// keywords that carry no constraint, accepted and ignored
+var annotations = map[string]bool{
+	"$schema":     true,
+	"$id":         true,
+	"$comment":    true,
+	"title":       true,
+	"description": true,
+	"default":     true,
+	"examples":    true,
+	"format":      true,
+	"readOnly":    true,
+	"writeOnly":   true,
+	"deprecated":  true,
+	"definitions": true,
+	"$defs":       true,
+}
+
+var typeNames = map[string]bool{
+	"null":    true,
+	"boolean": true,
+	"object":  true,
+	"array":   true,
+	"number":  true,
+	"integer": true,
+	"string":  true,
+}
+
+// Schema is a compiled JSON Schema.
+type Schema struct {
+	root *node
+}
+
+// ValidationError is the first constraint of the schema that a value fails.
+type ValidationError struct {
+	// JSON pointer to the failing part of the value, empty for the value itself
+	Path string
+	// the keyword of the failed constraint, such as type or required
+	Keyword string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	path := e.Path
+	if len(path) == 0 {
+		path = "/"
+	}
+	return fmt.Sprintf("schema validation failed at %s: %s", path, e.Message)
+}
+
+type patternNode struct {
+	pattern *regexp.Regexp
+	schema  *node
+}
+
+// node is a compiled schema or subschema. Unset bounds are nil.
+type node struct {
+	// for the boolean schemas true and false
+	reject bool
+
+	types    []string
+	enum     []interface{}
+	constant *interface{}
+
+	minimum, maximum                   *float64
+	exclusiveMinimum, exclusiveMaximum *float64
+
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+
+	items              *node
+	minItems, maxItems *int
+
+	properties           map[string]*node
+	patternProperties    []patternNode
+	additionalProperties *node
+	required             []string
+	minProperties        *int
+	maxProperties        *int
+
+	allOf, anyOf, oneOf []*node
+	not                 *node
+	ref                 *node
+}
+
+// Compile parses and compiles a JSON Schema.
+func Compile(document []byte) (*Schema, error) {
+	var root interface{}
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	if err := decoder.Decode(&root); err != nil {
+		return nil, fmt.Errorf("invalid json: %s", err)
+	}
+
+	c := &compiler{document: root, refs: make(map[string]*node)}
+	compiled := &node{}
+	if err := c.compile(compiled, root, "#"); err != nil {
+		return nil, err
+	}
+	return &Schema{root: compiled}, nil
+}
+
+// CompileFile compiles the JSON Schema in the file at path.
+func CompileFile(path string) (*Schema, error) {
+	document, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := Compile(document)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return schema, nil
+}
+
+type compiler struct {
+	document interface{}
+	// the subschemas referenced with $ref, by JSON pointer, compiled once each so that recursive
+	// references resolve to the same node
+	refs map[string]*node
+}
+
+func (c *compiler) compile(n *node, schema interface{}, location string) error {
+	if accept, ok := schema.(bool); ok {
+		n.reject = !accept
+		return nil
+	}
+	object, ok := schema.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: a schema must be an object or a boolean", location)
+	}
+
+	keywords := make([]string, 0, len(object))
+	for keyword := range object {
+		keywords = append(keywords, keyword)
+	}
+	// compile in a stable order, for the errors to be the same every time
+	sort.Strings(keywords)
+
+	for _, keyword := range keywords {
+		value := object[keyword]
+		at := location + "/" + escapePointer(keyword)
+		var err error
+		switch keyword {
+		case "type":
+			n.types, err = compileTypes(value)
+		case "enum":
+			values, isArray := value.([]interface{})
+			if !isArray {
+				err = fmt.Errorf("expected an array")
+			}
+			n.enum = values
+		case "const":
+			constant := value
+			n.constant = &constant
+		case "minimum":
+			n.minimum, err = compileNumber(value)
+		case "maximum":
+			n.maximum, err = compileNumber(value)
+		case "exclusiveMinimum":
+			n.exclusiveMinimum, err = compileNumber(value)
+		case "exclusiveMaximum":
+			n.exclusiveMaximum, err = compileNumber(value)
+		case "minLength":
+			n.minLength, err = compileCount(value)
+		case "maxLength":
+			n.maxLength, err = compileCount(value)
+		case "pattern":
+			n.pattern, err = compilePattern(value)
+		case "items":
+			if _, isArray := value.([]interface{}); isArray {
+				err = fmt.Errorf("arrays of item schemas are not supported")
+				break
+			}
+			n.items, err = c.subschema(value, at)
+		case "minItems":
+			n.minItems, err = compileCount(value)
+		case "maxItems":
+			n.maxItems, err = compileCount(value)
+		case "properties":
+			n.properties = make(map[string]*node)
+			err = c.compileObject(value, at, func(name string, schema *node) error {
+				n.properties[name] = schema
+				return nil
+			})
+		case "patternProperties":
+			err = c.compileObject(value, at, func(name string, schema *node) error {
+				pattern, err := compilePattern(name)
+				n.patternProperties = append(n.patternProperties, patternNode{pattern: pattern, schema: schema})
+				return err
+			})
+		case "additionalProperties":
+			n.additionalProperties, err = c.subschema(value, at)
+		case "required":
+			n.required, err = compileStrings(value)
+		case "minProperties":
+			n.minProperties, err = compileCount(value)
+		case "maxProperties":
+			n.maxProperties, err = compileCount(value)
+		case "allOf":
+			n.allOf, err = c.compileList(value, at)
+		case "anyOf":
+			n.anyOf, err = c.compileList(value, at)
+		case "oneOf":
+			n.oneOf, err = c.compileList(value, at)
+		case "not":
+			n.not, err = c.subschema(value, at)
+		case "$ref":
+			n.ref, err = c.compileRef(value)
+		default:
+			if !annotations[keyword] {
+				err = fmt.Errorf("unsupported keyword")
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", at, err)
+		}
+	}
+	return nil
+}
+
+func (c *compiler) subschema(schema interface{}, location string) (*node, error) {
+	n := &node{}
+	if err := c.compile(n, schema, location); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (c *compiler) compileList(value interface{}, location string) ([]*node, error) {
+	schemas, ok := value.([]interface{})
+	if !ok || len(schemas) == 0 {
+		return nil, fmt.Errorf("expected a non-empty array of schemas")
+	}
+	nodes := make([]*node, len(schemas))
+	for i, schema := range schemas {
+		var err error
+		if nodes[i], err = c.subschema(schema, location+"/"+strconv.Itoa(i)); err != nil {
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
+
+func (c *compiler) compileObject(value interface{}, location string, add func(name string, schema *node) error) error {
+	schemas, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("expected an object of schemas")
+	}
+	names := make([]string, 0, len(schemas))
+	for name := range schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		schema, err := c.subschema(schemas[name], location+"/"+escapePointer(name))
+		if err != nil {
+			return err
+		}
+		if err := add(name, schema); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compileRef resolves a reference to a location of the schema, such as #/definitions/process.
+func (c *compiler) compileRef(value interface{}) (*node, error) {
+	ref, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected a string")
+	}
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("only references inside the schema, starting with #, are supported")
+	}
+	pointer, err := url.PathUnescape(ref[1:])
+	if err != nil {
+		return nil, err
+	}
+	if n, ok := c.refs[pointer]; ok {
+		return n, nil
+	}
+
+	target := c.document
+	if len(pointer) > 0 {
+		if !strings.HasPrefix(pointer, "/") {
+			return nil, fmt.Errorf("invalid reference %s", ref)
+		}
+		for _, token := range strings.Split(pointer[1:], "/") {
+			token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+			switch parent := target.(type) {
+			case map[string]interface{}:
+				target, ok = parent[token]
+			case []interface{}:
+				var i int
+				i, err = strconv.Atoi(token)
+				ok = err == nil && i >= 0 && i < len(parent)
+				if ok {
+					target = parent[i]
+				}
+			default:
+				ok = false
+			}
+			if !ok {
+				return nil, fmt.Errorf("reference %s not found", ref)
+			}
+		}
+	}
+
+	n := &node{}
+	c.refs[pointer] = n
+	if err := c.compile(n, target, "#"+pointer); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func compileTypes(value interface{}) ([]string, error) {
+	var types []string
+	switch value := value.(type) {
+	case string:
+		types = []string{value}
+	case []interface{}:
+		var err error
+		if types, err = compileStrings(value); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("expected a type name or an array of them")
+	}
+	for _, name := range types {
+		if !typeNames[name] {
+			return nil, fmt.Errorf("unknown type %s", name)
+		}
+	}
+	return types, nil
+}
+
+func compileStrings(value interface{}) ([]string, error) {
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected an array of strings")
+	}
+	strs := make([]string, len(values))
+	for i, value := range values {
+		if strs[i], ok = value.(string); !ok {
+			return nil, fmt.Errorf("expected an array of strings")
+		}
+	}
+	return strs, nil
+}
+
+func compileNumber(value interface{}) (*float64, error) {
+	number, ok := toNumber(value)
+	if !ok {
+		return nil, fmt.Errorf("expected a number")
+	}
+	return &number, nil
+}
+
+func compileCount(value interface{}) (*int, error) {
+	number, ok := toNumber(value)
+	if !ok || number < 0 || number != math.Trunc(number) {
+		return nil, fmt.Errorf("expected a non-negative integer")
+	}
+	count := int(number)
+	return &count, nil
+}
+
+func compilePattern(value interface{}) (*regexp.Regexp, error) {
+	pattern, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected a regular expression")
+	}
+	return regexp.Compile(pattern)
+}
+
+func escapePointer(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
+
+// Validate returns the first constraint of the schema that value, as decoded by encoding/json,
+// fails, or nil if it matches the schema. Numbers may be decoded as float64 or json.Number.
+func (s *Schema) Validate(value interface{}) *ValidationError {
+	return s.root.validate(value, "")
+}
+
+// ValidateJSON validates a json document.
+func (s *Schema) ValidateJSON(document []byte) *ValidationError {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return &ValidationError{Keyword: "json", Message: fmt.Sprintf("invalid json: %s", err)}
+	}
+	return s.Validate(value)
+}
+
+func (n *node) validate(value interface{}, path string) *ValidationError {
+	fail := func(keyword, format string, args ...interface{}) *ValidationError {
+		return &ValidationError{Path: path, Keyword: keyword, Message: fmt.Sprintf(format, args...)}
+	}
+
+	if n.reject {
+		return fail("false", "no value is allowed")
+	}
+	if n.ref != nil {
+		if err := n.ref.validate(value, path); err != nil {
+			return err
+		}
+	}
+	if len(n.types) > 0 && !hasType(value, n.types) {
+		return fail("type", "expected %s, got %s", strings.Join(n.types, " or "), typeOf(value))
+	}
+	if n.enum != nil {
+		found := false
+		for _, allowed := range n.enum {
+			if equal(value, allowed) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fail("enum", "value %s is not one of the allowed values", encode(value))
+		}
+	}
+	if n.constant != nil && !equal(value, *n.constant) {
+		return fail("const", "expected %s, got %s", encode(*n.constant), encode(value))
+	}
+
+	switch value := value.(type) {
+	case string:
+		length := utf8.RuneCountInString(value)
+		if n.minLength != nil && length < *n.minLength {
+			return fail("minLength", "string is shorter than %d characters", *n.minLength)
+		}
+		if n.maxLength != nil && length > *n.maxLength {
+			return fail("maxLength", "string is longer than %d characters", *n.maxLength)
+		}
+		if n.pattern != nil && !n.pattern.MatchString(value) {
+			return fail("pattern", "string %q does not match %s", value, n.pattern)
+		}
+
+	case []interface{}:
+		if n.minItems != nil && len(value) < *n.minItems {
+			return fail("minItems", "array has fewer than %d items", *n.minItems)
+		}
+		if n.maxItems != nil && len(value) > *n.maxItems {
+			return fail("maxItems", "array has more than %d items", *n.maxItems)
+		}
+		if n.items != nil {
+			for i, item := range value {
+				if err := n.items.validate(item, path+"/"+strconv.Itoa(i)); err != nil {
+					return err
+				}
+			}
+		}
+
+	case map[string]interface{}:
+		if err := n.validateObject(value, path, fail); err != nil {
+			return err
+		}
+
+	default:
+		if number, ok := toNumber(value); ok {
+			switch {
+			case n.minimum != nil && number < *n.minimum:
+				return fail("minimum", "%s is less than %v", encode(value), *n.minimum)
+			case n.maximum != nil && number > *n.maximum:
+				return fail("maximum", "%s is greater than %v", encode(value), *n.maximum)
+			case n.exclusiveMinimum != nil && number <= *n.exclusiveMinimum:
+				return fail("exclusiveMinimum", "%s is not greater than %v", encode(value), *n.exclusiveMinimum)
+			case n.exclusiveMaximum != nil && number >= *n.exclusiveMaximum:
+				return fail("exclusiveMaximum", "%s is not less than %v", encode(value), *n.exclusiveMaximum)
+			}
+		}
+	}
+
+	for _, schema := range n.allOf {
+		if err := schema.validate(value, path); err != nil {
+			return err
+		}
+	}
+	if n.anyOf != nil {
+		matched := false
+		for _, schema := range n.anyOf {
+			if schema.validate(value, path) == nil {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fail("anyOf", "value does not match any of the schemas of anyOf")
+		}
+	}
+	if n.oneOf != nil {
+		matches := 0
+		for _, schema := range n.oneOf {
+			if schema.validate(value, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fail("oneOf", "value matches %d of the schemas of oneOf instead of exactly one", matches)
+		}
+	}
+	if n.not != nil && n.not.validate(value, path) == nil {
+		return fail("not", "value matches the schema of not")
+	}
+	return nil
+}
+
+func (n *node) validateObject(object map[string]interface{}, path string, fail func(keyword, format string, args ...interface{}) *ValidationError) *ValidationError {
+	for _, name := range n.required {
+		if _, ok := object[name]; !ok {
+			return fail("required", "missing required property %s", name)
+		}
+	}
+	if n.minProperties != nil && len(object) < *n.minProperties {
+		return fail("minProperties", "object has fewer than %d properties", *n.minProperties)
+	}
+	if n.maxProperties != nil && len(object) > *n.maxProperties {
+		return fail("maxProperties", "object has more than %d properties", *n.maxProperties)
+	}
+
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := object[name]
+		at := path + "/" + escapePointer(name)
+		matched := false
+		if schema, ok := n.properties[name]; ok {
+			matched = true
+			if err := schema.validate(value, at); err != nil {
+				return err
+			}
+		}
+		for _, property := range n.patternProperties {
+			if property.pattern.MatchString(name) {
+				matched = true
+				if err := property.schema.validate(value, at); err != nil {
+					return err
+				}
+			}
+		}
+		if !matched && n.additionalProperties != nil {
+			if n.additionalProperties.reject {
+				return &ValidationError{Path: at, Keyword: "additionalProperties", Message: fmt.Sprintf("property %s is not allowed", name)}
+			}
+			if err := n.additionalProperties.validate(value, at); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func hasType(value interface{}, types []string) bool {
+	actual := typeOf(value)
+	for _, name := range types {
+		if name == actual || name == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+// typeOf returns the JSON Schema type of a value, integer for numbers without a fraction.
+func typeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	if number, ok := toNumber(value); ok {
+		if number == math.Trunc(number) && !math.IsInf(number, 0) {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case json.Number:
+		number, err := value.Float64()
+		return number, err == nil
+	case float64:
+		return value, true
+	case int:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	}
+	return 0, false
+}
+
+// equal compares two json values, numbers by their value.
+func equal(a, b interface{}) bool {
+	if x, ok := toNumber(a); ok {
+		y, ok := toNumber(b)
+		return ok && x == y
+	}
+	switch a := a.(type) {
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			other, ok := b[key]
+			if !ok || !equal(value, other) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+func encode(value interface{}) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	if len(encoded) > 64 {
+		return string(encoded[:61]) + "..."
+	}
+	return string(encoded)
+}
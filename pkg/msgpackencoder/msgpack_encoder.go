@@ -0,0 +1,333 @@
+// Package msgpackencoder encodes events as MessagePack (https://msgpack.org), a binary
+// counterpart of json. Decoding an encoded event gives back the map that decoding the event's
+// json gives, so collectors can treat both formats the same.
+package msgpackencoder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Encode returns the MessagePack encoding of an event decoded from json. Map keys are written
+// in sorted order so that equal events have equal encodings. json.Number values are written as
+// integers when they have no fraction or exponent and fit 64 bits, and as float64 otherwise.
+func Encode(msg map[string]interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := encodeValue(&b, msg); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Frame prefixes an encoded event with its length as a 4 byte big endian integer. MessagePack
+// can contain any byte, so streams of events can't be split on newlines.
+func Frame(encoded []byte) []byte {
+	framed := make([]byte, 4+len(encoded))
+	binary.BigEndian.PutUint32(framed, uint32(len(encoded)))
+	copy(framed[4:], encoded)
+	return framed
+}
+
+func encodeValue(b *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		b.WriteByte(0xc0)
+	case bool:
+		if v {
+			b.WriteByte(0xc3)
+		} else {
+			b.WriteByte(0xc2)
+		}
+	case string:
+		encodeString(b, v)
+	case json.Number:
+		return encodeNumber(b, v)
+	case float64:
+		encodeFloat(b, v)
+	case int:
+		encodeInt(b, int64(v))
+	case int64:
+		encodeInt(b, v)
+	case uint64:
+		encodeUint(b, v)
+	case []interface{}:
+		encodeLength(b, len(v), 0x90, 15, 0xdc)
+		for _, item := range v {
+			if err := encodeValue(b, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		encodeLength(b, len(v), 0x80, 15, 0xde)
+		for _, key := range keys {
+			encodeString(b, key)
+			if err := encodeValue(b, v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Cannot encode %T as MessagePack", value)
+	}
+	return nil
+}
+
+// encodeLength writes the header of a string, array or map: fix is the type byte of the
+// compact form, for lengths up to fixMax, and wide the type byte of the 16 bit form, followed
+// by the 32 bit form.
+func encodeLength(b *bytes.Buffer, length int, fix byte, fixMax int, wide byte) {
+	switch {
+	case length <= fixMax:
+		b.WriteByte(fix | byte(length))
+	case length <= math.MaxUint16:
+		b.WriteByte(wide)
+		binary.Write(b, binary.BigEndian, uint16(length))
+	default:
+		b.WriteByte(wide + 1)
+		binary.Write(b, binary.BigEndian, uint32(length))
+	}
+}
+
+func encodeString(b *bytes.Buffer, s string) {
+	if len(s) > 31 && len(s) <= math.MaxUint8 {
+		b.WriteByte(0xd9)
+		b.WriteByte(byte(len(s)))
+	} else {
+		encodeLength(b, len(s), 0xa0, 31, 0xda)
+	}
+	b.WriteString(s)
+}
+
+func encodeNumber(b *bytes.Buffer, n json.Number) error {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		encodeInt(b, i)
+		return nil
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		encodeUint(b, u)
+		return nil
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return fmt.Errorf("Cannot encode number %s as MessagePack: %s", n, err)
+	}
+	encodeFloat(b, f)
+	return nil
+}
+
+func encodeInt(b *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0:
+		encodeUint(b, uint64(i))
+	case i >= -32:
+		b.WriteByte(byte(i))
+	case i >= math.MinInt8:
+		b.WriteByte(0xd0)
+		b.WriteByte(byte(i))
+	case i >= math.MinInt16:
+		b.WriteByte(0xd1)
+		binary.Write(b, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		b.WriteByte(0xd2)
+		binary.Write(b, binary.BigEndian, int32(i))
+	default:
+		b.WriteByte(0xd3)
+		binary.Write(b, binary.BigEndian, i)
+	}
+}
+
+func encodeUint(b *bytes.Buffer, u uint64) {
+	switch {
+	case u <= 127:
+		b.WriteByte(byte(u))
+	case u <= math.MaxUint8:
+		b.WriteByte(0xcc)
+		b.WriteByte(byte(u))
+	case u <= math.MaxUint16:
+		b.WriteByte(0xcd)
+		binary.Write(b, binary.BigEndian, uint16(u))
+	case u <= math.MaxUint32:
+		b.WriteByte(0xce)
+		binary.Write(b, binary.BigEndian, uint32(u))
+	default:
+		b.WriteByte(0xcf)
+		binary.Write(b, binary.BigEndian, u)
+	}
+}
+
+func encodeFloat(b *bytes.Buffer, f float64) {
+	b.WriteByte(0xcb)
+	binary.Write(b, binary.BigEndian, math.Float64bits(f))
+}
+
+// Decode reads an event written by Encode, with numbers as json.Number as when decoding json
+// with UseNumber. It is meant for tests and tools; only the types that Encode writes are
+// supported.
+func Decode(encoded []byte) (map[string]interface{}, error) {
+	d := decoder{data: encoded}
+	value, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, errors.New("Trailing bytes after MessagePack event")
+	}
+	msg, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("MessagePack event is a %T, not a map", value)
+	}
+	return msg, nil
+}
+
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+var errTruncated = errors.New("Truncated MessagePack event")
+
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errTruncated
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+func (d *decoder) value() (interface{}, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	t := b[0]
+
+	switch {
+	case t <= 0x7f:
+		return json.Number(strconv.FormatUint(uint64(t), 10)), nil
+	case t >= 0xe0:
+		return json.Number(strconv.FormatInt(int64(int8(t)), 10)), nil
+	case t&0xf0 == 0x80:
+		return d.mapOf(int(t & 0x0f))
+	case t&0xf0 == 0x90:
+		return d.arrayOf(int(t & 0x0f))
+	case t&0xe0 == 0xa0:
+		return d.stringOf(int(t & 0x1f))
+	}
+
+	switch t {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcb:
+		bits, err := d.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return json.Number(strconv.FormatFloat(math.Float64frombits(bits), 'g', -1, 64)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.uint(1 << (t - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		return json.Number(strconv.FormatUint(u, 10)), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (t - 0xd0)
+		u, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		// sign extend from the encoded size
+		shift := uint(64 - 8*size)
+		return json.Number(strconv.FormatInt(int64(u<<shift)>>shift, 10)), nil
+	case 0xd9, 0xda, 0xdb:
+		length, err := d.uint(1 << (t - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.stringOf(int(length))
+	case 0xdc, 0xdd:
+		length, err := d.uint(2 << (t - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.arrayOf(int(length))
+	case 0xde, 0xdf:
+		length, err := d.uint(2 << (t - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapOf(int(length))
+	}
+	return nil, fmt.Errorf("Unsupported MessagePack type 0x%02x", t)
+}
+
+func (d *decoder) stringOf(length int) (interface{}, error) {
+	b, err := d.next(length)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *decoder) arrayOf(length int) (interface{}, error) {
+	if length > len(d.data)-d.pos {
+		return nil, errTruncated
+	}
+	array := make([]interface{}, length)
+	for i := range array {
+		item, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		array[i] = item
+	}
+	return array, nil
+}
+
+func (d *decoder) mapOf(length int) (interface{}, error) {
+	if length > len(d.data)-d.pos {
+		return nil, errTruncated
+	}
+	msg := make(map[string]interface{}, length)
+	for i := 0; i < length; i++ {
+		key, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("MessagePack map key is a %T, not a string", key)
+		}
+		if msg[name], err = d.value(); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
@@ -0,0 +1,68 @@
+package outputs
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// the wait before retrying a batch doubles after every attempt, up to batchMaxBackoff
+const (
+	batchInitialBackoff = 500 * time.Millisecond
+	batchMaxBackoff     = 30 * time.Second
+)
+
+// batchRetry retries the requests of the outputs that send events in batches, on throttling and
+// server errors, backing off between attempts or waiting as long as the destination asks.
+type batchRetry struct {
+	maxRetries int
+	// when set, retryAfterMax bounds how long a Retry-After header can delay a retry
+	retryAfterMax time.Duration
+	// counts the retries, for the statistics of the output
+	retryCount *int64
+}
+
+// do calls send until it succeeds, fails for good or has been retried maxRetries times, returning
+// its last error. send returns whether its request may be retried, and how long the destination
+// asked to wait before doing so, or -1 to back off as usual. description names the request in
+// the logs.
+func (r batchRetry) do(description string, send func() (bool, time.Duration, error)) error {
+	backoff := batchInitialBackoff
+	for attempt := 0; ; attempt++ {
+		retry, retryAfter, err := send()
+		if err == nil || !retry || attempt >= r.maxRetries {
+			return err
+		}
+
+		wait := backoff
+		if retryAfter >= 0 {
+			wait = retryAfter
+			if r.retryAfterMax > 0 && wait > r.retryAfterMax {
+				log.Warnf("Asked to wait %s before retrying %s, waiting only %s", wait, description, r.retryAfterMax)
+				wait = r.retryAfterMax
+			}
+		}
+		if backoff *= 2; backoff > batchMaxBackoff {
+			backoff = batchMaxBackoff
+		}
+		atomic.AddInt64(r.retryCount, 1)
+		log.Debugf("Retrying %s in %s: %s", description, wait, err)
+		time.Sleep(wait)
+	}
+}
+
+// retryAfterWait returns how long the Retry-After header of response asks to wait, or -1 when
+// there is none.
+func retryAfterWait(response *http.Response) time.Duration {
+	now := time.Now()
+	until, ok := parseRetryAfter(response.Header.Get("Retry-After"), now)
+	if !ok {
+		return -1
+	}
+	if wait := until.Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
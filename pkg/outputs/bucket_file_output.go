@@ -0,0 +1,354 @@
+package outputs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// the layout of bucket file names under the output directory, one file per hour
+const bucketFileLayout = "2006/01/02/15"
+
+// how long the bucket of late events is kept open after its last event
+const lateBucketIdleTimeout = time.Minute
+
+// how many buckets are reported in the event counts of the statistics
+const bucketCountsKept = 48
+
+// BucketFileOutput writes events to one file per hour under a directory, as YYYY/MM/DD/HH.json.
+// Events are filed by their timestamp or by when they were received; events that arrive after
+// their hour is over are appended to the file of their hour, which is reopened for them.
+type BucketFileOutput struct {
+	Config    *Configuration
+	directory string
+	extension string
+
+	sync.Mutex
+	buckets        map[string]*timeBucketFile
+	currentBucket  string
+	eventCounts    map[string]uint64
+	lateEventCount uint64
+	// events filed by ingest time because they had no usable timestamp
+	timeSourceFallbackCount uint64
+}
+
+type timeBucketFile struct {
+	name       string
+	file       *os.File
+	compressor FlushableWriteCloser
+	writer     *bufio.Writer
+	lastWrite  time.Time
+}
+
+type BucketFileStatistics struct {
+	Directory               string            `json:"directory"`
+	TimeSource              TimeSource        `json:"time_source"`
+	OpenBuckets             []string          `json:"open_buckets"`
+	EventsByBucket          map[string]uint64 `json:"events_by_bucket"`
+	LateEventCount          uint64            `json:"late_event_count"`
+	TimeSourceFallbackCount uint64            `json:"time_source_fallback_count"`
+}
+
+func NewBucketFileOutputFromConfig(cfg *Configuration) *BucketFileOutput {
+	return &BucketFileOutput{Config: cfg}
+}
+
+func (o *BucketFileOutput) Initialize(directory string) error {
+	o.Lock()
+	defer o.Unlock()
+
+	o.closeBuckets(func(*timeBucketFile) bool { return true })
+
+	o.directory = directory
+	o.buckets = make(map[string]*timeBucketFile)
+	o.eventCounts = make(map[string]uint64)
+	o.currentBucket = bucketName(time.Now())
+
+	// the bucket name is followed by the extension of the format, then of the compression
+	o.extension = o.Config.FileExtensionForCompressionType()
+	if o.Config.FileHandlerCompressData {
+		plain := *o.Config
+		plain.CompressionType = NOCOMPRESSION
+		o.extension = plain.FileExtensionForCompressionType() + o.extension
+	}
+
+	return os.MkdirAll(directory, 0755)
+}
+
+func (o *BucketFileOutput) Key() string {
+	o.Lock()
+	defer o.Unlock()
+
+	return fmt.Sprintf("bucketfile:%s", o.directory)
+}
+
+func (o *BucketFileOutput) String() string {
+	o.Lock()
+	defer o.Unlock()
+
+	return fmt.Sprintf("Bucket files in %s", o.directory)
+}
+
+func (o *BucketFileOutput) Statistics() interface{} {
+	o.Lock()
+	defer o.Unlock()
+
+	stats := BucketFileStatistics{
+		Directory:               o.directory,
+		TimeSource:              o.Config.TimeSource,
+		OpenBuckets:             make([]string, 0, len(o.buckets)),
+		EventsByBucket:          make(map[string]uint64, len(o.eventCounts)),
+		LateEventCount:          o.lateEventCount,
+		TimeSourceFallbackCount: o.timeSourceFallbackCount,
+	}
+	for name := range o.buckets {
+		stats.OpenBuckets = append(stats.OpenBuckets, name)
+	}
+	sort.Strings(stats.OpenBuckets)
+	for name, count := range o.eventCounts {
+		stats.EventsByBucket[name] = count
+	}
+	return stats
+}
+
+func (o *BucketFileOutput) Go(messages <-chan string, signalChan <-chan os.Signal, exitCond *sync.Cond) error {
+	if o.buckets == nil {
+		return errors.New("No output directory specified")
+	}
+
+	go func() {
+		refreshTicker := time.NewTicker(1 * time.Second)
+
+		defer exitCond.Signal()
+		defer o.closeAll()
+		defer refreshTicker.Stop()
+
+		for {
+			select {
+			case message := <-messages:
+				if err := o.output(message, time.Now()); err != nil && !o.Config.DryRun {
+					log.Errorf("Fatal error %s", err)
+					return
+				}
+
+			case <-refreshTicker.C:
+				if err := o.roll(time.Now()); err != nil {
+					log.Errorf("Error rolling bucket files in %s: %s", o.directory, err)
+				}
+
+			case signal := <-signalChan:
+				switch signal {
+				case syscall.SIGHUP:
+					// the files of the current buckets are reopened by their next event
+					log.Info("Received SIGHUP, closing bucket files now.")
+					o.closeAll()
+
+				case FlushSignal:
+					if err := o.flush(); err != nil {
+						log.Errorf("Error flushing %s: %s", o, err)
+					}
+
+				case syscall.SIGTERM, syscall.SIGINT:
+					// handle exit gracefully
+					log.Info("Received SIGTERM. Exiting")
+					return
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Verify writes a single event and closes its bucket file.
+func (o *BucketFileOutput) Verify(message string) error {
+	if err := o.output(message, time.Now()); err != nil {
+		return err
+	}
+	return o.closeAll()
+}
+
+func (o *BucketFileOutput) output(message string, received time.Time) error {
+	o.Lock()
+	defer o.Unlock()
+
+	eventTime, fellBack := o.Config.TimeSource.MessageTime(message, received)
+	if fellBack {
+		o.timeSourceFallbackCount++
+	}
+	name := bucketName(eventTime)
+
+	if name < bucketName(received) {
+		o.lateEventCount++
+	}
+
+	bucket, err := o.openBucket(name)
+	if err != nil {
+		return err
+	}
+	if _, err := bucket.writer.WriteString(message); err != nil {
+		return err
+	}
+	// msgpack events are already framed by their length
+	if o.Config.OutputFormat != MsgPackOutputFormat {
+		if err := bucket.writer.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	bucket.lastWrite = received
+
+	o.countEvent(name)
+	return nil
+}
+
+// roll closes the buckets of past hours once the hour changes, and the buckets reopened for late
+// events once they stop receiving them. The buckets that stay open are flushed.
+func (o *BucketFileOutput) roll(now time.Time) error {
+	o.Lock()
+	defer o.Unlock()
+
+	current := bucketName(now)
+	rolled := current != o.currentBucket
+	o.currentBucket = current
+
+	err := o.closeBuckets(func(bucket *timeBucketFile) bool {
+		if bucket.name == current {
+			return false
+		}
+		return rolled || now.Sub(bucket.lastWrite) >= lateBucketIdleTimeout
+	})
+
+	for _, bucket := range o.buckets {
+		if flushErr := bucket.flush(); err == nil {
+			err = flushErr
+		}
+	}
+	return err
+}
+
+// flush writes out the buffered events of every open bucket and syncs their files to disk.
+func (o *BucketFileOutput) flush() error {
+	o.Lock()
+	defer o.Unlock()
+
+	for _, bucket := range o.buckets {
+		if err := bucket.flush(); err != nil {
+			return err
+		}
+		if err := bucket.file.Sync(); err != nil {
+			return err
+		}
+	}
+	log.Infof("Flushed %d bucket files of %s", len(o.buckets), o)
+	return nil
+}
+
+func (o *BucketFileOutput) closeAll() error {
+	o.Lock()
+	defer o.Unlock()
+
+	return o.closeBuckets(func(*timeBucketFile) bool { return true })
+}
+
+func (o *BucketFileOutput) closeBuckets(shouldClose func(*timeBucketFile) bool) (err error) {
+	for name, bucket := range o.buckets {
+		if !shouldClose(bucket) {
+			continue
+		}
+		delete(o.buckets, name)
+		log.Debugf("Closing bucket file %s", bucket.file.Name())
+		if closeErr := bucket.close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (o *BucketFileOutput) openBucket(name string) (*timeBucketFile, error) {
+	if bucket, ok := o.buckets[name]; ok {
+		return bucket, nil
+	}
+
+	fileName := filepath.Join(o.directory, filepath.FromSlash(name)+o.extension)
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return nil, err
+	}
+	// appending to a bucket written before, either before a restart or for late events; gzip and
+	// lz4 readers read the concatenated streams as one
+	fp, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket := &timeBucketFile{name: name, file: fp}
+	var w io.Writer = fp
+	if o.Config.FileHandlerCompressData {
+		if bucket.compressor, err = o.Config.WrapWriterWithCompressionSettings(fp); err != nil {
+			fp.Close()
+			return nil, err
+		}
+		w = bucket.compressor
+	}
+	bucket.writer = bufio.NewWriter(w)
+
+	log.Debugf("Opened bucket file %s", fileName)
+	o.buckets[name] = bucket
+	return bucket, nil
+}
+
+func (o *BucketFileOutput) countEvent(name string) {
+	o.eventCounts[name]++
+	if len(o.eventCounts) <= bucketCountsKept {
+		return
+	}
+
+	// bucket names sort by time, forget the oldest
+	names := make([]string, 0, len(o.eventCounts))
+	for n := range o.eventCounts {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names[:len(names)-bucketCountsKept] {
+		delete(o.eventCounts, n)
+	}
+}
+
+func (b *timeBucketFile) flush() error {
+	if err := b.writer.Flush(); err != nil {
+		return err
+	}
+	if b.compressor != nil {
+		return b.compressor.Flush()
+	}
+	return nil
+}
+
+func (b *timeBucketFile) close() error {
+	err := b.writer.Flush()
+	if b.compressor != nil {
+		if closeErr := b.compressor.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if syncErr := b.file.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := b.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func bucketName(t time.Time) string {
+	return t.UTC().Format(bucketFileLayout)
+}
@@ -3,6 +3,7 @@ package outputs
 import (
 	"errors"
 	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -19,6 +20,11 @@ type UploadStatus struct {
 	status   int
 }
 
+// Err returns the error that made the upload fail, or nil if it succeeded.
+func (s UploadStatus) Err() error {
+	return s.result
+}
+
 type BundledOutput struct {
 	Behavior BundleBehavior
 
@@ -40,7 +46,7 @@ type BundledOutput struct {
 
 	Config *Configuration
 
-	// TODO: make this thread-safe from the status page
+	// guards the upload results above, read by Statistics while uploads complete
 	sync.RWMutex
 }
 
@@ -67,6 +73,23 @@ type BundleBehavior interface {
 	String() string
 }
 
+// VerifyUploader is implemented by behaviors that upload the bundle of Verify differently from
+// the bundles of regular events.
+type VerifyUploader interface {
+	VerifyUpload(fileName string, fp *os.File) error
+}
+
+// UploadPauser is implemented by behaviors whose destination can ask not to receive anything for
+// a while. Meanwhile no bundle is uploaded and the output takes no events.
+type UploadPauser interface {
+	PausedUntil() time.Time
+}
+
+func (o *BundledOutput) uploadsPaused() bool {
+	pauser, ok := o.Behavior.(UploadPauser)
+	return ok && time.Now().Before(pauser.PausedUntil())
+}
+
 func (o *BundledOutput) uploadOne(fileName string) {
 	fp, err := os.OpenFile(fileName, os.O_RDONLY, 0644)
 	if err != nil {
@@ -184,6 +207,43 @@ func (o *BundledOutput) output(message string) error {
 	return o.tempFileOutput.output(message)
 }
 
+// Verify uploads a bundle holding a single event, written like the temporary files are. The
+// bundle is kept out of the temporary file directory, so that it is not uploaded again later
+// and no bundle left there is uploaded along with it.
+func (o *BundledOutput) Verify(message string) error {
+	fp, err := ioutil.TempFile("", "event-forwarder-verify")
+	if err != nil {
+		return err
+	}
+	fileName := fp.Name()
+	defer os.Remove(fileName)
+
+	writer := FlushableWriteCloser(NOPFlushWrappedWriter{WriteCloser: fp})
+	if o.Config.FileHandlerCompressData {
+		if writer, err = o.Config.WrapWriterWithCompressionSettings(fp); err != nil {
+			fp.Close()
+			return err
+		}
+	}
+	_, err = writer.Write([]byte(message + "\n"))
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	fp.Close()
+	if err != nil {
+		return err
+	}
+
+	if fp, err = os.Open(fileName); err != nil {
+		return err
+	}
+	defer fp.Close()
+	if uploader, ok := o.Behavior.(VerifyUploader); ok {
+		return uploader.VerifyUpload(fileName, fp)
+	}
+	return o.Behavior.Upload(fileName, fp).Err()
+}
+
 func (o *BundledOutput) rollOver() error {
 	if o.currentFileSize == 0 && !o.Config.UploadEmptyFiles {
 		// don't upload zero length files if UploadEmptyFiles is false
@@ -196,12 +256,32 @@ func (o *BundledOutput) rollOver() error {
 		return err
 	}
 
-	go o.uploadOne(fn)
+	if o.uploadsPaused() {
+		o.filesToUpload = append(o.filesToUpload, fn)
+	} else {
+		go o.uploadOne(fn)
+	}
 	o.currentFileSize = 0
 
 	return nil
 }
 
+// flush uploads the bundle being written right away, unless it is empty.
+func (o *BundledOutput) flush() error {
+	if o.currentFileSize == 0 {
+		log.Debugf("Nothing buffered for %s to flush", o.Behavior.String())
+		return nil
+	}
+
+	flushed := o.currentFileSize
+	if err := o.rollOver(); err != nil {
+		return err
+	}
+	log.Infof("Flushed a bundle of %d bytes to %s, %d earlier bundles are waiting to be uploaded again",
+		flushed, o.Behavior.String(), len(o.filesToUpload))
+	return nil
+}
+
 func (o *BundledOutput) Key() string {
 	return o.Behavior.Key()
 }
@@ -211,6 +291,9 @@ func (o *BundledOutput) String() string {
 }
 
 func (o *BundledOutput) Statistics() interface{} {
+	o.RLock()
+	defer o.RUnlock()
+
 	return BundleStatistics{
 		FilesUploaded:        o.successfulUploads,
 		LastErrorTime:        o.lastUploadErrorTime,
@@ -234,9 +317,17 @@ func (o *BundledOutput) Go(messages <-chan string, signals <-chan os.Signal, exi
 		defer o.tempFileOutput.closeFile()
 		defer o.tempFileOutput.flushOutput(true)
 
+		wasPaused := false
 		for {
+			// while paused, events wait in the output buffer
+			paused := o.uploadsPaused()
+			input := messages
+			if paused {
+				input = nil
+			}
+
 			select {
-			case message := <-messages:
+			case message := <-input:
 				if err := o.output(message); err != nil && !o.Config.DryRun {
 					log.Errorf("Error during output %s", err)
 					return
@@ -250,7 +341,12 @@ func (o *BundledOutput) Go(messages <-chan string, signals <-chan os.Signal, exi
 					}
 				}
 
-				if len(o.filesToUpload) > 0 {
+				if wasPaused && !paused {
+					log.Infof("Resuming uploads to %s", o.Behavior.String())
+				}
+				wasPaused = paused
+
+				if len(o.filesToUpload) > 0 && !paused {
 					var fn string
 					fn, o.filesToUpload = o.filesToUpload[0], o.filesToUpload[1:]
 					go o.uploadOne(fn)
@@ -258,9 +354,11 @@ func (o *BundledOutput) Go(messages <-chan string, signals <-chan os.Signal, exi
 
 			case fileResult := <-o.fileResultChan:
 				if fileResult.result != nil {
+					o.Lock()
 					o.uploadErrors++
 					o.lastUploadError = fileResult.result.Error()
 					o.lastUploadErrorTime = time.Now()
+					o.Unlock()
 					// Handle 400s - lets stop processing the file and move it to debug zone
 					if fileResult.status != 400 {
 						// our default behavior is to try and upload the file next time around...
@@ -275,8 +373,10 @@ func (o *BundledOutput) Go(messages <-chan string, signals <-chan os.Signal, exi
 
 					log.Infof("Error uploading file %s: %s", fileResult.fileName, fileResult.result)
 				} else {
+					o.Lock()
 					o.successfulUploads++
 					o.lastSuccessfulUpload = time.Now()
+					o.Unlock()
 					log.Infof("Successfully uploaded file %s to %s.", fileResult.fileName, o.Behavior.String())
 				}
 			case signal := <-signals:
@@ -288,6 +388,10 @@ func (o *BundledOutput) Go(messages <-chan string, signals <-chan os.Signal, exi
 						log.Errorf("Error Flushing output %s", err)
 						return
 					}
+				case FlushSignal:
+					if err := o.flush(); err != nil {
+						log.Errorf("Error Flushing output %s", err)
+					}
 				case syscall.SIGTERM, syscall.SIGINT:
 					// handle exit gracefully
 					log.Info("Received SIGTERM. Exiting")
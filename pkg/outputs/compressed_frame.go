@@ -0,0 +1,174 @@
+package outputs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Events framed with frame_compression start with a 9 byte header:
+//
+//	byte 0     codec of the payload: 0 for none, 1 for gzip, 2 for zstd
+//	bytes 1-4  length of the event once decompressed, big endian
+//	bytes 5-8  length of the payload that follows, big endian
+//
+// followed by the payload, the event compressed with the codec, or as is for none.
+const compressedFrameHeaderSize = 9
+
+// the codec byte of the header
+const (
+	frameCodecNone byte = 0
+	frameCodecGzip byte = 1
+	frameCodecZstd byte = 2
+)
+
+// largest event a frame is decoded into, to keep a corrupt header from exhausting memory
+const maxDecodedFrameSize = 64 * 1024 * 1024
+
+// CompressedFramer frames events with a header giving their codec and length, compressing those
+// larger than its threshold with the given level. Events are sent uncompressed when compressing
+// them doesn't make them smaller.
+type CompressedFramer struct {
+	compression FrameCompression
+	threshold   int
+	zstd        *zstd.Encoder
+	gzipWriters sync.Pool
+
+	compressedCount int64
+	savedBytes      int64
+}
+
+func NewCompressedFramer(compression FrameCompression, threshold int, level CompressionLevel) (*CompressedFramer, error) {
+	framer := &CompressedFramer{compression: compression, threshold: threshold}
+	switch compression {
+	case GzipFrameCompression:
+		framer.gzipWriters.New = func() interface{} {
+			writer, _ := gzip.NewWriterLevel(nil, level.Gzip())
+			return writer
+		}
+	case ZstdFrameCompression:
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(level.Zstd()))
+		if err != nil {
+			return nil, err
+		}
+		framer.zstd = encoder
+	default:
+		return nil, fmt.Errorf("frame compression %s not supported", compression)
+	}
+	return framer, nil
+}
+
+// Frame returns the event framed, compressed when it is larger than the threshold.
+func (f *CompressedFramer) Frame(event []byte) ([]byte, error) {
+	codec, payload := frameCodecNone, event
+	if len(event) > f.threshold {
+		compressed, err := f.compress(event)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(event) {
+			payload = compressed
+			codec = frameCodecGzip
+			if f.compression == ZstdFrameCompression {
+				codec = frameCodecZstd
+			}
+			atomic.AddInt64(&f.compressedCount, 1)
+			atomic.AddInt64(&f.savedBytes, int64(len(event)-len(compressed)))
+		}
+	}
+
+	framed := make([]byte, compressedFrameHeaderSize+len(payload))
+	framed[0] = codec
+	binary.BigEndian.PutUint32(framed[1:], uint32(len(event)))
+	binary.BigEndian.PutUint32(framed[5:], uint32(len(payload)))
+	copy(framed[compressedFrameHeaderSize:], payload)
+	return framed, nil
+}
+
+// CompressedCount returns how many events were sent compressed.
+func (f *CompressedFramer) CompressedCount() int64 {
+	return atomic.LoadInt64(&f.compressedCount)
+}
+
+// SavedBytes returns how many bytes compression saved, headers aside.
+func (f *CompressedFramer) SavedBytes() int64 {
+	return atomic.LoadInt64(&f.savedBytes)
+}
+
+func (f *CompressedFramer) compress(event []byte) ([]byte, error) {
+	if f.zstd != nil {
+		return f.zstd.EncodeAll(event, nil), nil
+	}
+
+	var compressed bytes.Buffer
+	writer := f.gzipWriters.Get().(*gzip.Writer)
+	defer f.gzipWriters.Put(writer)
+	writer.Reset(&compressed)
+	if _, err := writer.Write(event); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// ReadCompressedFrame reads a single event framed by a CompressedFramer from r, decompressing it.
+// It returns io.EOF when r ends before the frame starts.
+func ReadCompressedFrame(r io.Reader) ([]byte, error) {
+	var header [compressedFrameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("Truncated frame header")
+		}
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	payloadSize := binary.BigEndian.Uint32(header[5:])
+	if size > maxDecodedFrameSize || payloadSize > maxDecodedFrameSize {
+		return nil, fmt.Errorf("Frame of %d bytes (%d compressed) is too large", size, payloadSize)
+	}
+
+	payload := make([]byte, payloadSize)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("Truncated frame payload: %s", err)
+	}
+
+	var event []byte
+	switch header[0] {
+	case frameCodecNone:
+		event = payload
+	case frameCodecGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		if event, err = ioutil.ReadAll(io.LimitReader(reader, int64(size)+1)); err != nil {
+			return nil, err
+		}
+	case frameCodecZstd:
+		decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxDecodedFrameSize))
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		if event, err = decoder.DecodeAll(payload, make([]byte, 0, size)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unknown frame codec %d", header[0])
+	}
+
+	if uint32(len(event)) != size {
+		return nil, fmt.Errorf("Frame decoded into %d bytes, its header says %d", len(event), size)
+	}
+	return event, nil
+}
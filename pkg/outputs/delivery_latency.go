@@ -0,0 +1,118 @@
+package outputs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// LatencyReporter is implemented by outputs that measure how long events take from being
+// received by the forwarder to being delivered.
+type LatencyReporter interface {
+	DeliveryLatency() *DeliveryLatency
+}
+
+// DeliveryLatency keeps a distribution of delivery latencies. Outputs only see the formatted
+// events, so the forwarder passes the receive time of each event through Received, in the same
+// order as the events, right before handing it over to the output.
+type DeliveryLatency struct {
+	mutex   sync.Mutex
+	pending []time.Time
+	// receive time of the event being delivered, zero once it is recorded
+	current time.Time
+
+	histogram metrics.Histogram
+}
+
+type DeliveryLatencyStatistics struct {
+	Count  int64   `json:"count"`
+	MeanMs float64 `json:"mean_ms"`
+	P50Ms  float64 `json:"p50_ms"`
+	P95Ms  float64 `json:"p95_ms"`
+	P99Ms  float64 `json:"p99_ms"`
+	MaxMs  float64 `json:"max_ms"`
+}
+
+func NewDeliveryLatency() *DeliveryLatency {
+	return &DeliveryLatency{histogram: metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015))}
+}
+
+// Received queues the receive time of the next event handed over to the output.
+func (l *DeliveryLatency) Received(received time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.pending = append(l.pending, received)
+}
+
+// Withdraw takes back the last receive time given with Received, for an event that ended up not
+// being handed over to the output.
+func (l *DeliveryLatency) Withdraw() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.pending) > 0 {
+		l.pending = l.pending[:len(l.pending)-1]
+	}
+}
+
+// next is called by the output when it takes an event, to pick up its receive time.
+func (l *DeliveryLatency) next() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.current = time.Time{}
+	if len(l.pending) > 0 {
+		l.current = l.pending[0]
+		l.pending = l.pending[1:]
+	}
+}
+
+// delivered records the latency of the current event once it has been written successfully.
+func (l *DeliveryLatency) delivered() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.current.IsZero() {
+		return
+	}
+	l.histogram.Update(int64(time.Since(l.current)))
+	l.current = time.Time{}
+}
+
+// hold takes the receive time of the current event, for outputs that deliver it later along
+// with other events.
+func (l *DeliveryLatency) hold() time.Time {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	received := l.current
+	l.current = time.Time{}
+	return received
+}
+
+// deliveredHeld records the latencies of held events once they have been written successfully.
+func (l *DeliveryLatency) deliveredHeld(received []time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, t := range received {
+		if !t.IsZero() {
+			l.histogram.Update(int64(time.Since(t)))
+		}
+	}
+}
+
+func (l *DeliveryLatency) Statistics() DeliveryLatencyStatistics {
+	snapshot := l.histogram.Snapshot()
+	percentiles := snapshot.Percentiles([]float64{0.5, 0.95, 0.99})
+	return DeliveryLatencyStatistics{
+		Count:  snapshot.Count(),
+		MeanMs: snapshot.Mean() / float64(time.Millisecond),
+		P50Ms:  percentiles[0] / float64(time.Millisecond),
+		P95Ms:  percentiles[1] / float64(time.Millisecond),
+		P99Ms:  percentiles[2] / float64(time.Millisecond),
+		MaxMs:  float64(snapshot.Max()) / float64(time.Millisecond),
+	}
+}
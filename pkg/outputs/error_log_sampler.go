@@ -0,0 +1,68 @@
+package outputs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrorLogSampler limits how often an output logs errors while its destination is down. The
+// first burst errors are logged, then at most one per interval along with the number of errors
+// suppressed since the last one. Once no error has been seen for a whole interval the next
+// error starts a new burst. A nil sampler, or one with a zero interval, logs every error.
+type ErrorLogSampler struct {
+	burst    int
+	interval time.Duration
+
+	sync.Mutex
+	logged     int
+	suppressed int64
+	lastLogged time.Time
+	lastError  time.Time
+}
+
+func NewErrorLogSampler(burst int, interval time.Duration) *ErrorLogSampler {
+	return &ErrorLogSampler{burst: burst, interval: interval}
+}
+
+// Allow records an error at now and reports whether it should be logged, along with the number
+// of errors suppressed since the previous one that was.
+func (s *ErrorLogSampler) Allow(now time.Time) (bool, int64) {
+	if s == nil || s.interval <= 0 {
+		return true, 0
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if now.Sub(s.lastError) >= s.interval {
+		s.logged = 0
+	}
+	s.lastError = now
+
+	if s.logged >= s.burst && now.Sub(s.lastLogged) < s.interval {
+		s.suppressed++
+		return false, 0
+	}
+
+	suppressed := s.suppressed
+	s.logged++
+	s.suppressed = 0
+	s.lastLogged = now
+	return true, suppressed
+}
+
+func (s *ErrorLogSampler) Errorf(format string, args ...interface{}) {
+	ok, suppressed := s.Allow(time.Now())
+	if !ok {
+		return
+	}
+
+	if suppressed > 0 {
+		log.Errorf("%s (%d similar errors suppressed)", fmt.Sprintf(format, args...), suppressed)
+	} else {
+		log.Errorf(format, args...)
+	}
+}
@@ -138,6 +138,11 @@ func (o *FileOutput) Go(messages <-chan string, signalChan <-chan os.Signal, exi
 						return
 					}
 
+				case FlushSignal:
+					if err := o.flush(); err != nil {
+						log.Errorf("Error flushing %s: %s", o, err)
+					}
+
 				case syscall.SIGTERM, syscall.SIGINT:
 					// handle exit gracefully
 					log.Info("Received SIGTERM. Exiting")
@@ -191,15 +196,54 @@ func (o *FileOutput) flushOutput(force bool) error {
 	return nil
 }
 
+// flush writes out the buffered events and syncs the file to disk, as is done on exit.
+func (o *FileOutput) flush() error {
+	buffered := o.bufferOutput.buffer.Len()
+	if buffered == 0 {
+		log.Debugf("Nothing buffered for %s to flush", o)
+		return nil
+	}
+
+	if err := o.flushOutput(true); err != nil {
+		return err
+	}
+	if fp, ok := o.outputFile.(*os.File); ok {
+		if err := fp.Sync(); err != nil {
+			return err
+		}
+	}
+	log.Infof("Flushed %d buffered bytes to %s", buffered, o)
+	return nil
+}
+
 func (o *FileOutput) output(s string) error {
 	/*
 	 * Write to our buffer first
 	 */
-	o.bufferOutput.buffer.WriteString(s + "\n")
+	o.bufferOutput.buffer.WriteString(s)
+	// msgpack events are already framed by their length
+	if o.Config.OutputFormat != MsgPackOutputFormat {
+		o.bufferOutput.buffer.WriteString("\n")
+	}
 	err := o.flushOutput(false)
 	return err
 }
 
+// Verify writes a single event and closes the file.
+func (o *FileOutput) Verify(message string) error {
+	o.Lock()
+	defer o.Unlock()
+
+	if err := o.output(message); err != nil {
+		return err
+	}
+	if err := o.flushOutput(true); err != nil {
+		return err
+	}
+	o.closeFile()
+	return nil
+}
+
 func (o *FileOutput) rollOverFile(tf string) (string, error) {
 	o.closeFile()
 
@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package outputs
+
+import (
+	"os"
+	"syscall"
+)
+
+// FlushSignal makes the outputs write out the events they hold in buffers and batches right
+// away, without stopping.
+var FlushSignal os.Signal = syscall.SIGUSR1
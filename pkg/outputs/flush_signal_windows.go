@@ -0,0 +1,6 @@
+package outputs
+
+import "os"
+
+// FlushSignal is nil on Windows, which has no SIGUSR1.
+var FlushSignal os.Signal
@@ -0,0 +1,168 @@
+package outputs
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// HostConnectionLimiter caps how many connections are open at once to each host, counting
+// those of every output that dials through it. Hosts are the addresses names resolve to, so
+// that outputs naming the same collector differently still share its cap. Connections over the
+// cap are refused rather than queued, leaving it to the outputs to retry them as they retry any
+// failed connection, which spreads out mass reconnections.
+type HostConnectionLimiter struct {
+	mutex     sync.Mutex
+	limit     int
+	open      map[string]int
+	throttled map[string]int64
+}
+
+type HostConnectionStatistics struct {
+	Limit int `json:"max_connections_per_host"`
+	// connections open to each host, and how many were refused for going over the cap
+	Open           map[string]int   `json:"open"`
+	Throttled      map[string]int64 `json:"throttled,omitempty"`
+	ThrottledCount int64            `json:"throttled_count"`
+}
+
+// the limiter shared by every output
+var hostConnections = NewHostConnectionLimiter(0)
+
+// SharedHostConnectionLimiter returns the limiter of the connections opened by the tcp, http and
+// splunk outputs. It has no cap until one is set.
+func SharedHostConnectionLimiter() *HostConnectionLimiter {
+	return hostConnections
+}
+
+// NewHostConnectionLimiter returns a limiter of limit connections per host, 0 for no limit.
+func NewHostConnectionLimiter(limit int) *HostConnectionLimiter {
+	return &HostConnectionLimiter{limit: limit, open: make(map[string]int), throttled: make(map[string]int64)}
+}
+
+// SetLimit changes the cap. Connections already open over a lower cap are left open, but no
+// new one is allowed until enough of them close.
+func (l *HostConnectionLimiter) SetLimit(limit int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.limit = limit
+}
+
+func (l *HostConnectionLimiter) acquire(host string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.limit > 0 && l.open[host] >= l.limit {
+		l.throttled[host]++
+		return fmt.Errorf("max_connections_per_host (%d) reached for %s", l.limit, host)
+	}
+	l.open[host]++
+	return nil
+}
+
+func (l *HostConnectionLimiter) release(host string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.open[host]--; l.open[host] <= 0 {
+		delete(l.open, host)
+	}
+}
+
+// Dial connects like dialer does, taking one of the connections allowed to the address it
+// resolves to, which is given back once the connection closes.
+func (l *HostConnectionLimiter) Dial(dialer net.Dialer, network, address string) (net.Conn, error) {
+	// a dialer may try more than one address, even at once; only the one that connects keeps
+	// its slot
+	var mutex sync.Mutex
+	var acquired []string
+	control := dialer.Control
+	dialer.Control = func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if err := l.acquire(host); err != nil {
+			return err
+		}
+		mutex.Lock()
+		acquired = append(acquired, host)
+		mutex.Unlock()
+		if control != nil {
+			return control(network, address, c)
+		}
+		return nil
+	}
+
+	conn, err := dialer.Dial(network, address)
+	var kept string
+	if err == nil {
+		kept, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	keptSlot := false
+	for _, host := range acquired {
+		if err == nil && host == kept && !keptSlot {
+			keptSlot = true
+			continue
+		}
+		l.release(host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !keptSlot {
+		// the connection didn't go through Control, so there is no slot to give back
+		return conn, nil
+	}
+	return &limitedConn{Conn: conn, release: func() { l.release(kept) }}, nil
+}
+
+// Dialer returns a function that dials through the limiter like dialer does, for http.Transport.
+func (l *HostConnectionLimiter) Dialer(dialer net.Dialer) func(network, address string) (net.Conn, error) {
+	return func(network, address string) (net.Conn, error) {
+		return l.Dial(dialer, network, address)
+	}
+}
+
+func (l *HostConnectionLimiter) Statistics() HostConnectionStatistics {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	stats := HostConnectionStatistics{Limit: l.limit, Open: make(map[string]int, len(l.open))}
+	for host, open := range l.open {
+		stats.Open[host] = open
+	}
+	if len(l.throttled) > 0 {
+		stats.Throttled = make(map[string]int64, len(l.throttled))
+		for host, throttled := range l.throttled {
+			stats.Throttled[host] = throttled
+			stats.ThrottledCount += throttled
+		}
+	}
+	return stats
+}
+
+// limitedConn gives its slot back to the limiter when closed, once.
+type limitedConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// CloseWrite half-closes the connection, like that of a *net.TCPConn.
+func (c *limitedConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return nil
+}
@@ -7,11 +7,15 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"text/template"
 	"time"
 
 	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
 	gzip "github.com/klauspost/pgzip"
+	log "github.com/sirupsen/logrus"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/jwt"
@@ -28,6 +32,11 @@ type HTTPBehavior struct {
 	HTTPPostTemplate        *template.Template
 	firstEventTemplate      *template.Template
 	subsequentEventTemplate *template.Template
+
+	// set from the Retry-After of 429 and 503 responses
+	pauseMutex  sync.RWMutex
+	pausedUntil time.Time
+	pauseCount  int64
 }
 
 func NewHTTPOutputFromConfig(cfg *Configuration) *BundledOutput {
@@ -35,7 +44,10 @@ func NewHTTPOutputFromConfig(cfg *Configuration) *BundledOutput {
 }
 
 type HTTPStatistics struct {
-	Destination string `json:"destination"`
+	Destination string     `json:"destination"`
+	Paused      bool       `json:"paused"`
+	PausedUntil *time.Time `json:"paused_until,omitempty"`
+	PauseCount  int64      `json:"retry_after_pause_count"`
 }
 
 /* Construct the HTTPBehavior object */
@@ -70,7 +82,7 @@ func (this *HTTPBehavior) Initialize(dest string) error {
 func (this *HTTPBehavior) CreateTransport() http.RoundTripper {
 	baseTransport := &http.Transport{
 		TLSClientConfig:     this.Config.TLSConfig,
-		Dial:                (&net.Dialer{Timeout: 5 * time.Second}).Dial,
+		Dial:                hostConnections.Dialer(net.Dialer{Timeout: 5 * time.Second}),
 		TLSHandshakeTimeout: 10 * time.Second,
 	}
 
@@ -103,9 +115,70 @@ func (this *HTTPBehavior) String() string {
 }
 
 func (this *HTTPBehavior) Statistics() interface{} {
-	return HTTPStatistics{
+	this.pauseMutex.RLock()
+	defer this.pauseMutex.RUnlock()
+
+	stats := HTTPStatistics{
 		Destination: this.dest,
+		PauseCount:  this.pauseCount,
+	}
+	if time.Now().Before(this.pausedUntil) {
+		pausedUntil := this.pausedUntil
+		stats.Paused = true
+		stats.PausedUntil = &pausedUntil
 	}
+	return stats
+}
+
+// PausedUntil returns until when the remote service asked not to send anything.
+func (this *HTTPBehavior) PausedUntil() time.Time {
+	this.pauseMutex.RLock()
+	defer this.pauseMutex.RUnlock()
+	return this.pausedUntil
+}
+
+// pauseForRetryAfter pauses uploads for as long as the Retry-After header of a 429 or 503
+// response asks, bounded by retry_after_max when set.
+func (this *HTTPBehavior) pauseForRetryAfter(resp *http.Response, now time.Time) {
+	if !this.Config.HTTPHonorRetryAfter {
+		return
+	}
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return
+	}
+	until, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	if !ok {
+		return
+	}
+	if max := this.Config.HTTPRetryAfterMax; max > 0 && until.Sub(now) > max {
+		log.Warnf("%s asked to wait until %s, waiting only retry_after_max (%s)", this.String(), until.Format(time.RFC3339), max)
+		until = now.Add(max)
+	}
+
+	this.pauseMutex.Lock()
+	defer this.pauseMutex.Unlock()
+	if until.After(this.pausedUntil) {
+		if !now.Before(this.pausedUntil) {
+			this.pauseCount++
+		}
+		this.pausedUntil = until
+		log.Warnf("%s answered %s, pausing uploads until %s", this.String(), resp.Status, until.Format(time.RFC3339))
+	}
+}
+
+// parseRetryAfter parses both forms of the Retry-After header: a number of seconds, or an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return time.Time{}, false
+	}
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return now.Add(time.Duration(seconds) * time.Second), true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return date, true
+	}
+	return time.Time{}, false
 }
 
 func (this *HTTPBehavior) Key() string {
@@ -115,64 +188,103 @@ func (this *HTTPBehavior) Key() string {
 /* This function does a POST of the given event to this.dest. UploadBehavior is called from within its own
    goroutine so we can do some expensive work here. */
 func (this *HTTPBehavior) Upload(fileName string, fp *os.File) UploadStatus {
-	var err error = nil
-	var uploadData UploadData
+	/* Initialize the POST; the body is streamed, so it is sent chunked, without a Content-Length */
+	request, err := http.NewRequest("POST", this.dest, this.requestBody(fileName, fp))
+	if err != nil {
+		fp.Close()
+		return UploadStatus{fileName: fileName, result: err, status: 500}
+	}
 
-	/* Initialize the POST */
-	reader, writer := io.Pipe()
+	// the body is consumed as it is sent, when the request has to be sent again (following a 307
+	// or 308 redirect) it is read and compressed again from the file
+	request.GetBody = func() (io.ReadCloser, error) {
+		retryFp, err := os.Open(fileName)
+		if err != nil {
+			return nil, err
+		}
+		return this.requestBody(fileName, retryFp), nil
+	}
+
+	/* Set the header values of the post */
+	for key, value := range this.headers {
+		request.Header.Set(key, value)
+	}
 
+	/* Execute the POST */
+	resp, err := this.client.Do(request)
+	if err != nil {
+		return UploadStatus{fileName: fileName, result: err}
+	}
+	defer resp.Body.Close()
+
+	/* Some sort of issue with the POST */
+	if resp.StatusCode != 200 {
+		this.pauseForRetryAfter(resp, time.Now())
+		body, _ := readResponseBody(resp)
+		errorData := resp.Status + "\n" + string(body)
+
+		return UploadStatus{fileName: fileName,
+			result: fmt.Errorf("HTTP request failed: Error code %s", errorData), status: resp.StatusCode}
+	}
+	return UploadStatus{fileName: fileName, result: nil, status: 200}
+}
+
+// requestBody returns the body of the POST of a bundle, written by the HTTP post template as it
+// is read. fp is closed once it has been read. A failure to write the body, or to compress it,
+// fails the request instead of sending a truncated body.
+func (this *HTTPBehavior) requestBody(fileName string, fp *os.File) io.ReadCloser {
+	var uploadData UploadData
 	uploadData.FileName = fileName
-	fileInfo, err := fp.Stat()
-	if err == nil {
+	if fileInfo, err := fp.Stat(); err == nil {
 		uploadData.FileSize = fileInfo.Size()
 	}
 	uploadData.Events = make(chan UploadEvent)
 
-	request, err := http.NewRequest("POST", this.dest, reader)
+	reader, writer := io.Pipe()
 
-	if err == nil {
-		/*This has to happen in another context because of the pipe used to read-write the outgoing message*/
-		go func() {
-			defer fp.Close()
-			defer writer.Close()
+	/*This has to happen in another context because of the pipe used to read-write the outgoing message*/
+	go func() {
+		defer fp.Close()
 
-			var httpWriter io.Writer = writer
+		var httpWriter io.Writer = writer
 
-			// if we are using compression, chain the GzipWriter inline
-			if this.Config.CompressHTTPPayload {
-				gzw := gzip.NewWriter(writer)
-				defer gzw.Close()
-				httpWriter = gzw
-			}
+		// if we are using compression, chain the GzipWriter inline
+		var gzw *gzip.Writer
+		if this.Config.CompressHTTPPayload {
+			gzw, _ = gzip.NewWriterLevel(writer, this.Config.CompressionLevel.Gzip())
+			httpWriter = gzw
+		}
 
-			go convertFileIntoTemplate(this.Config, fp, uploadData.Events, this.firstEventTemplate, this.subsequentEventTemplate)
+		go convertFileIntoTemplate(this.Config, fp, uploadData.Events, this.firstEventTemplate, this.subsequentEventTemplate)
 
-			this.HTTPPostTemplate.Execute(httpWriter, uploadData)
-		}()
+		err := this.HTTPPostTemplate.Execute(httpWriter, uploadData)
 
-		/* Set the header values of the post */
-		for key, value := range this.headers {
-			request.Header.Set(key, value)
+		// when the template stopped early, let the file reader finish
+		for range uploadData.Events {
 		}
 
-		/* Execute the POST */
-		resp, err := this.client.Do(request)
-		if err != nil {
-			return UploadStatus{fileName: fileName, result: err}
+		if gzw != nil {
+			if closeErr := gzw.Close(); err == nil {
+				err = closeErr
+			}
 		}
-		defer resp.Body.Close()
+		writer.CloseWithError(err)
+	}()
 
-		/* Some sort of issue with the POST */
-		if resp.StatusCode != 200 {
-			body, _ := ioutil.ReadAll(resp.Body)
-			errorData := resp.Status + "\n" + string(body)
+	return reader
+}
 
-			return UploadStatus{fileName: fileName,
-				result: fmt.Errorf("HTTP request failed: Error code %s", errorData), status: resp.StatusCode}
-		}
-		return UploadStatus{fileName: fileName, result: err, status: 200}
+// readResponseBody returns the body of a response. Bodies compressed with gzip are decompressed;
+// the transport only does it for the responses to requests where it asked for gzip itself.
+func readResponseBody(resp *http.Response) ([]byte, error) {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return ioutil.ReadAll(resp.Body)
+	}
 
+	gzr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, err
 	}
-	fp.Close()
-	return UploadStatus{fileName: fileName, result: err, status: 500}
+	defer gzr.Close()
+	return ioutil.ReadAll(gzr)
 }
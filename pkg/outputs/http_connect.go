@@ -0,0 +1,77 @@
+package outputs
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// longest wait for the proxy to answer a CONNECT request
+const httpConnectTimeout = 30 * time.Second
+
+// dialHTTPConnect opens a connection to address through the HTTP proxy at proxyURL, asking it to
+// CONNECT to address. Basic auth is sent when the URL holds a user name.
+func dialHTTPConnect(dialer net.Dialer, proxyURL *url.URL, address string) (net.Conn, error) {
+	conn, err := hostConnections.Dial(dialer, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP proxy %s: %s", proxyURL.Host, err)
+	}
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	conn.SetDeadline(time.Now().Add(httpConnectTimeout))
+	reader := bufio.NewReader(conn)
+	err = request.Write(conn)
+	var response *http.Response
+	if err == nil {
+		response, err = http.ReadResponse(reader, request)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s: %s", proxyURL.Host, err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s refused to connect to %s: %s", proxyURL.Host, address, response.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// anything the collector sent right after the proxy's answer was read along with it
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were already read into reader.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// CloseWrite half-closes the connection to the proxy, like that of a *net.TCPConn.
+func (c *bufferedConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+//go:build linux
+// +build linux
+
+package outputs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// journal field names are limited to 64 characters
+const journalFieldNameMaxLength = 64
+
+// JournaldOutput writes every event to the systemd journal using its native protocol, with the
+// event as MESSAGE and each of its top level keys as a separate field.
+type JournaldOutput struct {
+	Config     *Configuration
+	socketPath string
+	conn       *net.UnixConn
+
+	connectTime       time.Time
+	sentEventCount    int64
+	droppedEventCount int64
+	bytesSent         int64
+	errorLog          *ErrorLogSampler
+	latency           *DeliveryLatency
+
+	sync.RWMutex
+}
+
+type JournaldStatistics struct {
+	LastOpenTime      time.Time `json:"last_open_time"`
+	Socket            string    `json:"socket"`
+	SentEventCount    int64     `json:"sent_event_count"`
+	DroppedEventCount int64     `json:"dropped_event_count"`
+	BytesSent         int64     `json:"bytes_sent"`
+	Connected         bool      `json:"connected"`
+
+	DeliveryLatency DeliveryLatencyStatistics `json:"delivery_latency"`
+}
+
+func (s JournaldStatistics) Sent() int64    { return s.SentEventCount }
+func (s JournaldStatistics) Dropped() int64 { return s.DroppedEventCount }
+
+func NewJournaldOutputFromConfig(cfg *Configuration) *JournaldOutput {
+	return &JournaldOutput{Config: cfg, errorLog: NewErrorLogSampler(cfg.ErrorLogBurst, cfg.ErrorLogInterval), latency: NewDeliveryLatency()}
+}
+
+func (o *JournaldOutput) DeliveryLatency() *DeliveryLatency {
+	return o.latency
+}
+
+// Initialize() expects the path of the journal socket, usually /run/systemd/journal/socket
+func (o *JournaldOutput) Initialize(socketPath string) error {
+	o.Lock()
+	defer o.Unlock()
+
+	o.socketPath = socketPath
+	return o.connect()
+}
+
+func (o *JournaldOutput) connect() error {
+	if o.conn != nil {
+		o.conn.Close()
+		o.conn = nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: o.socketPath, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("Error connecting to the journal at '%s': %s", o.socketPath, err)
+	}
+	o.conn = conn
+	o.connectTime = time.Now()
+	log.Infof("Connected to the journal at %s", o.socketPath)
+	return nil
+}
+
+func (o *JournaldOutput) Key() string {
+	return "journald:" + o.String()
+}
+
+func (o *JournaldOutput) String() string {
+	o.RLock()
+	defer o.RUnlock()
+
+	return o.socketPath
+}
+
+func (o *JournaldOutput) Statistics() interface{} {
+	o.RLock()
+	defer o.RUnlock()
+
+	return JournaldStatistics{
+		LastOpenTime:      o.connectTime,
+		Socket:            o.socketPath,
+		SentEventCount:    atomic.LoadInt64(&o.sentEventCount),
+		DroppedEventCount: atomic.LoadInt64(&o.droppedEventCount),
+		BytesSent:         atomic.LoadInt64(&o.bytesSent),
+		Connected:         o.conn != nil,
+
+		DeliveryLatency: o.latency.Statistics(),
+	}
+}
+
+func (o *JournaldOutput) output(m string) error {
+	o.Lock()
+	defer o.Unlock()
+
+	// journald may have been restarted since the last event
+	if o.conn == nil {
+		if err := o.connect(); err != nil {
+			atomic.AddInt64(&o.droppedEventCount, 1)
+			return err
+		}
+	}
+
+	entry := o.entry(m)
+	err := o.send(entry)
+	if err != nil {
+		o.conn.Close()
+		o.conn = nil
+		atomic.AddInt64(&o.droppedEventCount, 1)
+		return fmt.Errorf("Error writing to the journal at '%s': %s", o.socketPath, err)
+	}
+
+	atomic.AddInt64(&o.sentEventCount, 1)
+	atomic.AddInt64(&o.bytesSent, int64(len(entry)))
+	o.latency.delivered()
+	return nil
+}
+
+func (o *JournaldOutput) Verify(message string) error {
+	return o.output(message)
+}
+
+// send writes an entry as a single datagram. Entries too large for a datagram are written to an
+// unlinked temporary file whose descriptor is passed to journald instead.
+func (o *JournaldOutput) send(entry []byte) error {
+	_, err := o.conn.Write(entry)
+	if err == nil || !isMessageTooLarge(err) {
+		return err
+	}
+
+	file, err := ioutil.TempFile("/dev/shm", "cb-event-forwarder-journal")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		return err
+	}
+	if _, err := file.Write(entry); err != nil {
+		return err
+	}
+
+	_, _, err = o.conn.WriteMsgUnix(nil, syscall.UnixRights(int(file.Fd())), nil)
+	return err
+}
+
+func isMessageTooLarge(err error) bool {
+	var errno syscall.Errno
+	return errors.As(err, &errno) && (errno == syscall.EMSGSIZE || errno == syscall.ENOBUFS)
+}
+
+// entry serializes an event in the journal native protocol. The formatted event is the MESSAGE;
+// json events also have each top level key as a field, nested values encoded as json.
+func (o *JournaldOutput) entry(m string) []byte {
+	var b bytes.Buffer
+	appendJournalField(&b, "MESSAGE", m)
+	appendJournalField(&b, "PRIORITY", strconv.Itoa(o.Config.JournaldPriority))
+	if len(o.Config.JournaldIdentifier) > 0 {
+		appendJournalField(&b, "SYSLOG_IDENTIFIER", o.Config.JournaldIdentifier)
+	}
+
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(m))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return b.Bytes()
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		var value string
+		switch v := fields[key].(type) {
+		case string:
+			value = v
+		case json.Number:
+			value = v.String()
+		case nil:
+			continue
+		default:
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				continue
+			}
+			value = string(encoded)
+		}
+		appendJournalField(&b, journalFieldName(o.Config.JournaldFieldPrefix, key), value)
+	}
+	return b.Bytes()
+}
+
+// journalFieldName turns an event key into a valid journal field name: uppercase letters, digits
+// and underscores, not starting with an underscore or a digit.
+func journalFieldName(prefix, key string) string {
+	name := []byte(prefix + strings.ToUpper(key))
+	for i, c := range name {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			name[i] = '_'
+		}
+	}
+	if len(name) == 0 || !(name[0] >= 'A' && name[0] <= 'Z') {
+		name = append([]byte("F_"), name...)
+	}
+	if len(name) > journalFieldNameMaxLength {
+		name = name[:journalFieldNameMaxLength]
+	}
+	return string(name)
+}
+
+// appendJournalField adds a field to an entry. Values with newlines are written with an explicit
+// length, as the protocol requires.
+func appendJournalField(b *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+
+	b.WriteString(name)
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+func (o *JournaldOutput) Go(messages <-chan string, signals <-chan os.Signal, exitCond *sync.Cond) error {
+	go func() {
+		defer exitCond.Signal()
+
+		for {
+			select {
+			case message := <-messages:
+				o.latency.next()
+				if err := o.output(message); err != nil && !o.Config.DryRun {
+					o.errorLog.Errorf("%s", err)
+				}
+
+			case signal := <-signals:
+				switch signal {
+				case syscall.SIGTERM, syscall.SIGINT:
+					log.Infof("Journald output handling SIGTERM")
+					o.Lock()
+					if o.conn != nil {
+						o.conn.Close()
+						o.conn = nil
+					}
+					o.Unlock()
+					return
+				}
+			}
+		}
+	}()
+
+	return nil
+}
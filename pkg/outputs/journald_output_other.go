@@ -0,0 +1,45 @@
+//go:build !linux
+// +build !linux
+
+package outputs
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+)
+
+// JournaldOutput is only available on Linux; elsewhere it fails to initialize.
+type JournaldOutput struct {
+	Config *Configuration
+}
+
+func NewJournaldOutputFromConfig(cfg *Configuration) *JournaldOutput {
+	return &JournaldOutput{Config: cfg}
+}
+
+func (o *JournaldOutput) Initialize(string) error {
+	return errors.New("The journald output is only supported on Linux")
+}
+
+func (o *JournaldOutput) Key() string {
+	return "journald"
+}
+
+func (o *JournaldOutput) String() string {
+	return "journald"
+}
+
+func (o *JournaldOutput) Statistics() interface{} {
+	return nil
+}
+
+func (o *JournaldOutput) Verify(string) error {
+	return errors.New("The journald output is only supported on Linux")
+}
+
+func (o *JournaldOutput) Go(messages <-chan string, signals <-chan os.Signal, exitCond *sync.Cond) error {
+	return errors.New("The journald output is only supported on Linux")
+}
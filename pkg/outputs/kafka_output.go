@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -15,6 +16,7 @@ import (
 
 	"github.com/Shopify/sarama"
 	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/formatters"
 	"github.com/rcrowley/go-metrics"
 	log "github.com/sirupsen/logrus"
 )
@@ -49,22 +51,29 @@ type KafkaOutput struct {
 	topicSuffix       string
 	topic             *string
 	producer          sarama.AsyncProducer
+	deadLetters       chan ConfirmedMessage
 	droppedEventCount int64
 	eventSentCount    int64
+	deadLetterCount   int64
 	EventSent         metrics.Meter
 	DroppedEvent      metrics.Meter
+	errorLog          *ErrorLogSampler
 	sync.RWMutex
 }
 
 func NewKafkaOutputFromConfig(cfg *Configuration) *KafkaOutput {
-	return &KafkaOutput{Config: cfg}
+	return &KafkaOutput{Config: cfg, errorLog: NewErrorLogSampler(cfg.ErrorLogBurst, cfg.ErrorLogInterval)}
 }
 
 type KafkaStatistics struct {
-	DroppedEventCount int64 `json:"dropped_event_count"`
-	EventSentCount    int64 `json:"event_sent_count"`
+	DroppedEventCount    int64 `json:"dropped_event_count"`
+	EventSentCount       int64 `json:"event_sent_count"`
+	DeadLetterEventCount int64 `json:"dead_letter_event_count"`
 }
 
+func (s KafkaStatistics) Sent() int64    { return s.EventSentCount }
+func (s KafkaStatistics) Dropped() int64 { return s.DroppedEventCount }
+
 func (o *KafkaOutput) Initialize(unused string) (err error) {
 	o.Lock()
 	defer o.Unlock()
@@ -78,6 +87,18 @@ func (o *KafkaOutput) Initialize(unused string) (err error) {
 	kafkaConfig := sarama.NewConfig()
 	sarama.MaxRequestSize = o.Config.KafkaMaxRequestSize
 	kafkaConfig.Producer.Return.Successes = true
+	kafkaConfig.Producer.Retry.Max = o.Config.KafkaMaxRetries
+
+	switch o.Config.KafkaRequiredAcks {
+	case "local":
+		kafkaConfig.Producer.RequiredAcks = sarama.WaitForLocal
+	case "none":
+		kafkaConfig.Producer.RequiredAcks = sarama.NoResponse
+	default:
+		kafkaConfig.Producer.RequiredAcks = sarama.WaitForAll
+	}
+
+	o.deadLetters = make(chan ConfirmedMessage, 1000)
 
 	o.EventSent = metrics.NewRegisteredMeter("output.kafka.events_sent", metrics.DefaultRegistry)
 	o.DroppedEvent = metrics.NewRegisteredMeter("output.kafka.events_dropped", metrics.DefaultRegistry)
@@ -126,6 +147,19 @@ func (o *KafkaOutput) Initialize(unused string) (err error) {
 }
 
 func (o *KafkaOutput) Go(messages <-chan string, signals <-chan os.Signal, exitCond *sync.Cond) error {
+	confirmed := make(chan ConfirmedMessage)
+	go func() {
+		for message := range messages {
+			confirmed <- ConfirmedMessage{Message: message}
+		}
+	}()
+	return o.GoConfirmed(confirmed, signals, exitCond)
+}
+
+// GoConfirmed produces the messages, confirming each of them once the brokers acknowledge it as
+// required by required_acks, or once it is written to the dead letter topic. Messages that can't
+// be written to either are given up on.
+func (o *KafkaOutput) GoConfirmed(messages <-chan ConfirmedMessage, signals <-chan os.Signal, exitCond *sync.Cond) error {
 	go func() {
 		refreshTicker := time.NewTicker(1 * time.Second)
 		defer exitCond.Signal()
@@ -141,22 +175,14 @@ func (o *KafkaOutput) Go(messages <-chan string, signals <-chan os.Signal, exitC
 		for {
 			select {
 			case message := <-messages:
-				if o.topic != nil {
-					o.output(*o.topic, message)
+				if topic, ok := o.topicFor(message.Message); ok {
+					o.output(topic, message)
 				} else {
-					var parsedMsg map[string]interface{}
-
-					json.Unmarshal([]byte(message), &parsedMsg)
-					topic := parsedMsg["type"]
-					if topicString, ok := topic.(string); ok {
-						topicString = strings.ReplaceAll(topicString, "ingress.event.", "")
-						topicString += o.topicSuffix
-
-						o.output(topicString, message)
-					} else {
-						log.Info("ERROR: Topic was not a string")
-					}
+					log.Info("ERROR: Topic was not a string")
+					message.confirm(false)
 				}
+			case failed := <-o.deadLetters:
+				o.output(o.Config.KafkaDeadLetterTopic, failed)
 			case signal := <-signals:
 				switch signal {
 				case syscall.SIGTERM, syscall.SIGINT:
@@ -169,18 +195,22 @@ func (o *KafkaOutput) Go(messages <-chan string, signals <-chan os.Signal, exitC
 	}()
 
 	go func() {
-		for range o.producer.Successes() {
+		for msg := range o.producer.Successes() {
 			atomic.AddInt64(&o.eventSentCount, 1)
 			o.EventSent.Mark(1)
+			confirmedMessage(msg).confirm(true)
 		}
 	}()
 
 	go func() {
 		for err := range o.producer.Errors() {
-			log.Info(err)
+			if o.deadLetter(err) {
+				continue
+			}
 			atomic.AddInt64(&o.droppedEventCount, 1)
 			o.DroppedEvent.Mark(1)
-			log.Errorf("Dropped event due to %s", err)
+			o.errorLog.Errorf("Dropped event%s due to %s", o.eventID(err.Msg), err)
+			confirmedMessage(err.Msg).confirm(false)
 		}
 	}()
 
@@ -191,7 +221,11 @@ func (o *KafkaOutput) Statistics() interface{} {
 	o.RLock()
 	defer o.RUnlock()
 
-	return KafkaStatistics{DroppedEventCount: o.droppedEventCount, EventSentCount: o.eventSentCount}
+	return KafkaStatistics{
+		DroppedEventCount:    atomic.LoadInt64(&o.droppedEventCount),
+		EventSentCount:       atomic.LoadInt64(&o.eventSentCount),
+		DeadLetterEventCount: atomic.LoadInt64(&o.deadLetterCount),
+	}
 }
 
 func (o *KafkaOutput) String() string {
@@ -208,10 +242,85 @@ func (o *KafkaOutput) Key() string {
 	return fmt.Sprintf("brokers:%s", o.brokers)
 }
 
-func (o *KafkaOutput) output(topic string, m string) {
+// topicFor returns the topic an event goes to: the configured topic, or otherwise one named
+// after the event type.
+func (o *KafkaOutput) topicFor(message string) (string, bool) {
+	if o.topic != nil {
+		return *o.topic, true
+	}
+
+	var parsedMsg map[string]interface{}
+	json.Unmarshal([]byte(message), &parsedMsg)
+	topicString, ok := parsedMsg["type"].(string)
+	if !ok {
+		return "", false
+	}
+	topicString = strings.ReplaceAll(topicString, "ingress.event.", "")
+	return topicString + o.topicSuffix, true
+}
+
+// Verify produces a single event and waits until the brokers acknowledge it, as required by the
+// producer settings.
+func (o *KafkaOutput) Verify(message string) error {
+	topic, ok := o.topicFor(message)
+	if !ok {
+		return errors.New("The event has no type to choose a topic from")
+	}
+	o.output(topic, ConfirmedMessage{Message: message})
+
+	select {
+	case <-o.producer.Successes():
+	case err := <-o.producer.Errors():
+		o.producer.Close()
+		return err
+	}
+	return o.producer.Close()
+}
+
+// output produces a message, keeping it along as the metadata of the producer message so that
+// it can be confirmed, or dead-lettered, once the producer is done with it.
+func (o *KafkaOutput) output(topic string, m ConfirmedMessage) {
 	o.producer.Input() <- &sarama.ProducerMessage{
-		Topic: topic,
-		Key:   nil,
-		Value: sarama.StringEncoder(m),
+		Topic:    topic,
+		Key:      nil,
+		Value:    sarama.StringEncoder(m.Message),
+		Metadata: m,
+	}
+}
+
+// confirmedMessage returns the message a producer message was produced from.
+func confirmedMessage(msg *sarama.ProducerMessage) ConfirmedMessage {
+	m, _ := msg.Metadata.(ConfirmedMessage)
+	return m
+}
+
+// deadLetter queues an event that could not be written after all retries to the dead letter
+// topic, if one is configured. Events that fail on the dead letter topic itself are dropped.
+func (o *KafkaOutput) deadLetter(err *sarama.ProducerError) bool {
+	if len(o.Config.KafkaDeadLetterTopic) == 0 || err.Msg.Topic == o.Config.KafkaDeadLetterTopic {
+		return false
+	}
+
+	select {
+	case o.deadLetters <- confirmedMessage(err.Msg):
+		atomic.AddInt64(&o.deadLetterCount, 1)
+		log.Warnf("Sending event%s to dead letter topic %s after error on topic %s: %s",
+			o.eventID(err.Msg), o.Config.KafkaDeadLetterTopic, err.Msg.Topic, err.Err)
+		return true
+	default:
+		return false
+	}
+}
+
+// eventID returns the correlation ID embedded in a message, formatted to be added to a log
+// line, or nothing if IDs are not embedded in events.
+func (o *KafkaOutput) eventID(msg *sarama.ProducerMessage) string {
+	value, ok := msg.Value.(sarama.StringEncoder)
+	if !ok {
+		return ""
+	}
+	if id, ok := formatters.EmbeddedID(string(value), o.Config.CorrelationIDField); ok {
+		return " " + id
 	}
+	return ""
 }
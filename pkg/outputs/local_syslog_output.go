@@ -0,0 +1,183 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package outputs
+
+import (
+	"errors"
+	"fmt"
+	"log/syslog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// LocalSyslogOutput writes events to the syslog daemon of the host through log/syslog, which
+// finds the local socket and reconnects to it when the daemon restarts. Routing the events
+// onwards is left to the daemon's configuration.
+type LocalSyslogOutput struct {
+	Config *Configuration
+	writer *syslog.Writer
+
+	connectTime       time.Time
+	connected         bool
+	sentEventCount    int64
+	droppedEventCount int64
+	latency           *DeliveryLatency
+	errorLog          *ErrorLogSampler
+
+	sync.RWMutex
+}
+
+type LocalSyslogStatistics struct {
+	LastOpenTime      time.Time `json:"last_open_time"`
+	Tag               string    `json:"tag"`
+	Facility          int       `json:"facility"`
+	Connected         bool      `json:"connected"`
+	SentEventCount    int64     `json:"sent_event_count"`
+	DroppedEventCount int64     `json:"dropped_event_count"`
+
+	DeliveryLatency DeliveryLatencyStatistics `json:"delivery_latency"`
+}
+
+func (s LocalSyslogStatistics) Sent() int64    { return s.SentEventCount }
+func (s LocalSyslogStatistics) Dropped() int64 { return s.DroppedEventCount }
+
+func NewLocalSyslogOutputFromConfig(cfg *Configuration) *LocalSyslogOutput {
+	return &LocalSyslogOutput{Config: cfg, errorLog: NewErrorLogSampler(cfg.ErrorLogBurst, cfg.ErrorLogInterval), latency: NewDeliveryLatency()}
+}
+
+// Initialize() takes no parameters, the local syslog daemon is found by log/syslog.
+func (o *LocalSyslogOutput) Initialize(string) error {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.connected {
+		o.writer.Close()
+		o.connected = false
+	}
+
+	var err error
+	o.writer, err = syslog.New(syslog.Priority(o.Config.SyslogFacility<<3|o.Config.SyslogDefaultSeverity), o.Config.LocalSyslogTag)
+	if err != nil {
+		return fmt.Errorf("Error connecting to the local syslog daemon: %s", err)
+	}
+
+	o.connectTime = time.Now()
+	o.connected = true
+	log.Infof("Connected to the local syslog daemon at %s.", o.connectTime)
+	return nil
+}
+
+func (o *LocalSyslogOutput) Key() string {
+	return o.String()
+}
+
+func (o *LocalSyslogOutput) String() string {
+	return "localsyslog:" + o.Config.LocalSyslogTag
+}
+
+func (o *LocalSyslogOutput) Statistics() interface{} {
+	o.RLock()
+	defer o.RUnlock()
+
+	return LocalSyslogStatistics{
+		LastOpenTime:      o.connectTime,
+		Tag:               o.Config.LocalSyslogTag,
+		Facility:          o.Config.SyslogFacility,
+		Connected:         o.connected,
+		SentEventCount:    atomic.LoadInt64(&o.sentEventCount),
+		DroppedEventCount: atomic.LoadInt64(&o.droppedEventCount),
+
+		DeliveryLatency: o.latency.Statistics(),
+	}
+}
+
+func (o *LocalSyslogOutput) output(m string) error {
+	var err error
+	switch syslog.Priority(eventSyslogSeverity(o.Config, m)) {
+	case syslog.LOG_EMERG:
+		err = o.writer.Emerg(m)
+	case syslog.LOG_ALERT:
+		err = o.writer.Alert(m)
+	case syslog.LOG_CRIT:
+		err = o.writer.Crit(m)
+	case syslog.LOG_ERR:
+		err = o.writer.Err(m)
+	case syslog.LOG_WARNING:
+		err = o.writer.Warning(m)
+	case syslog.LOG_NOTICE:
+		err = o.writer.Notice(m)
+	case syslog.LOG_INFO:
+		err = o.writer.Info(m)
+	default:
+		err = o.writer.Debug(m)
+	}
+
+	// log/syslog already tried to reconnect once before failing
+	if err != nil {
+		atomic.AddInt64(&o.droppedEventCount, 1)
+		return fmt.Errorf("Could not write to the local syslog daemon: %s", err)
+	}
+	atomic.AddInt64(&o.sentEventCount, 1)
+	o.latency.delivered()
+	return nil
+}
+
+// Verify writes a single event and closes the connection.
+func (o *LocalSyslogOutput) Verify(message string) error {
+	if err := o.output(message); err != nil {
+		return err
+	}
+	o.close()
+	return nil
+}
+
+func (o *LocalSyslogOutput) DeliveryLatency() *DeliveryLatency {
+	return o.latency
+}
+
+func (o *LocalSyslogOutput) close() {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.connected {
+		o.writer.Close()
+		o.connected = false
+	}
+}
+
+func (o *LocalSyslogOutput) Go(messages <-chan string, signals <-chan os.Signal, exitCond *sync.Cond) error {
+	if o.writer == nil {
+		return errors.New("Local syslog not open")
+	}
+
+	go func() {
+		defer exitCond.Signal()
+
+		for {
+			select {
+			case message := <-messages:
+				o.latency.next()
+				if err := o.output(message); err != nil && !o.Config.DryRun {
+					o.errorLog.Errorf("%s", err)
+				}
+
+			case signal := <-signals:
+				switch signal {
+				case syscall.SIGTERM, syscall.SIGINT:
+					log.Infof("Local syslog output handling SIGTERM")
+					o.close()
+					return
+				}
+			}
+		}
+	}()
+
+	return nil
+}
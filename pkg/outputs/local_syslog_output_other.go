@@ -0,0 +1,45 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package outputs
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+)
+
+// LocalSyslogOutput needs a local syslog daemon; elsewhere it fails to initialize.
+type LocalSyslogOutput struct {
+	Config *Configuration
+}
+
+func NewLocalSyslogOutputFromConfig(cfg *Configuration) *LocalSyslogOutput {
+	return &LocalSyslogOutput{Config: cfg}
+}
+
+func (o *LocalSyslogOutput) Initialize(string) error {
+	return errors.New("The localsyslog output is not supported on this platform")
+}
+
+func (o *LocalSyslogOutput) Key() string {
+	return "localsyslog"
+}
+
+func (o *LocalSyslogOutput) String() string {
+	return "localsyslog"
+}
+
+func (o *LocalSyslogOutput) Statistics() interface{} {
+	return nil
+}
+
+func (o *LocalSyslogOutput) Verify(string) error {
+	return errors.New("The localsyslog output is not supported on this platform")
+}
+
+func (o *LocalSyslogOutput) Go(messages <-chan string, signals <-chan os.Signal, exitCond *sync.Cond) error {
+	return errors.New("The localsyslog output is not supported on this platform")
+}
@@ -0,0 +1,436 @@
+package outputs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// the path of Loki's push API, added to lokiout when it has no path of its own
+const lokiPushPath = "/loki/api/v1/push"
+
+// Loki reports the entries it refused along with the others it took as
+// "total ignored: <n> out of <m>"
+var lokiIgnoredEntries = regexp.MustCompile(`total ignored: (\d+) out of (\d+)`)
+
+// LokiOutput pushes events to Grafana Loki in batches, as log lines of streams labeled with
+// fields of the events. Loki requires the entries of a stream to be in time order, so entries
+// are sorted within each batch and those older than the last one pushed to their stream are sent
+// with a timestamp just after it.
+type LokiOutput struct {
+	Config *Configuration
+	url    string
+	client *http.Client
+
+	mutex   sync.Mutex
+	streams map[string]*lokiStream
+	// timestamp of the last entry pushed to each stream
+	lastTimestamps map[string]int64
+	pendingCount   int
+	batchStart     time.Time
+	pendingLatency []time.Time
+
+	pushedEventCount     int64
+	failedEventCount     int64
+	outOfOrderEventCount int64
+	reorderedEventCount  int64
+	retryCount           int64
+	latency              *DeliveryLatency
+	errorLog             *ErrorLogSampler
+}
+
+type LokiStatistics struct {
+	URL               string `json:"url"`
+	PendingEventCount int    `json:"pending_event_count"`
+	PushedEventCount  int64  `json:"pushed_event_count"`
+	FailedEventCount  int64  `json:"failed_event_count"`
+	// entries Loki refused for being out of order, and those sent with a later timestamp than
+	// their own to avoid it
+	OutOfOrderEventCount int64 `json:"out_of_order_event_count"`
+	ReorderedEventCount  int64 `json:"reordered_event_count"`
+	RetryCount           int64 `json:"retry_count"`
+
+	DeliveryLatency DeliveryLatencyStatistics `json:"delivery_latency"`
+}
+
+func (s LokiStatistics) Sent() int64    { return s.PushedEventCount }
+func (s LokiStatistics) Dropped() int64 { return s.FailedEventCount }
+
+type lokiStream struct {
+	labels  map[string]string
+	entries []lokiEntry
+}
+
+type lokiEntry struct {
+	timestamp int64
+	line      string
+}
+
+// the body of a push request
+type lokiPush struct {
+	Streams []lokiPushStream `json:"streams"`
+}
+
+type lokiPushStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func NewLokiOutputFromConfig(cfg *Configuration) *LokiOutput {
+	return &LokiOutput{Config: cfg, errorLog: NewErrorLogSampler(cfg.ErrorLogBurst, cfg.ErrorLogInterval), latency: NewDeliveryLatency()}
+}
+
+// Initialize() expects the URL of Loki, for example http://loki.example.com:3100, to which the
+// path of the push API is added, or the full URL of the push API.
+func (o *LokiOutput) Initialize(lokiURL string) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	location, err := url.ParseRequestURI(strings.TrimSpace(lokiURL))
+	if err != nil {
+		return fmt.Errorf("Invalid Loki URL '%s': %s", lokiURL, err)
+	}
+	if location.Scheme != "http" && location.Scheme != "https" {
+		return fmt.Errorf("Invalid Loki URL '%s': unsupported scheme %s (http or https)", lokiURL, location.Scheme)
+	}
+	if len(strings.Trim(location.Path, "/")) == 0 {
+		location.Path = lokiPushPath
+	}
+	o.url = location.String()
+
+	o.client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:     o.Config.TLSConfig,
+			Dial:                hostConnections.Dialer(net.Dialer{Timeout: 5 * time.Second}),
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		Timeout: 60 * time.Second,
+	}
+
+	o.streams = make(map[string]*lokiStream)
+	o.lastTimestamps = make(map[string]int64)
+	return nil
+}
+
+func (o *LokiOutput) Key() string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return fmt.Sprintf("loki:%s", o.url)
+}
+
+func (o *LokiOutput) String() string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return fmt.Sprintf("Loki %s", o.url)
+}
+
+func (o *LokiOutput) Statistics() interface{} {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return LokiStatistics{
+		URL:                  o.url,
+		PendingEventCount:    o.pendingCount,
+		PushedEventCount:     atomic.LoadInt64(&o.pushedEventCount),
+		FailedEventCount:     atomic.LoadInt64(&o.failedEventCount),
+		OutOfOrderEventCount: atomic.LoadInt64(&o.outOfOrderEventCount),
+		ReorderedEventCount:  atomic.LoadInt64(&o.reorderedEventCount),
+		RetryCount:           atomic.LoadInt64(&o.retryCount),
+
+		DeliveryLatency: o.latency.Statistics(),
+	}
+}
+
+func (o *LokiOutput) DeliveryLatency() *DeliveryLatency {
+	return o.latency
+}
+
+func (o *LokiOutput) Go(messages <-chan string, signals <-chan os.Signal, exitCond *sync.Cond) error {
+	if o.client == nil {
+		return errors.New("Loki output not initialized")
+	}
+
+	go func() {
+		refreshTicker := time.NewTicker(100 * time.Millisecond)
+		defer exitCond.Signal()
+		defer refreshTicker.Stop()
+
+		for {
+			select {
+			case message := <-messages:
+				o.latency.next()
+				o.add(message, time.Now())
+				if o.batchFull() {
+					o.flush()
+				}
+
+			case <-refreshTicker.C:
+				if o.batchDue(time.Now()) {
+					o.flush()
+				}
+
+			case signal := <-signals:
+				switch signal {
+				case FlushSignal:
+					o.flush()
+				case syscall.SIGTERM, syscall.SIGINT:
+					log.Infof("Loki output handling SIGTERM")
+					o.flush()
+					return
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Verify pushes a single event right away.
+func (o *LokiOutput) Verify(message string) error {
+	o.add(message, time.Now())
+	return o.flush()
+}
+
+// add adds an event to the stream of its labels in the current batch.
+func (o *LokiOutput) add(message string, ingest time.Time) {
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(message))
+	decoder.UseNumber()
+	// events that aren't json objects only get the static labels
+	decoder.Decode(&fields)
+
+	labels := make(map[string]string, len(o.Config.LokiStaticLabels)+len(o.Config.LokiLabels))
+	for name, value := range o.Config.LokiStaticLabels {
+		labels[name] = value
+	}
+	for _, label := range o.Config.LokiLabels {
+		if value, ok := lokiLabelValue(fields, label.Field); ok {
+			labels[label.Name] = value
+		}
+	}
+
+	timestamp := ingest
+	if fields != nil {
+		timestamp, _ = o.Config.TimeSource.EventTime(fields, ingest)
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	key := lokiStreamKey(labels)
+	stream, ok := o.streams[key]
+	if !ok {
+		stream = &lokiStream{labels: labels}
+		o.streams[key] = stream
+	}
+	stream.entries = append(stream.entries, lokiEntry{timestamp: timestamp.UnixNano(), line: strings.TrimRight(message, "\r\n")})
+
+	if o.pendingCount == 0 {
+		o.batchStart = ingest
+	}
+	o.pendingCount++
+	o.pendingLatency = append(o.pendingLatency, o.latency.hold())
+}
+
+func (o *LokiOutput) batchFull() bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return o.pendingCount >= o.Config.LokiBatchSize
+}
+
+func (o *LokiOutput) batchDue(now time.Time) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return o.pendingCount > 0 && now.Sub(o.batchStart) >= o.Config.LokiBatchWait
+}
+
+// flush pushes the current batch, retrying on throttling and server errors.
+func (o *LokiOutput) flush() error {
+	o.mutex.Lock()
+	if o.pendingCount == 0 {
+		o.mutex.Unlock()
+		return nil
+	}
+	push, count := o.takeBatch()
+	received := o.pendingLatency
+	o.pendingLatency = nil
+	o.mutex.Unlock()
+
+	body, err := json.Marshal(push)
+	if err != nil {
+		atomic.AddInt64(&o.failedEventCount, int64(count))
+		return err
+	}
+
+	retries := batchRetry{maxRetries: o.Config.LokiMaxRetries, retryAfterMax: o.Config.LokiRetryAfterMax, retryCount: &o.retryCount}
+	err = retries.do(fmt.Sprintf("push of %d events to %s", count, o.url), func() (bool, time.Duration, error) {
+		return o.push(body, count)
+	})
+	if err != nil {
+		atomic.AddInt64(&o.failedEventCount, int64(count))
+		err = fmt.Errorf("Dropped %d events after failing to push them to %s: %s", count, o.url, err)
+		o.errorLog.Errorf("%s", err)
+		return err
+	}
+	o.latency.deliveredHeld(received)
+	return nil
+}
+
+// takeBatch empties the current batch into a push request, sorting the entries of each stream
+// and moving those older than the last entry pushed to it to just after that entry.
+func (o *LokiOutput) takeBatch() (lokiPush, int) {
+	var push lokiPush
+	count := o.pendingCount
+
+	for key, stream := range o.streams {
+		sort.SliceStable(stream.entries, func(i, j int) bool {
+			return stream.entries[i].timestamp < stream.entries[j].timestamp
+		})
+
+		last, seen := o.lastTimestamps[key]
+		values := make([][2]string, 0, len(stream.entries))
+		for _, entry := range stream.entries {
+			if seen && entry.timestamp <= last {
+				if entry.timestamp < last {
+					atomic.AddInt64(&o.reorderedEventCount, 1)
+				}
+				entry.timestamp = last + 1
+			}
+			last, seen = entry.timestamp, true
+			values = append(values, [2]string{strconv.FormatInt(entry.timestamp, 10), entry.line})
+		}
+		o.lastTimestamps[key] = last
+		push.Streams = append(push.Streams, lokiPushStream{Stream: stream.labels, Values: values})
+	}
+
+	o.streams = make(map[string]*lokiStream)
+	o.pendingCount = 0
+	return push, count
+}
+
+// push sends a push request holding count events. When it fails, it returns whether to retry
+// it, and how long Loki asked to wait before doing so, or -1 to back off as usual.
+func (o *LokiOutput) push(body []byte, count int) (bool, time.Duration, error) {
+	request, err := http.NewRequest("POST", o.url, bytes.NewReader(body))
+	if err != nil {
+		return false, -1, err
+	}
+	for name, values := range o.Config.LokiHeaders {
+		request.Header[name] = append([]string(nil), values...)
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := o.client.Do(request)
+	if err != nil {
+		return true, -1, err
+	}
+	defer response.Body.Close()
+	responseBody, _ := ioutil.ReadAll(response.Body)
+
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		atomic.AddInt64(&o.pushedEventCount, int64(count))
+		return false, -1, nil
+
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		return true, retryAfterWait(response), fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(responseBody)))
+
+	case response.StatusCode == http.StatusBadRequest && strings.Contains(string(responseBody), "out of order"):
+		// Loki keeps the entries that were in order, and reports how many it refused
+		rejected := count
+		if match := lokiIgnoredEntries.FindStringSubmatch(string(responseBody)); match != nil {
+			if ignored, err := strconv.Atoi(match[1]); err == nil && ignored <= count {
+				rejected = ignored
+			}
+		}
+		atomic.AddInt64(&o.pushedEventCount, int64(count-rejected))
+		atomic.AddInt64(&o.outOfOrderEventCount, int64(rejected))
+		o.errorLog.Errorf("Loki at %s refused %d of %d events for being out of order", o.url, rejected, count)
+		return false, -1, nil
+	}
+
+	return false, -1, fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(responseBody)))
+}
+
+// lokiLabelValue returns the value of a field of an event as a label value. Fields holding
+// objects, arrays or empty strings don't make labels.
+func lokiLabelValue(fields map[string]interface{}, field string) (string, bool) {
+	value, ok := eventField(fields, field)
+	if !ok {
+		return "", false
+	}
+
+	switch value := value.(type) {
+	case string:
+		return value, len(value) > 0
+	case json.Number:
+		return value.String(), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	return "", false
+}
+
+// eventField returns a field of a parsed event. The field is looked up as a key first, then as a
+// dotted path into nested objects.
+func eventField(fields map[string]interface{}, field string) (interface{}, bool) {
+	if value, ok := fields[field]; ok {
+		return value, true
+	}
+
+	var current interface{} = fields
+	for _, part := range strings.Split(field, ".") {
+		object, isObject := current.(map[string]interface{})
+		if !isObject {
+			return nil, false
+		}
+		var ok bool
+		if current, ok = object[part]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// lokiStreamKey identifies the stream of a set of labels, in the label selector syntax.
+func lokiStreamKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var key strings.Builder
+	key.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			key.WriteByte(',')
+		}
+		key.WriteString(name)
+		key.WriteByte('=')
+		key.WriteString(strconv.Quote(labels[name]))
+	}
+	key.WriteByte('}')
+	return key.String()
+}
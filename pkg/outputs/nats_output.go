@@ -0,0 +1,837 @@
+package outputs
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	natsDefaultPort = "4222"
+	// longest time opening a connection, up to the server answering the first ping, may take
+	natsConnectTimeout = 10 * time.Second
+	// the max_payload of servers that don't say theirs
+	natsDefaultMaxPayload = 1024 * 1024
+	// longest time a single write may take before the connection is considered dead
+	natsWriteTimeout = 30 * time.Second
+	// wait before connecting again once a connection is lost or can't be opened
+	natsReconnectWait = 2 * time.Second
+	// the server is pinged every natsPingInterval, and the connection considered stale once
+	// natsMaxPingsOut pings go unanswered
+	natsPingInterval = 2 * time.Minute
+	natsMaxPingsOut  = 2
+)
+
+var errNATSDisconnected = errors.New("not connected")
+
+// NATSOutput publishes each event to a subject of a NATS server, rendered from the event's fields
+// by the subject template. With JetStream, every event is published with a reply subject on which
+// the stream that stores it acknowledges it: up to max_pending_acks events wait for their
+// acknowledgement at a time, and those not acknowledged within ack_timeout, or refused, are
+// published again, with the same message ID so that the stream can discard duplicates, up to
+// max_retries times.
+//
+// A lost connection is opened again every two seconds, trying the servers of natsout in turn.
+// Events wait in the output buffer meanwhile; the event being published when the connection was
+// lost, and with JetStream those waiting for their acknowledgement, are published again once
+// connected.
+type NATSOutput struct {
+	Config  *Configuration
+	servers []*url.URL
+	// the server connected to, or the next one to try
+	server int
+	// the reply subjects of the acknowledgements are under inbox, and the message IDs of the
+	// events start with msgIDPrefix, both unique to this output
+	inbox       string
+	msgIDPrefix string
+
+	mutex         sync.Mutex
+	conn          net.Conn
+	writer        *bufio.Writer
+	connected     bool
+	connectTime   time.Time
+	reconnectTime time.Time
+	maxPayload    int
+	lastPingTime  time.Time
+	pingsOut      int
+	// signalled on every pong, for Verify
+	pongs chan struct{}
+	// the last error sent by the server
+	serverError string
+	// closed once the goroutine reading from the connection sees it closed
+	readerDone chan struct{}
+
+	// with JetStream, the events waiting for their acknowledgement, by ID
+	nextID  uint64
+	pending map[uint64]*natsEvent
+	// without JetStream, the event whose publication failed, published again once connected
+	held *natsEvent
+
+	publishedEventCount int64
+	ackedEventCount     int64
+	failedEventCount    int64
+	retryCount          int64
+	reconnectCount      int64
+	bytesSent           int64
+	latency             *DeliveryLatency
+	errorLog            *ErrorLogSampler
+}
+
+type NATSStatistics struct {
+	Server       string    `json:"server"`
+	Connected    bool      `json:"connected"`
+	LastOpenTime time.Time `json:"last_open_time"`
+	// events published for the first time, and with JetStream, those a stream acknowledged and
+	// those still waiting for it
+	PublishedEventCount int64 `json:"published_event_count"`
+	AckedEventCount     int64 `json:"acked_event_count,omitempty"`
+	AckPendingCount     int   `json:"ack_pending_count,omitempty"`
+	FailedEventCount    int64 `json:"failed_event_count"`
+	// events published again, after a lost connection or for not being acknowledged
+	RetryCount     int64 `json:"retry_count"`
+	ReconnectCount int64 `json:"reconnect_count"`
+	BytesSent      int64 `json:"bytes_sent"`
+
+	DeliveryLatency DeliveryLatencyStatistics `json:"delivery_latency"`
+}
+
+func (s NATSStatistics) Sent() int64       { return s.PublishedEventCount }
+func (s NATSStatistics) Dropped() int64    { return s.FailedEventCount }
+func (s NATSStatistics) Reconnects() int64 { return s.ReconnectCount }
+
+type natsEvent struct {
+	id       uint64
+	subject  string
+	message  string
+	received time.Time
+	// how many times it was published, and with JetStream, when it is published again unless
+	// acknowledged; zero to publish it again right away
+	published int
+	deadline  time.Time
+}
+
+// the part of the INFO the server sends on connecting that the output uses
+type natsServerInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	MaxPayload  int  `json:"max_payload"`
+	Headers     bool `json:"headers"`
+}
+
+type natsConnectOptions struct {
+	Verbose      bool   `json:"verbose"`
+	Pedantic     bool   `json:"pedantic"`
+	TLSRequired  bool   `json:"tls_required"`
+	Name         string `json:"name"`
+	Lang         string `json:"lang"`
+	Protocol     int    `json:"protocol"`
+	User         string `json:"user,omitempty"`
+	Pass         string `json:"pass,omitempty"`
+	AuthToken    string `json:"auth_token,omitempty"`
+	Headers      bool   `json:"headers"`
+	NoResponders bool   `json:"no_responders"`
+}
+
+// the acknowledgement of a JetStream publish
+type natsPubAck struct {
+	Stream string `json:"stream"`
+	Error  *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+func NewNATSOutputFromConfig(cfg *Configuration) *NATSOutput {
+	return &NATSOutput{Config: cfg, errorLog: NewErrorLogSampler(cfg.ErrorLogBurst, cfg.ErrorLogInterval), latency: NewDeliveryLatency()}
+}
+
+// Initialize() expects a comma separated list of servers, as nats://host:port, or tls://host:port
+// to require TLS, for example nats://nats1.example.com:4222,nats://nats2.example.com:4222. The port
+// defaults to 4222, and user and password can be given in the URL. The servers are tried in turn
+// until one accepts the connection.
+func (o *NATSOutput) Initialize(servers string) error {
+	o.servers = nil
+	for _, server := range strings.Split(servers, ",") {
+		if server = strings.TrimSpace(server); len(server) == 0 {
+			continue
+		}
+		location, err := url.Parse(server)
+		if err != nil {
+			return fmt.Errorf("Invalid NATS server '%s': %s", server, err)
+		}
+		if location.Scheme != "nats" && location.Scheme != "tls" {
+			return fmt.Errorf("Invalid NATS server '%s': unsupported scheme %s (nats or tls)", server, location.Scheme)
+		}
+		if len(location.Port()) == 0 {
+			location.Host = net.JoinHostPort(location.Hostname(), natsDefaultPort)
+		}
+		o.servers = append(o.servers, location)
+	}
+	if len(o.servers) == 0 {
+		return errors.New("No NATS server to connect to")
+	}
+
+	var id [12]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return fmt.Errorf("Could not generate a NATS inbox: %s", err)
+	}
+	o.inbox = "_INBOX." + hex.EncodeToString(id[:])
+	o.msgIDPrefix = hex.EncodeToString(id[:]) + "-"
+	o.pending = make(map[uint64]*natsEvent)
+	o.pongs = make(chan struct{}, 1)
+
+	var err error
+	for range o.servers {
+		if err = o.connect(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// connect opens a connection to the current server, moving on to the next one when it fails.
+func (o *NATSOutput) connect() error {
+	o.mutex.Lock()
+	server := o.servers[o.server]
+	o.mutex.Unlock()
+
+	if err := o.open(server); err != nil {
+		o.mutex.Lock()
+		o.server = (o.server + 1) % len(o.servers)
+		o.mutex.Unlock()
+		return fmt.Errorf("Error connecting to '%s': %s", serverName(server), err)
+	}
+	return nil
+}
+
+func (o *NATSOutput) open(server *url.URL) error {
+	conn, err := hostConnections.Dial(net.Dialer{Timeout: 5 * time.Second}, "tcp", server.Host)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(natsConnectTimeout))
+	reader := bufio.NewReader(conn)
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("not a NATS server, it sent %q", strings.TrimSpace(line))
+	}
+	var info natsServerInfo
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info); err != nil {
+		conn.Close()
+		return fmt.Errorf("invalid server INFO: %s", err)
+	}
+	if o.Config.NATSJetStream && !info.Headers {
+		conn.Close()
+		return errors.New("the server doesn't support headers, which JetStream requires")
+	}
+
+	useTLS := server.Scheme == "tls" || info.TLSRequired
+	if useTLS {
+		tlsConfig := &tls.Config{}
+		if o.Config.TLSConfig != nil {
+			tlsConfig = o.Config.TLSConfig.Clone()
+		}
+		if len(tlsConfig.ServerName) == 0 {
+			tlsConfig.ServerName = server.Hostname()
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tlsConn
+		reader = bufio.NewReader(conn)
+	}
+
+	options := natsConnectOptions{
+		TLSRequired: useTLS,
+		Name:        "cb-event-forwarder",
+		Lang:        "go",
+		Protocol:    1,
+		User:        o.Config.NATSUser,
+		Pass:        o.Config.NATSPassword,
+		AuthToken:   o.Config.NATSToken,
+		// a publish that no stream captures is refused right away rather than timing out
+		Headers:      o.Config.NATSJetStream,
+		NoResponders: o.Config.NATSJetStream,
+	}
+	if server.User != nil {
+		options.User = server.User.Username()
+		options.Pass, _ = server.User.Password()
+	}
+	encoded, _ := json.Marshal(options)
+	writer := bufio.NewWriter(conn)
+	fmt.Fprintf(writer, "CONNECT %s\r\nPING\r\n", encoded)
+	if err := writer.Flush(); err != nil {
+		conn.Close()
+		return err
+	}
+	// the server answers the ping once it accepts the connection, or sends an error
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return fmt.Errorf("server error: %s", strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")), "'"))
+		}
+		if line == "PONG" {
+			break
+		}
+	}
+	if o.Config.NATSJetStream {
+		fmt.Fprintf(writer, "SUB %s.* 1\r\n", o.inbox)
+		if err := writer.Flush(); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.conn = conn
+	o.writer = writer
+	o.maxPayload = info.MaxPayload
+	o.connected = true
+	o.connectTime = time.Now()
+	o.lastPingTime = o.connectTime
+	o.pingsOut = 0
+	o.serverError = ""
+	// the events waiting for an acknowledgement on the previous connection won't get it
+	for _, event := range o.pending {
+		event.deadline = time.Time{}
+	}
+
+	readerDone := make(chan struct{})
+	o.readerDone = readerDone
+	maxPayload := info.MaxPayload
+	if maxPayload <= 0 {
+		maxPayload = natsDefaultMaxPayload
+	}
+	go o.read(conn, reader, maxPayload, readerDone)
+
+	log.Infof("Connected to %s at %s.", serverName(server), o.connectTime)
+	return nil
+}
+
+// serverName returns the URL of a server without the credentials it may hold.
+func serverName(server *url.URL) string {
+	return server.Scheme + "://" + server.Host
+}
+
+// read handles what the server sends: pings, errors and acknowledgements, until the connection
+// is closed or the server breaks the protocol, which drops the connection.
+func (o *NATSOutput) read(conn net.Conn, reader *bufio.Reader, maxPayload int, done chan struct{}) {
+	defer close(done)
+	if err := o.readMessages(conn, reader, maxPayload); err != nil {
+		o.errorLog.Errorf("Dropping the connection to NATS server %s: %s", conn.RemoteAddr(), err)
+	}
+}
+
+// readMessages returns nil once the connection is closed, or the protocol error of the server.
+func (o *NATSOutput) readMessages(conn net.Conn, reader *bufio.Reader, maxPayload int) error {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			o.mutex.Lock()
+			if o.conn == conn {
+				o.writer.WriteString("PONG\r\n")
+				o.writer.Flush()
+			}
+			o.mutex.Unlock()
+
+		case "PONG":
+			o.mutex.Lock()
+			if o.pingsOut > 0 {
+				o.pingsOut--
+			}
+			o.mutex.Unlock()
+			select {
+			case o.pongs <- struct{}{}:
+			default:
+			}
+
+		case "-ERR":
+			message := strings.Trim(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), args[0])), "'")
+			o.mutex.Lock()
+			o.serverError = message
+			o.mutex.Unlock()
+			o.errorLog.Errorf("NATS server %s: %s", conn.RemoteAddr(), message)
+
+		case "MSG", "HMSG":
+			headerSize, size, err := parseNATSMessageSizes(args, maxPayload)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %s", strings.TrimSpace(line), err)
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return nil
+			}
+			o.acknowledged(args[1], string(payload[:headerSize]), payload[headerSize:size])
+		}
+	}
+}
+
+// parseNATSMessageSizes returns the sizes of the headers and of the whole payload of a message,
+// MSG <subject> <sid> [reply] <size> or HMSG <subject> <sid> [reply] <header size> <size>, which
+// can't be larger than maxPayload.
+func parseNATSMessageSizes(args []string, maxPayload int) (int, int, error) {
+	sizes := 1
+	if strings.ToUpper(args[0]) == "HMSG" {
+		sizes = 2
+	}
+	if len(args) < 3+sizes || len(args) > 4+sizes {
+		return 0, 0, errors.New("wrong number of arguments")
+	}
+
+	size, err := strconv.Atoi(args[len(args)-1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid size: %s", err)
+	}
+	headerSize := 0
+	if sizes == 2 {
+		if headerSize, err = strconv.Atoi(args[len(args)-2]); err != nil {
+			return 0, 0, fmt.Errorf("invalid header size: %s", err)
+		}
+	}
+	if headerSize < 0 || headerSize > size || size > maxPayload {
+		return 0, 0, fmt.Errorf("sizes out of range, the max_payload being %d", maxPayload)
+	}
+	return headerSize, size, nil
+}
+
+// acknowledged handles the answer to a JetStream publish: the acknowledgement that a stream
+// stored the event, or an error, with headers holding a 503 status when no stream captures the
+// subject. Refused events are published again right away.
+func (o *NATSOutput) acknowledged(subject, headers string, payload []byte) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(subject, o.inbox+"."), 10, 64)
+	if err != nil {
+		return
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	event, ok := o.pending[id]
+	if !ok {
+		// acknowledged already, or given up on
+		return
+	}
+
+	var ack natsPubAck
+	var refusal string
+	switch {
+	case strings.HasPrefix(headers, "NATS/1.0 503"):
+		refusal = "no stream captures the subject"
+	case json.Unmarshal(payload, &ack) != nil:
+		refusal = fmt.Sprintf("invalid acknowledgement %q", payload)
+	case ack.Error != nil:
+		refusal = fmt.Sprintf("%s (%d)", ack.Error.Description, ack.Error.Code)
+	case len(o.Config.NATSStream) > 0 && ack.Stream != o.Config.NATSStream:
+		refusal = fmt.Sprintf("acknowledged by stream %s", ack.Stream)
+	}
+	if len(refusal) > 0 {
+		o.errorLog.Errorf("NATS refused an event published to %s: %s", event.subject, refusal)
+		event.deadline = time.Time{}
+		return
+	}
+
+	delete(o.pending, id)
+	atomic.AddInt64(&o.ackedEventCount, 1)
+	o.latency.deliveredHeld([]time.Time{event.received})
+}
+
+func (o *NATSOutput) Key() string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	names := make([]string, len(o.servers))
+	for i, server := range o.servers {
+		names[i] = serverName(server)
+	}
+	return fmt.Sprintf("nats:%s", strings.Join(names, ","))
+}
+
+func (o *NATSOutput) String() string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return fmt.Sprintf("NATS %s", serverName(o.servers[o.server]))
+}
+
+func (o *NATSOutput) Statistics() interface{} {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return NATSStatistics{
+		Server:              serverName(o.servers[o.server]),
+		Connected:           o.connected,
+		LastOpenTime:        o.connectTime,
+		PublishedEventCount: atomic.LoadInt64(&o.publishedEventCount),
+		AckedEventCount:     atomic.LoadInt64(&o.ackedEventCount),
+		AckPendingCount:     len(o.pending),
+		FailedEventCount:    atomic.LoadInt64(&o.failedEventCount),
+		RetryCount:          atomic.LoadInt64(&o.retryCount),
+		ReconnectCount:      atomic.LoadInt64(&o.reconnectCount),
+		BytesSent:           atomic.LoadInt64(&o.bytesSent),
+
+		DeliveryLatency: o.latency.Statistics(),
+	}
+}
+
+func (o *NATSOutput) DeliveryLatency() *DeliveryLatency {
+	return o.latency
+}
+
+func (o *NATSOutput) Go(messages <-chan string, signals <-chan os.Signal, exitCond *sync.Cond) error {
+	if o.pending == nil {
+		return errors.New("NATS output not initialized")
+	}
+
+	go func() {
+		refreshTicker := time.NewTicker(100 * time.Millisecond)
+		defer exitCond.Signal()
+		defer refreshTicker.Stop()
+
+		for {
+			// events wait in the output buffer while disconnected, and while too many wait for
+			// their acknowledgement
+			input := messages
+			if !o.ready() {
+				input = nil
+			}
+
+			select {
+			case message := <-input:
+				o.latency.next()
+				o.publishEvent(message)
+
+			case <-o.readerDone:
+				o.mutex.Lock()
+				connected := o.connected
+				o.mutex.Unlock()
+				if connected {
+					o.closeAndScheduleReconnection()
+				}
+				o.readerDone = nil
+
+			case now := <-refreshTicker.C:
+				o.refresh(now)
+
+			case signal := <-signals:
+				switch signal {
+				case syscall.SIGTERM, syscall.SIGINT:
+					log.Infof("NATS output handling SIGTERM")
+					if pending := o.waitForAcks(time.Now().Add(o.Config.NATSAckTimeout)); pending > 0 {
+						log.Warnf("Exiting with %d events published to %s that were not acknowledged", pending, o)
+					}
+					o.close()
+					return
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (o *NATSOutput) ready() bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return o.connected && o.held == nil && len(o.pending) < o.Config.NATSMaxPendingAcks
+}
+
+// refresh reconnects, publishes again the events that need it and pings the server.
+func (o *NATSOutput) refresh(now time.Time) {
+	o.mutex.Lock()
+	connected, reconnectTime := o.connected, o.reconnectTime
+	o.mutex.Unlock()
+
+	if !connected {
+		if now.Before(reconnectTime) {
+			return
+		}
+		atomic.AddInt64(&o.reconnectCount, 1)
+		if err := o.connect(); err != nil {
+			o.errorLog.Errorf("%s", err)
+			o.scheduleReconnection()
+			return
+		}
+	}
+
+	o.mutex.Lock()
+	held := o.held
+	o.mutex.Unlock()
+	if held != nil {
+		if err := o.publish(held); err != nil {
+			o.errorLog.Errorf("Could not publish to %s: %s", o, err)
+			o.closeAndScheduleReconnection()
+			return
+		}
+		o.mutex.Lock()
+		o.held = nil
+		o.mutex.Unlock()
+		o.latency.deliveredHeld([]time.Time{held.received})
+	}
+
+	o.retryUnacknowledged(now)
+	o.ping(now)
+}
+
+// publishEvent publishes an event taken from the output buffer.
+func (o *NATSOutput) publishEvent(message string) {
+	event := &natsEvent{message: strings.TrimRight(message, "\r\n"), received: o.latency.hold()}
+	subject, err := NATSSubject(o.Config.NATSSubject, event.message)
+	if err != nil {
+		atomic.AddInt64(&o.failedEventCount, 1)
+		o.errorLog.Errorf("Could not render the NATS subject of an event: %s", err)
+		return
+	}
+	event.subject = subject
+
+	o.mutex.Lock()
+	if o.maxPayload > 0 && len(event.message) > o.maxPayload {
+		o.mutex.Unlock()
+		atomic.AddInt64(&o.failedEventCount, 1)
+		o.errorLog.Errorf("Dropped an event of %d bytes, larger than the max_payload of %s", len(event.message), o)
+		return
+	}
+	if o.Config.NATSJetStream {
+		o.nextID++
+		event.id = o.nextID
+		o.pending[event.id] = event
+	}
+	o.mutex.Unlock()
+
+	if err := o.publish(event); err != nil {
+		o.errorLog.Errorf("Could not publish to %s: %s", o, err)
+		o.closeAndScheduleReconnection()
+		if !o.Config.NATSJetStream {
+			o.mutex.Lock()
+			o.held = event
+			o.mutex.Unlock()
+		}
+		return
+	}
+	if !o.Config.NATSJetStream {
+		o.latency.deliveredHeld([]time.Time{event.received})
+	}
+}
+
+// publish writes an event to the connection. With JetStream, it is published with its reply
+// subject and its message ID, and, when set, the stream expected to store it.
+func (o *NATSOutput) publish(event *natsEvent) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if !o.connected {
+		return errNATSDisconnected
+	}
+	o.conn.SetWriteDeadline(time.Now().Add(natsWriteTimeout))
+	if o.Config.NATSJetStream {
+		headers := fmt.Sprintf("NATS/1.0\r\nNats-Msg-Id: %s%d\r\n", o.msgIDPrefix, event.id)
+		if len(o.Config.NATSStream) > 0 {
+			headers += fmt.Sprintf("Nats-Expected-Stream: %s\r\n", o.Config.NATSStream)
+		}
+		headers += "\r\n"
+		fmt.Fprintf(o.writer, "HPUB %s %s.%d %d %d\r\n%s%s\r\n", event.subject, o.inbox, event.id,
+			len(headers), len(headers)+len(event.message), headers, event.message)
+	} else {
+		fmt.Fprintf(o.writer, "PUB %s %d\r\n%s\r\n", event.subject, len(event.message), event.message)
+	}
+	if err := o.writer.Flush(); err != nil {
+		return err
+	}
+
+	if event.published == 0 {
+		atomic.AddInt64(&o.publishedEventCount, 1)
+	} else {
+		atomic.AddInt64(&o.retryCount, 1)
+	}
+	event.published++
+	event.deadline = time.Now().Add(o.Config.NATSAckTimeout)
+	atomic.AddInt64(&o.bytesSent, int64(len(event.message)))
+	return nil
+}
+
+// retryUnacknowledged publishes again the events that were refused, not acknowledged in time or
+// waiting for an acknowledgement on a lost connection, dropping those published max_retries
+// times already.
+func (o *NATSOutput) retryUnacknowledged(now time.Time) {
+	o.mutex.Lock()
+	var due []*natsEvent
+	for id, event := range o.pending {
+		if !event.deadline.IsZero() && now.Before(event.deadline) {
+			continue
+		}
+		if event.published > o.Config.NATSMaxRetries {
+			delete(o.pending, id)
+			atomic.AddInt64(&o.failedEventCount, 1)
+			o.errorLog.Errorf("Dropped an event published to %s, not acknowledged after %d attempts", event.subject, event.published)
+			continue
+		}
+		due = append(due, event)
+	}
+	o.mutex.Unlock()
+
+	sort.Slice(due, func(i, j int) bool { return due[i].id < due[j].id })
+	for _, event := range due {
+		if err := o.publish(event); err != nil {
+			o.errorLog.Errorf("Could not publish to %s: %s", o, err)
+			o.closeAndScheduleReconnection()
+			return
+		}
+	}
+}
+
+// ping keeps an idle connection open and notices one that has silently gone away.
+func (o *NATSOutput) ping(now time.Time) {
+	o.mutex.Lock()
+	if !o.connected || now.Sub(o.lastPingTime) < natsPingInterval {
+		o.mutex.Unlock()
+		return
+	}
+	if o.pingsOut >= natsMaxPingsOut {
+		o.mutex.Unlock()
+		o.errorLog.Errorf("NATS server %s stopped answering pings", o)
+		o.closeAndScheduleReconnection()
+		return
+	}
+	o.lastPingTime = now
+	o.pingsOut++
+	o.conn.SetWriteDeadline(time.Now().Add(natsWriteTimeout))
+	o.writer.WriteString("PING\r\n")
+	err := o.writer.Flush()
+	o.mutex.Unlock()
+
+	if err != nil {
+		o.errorLog.Errorf("Could not ping %s: %s", o, err)
+		o.closeAndScheduleReconnection()
+	}
+}
+
+// waitForAcks waits for the events published with JetStream to be acknowledged, up to deadline,
+// and returns how many are still waiting.
+func (o *NATSOutput) waitForAcks(deadline time.Time) int {
+	for {
+		o.mutex.Lock()
+		pending, connected := len(o.pending), o.connected
+		o.mutex.Unlock()
+		if pending == 0 || !connected || time.Now().After(deadline) {
+			return pending
+		}
+		time.Sleep(10 * time.Millisecond)
+		o.retryUnacknowledged(time.Now())
+	}
+}
+
+// Verify publishes a single event and waits for the server to process it, or with JetStream, for
+// a stream to acknowledge it, then closes the connection.
+func (o *NATSOutput) Verify(message string) error {
+	defer o.close()
+
+	failed := atomic.LoadInt64(&o.failedEventCount)
+	o.publishEvent(message)
+	if o.Config.NATSJetStream {
+		if pending := o.waitForAcks(time.Now().Add(o.Config.NATSAckTimeout)); pending > 0 || atomic.LoadInt64(&o.failedEventCount) > failed {
+			return fmt.Errorf("%s did not acknowledge the event", o)
+		}
+		return nil
+	}
+
+	o.mutex.Lock()
+	if !o.connected || o.held != nil || atomic.LoadInt64(&o.failedEventCount) > failed {
+		o.mutex.Unlock()
+		return fmt.Errorf("Could not publish the event to %s", serverName(o.servers[o.server]))
+	}
+	// the server handles what a connection sends in order, so once it answers a ping it has
+	// handled the event, and sent an error if it refused it
+	o.writer.WriteString("PING\r\n")
+	err := o.writer.Flush()
+	o.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	select {
+	case <-o.pongs:
+	case <-time.After(natsConnectTimeout):
+		return fmt.Errorf("%s did not answer", o)
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if len(o.serverError) > 0 {
+		return fmt.Errorf("%s refused the event: %s", serverName(o.servers[o.server]), o.serverError)
+	}
+	return nil
+}
+
+func (o *NATSOutput) scheduleReconnection() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.reconnectTime = time.Now().Add(natsReconnectWait)
+}
+
+func (o *NATSOutput) closeAndScheduleReconnection() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.connected {
+		o.conn.Close()
+		o.connected = false
+	}
+	o.reconnectTime = time.Now().Add(natsReconnectWait)
+
+	log.Infof("Lost connection to %s. Will try to reconnect at %s.", serverName(o.servers[o.server]), o.reconnectTime)
+}
+
+// close is called on shutdown, flushing what is left to write before closing the connection.
+func (o *NATSOutput) close() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.connected {
+		o.writer.Flush()
+		o.conn.Close()
+		o.connected = false
+	}
+}
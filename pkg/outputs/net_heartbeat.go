@@ -0,0 +1,101 @@
+package outputs
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// longest line read from a collector that answers heartbeats; longer lines are skipped
+const maxHeartbeatReplyLength = 1024
+
+// heartbeatEnabled tells if the collector is pinged to check that the connection is alive.
+func (o *NetOutput) heartbeatEnabled() bool {
+	return o.Config.HeartbeatInterval > 0 && strings.HasPrefix(o.protocolName, "tcp")
+}
+
+// readHeartbeats reads the lines sent by the collector until the connection closes, signaling
+// each HeartbeatPong on a channel of its own so that replies on an old connection are never
+// taken for replies on a new one. Other lines are ignored.
+func (o *NetOutput) readHeartbeats() {
+	pongs := make(chan struct{}, 1)
+	readerDone := make(chan struct{})
+	o.pongs, o.readerDone = pongs, readerDone
+
+	reader := bufio.NewReaderSize(o.outputSocket, maxHeartbeatReplyLength)
+	go func() {
+		defer close(readerDone)
+		for {
+			line, err := reader.ReadSlice('\n')
+			if err == bufio.ErrBufferFull {
+				for err == bufio.ErrBufferFull {
+					_, err = reader.ReadSlice('\n')
+				}
+				continue
+			}
+			if err != nil {
+				return
+			}
+			if strings.TrimRight(string(line), "\r\n") == o.Config.HeartbeatPong {
+				select {
+				case pongs <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+}
+
+func (o *NetOutput) scheduleHeartbeat(after time.Duration) {
+	if o.heartbeatTimer != nil {
+		o.heartbeatTimer.Stop()
+	}
+	o.heartbeatTimer = time.NewTimer(after)
+}
+
+// receivedPong answers the last ping, and schedules the next one HeartbeatInterval after it.
+func (o *NetOutput) receivedPong() {
+	if o.pingSent.IsZero() {
+		return
+	}
+	next := time.Until(o.pingSent.Add(o.Config.HeartbeatInterval))
+	o.pingSent = time.Time{}
+	o.scheduleHeartbeat(next)
+}
+
+// heartbeat sends a ping when one is due, or reconnects when the last one was not answered
+// within HeartbeatTimeout.
+func (o *NetOutput) heartbeat() error {
+	if !o.connected {
+		return nil
+	}
+
+	if !o.pingSent.IsZero() {
+		// the reply may be waiting along with the timer
+		select {
+		case <-o.pongs:
+			o.receivedPong()
+			return nil
+		default:
+		}
+
+		// the link is presumed dead, so a pending batch is left to be dropped like on a lost
+		// connection rather than written into it
+		atomic.AddInt64(&o.missedHeartbeatCount, 1)
+		o.closeAndScheduleReconnection()
+		return fmt.Errorf("No heartbeat reply from %s within %s, reconnecting", o.netConn, o.Config.HeartbeatTimeout)
+	}
+
+	log.Debugf("Sending heartbeat to %s", o.netConn)
+	if err := o.write(o.Config.HeartbeatPing+"\r\n", 0); err != nil {
+		return fmt.Errorf("Could not send heartbeat to %s: %s", o.netConn, err)
+	}
+	atomic.AddInt64(&o.heartbeatCount, 1)
+	o.pingSent = time.Now()
+	o.scheduleHeartbeat(o.Config.HeartbeatTimeout)
+	return nil
+}
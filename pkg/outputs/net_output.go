@@ -1,10 +1,16 @@
 package outputs
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -21,19 +27,100 @@ type NetOutput struct {
 	protocolName   string
 	outputSocket   net.Conn
 	addNewline     bool
+	// closed once the goroutine reading from the connection sees the collector close its side
+	readerDone chan struct{}
+	// chunks of an event whose delivery was interrupted, sent again once reconnected
+	pendingChunks []string
+	// tcp connections are dialed through it when an SSH tunnel is configured
+	tunnel *sshTunnel
+	// the host:port connected to, which is remoteHostname unless it names SRV records
+	destination string
+	// set when the targets are discovered from SRV records
+	srv *srvDestinations
+	// with a heartbeat, the collector's replies are read from the connection by another goroutine
+	// and signaled on pongs. pingSent is when the unanswered ping was sent, zero when there is none;
+	// the timer fires when the next ping is due or the reply is late.
+	pongs          chan struct{}
+	pingSent       time.Time
+	heartbeatTimer *time.Timer
+	// closed after IdleTimeout without writes, opened again by the next event
+	idle bool
+	// events waiting to be written together, with their receive times for the delivery latency;
+	// the timer fires BatchMaxWait after the first of them was added
+	batch         strings.Builder
+	batchEvents   int
+	batchReceived []time.Time
+	batchTimer    *time.Timer
+	batchMessages []string
+	// the last events sent, replayed after a lost connection is reopened; nil when disabled
+	replay *replayRing
+	// with frame_compression, frames the events sent over tcp; nil when disabled
+	framer *CompressedFramer
+	// the throughput window being counted, zero while disconnected, and sentEventCount when it
+	// started
+	throughputWindowStart time.Time
+	throughputWindowBase  int64
+
+	// OnLowThroughput, when set, is called along with the warning logged when fewer than
+	// MinEventsPerWindow events were sent during a window
+	OnLowThroughput func(sent int64, window time.Duration)
 
 	connectTime                 time.Time
 	reconnectTime               time.Time
+	reconnectBackoff            time.Duration
+	rotateTime                  time.Time
+	rekeyTime                   time.Time
+	connectBytesSent            int64
+	lastWriteTime               time.Time
 	connected                   bool
 	droppedEventCount           int64
 	droppedEventSinceConnection int64
+	sentEventCount              int64
+	connectionEventCount        int64
+	bytesSent                   int64
+	reconnectCount              int64
+	flappingReconnectCount      int64
+	rotationCount               int64
+	idleCloseCount              int64
+	tlsHandshakeCount           int64
+	tlsResumedCount             int64
+	tlsRekeyCount               int64
+	srvSwitchCount              int64
+	heartbeatCount              int64
+	missedHeartbeatCount        int64
+	rotationNoticeCount         int64
+	lastWindowEventCount        int64
+	lowThroughputCount          int64
+	tlsVersion                  string
+	tlsCipherSuite              string
+	tlsHandshakeDuration        time.Duration
+	lastChunkedEventID          uint64
+	chunkedEventCount           int64
+	chunkCount                  int64
+	oversizeDroppedCount        int64
+	handshakeFailureCount       int64
+	startTLSFailureCount        int64
+	batchCount                  int64
+	replayedEventCount          int64
+	backpressureEvents          int64
+	backpressured               int32
+	backpressureStart           time.Time
+	latency                     *DeliveryLatency
 	Config                      *Configuration
+	errorLog                    *ErrorLogSampler
 
 	sync.RWMutex
 }
 
 func NewNetOutputfromConfig(cfg *Configuration) *NetOutput {
-	return &NetOutput{Config: cfg}
+	o := &NetOutput{Config: cfg, errorLog: NewErrorLogSampler(cfg.ErrorLogBurst, cfg.ErrorLogInterval), latency: NewDeliveryLatency()}
+	if len(cfg.SSHTunnelHost) > 0 {
+		o.tunnel = newSSHTunnel(cfg)
+	}
+	if cfg.ReplayOnReconnect > 0 {
+		o.replay = newReplayRing(cfg.ReplayOnReconnect)
+	}
+	return o
 }
 
 type NetStatistics struct {
@@ -41,36 +128,207 @@ type NetStatistics struct {
 	Protocol          string    `json:"connection_protocol"`
 	RemoteHostname    string    `json:"remote_hostname"`
 	DroppedEventCount int64     `json:"dropped_event_count"`
+	SentEventCount    int64     `json:"sent_event_count"`
+	BytesSent         int64     `json:"bytes_sent"`
+	ReconnectCount    int64     `json:"reconnect_count"`
+	RotationCount     int64     `json:"rotation_count"`
 	Connected         bool      `json:"connected"`
+
+	// connections dropped before min_healthy_connection, and the current wait between reconnections
+	FlappingReconnectCount  int64   `json:"flapping_reconnect_count,omitempty"`
+	ReconnectBackoffSeconds float64 `json:"reconnect_backoff_seconds,omitempty"`
+
+	// closed after idle_timeout, to be reopened by the next event
+	Idle           bool  `json:"idle,omitempty"`
+	IdleCloseCount int64 `json:"idle_close_count,omitempty"`
+
+	// the collector is connected but not accepting data fast enough
+	Backpressured      bool  `json:"backpressured"`
+	BackpressureEvents int64 `json:"backpressure_events"`
+
+	DeliveryLatency DeliveryLatencyStatistics `json:"delivery_latency"`
+
+	TLSHandshakeCount int64   `json:"tls_handshake_count,omitempty"`
+	TLSResumedCount   int64   `json:"tls_resumed_handshake_count,omitempty"`
+	TLSResumptionRate float64 `json:"tls_resumption_rate,omitempty"`
+
+	// negotiated by the last TLS handshake, and how long it took
+	TLSVersion          string  `json:"tls_version,omitempty"`
+	TLSCipherSuite      string  `json:"tls_cipher_suite,omitempty"`
+	TLSHandshakeSeconds float64 `json:"tls_handshake_seconds,omitempty"`
+
+	// connections replaced to renew their keys after tls_rekey_interval or tls_rekey_bytes
+	TLSRekeyCount int64 `json:"tls_rekey_count,omitempty"`
+
+	ChunkedEventCount    int64 `json:"chunked_event_count,omitempty"`
+	ChunkCount           int64 `json:"chunk_count,omitempty"`
+	OversizeDroppedCount int64 `json:"oversize_dropped_event_count,omitempty"`
+
+	HandshakeFailureCount int64 `json:"handshake_failure_count,omitempty"`
+
+	// connections the collector didn't agree to upgrade with starttls, or that failed to
+	StartTLSFailureCount int64 `json:"starttls_failure_count,omitempty"`
+
+	BatchCount int64 `json:"batch_count,omitempty"`
+
+	ReplayedEventCount int64 `json:"replayed_event_count,omitempty"`
+
+	SSHTunnelConnectCount int64 `json:"ssh_tunnel_connect_count,omitempty"`
+
+	// the targets found in SRV records, and the one connected to
+	Destination     string   `json:"destination,omitempty"`
+	SRVTargets      []string `json:"srv_targets,omitempty"`
+	SRVLookupErrors int64    `json:"srv_lookup_errors,omitempty"`
+	SRVSwitchCount  int64    `json:"srv_switch_count,omitempty"`
+
+	// pings sent with heartbeat_interval, and connections replaced for lack of a reply
+	HeartbeatCount                int64 `json:"heartbeat_count,omitempty"`
+	MissedHeartbeatReconnectCount int64 `json:"missed_heartbeat_reconnect_count,omitempty"`
+
+	// notices sent with rotation_notice before replacing a connection on purpose
+	RotationNoticeCount int64 `json:"rotation_notice_count,omitempty"`
+
+	// events sent during the last complete throughput_window, and the windows with fewer than
+	// min_events_per_window
+	LastWindowEventCount int64 `json:"last_window_event_count,omitempty"`
+	LowThroughputCount   int64 `json:"low_throughput_count,omitempty"`
+
+	// events framed with frame_compression that were sent compressed, and the bytes it saved
+	CompressedEventCount  int64 `json:"compressed_event_count,omitempty"`
+	CompressionSavedBytes int64 `json:"compression_saved_bytes,omitempty"`
+}
+
+func (s NetStatistics) Sent() int64       { return s.SentEventCount }
+func (s NetStatistics) Dropped() int64    { return s.DroppedEventCount }
+func (s NetStatistics) Reconnects() int64 { return s.ReconnectCount }
+
+// the protocols of connection strings, as named by net.Dial
+var netProtocols = map[string]bool{"tcp": true, "tcp4": true, "tcp6": true, "udp": true, "udp4": true, "udp6": true}
+
+// ParseNetConnection splits a connection string into its protocol and the host:port address to
+// dial, so that malformed strings are refused rather than dialed. IPv6 addresses go in brackets,
+// along with the zone of link-local ones, for example tcp:[fe80::1%eth0]:514: without them there
+// is no telling where the address ends and the port starts. Ports are numbers, and srv:(name)
+// addresses are returned as they are.
+func ParseNetConnection(netConn string) (string, string, error) {
+	connSpecification := strings.SplitN(netConn, ":", 2)
+	if len(connSpecification) != 2 || len(connSpecification[0]) == 0 {
+		return "", "", fmt.Errorf("Invalid connection string '%s': expected (protocol):(host):(port)", netConn)
+	}
+	protocol, address := connSpecification[0], connSpecification[1]
+	if !netProtocols[protocol] {
+		return "", "", fmt.Errorf("Invalid connection string '%s': unsupported protocol %s (tcp or udp)", netConn, protocol)
+	}
+	if strings.HasPrefix(address, srvDestinationPrefix) {
+		if len(strings.TrimPrefix(address, srvDestinationPrefix)) == 0 {
+			return "", "", fmt.Errorf("Invalid connection string '%s': missing SRV name", netConn)
+		}
+		return protocol, address, nil
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil && !strings.HasPrefix(address, "[") && strings.Count(address, ":") > 1 {
+		err = fmt.Errorf("IPv6 addresses must be enclosed in brackets, as in [2001:db8::1]:514")
+	}
+	if err == nil && (len(host) == 0 || len(port) == 0) {
+		err = fmt.Errorf("missing host or port")
+	}
+	if err == nil {
+		if number, convErr := strconv.Atoi(port); convErr != nil || number < 1 || number > 65535 {
+			err = fmt.Errorf("invalid port %s", port)
+		}
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid connection string '%s': %s", netConn, err)
+	}
+	return protocol, net.JoinHostPort(host, port), nil
+}
+
+// stripZone removes the zone of a scoped IPv6 address, fe80::1%eth0, which is meaningless beyond
+// the local host: certificates can't name it.
+func stripZone(host string) string {
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		return host[:i]
+	}
+	return host
 }
 
 // Initialize() expects a connection string in the following format:
 // (protocol):(hostname/IP):(port)
-// for example: tcp:destination.server.example.com:512
+// for example: tcp:destination.server.example.com:512 or tcp:[fe80::1%eth0]:514
+// or (protocol):srv:(name) to connect to the targets advertised by the SRV records of name, for
+// example: tcp:srv:_collector._tcp.example.com
+// tcp connections go through the HTTP proxy at Config.HTTPProxyURL when it is set, with the
+// CONNECT request answered before TLS starts or any data is sent.
 func (o *NetOutput) Initialize(netConn string) error {
 	o.Lock()
 	defer o.Unlock()
 
 	if o.connected {
-		o.outputSocket.Close()
+		o.closeSocket()
+		o.connected = false
 	}
 
 	o.netConn = netConn
+	o.readerDone = nil
 
-	connSpecification := strings.SplitN(netConn, ":", 2)
-
-	o.protocolName = connSpecification[0]
-	o.remoteHostname = connSpecification[1]
+	protocol, address, err := ParseNetConnection(netConn)
+	if err != nil {
+		return err
+	}
+	o.protocolName = protocol
+	o.remoteHostname = address
 
-	if strings.HasPrefix(o.protocolName, "tcp") {
+	// msgpack events are already framed by their length, and so are events with frame_compression
+	framed := o.Config.FrameCompression != "" && o.Config.FrameCompression != NoFrameCompression
+	if strings.HasPrefix(o.protocolName, "tcp") && framed && o.framer == nil {
+		framer, err := NewCompressedFramer(o.Config.FrameCompression, o.Config.FrameCompressionThreshold, o.Config.CompressionLevel)
+		if err != nil {
+			return err
+		}
+		o.framer = framer
+	}
+	if strings.HasPrefix(o.protocolName, "tcp") && o.Config.OutputFormat != MsgPackOutputFormat && !framed {
 		o.addNewline = true
 	}
 
-	var err error
-	o.outputSocket, err = net.Dial(o.protocolName, o.remoteHostname)
+	destinations := []string{o.remoteHostname}
+	if strings.HasPrefix(o.remoteHostname, srvDestinationPrefix) {
+		name := strings.TrimPrefix(o.remoteHostname, srvDestinationPrefix)
+		if o.srv == nil || o.srv.name != name {
+			o.srv = newSRVDestinations(name, o.Config.SRVResolver, o.Config.SRVRefreshInterval)
+		}
+		if destinations, err = o.srv.destinations(); err != nil {
+			return fmt.Errorf("Error connecting to '%s': %s", netConn, err)
+		}
+	} else {
+		o.srv = nil
+	}
 
+	// the targets of SRV records are tried in order until one of them takes the connection
+	for i, destination := range destinations {
+		if err = o.connect(destination); err == nil {
+			break
+		}
+		if i < len(destinations)-1 {
+			log.Warnf("%s, trying the next target of %s", err, o.remoteHostname)
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("Error connecting to '%s': %s", netConn, err)
+		return err
+	}
+
+	if o.heartbeatEnabled() {
+		o.readHeartbeats()
+	} else if tlsConn, ok := o.outputSocket.(*tls.Conn); ok && o.Config.TLSConfig.ClientSessionCache != nil {
+		// TLS 1.3 servers send session tickets after the handshake, and these are only
+		// processed while reading from the connection
+		readerDone := make(chan struct{})
+		o.readerDone = readerDone
+		go func() {
+			defer close(readerDone)
+			io.Copy(ioutil.Discard, tlsConn)
+		}()
 	}
 
 	o.markConnected()
@@ -78,10 +336,297 @@ func (o *NetOutput) Initialize(netConn string) error {
 	return nil
 }
 
+// connect opens the connection to destination, a host:port address, and authenticates with the
+// collector when configured.
+func (o *NetOutput) connect(destination string) error {
+	o.destination = destination
+	o.tlsVersion, o.tlsCipherSuite, o.tlsHandshakeDuration = "", "", 0
+
+	dialer := net.Dialer{}
+
+	address := destination
+	tlsConfig := o.Config.TLSConfig
+	if len(o.Config.DestinationAllowCIDRs) > 0 {
+		var host string
+		var err error
+		host, address, err = o.allowedAddress()
+		if err != nil {
+			return fmt.Errorf("Error connecting to '%s': %s", o.describeDestination(), err)
+		}
+		// dialing the checked address directly means the certificate has to be verified
+		// against the original hostname
+		if tlsConfig != nil && len(tlsConfig.ServerName) == 0 {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName = stripZone(host)
+		}
+	}
+
+	var err error
+	if strings.HasPrefix(o.protocolName, "tcp") && o.tunnel != nil {
+		o.outputSocket, err = o.dialThroughTunnel(address, tlsConfig)
+	} else if strings.HasPrefix(o.protocolName, "tcp") && o.Config.HTTPProxyURL != nil {
+		o.outputSocket, err = o.dialThroughProxy(dialer, address, tlsConfig)
+	} else if strings.HasPrefix(o.protocolName, "tcp") && o.Config.TCPUseTLS {
+		var conn net.Conn
+		conn, err = hostConnections.Dial(dialer, o.protocolName, address)
+		if err == nil {
+			o.setNoDelay(conn)
+			o.outputSocket, err = o.startTLS(conn, tlsConfig)
+		}
+	} else if strings.HasPrefix(o.protocolName, "tcp") {
+		o.outputSocket, err = hostConnections.Dial(dialer, o.protocolName, address)
+		if err == nil {
+			o.setNoDelay(o.outputSocket)
+		}
+	} else {
+		o.outputSocket, err = dialer.Dial(o.protocolName, address)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Error connecting to '%s': %s", o.describeDestination(), err)
+	}
+
+	if len(o.Config.HandshakePSKFile) > 0 && strings.HasPrefix(o.protocolName, "tcp") {
+		if err := o.handshake(); err != nil {
+			o.outputSocket.Close()
+			atomic.AddInt64(&o.handshakeFailureCount, 1)
+			return fmt.Errorf("Handshake with '%s' failed: %s", o.describeDestination(), err)
+		}
+	}
+	return nil
+}
+
+// describeDestination names the destination in errors: the connection string, along with the
+// target being connected to when it was found in SRV records.
+func (o *NetOutput) describeDestination() string {
+	if o.srv == nil {
+		return o.netConn
+	}
+	return fmt.Sprintf("%s (%s)", o.netConn, o.destination)
+}
+
+// setNoDelay applies tcp_nodelay to a tcp connection, dialed directly or to the HTTP proxy. Go
+// disables Nagle's algorithm on every tcp connection, so only turning it back on changes anything.
+// Connections through an SSH tunnel have no socket of their own to set it on.
+func (o *NetOutput) setNoDelay(conn net.Conn) {
+	if limited, ok := conn.(*limitedConn); ok {
+		conn = limited.Conn
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tcpConn.SetNoDelay(o.Config.TCPNoDelay); err != nil {
+		// not fatal: the connection works all the same
+		log.Warnf("Could not set TCP_NODELAY on the connection to %s: %s", o.destination, err)
+	}
+}
+
+// dialThroughTunnel connects to the collector from the SSH server, with TLS on top when
+// configured. The SSH connection is opened again if it has dropped since the last connection.
+func (o *NetOutput) dialThroughTunnel(address string, tlsConfig *tls.Config) (net.Conn, error) {
+	conn, err := o.tunnel.dial(o.protocolName, address)
+	if err != nil || !o.Config.TCPUseTLS {
+		return conn, err
+	}
+	return o.startTLS(conn, tlsConfig)
+}
+
+// dialThroughProxy connects to the collector through the HTTP proxy, with TLS on top when
+// configured. TLS is negotiated with the collector itself, the proxy only relays it.
+func (o *NetOutput) dialThroughProxy(dialer net.Dialer, address string, tlsConfig *tls.Config) (net.Conn, error) {
+	conn, err := dialHTTPConnect(dialer, o.Config.HTTPProxyURL, address)
+	if err == nil {
+		o.setNoDelay(conn)
+	}
+	if err != nil || !o.Config.TCPUseTLS {
+		return conn, err
+	}
+	return o.startTLS(conn, tlsConfig)
+}
+
+// startTLS starts TLS on a connection to the collector, first asking it to with the starttls
+// command when one is configured. The connection is closed if either step fails.
+func (o *NetOutput) startTLS(conn net.Conn, tlsConfig *tls.Config) (*tls.Conn, error) {
+	if len(o.Config.StartTLSCommand) > 0 {
+		if err := o.requestTLS(conn); err != nil {
+			conn.Close()
+			atomic.AddInt64(&o.startTLSFailureCount, 1)
+			return nil, fmt.Errorf("starttls refused: %s", err)
+		}
+	}
+	tlsConn, err := o.tlsHandshake(conn, tlsConfig)
+	if err != nil && len(o.Config.StartTLSCommand) > 0 {
+		atomic.AddInt64(&o.startTLSFailureCount, 1)
+	}
+	return tlsConn, err
+}
+
+// requestTLS sends the starttls command in plaintext and waits for the collector to agree.
+// Nothing after its reply is read, since the TLS handshake follows right away.
+func (o *NetOutput) requestTLS(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(o.Config.StartTLSTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write([]byte(o.Config.StartTLSCommand + "\r\n")); err != nil {
+		return err
+	}
+	reply, err := readLine(conn, maxHandshakeReplyLength)
+	if err != nil {
+		return fmt.Errorf("no reply received: %s", err)
+	}
+	if !strings.HasPrefix(reply, o.Config.StartTLSReply) {
+		return fmt.Errorf("the collector answered %q", reply)
+	}
+	return nil
+}
+
+// tlsHandshake starts TLS on a connection to the collector, recording how long the handshake
+// took and what it negotiated. The connection is closed if the handshake fails.
+func (o *NetOutput) tlsHandshake(conn net.Conn, tlsConfig *tls.Config) (*tls.Conn, error) {
+	// the connection was dialed separately, so the name to verify has to be set explicitly
+	if tlsConfig == nil || len(tlsConfig.ServerName) == 0 {
+		host, _, err := net.SplitHostPort(o.destination)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		} else {
+			tlsConfig = tlsConfig.Clone()
+		}
+		tlsConfig.ServerName = stripZone(host)
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	start := time.Now()
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	o.tlsHandshakeDuration = time.Since(start)
+
+	state := tlsConn.ConnectionState()
+	o.tlsHandshakeCount++
+	if state.DidResume {
+		o.tlsResumedCount++
+	}
+	o.tlsVersion = tlsVersionName(state.Version)
+	o.tlsCipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	return tlsConn, nil
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
+
+// handshake authenticates with the collector by sending the pre-shared key, read again on every
+// connection since it may have been rotated. When an acknowledgement is configured, the
+// collector has to answer with it before any event is sent.
+func (o *NetOutput) handshake() error {
+	psk, err := ioutil.ReadFile(o.Config.HandshakePSKFile)
+	if err != nil {
+		return fmt.Errorf("could not read the pre-shared key: %s", err)
+	}
+
+	line := strings.Replace(o.Config.HandshakeFormat, "{psk}", strings.TrimSpace(string(psk)), -1) + "\r\n"
+	o.outputSocket.SetDeadline(time.Now().Add(o.Config.HandshakeTimeout))
+	defer o.outputSocket.SetDeadline(time.Time{})
+
+	if _, err := o.outputSocket.Write([]byte(line)); err != nil {
+		return err
+	}
+
+	if len(o.Config.HandshakeAck) == 0 {
+		return nil
+	}
+
+	reply, err := readLine(o.outputSocket, maxHandshakeReplyLength)
+	if err != nil {
+		return fmt.Errorf("no acknowledgement received: %s", err)
+	}
+	if reply != o.Config.HandshakeAck {
+		return fmt.Errorf("rejected by the collector: %q", reply)
+	}
+	return nil
+}
+
+// longest handshake reply accepted from a collector
+const maxHandshakeReplyLength = 1024
+
+// readLine reads a single line, one byte at a time so that nothing after it is consumed.
+func readLine(r io.Reader, maxLength int) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < maxLength {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", fmt.Errorf("line longer than %d bytes", maxLength)
+}
+
+// allowedAddress resolves the remote host and returns the first of its addresses that falls
+// within DestinationAllowCIDRs, so that a hijacked DNS record cannot redirect the event stream.
+func (o *NetOutput) allowedAddress() (string, string, error) {
+	host, port, err := net.SplitHostPort(o.destination)
+	if err != nil {
+		return "", "", err
+	}
+
+	// the zone of scoped addresses is kept, the address being unreachable without it
+	addrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, addr := range addrs {
+		for _, allowed := range o.Config.DestinationAllowCIDRs {
+			if allowed.Contains(addr.IP) {
+				return host, net.JoinHostPort(addr.String(), port), nil
+			}
+		}
+		log.Errorf("Rejecting destination %s: resolved address %s is not in the allowed ranges", host, addr.IP)
+	}
+
+	return "", "", fmt.Errorf("no address of %s is in the allowed destination ranges", host)
+}
+
 func (o *NetOutput) markConnected() {
 	o.connectTime = time.Now()
+	o.lastWriteTime = o.connectTime
+	o.connectionEventCount = 0
 	log.Infof("Connected to %s at %s.", o.netConn, o.connectTime)
 	o.connected = true
+	if lifetime := o.Config.MaxConnectionLifetime; lifetime > 0 {
+		// up to 10% jitter so that forwarders started together don't all rotate at once
+		jitter := time.Duration(rand.Int63n(int64(lifetime)/10 + 1))
+		o.rotateTime = o.connectTime.Add(lifetime + jitter)
+	}
+	o.connectBytesSent = atomic.LoadInt64(&o.bytesSent)
+	o.rekeyTime = time.Time{}
+	if _, ok := o.outputSocket.(*tls.Conn); ok && o.Config.TLSRekeyInterval > 0 {
+		o.rekeyTime = o.connectTime.Add(o.Config.TLSRekeyInterval)
+	}
+	if o.heartbeatEnabled() {
+		o.pingSent = time.Time{}
+		o.scheduleHeartbeat(o.Config.HeartbeatInterval)
+	}
 	if o.droppedEventCount != o.droppedEventSinceConnection {
 		log.Infof("Dropped %d events since the last reconnection.",
 			o.droppedEventCount-o.droppedEventSinceConnection)
@@ -89,6 +634,135 @@ func (o *NetOutput) markConnected() {
 	}
 }
 
+// closeSocket closes the connection, ending the stream with the disconnect footer and a
+// half-close first when configured so that the collector knows every event has been sent. Must
+// be called with the lock held. Broken connections are closed directly instead.
+func (o *NetOutput) closeSocket() {
+	if o.Config.DisconnectFooter != nil && strings.HasPrefix(o.protocolName, "tcp") {
+		o.writeDisconnectFooter()
+	}
+	if o.Config.TCPHalfClose && strings.HasPrefix(o.protocolName, "tcp") {
+		o.halfClose()
+	}
+	o.outputSocket.Close()
+}
+
+// longest wait for a collector to accept the disconnect footer
+const disconnectFooterTimeout = 5 * time.Second
+
+// writeDisconnectFooter tells the collector that the connection is about to be closed. The
+// footer is not an event, and is not counted as one.
+func (o *NetOutput) writeDisconnectFooter() {
+	var footer strings.Builder
+	data := DisconnectFooterData{EventCount: o.connectionEventCount, ConnectedAt: o.connectTime}
+	if err := o.Config.DisconnectFooter.Execute(&footer, data); err != nil {
+		log.Warnf("Could not execute the disconnect footer for %s: %s", o.netConn, err)
+		return
+	}
+	if o.addNewline {
+		footer.WriteString("\r\n")
+	}
+
+	o.outputSocket.SetWriteDeadline(time.Now().Add(disconnectFooterTimeout))
+	n, err := io.WriteString(o.outputSocket, footer.String())
+	atomic.AddInt64(&o.bytesSent, int64(n))
+	if err != nil {
+		log.Warnf("Could not send the disconnect footer to %s: %s", o.netConn, err)
+	}
+}
+
+// sendRotationNotice tells the collector that the connection is about to be replaced on purpose,
+// and gives it RotationNoticeGrace to finalize, or until it closes the connection first. Events
+// wait meanwhile. Connections that failed are never noticed.
+func (o *NetOutput) sendRotationNotice() {
+	if len(o.Config.RotationNotice) == 0 || !o.connected || !strings.HasPrefix(o.protocolName, "tcp") {
+		return
+	}
+
+	notice := o.Config.RotationNotice
+	if o.addNewline {
+		notice += "\r\n"
+	}
+	o.outputSocket.SetWriteDeadline(time.Now().Add(disconnectFooterTimeout))
+	n, err := io.WriteString(o.outputSocket, notice)
+	o.outputSocket.SetWriteDeadline(time.Time{})
+	atomic.AddInt64(&o.bytesSent, int64(n))
+	if err != nil {
+		log.Warnf("Could not send the rotation notice to %s: %s", o.netConn, err)
+		return
+	}
+	atomic.AddInt64(&o.rotationNoticeCount, 1)
+
+	grace := o.Config.RotationNoticeGrace
+	if grace <= 0 {
+		return
+	}
+	if o.readerDone != nil {
+		select {
+		case <-o.readerDone:
+		case <-time.After(grace):
+		}
+		return
+	}
+	o.outputSocket.SetReadDeadline(time.Now().Add(grace))
+	io.Copy(ioutil.Discard, o.outputSocket)
+	o.outputSocket.SetReadDeadline(time.Time{})
+}
+
+// halfClose shuts down the sending side of the connection and waits for the collector to close
+// its side, for up to TCPHalfCloseTimeout.
+func (o *NetOutput) halfClose() {
+	// implemented by both *net.TCPConn and *tls.Conn, which sends a close_notify first
+	conn, ok := o.outputSocket.(interface{ CloseWrite() error })
+	if !ok {
+		return
+	}
+	if err := conn.CloseWrite(); err != nil {
+		log.Warnf("Could not half-close the connection to %s: %s", o.netConn, err)
+		return
+	}
+
+	timeout := o.Config.TCPHalfCloseTimeout
+	if timeout <= 0 {
+		return
+	}
+
+	if o.readerDone != nil {
+		select {
+		case <-o.readerDone:
+		case <-time.After(timeout):
+			log.Warnf("%s did not close the connection within %s", o.netConn, timeout)
+		}
+		return
+	}
+
+	o.outputSocket.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := io.Copy(ioutil.Discard, o.outputSocket); err != nil {
+		log.Warnf("%s did not close the connection within %s: %s", o.netConn, timeout, err)
+	}
+}
+
+// close is called on shutdown.
+func (o *NetOutput) close() {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.connected {
+		o.closeSocket()
+		o.connected = false
+	}
+	if o.tunnel != nil {
+		o.tunnel.close()
+	}
+}
+
+// shortest wait before reconnecting
+const reconnectInterval = 5 * time.Second
+
+// closeAndScheduleReconnection closes a failed connection, or handles a failed attempt to
+// connect. The wait before the next attempt doubles after every failure, up to
+// ReconnectBackoffMax, and starts over once a connection stays up for MinHealthyConnection.
+// A connection dropped sooner is counted as flapping, and keeps backing off.
 func (o *NetOutput) closeAndScheduleReconnection() {
 	o.Lock()
 	defer o.Unlock()
@@ -96,14 +770,124 @@ func (o *NetOutput) closeAndScheduleReconnection() {
 	if o.connected {
 		o.outputSocket.Close()
 		o.connected = false
+
+		if lasted := time.Since(o.connectTime); lasted >= o.Config.MinHealthyConnection {
+			o.reconnectBackoff = 0
+		} else {
+			atomic.AddInt64(&o.flappingReconnectCount, 1)
+			log.Warnf("Connection to %s dropped after %s, before min_healthy_connection (%s)",
+				o.netConn, lasted.Round(time.Millisecond), o.Config.MinHealthyConnection)
+		}
 	}
 
-	// try reconnecting in 5 seconds
-	o.reconnectTime = time.Now().Add(time.Duration(5 * time.Second))
+	switch {
+	case o.reconnectBackoff == 0:
+		o.reconnectBackoff = reconnectInterval
+	case o.reconnectBackoff < o.Config.ReconnectBackoffMax:
+		o.reconnectBackoff *= 2
+		if o.reconnectBackoff > o.Config.ReconnectBackoffMax {
+			o.reconnectBackoff = o.Config.ReconnectBackoffMax
+		}
+	}
+	o.reconnectTime = time.Now().Add(o.reconnectBackoff)
 
 	log.Infof("Lost connection to %s. Will try to reconnect at %s.", o.netConn, o.reconnectTime)
 }
 
+// markHealthy starts the reconnection backoff over once the connection has stayed up for
+// MinHealthyConnection.
+func (o *NetOutput) markHealthy() {
+	o.Lock()
+	defer o.Unlock()
+
+	o.reconnectBackoff = 0
+}
+
+// rotateConnection replaces a healthy connection that has reached its maximum lifetime, giving
+// load balancers in front of the collectors a chance to pick another backend.
+func (o *NetOutput) rotateConnection() {
+	o.replaceConnection(func() {
+		log.Infof("Rotating connection to %s after %s", o.netConn, time.Since(o.connectTime))
+		atomic.AddInt64(&o.rotationCount, 1)
+	})
+}
+
+// rekeyDue tells if the TLS connection has been open for TLSRekeyInterval or has sent
+// TLSRekeyBytes since it was opened.
+func (o *NetOutput) rekeyDue() bool {
+	if !o.connected {
+		return false
+	}
+	if !o.rekeyTime.IsZero() && time.Now().After(o.rekeyTime) {
+		return true
+	}
+	if _, ok := o.outputSocket.(*tls.Conn); !ok || o.Config.TLSRekeyBytes <= 0 {
+		return false
+	}
+	return atomic.LoadInt64(&o.bytesSent)-o.connectBytesSent >= o.Config.TLSRekeyBytes
+}
+
+// rekeyConnection replaces a TLS connection to renew its keys. crypto/tls can't start a TLS 1.3
+// key update, so a new connection, with a handshake of its own, is the only way to get them.
+func (o *NetOutput) rekeyConnection() {
+	o.replaceConnection(func() {
+		log.Infof("Renewing the TLS keys of the connection to %s after %s and %d bytes", o.netConn,
+			time.Since(o.connectTime), atomic.LoadInt64(&o.bytesSent)-o.connectBytesSent)
+		atomic.AddInt64(&o.tlsRekeyCount, 1)
+	})
+}
+
+// leaveSRVTarget replaces the connection to a target that is no longer advertised by the SRV
+// records, or that has been outranked by a target of a better priority.
+func (o *NetOutput) leaveSRVTarget() {
+	o.replaceConnection(func() {
+		log.Infof("Leaving %s, no longer the preferred target of %s", o.destination, o.remoteHostname)
+		atomic.AddInt64(&o.srvSwitchCount, 1)
+	})
+}
+
+// replaceConnection closes a healthy connection and opens a new one, calling record in between.
+// Events are written synchronously from the same goroutine, so once the batch is flushed nothing
+// is pending on the old connection when it closes, and the rotation notice comes after them.
+func (o *NetOutput) replaceConnection(record func()) {
+	if err := o.flushBatch(); err != nil {
+		o.errorLog.Errorf("%s", err)
+	}
+	record()
+	o.sendRotationNotice()
+
+	if err := o.Initialize(o.netConn); err != nil {
+		o.errorLog.Errorf("%s", err)
+		o.closeAndScheduleReconnection()
+	}
+}
+
+// closeIdleConnection closes a connection that has not been written to for IdleTimeout. It is
+// only opened again when the next event arrives, so nothing is scheduled or logged as an error.
+func (o *NetOutput) closeIdleConnection() {
+	o.Lock()
+	defer o.Unlock()
+
+	log.Infof("Closing connection to %s after %s without events", o.netConn, time.Since(o.lastWriteTime))
+	o.closeSocket()
+	o.connected = false
+	o.idle = true
+	atomic.AddInt64(&o.idleCloseCount, 1)
+}
+
+// reopenIdleConnection connects again for an event arriving after the connection was closed for
+// being idle. Failing to connect is then handled like a lost connection.
+func (o *NetOutput) reopenIdleConnection() {
+	o.Lock()
+	o.idle = false
+	o.Unlock()
+
+	if err := o.Initialize(o.netConn); err != nil {
+		o.errorLog.Errorf("%s", err)
+		o.closeAndScheduleReconnection()
+	}
+}
+
 func (o *NetOutput) Key() string {
 	o.RLock()
 	defer o.RUnlock()
@@ -122,18 +906,86 @@ func (o *NetOutput) Statistics() interface{} {
 	o.RLock()
 	defer o.RUnlock()
 
-	return NetStatistics{
+	var resumptionRate float64
+	if o.tlsHandshakeCount > 0 {
+		resumptionRate = float64(o.tlsResumedCount) / float64(o.tlsHandshakeCount)
+	}
+
+	stats := NetStatistics{
 		LastOpenTime:      o.connectTime,
 		Protocol:          o.protocolName,
 		RemoteHostname:    o.remoteHostname,
-		DroppedEventCount: o.droppedEventCount,
+		DroppedEventCount: atomic.LoadInt64(&o.droppedEventCount),
+		SentEventCount:    atomic.LoadInt64(&o.sentEventCount),
+		BytesSent:         atomic.LoadInt64(&o.bytesSent),
+		ReconnectCount:    atomic.LoadInt64(&o.reconnectCount),
+		RotationCount:     atomic.LoadInt64(&o.rotationCount),
 		Connected:         o.connected,
+
+		FlappingReconnectCount:  atomic.LoadInt64(&o.flappingReconnectCount),
+		ReconnectBackoffSeconds: o.reconnectBackoff.Seconds(),
+
+		Idle:           o.idle,
+		IdleCloseCount: atomic.LoadInt64(&o.idleCloseCount),
+
+		Backpressured:      atomic.LoadInt32(&o.backpressured) == 1,
+		BackpressureEvents: atomic.LoadInt64(&o.backpressureEvents),
+
+		TLSHandshakeCount: o.tlsHandshakeCount,
+		TLSResumedCount:   o.tlsResumedCount,
+		TLSResumptionRate: resumptionRate,
+
+		TLSVersion:          o.tlsVersion,
+		TLSCipherSuite:      o.tlsCipherSuite,
+		TLSHandshakeSeconds: o.tlsHandshakeDuration.Seconds(),
+
+		TLSRekeyCount: atomic.LoadInt64(&o.tlsRekeyCount),
+
+		DeliveryLatency: o.latency.Statistics(),
+
+		ChunkedEventCount:    atomic.LoadInt64(&o.chunkedEventCount),
+		ChunkCount:           atomic.LoadInt64(&o.chunkCount),
+		OversizeDroppedCount: atomic.LoadInt64(&o.oversizeDroppedCount),
+
+		HandshakeFailureCount: atomic.LoadInt64(&o.handshakeFailureCount),
+
+		StartTLSFailureCount: atomic.LoadInt64(&o.startTLSFailureCount),
+
+		BatchCount: atomic.LoadInt64(&o.batchCount),
+
+		ReplayedEventCount: atomic.LoadInt64(&o.replayedEventCount),
+
+		HeartbeatCount:                atomic.LoadInt64(&o.heartbeatCount),
+		MissedHeartbeatReconnectCount: atomic.LoadInt64(&o.missedHeartbeatCount),
+
+		RotationNoticeCount: atomic.LoadInt64(&o.rotationNoticeCount),
+
+		LastWindowEventCount: atomic.LoadInt64(&o.lastWindowEventCount),
+		LowThroughputCount:   atomic.LoadInt64(&o.lowThroughputCount),
+	}
+	if o.framer != nil {
+		stats.CompressedEventCount = o.framer.CompressedCount()
+		stats.CompressionSavedBytes = o.framer.SavedBytes()
+	}
+	if o.tunnel != nil {
+		stats.SSHTunnelConnectCount = o.tunnel.connectCount
+	}
+	if o.srv != nil {
+		stats.Destination = o.destination
+		stats.SRVTargets, stats.SRVLookupErrors = o.srv.statistics()
+		stats.SRVSwitchCount = atomic.LoadInt64(&o.srvSwitchCount)
 	}
+	return stats
 }
 
 func (o *NetOutput) output(m string) error {
+	var newline string
 	if o.addNewline {
-		m += "\r\n"
+		newline = "\r\n"
+	}
+
+	if o.idle {
+		o.reopenIdleConnection()
 	}
 
 	if !o.connected {
@@ -142,11 +994,326 @@ func (o *NetOutput) output(m string) error {
 		return nil
 	}
 
-	_, err := o.outputSocket.Write([]byte(m))
-	if err != nil {
-		o.closeAndScheduleReconnection()
+	if o.framer != nil {
+		framed, err := o.framer.Frame([]byte(m))
+		if err != nil {
+			atomic.AddInt64(&o.droppedEventCount, 1)
+			return fmt.Errorf("Could not frame event: %s", err)
+		}
+		m = string(framed)
+	}
+
+	if maxSize := o.Config.MaxMessageSize; maxSize > 0 && len(m)+len(newline) > maxSize {
+		if err := o.flushBatch(); err != nil {
+			o.errorLog.Errorf("%s", err)
+		}
+		if o.Config.OversizePolicy != ChunkOversize {
+			atomic.AddInt64(&o.droppedEventCount, 1)
+			atomic.AddInt64(&o.oversizeDroppedCount, 1)
+			return fmt.Errorf("Dropped event of %d bytes, larger than max_message_size (%d)", len(m), maxSize)
+		}
+		o.lastChunkedEventID++
+		if err := o.sendChunks(splitIntoChunks(m, o.lastChunkedEventID, maxSize, newline)); err != nil {
+			return err
+		}
+		o.latency.delivered()
+		return nil
+	}
+
+	if o.batching() {
+		return o.addToBatch(m, newline)
+	}
+
+	if err := o.write(m+newline, 1); err != nil {
+		return err
+	}
+	o.recordSent(m)
+	atomic.AddInt64(&o.sentEventCount, 1)
+	o.connectionEventCount++
+	o.latency.delivered()
+	return nil
+}
+
+// Verify sends a single event and closes the connection, half-closing it first when configured.
+func (o *NetOutput) Verify(message string) error {
+	sent := atomic.LoadInt64(&o.sentEventCount)
+	if err := o.output(message); err != nil {
+		return err
+	}
+	if err := o.flushBatch(); err != nil {
+		return err
+	}
+	if atomic.LoadInt64(&o.sentEventCount) == sent {
+		return fmt.Errorf("Not connected to %s", o.netConn)
+	}
+	o.close()
+	return nil
+}
+
+func (o *NetOutput) DeliveryLatency() *DeliveryLatency {
+	return o.latency
+}
+
+// errBackpressureDrop is returned when an event is dropped because the collector has not
+// accepted any data for longer than BackpressureMaxDuration, and overflow_policy is drop.
+var errBackpressureDrop = errors.New("Dropped event, the collector has not accepted data for longer than backpressure_max_duration")
+
+// write sends m over the connection. When BackpressureWriteTimeout is set, a write that doesn't
+// complete in time means that the collector is not keeping up: rather than treating it as a
+// failure, the rest of m is written again every BackpressurePause. Once the collector has not
+// accepted data for BackpressureMaxDuration, the events in m are dropped if overflow_policy is
+// drop, or writes keep being retried if it is block.
+func (o *NetOutput) write(m string, events int64) error {
+	data := []byte(m)
+	for {
+		// connections through an SSH tunnel don't support deadlines, and block instead
+		deadline := o.Config.BackpressureWriteTimeout > 0 &&
+			o.outputSocket.SetWriteDeadline(time.Now().Add(o.Config.BackpressureWriteTimeout)) == nil
+		if !deadline && strings.HasPrefix(o.protocolName, "udp") && o.Config.UDPSendTimeout > 0 {
+			// the runtime poller never blocks in write(2), so SO_SNDTIMEO would have no effect
+			o.outputSocket.SetWriteDeadline(time.Now().Add(o.Config.UDPSendTimeout))
+		}
+
+		n, err := o.outputSocket.Write(data)
+		atomic.AddInt64(&o.bytesSent, int64(n))
+		data = data[n:]
+		if n > 0 {
+			o.lastWriteTime = time.Now()
+		}
+		if err == nil {
+			o.endBackpressure()
+			return nil
+		}
+		if netErr, ok := err.(net.Error); !deadline || !ok || !netErr.Timeout() {
+			o.endBackpressure()
+			o.closeAndScheduleReconnection()
+			return err
+		}
+
+		if o.backpressureStart.IsZero() {
+			o.backpressureStart = time.Now()
+			atomic.StoreInt32(&o.backpressured, 1)
+			atomic.AddInt64(&o.backpressureEvents, 1)
+			o.errorLog.Errorf("%s is not accepting data, pausing", o.netConn)
+		}
+
+		if time.Since(o.backpressureStart) >= o.Config.BackpressureMaxDuration && o.Config.OverflowPolicy.Drops() {
+			atomic.AddInt64(&o.droppedEventCount, events)
+			if len(data) < len(m) {
+				// the collector has part of the event, only a new connection keeps the stream parseable
+				o.endBackpressure()
+				o.closeAndScheduleReconnection()
+				return fmt.Errorf("%s, reconnecting after sending it partially", errBackpressureDrop)
+			}
+			return errBackpressureDrop
+		}
+		time.Sleep(o.Config.BackpressurePause)
+	}
+}
+
+func (o *NetOutput) endBackpressure() {
+	if o.backpressureStart.IsZero() {
+		return
+	}
+	log.Infof("%s is accepting data again after %s", o.netConn, time.Since(o.backpressureStart))
+	o.backpressureStart = time.Time{}
+	atomic.StoreInt32(&o.backpressured, 0)
+}
+
+// sendChunks sends every chunk of an event. If the connection fails part way through, the
+// whole sequence is sent again on the next connection, so the collector never has to stitch
+// together chunks sent over different connections.
+func (o *NetOutput) sendChunks(chunks []string) error {
+	for _, chunk := range chunks {
+		if err := o.write(chunk, 1); err != nil {
+			if err != errBackpressureDrop {
+				o.pendingChunks = chunks
+			}
+			return err
+		}
+		atomic.AddInt64(&o.chunkCount, 1)
+	}
+	atomic.AddInt64(&o.chunkedEventCount, 1)
+	atomic.AddInt64(&o.sentEventCount, 1)
+	o.connectionEventCount++
+	return nil
+}
+
+// recordSent keeps an event written whole for replaying it after a reconnection. Chunked events
+// are not replayed.
+func (o *NetOutput) recordSent(m string) {
+	if o.replay != nil {
+		o.replay.add(m)
+	}
+}
+
+// replayRecent sends again the last events written before the connection was lost, in case the
+// collector lost them along with the connection. Each starts with replayHeader, and replays are
+// not recorded again. Replays that no longer fit in MaxMessageSize are skipped.
+func (o *NetOutput) replayRecent() error {
+	if o.replay == nil {
+		return nil
+	}
+	var newline string
+	if o.addNewline {
+		newline = "\r\n"
+	}
+
+	events := o.replay.recent()
+	if len(events) > 0 {
+		log.Infof("Replaying the last %d events sent to %s before the connection was lost", len(events), o.netConn)
+	}
+	for _, m := range events {
+		replay := replayHeader + m + newline
+		if maxSize := o.Config.MaxMessageSize; maxSize > 0 && len(replay) > maxSize {
+			continue
+		}
+		if err := o.write(replay, 0); err != nil {
+			return err
+		}
+		atomic.AddInt64(&o.replayedEventCount, 1)
+	}
+	return nil
+}
+
+func (o *NetOutput) resendPendingChunks() error {
+	chunks := o.pendingChunks
+	if chunks == nil {
+		return nil
+	}
+	o.pendingChunks = nil
+	log.Infof("Sending again the %d chunks of an event interrupted by the reconnection to %s", len(chunks), o.netConn)
+	return o.sendChunks(chunks)
+}
+
+// splitIntoChunks splits an event into chunks of at most maxSize bytes, newline included. Each
+// chunk starts with the header "CBCHUNK <event id> <index>/<total> ", with indexes starting at 1.
+func splitIntoChunks(m string, id uint64, maxSize int, newline string) []string {
+	// the header grows with the number of chunks, which depends on the room left by the header
+	total := 1
+	var dataSize int
+	for {
+		header := fmt.Sprintf("CBCHUNK %d %d/%d ", id, total, total)
+		dataSize = maxSize - len(header) - len(newline)
+		needed := (len(m) + dataSize - 1) / dataSize
+		if needed <= total {
+			break
+		}
+		total = needed
+	}
+	total = (len(m) + dataSize - 1) / dataSize
+
+	chunks := make([]string, 0, total)
+	for i := 0; i < total; i++ {
+		end := (i + 1) * dataSize
+		if end > len(m) {
+			end = len(m)
+		}
+		chunks = append(chunks, fmt.Sprintf("CBCHUNK %d %d/%d %s%s", id, i+1, total, m[i*dataSize:end], newline))
+	}
+	return chunks
+}
+
+// batching tells whether events are written in batches rather than one at a time. Each udp
+// datagram still holds a single event.
+func (o *NetOutput) batching() bool {
+	return (o.Config.BatchMaxEvents > 0 || o.Config.BatchMaxBytes > 0) && strings.HasPrefix(o.protocolName, "tcp")
+}
+
+// addToBatch adds an event, line ending included, to the batch, writing the batch once it is
+// full. The batch is written first when the event doesn't fit in it, and an event larger than
+// BatchMaxBytes is written on its own.
+func (o *NetOutput) addToBatch(m, newline string) error {
+	data := m + newline
+	maxBytes := o.Config.BatchMaxBytes
+	if maxBytes > 0 && o.batch.Len()+len(data) > maxBytes {
+		if err := o.flushBatch(); err != nil {
+			o.errorLog.Errorf("%s", err)
+		}
+	}
+
+	if o.batchEvents == 0 {
+		o.batchTimer = time.NewTimer(o.Config.BatchMaxWait)
+	}
+	o.batch.WriteString(data)
+	o.batchEvents++
+	o.batchReceived = append(o.batchReceived, o.latency.hold())
+	if o.replay != nil {
+		o.batchMessages = append(o.batchMessages, m)
+	}
+
+	if (o.Config.BatchMaxEvents > 0 && o.batchEvents >= o.Config.BatchMaxEvents) ||
+		(maxBytes > 0 && o.batch.Len() >= maxBytes) {
+		return o.flushBatch()
+	}
+	return nil
+}
+
+// flushBatch writes the events of the batch in a single write. If the connection was lost since
+// they were added, or fails, the events of the batch are dropped.
+func (o *NetOutput) flushBatch() error {
+	if o.batchEvents == 0 {
+		return nil
+	}
+
+	data, events, received, messages := o.batch.String(), int64(o.batchEvents), o.batchReceived, o.batchMessages
+	o.batch.Reset()
+	o.batchEvents = 0
+	o.batchReceived = nil
+	o.batchMessages = nil
+	if o.batchTimer != nil {
+		o.batchTimer.Stop()
+		o.batchTimer = nil
+	}
+
+	if !o.connected {
+		atomic.AddInt64(&o.droppedEventCount, events)
+		return fmt.Errorf("Dropped a batch of %d events, the connection to %s was lost", events, o.netConn)
+	}
+
+	if err := o.write(data, events); err != nil {
+		return err
+	}
+	for _, m := range messages {
+		o.recordSent(m)
+	}
+	atomic.AddInt64(&o.sentEventCount, events)
+	atomic.AddInt64(&o.batchCount, 1)
+	o.connectionEventCount += events
+	o.latency.deliveredHeld(received)
+	return nil
+}
+
+// checkThroughput reports low throughput when fewer than MinEventsPerWindow events were sent
+// during the window ending now. Windows only count time spent connected, or closed for being
+// idle, since a collector that can't be reached is reported by the connection errors instead.
+func (o *NetOutput) checkThroughput(now time.Time) {
+	if !o.connected && !o.idle {
+		o.throughputWindowStart = time.Time{}
+		return
+	}
+	sent := atomic.LoadInt64(&o.sentEventCount)
+	if o.throughputWindowStart.IsZero() {
+		o.throughputWindowStart, o.throughputWindowBase = now, sent
+		return
+	}
+	window := now.Sub(o.throughputWindowStart)
+	if window < o.Config.ThroughputWindow {
+		return
+	}
+
+	count := sent - o.throughputWindowBase
+	atomic.StoreInt64(&o.lastWindowEventCount, count)
+	o.throughputWindowStart, o.throughputWindowBase = now, sent
+	if count >= o.Config.MinEventsPerWindow {
+		return
+	}
+	atomic.AddInt64(&o.lowThroughputCount, 1)
+	log.Warnf("Only %d events were sent to %s in the last %s, fewer than the %d expected; check that the sensors "+
+		"and the Cb server are still reporting", count, o.netConn, window.Round(time.Second), o.Config.MinEventsPerWindow)
+	if o.OnLowThroughput != nil {
+		o.OnLowThroughput(count, window)
 	}
-	return err
 }
 
 func (o *NetOutput) Go(messages <-chan string, signals <-chan os.Signal, exitCond *sync.Cond) error {
@@ -160,23 +1327,86 @@ func (o *NetOutput) Go(messages <-chan string, signals <-chan os.Signal, exitCon
 		defer refreshTicker.Stop()
 
 		for {
+			var batchTimeout <-chan time.Time
+			if o.batchTimer != nil {
+				batchTimeout = o.batchTimer.C
+			}
+			var heartbeatDue <-chan time.Time
+			if o.heartbeatTimer != nil {
+				heartbeatDue = o.heartbeatTimer.C
+			}
+
 			select {
 			case message := <-messages:
+				o.latency.next()
 				if err := o.output(message); err != nil && !o.Config.DryRun {
-					log.Errorf("%s", err)
+					o.errorLog.Errorf("%s", err)
+				}
+				if o.rekeyDue() {
+					o.rekeyConnection()
+				}
+
+			case <-batchTimeout:
+				o.batchTimer = nil
+				if err := o.flushBatch(); err != nil && !o.Config.DryRun {
+					o.errorLog.Errorf("%s", err)
+				}
+
+			case <-o.pongs:
+				o.receivedPong()
+
+			case <-heartbeatDue:
+				o.heartbeatTimer = nil
+				if err := o.heartbeat(); err != nil {
+					o.errorLog.Errorf("%s", err)
 				}
 
 			case <-refreshTicker.C:
-				if !o.connected && time.Now().After(o.reconnectTime) {
+				if o.connected && o.reconnectBackoff > 0 && time.Since(o.connectTime) >= o.Config.MinHealthyConnection {
+					o.markHealthy()
+				}
+				if o.connected && !o.rotateTime.IsZero() && time.Now().After(o.rotateTime) {
+					o.rotateConnection()
+				}
+				if o.rekeyDue() {
+					o.rekeyConnection()
+				}
+				if o.connected && o.srv != nil && o.srv.refreshDue() {
+					if err := o.srv.refresh(); err != nil {
+						o.errorLog.Errorf("%s", err)
+					} else if o.srv.shouldLeave(o.destination) {
+						o.leaveSRVTarget()
+					}
+				}
+				if o.connected && o.Config.IdleTimeout > 0 && strings.HasPrefix(o.protocolName, "tcp") &&
+					time.Since(o.lastWriteTime) >= o.Config.IdleTimeout && o.batchEvents == 0 {
+					o.closeIdleConnection()
+				}
+				if o.Config.MinEventsPerWindow > 0 {
+					o.checkThroughput(time.Now())
+				}
+				if !o.connected && !o.idle && time.Now().After(o.reconnectTime) {
 					err := o.Initialize(o.netConn)
 					if err != nil {
 						o.closeAndScheduleReconnection()
+						continue
+					}
+					// only reconnections are counted, not the attempts that failed
+					atomic.AddInt64(&o.reconnectCount, 1)
+					if err := o.replayRecent(); err != nil {
+						o.errorLog.Errorf("%s", err)
+					} else if err := o.resendPendingChunks(); err != nil {
+						o.errorLog.Errorf("%s", err)
 					}
 				}
 			case signal := <-signals:
 				switch signal {
 				case syscall.SIGTERM, syscall.SIGINT:
 					log.Infof("Net output handling SIGTERM")
+					if err := o.flushBatch(); err != nil {
+						o.errorLog.Errorf("%s", err)
+					}
+					o.close()
 					return
 				}
 			}
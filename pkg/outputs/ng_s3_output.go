@@ -10,9 +10,11 @@ import (
 	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
 	log "github.com/sirupsen/logrus"
 	"io"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,15 +29,27 @@ type NGS3Output struct {
 }
 
 func NewNGS3OutputFromConfig(cfg *Configuration) *BaseOutput {
-	return &BaseOutput{OutputHandler: &NGS3Output{Config: cfg}}
+	return &BaseOutput{OutputHandler: &NGS3Output{Config: cfg}, errorLog: NewErrorLogSampler(cfg.ErrorLogBurst, cfg.ErrorLogInterval)}
 }
 
 func (so *NGS3Output) String() string {
 	return fmt.Sprintf("%s:%s", so.region, so.bucketName)
 }
 
+type NGS3Statistics struct {
+	TimeSource              TimeSource `json:"time_source"`
+	TimeSourceFallbackCount int64      `json:"time_source_fallback_count"`
+}
+
+// Statistics are only kept for partitioned object keys, the only place the time source is used.
 func (so *NGS3Output) Statistics() interface{} {
-	return nil
+	if so.Config.S3KeyTemplate == nil || so.chunkingPublisher == nil {
+		return nil
+	}
+	return NGS3Statistics{
+		TimeSource:              so.Config.TimeSource,
+		TimeSourceFallbackCount: atomic.LoadInt64(&so.chunkingPublisher.timeSourceFallbackCount),
+	}
 }
 
 func (so *NGS3Output) Key() string {
@@ -106,6 +120,33 @@ func (so *NGS3Output) Initialize(connString string) error {
 	return err
 }
 
+// Verify uploads an object holding a single event, written and named like the chunks are.
+func (so *NGS3Output) Verify(message string) error {
+	chunk, err := NewS3OutputChunk(so.Config, so.Config.BundleSizeMax, so.Config.BundleSizeMax/100,
+		"event-forwarder-verify", so.bucketName)
+	if err != nil {
+		return err
+	}
+	if so.Config.S3KeyTemplate != nil {
+		var fellBack bool
+		if chunk.partition, fellBack, err = S3Partition(so.Config.S3KeyTemplate, message, so.Config.TimeSource, time.Now()); err != nil {
+			return err
+		}
+		if fellBack {
+			atomic.AddInt64(&so.chunkingPublisher.timeSourceFallbackCount, 1)
+		}
+	}
+
+	// the chunk is a pipe, so it has to be written while it is uploaded
+	go func() {
+		chunk.Write(message)
+		chunk.CloseChunkWriters()
+	}()
+	_, err = so.chunkingPublisher.Upload(chunk.PrepareS3UploadInput(0))
+	chunk.CloseChunkReader()
+	return err
+}
+
 func (so *NGS3Output) Start() (err error) {
 	err = so.chunkingPublisher.Start()
 	if err != nil {
@@ -134,6 +175,15 @@ func (so *NGS3Output) HandleHup() error {
 	return nil
 }
 
+// HandleFlush uploads the objects being written, leaving out empty ones.
+func (so *NGS3Output) HandleFlush() error {
+	if err := so.chunkingPublisher.RollChunkIf(false); err != nil {
+		return err
+	}
+	log.Infof("Flushed the objects being written to %s", so)
+	return nil
+}
+
 func (so *NGS3Output) HandleTerm() {
 	so.chunkingPublisher.Stop()
 }
@@ -147,6 +197,8 @@ type S3ChunkingPublisher struct {
 	uploadWaitGroup *sync.WaitGroup
 	inputWaitGroup  *sync.WaitGroup
 	bucketName      string
+	// events partitioned by ingest time because they had no usable timestamp
+	timeSourceFallbackCount int64
 }
 
 func NewS3ChunkingPublisher(cfg *Configuration, uploader WrappedUploader, bucketName string) *S3ChunkingPublisher {
@@ -173,7 +225,13 @@ func (chunkingPublisher *S3ChunkingPublisher) LaunchInputWorkers(workerNum int)
 			log.Errorf("Error making chunker %e", err)
 			return err
 		} else {
+			if chunkingPublisher.config.S3KeyTemplate != nil {
+				chunker.partitions = newS3PartitionChunks(chunkingPublisher.config.S3PartitionMode,
+					chunkingPublisher.dedicatedUpload(chunkerId))
+				chunker.timeSourceFallbackCount = &chunkingPublisher.timeSourceFallbackCount
+			}
 			chunkingPublisher.chunkers = append(chunkingPublisher.chunkers, chunker)
+			chunkingPublisher.inputWaitGroup.Add(1)
 			go chunker.Work(chunkerId, chunkingPublisher.inputWaitGroup, chunkingPublisher.Input)
 			log.Debugf("Launched input worker - %d", chunkerId)
 		}
@@ -181,6 +239,19 @@ func (chunkingPublisher *S3ChunkingPublisher) LaunchInputWorkers(workerNum int)
 	return nil
 }
 
+// dedicatedUpload returns a function that uploads a chunk on its own, rather than through the
+// upload workers. Partitioned chunk workers can have any number of chunks open, each of them
+// streaming to its own upload, so they can't share a fixed number of upload workers.
+func (chunkingPublisher *S3ChunkingPublisher) dedicatedUpload(workerId int) func(*S3OutputChunk) {
+	return func(chunk *S3OutputChunk) {
+		chunkingPublisher.uploadWaitGroup.Add(1)
+		go func() {
+			defer chunkingPublisher.uploadWaitGroup.Done()
+			NewS3PublisherWorker(workerId, nil, nil, chunkingPublisher.WrappedUploader).publish(chunk)
+		}()
+	}
+}
+
 func (chunkingPublisher *S3ChunkingPublisher) RollChunkIf(uploadEmpty bool) (err error) {
 	var rollError error = nil
 	for i, chunker := range chunkingPublisher.chunkers {
@@ -231,6 +302,9 @@ type S3OutputChunkWorker struct {
 	uploadOutputs chan<- *S3OutputChunk
 	currentChunk  *S3OutputChunk
 	config        *Configuration
+	// set when object keys are partitioned, replacing currentChunk
+	partitions              *s3PartitionChunks
+	timeSourceFallbackCount *int64
 }
 
 type S3OutputChunk struct {
@@ -248,6 +322,12 @@ type S3OutputChunk struct {
 	sent             bool
 	createTime       time.Time
 	Closed           bool
+
+	// set when object keys are partitioned, along with a number that tells apart objects of
+	// the same partition opened within the same millisecond
+	partition       string
+	partitionObject uint64
+
 	sync.RWMutex
 }
 
@@ -334,6 +414,9 @@ func (chunkWorker *S3OutputChunkWorker) CurrentChunkTime() time.Time {
 }
 
 func (chunkWorker *S3OutputChunkWorker) CloseCurrentChunk() error {
+	if chunkWorker.partitions != nil {
+		return chunkWorker.partitions.rollIf(func(*S3OutputChunk) bool { return true })
+	}
 	if chunkWorker.currentChunk.Closed {
 		return nil
 	}
@@ -341,6 +424,9 @@ func (chunkWorker *S3OutputChunkWorker) CloseCurrentChunk() error {
 }
 
 func (chunkWorker *S3OutputChunkWorker) RollChunkIf(emptyOk bool) error {
+	if chunkWorker.partitions != nil {
+		return chunkWorker.partitions.rollIf(func(*S3OutputChunk) bool { return true })
+	}
 	if emptyOk || (!emptyOk && chunkWorker.currentChunk.currentByteCount > 0) {
 		return chunkWorker.RollChunkAndSend()
 	}
@@ -348,6 +434,11 @@ func (chunkWorker *S3OutputChunkWorker) RollChunkIf(emptyOk bool) error {
 }
 
 func (chunkWorker *S3OutputChunkWorker) RollChunkIfTimeElapsed(emptyOk bool, duration time.Duration) error {
+	if chunkWorker.partitions != nil {
+		return chunkWorker.partitions.rollIf(func(chunk *S3OutputChunk) bool {
+			return time.Now().Sub(chunk.createTime) >= duration
+		})
+	}
 	if time.Now().Sub(chunkWorker.CurrentChunkTime()) >= duration {
 		return chunkWorker.RollChunkIf(emptyOk)
 	}
@@ -369,6 +460,9 @@ func (chunkWorker *S3OutputChunkWorker) RollChunkAndSend() error {
 }
 
 func (chunkWorker *S3OutputChunkWorker) output(message string) (err error) {
+	if chunkWorker.partitions != nil {
+		return chunkWorker.outputToPartition(message)
+	}
 	err = chunkWorker.currentChunk.Write(message)
 	if chunkWorker.currentChunk.Full() {
 		return chunkWorker.RollChunkAndSend()
@@ -383,12 +477,15 @@ func (chunkWorker *S3OutputChunkWorker) SendChunk() {
 	}
 }
 
+// Work chunks the input until it is closed, marking wg done once the last chunk is closed. The
+// caller adds to wg before starting it, so that waiting on wg can't return before it starts.
 func (chunkWorker *S3OutputChunkWorker) Work(workerId int, wg *sync.WaitGroup, input <-chan string) {
-	wg.Add(1)
+	defer wg.Done()
 	defer chunkWorker.CloseCurrentChunk()
 	defer log.Infof("[%d]Chunk worker exiting...", workerId)
-	defer wg.Done()
-	chunkWorker.SendChunk()
+	if chunkWorker.partitions == nil {
+		chunkWorker.SendChunk()
+	}
 	for inputData := range input {
 		err := chunkWorker.output(inputData)
 		if err != nil {
@@ -411,10 +508,15 @@ func (chunk *S3OutputChunk) PrepareS3UploadInput(workerId int) *s3manager.Upload
 	} else {
 		baseName = filepath.Base(chunk.fileName)
 	}
+	key := fmt.Sprintf("%s.%s-%d%s", baseName, time.Now().Format("2006-01-02T15:04:05.000"), workerId, fileSuffix)
+	if len(chunk.partition) > 0 {
+		baseName = path.Join(path.Dir(baseName), chunk.partition, path.Base(baseName))
+		key = fmt.Sprintf("%s.%s-%d-%d%s", baseName, time.Now().Format("2006-01-02T15:04:05.000"), workerId, chunk.partitionObject, fileSuffix)
+	}
 	return &s3manager.UploadInput{
 		Body:                 chunk,
 		Bucket:               aws.String(chunk.bucketName),
-		Key:                  aws.String(fmt.Sprintf("%s.%s-%d%s", baseName, time.Now().Format("2006-01-02T15:04:05.000"), workerId, fileSuffix)),
+		Key:                  aws.String(key),
 		ServerSideEncryption: chunk.config.S3ServerSideEncryption,
 		ACL:                  chunk.config.S3ACLPolicy,
 	}
@@ -438,6 +540,7 @@ func NewS3Publisher(waitGroup *sync.WaitGroup, uploader WrappedUploader, uploadI
 
 func (publisher *S3Publisher) LaunchUploadWorkers(workerNum int) {
 	for workerId := 0; workerId < workerNum; workerId++ {
+		publisher.waitGroup.Add(1)
 		go publisher.worker(workerId)
 	}
 }
@@ -461,18 +564,23 @@ func NewS3PublisherWorker(workerId int, waitGroup *sync.WaitGroup, uploads <-cha
 	return &S3PublisherWorker{waitGroup: waitGroup, uploads: uploads, uploader: publisher, workerId: workerId}
 }
 
+// Work uploads chunks until uploads is closed, then marks waitGroup done. The caller adds to
+// waitGroup before starting it.
 func (worker *S3PublisherWorker) Work() {
-	worker.waitGroup.Add(1)
 	defer log.Debugf("[WORKER%d] S3 uploader-worker exiting", worker.workerId)
 	defer worker.waitGroup.Done()
 	for inputChunk := range worker.uploads {
-		s3Input := inputChunk.PrepareS3UploadInput(worker.workerId)
-		uploadResult, err := worker.uploader.Upload(s3Input)
-		inputChunk.CloseChunkReader()
-		if err != nil {
-			log.Errorf("[WORKER%d]-Upload error %v", worker.workerId, err)
-		} else {
-			log.Debugf("[WORKER%d]-Uploaded successfully %v", worker.workerId, uploadResult)
-		}
+		worker.publish(inputChunk)
+	}
+}
+
+func (worker *S3PublisherWorker) publish(inputChunk *S3OutputChunk) {
+	s3Input := inputChunk.PrepareS3UploadInput(worker.workerId)
+	uploadResult, err := worker.uploader.Upload(s3Input)
+	inputChunk.CloseChunkReader()
+	if err != nil {
+		log.Errorf("[WORKER%d]-Upload error %v", worker.workerId, err)
+	} else {
+		log.Debugf("[WORKER%d]-Uploaded successfully %v", worker.workerId, uploadResult)
 	}
 }
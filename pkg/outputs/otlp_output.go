@@ -0,0 +1,455 @@
+package outputs
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+)
+
+// the path of the logs endpoint of OTLP/HTTP, added to otlpout when it has no path of its own, and
+// the method of the logs service of OTLP/gRPC
+const (
+	otlpHTTPLogsPath   = "/v1/logs"
+	otlpGRPCExportPath = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+)
+
+// the gRPC status codes that OTLP exporters retry on: CANCELLED, DEADLINE_EXCEEDED,
+// RESOURCE_EXHAUSTED, ABORTED, OUT_OF_RANGE, UNAVAILABLE and DATA_LOSS
+var otlpRetryableGRPCCodes = map[int]bool{1: true, 4: true, 8: true, 10: true, 11: true, 14: true, 15: true}
+
+// OTLPOutput exports events as OpenTelemetry log records, in batches, over OTLP/HTTP or OTLP/gRPC.
+// Each formatted event is the body of a record, timestamped with the time of the event and with
+// attributes taken from its fields. gRPC is spoken over HTTP/2 directly, the forwarder not
+// depending on a gRPC implementation: only unary calls are needed.
+type OTLPOutput struct {
+	Config *Configuration
+	url    string
+	client *http.Client
+
+	mutex          sync.Mutex
+	pending        []otlpLogRecord
+	batchStart     time.Time
+	pendingLatency []time.Time
+
+	exportedEventCount int64
+	failedEventCount   int64
+	rejectedEventCount int64
+	retryCount         int64
+	latency            *DeliveryLatency
+	errorLog           *ErrorLogSampler
+}
+
+type OTLPStatistics struct {
+	Endpoint           string `json:"endpoint"`
+	Protocol           string `json:"protocol"`
+	PendingEventCount  int    `json:"pending_event_count"`
+	ExportedEventCount int64  `json:"exported_event_count"`
+	// events dropped, including those the collector rejected, also counted in rejected_event_count
+	FailedEventCount   int64 `json:"failed_event_count"`
+	RejectedEventCount int64 `json:"rejected_event_count"`
+	RetryCount         int64 `json:"retry_count"`
+
+	DeliveryLatency DeliveryLatencyStatistics `json:"delivery_latency"`
+}
+
+func (s OTLPStatistics) Sent() int64    { return s.ExportedEventCount }
+func (s OTLPStatistics) Dropped() int64 { return s.FailedEventCount }
+
+func NewOTLPOutputFromConfig(cfg *Configuration) *OTLPOutput {
+	return &OTLPOutput{Config: cfg, errorLog: NewErrorLogSampler(cfg.ErrorLogBurst, cfg.ErrorLogInterval), latency: NewDeliveryLatency()}
+}
+
+// Initialize() expects the URL of the collector, for example http://otel.example.com:4318. With
+// OTLP/HTTP, the path of the logs endpoint is added when the URL has no path; with OTLP/gRPC, the
+// URL has no path, and http:// URLs connect without TLS.
+func (o *OTLPOutput) Initialize(endpoint string) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	location, err := url.ParseRequestURI(strings.TrimSpace(endpoint))
+	if err != nil {
+		return fmt.Errorf("Invalid OTLP endpoint '%s': %s", endpoint, err)
+	}
+	if location.Scheme != "http" && location.Scheme != "https" {
+		return fmt.Errorf("Invalid OTLP endpoint '%s': unsupported scheme %s (http or https)", endpoint, location.Scheme)
+	}
+
+	dial := hostConnections.Dialer(net.Dialer{Timeout: 5 * time.Second})
+	if o.Config.OTLPProtocol == OTLPGRPCProtocol {
+		if len(strings.Trim(location.Path, "/")) > 0 {
+			return fmt.Errorf("Invalid OTLP endpoint '%s': gRPC endpoints have no path", endpoint)
+		}
+		location.Path = otlpGRPCExportPath
+		useTLS := location.Scheme == "https"
+
+		o.client = &http.Client{
+			Transport: &http2.Transport{
+				TLSClientConfig: o.Config.TLSConfig,
+				// gRPC servers without TLS take HTTP/2 right away
+				AllowHTTP: true,
+				DialTLS: func(network, address string, tlsConfig *tls.Config) (net.Conn, error) {
+					conn, err := dial(network, address)
+					if err != nil || !useTLS {
+						return conn, err
+					}
+					tlsConn := tls.Client(conn, tlsConfig)
+					conn.SetDeadline(time.Now().Add(10 * time.Second))
+					if err := tlsConn.Handshake(); err != nil {
+						conn.Close()
+						return nil, err
+					}
+					conn.SetDeadline(time.Time{})
+					return tlsConn, nil
+				},
+			},
+			Timeout: 60 * time.Second,
+		}
+	} else {
+		if len(strings.Trim(location.Path, "/")) == 0 {
+			location.Path = otlpHTTPLogsPath
+		}
+
+		o.client = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig:     o.Config.TLSConfig,
+				Dial:                dial,
+				TLSHandshakeTimeout: 10 * time.Second,
+			},
+			Timeout: 60 * time.Second,
+		}
+	}
+	o.url = location.String()
+
+	return nil
+}
+
+func (o *OTLPOutput) Key() string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return fmt.Sprintf("otlp:%s", o.url)
+}
+
+func (o *OTLPOutput) String() string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return fmt.Sprintf("OTLP %s %s", o.Config.OTLPProtocol, o.url)
+}
+
+func (o *OTLPOutput) Statistics() interface{} {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return OTLPStatistics{
+		Endpoint:           o.url,
+		Protocol:           o.Config.OTLPProtocol,
+		PendingEventCount:  len(o.pending),
+		ExportedEventCount: atomic.LoadInt64(&o.exportedEventCount),
+		FailedEventCount:   atomic.LoadInt64(&o.failedEventCount),
+		RejectedEventCount: atomic.LoadInt64(&o.rejectedEventCount),
+		RetryCount:         atomic.LoadInt64(&o.retryCount),
+
+		DeliveryLatency: o.latency.Statistics(),
+	}
+}
+
+func (o *OTLPOutput) DeliveryLatency() *DeliveryLatency {
+	return o.latency
+}
+
+func (o *OTLPOutput) Go(messages <-chan string, signals <-chan os.Signal, exitCond *sync.Cond) error {
+	if o.client == nil {
+		return errors.New("OTLP output not initialized")
+	}
+
+	go func() {
+		refreshTicker := time.NewTicker(100 * time.Millisecond)
+		defer exitCond.Signal()
+		defer refreshTicker.Stop()
+
+		for {
+			select {
+			case message := <-messages:
+				o.latency.next()
+				o.add(message, time.Now())
+				if o.batchFull() {
+					o.flush()
+				}
+
+			case <-refreshTicker.C:
+				if o.batchDue(time.Now()) {
+					o.flush()
+				}
+
+			case signal := <-signals:
+				switch signal {
+				case FlushSignal:
+					o.flush()
+				case syscall.SIGTERM, syscall.SIGINT:
+					log.Infof("OTLP output handling SIGTERM")
+					o.flush()
+					return
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Verify exports a single event right away.
+func (o *OTLPOutput) Verify(message string) error {
+	o.add(message, time.Now())
+	return o.flush()
+}
+
+// add adds the log record of an event to the current batch.
+func (o *OTLPOutput) add(message string, ingest time.Time) {
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(message))
+	decoder.UseNumber()
+	// events that aren't json objects have no attributes, and are timestamped when received
+	decoder.Decode(&fields)
+
+	timestamp := ingest
+	if fields != nil {
+		timestamp, _ = o.Config.TimeSource.EventTime(fields, ingest)
+	}
+	record := otlpLogRecord{
+		time:         timestamp.UnixNano(),
+		observedTime: ingest.UnixNano(),
+		body:         strings.TrimRight(message, "\r\n"),
+	}
+	for _, attribute := range o.Config.OTLPAttributes {
+		if value, ok := otlpAttributeValue(fields, attribute.Field); ok {
+			record.attributes = append(record.attributes, otlpAttribute{key: attribute.Name, value: value})
+		}
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if len(o.pending) == 0 {
+		o.batchStart = ingest
+	}
+	o.pending = append(o.pending, record)
+	o.pendingLatency = append(o.pendingLatency, o.latency.hold())
+}
+
+func (o *OTLPOutput) batchFull() bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return len(o.pending) >= o.Config.OTLPBatchSize
+}
+
+func (o *OTLPOutput) batchDue(now time.Time) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return len(o.pending) > 0 && now.Sub(o.batchStart) >= o.Config.OTLPBatchWait
+}
+
+// flush exports the current batch, retrying on the errors that OTLP deems transient.
+func (o *OTLPOutput) flush() error {
+	o.mutex.Lock()
+	if len(o.pending) == 0 {
+		o.mutex.Unlock()
+		return nil
+	}
+	records := o.pending
+	received := o.pendingLatency
+	o.pending, o.pendingLatency = nil, nil
+	o.mutex.Unlock()
+
+	body := encodeOTLPLogs(o.Config.OTLPResourceAttributes, records)
+	count := len(records)
+
+	retries := batchRetry{maxRetries: o.Config.OTLPMaxRetries, retryAfterMax: batchMaxBackoff, retryCount: &o.retryCount}
+	err := retries.do(fmt.Sprintf("export of %d events to %s", count, o.url), func() (bool, time.Duration, error) {
+		return o.export(body, count)
+	})
+	if err != nil {
+		atomic.AddInt64(&o.failedEventCount, int64(count))
+		err = fmt.Errorf("Dropped %d events after failing to export them to %s: %s", count, o.url, err)
+		o.errorLog.Errorf("%s", err)
+		return err
+	}
+	o.latency.deliveredHeld(received)
+	return nil
+}
+
+// export sends an export request holding count events. When it fails, it returns whether to retry
+// it, and how long the collector asked to wait before doing so, or -1 to back off as usual.
+func (o *OTLPOutput) export(body []byte, count int) (bool, time.Duration, error) {
+	var response []byte
+	var retry bool
+	var retryAfter time.Duration
+	var err error
+	if o.Config.OTLPProtocol == OTLPGRPCProtocol {
+		response, retry, retryAfter, err = o.exportGRPC(body)
+	} else {
+		response, retry, retryAfter, err = o.exportHTTP(body)
+	}
+	if err != nil {
+		return retry, retryAfter, err
+	}
+
+	// the collector may take some of the records only, rejecting the others for good
+	rejected, message, err := decodeOTLPPartialSuccess(response)
+	if err != nil {
+		log.Debugf("Could not decode the response of %s: %s", o.url, err)
+	}
+	if rejected > int64(count) {
+		rejected = int64(count)
+	}
+	if rejected > 0 {
+		atomic.AddInt64(&o.failedEventCount, rejected)
+		atomic.AddInt64(&o.rejectedEventCount, rejected)
+		o.errorLog.Errorf("OTLP collector at %s rejected %d of %d events: %s", o.url, rejected, count, message)
+	} else if len(message) > 0 {
+		log.Warnf("OTLP collector at %s took all events with a warning: %s", o.url, message)
+	}
+	atomic.AddInt64(&o.exportedEventCount, int64(count)-rejected)
+	return false, -1, nil
+}
+
+// exportHTTP posts an export request to the OTLP/HTTP endpoint, returning the body of the response.
+func (o *OTLPOutput) exportHTTP(body []byte) ([]byte, bool, time.Duration, error) {
+	request, err := http.NewRequest("POST", o.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, -1, err
+	}
+	for name, values := range o.Config.OTLPHeaders {
+		request.Header[name] = append([]string(nil), values...)
+	}
+	request.Header.Set("Content-Type", "application/x-protobuf")
+
+	response, err := o.client.Do(request)
+	if err != nil {
+		return nil, true, -1, err
+	}
+	defer response.Body.Close()
+	responseBody, _ := ioutil.ReadAll(response.Body)
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return responseBody, false, -1, nil
+	}
+
+	// failures are described by a google.rpc.Status, or by plain text from proxies
+	message := strings.TrimSpace(string(responseBody))
+	if response.Header.Get("Content-Type") == "application/x-protobuf" {
+		if status, err := decodeOTLPStatusMessage(responseBody); err == nil {
+			message = status
+		}
+	}
+	err = fmt.Errorf("%s: %s", response.Status, message)
+
+	switch response.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return nil, true, retryAfterWait(response), err
+	}
+	return nil, false, -1, err
+}
+
+// exportGRPC calls the Export method of the logs service, returning the response message.
+func (o *OTLPOutput) exportGRPC(body []byte) ([]byte, bool, time.Duration, error) {
+	// a gRPC message is prefixed by a byte telling whether it is compressed, and its length
+	frame := make([]byte, 5, 5+len(body))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(body)))
+	frame = append(frame, body...)
+
+	request, err := http.NewRequest("POST", o.url, bytes.NewReader(frame))
+	if err != nil {
+		return nil, false, -1, err
+	}
+	for name, values := range o.Config.OTLPHeaders {
+		request.Header[name] = append([]string(nil), values...)
+	}
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("TE", "trailers")
+
+	response, err := o.client.Do(request)
+	if err != nil {
+		return nil, true, -1, err
+	}
+	defer response.Body.Close()
+	// the status is in the trailers, read along with the body
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, true, -1, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		switch response.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return nil, true, -1, fmt.Errorf("%s", response.Status)
+		}
+		return nil, false, -1, fmt.Errorf("%s", response.Status)
+	}
+
+	// responses without a message carry their status in the headers
+	status := response.Trailer.Get("Grpc-Status")
+	message := response.Trailer.Get("Grpc-Message")
+	if len(status) == 0 {
+		status, message = response.Header.Get("Grpc-Status"), response.Header.Get("Grpc-Message")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return nil, false, -1, fmt.Errorf("invalid gRPC status '%s'", status)
+	}
+	if code != 0 {
+		if unescaped, err := url.PathUnescape(message); err == nil {
+			message = unescaped
+		}
+		return nil, otlpRetryableGRPCCodes[code], -1, fmt.Errorf("gRPC status %d: %s", code, message)
+	}
+
+	if len(responseBody) < 5 || responseBody[0] != 0 {
+		return nil, false, -1, nil
+	}
+	return responseBody[5:], false, -1, nil
+}
+
+// otlpAttributeValue returns the value of a field of an event as an attribute value. Objects and
+// arrays are kept as json.
+func otlpAttributeValue(fields map[string]interface{}, field string) (interface{}, bool) {
+	value, ok := eventField(fields, field)
+	if !ok {
+		return nil, false
+	}
+
+	switch value := value.(type) {
+	case nil:
+		return nil, false
+	case string, bool:
+		return value, true
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i, true
+		}
+		f, err := value.Float64()
+		return f, err == nil
+	}
+	b, err := json.Marshal(value)
+	return string(b), err == nil
+}
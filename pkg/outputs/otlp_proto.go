@@ -0,0 +1,203 @@
+package outputs
+
+import (
+	"math"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages of the OTLP logs service are encoded by hand, field numbers following
+// opentelemetry/proto/collector/logs/v1/logs_service.proto and the messages it refers to, as only
+// the few fields below are ever written or read.
+const (
+	// ExportLogsServiceRequest and ExportLogsServiceResponse
+	otlpRequestResourceLogs    protowire.Number = 1
+	otlpResponsePartialSuccess protowire.Number = 1
+	// ExportLogsPartialSuccess
+	otlpPartialSuccessRejected protowire.Number = 1
+	otlpPartialSuccessMessage  protowire.Number = 2
+	// ResourceLogs, Resource and ScopeLogs
+	otlpResourceLogsResource  protowire.Number = 1
+	otlpResourceLogsScopeLogs protowire.Number = 2
+	otlpResourceAttributes    protowire.Number = 1
+	otlpScopeLogsScope        protowire.Number = 1
+	otlpScopeLogsLogRecords   protowire.Number = 2
+	otlpScopeName             protowire.Number = 1
+	// LogRecord
+	otlpLogRecordTime         protowire.Number = 1
+	otlpLogRecordBody         protowire.Number = 5
+	otlpLogRecordAttributes   protowire.Number = 6
+	otlpLogRecordObservedTime protowire.Number = 11
+	// KeyValue and AnyValue
+	otlpKeyValueKey    protowire.Number = 1
+	otlpKeyValueValue  protowire.Number = 2
+	otlpAnyValueString protowire.Number = 1
+	otlpAnyValueBool   protowire.Number = 2
+	otlpAnyValueInt    protowire.Number = 3
+	otlpAnyValueDouble protowire.Number = 4
+	// google.rpc.Status, the body of failed OTLP/HTTP requests
+	otlpStatusMessage protowire.Number = 2
+)
+
+// the instrumentation scope of the log records
+const otlpInstrumentationScope = "cb-event-forwarder"
+
+// otlpLogRecord is what an event is exported as: a LogRecord with the formatted event as its body.
+type otlpLogRecord struct {
+	// unix nanoseconds of the event, and of when the output received it
+	time         int64
+	observedTime int64
+	body         string
+	attributes   []otlpAttribute
+}
+
+// otlpAttribute is an attribute of a log record, its value a string, bool, int64 or float64.
+type otlpAttribute struct {
+	key   string
+	value interface{}
+}
+
+// encodeOTLPLogs encodes an ExportLogsServiceRequest holding records, all of them from a single
+// resource with the given attributes.
+func encodeOTLPLogs(resourceAttributes map[string]string, records []otlpLogRecord) []byte {
+	keys := make([]string, 0, len(resourceAttributes))
+	for key := range resourceAttributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var resource []byte
+	for _, key := range keys {
+		resource = appendOTLPMessage(resource, otlpResourceAttributes, encodeOTLPKeyValue(key, resourceAttributes[key]))
+	}
+
+	var scope []byte
+	scope = protowire.AppendTag(scope, otlpScopeName, protowire.BytesType)
+	scope = protowire.AppendString(scope, otlpInstrumentationScope)
+
+	var scopeLogs []byte
+	scopeLogs = appendOTLPMessage(scopeLogs, otlpScopeLogsScope, scope)
+	for _, record := range records {
+		scopeLogs = appendOTLPMessage(scopeLogs, otlpScopeLogsLogRecords, encodeOTLPLogRecord(record))
+	}
+
+	var resourceLogs []byte
+	resourceLogs = appendOTLPMessage(resourceLogs, otlpResourceLogsResource, resource)
+	resourceLogs = appendOTLPMessage(resourceLogs, otlpResourceLogsScopeLogs, scopeLogs)
+
+	return appendOTLPMessage(nil, otlpRequestResourceLogs, resourceLogs)
+}
+
+func encodeOTLPLogRecord(record otlpLogRecord) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, otlpLogRecordTime, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, uint64(record.time))
+	b = appendOTLPMessage(b, otlpLogRecordBody, encodeOTLPAnyValue(record.body))
+	for _, attribute := range record.attributes {
+		b = appendOTLPMessage(b, otlpLogRecordAttributes, encodeOTLPKeyValue(attribute.key, attribute.value))
+	}
+	b = protowire.AppendTag(b, otlpLogRecordObservedTime, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, uint64(record.observedTime))
+}
+
+func encodeOTLPKeyValue(key string, value interface{}) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, otlpKeyValueKey, protowire.BytesType)
+	b = protowire.AppendString(b, key)
+	return appendOTLPMessage(b, otlpKeyValueValue, encodeOTLPAnyValue(value))
+}
+
+func encodeOTLPAnyValue(value interface{}) []byte {
+	var b []byte
+	switch value := value.(type) {
+	case string:
+		b = protowire.AppendTag(b, otlpAnyValueString, protowire.BytesType)
+		b = protowire.AppendString(b, value)
+	case bool:
+		b = protowire.AppendTag(b, otlpAnyValueBool, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(value))
+	case int64:
+		b = protowire.AppendTag(b, otlpAnyValueInt, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(value))
+	case float64:
+		b = protowire.AppendTag(b, otlpAnyValueDouble, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(value))
+	}
+	return b
+}
+
+func appendOTLPMessage(b []byte, num protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
+
+// decodeOTLPPartialSuccess returns how many log records the collector rejected, and why, from an
+// ExportLogsServiceResponse. Responses without a partial success reject nothing.
+func decodeOTLPPartialSuccess(response []byte) (int64, string, error) {
+	var rejected int64
+	var message string
+	err := consumeOTLPFields(response, func(num protowire.Number, value []byte, _ uint64) error {
+		if num != otlpResponsePartialSuccess || value == nil {
+			return nil
+		}
+		return consumeOTLPFields(value, func(num protowire.Number, value []byte, varint uint64) error {
+			switch num {
+			case otlpPartialSuccessRejected:
+				rejected = int64(varint)
+			case otlpPartialSuccessMessage:
+				message = string(value)
+			}
+			return nil
+		})
+	})
+	return rejected, message, err
+}
+
+// decodeOTLPStatusMessage returns the message of a google.rpc.Status.
+func decodeOTLPStatusMessage(status []byte) (string, error) {
+	var message string
+	err := consumeOTLPFields(status, func(num protowire.Number, value []byte, _ uint64) error {
+		if num == otlpStatusMessage {
+			message = string(value)
+		}
+		return nil
+	})
+	return message, err
+}
+
+// consumeOTLPFields calls field for every field of an encoded message, with the bytes of length
+// delimited values or the value of varints, skipping fields of other types.
+func consumeOTLPFields(b []byte, field func(num protowire.Number, value []byte, varint uint64) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var err error
+		switch typ {
+		case protowire.BytesType:
+			var value []byte
+			if value, n = protowire.ConsumeBytes(b); n >= 0 {
+				err = field(num, value, 0)
+			}
+		case protowire.VarintType:
+			var varint uint64
+			if varint, n = protowire.ConsumeVarint(b); n >= 0 {
+				err = field(num, nil, varint)
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package outputs
 
 import (
+	"errors"
 	log "github.com/sirupsen/logrus"
 	"os"
 	"sync"
@@ -14,6 +15,47 @@ type Output interface {
 	OutputInitializer
 }
 
+// Verifier is implemented by outputs that can send a single event right after being initialized
+// and confirm that it was written, used to check a configuration end to end. The output is not
+// expected to be used afterwards.
+type Verifier interface {
+	Verify(message string) error
+}
+
+// ConfirmingOutput is implemented by outputs that confirm every message once it is safely
+// written, so that the delivery the message came from is only acknowledged then. Such outputs
+// are run with GoConfirmed instead of Go.
+type ConfirmingOutput interface {
+	GoConfirmed(messages <-chan ConfirmedMessage, signalChan <-chan os.Signal, exitCond *sync.Cond) error
+}
+
+// ConfirmedMessage is a message handed over to a ConfirmingOutput, along with the function to
+// call once it is written, with true, or given up on, with false. Confirm may be nil.
+type ConfirmedMessage struct {
+	Message string
+	Confirm func(written bool)
+}
+
+// confirm calls the message's Confirm function, if it has one.
+func (m ConfirmedMessage) confirm(written bool) {
+	if m.Confirm != nil {
+		m.Confirm(written)
+	}
+}
+
+// DeliveryStatistics is implemented by the statistics of outputs that count the events they
+// delivered and those they gave up on, for the summary logged on shutdown.
+type DeliveryStatistics interface {
+	Sent() int64
+	Dropped() int64
+}
+
+// ReconnectStatistics is implemented by the statistics of outputs that keep a connection open,
+// counting how many times it was opened again.
+type ReconnectStatistics interface {
+	Reconnects() int64
+}
+
 type OutputInitializer interface {
 	Initialize(string) error
 }
@@ -35,8 +77,23 @@ type OutputHandler interface {
 	OutputInitializer
 }
 
+// Flusher is implemented by output handlers that hold batches of events, to send them right away
+// on FlushSignal.
+type Flusher interface {
+	HandleFlush() error
+}
+
 type BaseOutput struct {
 	OutputHandler
+	errorLog *ErrorLogSampler
+}
+
+func (baseOutputHandler *BaseOutput) Verify(message string) error {
+	verifier, ok := baseOutputHandler.OutputHandler.(Verifier)
+	if !ok {
+		return errors.New("This output can't be verified")
+	}
+	return verifier.Verify(message)
 }
 
 func (baseOutputHandler *BaseOutput) Go(messages <-chan string, signalChan <-chan os.Signal, exitCond *sync.Cond) error {
@@ -56,7 +113,7 @@ func (baseOutputHandler *BaseOutput) Go(messages <-chan string, signalChan <-cha
 			case message := <-messages:
 				err := baseOutputHandler.HandleMessage(message)
 				if err != nil {
-					log.Errorf("%s", err)
+					baseOutputHandler.errorLog.Errorf("%s", err)
 				}
 			case signal := <-signalChan:
 				switch signal {
@@ -67,6 +124,12 @@ func (baseOutputHandler *BaseOutput) Go(messages <-chan string, signalChan <-cha
 					if err != nil {
 						log.Errorf("%s", err)
 					}
+				case FlushSignal:
+					if flusher, ok := baseOutputHandler.OutputHandler.(Flusher); ok {
+						if err := flusher.HandleFlush(); err != nil {
+							log.Errorf("%s", err)
+						}
+					}
 				case syscall.SIGTERM, syscall.SIGINT:
 					// handle exit gracefully
 					baseOutputHandler.HandleTerm()
@@ -76,7 +139,7 @@ func (baseOutputHandler *BaseOutput) Go(messages <-chan string, signalChan <-cha
 			case <-refreshTicker.C:
 				err := baseOutputHandler.HandleTick()
 				if err != nil {
-					log.Errorf("%s", err)
+					baseOutputHandler.errorLog.Errorf("%s", err)
 				}
 			}
 		}
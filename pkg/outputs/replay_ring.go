@@ -0,0 +1,33 @@
+package outputs
+
+// replayHeader marks events sent again after a reconnection, so that collectors can tell them
+// apart from new events and discard those they already have.
+const replayHeader = "CBREPLAY "
+
+// replayRing keeps the last events sent over a connection, oldest first, to send them again
+// once a lost connection is reopened.
+type replayRing struct {
+	events []string
+	next   int
+	full   bool
+}
+
+func newReplayRing(size int) *replayRing {
+	return &replayRing{events: make([]string, size)}
+}
+
+func (r *replayRing) add(event string) {
+	r.events[r.next] = event
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// recent returns the events kept, oldest first.
+func (r *replayRing) recent() []string {
+	if !r.full {
+		return append([]string(nil), r.events[:r.next]...)
+	}
+	return append(append([]string(nil), r.events[r.next:]...), r.events[:r.next]...)
+}
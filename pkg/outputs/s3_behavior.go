@@ -2,23 +2,51 @@ package outputs
 
 import (
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
 	log "github.com/sirupsen/logrus"
 )
 
+// upper bound of the wait between two attempts to upload the same file
+const s3MaxUploadBackoff = time.Minute
+
 type S3Behavior struct {
-	Config     *Configuration
+	Config *Configuration
+	// the bucket in s3out first, followed by the replicas
+	targets []*s3Target
+
+	// the targets each file has reached so far, for files still waiting to be uploaded to others
+	delivered      map[string]map[*s3Target]bool
+	deliveredMutex sync.Mutex
+}
+
+// s3Target is a bucket that every file is uploaded to. Uploads to each target are retried on
+// their own, so a file that reached one bucket is not uploaded there again.
+type s3Target struct {
 	bucketName string
-	out        *s3.S3
 	region     string
+	out        *s3.S3
+	uploader   *s3manager.Uploader
+
+	uploadAttempts   int64
+	uploadFailures   int64
+	multipartUploads int64
+	filesUploaded    int64
+	fallbackFiles    int64
 }
 
 func NewS3OutputFromConfig(cfg *Configuration) *BundledOutput {
@@ -29,9 +57,78 @@ type S3Statistics struct {
 	BucketName        string `json:"bucket_name"`
 	Region            string `json:"region"`
 	EncryptionEnabled bool   `json:"encryption_enabled"`
+	UploadAttempts    int64  `json:"upload_attempts"`
+	UploadFailures    int64  `json:"upload_failures"`
+	MultipartUploads  int64  `json:"multipart_uploads"`
+	FallbackFiles     int64  `json:"fallback_files"`
+	// only listed when files are replicated to other buckets
+	Targets []S3TargetStatistics `json:"targets,omitempty"`
+}
+
+type S3TargetStatistics struct {
+	BucketName       string `json:"bucket_name"`
+	Region           string `json:"region"`
+	UploadAttempts   int64  `json:"upload_attempts"`
+	UploadFailures   int64  `json:"upload_failures"`
+	MultipartUploads int64  `json:"multipart_uploads"`
+	FilesUploaded    int64  `json:"files_uploaded"`
+	FallbackFiles    int64  `json:"fallback_files"`
 }
 
+// Upload sends the file to every target it has not reached yet, retrying each of them with an
+// exponential backoff. When every attempt to a target fails the file is left in the temporary
+// directory, from where it is retried later for the targets still missing it. A target that
+// can never take the file, such as a bucket that does not exist, gets a copy of it on local disk
+// instead, in the failed-uploads directory next to the file.
 func (o *S3Behavior) Upload(fileName string, fp *os.File) UploadStatus {
+	defer fp.Close()
+
+	fileInfo, err := fp.Stat()
+	if err != nil {
+		return UploadStatus{fileName: fileName, result: err}
+	}
+
+	var uploadErr error
+	for _, target := range o.targets {
+		if o.isDelivered(fileName, target) {
+			continue
+		}
+
+		err := o.uploadWithRetries(target, fileName, fp, fileInfo.Size())
+		if err != nil && s3PermanentError(err) {
+			log.Errorf("%s can't take %s, keeping a copy on disk instead: %s", target, fileName, err)
+			if err = o.fallBack(target, fileName, fp); err == nil {
+				atomic.AddInt64(&target.fallbackFiles, 1)
+			}
+		}
+		if err != nil {
+			uploadErr = err
+			continue
+		}
+		o.markDelivered(fileName, target)
+	}
+
+	if uploadErr == nil {
+		o.forgetDelivered(fileName)
+	}
+	return UploadStatus{fileName: fileName, result: uploadErr}
+}
+
+// VerifyUpload uploads the file to every target, failing if any of them does not take it.
+func (o *S3Behavior) VerifyUpload(fileName string, fp *os.File) error {
+	fileInfo, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	for _, target := range o.targets {
+		if err := o.uploadWithRetries(target, fileName, fp, fileInfo.Size()); err != nil {
+			return fmt.Errorf("%s: %s", target, err)
+		}
+	}
+	return nil
+}
+
+func (o *S3Behavior) uploadWithRetries(target *s3Target, fileName string, fp *os.File, size int64) (err error) {
 	var baseName string
 
 	//
@@ -44,43 +141,169 @@ func (o *S3Behavior) Upload(fileName string, fp *os.File) UploadStatus {
 		baseName = filepath.Base(fileName)
 	}
 
-	_, err := o.out.PutObject(&s3.PutObjectInput{
+	log.WithFields(log.Fields{"Filename": fileName, "Bucket": &target.bucketName}).Debug("Uploading File to Bucket")
+
+	backoff := o.Config.S3UploadRetryBackoff
+	attempts := o.Config.S3UploadRetries + 1
+	for attempt := 1; ; attempt++ {
+		if _, err = fp.Seek(0, io.SeekStart); err == nil {
+			atomic.AddInt64(&target.uploadAttempts, 1)
+			err = o.uploadFile(target, baseName, fp, size)
+		}
+		if err == nil || attempt >= attempts || s3PermanentError(err) {
+			break
+		}
+
+		log.Infof("Error uploading %s to %s (attempt %d of %d), retrying in %s: %s", fileName, target, attempt, attempts, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > s3MaxUploadBackoff {
+			backoff = s3MaxUploadBackoff
+		}
+	}
+
+	if err != nil {
+		atomic.AddInt64(&target.uploadFailures, 1)
+		if !s3PermanentError(err) {
+			log.Errorf("Could not upload %s to %s after %d attempts, keeping it on disk to retry later: %s", fileName, target, attempts, err)
+		}
+	} else {
+		atomic.AddInt64(&target.filesUploaded, 1)
+	}
+	return err
+}
+
+// uploadFile uploads large files in parts. A failed multipart upload is aborted so that the
+// parts already uploaded are not left behind in the bucket.
+func (o *S3Behavior) uploadFile(target *s3Target, key string, fp *os.File, size int64) error {
+	if o.Config.S3MultipartThreshold > 0 && size >= o.Config.S3MultipartThreshold {
+		atomic.AddInt64(&target.multipartUploads, 1)
+		_, err := target.uploader.Upload(&s3manager.UploadInput{
+			Body:                 fp,
+			Bucket:               &target.bucketName,
+			Key:                  &key,
+			ServerSideEncryption: o.Config.S3ServerSideEncryption,
+			ACL:                  o.Config.S3ACLPolicy,
+		})
+		return err
+	}
+
+	_, err := target.out.PutObject(&s3.PutObjectInput{
 		Body:                 fp,
-		Bucket:               &o.bucketName,
-		Key:                  &baseName,
+		Bucket:               &target.bucketName,
+		Key:                  &key,
 		ServerSideEncryption: o.Config.S3ServerSideEncryption,
 		ACL:                  o.Config.S3ACLPolicy,
 	})
-	fp.Close()
+	return err
+}
+
+// fallBack copies the file to the failed-uploads directory of the target, which is left for the
+// operator to deal with.
+func (o *S3Behavior) fallBack(target *s3Target, fileName string, fp *os.File) error {
+	dir := filepath.Join(filepath.Dir(fileName), "failed-uploads", target.region+"_"+target.bucketName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	copied, err := os.OpenFile(filepath.Join(dir, filepath.Base(fileName)), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(copied, fp)
+	if closeErr := copied.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// s3PermanentError tells if retrying will never make the upload succeed: the bucket does not
+// exist, or it is in another region.
+func s3PermanentError(err error) bool {
+	if requestErr, ok := err.(awserr.RequestFailure); ok {
+		switch requestErr.StatusCode() {
+		case http.StatusMovedPermanently, http.StatusNotFound:
+			return true
+		}
+	}
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch awsErr.Code() {
+	case s3.ErrCodeNoSuchBucket, "PermanentRedirect", "InvalidBucketName":
+		return true
+	}
+	// failed multipart uploads wrap the error of the request that failed
+	return awsErr.OrigErr() != nil && s3PermanentError(awsErr.OrigErr())
+}
+
+func (o *S3Behavior) isDelivered(fileName string, target *s3Target) bool {
+	o.deliveredMutex.Lock()
+	defer o.deliveredMutex.Unlock()
+	return o.delivered[fileName][target]
+}
 
-	log.WithFields(log.Fields{"Filename": fileName, "Bucket": &o.bucketName}).Debug("Uploading File to Bucket")
+func (o *S3Behavior) markDelivered(fileName string, target *s3Target) {
+	o.deliveredMutex.Lock()
+	defer o.deliveredMutex.Unlock()
+	if o.delivered[fileName] == nil {
+		o.delivered[fileName] = make(map[*s3Target]bool)
+	}
+	o.delivered[fileName][target] = true
+}
 
-	return UploadStatus{fileName: fileName, result: err}
+func (o *S3Behavior) forgetDelivered(fileName string) {
+	o.deliveredMutex.Lock()
+	defer o.deliveredMutex.Unlock()
+	delete(o.delivered, fileName)
 }
 
 func (o *S3Behavior) Initialize(connString string) error {
+	o.targets = nil
+	o.delivered = make(map[string]map[*s3Target]bool)
+
+	for _, targetString := range append([]string{connString}, o.Config.S3Replicas...) {
+		target, err := o.newTarget(targetString)
+		if err != nil {
+			return err
+		}
+		for _, other := range o.targets {
+			if other.Key() == target.Key() {
+				return fmt.Errorf("%s is both the bucket in s3out and one of its replicas", target)
+			}
+		}
+		o.targets = append(o.targets, target)
+	}
+	return nil
+}
+
+func (o *S3Behavior) newTarget(connString string) (*s3Target, error) {
 	// bucketName can either be a single value (just the bucket name itself, defaulting to "/var/cb/data/event-forwarder" as the
 	// temporary file directory and "us-east-1" for the AWS region), or:
 	//
 	// if bucketName contains two colons, treat it as follows: (temp-file-directory):(region):(bucket-name)
+	target := &s3Target{}
 
 	parts := strings.SplitN(connString, ":", 2)
 	switch len(parts) {
 	case 1:
-		o.bucketName = connString
-		o.region = "us-east-1"
+		target.bucketName = connString
+		target.region = "us-east-1"
 	case 2:
-		o.bucketName = parts[1]
-		o.region = parts[0]
+		target.bucketName = parts[1]
+		target.region = parts[0]
 	default:
-		return fmt.Errorf("Invalid connection string: '%s' should look like (temp-file-directory):(region):bucket-name",
+		return nil, fmt.Errorf("Invalid connection string: '%s' should look like (temp-file-directory):(region):bucket-name",
 			connString)
 	}
 
-	awsConfig := &aws.Config{Region: aws.String(o.region)}
+	awsConfig := &aws.Config{Region: aws.String(target.region)}
 
 	if o.Config.S3Endpoint != nil {
-		awsConfig = &aws.Config{Endpoint: aws.String(*o.Config.S3Endpoint), Region: aws.String(o.region), DisableSSL: aws.Bool(true),
+		awsConfig = &aws.Config{Endpoint: aws.String(*o.Config.S3Endpoint), Region: aws.String(target.region), DisableSSL: aws.Bool(true),
 			S3ForcePathStyle: aws.Bool(true)}
 	}
 
@@ -104,29 +327,66 @@ func (o *S3Behavior) Initialize(connString string) error {
 	}
 
 	sess := session.New(awsConfig)
-	o.out = s3.New(sess)
+	target.out = s3.New(sess)
+	target.uploader = s3manager.NewUploaderWithClient(target.out, func(u *s3manager.Uploader) {
+		if o.Config.S3Concurrency > 0 {
+			u.Concurrency = o.Config.S3Concurrency
+		}
+		u.LeavePartsOnError = false
+	})
 
-	_, err := o.out.HeadBucket(&s3.HeadBucketInput{Bucket: &o.bucketName})
+	_, err := target.out.HeadBucket(&s3.HeadBucketInput{Bucket: &target.bucketName})
 	if err != nil {
 		// converting this to a warning, as you could have buckets with PutObject rights but not ListBucket
-		log.Infof("Could not open bucket %s: %s", o.bucketName, err)
+		log.Infof("Could not open bucket %s: %s", target.bucketName, err)
 	}
 
-	return nil
+	return target, nil
+}
+
+func (t *s3Target) Key() string {
+	return fmt.Sprintf("%s:%s", t.region, t.bucketName)
+}
+
+func (t *s3Target) String() string {
+	return "AWS S3 " + t.Key()
 }
 
 func (o *S3Behavior) Key() string {
-	return fmt.Sprintf("%s:%s", o.region, o.bucketName)
+	return o.targets[0].Key()
 }
 
 func (o *S3Behavior) String() string {
-	return "AWS S3 " + o.Key()
+	keys := make([]string, len(o.targets))
+	for i, target := range o.targets {
+		keys[i] = target.Key()
+	}
+	return "AWS S3 " + strings.Join(keys, ",")
 }
 
 func (o *S3Behavior) Statistics() interface{} {
-	return S3Statistics{
-		BucketName:        o.bucketName,
-		Region:            o.region,
+	stats := S3Statistics{
+		BucketName:        o.targets[0].bucketName,
+		Region:            o.targets[0].region,
 		EncryptionEnabled: o.Config.S3ServerSideEncryption != nil,
 	}
+	for _, target := range o.targets {
+		targetStats := S3TargetStatistics{
+			BucketName:       target.bucketName,
+			Region:           target.region,
+			UploadAttempts:   atomic.LoadInt64(&target.uploadAttempts),
+			UploadFailures:   atomic.LoadInt64(&target.uploadFailures),
+			MultipartUploads: atomic.LoadInt64(&target.multipartUploads),
+			FilesUploaded:    atomic.LoadInt64(&target.filesUploaded),
+			FallbackFiles:    atomic.LoadInt64(&target.fallbackFiles),
+		}
+		stats.UploadAttempts += targetStats.UploadAttempts
+		stats.UploadFailures += targetStats.UploadFailures
+		stats.MultipartUploads += targetStats.MultipartUploads
+		stats.FallbackFiles += targetStats.FallbackFiles
+		if len(o.targets) > 1 {
+			stats.Targets = append(stats.Targets, targetStats)
+		}
+	}
+	return stats
 }
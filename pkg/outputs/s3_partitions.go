@@ -0,0 +1,95 @@
+package outputs
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// s3PartitionChunks holds the open chunks of a chunk worker whose object keys are partitioned,
+// by partition. Every chunk is uploaded while it is written, so each open partition holds an
+// upload in progress.
+type s3PartitionChunks struct {
+	mode   S3PartitionMode
+	upload func(*S3OutputChunk)
+
+	sync.Mutex
+	chunks      map[string]*S3OutputChunk
+	openedCount uint64
+}
+
+func newS3PartitionChunks(mode S3PartitionMode, upload func(*S3OutputChunk)) *s3PartitionChunks {
+	return &s3PartitionChunks{mode: mode, upload: upload, chunks: make(map[string]*S3OutputChunk)}
+}
+
+// write adds the message to the chunk of its partition, opening one with newChunk if needed. In
+// roll mode opening a chunk closes the previous one first.
+func (p *s3PartitionChunks) write(partition, message string, newChunk func() (*S3OutputChunk, error)) error {
+	p.Lock()
+	defer p.Unlock()
+
+	chunk, ok := p.chunks[partition]
+	if !ok {
+		if p.mode == RollOnPartitionChange {
+			p.closeIf(func(*S3OutputChunk) bool { return true })
+		}
+
+		var err error
+		if chunk, err = newChunk(); err != nil {
+			return err
+		}
+		chunk.partition = partition
+		chunk.partitionObject = p.openedCount
+		p.openedCount++
+		p.upload(chunk)
+		chunk.MarkSent()
+		p.chunks[partition] = chunk
+	}
+
+	err := chunk.Write(message)
+	if chunk.Full() {
+		delete(p.chunks, partition)
+		if closeErr := chunk.CloseChunkWriters(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// rollIf closes the chunks for which roll returns true, completing their uploads. Partitions
+// get a new chunk on their next event, so no empty objects are uploaded.
+func (p *s3PartitionChunks) rollIf(roll func(*S3OutputChunk) bool) error {
+	p.Lock()
+	defer p.Unlock()
+	return p.closeIf(roll)
+}
+
+func (p *s3PartitionChunks) closeIf(roll func(*S3OutputChunk) bool) (err error) {
+	for partition, chunk := range p.chunks {
+		if !roll(chunk) {
+			continue
+		}
+		delete(p.chunks, partition)
+		if closeErr := chunk.CloseChunkWriters(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (chunkWorker *S3OutputChunkWorker) outputToPartition(message string) error {
+	partition, fellBack, err := S3Partition(chunkWorker.config.S3KeyTemplate, message, chunkWorker.config.TimeSource, time.Now())
+	if err != nil {
+		log.Errorf("Could not render the S3 object key of an event, dropping it: %s", err)
+		return nil
+	}
+	if fellBack && chunkWorker.timeSourceFallbackCount != nil {
+		atomic.AddInt64(chunkWorker.timeSourceFallbackCount, 1)
+	}
+	return chunkWorker.partitions.write(partition, message, func() (*S3OutputChunk, error) {
+		return NewS3OutputChunk(chunkWorker.config, chunkWorker.chunkSize, chunkWorker.flushSize, chunkWorker.baseFileName, chunkWorker.bucketName)
+	})
+}
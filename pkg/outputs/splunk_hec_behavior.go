@@ -51,7 +51,7 @@ func (this *SplunkBehavior) Initialize(dest string) error {
 
 	transport := &http.Transport{
 		TLSClientConfig:     this.Config.TLSConfig,
-		Dial:                (&net.Dialer{Timeout: 5 * time.Second}).Dial,
+		Dial:                hostConnections.Dialer(net.Dialer{Timeout: 5 * time.Second}),
 		TLSHandshakeTimeout: 10 * time.Second,
 	}
 	this.client = &http.Client{
@@ -0,0 +1,526 @@
+package outputs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// the path of the event endpoint of HEC, added to splunkhecout when it has no path of its own
+const splunkHECEventPath = "/services/collector/event"
+
+// SplunkHECOutput sends events to the HTTP Event Collector of Splunk in batches, each event
+// wrapped in the HEC envelope with its time, host, source, sourcetype and index. With indexer
+// acknowledgement, a batch only counts as delivered once Splunk reports it indexed: the
+// acknowledgements of the batches sent are polled for, and batches that are not acknowledged in
+// time are sent again.
+type SplunkHECOutput struct {
+	Config  *Configuration
+	url     string
+	ackURL  string
+	channel string
+	client  *http.Client
+
+	mutex          sync.Mutex
+	batch          bytes.Buffer
+	pendingCount   int
+	batchStart     time.Time
+	pendingLatency []time.Time
+	// batches waiting for their acknowledgement, by ack ID
+	unacked     map[int64]*splunkHECBatch
+	lastAckPoll time.Time
+
+	sentEventCount   int64
+	ackedEventCount  int64
+	failedEventCount int64
+	retryCount       int64
+	ackTimeoutCount  int64
+	latency          *DeliveryLatency
+	errorLog         *ErrorLogSampler
+}
+
+type SplunkHECStatistics struct {
+	URL               string `json:"url"`
+	PendingEventCount int    `json:"pending_event_count"`
+	// events accepted by HEC, and with indexer_ack, those Splunk acknowledged indexing and those
+	// still waiting for it
+	SentEventCount    int64 `json:"sent_event_count"`
+	AckedEventCount   int64 `json:"acked_event_count,omitempty"`
+	UnackedEventCount int   `json:"unacked_event_count,omitempty"`
+	FailedEventCount  int64 `json:"failed_event_count"`
+	RetryCount        int64 `json:"retry_count"`
+	// batches sent again for not being acknowledged within ack_timeout
+	AckTimeoutCount int64 `json:"ack_timeout_count,omitempty"`
+
+	DeliveryLatency DeliveryLatencyStatistics `json:"delivery_latency"`
+}
+
+func (s SplunkHECStatistics) Sent() int64    { return s.SentEventCount }
+func (s SplunkHECStatistics) Dropped() int64 { return s.FailedEventCount }
+
+// a batch of events, in the HEC envelope, sent in a single request
+type splunkHECBatch struct {
+	body     []byte
+	count    int
+	received []time.Time
+	// when it was last sent, and how many times it was sent again for not being acknowledged
+	sent    time.Time
+	resends int
+}
+
+// the HEC envelope of an event
+type splunkHECEvent struct {
+	Time       json.Number     `json:"time"`
+	Host       string          `json:"host,omitempty"`
+	Source     string          `json:"source,omitempty"`
+	SourceType string          `json:"sourcetype,omitempty"`
+	Index      string          `json:"index,omitempty"`
+	Event      json.RawMessage `json:"event"`
+}
+
+// the answer of HEC to the events sent, with an ackId when indexer acknowledgement is enabled
+type splunkHECResponse struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckID *int64 `json:"ackId"`
+}
+
+func NewSplunkHECOutputFromConfig(cfg *Configuration) *SplunkHECOutput {
+	return &SplunkHECOutput{Config: cfg, errorLog: NewErrorLogSampler(cfg.ErrorLogBurst, cfg.ErrorLogInterval), latency: NewDeliveryLatency()}
+}
+
+// Initialize() expects the URL of HEC, for example https://splunk.example.com:8088, to which the
+// path of the event endpoint is added, or the full URL of the event endpoint. Acknowledgements
+// are polled for at the ack endpoint next to it.
+func (o *SplunkHECOutput) Initialize(hecURL string) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	location, err := url.ParseRequestURI(strings.TrimSpace(hecURL))
+	if err != nil {
+		return fmt.Errorf("Invalid Splunk HEC URL '%s': %s", hecURL, err)
+	}
+	if location.Scheme != "http" && location.Scheme != "https" {
+		return fmt.Errorf("Invalid Splunk HEC URL '%s': unsupported scheme %s (http or https)", hecURL, location.Scheme)
+	}
+	if len(strings.Trim(location.Path, "/")) == 0 {
+		location.Path = splunkHECEventPath
+	}
+	o.url = location.String()
+	location.Path = strings.TrimSuffix(strings.TrimSuffix(location.Path, "/"), "/event") + "/ack"
+	o.ackURL = location.String()
+
+	o.channel = o.Config.SplunkHECChannel
+	if o.Config.SplunkHECAck && len(o.channel) == 0 {
+		// acknowledgements are given per channel, which HEC requires to be a GUID
+		if o.channel, err = newSplunkHECChannel(); err != nil {
+			return err
+		}
+	}
+
+	o.client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:     o.Config.TLSConfig,
+			Dial:                hostConnections.Dialer(net.Dialer{Timeout: 5 * time.Second}),
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		Timeout: 60 * time.Second,
+	}
+
+	o.unacked = make(map[int64]*splunkHECBatch)
+	return nil
+}
+
+func newSplunkHECChannel() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", fmt.Errorf("Could not generate a Splunk HEC channel: %s", err)
+	}
+	// a random (version 4) UUID
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:]), nil
+}
+
+func (o *SplunkHECOutput) Key() string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return fmt.Sprintf("splunk_hec:%s", o.url)
+}
+
+func (o *SplunkHECOutput) String() string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return fmt.Sprintf("Splunk HEC %s", o.url)
+}
+
+func (o *SplunkHECOutput) Statistics() interface{} {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	unacked := 0
+	for _, batch := range o.unacked {
+		unacked += batch.count
+	}
+	return SplunkHECStatistics{
+		URL:               o.url,
+		PendingEventCount: o.pendingCount,
+		SentEventCount:    atomic.LoadInt64(&o.sentEventCount),
+		AckedEventCount:   atomic.LoadInt64(&o.ackedEventCount),
+		UnackedEventCount: unacked,
+		FailedEventCount:  atomic.LoadInt64(&o.failedEventCount),
+		RetryCount:        atomic.LoadInt64(&o.retryCount),
+		AckTimeoutCount:   atomic.LoadInt64(&o.ackTimeoutCount),
+
+		DeliveryLatency: o.latency.Statistics(),
+	}
+}
+
+func (o *SplunkHECOutput) DeliveryLatency() *DeliveryLatency {
+	return o.latency
+}
+
+func (o *SplunkHECOutput) Go(messages <-chan string, signals <-chan os.Signal, exitCond *sync.Cond) error {
+	if o.client == nil {
+		return errors.New("Splunk HEC output not initialized")
+	}
+
+	go func() {
+		refreshTicker := time.NewTicker(100 * time.Millisecond)
+		defer exitCond.Signal()
+		defer refreshTicker.Stop()
+
+		for {
+			select {
+			case message := <-messages:
+				o.latency.next()
+				o.add(message, time.Now())
+				if o.batchFull() {
+					o.flush()
+				}
+
+			case now := <-refreshTicker.C:
+				if o.batchDue(now) {
+					o.flush()
+				}
+				if o.ackPollDue(now) {
+					o.pollAcks(now)
+				}
+
+			case signal := <-signals:
+				switch signal {
+				case FlushSignal:
+					o.flush()
+				case syscall.SIGTERM, syscall.SIGINT:
+					log.Infof("Splunk HEC output handling SIGTERM")
+					o.flush()
+					if unacked := o.waitForAcks(time.Now().Add(o.Config.SplunkHECAckTimeout)); unacked > 0 {
+						log.Warnf("Exiting with %d events sent to %s that were not acknowledged", unacked, o.url)
+					}
+					return
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Verify sends a single event right away, waiting for it to be acknowledged when indexer
+// acknowledgement is enabled.
+func (o *SplunkHECOutput) Verify(message string) error {
+	failed := atomic.LoadInt64(&o.failedEventCount)
+	o.add(message, time.Now())
+	if err := o.flush(); err != nil {
+		return err
+	}
+	if unacked := o.waitForAcks(time.Now().Add(o.Config.SplunkHECAckTimeout)); unacked > 0 || atomic.LoadInt64(&o.failedEventCount) > failed {
+		return fmt.Errorf("%s did not acknowledge the event", o.url)
+	}
+	return nil
+}
+
+// add wraps an event in the HEC envelope and adds it to the current batch. Events that aren't
+// json objects get the configured source, sourcetype and index, and are sent as a string.
+func (o *SplunkHECOutput) add(message string, ingest time.Time) {
+	message = strings.TrimRight(message, "\r\n")
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(message))
+	decoder.UseNumber()
+	decoder.Decode(&fields)
+
+	event := splunkHECEvent{Source: o.Config.SplunkHECSource, SourceType: o.Config.SplunkHECSourceType, Index: o.Config.SplunkHECIndex}
+	timestamp := ingest
+	if fields != nil {
+		eventType, _ := fields["type"].(string)
+		if sourceType, ok := MatchEventTypeValue(o.Config.SplunkHECSourceTypes, eventType); ok {
+			event.SourceType = sourceType
+		}
+		if index, ok := MatchEventTypeValue(o.Config.SplunkHECIndexes, eventType); ok {
+			event.Index = index
+		}
+		if len(o.Config.SplunkHECHostField) > 0 {
+			event.Host, _ = lokiLabelValue(fields, o.Config.SplunkHECHostField) // a label value makes a host as well
+		}
+		timestamp, _ = o.Config.TimeSource.EventTime(fields, ingest)
+		event.Event = json.RawMessage(message)
+	} else {
+		event.Event, _ = json.Marshal(message)
+	}
+	// seconds since the epoch, to the millisecond
+	event.Time = json.Number(strconv.FormatFloat(float64(timestamp.UnixNano()/int64(time.Millisecond))/1000, 'f', 3, 64))
+
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		atomic.AddInt64(&o.failedEventCount, 1)
+		o.errorLog.Errorf("Could not wrap an event for %s: %s", o.url, err)
+		return
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.batch.Write(encoded)
+	if o.pendingCount == 0 {
+		o.batchStart = ingest
+	}
+	o.pendingCount++
+	o.pendingLatency = append(o.pendingLatency, o.latency.hold())
+}
+
+func (o *SplunkHECOutput) batchFull() bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return o.pendingCount >= o.Config.SplunkHECBatchSize
+}
+
+func (o *SplunkHECOutput) batchDue(now time.Time) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return o.pendingCount > 0 && now.Sub(o.batchStart) >= o.Config.SplunkHECBatchWait
+}
+
+func (o *SplunkHECOutput) ackPollDue(now time.Time) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return len(o.unacked) > 0 && now.Sub(o.lastAckPoll) >= o.Config.SplunkHECAckInterval
+}
+
+// flush sends the current batch.
+func (o *SplunkHECOutput) flush() error {
+	o.mutex.Lock()
+	if o.pendingCount == 0 {
+		o.mutex.Unlock()
+		return nil
+	}
+	batch := &splunkHECBatch{body: append([]byte(nil), o.batch.Bytes()...), count: o.pendingCount, received: o.pendingLatency}
+	o.batch.Reset()
+	o.pendingCount = 0
+	o.pendingLatency = nil
+	o.mutex.Unlock()
+
+	return o.send(batch)
+}
+
+// send posts a batch, retrying on throttling and server errors, such as the 503 HEC answers with
+// while its queue is full. A batch that gets an ack ID is kept until it is acknowledged.
+func (o *SplunkHECOutput) send(batch *splunkHECBatch) error {
+	var ackID *int64
+	retries := batchRetry{maxRetries: o.Config.SplunkHECMaxRetries, retryAfterMax: batchMaxBackoff, retryCount: &o.retryCount}
+	err := retries.do(fmt.Sprintf("%d events to %s", batch.count, o.url), func() (bool, time.Duration, error) {
+		var retry bool
+		var retryAfter time.Duration
+		var err error
+		ackID, retry, retryAfter, err = o.post(batch.body)
+		return retry, retryAfter, err
+	})
+	if err != nil {
+		atomic.AddInt64(&o.failedEventCount, int64(batch.count))
+		err = fmt.Errorf("Dropped %d events after failing to send them to %s: %s", batch.count, o.url, err)
+		o.errorLog.Errorf("%s", err)
+		return err
+	}
+
+	atomic.AddInt64(&o.sentEventCount, int64(batch.count))
+	if ackID == nil {
+		o.latency.deliveredHeld(batch.received)
+		return nil
+	}
+	o.mutex.Lock()
+	batch.sent = time.Now()
+	o.unacked[*ackID] = batch
+	o.mutex.Unlock()
+	return nil
+}
+
+// post sends a batch of events, returning its ack ID when HEC gives one. When it fails, it returns
+// whether to retry it, and how long HEC asked to wait before doing so, or -1 to back off as usual.
+func (o *SplunkHECOutput) post(body []byte) (*int64, bool, time.Duration, error) {
+	response, responseBody, err := o.request(o.url, body)
+	if err != nil {
+		return nil, true, -1, err
+	}
+
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		var answer splunkHECResponse
+		if err := json.Unmarshal(responseBody, &answer); err != nil {
+			// the events were accepted all the same
+			log.Debugf("Unexpected answer from %s: %s", o.url, err)
+		}
+		if !o.Config.SplunkHECAck {
+			return nil, false, -1, nil
+		}
+		if answer.AckID == nil {
+			o.errorLog.Errorf("%s did not return an ack ID, check that indexer acknowledgement is enabled for the token", o.url)
+		}
+		return answer.AckID, false, -1, nil
+
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		return nil, true, retryAfterWait(response), fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(responseBody)))
+	}
+
+	return nil, false, -1, fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(responseBody)))
+}
+
+// request posts body to a HEC endpoint, returning the response and its body.
+func (o *SplunkHECOutput) request(endpoint string, body []byte) (*http.Response, []byte, error) {
+	request, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	request.Header.Set("Authorization", "Splunk "+o.Config.SplunkHECToken)
+	request.Header.Set("Content-Type", "application/json")
+	if len(o.channel) > 0 {
+		request.Header.Set("X-Splunk-Request-Channel", o.channel)
+	}
+
+	response, err := o.client.Do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+	responseBody, err := ioutil.ReadAll(response.Body)
+	return response, responseBody, err
+}
+
+// pollAcks asks HEC which of the batches waiting for an acknowledgement were indexed, and sends
+// again those that were not acknowledged within the ack timeout, up to max_retries times.
+func (o *SplunkHECOutput) pollAcks(now time.Time) {
+	o.mutex.Lock()
+	o.lastAckPoll = now
+	ids := make([]int64, 0, len(o.unacked))
+	for id := range o.unacked {
+		ids = append(ids, id)
+	}
+	o.mutex.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	// batches that time out are still sent again when the poll fails
+	acked, err := o.queryAcks(ids)
+	if err != nil {
+		o.errorLog.Errorf("Could not poll %s for acknowledgements: %s", o.ackURL, err)
+	}
+
+	var expired []*splunkHECBatch
+	o.mutex.Lock()
+	for _, id := range ids {
+		batch := o.unacked[id]
+		switch {
+		case acked[id]:
+			delete(o.unacked, id)
+			atomic.AddInt64(&o.ackedEventCount, int64(batch.count))
+			o.latency.deliveredHeld(batch.received)
+		case now.Sub(batch.sent) >= o.Config.SplunkHECAckTimeout:
+			delete(o.unacked, id)
+			expired = append(expired, batch)
+		}
+	}
+	o.mutex.Unlock()
+
+	for _, batch := range expired {
+		atomic.AddInt64(&o.ackTimeoutCount, 1)
+		if batch.resends >= o.Config.SplunkHECMaxRetries {
+			atomic.AddInt64(&o.failedEventCount, int64(batch.count))
+			o.errorLog.Errorf("Dropped %d events that %s did not acknowledge after %d attempts", batch.count, o.url, batch.resends+1)
+			continue
+		}
+		batch.resends++
+		atomic.AddInt64(&o.retryCount, 1)
+		log.Debugf("Sending again %d events that %s did not acknowledge within %s", batch.count, o.url, o.Config.SplunkHECAckTimeout)
+		o.send(batch)
+	}
+}
+
+// queryAcks returns which of the ack IDs HEC reports as indexed.
+func (o *SplunkHECOutput) queryAcks(ids []int64) (map[int64]bool, error) {
+	body, err := json.Marshal(map[string][]int64{"acks": ids})
+	if err != nil {
+		return nil, err
+	}
+	response, responseBody, err := o.request(o.ackURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(responseBody)))
+	}
+
+	var answer struct {
+		Acks map[string]bool `json:"acks"`
+	}
+	if err := json.Unmarshal(responseBody, &answer); err != nil {
+		return nil, fmt.Errorf("invalid answer %q: %s", responseBody, err)
+	}
+	acked := make(map[int64]bool, len(answer.Acks))
+	for id, ok := range answer.Acks {
+		if n, err := strconv.ParseInt(id, 10, 64); err == nil && ok {
+			acked[n] = true
+		}
+	}
+	return acked, nil
+}
+
+// waitForAcks polls for the acknowledgement of the batches sent until all of them are
+// acknowledged or the deadline passes, and returns how many events are left unacknowledged.
+func (o *SplunkHECOutput) waitForAcks(deadline time.Time) int {
+	for {
+		o.mutex.Lock()
+		unacked := 0
+		for _, batch := range o.unacked {
+			unacked += batch.count
+		}
+		o.mutex.Unlock()
+
+		if unacked == 0 || !time.Now().Before(deadline) {
+			return unacked
+		}
+		time.Sleep(o.Config.SplunkHECAckInterval)
+		o.pollAcks(time.Now())
+	}
+}
@@ -0,0 +1,86 @@
+package outputs
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// SQLDialect holds what the sql output needs to know about a database beyond database/sql.
+// Dialects are registered under the name of their database/sql driver with RegisterSQLDialect;
+// custom builds can add databases by registering a driver and a dialect for it.
+type SQLDialect interface {
+	// Placeholder returns the placeholder of the n-th parameter of a statement, counting from 1
+	Placeholder(n int) string
+	// QuoteIdentifier quotes a single identifier, dots included: qualified names are quoted one
+	// part at a time
+	QuoteIdentifier(name string) string
+	// MaxParameters is the largest number of parameters a single statement can take
+	MaxParameters() int
+	// IsTransient tells if a statement that failed with err may succeed if retried
+	IsTransient(err error) bool
+}
+
+var (
+	sqlDialectsMutex sync.RWMutex
+	sqlDialects      = map[string]SQLDialect{"postgres": PostgresDialect{}}
+)
+
+// RegisterSQLDialect makes dialect available to the sql output for driver=name.
+func RegisterSQLDialect(name string, dialect SQLDialect) {
+	sqlDialectsMutex.Lock()
+	defer sqlDialectsMutex.Unlock()
+
+	sqlDialects[name] = dialect
+}
+
+func sqlDialectFor(name string) (SQLDialect, bool) {
+	sqlDialectsMutex.RLock()
+	defer sqlDialectsMutex.RUnlock()
+
+	dialect, ok := sqlDialects[name]
+	return dialect, ok
+}
+
+// PostgresDialect is the dialect of PostgreSQL, through the github.com/lib/pq driver.
+type PostgresDialect struct{}
+
+func (PostgresDialect) Placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+func (PostgresDialect) QuoteIdentifier(name string) string {
+	return pq.QuoteIdentifier(name)
+}
+
+func (PostgresDialect) MaxParameters() int {
+	return 65535
+}
+
+// IsTransient reports connection errors, and server errors of the classes that are about the
+// state of the server rather than the statement: connection exceptions (08), transaction
+// rollbacks such as deadlocks (40), insufficient resources (53) and operator intervention (57).
+func (PostgresDialect) IsTransient(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		case "08", "40", "53", "57":
+			return true
+		}
+		return false
+	}
+	return isTransientConnectionError(err)
+}
+
+// isTransientConnectionError tells if err is about the connection to the database rather than
+// what was sent through it.
+func isTransientConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &netErr)
+}
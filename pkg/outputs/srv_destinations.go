@@ -0,0 +1,177 @@
+package outputs
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// destinations of this form are discovered from the SRV records of the name that follows
+const srvDestinationPrefix = "srv:"
+
+// longest wait for an SRV lookup
+const srvLookupTimeout = 10 * time.Second
+
+// srvDestinations holds the targets advertised by the SRV records of a name, looked up again
+// every refreshInterval. When a lookup fails the targets of the last successful one are kept.
+type srvDestinations struct {
+	name            string
+	resolver        *net.Resolver
+	refreshInterval time.Duration
+
+	sync.Mutex
+	records      []*net.SRV
+	resolvedAt   time.Time
+	lookupErrors int64
+}
+
+func newSRVDestinations(name string, resolver *net.Resolver, refreshInterval time.Duration) *srvDestinations {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &srvDestinations{name: name, resolver: resolver, refreshInterval: refreshInterval}
+}
+
+// refreshDue tells if the records are older than the refresh interval.
+func (d *srvDestinations) refreshDue() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.refreshInterval > 0 && time.Since(d.resolvedAt) >= d.refreshInterval
+}
+
+// refresh looks up the records again.
+func (d *srvDestinations) refresh() error {
+	ctx, cancel := context.WithTimeout(context.Background(), srvLookupTimeout)
+	defer cancel()
+	_, records, err := d.resolver.LookupSRV(ctx, "", "", d.name)
+
+	d.Lock()
+	defer d.Unlock()
+	// a failed lookup is only tried again after another interval
+	d.resolvedAt = time.Now()
+	if err == nil && len(records) == 0 {
+		err = fmt.Errorf("no SRV records found for %s", d.name)
+	}
+	if err != nil {
+		d.lookupErrors++
+		if len(d.records) > 0 {
+			log.Warnf("Could not look up the SRV records of %s, keeping the %d targets found before: %s", d.name, len(d.records), err)
+			return nil
+		}
+		return err
+	}
+
+	// a single "." target means the service is not available at this domain
+	if len(records) == 1 && records[0].Target == "." {
+		return fmt.Errorf("%s is not available according to its SRV records", d.name)
+	}
+	d.records = records
+	return nil
+}
+
+// destinations returns the host:port addresses of the targets, in the order they should be
+// tried: by priority, and within each priority in a random order weighted as RFC 2782 describes,
+// so that every forwarder spreads its connections across the targets in proportion to their
+// weight. The records are looked up first if they are due for a refresh, or always when there is
+// no refresh interval.
+func (d *srvDestinations) destinations() ([]string, error) {
+	d.Lock()
+	stale := len(d.records) == 0 || time.Since(d.resolvedAt) >= d.refreshInterval
+	d.Unlock()
+	if stale {
+		if err := d.refresh(); err != nil {
+			return nil, err
+		}
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	return orderSRVRecords(d.records, rand.Int63n), nil
+}
+
+// shouldLeave tells if the connection to destination should be replaced: it is no longer
+// advertised, or a target of a better priority has appeared.
+func (d *srvDestinations) shouldLeave(destination string) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	best := -1
+	current := -1
+	for _, record := range d.records {
+		if best == -1 || int(record.Priority) < best {
+			best = int(record.Priority)
+		}
+		if srvAddress(record) == destination {
+			current = int(record.Priority)
+		}
+	}
+	return current == -1 || current > best
+}
+
+// statistics returns the targets and how many lookups failed.
+func (d *srvDestinations) statistics() ([]string, int64) {
+	d.Lock()
+	defer d.Unlock()
+
+	targets := make([]string, len(d.records))
+	for i, record := range d.records {
+		targets[i] = fmt.Sprintf("%s priority=%d weight=%d", srvAddress(record), record.Priority, record.Weight)
+	}
+	return targets, d.lookupErrors
+}
+
+func srvAddress(record *net.SRV) string {
+	return net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+}
+
+// orderSRVRecords orders the addresses of records by priority, and within the same priority
+// picks them one at a time with a probability proportional to their weight. Records of weight
+// 0 come after the rest of their priority, in a random order.
+func orderSRVRecords(records []*net.SRV, random func(n int64) int64) []string {
+	sorted := make([]*net.SRV, len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority < sorted[j].Priority })
+
+	addresses := make([]string, 0, len(sorted))
+	for start := 0; start < len(sorted); {
+		end := start
+		for end < len(sorted) && sorted[end].Priority == sorted[start].Priority {
+			end++
+		}
+
+		group := sorted[start:end]
+		for len(group) > 0 {
+			var total int64
+			for _, record := range group {
+				total += int64(record.Weight)
+			}
+
+			picked := 0
+			if total > 0 {
+				n := random(total)
+				for i, record := range group {
+					if n < int64(record.Weight) {
+						picked = i
+						break
+					}
+					n -= int64(record.Weight)
+				}
+			} else {
+				picked = int(random(int64(len(group))))
+			}
+
+			addresses = append(addresses, srvAddress(group[picked]))
+			group = append(group[:picked:picked], group[picked+1:]...)
+		}
+		start = end
+	}
+	return addresses
+}
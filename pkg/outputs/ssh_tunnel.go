@@ -0,0 +1,150 @@
+package outputs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// how often an idle tunnel is checked, so that a dead SSH server is noticed before events are
+// written to it
+const sshKeepaliveInterval = 30 * time.Second
+
+// sshTunnel dials connections through an SSH server. The SSH connection is opened on the first
+// dial and opened again by the next dial once it drops.
+type sshTunnel struct {
+	config *Configuration
+	client *ssh.Client
+	// closed once the SSH connection is gone
+	done chan struct{}
+
+	connectCount int64
+}
+
+func newSSHTunnel(cfg *Configuration) *sshTunnel {
+	return &sshTunnel{config: cfg}
+}
+
+// dial opens a connection to address from the SSH server. A failure closes the SSH connection,
+// so that it is established again on the next attempt.
+func (t *sshTunnel) dial(network, address string) (net.Conn, error) {
+	if !t.isOpen() {
+		if err := t.connect(); err != nil {
+			return nil, fmt.Errorf("SSH tunnel through %s: %s", t.config.SSHTunnelHost, err)
+		}
+	}
+
+	conn, err := t.client.Dial(network, address)
+	if err != nil {
+		t.close()
+		return nil, fmt.Errorf("SSH tunnel through %s: %s", t.config.SSHTunnelHost, err)
+	}
+	return conn, nil
+}
+
+func (t *sshTunnel) isOpen() bool {
+	if t.client == nil {
+		return false
+	}
+	select {
+	case <-t.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (t *sshTunnel) connect() error {
+	t.close()
+
+	hostKeyCallback, err := knownhosts.New(t.config.SSHTunnelKnownHostsFile)
+	if err != nil {
+		return fmt.Errorf("could not read known hosts: %s", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if len(t.config.SSHTunnelKeyFile) > 0 {
+		signer, err := readSSHKey(t.config.SSHTunnelKeyFile)
+		if err != nil {
+			return err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if t.config.SSHTunnelUseAgent {
+		agentConn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+		if err != nil {
+			return fmt.Errorf("could not connect to the SSH agent: %s", err)
+		}
+		// the agent is only needed while authenticating
+		defer agentConn.Close()
+		auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+	}
+
+	client, err := ssh.Dial("tcp", t.config.SSHTunnelHost, &ssh.ClientConfig{
+		User:            t.config.SSHTunnelUser,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	t.client = client
+	t.done = done
+	t.connectCount++
+	log.Infof("Opened SSH tunnel through %s", t.config.SSHTunnelHost)
+
+	go func() {
+		defer close(done)
+		client.Wait()
+		log.Infof("SSH tunnel through %s closed", t.config.SSHTunnelHost)
+	}()
+	go keepSSHAlive(client, done)
+	return nil
+}
+
+func keepSSHAlive(client *ssh.Client, done <-chan struct{}) {
+	ticker := time.NewTicker(sshKeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				client.Close()
+				return
+			}
+		}
+	}
+}
+
+func readSSHKey(path string) (ssh.Signer, error) {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read SSH key: %s", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse SSH key %s: %s", path, err)
+	}
+	return signer, nil
+}
+
+func (t *sshTunnel) close() {
+	if t.client != nil {
+		t.client.Close()
+		t.client = nil
+	}
+}
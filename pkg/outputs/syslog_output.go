@@ -1,6 +1,7 @@
 package outputs
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
@@ -27,20 +28,23 @@ type SyslogOutput struct {
 	connected                   bool
 	droppedEventCount           int64
 	droppedEventSinceConnection int64
+	truncatedEventCount         int64
+	errorLog                    *ErrorLogSampler
 
 	sync.RWMutex
 }
 
 func NewSyslogOutputFromConfig(cfg *Configuration) *SyslogOutput {
-	return &SyslogOutput{Config: cfg}
+	return &SyslogOutput{Config: cfg, errorLog: NewErrorLogSampler(cfg.ErrorLogBurst, cfg.ErrorLogInterval)}
 }
 
 type SyslogStatistics struct {
-	LastOpenTime       time.Time `json:"last_open_time"`
-	Protocol           string    `json:"protocol"`
-	RemoteHostnamePort string    `json:"remote_hostname_port"`
-	DroppedEventCount  int64     `json:"dropped_event_count"`
-	Connected          bool      `json:"connected"`
+	LastOpenTime        time.Time `json:"last_open_time"`
+	Protocol            string    `json:"protocol"`
+	RemoteHostnamePort  string    `json:"remote_hostname_port"`
+	DroppedEventCount   int64     `json:"dropped_event_count"`
+	TruncatedEventCount int64     `json:"truncated_event_count"`
+	Connected           bool      `json:"connected"`
 }
 
 // Initialize() expects a connection string in the following format:
@@ -67,6 +71,19 @@ func (o *SyslogOutput) Initialize(netConn string) error {
 		return fmt.Errorf("Error connecting to '%s': %s", netConn, err)
 	}
 
+	if o.Config.SyslogRFC5424 {
+		// udp messages are single datagrams (RFC 5426), stream transports use octet counting (RFC 5425)
+		maxSize := 0
+		if o.protocol == "udp" {
+			maxSize = o.Config.SyslogMaxMessageSize
+		} else {
+			o.outputSocket.SetFramer(syslog.RFC5425MessageLengthFramer)
+		}
+		o.outputSocket.SetFormatter(newRFC5424Formatter(o.Config, maxSize, func() {
+			atomic.AddInt64(&o.truncatedEventCount, 1)
+		}).Format)
+	}
+
 	o.markConnected()
 
 	return nil
@@ -88,11 +105,12 @@ func (o *SyslogOutput) Statistics() interface{} {
 	defer o.RUnlock()
 
 	return SyslogStatistics{
-		LastOpenTime:       o.connectTime,
-		Protocol:           o.protocol,
-		RemoteHostnamePort: o.hostnamePort,
-		DroppedEventCount:  o.droppedEventCount,
-		Connected:          o.connected,
+		LastOpenTime:        o.connectTime,
+		Protocol:            o.protocol,
+		RemoteHostnamePort:  o.hostnamePort,
+		DroppedEventCount:   o.droppedEventCount,
+		TruncatedEventCount: atomic.LoadInt64(&o.truncatedEventCount),
+		Connected:           o.connected,
 	}
 }
 
@@ -128,7 +146,7 @@ func (o *SyslogOutput) output(m string) error {
 		return nil
 	}
 
-	err := o.outputSocket.Info(m)
+	_, err := o.outputSocket.WriteWithPriority(o.priority(m), []byte(m))
 	if err != nil {
 		o.closeAndScheduleReconnection()
 		atomic.AddInt64(&o.droppedEventCount, 1)
@@ -137,6 +155,55 @@ func (o *SyslogOutput) output(m string) error {
 	return err
 }
 
+// Verify sends a single event and closes the connection.
+func (o *SyslogOutput) Verify(message string) error {
+	if !o.connected {
+		return fmt.Errorf("Not connected to %s", o.hostnamePort)
+	}
+	if err := o.output(message); err != nil {
+		return err
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	o.connected = false
+	return o.outputSocket.Close()
+}
+
+// priority computes the PRI value of a message from the configured facility and the
+// severity of the first rule matching the event's type and score.
+func (o *SyslogOutput) priority(m string) syslog.Priority {
+	return syslog.Priority(o.Config.SyslogFacility<<3 | eventSyslogSeverity(o.Config, m))
+}
+
+// eventSyslogSeverity returns the severity of the first of the configured rules matching the
+// event's type and score, or the default severity.
+func eventSyslogSeverity(cfg *Configuration, m string) int {
+	if len(cfg.SyslogSeverityRules) > 0 {
+		var event struct {
+			Type        string   `json:"type"`
+			ReportScore *float64 `json:"report_score"`
+			Score       *float64 `json:"score"`
+		}
+		if err := json.Unmarshal([]byte(m), &event); err == nil {
+			score, hasScore := 0.0, false
+			if event.ReportScore != nil {
+				score, hasScore = *event.ReportScore, true
+			} else if event.Score != nil {
+				score, hasScore = *event.Score, true
+			}
+
+			for _, rule := range cfg.SyslogSeverityRules {
+				if rule.Matches(event.Type, score, hasScore) {
+					return rule.Severity
+				}
+			}
+		}
+	}
+
+	return cfg.SyslogDefaultSeverity
+}
+
 func (o *SyslogOutput) Go(messages <-chan string, signals <-chan os.Signal, exitCond *sync.Cond) error {
 	if o.outputSocket == nil {
 		return errors.New("Output socket not open")
@@ -151,7 +218,7 @@ func (o *SyslogOutput) Go(messages <-chan string, signals <-chan os.Signal, exit
 			select {
 			case message := <-messages:
 				if err := o.output(message); err != nil && !o.Config.DryRun {
-					log.Errorf("%s", err)
+					o.errorLog.Errorf("%s", err)
 				}
 
 			case <-refreshTicker.C:
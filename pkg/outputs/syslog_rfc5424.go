@@ -0,0 +1,147 @@
+package outputs
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	syslog "github.com/RackSec/srslog"
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+)
+
+const syslogAppName = "cb-event-forwarder"
+
+// rfc5424Formatter builds RFC 5424 messages: the event is the MSG, its type the MSGID, and the
+// configured event fields go into a single SD-ELEMENT. When maxSize is not zero, messages are
+// truncated to maxSize bytes and onTruncate is called for each of them.
+type rfc5424Formatter struct {
+	hostname   string
+	sdID       string
+	sdFields   []string
+	maxSize    int
+	onTruncate func()
+}
+
+func newRFC5424Formatter(cfg *Configuration, maxSize int, onTruncate func()) *rfc5424Formatter {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = ""
+	}
+	return &rfc5424Formatter{
+		hostname:   rfc5424HeaderField(hostname, 255),
+		sdID:       cfg.SyslogStructuredDataID,
+		sdFields:   cfg.SyslogStructuredDataFields,
+		maxSize:    maxSize,
+		onTruncate: onTruncate,
+	}
+}
+
+// Format implements srslog.Formatter. The hostname and tag of the writer are ignored, the
+// dialer sets the hostname to the local address of the connection.
+func (f *rfc5424Formatter) Format(p syslog.Priority, _, _, content string) string {
+	// the writer terminates every message with a newline, which is not part of the event
+	content = strings.TrimSuffix(content, "\n")
+
+	var event map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(content), &event); err != nil {
+		event = nil
+	}
+
+	msgID := "-"
+	if raw, ok := event["type"]; ok {
+		var eventType string
+		if json.Unmarshal(raw, &eventType) == nil {
+			msgID = rfc5424HeaderField(eventType, 32)
+		}
+	}
+
+	header := "<" + strconv.Itoa(int(p)) + ">1 " + time.Now().UTC().Format("2006-01-02T15:04:05.000000Z07:00") + " " +
+		f.hostname + " " + syslogAppName + " " + strconv.Itoa(os.Getpid()) + " " + msgID + " "
+	structuredData := f.structuredData(event)
+
+	if f.maxSize == 0 || len(header)+len(structuredData)+1+len(content) <= f.maxSize {
+		return header + structuredData + " " + content
+	}
+
+	f.onTruncate()
+	if len(header)+len(structuredData)+1 > f.maxSize {
+		// keep as much of the event as possible rather than its copied fields
+		structuredData = "-"
+	}
+	return header + structuredData + " " + truncateUTF8(content, f.maxSize-len(header)-len(structuredData)-1)
+}
+
+// structuredData returns the SD-ELEMENT with the configured fields present in the event, or
+// the NILVALUE. String fields are copied as is, any other field as its JSON text.
+func (f *rfc5424Formatter) structuredData(event map[string]json.RawMessage) string {
+	var sd strings.Builder
+	for _, field := range f.sdFields {
+		raw, ok := event[field]
+		if !ok {
+			continue
+		}
+		value := string(raw)
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			value = s
+		}
+
+		if sd.Len() == 0 {
+			sd.WriteString("[" + f.sdID)
+		}
+		sd.WriteString(" " + field + "=\"" + escapeSDParamValue(value) + "\"")
+	}
+	if sd.Len() == 0 {
+		return "-"
+	}
+	sd.WriteString("]")
+	return sd.String()
+}
+
+// escapeSDParamValue escapes the characters that RFC 5424 requires to be escaped in a
+// PARAM-VALUE.
+func escapeSDParamValue(value string) string {
+	if !strings.ContainsAny(value, "\"\\]") {
+		return value
+	}
+	var escaped strings.Builder
+	for _, r := range value {
+		if r == '"' || r == '\\' || r == ']' {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+// rfc5424HeaderField returns value as a header field of at most maxLen printable ASCII
+// characters, replacing any other character with '_', or the NILVALUE if value is empty.
+func rfc5424HeaderField(value string, maxLen int) string {
+	if len(value) == 0 {
+		return "-"
+	}
+	if len(value) > maxLen {
+		value = value[:maxLen]
+	}
+	field := []byte(value)
+	for i, c := range field {
+		if c < 33 || c > 126 {
+			field[i] = '_'
+		}
+	}
+	return string(field)
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a multi-byte character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
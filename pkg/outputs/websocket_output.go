@@ -0,0 +1,314 @@
+package outputs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+)
+
+// longest time a single message may take to be written before the connection is considered dead
+const websocketWriteTimeout = 30 * time.Second
+
+// pingCodec sends an empty ping frame
+var pingCodec = websocket.Codec{Marshal: func(interface{}) ([]byte, byte, error) {
+	return nil, websocket.PingFrame, nil
+}}
+
+type WebSocketOutput struct {
+	url    string
+	socket *websocket.Conn
+	// closed once the goroutine reading from the connection sees it closed
+	readerDone chan struct{}
+
+	connectTime                 time.Time
+	reconnectTime               time.Time
+	lastPingTime                time.Time
+	connected                   bool
+	droppedEventCount           int64
+	droppedEventSinceConnection int64
+	sentMessageCount            int64
+	bytesSent                   int64
+	reconnectCount              int64
+	pingCount                   int64
+	latency                     *DeliveryLatency
+	Config                      *Configuration
+	errorLog                    *ErrorLogSampler
+
+	sync.RWMutex
+}
+
+type WebSocketStatistics struct {
+	LastOpenTime      time.Time `json:"last_open_time"`
+	URL               string    `json:"url"`
+	Connected         bool      `json:"connected"`
+	DroppedEventCount int64     `json:"dropped_event_count"`
+	SentMessageCount  int64     `json:"sent_message_count"`
+	BytesSent         int64     `json:"bytes_sent"`
+	ReconnectCount    int64     `json:"reconnect_count"`
+	PingCount         int64     `json:"ping_count"`
+
+	DeliveryLatency DeliveryLatencyStatistics `json:"delivery_latency"`
+}
+
+func (s WebSocketStatistics) Sent() int64       { return s.SentMessageCount }
+func (s WebSocketStatistics) Dropped() int64    { return s.DroppedEventCount }
+func (s WebSocketStatistics) Reconnects() int64 { return s.ReconnectCount }
+
+func NewWebSocketOutputFromConfig(cfg *Configuration) *WebSocketOutput {
+	return &WebSocketOutput{Config: cfg, errorLog: NewErrorLogSampler(cfg.ErrorLogBurst, cfg.ErrorLogInterval), latency: NewDeliveryLatency()}
+}
+
+// Initialize() expects the URL of the collector, for example:
+// wss://collector.example.com:8443/events
+func (o *WebSocketOutput) Initialize(wsURL string) error {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.connected {
+		o.socket.Close()
+		o.connected = false
+	}
+	o.url = wsURL
+
+	wsConfig, err := o.dialConfig()
+	if err != nil {
+		return fmt.Errorf("Error connecting to '%s': %s", wsURL, err)
+	}
+	o.socket, err = websocket.DialConfig(wsConfig)
+	if err != nil {
+		return fmt.Errorf("Error connecting to '%s': %s", wsURL, err)
+	}
+
+	// reading answers the collector's pings and notices when it closes the connection; anything
+	// else it sends is ignored
+	readerDone := make(chan struct{})
+	o.readerDone = readerDone
+	go func(socket *websocket.Conn) {
+		defer close(readerDone)
+		io.Copy(ioutil.Discard, socket)
+	}(o.socket)
+
+	o.markConnected()
+
+	return nil
+}
+
+func (o *WebSocketOutput) dialConfig() (*websocket.Config, error) {
+	location, err := url.ParseRequestURI(o.url)
+	if err != nil {
+		return nil, err
+	}
+	if location.Scheme != "ws" && location.Scheme != "wss" {
+		return nil, fmt.Errorf("unsupported scheme %s (ws or wss)", location.Scheme)
+	}
+
+	origin := o.Config.WebSocketOrigin
+	if len(origin) == 0 {
+		// the collector's own address, as seen by a browser
+		origin = strings.Replace(location.Scheme, "ws", "http", 1) + "://" + location.Host
+	}
+	originURL, err := url.ParseRequestURI(origin)
+	if err != nil {
+		return nil, fmt.Errorf("invalid origin: %s", err)
+	}
+
+	wsConfig := &websocket.Config{
+		Location:  location,
+		Origin:    originURL,
+		Protocol:  o.Config.WebSocketSubprotocols,
+		Version:   websocket.ProtocolVersionHybi13,
+		TlsConfig: o.Config.TLSConfig,
+		Header:    http.Header{},
+	}
+	for name, values := range o.Config.WebSocketHeaders {
+		wsConfig.Header[name] = append([]string(nil), values...)
+	}
+	return wsConfig, nil
+}
+
+func (o *WebSocketOutput) markConnected() {
+	o.connectTime = time.Now()
+	o.lastPingTime = o.connectTime
+	log.Infof("Connected to %s at %s.", o.url, o.connectTime)
+	o.connected = true
+	if o.droppedEventCount != o.droppedEventSinceConnection {
+		log.Infof("Dropped %d events since the last reconnection.",
+			o.droppedEventCount-o.droppedEventSinceConnection)
+		o.droppedEventSinceConnection = o.droppedEventCount
+	}
+}
+
+// close is called on shutdown, and sends a close frame before closing the connection.
+func (o *WebSocketOutput) close() {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.connected {
+		o.socket.Close()
+		o.connected = false
+	}
+}
+
+func (o *WebSocketOutput) closeAndScheduleReconnection() {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.connected {
+		o.socket.Close()
+		o.connected = false
+	}
+
+	// try reconnecting in 5 seconds
+	o.reconnectTime = time.Now().Add(time.Duration(5 * time.Second))
+
+	log.Infof("Lost connection to %s. Will try to reconnect at %s.", o.url, o.reconnectTime)
+}
+
+func (o *WebSocketOutput) Key() string {
+	o.RLock()
+	defer o.RUnlock()
+
+	return o.url
+}
+
+func (o *WebSocketOutput) String() string {
+	o.RLock()
+	defer o.RUnlock()
+
+	return o.url
+}
+
+func (o *WebSocketOutput) Statistics() interface{} {
+	o.RLock()
+	defer o.RUnlock()
+
+	return WebSocketStatistics{
+		LastOpenTime:      o.connectTime,
+		URL:               o.url,
+		Connected:         o.connected,
+		DroppedEventCount: atomic.LoadInt64(&o.droppedEventCount),
+		SentMessageCount:  atomic.LoadInt64(&o.sentMessageCount),
+		BytesSent:         atomic.LoadInt64(&o.bytesSent),
+		ReconnectCount:    atomic.LoadInt64(&o.reconnectCount),
+		PingCount:         atomic.LoadInt64(&o.pingCount),
+
+		DeliveryLatency: o.latency.Statistics(),
+	}
+}
+
+func (o *WebSocketOutput) output(m string) error {
+	if !o.connected {
+		// drop this event on the floor...
+		atomic.AddInt64(&o.droppedEventCount, 1)
+		return nil
+	}
+
+	var message interface{} = m
+	if o.Config.WebSocketBinaryMessages {
+		message = []byte(m)
+	}
+
+	o.socket.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+	if err := websocket.Message.Send(o.socket, message); err != nil {
+		o.closeAndScheduleReconnection()
+		atomic.AddInt64(&o.droppedEventCount, 1)
+		return err
+	}
+	atomic.AddInt64(&o.sentMessageCount, 1)
+	atomic.AddInt64(&o.bytesSent, int64(len(m)))
+	o.latency.delivered()
+	return nil
+}
+
+// ping keeps an idle connection open through proxies and load balancers, and notices a
+// connection that has silently gone away.
+func (o *WebSocketOutput) ping() {
+	o.lastPingTime = time.Now()
+	o.socket.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+	if err := pingCodec.Send(o.socket, nil); err != nil {
+		o.errorLog.Errorf("Could not ping %s: %s", o.url, err)
+		o.closeAndScheduleReconnection()
+		return
+	}
+	atomic.AddInt64(&o.pingCount, 1)
+}
+
+// Verify sends a single event and closes the connection.
+func (o *WebSocketOutput) Verify(message string) error {
+	if !o.connected {
+		return fmt.Errorf("Not connected to %s", o.url)
+	}
+	if err := o.output(message); err != nil {
+		return err
+	}
+	o.close()
+	return nil
+}
+
+func (o *WebSocketOutput) DeliveryLatency() *DeliveryLatency {
+	return o.latency
+}
+
+func (o *WebSocketOutput) Go(messages <-chan string, signals <-chan os.Signal, exitCond *sync.Cond) error {
+	if o.socket == nil {
+		return errors.New("WebSocket not open")
+	}
+
+	go func() {
+		refreshTicker := time.NewTicker(1 * time.Second)
+		defer exitCond.Signal()
+		defer refreshTicker.Stop()
+
+		for {
+			select {
+			case message := <-messages:
+				o.latency.next()
+				if err := o.output(message); err != nil && !o.Config.DryRun {
+					o.errorLog.Errorf("%s", err)
+				}
+
+			case <-o.readerDone:
+				if o.connected {
+					o.closeAndScheduleReconnection()
+				}
+				o.readerDone = nil
+
+			case <-refreshTicker.C:
+				interval := o.Config.WebSocketPingInterval
+				if o.connected && interval > 0 && time.Since(o.lastPingTime) >= interval {
+					o.ping()
+				}
+				if !o.connected && time.Now().After(o.reconnectTime) {
+					atomic.AddInt64(&o.reconnectCount, 1)
+					if err := o.Initialize(o.url); err != nil {
+						o.errorLog.Errorf("%s", err)
+						o.closeAndScheduleReconnection()
+					}
+				}
+
+			case signal := <-signals:
+				switch signal {
+				case syscall.SIGTERM, syscall.SIGINT:
+					log.Infof("WebSocket output handling SIGTERM")
+					o.close()
+					return
+				}
+			}
+		}
+	}()
+
+	return nil
+}
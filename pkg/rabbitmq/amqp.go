@@ -3,6 +3,8 @@ package rabbitmq
 import (
 	"crypto/tls"
 	"fmt"
+	"sync"
+
 	log "github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
 )
@@ -24,6 +26,11 @@ type Consumer struct {
 	routingKeys       []string
 	dialer            AMQPDialer
 	ConnectionErrors  chan *amqp.Error
+
+	// with manual acking the broker stops sending once prefetchCount deliveries are unacked
+	manualAck     bool
+	prefetchMutex sync.Mutex
+	prefetchCount int
 }
 
 type AMQPConnection interface {
@@ -33,6 +40,7 @@ type AMQPConnection interface {
 }
 
 type AMQPChannel interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
 	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
 	Cancel(consumer string, noWait bool) error
 	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
@@ -76,6 +84,30 @@ func NewConsumerWithTlsCfg(amqpURI, queueName, ctag string, bindToRawExchange bo
 	return c
 }
 
+// UseManualAcking makes the consumer ack deliveries explicitly, with at most prefetchCount of
+// them unacked at a time. Must be called before Connect.
+func (c *Consumer) UseManualAcking(prefetchCount int) {
+	c.manualAck = true
+	c.prefetchCount = prefetchCount
+}
+
+func (c *Consumer) ManualAcking() bool {
+	return c.manualAck
+}
+
+// SetPrefetch changes how many unacked deliveries the broker sends before waiting for acks.
+// It has no effect with automatic acking.
+func (c *Consumer) SetPrefetch(prefetchCount int) error {
+	c.prefetchMutex.Lock()
+	defer c.prefetchMutex.Unlock()
+
+	c.prefetchCount = prefetchCount
+	if !c.manualAck || c.channel == nil {
+		return nil
+	}
+	return c.channel.Qos(prefetchCount, 0, false)
+}
+
 func (c *Consumer) DialAMQP() error {
 	var err error = nil
 	if c.tlsCfg != nil {
@@ -101,7 +133,12 @@ func (c *Consumer) Connect() (deliveries <-chan amqp.Delivery, err error) {
 	if err != nil {
 		return deliveries, err
 	}
+	c.prefetchMutex.Lock()
 	c.channel, err = c.conn.Channel()
+	if err == nil && c.manualAck {
+		err = c.channel.Qos(c.prefetchCount, 0, false)
+	}
+	c.prefetchMutex.Unlock()
 	if err != nil {
 		return deliveries, err
 	}
@@ -137,11 +174,11 @@ func (c *Consumer) Connect() (deliveries <-chan amqp.Delivery, err error) {
 	deliveries, err = c.channel.Consume(
 		queue.Name,
 		c.tag,
-		true,  // automatic or manual acking
-		false, // exclusive
-		false, // noLocal
-		false, // noWait
-		nil,   // arguments
+		!c.manualAck, // automatic or manual acking
+		false,        // exclusive
+		false,        // noLocal
+		false,        // noWait
+		nil,          // arguments
 	)
 
 	if err != nil {
@@ -47,8 +47,9 @@ func (mock *MockAMQPQueue) String() string {
 }
 
 type MockAMQPChannel struct {
-	Closed bool
-	Queues []MockAMQPQueue
+	Closed        bool
+	Queues        []MockAMQPQueue
+	PrefetchCount int
 	sync.RWMutex
 }
 
@@ -100,6 +101,13 @@ func (mock *MockAMQPChannel) QueueBind(name, key, exchange string, noWait bool,
 	return nil
 }
 
+func (mock *MockAMQPChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	mock.Lock()
+	mock.PrefetchCount = prefetchCount
+	mock.Unlock()
+	return nil
+}
+
 func (mock MockAMQPChannel) Cancel(consumer string, noWait bool) error {
 	return nil
 }
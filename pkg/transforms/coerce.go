@@ -0,0 +1,233 @@
+package transforms
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// CoercionType is the type a field is converted to.
+type CoercionType string
+
+const (
+	CoerceToString CoercionType = "string"
+	CoerceToInt    CoercionType = "int"
+	CoerceToFloat  CoercionType = "float"
+	CoerceToBool   CoercionType = "bool"
+)
+
+// CoercionFailurePolicy controls what happens to a field whose value can't be converted.
+type CoercionFailurePolicy string
+
+const (
+	// KeepUncoercible leaves the field with its original value
+	KeepUncoercible CoercionFailurePolicy = "keep"
+	// DropUncoercible removes the field from the event
+	DropUncoercible CoercionFailurePolicy = "drop"
+)
+
+func CoercionFailurePolicyFromString(policyString string) (CoercionFailurePolicy, error) {
+	switch CoercionFailurePolicy(strings.ToLower(strings.TrimSpace(policyString))) {
+	case KeepUncoercible:
+		return KeepUncoercible, nil
+	case DropUncoercible:
+		return DropUncoercible, nil
+	default:
+		return KeepUncoercible, fmt.Errorf("coercion failure policy %s not recognized (keep or drop)", policyString)
+	}
+}
+
+type coercion struct {
+	path   fieldPath
+	target CoercionType
+}
+
+// Coercions converts fields of an event to the types expected by the destination, so that
+// fields sent with inconsistent types are not rejected on ingestion.
+type Coercions struct {
+	fields []coercion
+	policy CoercionFailurePolicy
+}
+
+// ParseCoercions parses a comma separated list of <field>:<type> pairs, where field is a dotted
+// path and type is one of string, int, float or bool.
+func ParseCoercions(spec string, policy CoercionFailurePolicy) (*Coercions, error) {
+	coercions := &Coercions{policy: policy}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+
+		separator := strings.LastIndex(pair, ":")
+		if separator < 0 {
+			return nil, fmt.Errorf("coercion %s should be <field>:<type>", pair)
+		}
+		field := strings.TrimSpace(pair[:separator])
+		target := CoercionType(strings.ToLower(strings.TrimSpace(pair[separator+1:])))
+
+		path := fieldPath(strings.Split(field, "."))
+		for _, key := range path {
+			if len(key) == 0 {
+				return nil, fmt.Errorf("invalid field %q in coercion %s", field, pair)
+			}
+		}
+		switch target {
+		case CoerceToString, CoerceToInt, CoerceToFloat, CoerceToBool:
+		default:
+			return nil, fmt.Errorf("unknown type %s for %s (string, int, float or bool)", target, field)
+		}
+		coercions.fields = append(coercions.fields, coercion{path: path, target: target})
+	}
+
+	if len(coercions.fields) == 0 {
+		return nil, fmt.Errorf("no fields to coerce")
+	}
+	return coercions, nil
+}
+
+// Apply converts every configured field present in event, modifying it in place. Missing and
+// null fields are left alone. Fields that can't be converted are kept or removed depending on
+// the failure policy, and reported in the returned error.
+func (c *Coercions) Apply(event map[string]interface{}) error {
+	return c.ApplyTracked(event, nil)
+}
+
+// ApplyTracked converts the fields of event like Apply, recording its writes in writes. Under the
+// first-wins policy fields that another stage wrote are left as they are; under the error policy
+// converting one fails with a ConflictError, leaving the event partially converted.
+func (c *Coercions) ApplyTracked(event map[string]interface{}, writes *FieldWrites) error {
+	var failed []string
+	for _, field := range c.fields {
+		value, ok := field.path.lookup(event)
+		if !ok || value == nil {
+			continue
+		}
+
+		converted, err := coerce(value, field.target)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", field.path, err))
+			if c.policy != DropUncoercible {
+				continue
+			}
+		} else if converted == value {
+			// a field that already has the type is not written
+			continue
+		}
+
+		if ok, claimErr := writes.claim(field.path); !ok {
+			if claimErr != nil {
+				return claimErr
+			}
+			continue
+		}
+		if err != nil {
+			field.path.remove(event)
+			continue
+		}
+		if err := field.path.set(event, converted); err != nil {
+			return err
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("could not coerce %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func coerce(value interface{}, target CoercionType) (interface{}, error) {
+	switch target {
+	case CoerceToString:
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case json.Number:
+			return v.String(), nil
+		case bool:
+			return strconv.FormatBool(v), nil
+		}
+
+	case CoerceToInt:
+		var f float64
+		switch v := value.(type) {
+		case json.Number:
+			if _, err := v.Int64(); err == nil {
+				return v, nil
+			}
+			f, _ = v.Float64()
+		case string:
+			s := strings.TrimSpace(v)
+			if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return json.Number(strconv.FormatInt(i, 10)), nil
+			}
+			var err error
+			if f, err = strconv.ParseFloat(s, 64); err != nil {
+				return nil, fmt.Errorf("%q is not a number", v)
+			}
+		case bool:
+			if v {
+				return json.Number("1"), nil
+			}
+			return json.Number("0"), nil
+		default:
+			return nil, fmt.Errorf("%s can't be converted to %s", describe(value), target)
+		}
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			return nil, fmt.Errorf("%v is not an integer", value)
+		}
+		return json.Number(strconv.FormatInt(int64(f), 10)), nil
+
+	case CoerceToFloat:
+		switch v := value.(type) {
+		case json.Number:
+			return v, nil
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+				return nil, fmt.Errorf("%q is not a number", v)
+			}
+			return fromNumber(f), nil
+		case bool:
+			if v {
+				return json.Number("1"), nil
+			}
+			return json.Number("0"), nil
+		}
+
+	case CoerceToBool:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			switch strings.ToLower(strings.TrimSpace(v)) {
+			case "true", "1", "yes", "on":
+				return true, nil
+			case "false", "0", "no", "off":
+				return false, nil
+			}
+			return nil, fmt.Errorf("%q is not a boolean", v)
+		case json.Number:
+			switch f, _ := v.Float64(); f {
+			case 0:
+				return false, nil
+			case 1:
+				return true, nil
+			}
+			return nil, fmt.Errorf("%s is not a boolean", v)
+		}
+	}
+	return nil, fmt.Errorf("%s can't be converted to %s", describe(value), target)
+}
+
+func describe(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	}
+	return fmt.Sprintf("%v", value)
+}
@@ -0,0 +1,96 @@
+package transforms
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConflictPolicy decides what happens when two stages of a pipeline write the same field of an
+// event, or when two fields are flattened into the same key.
+type ConflictPolicy string
+
+const (
+	// LastWriteWins keeps the value written last
+	LastWriteWins ConflictPolicy = "last-wins"
+	// FirstWriteWins keeps the value written first, ignoring later writes to the field
+	FirstWriteWins ConflictPolicy = "first-wins"
+	// FailOnConflict fails the event with a ConflictError
+	FailOnConflict ConflictPolicy = "error"
+)
+
+func ConflictPolicyFromString(policyString string) (ConflictPolicy, error) {
+	switch ConflictPolicy(strings.ToLower(strings.TrimSpace(policyString))) {
+	case LastWriteWins:
+		return LastWriteWins, nil
+	case FirstWriteWins:
+		return FirstWriteWins, nil
+	case FailOnConflict:
+		return FailOnConflict, nil
+	default:
+		return LastWriteWins, fmt.Errorf("conflict policy %s not recognized (last-wins, first-wins or error)", policyString)
+	}
+}
+
+// TracksWrites reports whether the policy needs to know which stage wrote each field.
+func (policy ConflictPolicy) TracksWrites() bool {
+	return policy == FirstWriteWins || policy == FailOnConflict
+}
+
+// ConflictError is the error of an event that two writers changed the same field of, under the
+// error conflict policy.
+type ConflictError struct {
+	Field string
+	// the writers of the field, in order: pipeline stages, or the fields flattened into it
+	First, Second string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("conflicting writes to %s by %s and %s", e.Field, e.First, e.Second)
+}
+
+// FieldWrites records which stage of a pipeline wrote each field of an event, so that a field
+// written by more than one stage is resolved with the conflict policy. Writes are tracked by
+// field path, so a stage replacing a whole object doesn't conflict with another one writing a
+// field inside it. A nil FieldWrites tracks nothing and lets every write through.
+type FieldWrites struct {
+	policy  ConflictPolicy
+	stage   string
+	writers map[string]string
+}
+
+// NewFieldWrites returns the record of the writes to a single event, or nil under the
+// last-wins policy, which doesn't need one.
+func NewFieldWrites(policy ConflictPolicy) *FieldWrites {
+	if !policy.TracksWrites() {
+		return nil
+	}
+	return &FieldWrites{policy: policy, writers: make(map[string]string)}
+}
+
+// Stage sets the stage that the next writes are made by.
+func (w *FieldWrites) Stage(stage string) {
+	if w != nil {
+		w.stage = stage
+	}
+}
+
+// claim reports whether the current stage may write the fields at paths, recording the writes
+// when it may. Writing again a field that the same stage wrote is never a conflict.
+func (w *FieldWrites) claim(paths ...fieldPath) (bool, error) {
+	if w == nil {
+		return true, nil
+	}
+	for _, path := range paths {
+		field := path.String()
+		if writer, ok := w.writers[field]; ok && writer != w.stage {
+			if w.policy == FailOnConflict {
+				return false, &ConflictError{Field: field, First: writer, Second: w.stage}
+			}
+			return false, nil
+		}
+	}
+	for _, path := range paths {
+		w.writers[path.String()] = w.stage
+	}
+	return true, nil
+}
@@ -0,0 +1,401 @@
+package transforms
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenSeparator
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenPunct
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value string
+	pos   int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of script"
+	case tokenSeparator:
+		return "end of statement"
+	}
+	return fmt.Sprintf("'%s'", t.text)
+}
+
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	runes := []rune(src)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+
+		switch {
+		case r == '\n' || r == ';':
+			tokens = append(tokens, token{kind: tokenSeparator, text: string(r), pos: start})
+			i++
+		case unicode.IsSpace(r):
+			i++
+		case r == '#':
+			// comment until the end of the line
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+		case r == '"' || r == '\'':
+			var value strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+					switch runes[i] {
+					case 'n':
+						value.WriteRune('\n')
+					case 't':
+						value.WriteRune('\t')
+					default:
+						value.WriteRune(runes[i])
+					}
+					continue
+				}
+				value.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			tokens = append(tokens, token{kind: tokenString, text: string(runes[start:i]), value: value.String(), pos: start})
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: string(runes[start:i]), pos: start})
+		case unicode.IsLetter(r) || r == '_':
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: string(runes[start:i]), pos: start})
+		default:
+			text := string(r)
+			if i+1 < len(runes) {
+				if two := string(runes[i : i+2]); two == "==" || two == "!=" || two == "<=" || two == ">=" {
+					text = two
+				}
+			}
+			if !strings.Contains("()=,<>+", text) && len(text) == 1 {
+				return nil, fmt.Errorf("unexpected character '%s' at position %d", text, start)
+			}
+			i += len(text)
+			tokens = append(tokens, token{kind: tokenPunct, text: text, pos: start})
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(runes)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isKeyword(keyword string) bool {
+	t := p.peek()
+	return t.kind == tokenIdent && t.text == keyword
+}
+
+func (p *parser) isPunct(punct string) bool {
+	t := p.peek()
+	return t.kind == tokenPunct && t.text == punct
+}
+
+func (p *parser) expectKeyword(keyword string) error {
+	if !p.isKeyword(keyword) {
+		return fmt.Errorf("expected '%s' at position %d, found %s", keyword, p.peek().pos, p.peek())
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) expectPunct(punct string) error {
+	if !p.isPunct(punct) {
+		return fmt.Errorf("expected '%s' at position %d, found %s", punct, p.peek().pos, p.peek())
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) parseProgram() ([]statement, error) {
+	var statements []statement
+	for {
+		for p.peek().kind == tokenSeparator {
+			p.next()
+		}
+		if p.peek().kind == tokenEOF {
+			return statements, nil
+		}
+
+		stmt, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, stmt)
+
+		if t := p.peek(); t.kind != tokenSeparator && t.kind != tokenEOF {
+			return nil, fmt.Errorf("unexpected %s at position %d", t, t.pos)
+		}
+	}
+}
+
+func (p *parser) parsePath() (fieldPath, error) {
+	t := p.next()
+	if t.kind != tokenIdent || isReserved(t.text) {
+		return nil, fmt.Errorf("expected a field name at position %d, found %s", t.pos, t)
+	}
+	for _, part := range strings.Split(t.text, ".") {
+		if len(part) == 0 {
+			return nil, fmt.Errorf("invalid field name '%s' at position %d", t.text, t.pos)
+		}
+	}
+	return fieldPath(strings.Split(t.text, ".")), nil
+}
+
+func (p *parser) parseStatement() (statement, error) {
+	t := p.next()
+	if t.kind != tokenIdent {
+		return nil, fmt.Errorf("expected a statement at position %d, found %s", t.pos, t)
+	}
+
+	switch t.text {
+	case "set":
+		target, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct("="); err != nil {
+			return nil, err
+		}
+		value, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		return setStatement{target: target, value: value}, nil
+
+	case "rename", "copy":
+		source, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("to"); err != nil {
+			return nil, err
+		}
+		target, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		return moveStatement{source: source, target: target, keepSource: t.text == "copy"}, nil
+
+	case "delete":
+		target, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		return deleteStatement{target: target}, nil
+
+	case "if":
+		cond, err := p.parseCondition()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("then"); err != nil {
+			return nil, err
+		}
+		body, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		return ifStatement{condition: cond, body: body}, nil
+	}
+
+	return nil, fmt.Errorf("unknown statement '%s' at position %d", t.text, t.pos)
+}
+
+func (p *parser) parseCondition() (condition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orCondition{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (condition, error) {
+	left, err := p.parseUnaryCondition()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("and") {
+		p.next()
+		right, err := p.parseUnaryCondition()
+		if err != nil {
+			return nil, err
+		}
+		left = andCondition{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnaryCondition() (condition, error) {
+	switch {
+	case p.isKeyword("not"):
+		p.next()
+		cond, err := p.parseUnaryCondition()
+		if err != nil {
+			return nil, err
+		}
+		return notCondition{cond}, nil
+	case p.isKeyword("exists"):
+		p.next()
+		path, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		return existsCondition{path}, nil
+	}
+
+	left, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	if t.kind == tokenPunct {
+		switch t.text {
+		case "==", "!=", "<", ">", "<=", ">=":
+			p.next()
+			right, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			return comparison{op: t.text, left: left, right: right}, nil
+		}
+	}
+	return truthyCondition{left}, nil
+}
+
+func (p *parser) parseExpression() (expression, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for p.isPunct("+") {
+		p.next()
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = addExpression{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseTerm() (expression, error) {
+	t := p.peek()
+
+	switch t.kind {
+	case tokenString:
+		p.next()
+		return literal{t.value}, nil
+	case tokenNumber:
+		p.next()
+		return literal{json.Number(t.text)}, nil
+	case tokenPunct:
+		if t.text == "(" {
+			p.next()
+			expr, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			return expr, p.expectPunct(")")
+		}
+	case tokenIdent:
+		switch t.text {
+		case "true", "false":
+			p.next()
+			return literal{t.text == "true"}, nil
+		case "null":
+			p.next()
+			return literal{nil}, nil
+		}
+
+		if fn, ok := functions[t.text]; ok && p.tokens[p.pos+1].kind == tokenPunct && p.tokens[p.pos+1].text == "(" {
+			p.next()
+			p.next()
+			var args []expression
+			for !p.isPunct(")") {
+				if len(args) > 0 {
+					if err := p.expectPunct(","); err != nil {
+						return nil, err
+					}
+				}
+				arg, err := p.parseExpression()
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, arg)
+			}
+			p.next()
+			if fn.minArgs > len(args) || (fn.maxArgs >= 0 && len(args) > fn.maxArgs) {
+				return nil, fmt.Errorf("wrong number of arguments to %s at position %d", t.text, t.pos)
+			}
+			return call{name: t.text, fn: fn.apply, args: args}, nil
+		}
+
+		path, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		return fieldReference{path}, nil
+	}
+
+	return nil, fmt.Errorf("expected a value at position %d, found %s", t.pos, t)
+}
+
+func isReserved(word string) bool {
+	switch word {
+	case "set", "rename", "copy", "delete", "if", "then", "to", "and", "or", "not", "exists", "true", "false", "null":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,495 @@
+// Package transforms implements a small, sandboxed language used to rewrite events before
+// they are formatted. A script is a list of statements separated by newlines or ';':
+//
+//	set path = expression
+//	rename path to path
+//	copy path to path
+//	delete path
+//	if condition then statement
+//
+// Paths are dotted field names (e.g. "process.name"). Expressions are strings, numbers,
+// true/false/null, field references, function calls and '+', which adds numbers and
+// concatenates anything else. Conditions compare expressions with ==, !=, <, >, <= and >=,
+// test a field with "exists path", and combine with and/or/not. Scripts can only read and
+// modify the event they are applied to.
+package transforms
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Program struct {
+	source     string
+	statements []statement
+}
+
+// Compile parses source into a Program that can be applied to any number of events.
+func Compile(source string) (*Program, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	statements, err := p.parseProgram()
+	if err != nil {
+		return nil, err
+	}
+	if len(statements) == 0 {
+		return nil, fmt.Errorf("transform has no statements")
+	}
+	return &Program{source: source, statements: statements}, nil
+}
+
+func (program *Program) String() string {
+	return program.source
+}
+
+// Apply runs the program over event, modifying it in place. When an error is returned the
+// event may have been partially modified.
+func (program *Program) Apply(event map[string]interface{}) error {
+	return program.ApplyTracked(event, nil)
+}
+
+// ApplyTracked runs the program over event like Apply, recording its writes in writes. Statements
+// writing a field that another stage wrote are skipped under the first-wins policy, and fail the
+// program with a ConflictError under the error policy.
+func (program *Program) ApplyTracked(event map[string]interface{}, writes *FieldWrites) error {
+	for _, stmt := range program.statements {
+		if err := stmt.execute(event, writes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type fieldPath []string
+
+func (path fieldPath) String() string {
+	return strings.Join(path, ".")
+}
+
+func (path fieldPath) lookup(event map[string]interface{}) (interface{}, bool) {
+	current := event
+	for i, key := range path {
+		value, ok := current[key]
+		if !ok {
+			return nil, false
+		}
+		if i == len(path)-1 {
+			return value, true
+		}
+		if current, ok = value.(map[string]interface{}); !ok {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+func (path fieldPath) parent(event map[string]interface{}, create bool) (map[string]interface{}, error) {
+	current := event
+	for _, key := range path[:len(path)-1] {
+		value, ok := current[key]
+		if !ok {
+			if !create {
+				return nil, nil
+			}
+			child := make(map[string]interface{})
+			current[key] = child
+			current = child
+			continue
+		}
+		if current, ok = value.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("cannot access %s: %s is not an object", path, key)
+		}
+	}
+	return current, nil
+}
+
+func (path fieldPath) set(event map[string]interface{}, value interface{}) error {
+	parent, err := path.parent(event, true)
+	if err != nil {
+		return err
+	}
+	parent[path[len(path)-1]] = value
+	return nil
+}
+
+func (path fieldPath) remove(event map[string]interface{}) {
+	if parent, err := path.parent(event, false); err == nil && parent != nil {
+		delete(parent, path[len(path)-1])
+	}
+}
+
+type statement interface {
+	execute(event map[string]interface{}, writes *FieldWrites) error
+}
+
+type setStatement struct {
+	target fieldPath
+	value  expression
+}
+
+func (s setStatement) execute(event map[string]interface{}, writes *FieldWrites) error {
+	value, err := s.value.evaluate(event)
+	if err != nil {
+		return err
+	}
+	if ok, err := writes.claim(s.target); !ok {
+		return err
+	}
+	return s.target.set(event, value)
+}
+
+type moveStatement struct {
+	source     fieldPath
+	target     fieldPath
+	keepSource bool
+}
+
+func (s moveStatement) execute(event map[string]interface{}, writes *FieldWrites) error {
+	value, ok := s.source.lookup(event)
+	if !ok {
+		return nil
+	}
+	written := []fieldPath{s.target}
+	if !s.keepSource {
+		written = append(written, s.source)
+	}
+	if ok, err := writes.claim(written...); !ok {
+		return err
+	}
+	if !s.keepSource {
+		s.source.remove(event)
+	}
+	return s.target.set(event, value)
+}
+
+type deleteStatement struct {
+	target fieldPath
+}
+
+func (s deleteStatement) execute(event map[string]interface{}, writes *FieldWrites) error {
+	if _, ok := s.target.lookup(event); !ok {
+		return nil
+	}
+	if ok, err := writes.claim(s.target); !ok {
+		return err
+	}
+	s.target.remove(event)
+	return nil
+}
+
+type ifStatement struct {
+	condition condition
+	body      statement
+}
+
+func (s ifStatement) execute(event map[string]interface{}, writes *FieldWrites) error {
+	ok, err := s.condition.test(event)
+	if err != nil || !ok {
+		return err
+	}
+	return s.body.execute(event, writes)
+}
+
+type condition interface {
+	test(event map[string]interface{}) (bool, error)
+}
+
+type andCondition struct {
+	left, right condition
+}
+
+func (c andCondition) test(event map[string]interface{}) (bool, error) {
+	ok, err := c.left.test(event)
+	if err != nil || !ok {
+		return false, err
+	}
+	return c.right.test(event)
+}
+
+type orCondition struct {
+	left, right condition
+}
+
+func (c orCondition) test(event map[string]interface{}) (bool, error) {
+	ok, err := c.left.test(event)
+	if err != nil || ok {
+		return ok, err
+	}
+	return c.right.test(event)
+}
+
+type notCondition struct {
+	condition condition
+}
+
+func (c notCondition) test(event map[string]interface{}) (bool, error) {
+	ok, err := c.condition.test(event)
+	return !ok, err
+}
+
+type existsCondition struct {
+	path fieldPath
+}
+
+func (c existsCondition) test(event map[string]interface{}) (bool, error) {
+	_, ok := c.path.lookup(event)
+	return ok, nil
+}
+
+type truthyCondition struct {
+	value expression
+}
+
+func (c truthyCondition) test(event map[string]interface{}) (bool, error) {
+	value, err := c.value.evaluate(event)
+	if err != nil {
+		return false, err
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	case string:
+		return len(v) > 0, nil
+	}
+	if n, ok := toNumber(value); ok {
+		return n != 0, nil
+	}
+	return true, nil
+}
+
+type comparison struct {
+	op          string
+	left, right expression
+}
+
+func (c comparison) test(event map[string]interface{}) (bool, error) {
+	left, err := c.left.evaluate(event)
+	if err != nil {
+		return false, err
+	}
+	right, err := c.right.evaluate(event)
+	if err != nil {
+		return false, err
+	}
+
+	var order int
+	leftNumber, leftIsNumber := toNumber(left)
+	rightNumber, rightIsNumber := toNumber(right)
+
+	switch {
+	case leftIsNumber && rightIsNumber:
+		switch {
+		case leftNumber < rightNumber:
+			order = -1
+		case leftNumber > rightNumber:
+			order = 1
+		}
+	case c.op == "==" || c.op == "!=":
+		equal := left == nil && right == nil
+		if left != nil && right != nil {
+			equal = toString(left) == toString(right)
+		}
+		return equal == (c.op == "=="), nil
+	default:
+		if left == nil || right == nil {
+			return false, nil
+		}
+		order = strings.Compare(toString(left), toString(right))
+	}
+
+	switch c.op {
+	case "==":
+		return order == 0, nil
+	case "!=":
+		return order != 0, nil
+	case "<":
+		return order < 0, nil
+	case ">":
+		return order > 0, nil
+	case "<=":
+		return order <= 0, nil
+	default:
+		return order >= 0, nil
+	}
+}
+
+type expression interface {
+	evaluate(event map[string]interface{}) (interface{}, error)
+}
+
+type literal struct {
+	value interface{}
+}
+
+func (e literal) evaluate(event map[string]interface{}) (interface{}, error) {
+	return e.value, nil
+}
+
+type fieldReference struct {
+	path fieldPath
+}
+
+func (e fieldReference) evaluate(event map[string]interface{}) (interface{}, error) {
+	value, _ := e.path.lookup(event)
+	return value, nil
+}
+
+type addExpression struct {
+	left, right expression
+}
+
+func (e addExpression) evaluate(event map[string]interface{}) (interface{}, error) {
+	left, err := e.left.evaluate(event)
+	if err != nil {
+		return nil, err
+	}
+	right, err := e.right.evaluate(event)
+	if err != nil {
+		return nil, err
+	}
+
+	leftNumber, leftIsNumber := toNumber(left)
+	rightNumber, rightIsNumber := toNumber(right)
+	if leftIsNumber && rightIsNumber {
+		return fromNumber(leftNumber + rightNumber), nil
+	}
+
+	for _, v := range []interface{}{left, right} {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("cannot add %T values", v)
+		}
+	}
+	return toString(left) + toString(right), nil
+}
+
+type call struct {
+	name string
+	fn   func(args []interface{}) (interface{}, error)
+	args []expression
+}
+
+func (e call) evaluate(event map[string]interface{}) (interface{}, error) {
+	args := make([]interface{}, len(e.args))
+	for i, arg := range e.args {
+		value, err := arg.evaluate(event)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+
+	value, err := e.fn(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", e.name, err)
+	}
+	return value, nil
+}
+
+type function struct {
+	minArgs int
+	maxArgs int // -1 for any number of arguments
+	apply   func(args []interface{}) (interface{}, error)
+}
+
+var functions = map[string]function{
+	"lower": {1, 1, func(args []interface{}) (interface{}, error) {
+		return strings.ToLower(toString(args[0])), nil
+	}},
+	"upper": {1, 1, func(args []interface{}) (interface{}, error) {
+		return strings.ToUpper(toString(args[0])), nil
+	}},
+	"trim": {1, 1, func(args []interface{}) (interface{}, error) {
+		return strings.TrimSpace(toString(args[0])), nil
+	}},
+	"replace": {3, 3, func(args []interface{}) (interface{}, error) {
+		return strings.Replace(toString(args[0]), toString(args[1]), toString(args[2]), -1), nil
+	}},
+	"concat": {1, -1, func(args []interface{}) (interface{}, error) {
+		var b strings.Builder
+		for _, arg := range args {
+			b.WriteString(toString(arg))
+		}
+		return b.String(), nil
+	}},
+	"coalesce": {1, -1, func(args []interface{}) (interface{}, error) {
+		for _, arg := range args {
+			if arg != nil {
+				return arg, nil
+			}
+		}
+		return nil, nil
+	}},
+	"len": {1, 1, func(args []interface{}) (interface{}, error) {
+		switch v := args[0].(type) {
+		case nil:
+			return json.Number("0"), nil
+		case []interface{}:
+			return json.Number(strconv.Itoa(len(v))), nil
+		case map[string]interface{}:
+			return json.Number(strconv.Itoa(len(v))), nil
+		}
+		return json.Number(strconv.Itoa(len([]rune(toString(args[0]))))), nil
+	}},
+	"string": {1, 1, func(args []interface{}) (interface{}, error) {
+		return toString(args[0]), nil
+	}},
+	"number": {1, 1, func(args []interface{}) (interface{}, error) {
+		n, ok := toNumber(args[0])
+		if !ok {
+			if s, isString := args[0].(string); isString {
+				f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+				if err != nil {
+					return nil, fmt.Errorf("'%s' is not a number", s)
+				}
+				n = f
+			} else {
+				return nil, fmt.Errorf("cannot convert %T to a number", args[0])
+			}
+		}
+		return fromNumber(n), nil
+	}},
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func fromNumber(n float64) json.Number {
+	return json.Number(strconv.FormatFloat(n, 'f', -1, 64))
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+	return fmt.Sprint(value)
+}
@@ -3,6 +3,8 @@ package tests
 import (
 	rabbitmq "github.com/carbonblack/cb-event-forwarder/pkg/rabbitmq"
 	"testing"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 func TestNewConsumer(t *testing.T) {
@@ -11,3 +13,38 @@ func TestNewConsumer(t *testing.T) {
 		t.Errorf("ConnectionError channel not constructed properly")
 	}
 }
+
+func TestConsumerPrefetch(t *testing.T) {
+	tests := []struct {
+		name      string
+		manualAck bool
+		expected  []int
+	}{
+		{name: "automatic acking ignores prefetch", manualAck: false, expected: []int{0, 0}},
+		{name: "manual acking sets prefetch", manualAck: true, expected: []int{100, 10}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dialer := rabbitmq.NewMockAMQPDialer()
+			c := rabbitmq.NewConsumer("amqp://lol:lol@cb/", "aqueuename", "consumertag", true, nil, dialer, nil)
+			if test.manualAck {
+				c.UseManualAcking(100)
+			}
+			if _, err := c.Connect(); err != nil {
+				t.Fatalf("Connect failed: %s", err)
+			}
+
+			var got []int
+			got = append(got, dialer.Connection.AMQPCHAN.PrefetchCount)
+			if err := c.SetPrefetch(10); err != nil {
+				t.Fatalf("SetPrefetch failed: %s", err)
+			}
+			got = append(got, dialer.Connection.AMQPCHAN.PrefetchCount)
+
+			if diff := cmp.Diff(test.expected, got); diff != "" {
+				t.Errorf("prefetch counts mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package tests
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBucketFileOutput(t *testing.T) {
+	events := []string{
+		`{"timestamp":1577934000,"type":"first"}`,
+		`{"timestamp":1577937599.5,"type":"second"}`,
+		`{"timestamp":1577937600,"type":"third"}`,
+		`not json`,
+	}
+	current := time.Now().UTC().Format("2006/01/02/15")
+
+	tests := []struct {
+		name           string
+		config         Configuration
+		expectedFiles  map[string]string
+		expectedCounts map[string]uint64
+		expectedLate   uint64
+		// events without a usable timestamp filed by their ingest time
+		expectedFallbacks uint64
+	}{
+		{
+			name:   "event time",
+			config: Configuration{OutputFormat: JSONOutputFormat, TimeSource: EventTimeSource, CompressionType: NOCOMPRESSION},
+			expectedFiles: map[string]string{
+				"2020/01/02/03.json": events[0] + "\n" + events[1] + "\n",
+				"2020/01/02/04.json": events[2] + "\n",
+				current + ".json":    events[3] + "\n",
+			},
+			expectedCounts:    map[string]uint64{"2020/01/02/03": 2, "2020/01/02/04": 1, current: 1},
+			expectedLate:      3,
+			expectedFallbacks: 1,
+		},
+		{
+			name:   "received time",
+			config: Configuration{OutputFormat: JSONOutputFormat, CompressionType: NOCOMPRESSION},
+			expectedFiles: map[string]string{
+				current + ".json": events[0] + "\n" + events[1] + "\n" + events[2] + "\n" + events[3] + "\n",
+			},
+			expectedCounts: map[string]uint64{current: 4},
+		},
+		{
+			name:   "compressed",
+			config: Configuration{OutputFormat: JSONOutputFormat, TimeSource: EventTimeSource, FileHandlerCompressData: true, CompressionType: GZIPCOMPRESSION},
+			expectedFiles: map[string]string{
+				"2020/01/02/03.json.gz": events[0] + "\n" + events[1] + "\n",
+				"2020/01/02/04.json.gz": events[2] + "\n",
+				current + ".json.gz":    events[3] + "\n",
+			},
+			expectedCounts:    map[string]uint64{"2020/01/02/03": 2, "2020/01/02/04": 1, current: 1},
+			expectedLate:      3,
+			expectedFallbacks: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "bucketfile")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			output := outputs.NewBucketFileOutputFromConfig(&test.config)
+			if err := output.Initialize(dir); err != nil {
+				t.Fatal(err)
+			}
+
+			messages := make(chan string)
+			signals := make(chan os.Signal)
+			if err := output.Go(messages, signals, sync.NewCond(&sync.Mutex{})); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { signals <- syscall.SIGTERM }()
+
+			// the first event is written again after its bucket is closed, appending to its file
+			messages <- events[0]
+			signals <- syscall.SIGHUP
+			for _, event := range events[1:] {
+				messages <- event
+			}
+			// the second SIGHUP is only received once the first one closed the files
+			signals <- syscall.SIGHUP
+			signals <- syscall.SIGHUP
+
+			files := make(map[string]string)
+			err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				f, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+
+				var contents []byte
+				if test.config.FileHandlerCompressData {
+					r, err := gzip.NewReader(f)
+					if err != nil {
+						return err
+					}
+					contents, err = ioutil.ReadAll(r)
+				} else {
+					contents, err = ioutil.ReadAll(f)
+				}
+				name, _ := filepath.Rel(dir, path)
+				files[filepath.ToSlash(name)] = string(contents)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.expectedFiles, files); diff != "" {
+				t.Errorf("unexpected bucket files, diff: %s", diff)
+			}
+
+			stats := output.Statistics().(outputs.BucketFileStatistics)
+			if diff := cmp.Diff(test.expectedCounts, stats.EventsByBucket); diff != "" {
+				t.Errorf("unexpected events by bucket, diff: %s", diff)
+			}
+			if stats.LateEventCount != test.expectedLate || len(stats.OpenBuckets) != 0 {
+				t.Errorf("expected %d late events and no open buckets, got %+v", test.expectedLate, stats)
+			}
+			if stats.TimeSourceFallbackCount != test.expectedFallbacks {
+				t.Errorf("expected %d time source fallbacks, got %d", test.expectedFallbacks, stats.TimeSourceFallbackCount)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package tests
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+)
+
+// testCollectorOptions configures what a testCollector expects on the wire and how it answers.
+type testCollectorOptions struct {
+	// Frames reads tcp streams as frames written with frame_compression, decompressing them,
+	// instead of as lines. udp datagrams are always a message each.
+	Frames bool
+	// TLS serves tcp connections over TLS, with a self-signed certificate for 127.0.0.1
+	TLS bool
+	// Ack, when set, returns the reply written back for each message, followed by a CRLF. Nothing
+	// is written for empty replies.
+	Ack func(message string) string
+}
+
+// testCollector is an in-process tcp or udp collector recording the messages the net output
+// puts on the wire, in the order they were received across all connections, so that tests can
+// assert on exactly what was sent, including its framing.
+type testCollector struct {
+	t          *testing.T
+	options    testCollectorOptions
+	listener   net.Listener
+	packetConn net.PacketConn
+	tlsConfig  *tls.Config
+
+	mutex    sync.Mutex
+	messages []string
+	// the tcp connections accepted, without TLS on top
+	connections []net.Conn
+	accepted    int
+	// signaled, without blocking, whenever a message is recorded
+	received chan struct{}
+}
+
+// newTestCollector starts a collector on a random port of 127.0.0.1, for network tcp or udp.
+// It is closed when the test ends.
+func newTestCollector(t *testing.T, network string, options testCollectorOptions) *testCollector {
+	c := &testCollector{t: t, options: options, received: make(chan struct{}, 1)}
+
+	var err error
+	switch network {
+	case "udp":
+		if c.packetConn, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		go c.readDatagrams()
+	default:
+		if c.listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if options.TLS {
+			c.tlsConfig = &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}}
+		}
+		go c.accept()
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// Destination returns the connection string of the collector, for NetOutput.Initialize.
+func (c *testCollector) Destination() string {
+	if c.packetConn != nil {
+		return "udp:" + c.packetConn.LocalAddr().String()
+	}
+	return "tcp:" + c.listener.Addr().String()
+}
+
+// Messages returns the messages received so far.
+func (c *testCollector) Messages() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.messages...)
+}
+
+// WaitForMessages waits for the collector to have received at least n messages, failing the
+// test when it takes longer than timeout, and returns them.
+func (c *testCollector) WaitForMessages(n int, timeout time.Duration) []string {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		if messages := c.Messages(); len(messages) >= n {
+			return messages
+		}
+		select {
+		case <-c.received:
+		case <-deadline.C:
+			c.t.Fatalf("timed out waiting for %d messages, received %q", n, c.Messages())
+		}
+	}
+}
+
+// Accepted returns how many tcp connections the collector accepted.
+func (c *testCollector) Accepted() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.accepted
+}
+
+// DropConnections resets the open tcp connections, as a collector restarting would.
+func (c *testCollector) DropConnections() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, conn := range c.connections {
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}
+	c.connections = nil
+}
+
+// Close stops the collector and closes its connections.
+func (c *testCollector) Close() {
+	if c.packetConn != nil {
+		c.packetConn.Close()
+		return
+	}
+	c.listener.Close()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, conn := range c.connections {
+		conn.Close()
+	}
+	c.connections = nil
+}
+
+func (c *testCollector) accept() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			return
+		}
+		c.mutex.Lock()
+		c.accepted++
+		c.connections = append(c.connections, conn)
+		c.mutex.Unlock()
+		if c.tlsConfig != nil {
+			conn = tls.Server(conn, c.tlsConfig)
+		}
+		go c.read(conn)
+	}
+}
+
+func (c *testCollector) read(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		var message string
+		if c.options.Frames {
+			frame, err := outputs.ReadCompressedFrame(reader)
+			if err != nil {
+				return
+			}
+			message = string(frame)
+		} else {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				if err != io.EOF || len(line) == 0 {
+					return
+				}
+			}
+			message = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		}
+		c.record(message)
+		if reply := c.reply(message); len(reply) > 0 {
+			conn.Write([]byte(reply))
+		}
+	}
+}
+
+func (c *testCollector) readDatagrams() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := c.packetConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		message := string(buf[:n])
+		c.record(message)
+		if reply := c.reply(message); len(reply) > 0 {
+			c.packetConn.WriteTo([]byte(reply), from)
+		}
+	}
+}
+
+func (c *testCollector) record(message string) {
+	c.mutex.Lock()
+	c.messages = append(c.messages, message)
+	c.mutex.Unlock()
+	select {
+	case c.received <- struct{}{}:
+	default:
+	}
+}
+
+func (c *testCollector) reply(message string) string {
+	if c.options.Ack == nil {
+		return ""
+	}
+	if reply := c.options.Ack(message); len(reply) > 0 {
+		return reply + "\r\n"
+	}
+	return ""
+}
@@ -0,0 +1,128 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCompressedFrame(t *testing.T) {
+	small := []byte(`{"type":"ingress.event.procstart"}`)
+	large := []byte(`{"type":"ingress.event.procstart","cmdline":"` + strings.Repeat("powershell -enc AAAA ", 100) + `"}`)
+
+	for _, test := range []struct {
+		compression FrameCompression
+		codec       byte
+	}{
+		{compression: GzipFrameCompression, codec: 1},
+		{compression: ZstdFrameCompression, codec: 2},
+	} {
+		t.Run(string(test.compression), func(t *testing.T) {
+			framer, err := outputs.NewCompressedFramer(test.compression, 256, DefaultCompressionLevel)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var stream bytes.Buffer
+			for _, event := range [][]byte{small, large} {
+				framed, err := framer.Frame(event)
+				if err != nil {
+					t.Fatal(err)
+				}
+				stream.Write(framed)
+			}
+			raw := stream.Bytes()
+
+			// the small event is sent as is, after its header
+			if raw[0] != 0 || binary.BigEndian.Uint32(raw[1:]) != uint32(len(small)) || binary.BigEndian.Uint32(raw[5:]) != uint32(len(small)) ||
+				!bytes.Equal(raw[9:9+len(small)], small) {
+				t.Errorf("unexpected frame for the small event %q", raw[:9+len(small)])
+			}
+			// the large one is compressed
+			header := raw[9+len(small):]
+			if header[0] != test.codec || binary.BigEndian.Uint32(header[1:]) != uint32(len(large)) || binary.BigEndian.Uint32(header[5:]) >= uint32(len(large)) {
+				t.Errorf("unexpected header for the large event %v", header[:9])
+			}
+			if framer.CompressedCount() != 1 || framer.SavedBytes() <= 0 {
+				t.Errorf("expected 1 compressed event, got %d saving %d bytes", framer.CompressedCount(), framer.SavedBytes())
+			}
+
+			reader := bytes.NewReader(raw)
+			for _, expected := range [][]byte{small, large} {
+				event, err := outputs.ReadCompressedFrame(reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(event, expected) {
+					t.Errorf("expected %q, got %q", expected, event)
+				}
+			}
+			if _, err := outputs.ReadCompressedFrame(reader); err != io.EOF {
+				t.Errorf("expected io.EOF at the end of the stream, got %v", err)
+			}
+		})
+	}
+
+	// events that don't shrink are sent as they are
+	framer, _ := outputs.NewCompressedFramer(GzipFrameCompression, 0, DefaultCompressionLevel)
+	framed, _ := framer.Frame([]byte("x"))
+	if framed[0] != 0 || framer.CompressedCount() != 0 {
+		t.Errorf("expected a tiny event to be left uncompressed, got %v", framed)
+	}
+}
+
+func TestReadCompressedFrameErrors(t *testing.T) {
+	for _, test := range []struct {
+		desc  string
+		frame []byte
+	}{
+		{desc: "truncated header", frame: []byte{0, 0, 0}},
+		{desc: "truncated payload", frame: []byte{0, 0, 0, 0, 4, 0, 0, 0, 4, 'a'}},
+		{desc: "unknown codec", frame: []byte{9, 0, 0, 0, 1, 0, 0, 0, 1, 'a'}},
+		{desc: "corrupt gzip", frame: []byte{1, 0, 0, 0, 1, 0, 0, 0, 1, 'a'}},
+		{desc: "wrong length", frame: []byte{0, 0, 0, 0, 2, 0, 0, 0, 1, 'a'}},
+		{desc: "too large", frame: []byte{0, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 1, 'a'}},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			if event, err := outputs.ReadCompressedFrame(bytes.NewReader(test.frame)); err == nil || err == io.EOF {
+				t.Errorf("expected an error, got %q, %v", event, err)
+			}
+		})
+	}
+}
+
+func TestNetOutputFrameCompression(t *testing.T) {
+	collector := newTestCollector(t, "tcp", testCollectorOptions{Frames: true})
+
+	output := outputs.NewNetOutputfromConfig(&Configuration{FrameCompression: ZstdFrameCompression, FrameCompressionThreshold: 64})
+	if err := output.Initialize(collector.Destination()); err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan string)
+	signals := make(chan os.Signal)
+	if err := output.Go(messages, signals, sync.NewCond(&sync.Mutex{})); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { signals <- syscall.SIGTERM }()
+
+	sent := []string{`{"n":1}`, `{"n":2,"path":"` + strings.Repeat(`c:\\windows\\system32\\`, 20) + `"}`}
+	for _, message := range sent {
+		messages <- message
+	}
+	if diff := cmp.Diff(sent, collector.WaitForMessages(len(sent), 5*time.Second)); diff != "" {
+		t.Errorf("unexpected events (-want +got):\n%s", diff)
+	}
+	if stats := output.Statistics().(outputs.NetStatistics); stats.CompressedEventCount != 1 {
+		t.Errorf("expected 1 compressed event, got %d", stats.CompressedEventCount)
+	}
+}
@@ -1,11 +1,26 @@
 package tests
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/transforms"
 	"github.com/go-ini/ini"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
 	"testing"
+	"text/template"
+	"time"
 )
 
 type mapString map[string]string
@@ -363,3 +378,2607 @@ func TestParseOAuthConfigurationErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestTLSVersionFromString(t *testing.T) {
+	for _, test := range []struct {
+		desc            string
+		input           string
+		expectedVersion uint16
+		expectError     bool
+	}{
+		{desc: "plain version", input: "1.2", expectedVersion: tls.VersionTLS12},
+		{desc: "prefixed version", input: "TLSv1.3", expectedVersion: tls.VersionTLS13},
+		{desc: "unknown version", input: "1.4", expectError: true},
+	} {
+		test := test // capture range variable.
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			version, err := TLSVersionFromString(test.input)
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if diff := cmp.Diff(version, test.expectedVersion); diff != "" {
+				t.Errorf("version different from expected, diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestTLSCipherSuitesFromString(t *testing.T) {
+	for _, test := range []struct {
+		desc           string
+		input          string
+		expectedSuites []uint16
+		expectedErr    string
+	}{
+		{
+			desc:  "valid suites",
+			input: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+			expectedSuites: []uint16{
+				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			},
+		},
+		{
+			desc:        "invalid suite lists valid names",
+			input:       "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,NOT_A_CIPHER",
+			expectedErr: "TLS cipher suite NOT_A_CIPHER not recognized, valid names are: ",
+		},
+		{
+			desc:        "empty list",
+			input:       " , ",
+			expectedErr: "No TLS cipher suites specified, valid names are: ",
+		},
+	} {
+		test := test // capture range variable.
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			suites, err := TLSCipherSuitesFromString(test.input)
+			if test.expectedErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.expectedErr) ||
+					!strings.Contains(err.Error(), "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256") {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(suites, test.expectedSuites); diff != "" {
+				t.Errorf("cipher suites different from expected, diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestTLSPinsFromString(t *testing.T) {
+	pin := bytes.Repeat([]byte{0xab}, 32)
+
+	for _, test := range []struct {
+		desc         string
+		input        string
+		expectedPins [][]byte
+		expectError  bool
+	}{
+		{desc: "base64", input: base64.StdEncoding.EncodeToString(pin), expectedPins: [][]byte{pin}},
+		{desc: "prefixed base64", input: "sha256/" + base64.StdEncoding.EncodeToString(pin), expectedPins: [][]byte{pin}},
+		{desc: "hex", input: strings.Repeat("ab", 32), expectedPins: [][]byte{pin}},
+		{desc: "hex with colons", input: strings.Repeat("AB:", 31) + "AB", expectedPins: [][]byte{pin}},
+		{desc: "several pins", input: strings.Repeat("ab", 32) + ", " + strings.Repeat("ab", 32), expectedPins: [][]byte{pin, pin}},
+		{desc: "short hash", input: strings.Repeat("ab", 20), expectError: true},
+		{desc: "not a hash", input: "collector.example.com", expectError: true},
+		{desc: "empty list", input: " , ", expectError: true},
+	} {
+		test := test // capture range variable.
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			pins, err := TLSPinsFromString(test.input)
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if diff := cmp.Diff(pins, test.expectedPins); diff != "" {
+				t.Errorf("pins different from expected, diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestParseCIDRList(t *testing.T) {
+	for _, test := range []struct {
+		desc        string
+		input       string
+		expected    []string
+		expectError bool
+	}{
+		{desc: "ranges", input: "10.0.0.0/8, 192.168.1.0/24", expected: []string{"10.0.0.0/8", "192.168.1.0/24"}},
+		{desc: "plain addresses", input: "10.1.2.3,::1", expected: []string{"10.1.2.3/32", "::1/128"}},
+		{desc: "invalid range", input: "10.0.0.0/33", expectError: true},
+		{desc: "invalid address", input: "collector.local", expectError: true},
+		{desc: "empty", input: " , ", expectError: true},
+	} {
+		test := test // capture range variable.
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			allowed, err := ParseCIDRList(test.input)
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			var ranges []string
+			for _, ipNet := range allowed {
+				ranges = append(ranges, ipNet.String())
+			}
+			if diff := cmp.Diff(ranges, test.expected); diff != "" {
+				t.Errorf("ranges different from expected, diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestParseScheduleRules(t *testing.T) {
+	weekdays := [7]bool{false, true, true, true, true, true, false}
+	weekend := [7]bool{true, false, false, false, false, false, true}
+
+	for _, test := range []struct {
+		desc        string
+		input       string
+		expected    []ScheduleRule
+		expectError bool
+	}{
+		{
+			desc:  "windows",
+			input: "alert.*@mon-fri 09:00-17:30=forward, ingress.event.*@sat+sun=drop, alert.*=buffer",
+			expected: []ScheduleRule{
+				{TypePattern: "alert.*", Days: weekdays, HasDays: true, Start: 9 * 60, End: 17*60 + 30, HasTime: true, Action: ScheduleForward},
+				{TypePattern: "ingress.event.*", Days: weekend, HasDays: true, Action: ScheduleDrop},
+				{TypePattern: "alert.*", Action: ScheduleBuffer},
+			},
+		},
+		{
+			desc:     "wrapping days and times",
+			input:    "feed.*@fri-mon 22:00-06:00=Drop",
+			expected: []ScheduleRule{{TypePattern: "feed.*", Days: [7]bool{true, true, false, false, false, true, true}, HasDays: true, Start: 22 * 60, End: 6 * 60, HasTime: true, Action: ScheduleDrop}},
+		},
+		{desc: "unknown action", input: "alert.*=hold", expectError: true},
+		{desc: "unknown day", input: "alert.*@monday=drop", expectError: true},
+		{desc: "invalid time", input: "alert.*@09:00-25:00=drop", expectError: true},
+		{desc: "missing action", input: "alert.*@mon", expectError: true},
+		{desc: "empty pattern", input: "@mon=drop", expectError: true},
+	} {
+		test := test // capture range variable.
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			rules, err := ParseScheduleRules(test.input)
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if diff := cmp.Diff(rules, test.expected); diff != "" {
+				t.Errorf("rules different from expected, diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestScheduleActionFor(t *testing.T) {
+	rules, err := ParseScheduleRules("alert.*@mon-fri 09:00-17:00=forward, alert.*=buffer, feed.*@fri 22:00-06:00=drop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2021-03-05 is a friday
+	at := func(day int, hour, minute int) time.Time {
+		return time.Date(2021, 3, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	for _, test := range []struct {
+		desc      string
+		eventType string
+		now       time.Time
+		expected  ScheduleAction
+	}{
+		{desc: "business hours", eventType: "alert.watchlist.hit", now: at(5, 10, 0), expected: ScheduleForward},
+		{desc: "after hours", eventType: "alert.watchlist.hit", now: at(5, 17, 0), expected: ScheduleBuffer},
+		{desc: "weekend", eventType: "alert.watchlist.hit", now: at(6, 10, 0), expected: ScheduleBuffer},
+		{desc: "overnight window start", eventType: "feed.hit", now: at(5, 23, 0), expected: ScheduleDrop},
+		{desc: "overnight window next day", eventType: "feed.hit", now: at(6, 5, 59), expected: ScheduleDrop},
+		{desc: "overnight window other day", eventType: "feed.hit", now: at(5, 5, 0), expected: ScheduleForward},
+		{desc: "no matching rule", eventType: "ingress.event.process", now: at(6, 3, 0), expected: ScheduleForward},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			if action := ScheduleActionFor(rules, test.eventType, test.now); action != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, action)
+			}
+		})
+	}
+}
+
+func TestEventTypeAllowed(t *testing.T) {
+	allowlist, err := ParseEventTypePatterns("watchlist.hit.*, alert.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	denylist, err := ParseEventTypePatterns("alert.watchlist.hit.ingress.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseEventTypePatterns("alert.[*"); err == nil {
+		t.Error("expected an error parsing an invalid pattern")
+	}
+
+	for _, test := range []struct {
+		desc      string
+		allowlist []string
+		denylist  []string
+		eventType string
+		expected  bool
+	}{
+		{desc: "allowed", allowlist: allowlist, eventType: "watchlist.hit.process", expected: true},
+		{desc: "not allowed", allowlist: allowlist, eventType: "ingress.event.netconn", expected: false},
+		{desc: "wildcard does not match prefix only", allowlist: allowlist, eventType: "watchlist.storage.hit.process", expected: false},
+		{desc: "no type with an allowlist", allowlist: allowlist, eventType: "", expected: false},
+		{desc: "allowed and denied", allowlist: allowlist, denylist: denylist, eventType: "alert.watchlist.hit.ingress.process", expected: false},
+		{desc: "allowed and not denied", allowlist: allowlist, denylist: denylist, eventType: "alert.watchlist.hit.query.binary", expected: true},
+		{desc: "only denylist", denylist: []string{"ingress.event.*"}, eventType: "ingress.event.regmod", expected: false},
+		{desc: "not denied", denylist: []string{"ingress.event.*"}, eventType: "feed.ingress.hit.process", expected: true},
+		{desc: "no type without an allowlist", denylist: []string{"ingress.event.*"}, eventType: "", expected: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			if allowed := EventTypeAllowed(test.allowlist, test.denylist, test.eventType); allowed != test.expected {
+				t.Errorf("expected %t, got %t", test.expected, allowed)
+			}
+		})
+	}
+}
+
+func TestParseSyslogSeverityRules(t *testing.T) {
+	for _, test := range []struct {
+		desc          string
+		input         string
+		expectedRules []SyslogSeverityRule
+		expectError   bool
+	}{
+		{
+			desc:  "rules with and without scores",
+			input: "alert.*@80:2, feed.*:5",
+			expectedRules: []SyslogSeverityRule{
+				{TypePattern: "alert.*", MinScore: 80, HasMinScore: true, Severity: 2},
+				{TypePattern: "feed.*", Severity: 5},
+			},
+		},
+		{desc: "severity out of range", input: "alert.*:8", expectError: true},
+		{desc: "missing severity", input: "alert.*", expectError: true},
+		{desc: "invalid score", input: "alert.*@high:1", expectError: true},
+	} {
+		test := test // capture range variable.
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			rules, err := ParseSyslogSeverityRules(test.input)
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if diff := cmp.Diff(rules, test.expectedRules); diff != "" {
+				t.Errorf("rules different from expected, diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestSyslogSeverityRuleMatches(t *testing.T) {
+	rule := SyslogSeverityRule{TypePattern: "alert.*", MinScore: 80, HasMinScore: true, Severity: 2}
+
+	for _, test := range []struct {
+		desc      string
+		eventType string
+		score     float64
+		hasScore  bool
+		expected  bool
+	}{
+		{desc: "type and score match", eventType: "alert.watchlist.hit.ingress.process", score: 90, hasScore: true, expected: true},
+		{desc: "score too low", eventType: "alert.watchlist.hit.ingress.process", score: 50, hasScore: true, expected: false},
+		{desc: "no score", eventType: "alert.watchlist.hit.ingress.process", expected: false},
+		{desc: "type mismatch", eventType: "feed.ingress.hit.process", score: 90, hasScore: true, expected: false},
+	} {
+		test := test // capture range variable.
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			if got := rule.Matches(test.eventType, test.score, test.hasScore); got != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseConfigAdditionalOutputs(t *testing.T) {
+	type outputSummary struct {
+		Name           string
+		Type           int
+		Format         int
+		Parameters     string
+		OverflowPolicy OverflowPolicy
+		MaxBytes       int64
+	}
+
+	bridge := mapString{
+		"rabbit_mq_username": "cb",
+		"rabbit_mq_password": "password",
+		"cb_server_url":      "https://cbserver/",
+		"server_name":        "test",
+		"output_type":        "file",
+		"outfile":            "/tmp/out.json",
+	}
+
+	withBridge := func(extra mapString) mapString {
+		m := mapString{}
+		for k, v := range bridge {
+			m[k] = v
+		}
+		for k, v := range extra {
+			m[k] = v
+		}
+		return m
+	}
+
+	for _, test := range []struct {
+		desc            string
+		input           map[string]mapString
+		expectedOutputs []outputSummary
+		expectError     bool
+	}{
+		{
+			desc: "no additional outputs",
+			input: map[string]mapString{
+				"bridge": bridge,
+			},
+			expectedOutputs: []outputSummary{
+				{Type: FileOutputType, Format: JSONOutputFormat, Parameters: "/tmp/out.json", OverflowPolicy: BlockOnOverflow},
+			},
+		},
+		{
+			desc: "two additional outputs",
+			input: map[string]mapString{
+				"bridge": withBridge(mapString{"additional_outputs": "siem, archive"}),
+				"siem": mapString{
+					"output_type":     "tcp",
+					"tcpout":          "siem:5514",
+					"output_format":   "leef",
+					"overflow_policy": "drop",
+
+					"output_buffer_max_bytes": "1048576",
+				},
+				"archive": mapString{
+					"output_type":     "file",
+					"outfile":         "/tmp/archive.json",
+					"overflow_policy": "drop-oldest",
+				},
+			},
+			expectedOutputs: []outputSummary{
+				{Type: FileOutputType, Format: JSONOutputFormat, Parameters: "/tmp/out.json", OverflowPolicy: BlockOnOverflow},
+				{Name: "siem", Type: TCPOutputType, Format: LEEFOutputFormat, Parameters: "siem:5514", OverflowPolicy: DropNewestOnOverflow, MaxBytes: 1048576},
+				{Name: "archive", Type: FileOutputType, Format: JSONOutputFormat, Parameters: "/tmp/archive.json", OverflowPolicy: DropOldestOnOverflow},
+			},
+		},
+		{
+			desc: "same host in two formats",
+			input: map[string]mapString{
+				"bridge": withBridge(mapString{"additional_outputs": "legacy,collector"}),
+				"legacy": mapString{
+					"output_type":   "udp",
+					"udpout":        "collector:514",
+					"output_format": "leef",
+				},
+				"collector": mapString{
+					"output_type": "tcp",
+					"tcpout":      "collector:6514",
+				},
+			},
+			expectedOutputs: []outputSummary{
+				{Type: FileOutputType, Format: JSONOutputFormat, Parameters: "/tmp/out.json", OverflowPolicy: BlockOnOverflow},
+				{Name: "legacy", Type: UDPOutputType, Format: LEEFOutputFormat, Parameters: "collector:514", OverflowPolicy: BlockOnOverflow},
+				{Name: "collector", Type: TCPOutputType, Format: JSONOutputFormat, Parameters: "collector:6514", OverflowPolicy: BlockOnOverflow},
+			},
+		},
+		{
+			desc: "msgpack over tcp",
+			input: map[string]mapString{
+				"bridge": withBridge(mapString{"additional_outputs": "collector"}),
+				"collector": mapString{
+					"output_type":   "tcp",
+					"tcpout":        "collector:6514",
+					"output_format": "msgpack",
+				},
+			},
+			expectedOutputs: []outputSummary{
+				{Type: FileOutputType, Format: JSONOutputFormat, Parameters: "/tmp/out.json", OverflowPolicy: BlockOnOverflow},
+				{Name: "collector", Type: TCPOutputType, Format: MsgPackOutputFormat, Parameters: "collector:6514", OverflowPolicy: BlockOnOverflow},
+			},
+		},
+		{
+			desc: "msgpack over http",
+			input: map[string]mapString{
+				"bridge": withBridge(mapString{"additional_outputs": "collector"}),
+				"collector": mapString{
+					"output_type":   "http",
+					"httpout":       "https://collector/",
+					"output_format": "msgpack",
+				},
+			},
+			expectError: true,
+		},
+		{
+			desc: "syslog severity rules with leef",
+			input: map[string]mapString{
+				"bridge": withBridge(mapString{"additional_outputs": "siem"}),
+				"siem": mapString{
+					"output_type":    "syslog",
+					"syslogout":      "tcp:siem:514",
+					"output_format":  "leef",
+					"severity_rules": "alert.*:4",
+				},
+			},
+			expectError: true,
+		},
+		{
+			desc: "s3 object key template with leef",
+			input: map[string]mapString{
+				"bridge": withBridge(mapString{"additional_outputs": "archive"}),
+				"archive": mapString{
+					"output_type":         "s3",
+					"s3out":               "us-east-1:archive",
+					"output_format":       "leef",
+					"object_key_template": `type={{.Field "type"}}`,
+				},
+			},
+			expectError: true,
+		},
+		{
+			desc: "missing section",
+			input: map[string]mapString{
+				"bridge": withBridge(mapString{"additional_outputs": "siem"}),
+			},
+			expectError: true,
+		},
+		{
+			desc: "invalid overflow policy",
+			input: map[string]mapString{
+				"bridge": withBridge(mapString{"additional_outputs": "siem"}),
+				"siem": mapString{
+					"output_type":     "tcp",
+					"tcpout":          "siem:5514",
+					"overflow_policy": "sometimes",
+				},
+			},
+			expectError: true,
+		},
+		{
+			desc: "invalid output buffer max bytes",
+			input: map[string]mapString{
+				"bridge": withBridge(mapString{"output_buffer_max_bytes": "-1"}),
+			},
+			expectError: true,
+		},
+	} {
+		test := test // capture range variable.
+		t.Run(test.desc, func(t *testing.T) {
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(test.input))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+
+			var outputs []outputSummary
+			for _, output := range append([]Configuration{config}, config.AdditionalOutputs...) {
+				outputs = append(outputs, outputSummary{
+					Name:           output.OutputName,
+					Type:           output.OutputType,
+					Format:         output.OutputFormat,
+					Parameters:     output.OutputParameters,
+					OverflowPolicy: output.OverflowPolicy,
+					MaxBytes:       output.OutputBufferMaxBytes,
+				})
+			}
+			if diff := cmp.Diff(outputs, test.expectedOutputs); diff != "" {
+				t.Errorf("outputs different from expected, diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestParseConfigDir(t *testing.T) {
+	bridge := mapString{
+		"rabbit_mq_username": "cb",
+		"rabbit_mq_password": "password",
+		"cb_server_url":      "https://cbserver/",
+		"server_name":        "test",
+		"output_type":        "file",
+		"outfile":            "/tmp/out.json",
+		"additional_outputs": "siem",
+	}
+	siem := mapString{"output_type": "tcp", "tcpout": "siem:5514"}
+
+	for _, test := range []struct {
+		desc          string
+		configDir     string
+		files         map[string]string
+		expectedNames []string
+		expectError   string
+	}{
+		{
+			desc:      "outputs in file order",
+			configDir: "config.d",
+			files: map[string]string{
+				"20-archive.conf": "[archive]\noutput_type=file\noutfile=/tmp/archive.json\n",
+				"10-kafka.ini":    "; the kafka team\n[kafka-team]\noutput_type=udp\nudpout=kafka-bridge:514\n",
+				"notes.txt":       "not an output",
+				".10-hidden.conf": "[hidden]\noutput_type=file\noutfile=/tmp/hidden.json\n",
+			},
+			expectedNames: []string{"", "siem", "kafka-team", "archive"},
+		},
+		{
+			desc:          "explicit directory",
+			configDir:     "outputs",
+			files:         map[string]string{"archive.conf": "[archive]\noutput_type=file\noutfile=/tmp/archive.json\n"},
+			expectedNames: []string{"", "siem", "archive"},
+		},
+		{
+			// config.d is only read when config_dir says so
+			desc:          "not configured",
+			files:         map[string]string{"archive.conf": "[archive]\noutput_type=file\noutfile=/tmp/archive.json\n"},
+			expectedNames: []string{"", "siem"},
+		},
+		{
+			desc:          "disabled",
+			configDir:     " ",
+			files:         map[string]string{"archive.conf": "[archive]\noutput_type=file\noutfile=/tmp/archive.json\n"},
+			expectedNames: []string{"", "siem"},
+		},
+		{
+			desc:        "missing explicit directory",
+			configDir:   "/nonexistent/outputs",
+			expectError: "Could not read config_dir /nonexistent/outputs",
+		},
+		{
+			desc:        "conflicts with the configuration file",
+			configDir:   "config.d",
+			files:       map[string]string{"siem.conf": "[siem]\noutput_type=tcp\ntcpout=other:5514\n"},
+			expectError: "conflicts with section [siem] of the configuration file",
+		},
+		{
+			desc:      "defined in two files",
+			configDir: "config.d",
+			files: map[string]string{
+				"a.conf": "[archive]\noutput_type=file\noutfile=/tmp/a.json\n",
+				"b.conf": "[archive]\noutput_type=file\noutfile=/tmp/b.json\n",
+			},
+			expectError: "Output archive is defined both in",
+		},
+		{
+			desc:        "several outputs in a file",
+			configDir:   "config.d",
+			files:       map[string]string{"a.conf": "[a]\noutput_type=file\noutfile=/tmp/a.json\n[b]\noutput_type=file\noutfile=/tmp/b.json\n"},
+			expectError: "should define a single output",
+		},
+		{
+			desc:        "keys outside of a section",
+			configDir:   "config.d",
+			files:       map[string]string{"a.conf": "output_type=file\noutfile=/tmp/a.json\n"},
+			expectError: "should define a single output",
+		},
+		{
+			desc:        "invalid output",
+			configDir:   "config.d",
+			files:       map[string]string{"a.conf": "[a]\noutput_type=carrier-pigeon\n"},
+			expectError: "carrier-pigeon",
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			sections := map[string]mapString{"bridge": {}, "siem": siem}
+			for key, value := range bridge {
+				sections["bridge"][key] = value
+			}
+			outputsDir := filepath.Join(dir, "config.d")
+			if len(test.configDir) > 0 {
+				sections["bridge"]["config_dir"] = test.configDir
+				outputsDir = filepath.Join(dir, test.configDir)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, "cb-event-forwarder.conf"), iniFromMap(sections), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if len(test.files) > 0 {
+				if err := os.Mkdir(outputsDir, 0700); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, content := range test.files {
+				if err := ioutil.WriteFile(filepath.Join(outputsDir, name), []byte(content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			config, err := ParseConfig(filepath.Join(dir, "cb-event-forwarder.conf"))
+			if len(test.expectError) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.expectError) {
+					t.Fatalf("expected an error about %q, got %v", test.expectError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			for _, output := range append([]Configuration{config}, config.AdditionalOutputs...) {
+				names = append(names, output.OutputName)
+			}
+			if diff := cmp.Diff(test.expectedNames, names); diff != "" {
+				t.Errorf("outputs mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseConfigRequiredOutputs(t *testing.T) {
+	bridge := func(required string) mapString {
+		m := mapString{
+			"rabbit_mq_username": "cb",
+			"rabbit_mq_password": "password",
+			"cb_server_url":      "https://cbserver/",
+			"server_name":        "test",
+			"output_type":        "file",
+			"outfile":            "/tmp/out.json",
+			"additional_outputs": "siem",
+		}
+		if required != "" {
+			m["required_outputs"] = required
+		}
+		return m
+	}
+	siem := mapString{"output_type": "tcp", "tcpout": "siem:5514"}
+
+	for _, test := range []struct {
+		desc           string
+		required       string
+		expectedBridge bool
+		expectedSiem   bool
+		expectError    bool
+	}{
+		{desc: "every output required by default", expectedBridge: true, expectedSiem: true},
+		{desc: "main output only", required: "bridge", expectedBridge: true},
+		{desc: "additional output only", required: "siem", expectedSiem: true},
+		{desc: "unknown output", required: "bridge, archive", expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(map[string]mapString{"bridge": bridge(test.required), "siem": siem}))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+
+			got := []bool{config.IsRequiredOutput(&config), config.IsRequiredOutput(&config.AdditionalOutputs[0])}
+			if diff := cmp.Diff([]bool{test.expectedBridge, test.expectedSiem}, got); diff != "" {
+				t.Errorf("required outputs mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseConfigBatchEncoding(t *testing.T) {
+	type event struct{ EventText string }
+	// events as the http output hands them to the template
+	commaSeparated := []event{{`{"a":1}`}, {"\n, " + `{"b":2}`}}
+	newlineSeparated := []event{{`{"a":1}` + "\n"}, {`{"b":2}` + "\n"}}
+
+	for _, test := range []struct {
+		desc                string
+		bridge              mapString
+		section             string
+		expectError         bool
+		expectedComma       bool
+		expectedContentType string
+		expectedBody        string
+	}{
+		{
+			desc:                "default json",
+			bridge:              mapString{"output_type": "http", "httpout": "http://collector/"},
+			expectedComma:       true,
+			expectedContentType: "application/json",
+			expectedBody:        `{"filename": "bundle", "service": "carbonblack", "alerts":[{"a":1}` + "\n, " + `{"b":2}]}`,
+		},
+		{
+			desc:                "json array",
+			bridge:              mapString{"output_type": "http", "httpout": "http://collector/"},
+			section:             "json-array",
+			expectedComma:       true,
+			expectedContentType: "application/json",
+			expectedBody:        `[{"a":1}` + "\n, " + `{"b":2}]`,
+		},
+		{
+			desc:                "ndjson",
+			bridge:              mapString{"output_type": "http", "httpout": "http://collector/"},
+			section:             "ndjson",
+			expectedContentType: "application/x-ndjson",
+			expectedBody:        `{"a":1}` + "\n" + `{"b":2}` + "\n",
+		},
+		{
+			desc:        "unknown encoding",
+			bridge:      mapString{"output_type": "http", "httpout": "http://collector/"},
+			section:     "xml",
+			expectError: true,
+		},
+		{
+			desc:        "json array with leef",
+			bridge:      mapString{"output_type": "http", "httpout": "http://collector/", "output_format": "leef"},
+			section:     "json-array",
+			expectError: true,
+		},
+		{
+			desc:        "json array with s3",
+			bridge:      mapString{"output_type": "s3", "s3out": "bucket"},
+			section:     "json-array",
+			expectError: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			bridge := mapString{
+				"rabbit_mq_username": "cb",
+				"rabbit_mq_password": "password",
+				"cb_server_url":      "https://cbserver/",
+				"server_name":        "test",
+			}
+			for key, value := range test.bridge {
+				bridge[key] = value
+			}
+			sections := map[string]mapString{"bridge": bridge}
+			if test.section != "" {
+				outType := test.bridge["output_type"]
+				sections[outType] = mapString{"batch_encoding": test.section}
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(sections))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+
+			if config.CommaSeparateEvents != test.expectedComma {
+				t.Errorf("expected CommaSeparateEvents to be %v", test.expectedComma)
+			}
+			if diff := cmp.Diff(test.expectedContentType, *config.HTTPContentType); diff != "" {
+				t.Errorf("content type mismatch (-want +got):\n%s", diff)
+			}
+			events := newlineSeparated
+			if config.CommaSeparateEvents {
+				events = commaSeparated
+			}
+			var body strings.Builder
+			err = config.HTTPPostTemplate.Execute(&body, struct {
+				FileName string
+				Events   []event
+			}{"bundle", events})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.expectedBody, body.String()); diff != "" {
+				t.Errorf("body mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseConfigLocalSyslog(t *testing.T) {
+	type localSyslog struct {
+		Tag             string
+		Facility        int
+		DefaultSeverity int
+	}
+
+	for _, test := range []struct {
+		desc        string
+		section     mapString
+		expected    localSyslog
+		expectError bool
+	}{
+		{
+			desc:     "defaults",
+			expected: localSyslog{Tag: "cb-event-forwarder", Facility: 1, DefaultSeverity: 6},
+		},
+		{
+			desc:     "custom",
+			section:  mapString{"tag": "edr", "facility": "19", "default_severity": "4"},
+			expected: localSyslog{Tag: "edr", Facility: 19, DefaultSeverity: 4},
+		},
+		{desc: "invalid facility", section: mapString{"facility": "24"}, expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			sections := map[string]mapString{"bridge": {
+				"rabbit_mq_username": "cb",
+				"rabbit_mq_password": "password",
+				"cb_server_url":      "https://cbserver/",
+				"server_name":        "test",
+				"output_type":        "localsyslog",
+			}}
+			if test.section != nil {
+				sections["localsyslog"] = test.section
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(sections))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+
+			if config.OutputType != LocalSyslogOutputType {
+				t.Errorf("expected the localsyslog output type, got %d", config.OutputType)
+			}
+			got := localSyslog{Tag: config.LocalSyslogTag, Facility: config.SyslogFacility, DefaultSeverity: config.SyslogDefaultSeverity}
+			if diff := cmp.Diff(test.expected, got); diff != "" {
+				t.Errorf("local syslog configuration mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseConfigSyslogRFC5424(t *testing.T) {
+	type syslogFormat struct {
+		RFC5424          bool
+		StructuredDataID string
+		Fields           []string
+		MaxMessageSize   int
+	}
+
+	for _, test := range []struct {
+		desc        string
+		section     mapString
+		expected    syslogFormat
+		expectError bool
+	}{
+		{
+			desc:     "defaults",
+			expected: syslogFormat{StructuredDataID: "cb@32473", MaxMessageSize: 65507},
+		},
+		{
+			desc:     "custom",
+			section:  mapString{"format": "RFC5424", "structured_data_id": "edr@12345", "structured_data_fields": "type, sensor_id,", "max_message_size": "2048"},
+			expected: syslogFormat{RFC5424: true, StructuredDataID: "edr@12345", Fields: []string{"type", "sensor_id"}, MaxMessageSize: 2048},
+		},
+		{desc: "invalid format", section: mapString{"format": "rfc3164"}, expectError: true},
+		{desc: "invalid structured data id", section: mapString{"structured_data_id": "a b"}, expectError: true},
+		{desc: "invalid field", section: mapString{"structured_data_fields": "type,a=b"}, expectError: true},
+		{desc: "message size too small", section: mapString{"max_message_size": "100"}, expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			sections := map[string]mapString{"bridge": {
+				"rabbit_mq_username": "cb",
+				"rabbit_mq_password": "password",
+				"cb_server_url":      "https://cbserver/",
+				"server_name":        "test",
+				"output_type":        "syslog",
+				"syslogout":          "udp:127.0.0.1:514",
+			}}
+			if test.section != nil {
+				sections["syslog"] = test.section
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(sections))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+
+			got := syslogFormat{
+				RFC5424:          config.SyslogRFC5424,
+				StructuredDataID: config.SyslogStructuredDataID,
+				Fields:           config.SyslogStructuredDataFields,
+				MaxMessageSize:   config.SyslogMaxMessageSize,
+			}
+			if diff := cmp.Diff(test.expected, got); diff != "" {
+				t.Errorf("syslog configuration mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDiffConfigurations(t *testing.T) {
+	token := "secret-1"
+	newToken := "secret-2"
+	old := Configuration{
+		ConfigFile:         "/etc/cb/a.conf",
+		EventTypeAllowlist: []string{"alert.*"},
+		BundleSendTimeout:  30 * time.Second,
+		AMQPPassword:       "password-1",
+		AdditionalOutputs:  []Configuration{{OutputParameters: "tcp:a:1"}},
+	}
+	updated := old
+	updated.ConfigFile = "/etc/cb/b.conf"
+	updated.EventTypeAllowlist = []string{"alert.*", "feed.*"}
+	updated.BundleSendTimeout = time.Minute
+	updated.AMQPPassword = "password-2"
+	updated.HTTPAuthorizationToken = &newToken
+	old.HTTPAuthorizationToken = &token
+	updated.AdditionalOutputs = []Configuration{{OutputParameters: "tcp:b:1"}}
+
+	expected := []ConfigChange{
+		{Field: "AMQPPassword", Old: "<redacted>", New: "<redacted>"},
+		{Field: "EventTypeAllowlist", Old: "alert.*", New: "alert.*,feed.*"},
+		{Field: "HTTPAuthorizationToken", Old: "<redacted>", New: "<redacted>"},
+		{Field: "BundleSendTimeout", Old: "30s", New: "1m0s"},
+		{Field: "AdditionalOutputs[0].OutputParameters", Old: "<redacted>", New: "<redacted>"},
+	}
+	sortChanges := cmpopts.SortSlices(func(a, b ConfigChange) bool { return a.Field < b.Field })
+	if diff := cmp.Diff(expected, DiffConfigurations(&old, &updated), sortChanges); diff != "" {
+		t.Errorf("unexpected changes (-want +got):\n%s", diff)
+	}
+
+	// templates parsed from the same text are not reported
+	a, _ := template.New("post").Parse("{{.Events}}")
+	b, _ := template.New("post").Parse("{{.Events}}")
+	old, updated = Configuration{HTTPPostTemplate: a}, Configuration{HTTPPostTemplate: b}
+	if changes := DiffConfigurations(&old, &updated); len(changes) != 0 {
+		t.Errorf("expected no changes, got %+v", changes)
+	}
+}
+
+func TestDiffConfigurationsRedactsSecrets(t *testing.T) {
+	// every setting that can hold a credential, directly or in a URL, connection string or header
+	secrets := map[string]bool{
+		"AMQPPassword":           true,
+		"OutputParameters":       true,
+		"HTTPAuthorizationToken": true,
+		"OAuthJwtPrivateKey":     true,
+		"KafkaPassword":          true,
+		"SplunkToken":            true,
+		"HTTPProxyURL":           true,
+		"WebSocketHeaders":       true,
+		"LokiHeaders":            true,
+		"SplunkHECToken":         true,
+		"NATSPassword":           true,
+		"NATSToken":              true,
+		"OTLPHeaders":            true,
+	}
+	// settings named like credentials have to be among them, so that new ones are not forgotten
+	credentialName := regexp.MustCompile(`Password|Token$|Secret|PrivateKey$|Headers$|ProxyURL$`)
+
+	configType := reflect.TypeOf(Configuration{})
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		if credentialName.MatchString(field.Name) && !secrets[field.Name] {
+			t.Errorf("%s looks like a credential, but is not expected to be redacted", field.Name)
+		}
+		if !secrets[field.Name] {
+			continue
+		}
+		delete(secrets, field.Name)
+
+		old, updated := Configuration{}, Configuration{}
+		for value, config := range map[string]*Configuration{"secret-1": &old, "secret-2": &updated} {
+			setSecret(t, reflect.ValueOf(config).Elem().Field(i), value)
+		}
+		for _, config := range []*Configuration{&old, &updated} {
+			config.AdditionalOutputs = []Configuration{*config}
+		}
+
+		changes := DiffConfigurations(&old, &updated)
+		if len(changes) != 2 {
+			t.Errorf("expected %s to change in the output and the additional output, got %+v", field.Name, changes)
+		}
+		for _, change := range changes {
+			if change.Old != "<redacted>" || change.New != "<redacted>" {
+				t.Errorf("expected %s to be redacted, got %+v", change.Field, change)
+			}
+		}
+	}
+	for name := range secrets {
+		t.Errorf("%s is not a setting", name)
+	}
+}
+
+// setSecret sets a setting to a value holding secret, whatever its type.
+func setSecret(t *testing.T, field reflect.Value, secret string) {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(secret)
+	case *string:
+		field.Set(reflect.ValueOf(&secret))
+	case []byte:
+		field.SetBytes([]byte(secret))
+	case *url.URL:
+		field.Set(reflect.ValueOf(&url.URL{Scheme: "http", User: url.UserPassword("user", secret), Host: "proxy:3128"}))
+	case http.Header:
+		field.Set(reflect.ValueOf(http.Header{"Authorization": []string{"Bearer " + secret}}))
+	default:
+		t.Fatalf("unexpected setting type %s", field.Type())
+	}
+}
+
+func TestParseConfigTimeSource(t *testing.T) {
+	type timeSources struct {
+		Output   TimeSource
+		Schedule TimeSource
+	}
+
+	for _, test := range []struct {
+		desc        string
+		bucketfile  mapString
+		bridge      mapString
+		expected    timeSources
+		expectError bool
+	}{
+		{desc: "defaults", expected: timeSources{Output: EventTimeSource, Schedule: IngestTimeSource}},
+		{
+			desc:       "custom",
+			bucketfile: mapString{"time_source": "ingest"},
+			bridge:     mapString{"schedule_time_source": "event"},
+			expected:   timeSources{Output: IngestTimeSource, Schedule: EventTimeSource},
+		},
+		{
+			desc:       "bucket_time",
+			bucketfile: mapString{"bucket_time": "received"},
+			expected:   timeSources{Output: IngestTimeSource, Schedule: IngestTimeSource},
+		},
+		{
+			desc:       "time_source overrides bucket_time",
+			bucketfile: mapString{"bucket_time": "received", "time_source": "event"},
+			expected:   timeSources{Output: EventTimeSource, Schedule: IngestTimeSource},
+		},
+		{desc: "invalid time_source", bucketfile: mapString{"time_source": "now"}, expectError: true},
+		{desc: "invalid schedule_time_source", bridge: mapString{"schedule_time_source": "now"}, expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			bridge := mapString{
+				"rabbit_mq_username": "cb",
+				"rabbit_mq_password": "password",
+				"cb_server_url":      "https://cbserver/",
+				"server_name":        "test",
+				"output_type":        "bucketfile",
+				"bucketdir":          "/tmp/buckets",
+			}
+			for key, value := range test.bridge {
+				bridge[key] = value
+			}
+			sections := map[string]mapString{"bridge": bridge}
+			if test.bucketfile != nil {
+				sections["bucketfile"] = test.bucketfile
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(sections))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+
+			got := timeSources{Output: config.TimeSource, Schedule: config.ScheduleTimeSource}
+			if diff := cmp.Diff(test.expected, got); diff != "" {
+				t.Errorf("time source mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseConfigPipeline(t *testing.T) {
+	for _, test := range []struct {
+		desc           string
+		bridge         mapString
+		additional     mapString
+		expected       []PipelineStage
+		expectedShared []PipelineStage
+		expectError    bool
+	}{
+		{
+			desc:           "default order",
+			bridge:         mapString{"flatten": "true"},
+			expected:       DefaultPipeline,
+			expectedShared: []PipelineStage{PipelineTransform, PipelineCoerce},
+		},
+		{
+			desc:           "flatten first",
+			bridge:         mapString{"flatten": "true", "transform": `delete a`, "pipeline": "Flatten, transform"},
+			expected:       []PipelineStage{PipelineFlatten, PipelineTransform},
+			expectedShared: []PipelineStage{},
+		},
+		{
+			desc:           "common prefix",
+			bridge:         mapString{"pipeline": "coerce,transform,flatten", "coerce_fields": "a:int"},
+			additional:     mapString{"pipeline": "coerce,flatten,transform"},
+			expected:       []PipelineStage{PipelineCoerce, PipelineTransform, PipelineFlatten},
+			expectedShared: []PipelineStage{PipelineCoerce},
+		},
+		{
+			desc:           "conflict policy with every tracked stage shared",
+			bridge:         mapString{"flatten": "true", "transform": `delete a`, "conflict_policy": "error"},
+			expected:       DefaultPipeline,
+			expectedShared: []PipelineStage{PipelineTransform, PipelineCoerce},
+		},
+		{
+			desc:           "conflict policy with tracked stages split",
+			bridge:         mapString{"pipeline": "coerce,transform,flatten", "coerce_fields": "a:int", "transform": `delete a`, "conflict_policy": "first-wins"},
+			additional:     mapString{"pipeline": "coerce,flatten,transform"},
+			expected:       []PipelineStage{PipelineCoerce, PipelineTransform, PipelineFlatten},
+			expectedShared: []PipelineStage{},
+		},
+		{desc: "unknown stage", bridge: mapString{"pipeline": "transform,redact"}, expectError: true},
+		{desc: "repeated stage", bridge: mapString{"pipeline": "transform,flatten,transform"}, expectError: true},
+		{desc: "configured stage left out", bridge: mapString{"flatten": "true", "pipeline": "transform,coerce"}, expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			bridge := mapString{
+				"rabbit_mq_username": "cb",
+				"rabbit_mq_password": "password",
+				"cb_server_url":      "https://cbserver/",
+				"server_name":        "test",
+				"output_type":        "file",
+				"outfile":            "/tmp/out.json",
+			}
+			for key, value := range test.bridge {
+				bridge[key] = value
+			}
+			sections := map[string]mapString{"bridge": bridge}
+			if test.additional != nil {
+				bridge["additional_outputs"] = "archive"
+				sections["archive"] = mapString{"output_type": "file", "outfile": "/tmp/archive.json"}
+				for key, value := range test.additional {
+					sections["archive"][key] = value
+				}
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(sections))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+
+			if diff := cmp.Diff(test.expected, config.PipelineStages()); diff != "" {
+				t.Errorf("pipeline mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(test.expectedShared, config.SharedPipelineStages(), cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("shared stages mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseConfigConflictPolicy(t *testing.T) {
+	for _, test := range []struct {
+		desc        string
+		bridge      mapString
+		expected    transforms.ConflictPolicy
+		expectError bool
+	}{
+		{desc: "default", bridge: mapString{}, expected: transforms.LastWriteWins},
+		{desc: "first wins", bridge: mapString{"conflict_policy": "First-Wins"}, expected: transforms.FirstWriteWins},
+		{desc: "error", bridge: mapString{"conflict_policy": "error", "dead_letter_file": "/tmp/dead-letters.json"}, expected: transforms.FailOnConflict},
+		{desc: "unknown policy", bridge: mapString{"conflict_policy": "newest"}, expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			bridge := mapString{
+				"rabbit_mq_username": "cb",
+				"rabbit_mq_password": "password",
+				"cb_server_url":      "https://cbserver/",
+				"server_name":        "test",
+				"output_type":        "file",
+				"outfile":            "/tmp/out.json",
+				"flatten":            "true",
+				"additional_outputs": "archive",
+			}
+			for key, value := range test.bridge {
+				bridge[key] = value
+			}
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(map[string]mapString{
+				"bridge":  bridge,
+				"archive": {"output_type": "file", "outfile": "/tmp/archive.json", "flatten": "true"},
+			}))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+
+			// every output, and its flatten stage, follow the policy
+			for _, cfg := range []Configuration{config, config.AdditionalOutputs[0]} {
+				if cfg.ConflictPolicy != test.expected || cfg.Flatten.Conflicts != test.expected {
+					t.Errorf("expected conflict policy %s, got %s and %s for flatten", test.expected, cfg.ConflictPolicy, cfg.Flatten.Conflicts)
+				}
+				if cfg.DeadLetterFile != test.bridge["dead_letter_file"] {
+					t.Errorf("unexpected dead letter file %q", cfg.DeadLetterFile)
+				}
+			}
+		})
+	}
+}
+
+func TestParseConfigS3Replicas(t *testing.T) {
+	for _, test := range []struct {
+		desc        string
+		outputType  string
+		replicas    string
+		expected    []string
+		expectError bool
+	}{
+		{
+			desc:       "regions and buckets",
+			outputType: "olds3",
+			replicas:   "us-west-2:events-dr, events-backup",
+			expected:   []string{"us-west-2:events-dr", "us-east-1:events-backup"},
+		},
+		{desc: "repeated target", outputType: "olds3", replicas: "us-west-2:dr,us-west-2:dr", expectError: true},
+		{desc: "temp directory", outputType: "olds3", replicas: "/tmp:us-west-2:dr", expectError: true},
+		{desc: "missing bucket", outputType: "olds3", replicas: "us-west-2:", expectError: true},
+		{desc: "streaming s3 output", outputType: "s3", replicas: "us-west-2:dr", expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			sections := map[string]mapString{
+				"bridge": {
+					"rabbit_mq_username": "cb",
+					"rabbit_mq_password": "password",
+					"cb_server_url":      "https://cbserver/",
+					"server_name":        "test",
+					"output_type":        test.outputType,
+					"s3out":              "us-east-1:events",
+				},
+				"s3": {"replicas": test.replicas},
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(sections))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+			if diff := cmp.Diff(test.expected, config.S3Replicas); diff != "" {
+				t.Errorf("replicas mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseConfigEmptyOutputPolicy(t *testing.T) {
+	for _, test := range []struct {
+		value       string
+		expected    EmptyOutputPolicy
+		expectError bool
+	}{
+		{value: "", expected: SkipEmptyOutput},
+		{value: "skip", expected: SkipEmptyOutput},
+		{value: " Error", expected: ErrorOnEmptyOutput},
+		{value: "drop", expectError: true},
+	} {
+		t.Run(test.value, func(t *testing.T) {
+			bridge := mapString{
+				"rabbit_mq_username": "cb",
+				"rabbit_mq_password": "password",
+				"cb_server_url":      "https://cbserver/",
+				"server_name":        "test",
+				"output_type":        "file",
+				"outfile":            "/tmp/out.json",
+			}
+			if test.value != "" {
+				bridge["empty_output_policy"] = test.value
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(map[string]mapString{"bridge": bridge}))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if !test.expectError && config.EmptyOutputPolicy != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, config.EmptyOutputPolicy)
+			}
+		})
+	}
+}
+
+func TestParseConfigPaceEPS(t *testing.T) {
+	for _, test := range []struct {
+		value       string
+		expected    float64
+		expectError bool
+	}{
+		{value: "", expected: 0},
+		{value: "0", expected: 0},
+		{value: "250", expected: 250},
+		{value: "0.5", expected: 0.5},
+		{value: "-1", expectError: true},
+		{value: "0.001", expectError: true},
+		{value: "fast", expectError: true},
+	} {
+		t.Run(test.value, func(t *testing.T) {
+			bridge := mapString{
+				"rabbit_mq_username": "cb",
+				"rabbit_mq_password": "password",
+				"cb_server_url":      "https://cbserver/",
+				"server_name":        "test",
+				"output_type":        "file",
+				"outfile":            "/tmp/out.json",
+			}
+			if test.value != "" {
+				bridge["pace_eps"] = test.value
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(map[string]mapString{"bridge": bridge}))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if !test.expectError && config.PaceEPS != test.expected {
+				t.Errorf("expected %f, got %f", test.expected, config.PaceEPS)
+			}
+		})
+	}
+}
+
+func TestParseConfigDebugTee(t *testing.T) {
+	for _, test := range []struct {
+		desc        string
+		settings    mapString
+		rate        float64
+		maxBytes    int64
+		expectError bool
+	}{
+		{desc: "defaults", settings: mapString{"debug_tee_file": "/tmp/tee.json"}, rate: 0.01, maxBytes: 100 * 1024 * 1024},
+		{desc: "custom", settings: mapString{"debug_tee_file": "/tmp/tee.json", "debug_tee_sample_rate": "1", "debug_tee_max_mb": "5"}, rate: 1, maxBytes: 5 * 1024 * 1024},
+		{desc: "zero rate", settings: mapString{"debug_tee_sample_rate": "0"}, expectError: true},
+		{desc: "rate over 1", settings: mapString{"debug_tee_sample_rate": "1.5"}, expectError: true},
+		{desc: "invalid max_mb", settings: mapString{"debug_tee_max_mb": "0"}, expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			bridge := mapString{
+				"rabbit_mq_username": "cb",
+				"rabbit_mq_password": "password",
+				"cb_server_url":      "https://cbserver/",
+				"server_name":        "test",
+				"output_type":        "file",
+				"outfile":            "/tmp/out.json",
+			}
+			for key, value := range test.settings {
+				bridge[key] = value
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(map[string]mapString{"bridge": bridge}))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+			if config.DebugTeeFile != "/tmp/tee.json" || config.DebugTeeSampleRate != test.rate || config.DebugTeeMaxBytes != test.maxBytes {
+				t.Errorf("unexpected debug tee settings: %s %v %d", config.DebugTeeFile, config.DebugTeeSampleRate, config.DebugTeeMaxBytes)
+			}
+		})
+	}
+}
+
+func TestParseConfigEventMaxAge(t *testing.T) {
+	for _, test := range []struct {
+		value       string
+		expected    time.Duration
+		expectError bool
+	}{
+		{value: "", expected: 0},
+		{value: "0", expected: 0},
+		{value: "3600", expected: time.Hour},
+		{value: "-1", expectError: true},
+		{value: "1h", expectError: true},
+	} {
+		t.Run(test.value, func(t *testing.T) {
+			bridge := mapString{
+				"rabbit_mq_username": "cb",
+				"rabbit_mq_password": "password",
+				"cb_server_url":      "https://cbserver/",
+				"server_name":        "test",
+				"output_type":        "file",
+				"outfile":            "/tmp/out.json",
+			}
+			if test.value != "" {
+				bridge["event_max_age"] = test.value
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(map[string]mapString{"bridge": bridge}))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if !test.expectError && config.EventMaxAge != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, config.EventMaxAge)
+			}
+		})
+	}
+}
+
+func TestParseConfigMaxLineBytes(t *testing.T) {
+	for _, test := range []struct {
+		desc           string
+		values         mapString
+		expectedBytes  int
+		expectedPolicy LongLinePolicy
+		expectError    bool
+	}{
+		{desc: "default", values: mapString{}, expectedPolicy: TruncateLongLines},
+		{desc: "truncate leef", values: mapString{"output_format": "leef", "max_line_bytes": "8192"}, expectedBytes: 8192, expectedPolicy: TruncateLongLines},
+		{desc: "drop json", values: mapString{"max_line_bytes": "8192", "long_line_policy": " Drop"}, expectedBytes: 8192, expectedPolicy: DropLongLines},
+		{desc: "truncate json", values: mapString{"max_line_bytes": "8192", "long_line_policy": "truncate"}, expectError: true},
+		{desc: "msgpack", values: mapString{"output_format": "msgpack", "max_line_bytes": "8192", "long_line_policy": "drop"}, expectError: true},
+		{desc: "negative", values: mapString{"max_line_bytes": "-1"}, expectError: true},
+		{desc: "unknown policy", values: mapString{"output_format": "leef", "long_line_policy": "wrap"}, expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			bridge := mapString{
+				"rabbit_mq_username": "cb",
+				"rabbit_mq_password": "password",
+				"cb_server_url":      "https://cbserver/",
+				"server_name":        "test",
+				"output_type":        "file",
+				"outfile":            "/tmp/out.json",
+			}
+			for key, value := range test.values {
+				bridge[key] = value
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(map[string]mapString{"bridge": bridge}))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if !test.expectError && (config.MaxLineBytes != test.expectedBytes || config.LongLinePolicy != test.expectedPolicy) {
+				t.Errorf("expected %d and %s, got %d and %s", test.expectedBytes, test.expectedPolicy, config.MaxLineBytes, config.LongLinePolicy)
+			}
+		})
+	}
+}
+
+func TestParseConfigHeartbeat(t *testing.T) {
+	for _, test := range []struct {
+		desc        string
+		bridge      mapString
+		tcp         mapString
+		expected    []interface{}
+		expectError bool
+	}{
+		{desc: "disabled", expected: []interface{}{time.Duration(0), 10 * time.Second, "PING", "PONG"}},
+		{
+			desc:     "custom",
+			tcp:      mapString{"heartbeat_interval": "30", "heartbeat_timeout": "5", "heartbeat_ping": "HB?", "heartbeat_pong": "HB!"},
+			expected: []interface{}{30 * time.Second, 5 * time.Second, "HB?", "HB!"},
+		},
+		{desc: "invalid timeout", tcp: mapString{"heartbeat_interval": "30", "heartbeat_timeout": "0"}, expectError: true},
+		{desc: "msgpack", bridge: mapString{"output_format": "msgpack"}, tcp: mapString{"heartbeat_interval": "30"}, expectError: true},
+		{desc: "idle timeout", tcp: mapString{"heartbeat_interval": "30", "idle_timeout": "60"}, expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			bridge := mapString{
+				"rabbit_mq_username": "cb",
+				"rabbit_mq_password": "password",
+				"cb_server_url":      "https://cbserver/",
+				"server_name":        "test",
+				"output_type":        "tcp",
+				"tcpout":             "collector:514",
+			}
+			for key, value := range test.bridge {
+				bridge[key] = value
+			}
+			sections := map[string]mapString{"bridge": bridge}
+			if test.tcp != nil {
+				sections["tcp"] = test.tcp
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(sections))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+			actual := []interface{}{config.HeartbeatInterval, config.HeartbeatTimeout, config.HeartbeatPing, config.HeartbeatPong}
+			if diff := cmp.Diff(test.expected, actual); diff != "" {
+				t.Errorf("heartbeat settings mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseConfigFrameCompression(t *testing.T) {
+	for _, test := range []struct {
+		desc        string
+		tcp         mapString
+		expected    []interface{}
+		expectError bool
+	}{
+		{desc: "disabled", expected: []interface{}{NoFrameCompression, DefaultFrameCompressionThreshold}},
+		{desc: "zstd", tcp: mapString{"frame_compression": "ZSTD", "frame_compression_threshold": "1024"}, expected: []interface{}{ZstdFrameCompression, 1024}},
+		{desc: "unknown codec", tcp: mapString{"frame_compression": "lz4"}, expectError: true},
+		{desc: "invalid threshold", tcp: mapString{"frame_compression": "gzip", "frame_compression_threshold": "-1"}, expectError: true},
+		{desc: "replay", tcp: mapString{"frame_compression": "gzip", "replay_on_reconnect": "10"}, expectError: true},
+		{desc: "chunks", tcp: mapString{"frame_compression": "gzip", "max_message_size": "1400", "oversize_policy": "chunk"}, expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			sections := map[string]mapString{"bridge": {
+				"rabbit_mq_username": "cb",
+				"rabbit_mq_password": "password",
+				"cb_server_url":      "https://cbserver/",
+				"server_name":        "test",
+				"output_type":        "tcp",
+				"tcpout":             "collector:514",
+			}}
+			if test.tcp != nil {
+				sections["tcp"] = test.tcp
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(sections))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+			actual := []interface{}{config.FrameCompression, config.FrameCompressionThreshold}
+			if diff := cmp.Diff(test.expected, actual); diff != "" {
+				t.Errorf("frame compression settings mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseConfigCompressionLevel(t *testing.T) {
+	for _, test := range []struct {
+		desc        string
+		bridge      mapString
+		tcp         mapString
+		expected    CompressionLevel
+		expectError bool
+	}{
+		{desc: "balanced by default", bridge: mapString{"compress_data": "true"}, expected: DefaultCompressionLevel},
+		{desc: "gzip level", bridge: mapString{"compress_data": "true", "compression_level": "9"}, expected: 9},
+		{desc: "named", bridge: mapString{"compress_data": "true", "compression_type": "lz4", "compression_level": "Fastest"}, expected: FastestCompressionLevel},
+		{desc: "zstd level", tcp: mapString{"frame_compression": "zstd"}, bridge: mapString{"compression_level": "19"}, expected: 19},
+		{desc: "beyond gzip", bridge: mapString{"compression_level": "19"}, tcp: mapString{"frame_compression": "gzip"}, expectError: true},
+		{desc: "beyond lz4", bridge: mapString{"compress_data": "true", "compression_type": "lz4", "compression_level": "12"}, expectError: true},
+		{desc: "not a level", bridge: mapString{"compress_data": "true", "compression_level": "max"}, expectError: true},
+		// the gzip levels that compression_level used to take
+		{desc: "zero", bridge: mapString{"compress_data": "true", "compression_level": "0"}, expected: NoCompressionLevel},
+		{desc: "minus one", bridge: mapString{"compress_data": "true", "compression_level": "-1"}, expected: DefaultCompressionLevel},
+		{desc: "below minus one", bridge: mapString{"compress_data": "true", "compression_level": "-2"}, expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			bridge := mapString{
+				"rabbit_mq_username": "cb",
+				"rabbit_mq_password": "password",
+				"cb_server_url":      "https://cbserver/",
+				"server_name":        "test",
+				"output_type":        "tcp",
+				"tcpout":             "collector:514",
+			}
+			for key, value := range test.bridge {
+				bridge[key] = value
+			}
+			sections := map[string]mapString{"bridge": bridge}
+			if test.tcp != nil {
+				sections["tcp"] = test.tcp
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(sections))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+			if config.CompressionLevel != test.expected {
+				t.Errorf("expected compression level %s, got %s", test.expected, config.CompressionLevel)
+			}
+		})
+	}
+}
+
+func TestParseConfigStartTLS(t *testing.T) {
+	for _, test := range []struct {
+		desc        string
+		tcp         mapString
+		expected    []interface{}
+		expectError bool
+	}{
+		{desc: "disabled", tcp: mapString{"use_tls": "true"}, expected: []interface{}{"", "OK", 10 * time.Second}},
+		{desc: "enabled", tcp: mapString{"use_tls": "true", "starttls": "STARTTLS", "starttls_reply": "220", "starttls_timeout": "3"},
+			expected: []interface{}{"STARTTLS", "220", 3 * time.Second}},
+		{desc: "without tls", tcp: mapString{"starttls": "STARTTLS"}, expectError: true},
+		{desc: "empty reply", tcp: mapString{"use_tls": "true", "starttls": "STARTTLS", "starttls_reply": ""}, expectError: true},
+		{desc: "invalid timeout", tcp: mapString{"use_tls": "true", "starttls": "STARTTLS", "starttls_timeout": "0"}, expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			sections := map[string]mapString{
+				"bridge": {
+					"rabbit_mq_username": "cb",
+					"rabbit_mq_password": "password",
+					"cb_server_url":      "https://cbserver/",
+					"server_name":        "test",
+					"output_type":        "tcp",
+					"tcpout":             "collector:6514",
+				},
+				"tcp": test.tcp,
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(sections))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+			actual := []interface{}{config.StartTLSCommand, config.StartTLSReply, config.StartTLSTimeout}
+			if diff := cmp.Diff(test.expected, actual); diff != "" {
+				t.Errorf("starttls settings mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseConfigTCPNoDelay(t *testing.T) {
+	for _, test := range []struct {
+		desc        string
+		tcp         mapString
+		expected    bool
+		expectError bool
+	}{
+		{desc: "default", expected: true},
+		{desc: "enabled", tcp: mapString{"tcp_nodelay": "true"}, expected: true},
+		{desc: "disabled", tcp: mapString{"tcp_nodelay": "false"}, expected: false},
+		{desc: "invalid", tcp: mapString{"tcp_nodelay": "sometimes"}, expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			sections := map[string]mapString{
+				"bridge": {
+					"rabbit_mq_username": "cb",
+					"rabbit_mq_password": "password",
+					"cb_server_url":      "https://cbserver/",
+					"server_name":        "test",
+					"output_type":        "tcp",
+					"tcpout":             "collector:6514",
+				},
+			}
+			if test.tcp != nil {
+				sections["tcp"] = test.tcp
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(sections))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+			if config.TCPNoDelay != test.expected {
+				t.Errorf("expected tcp_nodelay %v, got %v", test.expected, config.TCPNoDelay)
+			}
+		})
+	}
+}
+
+func TestParseConfigLowThroughput(t *testing.T) {
+	for _, test := range []struct {
+		desc        string
+		outputType  string
+		section     mapString
+		expected    []interface{}
+		expectError bool
+	}{
+		{desc: "disabled", outputType: "tcp", expected: []interface{}{int64(0), 5 * time.Minute}},
+		{desc: "tcp", outputType: "tcp", section: mapString{"min_events_per_window": "1000", "throughput_window": "60"}, expected: []interface{}{int64(1000), time.Minute}},
+		{desc: "udp", outputType: "udp", section: mapString{"min_events_per_window": "10"}, expected: []interface{}{int64(10), 5 * time.Minute}},
+		{desc: "negative", outputType: "tcp", section: mapString{"min_events_per_window": "-1"}, expectError: true},
+		{desc: "empty window", outputType: "udp", section: mapString{"min_events_per_window": "10", "throughput_window": "0"}, expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			sections := map[string]mapString{"bridge": {
+				"rabbit_mq_username":    "cb",
+				"rabbit_mq_password":    "password",
+				"cb_server_url":         "https://cbserver/",
+				"server_name":           "test",
+				"output_type":           test.outputType,
+				test.outputType + "out": "collector:514",
+			}}
+			if test.section != nil {
+				sections[test.outputType] = test.section
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(sections))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+			actual := []interface{}{config.MinEventsPerWindow, config.ThroughputWindow}
+			if diff := cmp.Diff(test.expected, actual); diff != "" {
+				t.Errorf("throughput settings mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseConfigRotationNotice(t *testing.T) {
+	for _, test := range []struct {
+		desc        string
+		bridge      mapString
+		tcp         mapString
+		expected    []interface{}
+		expectError bool
+	}{
+		{desc: "disabled", expected: []interface{}{"", 2 * time.Second}},
+		{desc: "custom", tcp: mapString{"rotation_notice": " CHECKPOINT ", "rotation_notice_grace": "10"}, expected: []interface{}{"CHECKPOINT", 10 * time.Second}},
+		{desc: "invalid grace", tcp: mapString{"rotation_notice": "CHECKPOINT", "rotation_notice_grace": "-1"}, expectError: true},
+		{desc: "msgpack", bridge: mapString{"output_format": "msgpack"}, tcp: mapString{"rotation_notice": "CHECKPOINT"}, expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			bridge := mapString{
+				"rabbit_mq_username": "cb",
+				"rabbit_mq_password": "password",
+				"cb_server_url":      "https://cbserver/",
+				"server_name":        "test",
+				"output_type":        "tcp",
+				"tcpout":             "collector:514",
+			}
+			for key, value := range test.bridge {
+				bridge[key] = value
+			}
+			sections := map[string]mapString{"bridge": bridge}
+			if test.tcp != nil {
+				sections["tcp"] = test.tcp
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(sections))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+			actual := []interface{}{config.RotationNotice, config.RotationNoticeGrace}
+			if diff := cmp.Diff(test.expected, actual); diff != "" {
+				t.Errorf("rotation notice settings mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseConfigLoki(t *testing.T) {
+	type lokiSettings struct {
+		Labels        []LokiLabel
+		StaticLabels  map[string]string
+		TenantID      string
+		BatchSize     int
+		BatchWait     time.Duration
+		MaxRetries    int
+		RetryAfterMax time.Duration
+	}
+
+	for _, test := range []struct {
+		desc        string
+		loki        mapString
+		expected    lokiSettings
+		expectError bool
+	}{
+		{
+			desc: "defaults",
+			expected: lokiSettings{
+				Labels:        []LokiLabel{{Name: "event_type", Field: "type"}},
+				StaticLabels:  map[string]string{"job": "cb-event-forwarder"},
+				BatchSize:     1000,
+				BatchWait:     time.Second,
+				MaxRetries:    5,
+				RetryAfterMax: 30 * time.Second,
+			},
+		},
+		{
+			desc: "custom",
+			loki: mapString{
+				"labels":          "event_type=type, sensor_id, process.name",
+				"static_labels":   "job=edr, env = prod",
+				"tenant_id":       "tenant1",
+				"batch_size":      "500",
+				"batch_wait_ms":   "250",
+				"max_retries":     "0",
+				"retry_after_max": "0",
+			},
+			expected: lokiSettings{
+				Labels: []LokiLabel{
+					{Name: "event_type", Field: "type"},
+					{Name: "sensor_id", Field: "sensor_id"},
+					{Name: "process_name", Field: "process.name"},
+				},
+				StaticLabels: map[string]string{"job": "edr", "env": "prod"},
+				TenantID:     "tenant1",
+				BatchSize:    500,
+				BatchWait:    250 * time.Millisecond,
+				MaxRetries:   0,
+			},
+		},
+		{desc: "no labels", loki: mapString{"labels": "", "static_labels": ""}, expectError: true},
+		{desc: "invalid label name", loki: mapString{"labels": "event-type=type"}, expectError: true},
+		{desc: "reserved label name", loki: mapString{"static_labels": "__name__=events"}, expectError: true},
+		{desc: "static label without value", loki: mapString{"static_labels": "job"}, expectError: true},
+		{desc: "invalid batch_size", loki: mapString{"batch_size": "0"}, expectError: true},
+		{desc: "invalid batch_wait_ms", loki: mapString{"batch_wait_ms": "soon"}, expectError: true},
+		{desc: "invalid max_retries", loki: mapString{"max_retries": "-1"}, expectError: true},
+		{desc: "invalid retry_after_max", loki: mapString{"retry_after_max": "-5"}, expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			sections := map[string]mapString{"bridge": {
+				"rabbit_mq_username": "cb",
+				"rabbit_mq_password": "password",
+				"cb_server_url":      "https://cbserver/",
+				"server_name":        "test",
+				"output_type":        "loki",
+				"lokiout":            "http://loki:3100",
+			}}
+			if test.loki != nil {
+				sections["loki"] = test.loki
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(sections))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+			actual := lokiSettings{
+				Labels:        config.LokiLabels,
+				StaticLabels:  config.LokiStaticLabels,
+				TenantID:      config.LokiHeaders.Get("X-Scope-OrgID"),
+				BatchSize:     config.LokiBatchSize,
+				BatchWait:     config.LokiBatchWait,
+				MaxRetries:    config.LokiMaxRetries,
+				RetryAfterMax: config.LokiRetryAfterMax,
+			}
+			if config.OutputType != LokiOutputType || config.OutputParameters != "http://loki:3100" {
+				t.Errorf("unexpected output %d %s", config.OutputType, config.OutputParameters)
+			}
+			if diff := cmp.Diff(test.expected, actual); diff != "" {
+				t.Errorf("loki settings mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseConfigSQL(t *testing.T) {
+	type sqlSettings struct {
+		Driver             string
+		Table              string
+		Columns            []SQLColumn
+		ExtraColumn        string
+		BatchSize          int
+		BatchWait          time.Duration
+		MaxRetries         int
+		MaxOpenConnections int
+	}
+
+	for _, test := range []struct {
+		desc        string
+		bridge      mapString
+		sql         mapString
+		expected    sqlSettings
+		expectError bool
+	}{
+		{
+			desc: "defaults",
+			sql:  mapString{"table": "cb_events"},
+			expected: sqlSettings{
+				Driver:             "postgres",
+				Table:              "cb_events",
+				ExtraColumn:        "event",
+				BatchSize:          500,
+				BatchWait:          time.Second,
+				MaxRetries:         5,
+				MaxOpenConnections: 4,
+			},
+		},
+		{
+			desc: "custom",
+			sql: mapString{
+				"driver":               "pgx",
+				"table":                "edr.events",
+				"columns":              "event_type=type, sensor_id, process.pid, event_time=timestamp:timestamp",
+				"extra_column":         "",
+				"batch_size":           "100",
+				"batch_wait_ms":        "250",
+				"max_retries":          "1",
+				"max_open_connections": "8",
+			},
+			expected: sqlSettings{
+				Driver: "pgx",
+				Table:  "edr.events",
+				Columns: []SQLColumn{
+					{Name: "event_type", Field: "type"},
+					{Name: "sensor_id", Field: "sensor_id"},
+					{Name: "process_pid", Field: "process.pid"},
+					{Name: "event_time", Field: "timestamp", Timestamp: true},
+				},
+				BatchSize:          100,
+				BatchWait:          250 * time.Millisecond,
+				MaxRetries:         1,
+				MaxOpenConnections: 8,
+			},
+		},
+		{desc: "missing table", expectError: true},
+		{desc: "invalid table", sql: mapString{"table": "events-2024"}, expectError: true},
+		{desc: "invalid column", sql: mapString{"table": "events", "columns": "event-type=type"}, expectError: true},
+		{desc: "unknown conversion", sql: mapString{"table": "events", "columns": "event_time=timestamp:date"}, expectError: true},
+		{desc: "duplicate column", sql: mapString{"table": "events", "columns": "type, TYPE=event_type"}, expectError: true},
+		{desc: "column is the extra column", sql: mapString{"table": "events", "columns": "event=type"}, expectError: true},
+		{desc: "no columns", sql: mapString{"table": "events", "extra_column": ""}, expectError: true},
+		{desc: "invalid batch_size", sql: mapString{"table": "events", "batch_size": "0"}, expectError: true},
+		{desc: "invalid max_open_connections", sql: mapString{"table": "events", "max_open_connections": "0"}, expectError: true},
+		{desc: "leef", bridge: mapString{"output_format": "leef"}, sql: mapString{"table": "events"}, expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			bridge := mapString{
+				"rabbit_mq_username": "cb",
+				"rabbit_mq_password": "password",
+				"cb_server_url":      "https://cbserver/",
+				"server_name":        "test",
+				"output_type":        "sql",
+				"sqlout":             "postgres://forwarder@db/events",
+			}
+			for key, value := range test.bridge {
+				bridge[key] = value
+			}
+			sections := map[string]mapString{"bridge": bridge}
+			if test.sql != nil {
+				sections["sql"] = test.sql
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(sections))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+			actual := sqlSettings{
+				Driver:             config.SQLDriver,
+				Table:              config.SQLTable,
+				Columns:            config.SQLColumns,
+				ExtraColumn:        config.SQLExtraColumn,
+				BatchSize:          config.SQLBatchSize,
+				BatchWait:          config.SQLBatchWait,
+				MaxRetries:         config.SQLMaxRetries,
+				MaxOpenConnections: config.SQLMaxOpenConnections,
+			}
+			if diff := cmp.Diff(test.expected, actual); diff != "" {
+				t.Errorf("sql settings mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseConfigSplunkHEC(t *testing.T) {
+	type splunkHECSettings struct {
+		Token       string
+		Source      string
+		SourceType  string
+		Index       string
+		HostField   string
+		SourceTypes []EventTypeValue
+		Indexes     []EventTypeValue
+		BatchSize   int
+		BatchWait   time.Duration
+		MaxRetries  int
+		Ack         bool
+		Channel     string
+		AckInterval time.Duration
+		AckTimeout  time.Duration
+	}
+
+	for _, test := range []struct {
+		desc        string
+		splunkHEC   mapString
+		expected    splunkHECSettings
+		expectError bool
+	}{
+		{
+			desc:      "defaults",
+			splunkHEC: mapString{"hec_token": "token"},
+			expected: splunkHECSettings{
+				Token:       "token",
+				SourceType:  DefaultSplunkHECSourceType,
+				HostField:   "computer_name",
+				BatchSize:   100,
+				BatchWait:   time.Second,
+				MaxRetries:  5,
+				AckInterval: time.Second,
+				AckTimeout:  time.Minute,
+			},
+		},
+		{
+			desc: "custom",
+			splunkHEC: mapString{
+				"hec_token":              "token",
+				"source":                 "edr",
+				"sourcetype":             "cb:json",
+				"index":                  "main",
+				"host_field":             "",
+				"event_type_sourcetypes": "alert.*=cb:alert",
+				"event_type_indexes":     "ingress.event.netconn = network, ingress.event.*=endpoint",
+				"batch_size":             "10",
+				"batch_wait_ms":          "250",
+				"max_retries":            "0",
+				"indexer_ack":            "true",
+				"channel":                "11111111-2222-3333-4444-555555555555",
+				"ack_interval_ms":        "500",
+				"ack_timeout":            "30",
+			},
+			expected: splunkHECSettings{
+				Token:       "token",
+				Source:      "edr",
+				SourceType:  "cb:json",
+				Index:       "main",
+				SourceTypes: []EventTypeValue{{TypePattern: "alert.*", Value: "cb:alert"}},
+				Indexes: []EventTypeValue{
+					{TypePattern: "ingress.event.netconn", Value: "network"},
+					{TypePattern: "ingress.event.*", Value: "endpoint"},
+				},
+				BatchSize:   10,
+				BatchWait:   250 * time.Millisecond,
+				MaxRetries:  0,
+				Ack:         true,
+				Channel:     "11111111-2222-3333-4444-555555555555",
+				AckInterval: 500 * time.Millisecond,
+				AckTimeout:  30 * time.Second,
+			},
+		},
+		{desc: "missing hec_token", expectError: true},
+		{desc: "override without value", splunkHEC: mapString{"hec_token": "token", "event_type_indexes": "alert.*"}, expectError: true},
+		{desc: "invalid override pattern", splunkHEC: mapString{"hec_token": "token", "event_type_sourcetypes": "alert.[=cb:alert"}, expectError: true},
+		{desc: "invalid batch_size", splunkHEC: mapString{"hec_token": "token", "batch_size": "0"}, expectError: true},
+		{desc: "invalid indexer_ack", splunkHEC: mapString{"hec_token": "token", "indexer_ack": "maybe"}, expectError: true},
+		{desc: "invalid ack_timeout", splunkHEC: mapString{"hec_token": "token", "ack_timeout": "0"}, expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			sections := map[string]mapString{"bridge": {
+				"rabbit_mq_username": "cb",
+				"rabbit_mq_password": "password",
+				"cb_server_url":      "https://cbserver/",
+				"server_name":        "test",
+				"output_type":        "splunk_hec",
+				"splunkhecout":       "https://splunk:8088",
+			}}
+			if test.splunkHEC != nil {
+				sections["splunk_hec"] = test.splunkHEC
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(sections))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+			actual := splunkHECSettings{
+				Token:       config.SplunkHECToken,
+				Source:      config.SplunkHECSource,
+				SourceType:  config.SplunkHECSourceType,
+				Index:       config.SplunkHECIndex,
+				HostField:   config.SplunkHECHostField,
+				SourceTypes: config.SplunkHECSourceTypes,
+				Indexes:     config.SplunkHECIndexes,
+				BatchSize:   config.SplunkHECBatchSize,
+				BatchWait:   config.SplunkHECBatchWait,
+				MaxRetries:  config.SplunkHECMaxRetries,
+				Ack:         config.SplunkHECAck,
+				Channel:     config.SplunkHECChannel,
+				AckInterval: config.SplunkHECAckInterval,
+				AckTimeout:  config.SplunkHECAckTimeout,
+			}
+			if config.OutputType != SplunkHECOutputType || config.OutputParameters != "https://splunk:8088" {
+				t.Errorf("unexpected output %d %s", config.OutputType, config.OutputParameters)
+			}
+			if diff := cmp.Diff(test.expected, actual); diff != "" {
+				t.Errorf("splunk_hec settings mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseConfigNATS(t *testing.T) {
+	type natsSettings struct {
+		Subject        string
+		User           string
+		Password       string
+		Token          string
+		JetStream      bool
+		Stream         string
+		MaxPendingAcks int
+		AckTimeout     time.Duration
+		MaxRetries     int
+	}
+
+	for _, test := range []struct {
+		desc        string
+		nats        mapString
+		expected    natsSettings
+		expectError bool
+	}{
+		{
+			desc: "defaults",
+			nats: mapString{"subject": "cb.events"},
+			expected: natsSettings{
+				Subject:        "cb.events",
+				MaxPendingAcks: 256,
+				AckTimeout:     5 * time.Second,
+				MaxRetries:     5,
+			},
+		},
+		{
+			desc: "custom",
+			nats: mapString{
+				"subject":          `cb.{{.Field "type"}}`,
+				"user":             "forwarder",
+				"password":         "secret",
+				"token":            "s3cr3t",
+				"jetstream":        "true",
+				"stream":           "EDR",
+				"max_pending_acks": "10",
+				"ack_timeout":      "30",
+				"max_retries":      "0",
+			},
+			expected: natsSettings{
+				Subject:        "cb.ingress.event.procstart",
+				User:           "forwarder",
+				Password:       "secret",
+				Token:          "s3cr3t",
+				JetStream:      true,
+				Stream:         "EDR",
+				MaxPendingAcks: 10,
+				AckTimeout:     30 * time.Second,
+				MaxRetries:     0,
+			},
+		},
+		{desc: "missing subject", expectError: true},
+		{desc: "invalid template", nats: mapString{"subject": `cb.{{.Field "type"`}, expectError: true},
+		{desc: "wildcard subject", nats: mapString{"subject": "cb.>"}, expectError: true},
+		{desc: "stream without jetstream", nats: mapString{"subject": "cb", "stream": "EDR"}, expectError: true},
+		{desc: "invalid jetstream", nats: mapString{"subject": "cb", "jetstream": "maybe"}, expectError: true},
+		{desc: "invalid max_pending_acks", nats: mapString{"subject": "cb", "max_pending_acks": "0"}, expectError: true},
+		{desc: "invalid ack_timeout", nats: mapString{"subject": "cb", "ack_timeout": "0"}, expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			sections := map[string]mapString{"bridge": {
+				"rabbit_mq_username": "cb",
+				"rabbit_mq_password": "password",
+				"cb_server_url":      "https://cbserver/",
+				"server_name":        "test",
+				"output_type":        "nats",
+				"natsout":            "nats://nats:4222",
+			}}
+			if test.nats != nil {
+				sections["nats"] = test.nats
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(sections))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+			subject, err := NATSSubject(config.NATSSubject, `{"type":"ingress.event.procstart"}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual := natsSettings{
+				Subject:        subject,
+				User:           config.NATSUser,
+				Password:       config.NATSPassword,
+				Token:          config.NATSToken,
+				JetStream:      config.NATSJetStream,
+				Stream:         config.NATSStream,
+				MaxPendingAcks: config.NATSMaxPendingAcks,
+				AckTimeout:     config.NATSAckTimeout,
+				MaxRetries:     config.NATSMaxRetries,
+			}
+			if config.OutputType != NATSOutputType || config.OutputParameters != "nats://nats:4222" {
+				t.Errorf("unexpected output %d %s", config.OutputType, config.OutputParameters)
+			}
+			if diff := cmp.Diff(test.expected, actual); diff != "" {
+				t.Errorf("nats settings mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseConfigOTLP(t *testing.T) {
+	type otlpSettings struct {
+		Protocol           string
+		Attributes         []OTLPAttribute
+		ResourceAttributes map[string]string
+		Authorization      string
+		BatchSize          int
+		BatchWait          time.Duration
+		MaxRetries         int
+	}
+
+	for _, test := range []struct {
+		desc        string
+		otlp        mapString
+		expected    otlpSettings
+		expectError bool
+	}{
+		{
+			desc: "defaults",
+			expected: otlpSettings{
+				Protocol:           OTLPHTTPProtocol,
+				Attributes:         []OTLPAttribute{{Name: "cb.event_type", Field: "type"}},
+				ResourceAttributes: map[string]string{"service.name": "cb-event-forwarder"},
+				BatchSize:          512,
+				BatchWait:          time.Second,
+				MaxRetries:         5,
+			},
+		},
+		{
+			desc: "custom",
+			otlp: mapString{
+				"protocol":             "gRPC",
+				"attributes":           "cb.event_type=type, sensor_id, host.name = computer_name",
+				"resource_attributes":  "service.name=edr, deployment.environment = prod",
+				"header_Authorization": "Bearer secret",
+				"batch_size":           "100",
+				"batch_wait_ms":        "250",
+				"max_retries":          "0",
+			},
+			expected: otlpSettings{
+				Protocol: OTLPGRPCProtocol,
+				Attributes: []OTLPAttribute{
+					{Name: "cb.event_type", Field: "type"},
+					{Name: "sensor_id", Field: "sensor_id"},
+					{Name: "host.name", Field: "computer_name"},
+				},
+				ResourceAttributes: map[string]string{"service.name": "edr", "deployment.environment": "prod"},
+				Authorization:      "Bearer secret",
+				BatchSize:          100,
+				BatchWait:          250 * time.Millisecond,
+				MaxRetries:         0,
+			},
+		},
+		{desc: "invalid protocol", otlp: mapString{"protocol": "http/json"}, expectError: true},
+		{desc: "attribute without field", otlp: mapString{"attributes": "sensor="}, expectError: true},
+		{desc: "resource attribute without value", otlp: mapString{"resource_attributes": "service.name"}, expectError: true},
+		{desc: "invalid batch_size", otlp: mapString{"batch_size": "0"}, expectError: true},
+		{desc: "invalid batch_wait_ms", otlp: mapString{"batch_wait_ms": "soon"}, expectError: true},
+		{desc: "invalid max_retries", otlp: mapString{"max_retries": "-1"}, expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			sections := map[string]mapString{"bridge": {
+				"rabbit_mq_username": "cb",
+				"rabbit_mq_password": "password",
+				"cb_server_url":      "https://cbserver/",
+				"server_name":        "test",
+				"output_type":        "otlp",
+				"otlpout":            "http://otel:4318",
+			}}
+			if test.otlp != nil {
+				sections["otlp"] = test.otlp
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(sections))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+			actual := otlpSettings{
+				Protocol:           config.OTLPProtocol,
+				Attributes:         config.OTLPAttributes,
+				ResourceAttributes: config.OTLPResourceAttributes,
+				Authorization:      config.OTLPHeaders.Get("Authorization"),
+				BatchSize:          config.OTLPBatchSize,
+				BatchWait:          config.OTLPBatchWait,
+				MaxRetries:         config.OTLPMaxRetries,
+			}
+			if config.OutputType != OTLPOutputType || config.OutputParameters != "http://otel:4318" {
+				t.Errorf("unexpected output %d %s", config.OutputType, config.OutputParameters)
+			}
+			if diff := cmp.Diff(test.expected, actual); diff != "" {
+				t.Errorf("otlp settings mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseConfigSchemaFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cb-event-forwarder-schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	schemaFile := filepath.Join(dir, "schema.json")
+	ioutil.WriteFile(schemaFile, []byte(`{"type":"object","required":["type"]}`), 0644)
+	unsupportedFile := filepath.Join(dir, "unsupported.json")
+	ioutil.WriteFile(unsupportedFile, []byte(`{"type":"object","dependentRequired":{"a":["b"]}}`), 0644)
+
+	for _, test := range []struct {
+		desc         string
+		bridge       mapString
+		expectSchema bool
+		expectStage  SchemaStage
+		expectPolicy SchemaFailurePolicy
+		expectError  bool
+	}{
+		{desc: "no schema", expectStage: ValidateFormattedEvents, expectPolicy: DropSchemaFailures},
+		{desc: "defaults", bridge: mapString{"schema_file": schemaFile}, expectSchema: true, expectStage: ValidateFormattedEvents, expectPolicy: DropSchemaFailures},
+		{
+			desc:         "event stage",
+			bridge:       mapString{"schema_file": schemaFile, "schema_stage": "event", "schema_failure_policy": "dead-letter", "output_format": "leef"},
+			expectSchema: true, expectStage: ValidateEventsBeforeFormat, expectPolicy: DeadLetterSchemaFailures,
+		},
+		{desc: "missing file", bridge: mapString{"schema_file": filepath.Join(dir, "missing.json")}, expectError: true},
+		{desc: "unsupported keyword", bridge: mapString{"schema_file": unsupportedFile}, expectError: true},
+		{desc: "formatted leef", bridge: mapString{"schema_file": schemaFile, "output_format": "leef"}, expectError: true},
+		{desc: "invalid stage", bridge: mapString{"schema_file": schemaFile, "schema_stage": "raw"}, expectError: true},
+		{desc: "invalid policy", bridge: mapString{"schema_file": schemaFile, "schema_failure_policy": "retry"}, expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			bridge := mapString{
+				"rabbit_mq_username": "cb",
+				"rabbit_mq_password": "password",
+				"cb_server_url":      "https://cbserver/",
+				"server_name":        "test",
+				"output_type":        "file",
+				"outfile":            filepath.Join(dir, "out.json"),
+			}
+			for key, value := range test.bridge {
+				bridge[key] = value
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(map[string]mapString{"bridge": bridge}))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+			if (config.EventSchema != nil) != test.expectSchema || config.SchemaStage != test.expectStage || config.SchemaFailurePolicy != test.expectPolicy {
+				t.Errorf("unexpected schema settings: schema %v, stage %s, policy %s", config.EventSchema != nil, config.SchemaStage, config.SchemaFailurePolicy)
+			}
+			if config.UsesDeadLetters() != (test.expectPolicy == DeadLetterSchemaFailures) {
+				t.Errorf("unexpected UsesDeadLetters %v", config.UsesDeadLetters())
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/carbonblack/cb-event-forwarder/pkg/forwarder"
+	"github.com/carbonblack/cb-event-forwarder/pkg/transforms"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDeadLetterFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cb-event-forwarder-dead-letters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dead-letters.json")
+	deadLetters, err := forwarder.OpenDeadLetterFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLetters.Write("", `{"type":"ingress.event.procstart","port":"443"}`, &transforms.ConflictError{Field: "port", First: "transform", Second: "coerce"})
+	deadLetters.Write("siem", `not json`, errors.New("conflicting writes"))
+	if err := deadLetters.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []forwarder.DeadLetterRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record forwarder.DeadLetterRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid record %s: %s", scanner.Text(), err)
+		}
+		if len(record.Time) == 0 {
+			t.Errorf("record without a time: %s", scanner.Text())
+		}
+		record.Time = ""
+		records = append(records, record)
+	}
+
+	// events that are not json are kept as a string
+	expected := []forwarder.DeadLetterRecord{
+		{Reason: "conflicting writes to port by transform and coerce", Event: json.RawMessage(`{"type":"ingress.event.procstart","port":"443"}`)},
+		{Output: "siem", Reason: "conflicting writes", Event: json.RawMessage(`"not json"`)},
+	}
+	if diff := cmp.Diff(expected, records); diff != "" {
+		t.Errorf("records mismatch (-want +got):\n%s", diff)
+	}
+	if stats := deadLetters.Statistics(); stats.EventCount != 2 || stats.WriteErrorCount != 0 || stats.File != path {
+		t.Errorf("unexpected statistics: %+v", stats)
+	}
+}
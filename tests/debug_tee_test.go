@@ -0,0 +1,134 @@
+package tests
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/carbonblack/cb-event-forwarder/pkg/formatters"
+	"github.com/carbonblack/cb-event-forwarder/pkg/forwarder"
+	"github.com/google/go-cmp/cmp"
+)
+
+func readDebugTeeRecords(t *testing.T, path string) []forwarder.DebugTeeRecord {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []forwarder.DebugTeeRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record forwarder.DebugTeeRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid record %s: %s", scanner.Text(), err)
+		}
+		if len(record.Time) == 0 {
+			t.Errorf("record without a time: %s", scanner.Text())
+		}
+		record.Time = ""
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestDebugTee(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cb-event-forwarder-debug-tee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tee.json")
+	tee, err := forwarder.OpenDebugTee(path, 0.5, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every second event is sampled
+	var events []*formatters.Event
+	for _, raw := range []string{
+		`{"type":"ingress.event.procstart","pid":1}`,
+		`{"type":"ingress.event.procstart","pid":2}`,
+		`{"type":"ingress.event.netconn","port":443}`,
+		`not json`,
+	} {
+		event := formatters.NewEvent(raw)
+		events = append(events, event)
+		record := tee.Sample(event)
+		record.Add("bridge", event.Raw()+"\n", nil)
+		record.Add("siem", "", errors.New("the formatted message is empty"))
+		tee.Write(record)
+	}
+	if err := tee.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []forwarder.DebugTeeRecord{
+		{
+			ID:    events[1].ID(),
+			Event: json.RawMessage(`{"type":"ingress.event.procstart","pid":2}`),
+			Outputs: map[string]forwarder.DebugTeeOutput{
+				"bridge": {Message: `{"type":"ingress.event.procstart","pid":2}` + "\n"},
+				"siem":   {Error: "the formatted message is empty"},
+			},
+		},
+		{
+			ID:    events[3].ID(),
+			Event: json.RawMessage(`"not json"`),
+			Outputs: map[string]forwarder.DebugTeeOutput{
+				"bridge": {Message: "not json\n"},
+				"siem":   {Error: "the formatted message is empty"},
+			},
+		},
+	}
+	if diff := cmp.Diff(expected, readDebugTeeRecords(t, path)); diff != "" {
+		t.Errorf("records mismatch (-want +got):\n%s", diff)
+	}
+	if stats := tee.Statistics(); stats.SampledEventCount != 2 || stats.WriteErrorCount != 0 || stats.File != path {
+		t.Errorf("unexpected statistics: %+v", stats)
+	}
+
+	// without a file nothing is sampled
+	tee, err = forwarder.OpenDebugTee("", 1, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record := tee.Sample(events[0]); record != nil {
+		t.Errorf("unexpected record without a file: %+v", record)
+	}
+}
+
+func TestDebugTeeRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cb-event-forwarder-debug-tee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// room for a single record per file
+	path := filepath.Join(dir, "tee.json")
+	tee, err := forwarder.OpenDebugTee(path, 1, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		event := formatters.NewEvent(`{"type":"ingress.event.procstart"}`)
+		record := tee.Sample(event)
+		record.Add("bridge", event.Raw(), nil)
+		tee.Write(record)
+	}
+	tee.Close()
+
+	current, previous := readDebugTeeRecords(t, path), readDebugTeeRecords(t, path+".1")
+	if len(current) != 1 || len(previous) != 1 || previous[0].ID+1 != current[0].ID {
+		t.Errorf("expected the last two records in the current and previous files, got %+v and %+v", current, previous)
+	}
+	if stats := tee.Statistics(); stats.SampledEventCount != 3 || stats.RotationCount != 2 || stats.WriteErrorCount != 0 {
+		t.Errorf("unexpected statistics: %+v", stats)
+	}
+}
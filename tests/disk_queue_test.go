@@ -0,0 +1,102 @@
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/carbonblack/cb-event-forwarder/pkg/forwarder"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiskQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.db")
+
+	events := func(first, n int) []forwarder.DiskQueueEvent {
+		var batch []forwarder.DiskQueueEvent
+		for i := first; i < first+n; i++ {
+			batch = append(batch, forwarder.DiskQueueEvent{Message: "event " + strconv.Itoa(i), Enqueued: time.Unix(int64(i), 0)})
+		}
+		return batch
+	}
+	messages := func(batch []forwarder.DiskQueueEvent) []string {
+		var m []string
+		for _, event := range batch {
+			m = append(m, event.Message)
+		}
+		return m
+	}
+
+	queue, err := forwarder.OpenDiskQueue(path, 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Push(events(0, 4)); err != nil {
+		t.Fatal(err)
+	}
+	next, err := queue.Next(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(messages(events(0, 3)), messages(next)); diff != "" {
+		t.Errorf("unexpected events (-want +got):\n%s", diff)
+	}
+	if !next[1].Enqueued.Equal(time.Unix(1, 0)) || !next[1].Received.IsZero() {
+		t.Errorf("unexpected times %s and %s", next[1].Enqueued, next[1].Received)
+	}
+	if err := queue.Remove(next[:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	// the queue holds 5 events, so the last of these waits for room
+	pushed := make(chan error)
+	go func() { pushed <- queue.Push(events(4, 4)) }()
+	select {
+	case err := <-pushed:
+		t.Fatalf("expected the push to wait for room, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if stats := queue.Statistics(); stats.Depth != 5 || stats.Bytes != 5*int64(len("event 0")) || stats.FileSize == 0 {
+		t.Errorf("unexpected statistics %+v", stats)
+	}
+	if err := queue.Remove(next[2:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-pushed; err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Push(events(8, 1)); err != forwarder.ErrDiskQueueClosed {
+		t.Errorf("expected pushing to a closed queue to fail, got %v", err)
+	}
+
+	// the events that were not removed are read again, in order, after reopening the queue
+	queue, err = forwarder.OpenDiskQueue(path, 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	if _, err := forwarder.OpenDiskQueue(path, 5, 0); err == nil {
+		t.Error("expected the queue file to be locked")
+	}
+	if stats := queue.Statistics(); stats.Depth != 5 {
+		t.Errorf("expected 5 events after reopening the queue, got %+v", stats)
+	}
+	next, err = queue.Next(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(messages(events(3, 5)), messages(next)); diff != "" {
+		t.Errorf("unexpected events after reopening the queue (-want +got):\n%s", diff)
+	}
+}
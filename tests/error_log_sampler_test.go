@@ -0,0 +1,59 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestErrorLogSampler(t *testing.T) {
+	type result struct {
+		Logged     bool
+		Suppressed int64
+	}
+
+	start := time.Now()
+	for _, test := range []struct {
+		desc     string
+		sampler  *outputs.ErrorLogSampler
+		offsets  []time.Duration
+		expected []result
+	}{
+		{
+			desc:     "burst then one per interval",
+			sampler:  outputs.NewErrorLogSampler(2, time.Minute),
+			offsets:  []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second, 61 * time.Second, 62 * time.Second},
+			expected: []result{{true, 0}, {true, 0}, {false, 0}, {false, 0}, {true, 2}, {false, 0}},
+		},
+		{
+			desc:     "new burst after a quiet interval",
+			sampler:  outputs.NewErrorLogSampler(1, time.Minute),
+			offsets:  []time.Duration{0, time.Second, 2 * time.Minute, 2*time.Minute + time.Second},
+			expected: []result{{true, 0}, {false, 0}, {true, 1}, {false, 0}},
+		},
+		{
+			desc:     "disabled",
+			sampler:  outputs.NewErrorLogSampler(0, 0),
+			offsets:  []time.Duration{0, 0, 0},
+			expected: []result{{true, 0}, {true, 0}, {true, 0}},
+		},
+		{
+			desc:     "nil sampler",
+			offsets:  []time.Duration{0, 0},
+			expected: []result{{true, 0}, {true, 0}},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			var results []result
+			for _, offset := range test.offsets {
+				logged, suppressed := test.sampler.Allow(start.Add(offset))
+				results = append(results, result{logged, suppressed})
+			}
+			if diff := cmp.Diff(test.expected, results); diff != "" {
+				t.Errorf("unexpected sampling, diff: %s", diff)
+			}
+		})
+	}
+}
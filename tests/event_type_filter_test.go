@@ -0,0 +1,155 @@
+package tests
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/forwarder"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEventTypeFilterSetRules(t *testing.T) {
+	event := func(eventType string) []byte {
+		return []byte(fmt.Sprintf(`{"type":%q}`, eventType))
+	}
+	admitted := func(filter *forwarder.EventTypeFilter, types ...string) []string {
+		var result []string
+		for _, eventType := range types {
+			if filter.Admit(event(eventType)) {
+				result = append(result, eventType)
+			}
+		}
+		return result
+	}
+	types := []string{"watchlist.hit.process", "alert.watchlist.hit.query.process", "ingress.event.moduleload"}
+
+	filter := forwarder.NewEventTypeFilter(nil, nil)
+	if diff := cmp.Diff(types, admitted(filter, types...)); diff != "" {
+		t.Errorf("expected every event without rules, diff: %s", diff)
+	}
+
+	if version := filter.SetRules([]string{"watchlist.hit.*", "alert.*"}, nil); version != 2 {
+		t.Errorf("expected rule set version 2, got %d", version)
+	}
+	if diff := cmp.Diff(types[:2], admitted(filter, types...)); diff != "" {
+		t.Errorf("unexpected events admitted by the allowlist, diff: %s", diff)
+	}
+
+	// decisions cached for the previous rules must not outlive them
+	if version := filter.SetRules(nil, []string{"watchlist.*"}); version != 3 {
+		t.Errorf("expected rule set version 3, got %d", version)
+	}
+	if diff := cmp.Diff(types[1:], admitted(filter, types...)); diff != "" {
+		t.Errorf("unexpected events admitted by the denylist, diff: %s", diff)
+	}
+
+	stats := filter.Statistics()
+	if stats.RuleSetVersion != 3 || stats.FilteredEventCount != 2 {
+		t.Errorf("unexpected statistics: %+v", stats)
+	}
+	if diff := cmp.Diff(map[string]int64{"ingress.event.moduleload": 1, "watchlist.hit.process": 1}, stats.FilteredByType); diff != "" {
+		t.Errorf("unexpected filtered counts, diff: %s", diff)
+	}
+}
+
+func TestEventTypeFilterConcurrentReload(t *testing.T) {
+	filter := forwarder.NewEventTypeFilter([]string{"a.*"}, nil)
+	msg := []byte(`{"type":"a.b"}`)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				filter.Admit(msg)
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			filter.SetRules(nil, []string{"a.*"})
+		} else {
+			filter.SetRules([]string{"a.*"}, nil)
+		}
+	}
+	wg.Wait()
+
+	if version := filter.Statistics().RuleSetVersion; version != 101 {
+		t.Errorf("expected rule set version 101, got %d", version)
+	}
+}
+
+func TestEventTypeRateLimiter(t *testing.T) {
+	limits, err := ParseEventTypeRateLimits("ingress.event.filemod:10, ingress.event.net*:5:sample=4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := forwarder.NewEventTypeRateLimiter(limits)
+
+	// 40 events of each type within a second, then 10 more a second later
+	admitted := map[string]int{}
+	start := time.Now()
+	for _, at := range []time.Duration{0, time.Second} {
+		events := 40
+		if at > 0 {
+			events = 10
+		}
+		for i := 0; i < events; i++ {
+			now := start.Add(at + time.Duration(i)*time.Millisecond)
+			for _, eventType := range []string{"ingress.event.filemod", "ingress.event.netconn", "alert.watchlist.hit.query.process"} {
+				if limiter.AdmitType(eventType, now) {
+					admitted[eventType]++
+				}
+			}
+		}
+	}
+
+	// the buckets start full and refill with a second worth of events; one in 4 netconn events
+	// over the limit is sampled: 8 of the first 35 and 2 of the next 5
+	expected := map[string]int{
+		"ingress.event.filemod":             10 + 10,
+		"ingress.event.netconn":             5 + 8 + 5 + 2,
+		"alert.watchlist.hit.query.process": 50,
+	}
+	if diff := cmp.Diff(expected, admitted); diff != "" {
+		t.Errorf("unexpected events admitted (-want +got):\n%s", diff)
+	}
+
+	stats := limiter.Statistics()
+	if diff := cmp.Diff(map[string]int64{"ingress.event.filemod": 30, "ingress.event.netconn": 30}, stats.ThrottledByType); diff != "" {
+		t.Errorf("unexpected throttled counts (-want +got):\n%s", diff)
+	}
+	if stats.ThrottledEventCount != 60 || stats.SampledByType["ingress.event.netconn"] != 10 {
+		t.Errorf("unexpected statistics: %+v", stats)
+	}
+
+	// events are only decoded when there are limits
+	if !forwarder.NewEventTypeRateLimiter(nil).Admit([]byte("not json")) {
+		t.Error("expected events to be admitted without limits")
+	}
+}
+
+func TestParseEventTypeRateLimits(t *testing.T) {
+	limits, err := ParseEventTypeRateLimits(" ingress.event.filemod:1000 , ingress.event.*:0.5:DROP, alert.*:10:sample=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []EventTypeRateLimit{
+		{TypePattern: "ingress.event.filemod", EventsPerSecond: 1000},
+		{TypePattern: "ingress.event.*", EventsPerSecond: 0.5},
+		{TypePattern: "alert.*", EventsPerSecond: 10, SampleOneIn: 100},
+	}
+	if diff := cmp.Diff(expected, limits); diff != "" {
+		t.Errorf("unexpected limits (-want +got):\n%s", diff)
+	}
+
+	for _, invalid := range []string{"filemod", "filemod:0", "filemod:fast", "[:10", "filemod:10:sample=0", "filemod:10:queue", ":10"} {
+		if _, err := ParseEventTypeRateLimits(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
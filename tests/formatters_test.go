@@ -0,0 +1,564 @@
+package tests
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	_ "github.com/carbonblack/cb-event-forwarder/examples/customformatter"
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/formatters"
+	"github.com/carbonblack/cb-event-forwarder/pkg/msgpackencoder"
+	"github.com/carbonblack/cb-event-forwarder/pkg/transforms"
+	"github.com/google/go-cmp/cmp"
+)
+
+func formatterForConfig(t *testing.T, cfg *Configuration) formatters.Formatter {
+	formatter, err := formatters.ForConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return formatter
+}
+
+func TestFormattersShareEvent(t *testing.T) {
+	const raw = `{"type":"ingress.event.netconn","cb_version":"7.5.0","docs":[{"process_name":"cmd.exe"}],"local_ip":"10.0.0.1","remote_ip":"10.0.0.2"}`
+
+	event := formatters.NewEvent(raw)
+	fields, err := event.Fields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := make(map[string]interface{})
+	for key, value := range fields {
+		before[key] = value
+	}
+
+	jsonOutput := formatterForConfig(t, &Configuration{OutputFormat: JSONOutputFormat})
+	leefOutput := formatterForConfig(t, &Configuration{OutputFormat: LEEFOutputFormat})
+
+	for _, test := range []struct {
+		desc      string
+		formatter formatters.Formatter
+		check     func(string) bool
+	}{
+		{desc: "json", formatter: jsonOutput, check: func(s string) bool { return s == raw }},
+		{desc: "leef", formatter: leefOutput, check: func(s string) bool {
+			return strings.HasPrefix(s, "LEEF:1.0|CB|CB|7.5.0|ingress.event.netconn|") &&
+				strings.Contains(s, "process_name=cmd.exe") && strings.Contains(s, "src=10.0.0.1")
+		}},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			formatted, err := test.formatter.Format(event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.check(formatted) {
+				t.Errorf("unexpected %s output: %s", test.desc, formatted)
+			}
+		})
+	}
+
+	// formatting must not leak changes into the event seen by other outputs
+	after, _ := event.Fields()
+	if diff := cmp.Diff(before, after); diff != "" {
+		t.Errorf("event modified by formatters, diff: %s", diff)
+	}
+}
+
+func TestFormattersParseError(t *testing.T) {
+	event := formatters.NewEvent("not json")
+
+	if formatted, err := (formatters.JSONFormatter{}).Format(event); err != nil || formatted != "not json" {
+		t.Errorf("json formatter should forward the event as is, got %q, %v", formatted, err)
+	}
+	if _, err := (formatters.LEEFFormatter{}).Format(event); err == nil {
+		t.Error("expected leef formatter to fail on an invalid event")
+	}
+}
+
+func TestEventEmbedID(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		raw      string
+		expected string
+	}{
+		{desc: "object", raw: `{"type":"ingress.event.procstart"}`, expected: `{"event_id":ID,"type":"ingress.event.procstart"}`},
+		{desc: "empty object", raw: `{ }`, expected: `{"event_id":ID}`},
+		{desc: "not an object", raw: `["a"]`, expected: `["a"]`},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			event := formatters.NewEvent(test.raw)
+			event.EmbedID("event_id")
+
+			id := strconv.FormatUint(event.ID(), 10)
+			if diff := cmp.Diff(strings.Replace(test.expected, "ID", id, 1), event.Raw()); diff != "" {
+				t.Errorf("unexpected event (-want +got):\n%s", diff)
+			}
+
+			embedded, ok := formatters.EmbeddedID(event.Raw(), "event_id")
+			if ok != strings.Contains(test.expected, "ID") || (ok && embedded != id) {
+				t.Errorf("expected embedded ID %s, got %q (%v)", id, embedded, ok)
+			}
+		})
+	}
+
+	if first, second := formatters.NewEvent("{}"), formatters.NewEvent("{}"); second.ID() <= first.ID() {
+		t.Errorf("expected increasing IDs, got %d then %d", first.ID(), second.ID())
+	}
+}
+
+func TestFlattenFormatter(t *testing.T) {
+	const raw = `{"type":"ingress.event.procstart","process":{"name":"cmd.exe","cmdline":"cmd /c dir","parent":{"pid":4}},"md5s":["a","b"],"docs":[{"id":1},{"id":2}],"empty":{}}`
+
+	for _, test := range []struct {
+		desc     string
+		options  FlattenOptions
+		expected string
+	}{
+		{
+			desc:     "index arrays",
+			options:  FlattenOptions{Separator: ".", Arrays: FlattenArraysIndex},
+			expected: `{"docs.0.id":1,"docs.1.id":2,"empty":"{}","md5s.0":"a","md5s.1":"b","process.cmdline":"cmd /c dir","process.name":"cmd.exe","process.parent.pid":4,"type":"ingress.event.procstart"}`,
+		},
+		{
+			desc:     "join arrays",
+			options:  FlattenOptions{Separator: "_", Arrays: FlattenArraysJoin, ArraySeparator: "|"},
+			expected: `{"docs":"{\"id\":1}|{\"id\":2}","empty":"{}","md5s":"a|b","process_cmdline":"cmd /c dir","process_name":"cmd.exe","process_parent_pid":4,"type":"ingress.event.procstart"}`,
+		},
+		{
+			desc:     "max depth",
+			options:  FlattenOptions{Separator: ".", MaxDepth: 1, Arrays: FlattenArraysIndex},
+			expected: `{"docs.0":"{\"id\":1}","docs.1":"{\"id\":2}","empty":"{}","md5s.0":"a","md5s.1":"b","process.cmdline":"cmd /c dir","process.name":"cmd.exe","process.parent":"{\"pid\":4}","type":"ingress.event.procstart"}`,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			options := test.options
+			formatter := formatterForConfig(t, &Configuration{OutputFormat: JSONOutputFormat, Flatten: &options})
+
+			// formatting the same event over and over must always produce the same output
+			for i := 0; i < 20; i++ {
+				formatted, err := formatter.Format(formatters.NewEvent(raw))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(test.expected, formatted); diff != "" {
+					t.Fatalf("unexpected output (-want +got):\n%s", diff)
+				}
+			}
+		})
+	}
+}
+
+func TestFlattenConflicts(t *testing.T) {
+	// process.name and the top level process_name are both flattened into process_name
+	const raw = `{"process":{"name":"cmd.exe"},"process_name":"powershell.exe"}`
+
+	for _, test := range []struct {
+		policy   transforms.ConflictPolicy
+		expected string
+		err      string
+	}{
+		{policy: transforms.LastWriteWins, expected: `{"process_name":"powershell.exe"}`},
+		{policy: transforms.FirstWriteWins, expected: `{"process_name":"cmd.exe"}`},
+		{policy: transforms.FailOnConflict, err: "conflicting writes to process_name by /process/name and /process_name"},
+	} {
+		t.Run(string(test.policy), func(t *testing.T) {
+			formatter := formatterForConfig(t, &Configuration{
+				OutputFormat:   JSONOutputFormat,
+				FormatFallback: true,
+				Flatten:        &FlattenOptions{Separator: "_", Arrays: FlattenArraysIndex, Conflicts: test.policy},
+			})
+			formatted, err := formatter.Format(formatters.NewEvent(raw))
+			if len(test.err) > 0 {
+				// conflicts are not sent as fallback records
+				var conflict *transforms.ConflictError
+				if !errors.As(err, &conflict) || err.Error() != test.err {
+					t.Errorf("expected a conflict error, got %q and %v", formatted, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.expected, formatted); diff != "" {
+				t.Errorf("unexpected output (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMsgPackFormatter(t *testing.T) {
+	files, err := filepath.Glob("../test/raw_data/json/*/0.json")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no sample events found: %v", err)
+	}
+
+	formatter := formatterForConfig(t, &Configuration{OutputFormat: MsgPackOutputFormat})
+	for _, file := range files {
+		t.Run(filepath.Base(filepath.Dir(file)), func(t *testing.T) {
+			raw, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			event := formatters.NewEvent(string(raw))
+			fields, err := event.Fields()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			formatted, err := formatter.Format(event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if length := binary.BigEndian.Uint32([]byte(formatted[:4])); int(length) != len(formatted)-4 {
+				t.Fatalf("length prefix %d doesn't match the %d bytes of the event", length, len(formatted)-4)
+			}
+
+			decoded, err := msgpackencoder.Decode([]byte(formatted[4:]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// json numbers may be written differently, as 1.0 and 1, and still be the same number
+			sameNumber := cmp.Comparer(func(a, b json.Number) bool {
+				x, errX := a.Float64()
+				y, errY := b.Float64()
+				return errX == nil && errY == nil && x == y
+			})
+			if diff := cmp.Diff(fields, decoded, sameNumber); diff != "" {
+				t.Errorf("decoded event different from json, diff: %s", diff)
+			}
+
+			compact, err := json.Marshal(fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Logf("json %d bytes (%d compact), msgpack %d bytes", len(raw), len(compact), len(formatted))
+			if len(formatted) >= len(compact) {
+				t.Errorf("msgpack event (%d bytes) not smaller than compact json (%d bytes)", len(formatted), len(compact))
+			}
+		})
+	}
+}
+
+func TestMsgPackEncoderValues(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		value    interface{}
+		expected []byte
+	}{
+		{desc: "positive fixint", value: json.Number("7"), expected: []byte{0x07}},
+		{desc: "negative fixint", value: json.Number("-3"), expected: []byte{0xfd}},
+		{desc: "uint16", value: json.Number("443"), expected: []byte{0xcd, 0x01, 0xbb}},
+		{desc: "int32", value: json.Number("-70000"), expected: []byte{0xd2, 0xff, 0xfe, 0xee, 0x90}},
+		{desc: "uint64", value: json.Number("18446744073709551615"), expected: []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{desc: "float", value: json.Number("0.5"), expected: []byte{0xcb, 0x3f, 0xe0, 0, 0, 0, 0, 0, 0}},
+		{desc: "fixstr", value: "abc", expected: []byte{0xa3, 'a', 'b', 'c'}},
+		{desc: "str8", value: strings.Repeat("a", 32), expected: append([]byte{0xd9, 32}, strings.Repeat("a", 32)...)},
+		{desc: "nil and bools", value: []interface{}{nil, true, false}, expected: []byte{0x93, 0xc0, 0xc3, 0xc2}},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			encoded, err := msgpackencoder.Encode(map[string]interface{}{"v": test.value})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := append([]byte{0x81, 0xa1, 'v'}, test.expected...)
+			if diff := cmp.Diff(expected, encoded); diff != "" {
+				t.Errorf("encoding different from expected, diff: %s", diff)
+			}
+
+			decoded, err := msgpackencoder.Decode(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(map[string]interface{}{"v": test.value}, decoded); diff != "" {
+				t.Errorf("decoded value different from expected, diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestFallbackFormatter(t *testing.T) {
+	// leef can't represent an event with more than one entry in docs
+	const raw = `{"type":"watchlist.hit.process","docs":[{"process_name":"a.exe"},{"process_name":"b.exe"}]}`
+
+	for _, test := range []struct {
+		desc     string
+		cfg      Configuration
+		event    string
+		check    func(string) bool
+		fallback int64
+	}{
+		{
+			desc:  "formatted event",
+			cfg:   Configuration{OutputFormat: LEEFOutputFormat, FormatFallback: true},
+			event: `{"type":"watchlist.hit.process","docs":[{"process_name":"a.exe"}]}`,
+			check: func(s string) bool { return strings.Contains(s, "process_name=a.exe") },
+		},
+		{
+			desc:  "leef fallback",
+			cfg:   Configuration{OutputFormat: LEEFOutputFormat, FormatFallback: true},
+			event: raw,
+			check: func(s string) bool {
+				return strings.HasPrefix(s, "LEEF:1.0|CB|CB|") && strings.Contains(s, "|watchlist.hit.process|") &&
+					strings.Contains(s, "format_error=More than one entry in docs[]") && strings.Contains(s, "event_id=")
+			},
+			fallback: 1,
+		},
+		{
+			desc:  "json fallback with correlation id field",
+			cfg:   Configuration{OutputFormat: JSONOutputFormat, FormatFallback: true, CorrelationIDField: "cb_event_id", Flatten: &FlattenOptions{Separator: "."}},
+			event: `not json`,
+			check: func(s string) bool {
+				var record map[string]interface{}
+				return json.Unmarshal([]byte(s), &record) == nil && record["cb_event_id"] != nil &&
+					record["type"] == nil && strings.HasPrefix(record["format_error"].(string), "invalid character")
+			},
+			fallback: 1,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			formatter := formatterForConfig(t, &test.cfg)
+			formatted, err := formatter.Format(formatters.NewEvent(test.event))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.check(formatted) {
+				t.Errorf("unexpected output: %s", formatted)
+			}
+			if count := formatter.(*formatters.FallbackFormatter).FallbackCount(); count != test.fallback {
+				t.Errorf("expected %d fallback events, got %d", test.fallback, count)
+			}
+		})
+	}
+
+	// without format_fallback the event is dropped
+	if _, err := formatterForConfig(t, &Configuration{OutputFormat: LEEFOutputFormat}).Format(formatters.NewEvent(raw)); err == nil {
+		t.Error("expected an error without format_fallback")
+	}
+}
+
+func TestRegisterFormatter(t *testing.T) {
+	formatters.RegisterFormatter("Upper", func(cfg *Configuration) (formatters.Formatter, error) {
+		if cfg.CorrelationIDField == "invalid" {
+			return nil, errors.New("invalid configuration")
+		}
+		return upperFormatter{}, nil
+	})
+
+	if diff := cmp.Diff([]string{"csv", "json", "leef", "msgpack", "upper"}, formatters.RegisteredFormatters()); diff != "" {
+		t.Errorf("unexpected registered formats (-want +got):\n%s", diff)
+	}
+
+	event := `{"type":"ingress.event.procstart","timestamp":1614379081.5,"sensor_id":3,"process_name":"say \"hi\", bye"}`
+	for _, test := range []struct {
+		cfg      Configuration
+		expected string
+	}{
+		{
+			cfg:      Configuration{OutputFormat: CustomOutputFormat, CustomOutputFormatName: "csv"},
+			expected: `ingress.event.procstart,1614379081.5,3,,"say ""hi"", bye"`,
+		},
+		{
+			cfg:      Configuration{OutputFormat: CustomOutputFormat, CustomOutputFormatName: "upper"},
+			expected: strings.ToUpper(event),
+		},
+	} {
+		formatted, err := formatterForConfig(t, &test.cfg).Format(formatters.NewEvent(event))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if formatted != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.cfg.CustomOutputFormatName, test.expected, formatted)
+		}
+	}
+
+	for _, cfg := range []Configuration{
+		{OutputFormat: CustomOutputFormat, CustomOutputFormatName: "missing"},
+		{OutputFormat: CustomOutputFormat, CustomOutputFormatName: "upper", CorrelationIDField: "invalid"},
+	} {
+		if _, err := formatters.ForConfig(&cfg); err == nil {
+			t.Errorf("expected an error for format %s", cfg.CustomOutputFormatName)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a format twice to panic")
+		}
+	}()
+	formatters.RegisterFormatter("json", func(*Configuration) (formatters.Formatter, error) { return upperFormatter{}, nil })
+}
+
+type upperFormatter struct{}
+
+func (upperFormatter) Format(event *formatters.Event) (string, error) {
+	return strings.ToUpper(event.Raw()), nil
+}
+
+func TestFormatterPipeline(t *testing.T) {
+	const raw = `{"type":"ingress.event.procstart","process":{"name":"cmd.exe"}}`
+
+	// renames process.name, which only exists before the event is flattened
+	rename := func(next formatters.Formatter) formatters.Formatter {
+		return formatters.StageFormatter{
+			Apply: func(fields map[string]interface{}, _ *transforms.FieldWrites) (bool, error) {
+				process, ok := fields["process"].(map[string]interface{})
+				if !ok {
+					return false, nil
+				}
+				process["image"] = process["name"]
+				delete(process, "name")
+				return true, nil
+			},
+			Next: next,
+		}
+	}
+	flatten := formatters.NewFlattenStage(&FlattenOptions{Separator: ".", Arrays: FlattenArraysIndex})
+	cfg := &Configuration{OutputFormat: JSONOutputFormat}
+
+	for _, test := range []struct {
+		desc     string
+		stages   []formatters.Stage
+		expected string
+	}{
+		{
+			desc:     "rename then flatten",
+			stages:   []formatters.Stage{rename, flatten},
+			expected: `{"process.image":"cmd.exe","type":"ingress.event.procstart"}`,
+		},
+		{
+			desc:     "flatten then rename",
+			stages:   []formatters.Stage{flatten, rename},
+			expected: `{"process.name":"cmd.exe","type":"ingress.event.procstart"}`,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			formatter, err := formatters.ForPipeline(cfg, test.stages)
+			if err != nil {
+				t.Fatal(err)
+			}
+			event := formatters.NewEvent(raw)
+			formatted, err := formatter.Format(event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.expected, formatted); diff != "" {
+				t.Errorf("unexpected output (-want +got):\n%s", diff)
+			}
+			// the event itself is left for the other outputs as it was
+			if event.Raw() != raw {
+				t.Errorf("the event was modified: %s", event.Raw())
+			}
+		})
+	}
+}
+
+func TestUTF8Sanitizer(t *testing.T) {
+	// an invalid byte in a value, an unpaired surrogate escape in a key, and a valid pair of them
+	const raw = "{\"cmdline\":\"a\xffb\",\"x\\udc00\":\"\\ud83d\\ude00\",\"path\":\"C:\\\\udata\"}"
+
+	for _, test := range []struct {
+		policy      UTF8Policy
+		expected    string
+		sanitized   int64
+		expectError bool
+	}{
+		{policy: KeepInvalidUTF8, expected: raw},
+		{policy: ReplaceInvalidUTF8, expected: "{\"cmdline\":\"a\uFFFDb\",\"x\uFFFD\":\"\\ud83d\\ude00\",\"path\":\"C:\\\\udata\"}", sanitized: 2},
+		{policy: StripInvalidUTF8, expected: "{\"cmdline\":\"ab\",\"x\":\"\\ud83d\\ude00\",\"path\":\"C:\\\\udata\"}", sanitized: 2},
+		{policy: RejectInvalidUTF8, expectError: true},
+	} {
+		t.Run(string(test.policy), func(t *testing.T) {
+			formatter := formatterForConfig(t, &Configuration{OutputFormat: JSONOutputFormat, UTF8Policy: test.policy})
+			formatted, err := formatter.Format(formatters.NewEvent(raw))
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if test.expectError {
+				return
+			}
+			if formatted != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, formatted)
+			}
+			if sanitizer, ok := formatter.(*formatters.UTF8Sanitizer); ok && sanitizer.SanitizedFieldCount() != test.sanitized {
+				t.Errorf("expected %d sanitized fields, got %d", test.sanitized, sanitizer.SanitizedFieldCount())
+			}
+		})
+	}
+
+	// valid events are passed through as they are
+	formatter := formatterForConfig(t, &Configuration{OutputFormat: JSONOutputFormat, UTF8Policy: ReplaceInvalidUTF8})
+	if formatted, err := formatter.Format(formatters.NewEvent(`{"a":"é"}`)); err != nil || formatted != `{"a":"é"}` {
+		t.Errorf("unexpected output %q: %v", formatted, err)
+	}
+}
+
+func TestTruncateLine(t *testing.T) {
+	const leef = "LEEF:1.0|CB|CB|5.1|ingress.event.procstart|cmdline=a\\=b c\tpath=C:\\\\Windows\\\\é.exe\tpid=12"
+	const cef = "CEF:0|CB|EDR|7.0|procstart|Process start \\| x|5|cmdline=run it now suser=root dvchost=host"
+
+	for _, test := range []struct {
+		desc     string
+		line     string
+		maxBytes int
+		expected string
+		fails    bool
+	}{
+		{desc: "fits", line: leef, maxBytes: len(leef), expected: leef},
+		{desc: "leef whole fields", line: leef, maxBytes: len(leef) - 1, expected: "LEEF:1.0|CB|CB|5.1|ingress.event.procstart|cmdline=a\\=b c\tpath=C:\\\\Windows\\\\é.exe\tpid=1"},
+		{desc: "leef before a multi-byte character", line: leef, maxBytes: 77, expected: "LEEF:1.0|CB|CB|5.1|ingress.event.procstart|cmdline=a\\=b c\tpath=C:\\\\Windows\\\\"},
+		{desc: "leef before an escape", line: leef, maxBytes: 75, expected: "LEEF:1.0|CB|CB|5.1|ingress.event.procstart|cmdline=a\\=b c\tpath=C:\\\\Windows"},
+		{desc: "leef header only", line: leef, maxBytes: 45, expected: "LEEF:1.0|CB|CB|5.1|ingress.event.procstart|"},
+		{desc: "leef header too long", line: leef, maxBytes: 20, fails: true},
+		{desc: "leef 2.0 delimiter", line: "LEEF:2.0|CB|CB|5.1|proc|^|a=1^b=2", maxBytes: 30, expected: "LEEF:2.0|CB|CB|5.1|proc|^|a=1"},
+		{desc: "cef values with spaces", line: cef, maxBytes: len(cef) - 8, expected: "CEF:0|CB|EDR|7.0|procstart|Process start \\| x|5|cmdline=run it now suser=root"},
+		{desc: "cef cut value", line: cef, maxBytes: 59, expected: "CEF:0|CB|EDR|7.0|procstart|Process start \\| x|5|cmdline=run"},
+		{desc: "json", line: `{"type":"ingress.event.procstart"}`, maxBytes: 10, fails: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			truncated, ok := formatters.TruncateLine(test.line, test.maxBytes)
+			if ok == test.fails {
+				t.Fatalf("unexpected result %q, %t", truncated, ok)
+			}
+			if ok && truncated != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, truncated)
+			}
+			if ok && len(truncated) > test.maxBytes {
+				t.Errorf("%d bytes is longer than %d", len(truncated), test.maxBytes)
+			}
+		})
+	}
+}
+
+func TestLineLimiter(t *testing.T) {
+	event := `{"type":"ingress.event.procstart","cmdline":"` + strings.Repeat("x", 200) + `"}`
+
+	formatter := formatterForConfig(t, &Configuration{OutputFormat: LEEFOutputFormat, MaxLineBytes: 100, LongLinePolicy: TruncateLongLines})
+	formatted, err := formatter.Format(formatters.NewEvent(event))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(formatted) != 100 || !strings.HasPrefix(formatted, "LEEF:1.0|CB|CB|5.1|ingress.event.process|cmdline=xxx") {
+		t.Errorf("unexpected truncated line %q", formatted)
+	}
+	if limiter := formatter.(*formatters.LineLimiter); limiter.TruncatedCount() != 1 || limiter.DroppedCount() != 0 {
+		t.Errorf("expected 1 truncated line, got %d truncated and %d dropped", limiter.TruncatedCount(), limiter.DroppedCount())
+	}
+
+	formatter = formatterForConfig(t, &Configuration{OutputFormat: LEEFOutputFormat, MaxLineBytes: 100, LongLinePolicy: DropLongLines})
+	if _, err := formatter.Format(formatters.NewEvent(event)); err == nil {
+		t.Error("expected the long line to be dropped")
+	}
+	if formatted, err := formatter.Format(formatters.NewEvent(`{"type":"short"}`)); err != nil || formatted != "LEEF:1.0|CB|CB|5.1|short|type=short" {
+		t.Errorf("unexpected output %q: %v", formatted, err)
+	}
+	if limiter := formatter.(*formatters.LineLimiter); limiter.DroppedCount() != 1 {
+		t.Errorf("expected 1 dropped line, got %d", limiter.DroppedCount())
+	}
+}
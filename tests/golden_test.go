@@ -0,0 +1,224 @@
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/forwarder"
+)
+
+func TestCheckGolden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cb-event-forwarder-golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "cb-event-forwarder.conf")
+	ioutil.WriteFile(configFile, iniFromMap(map[string]mapString{
+		"bridge": mapString{
+			"rabbit_mq_username":  "cb",
+			"rabbit_mq_password":  "password",
+			"cb_server_url":       "https://cbserver/",
+			"server_name":         "test",
+			"output_type":         "file",
+			"outfile":             filepath.Join(dir, "out.json"),
+			"event_type_denylist": "ingress.event.netconn",
+			"additional_outputs":  "siem",
+		},
+		"siem": mapString{
+			"output_type":   "file",
+			"outfile":       filepath.Join(dir, "siem.leef"),
+			"output_format": "leef",
+		},
+	}), 0644)
+	cfg, err := ParseConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventForwarder, err := forwarder.NewEventForwarderFromConfig(make(chan os.Signal, 1), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := filepath.Join(dir, "cases")
+	os.Mkdir(cases, 0755)
+	ioutil.WriteFile(filepath.Join(cases, "procstart.json"), []byte(`{"type":"ingress.event.procstart","cb_server":"test","process_guid":"1","path":"c:\\windows\\cmd.exe"}`+"\n"), 0644)
+	ioutil.WriteFile(filepath.Join(cases, "netconn.json"), []byte(`{"type":"ingress.event.netconn","cb_server":"test"}`), 0644)
+
+	if _, err := eventForwarder.CheckGolden(cases, false); err != nil {
+		t.Fatal(err)
+	}
+	report, err := eventForwarder.CheckGolden(cases, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Updated != 4 {
+		t.Fatalf("expected 4 golden files to be written, got %d", report.Updated)
+	}
+	// the filtered out event is sent to no output
+	if golden, _ := ioutil.ReadFile(filepath.Join(cases, "netconn.bridge.golden")); len(golden) != 0 {
+		t.Errorf("expected an empty golden file for the filtered event, got %q", golden)
+	}
+
+	report, err = eventForwarder.CheckGolden(cases, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 4 || len(report.Failures) != 0 {
+		t.Fatalf("expected 4 matching outputs, got %d checked and failures %v", report.Checked, report.Failures)
+	}
+
+	// keys in a different order still match, a changed value doesn't
+	ioutil.WriteFile(filepath.Join(cases, "procstart.bridge.golden"), []byte(`{"path":"c:\\windows\\cmd.exe","process_guid":"1","cb_server":"test","type":"ingress.event.procstart"}`), 0644)
+	report, _ = eventForwarder.CheckGolden(cases, false)
+	if len(report.Failures) != 0 {
+		t.Errorf("expected reordered keys to match, got %v", report.Failures)
+	}
+	ioutil.WriteFile(filepath.Join(cases, "procstart.bridge.golden"), []byte(`{"type":"ingress.event.procstart","cb_server":"other","process_guid":"1","path":"c:\\windows\\cmd.exe"}`), 0644)
+	report, _ = eventForwarder.CheckGolden(cases, false)
+	if len(report.Failures) != 1 || report.Failures[0].Case != "procstart" || report.Failures[0].Output != "bridge" ||
+		!strings.Contains(report.Failures[0].Problem, `"other"`) {
+		t.Errorf("expected the changed value to be reported, got %v", report.Failures)
+	}
+}
+
+func TestCheckGoldenConflicts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cb-event-forwarder-golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the transform and coerce stages run once for both outputs, flatten runs for the siem one
+	configFile := filepath.Join(dir, "cb-event-forwarder.conf")
+	ioutil.WriteFile(configFile, iniFromMap(map[string]mapString{
+		"bridge": mapString{
+			"rabbit_mq_username": "cb",
+			"rabbit_mq_password": "password",
+			"cb_server_url":      "https://cbserver/",
+			"server_name":        "test",
+			"output_type":        "file",
+			"outfile":            filepath.Join(dir, "out.json"),
+			"transform":          `if exists port then set port = port + ""`,
+			"coerce_fields":      "port:int",
+			"conflict_policy":    "error",
+			"additional_outputs": "siem",
+		},
+		"siem": mapString{
+			"output_type":       "file",
+			"outfile":           filepath.Join(dir, "siem.json"),
+			"flatten":           "true",
+			"flatten_separator": "_",
+		},
+	}), 0644)
+	cfg, err := ParseConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventForwarder, err := forwarder.NewEventForwarderFromConfig(make(chan os.Signal, 1), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := filepath.Join(dir, "cases")
+	os.Mkdir(cases, 0755)
+	ioutil.WriteFile(filepath.Join(cases, "written.json"), []byte(`{"type":"ingress.event.netconn","port":443}`), 0644)
+	ioutil.WriteFile(filepath.Join(cases, "flattened.json"), []byte(`{"type":"ingress.event.procstart","process":{"name":"cmd.exe"},"process_name":"cmd"}`), 0644)
+	for _, golden := range []string{"written.bridge", "written.siem", "flattened.bridge", "flattened.siem"} {
+		ioutil.WriteFile(filepath.Join(cases, golden+".golden"), nil, 0644)
+	}
+
+	report, err := eventForwarder.CheckGolden(cases, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems := make(map[string]string)
+	for _, failure := range report.Failures {
+		problems[failure.Case+"."+failure.Output] = failure.Problem
+	}
+	for name, expected := range map[string]string{
+		"written.bridge": "conflicting writes to port by transform and coerce",
+		"written.siem":   "conflicting writes to port by transform and coerce",
+		"flattened.siem": "conflicting writes to process_name by /process/name and /process_name",
+		// the main output doesn't flatten, so the event is formatted
+		"flattened.bridge": "output differs",
+	} {
+		if !strings.Contains(problems[name], expected) {
+			t.Errorf("expected %q to be reported for %s, got %q", expected, name, problems[name])
+		}
+	}
+}
+
+func TestCheckGoldenSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cb-event-forwarder-golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the main output validates the formatted events, the siem one the events once flattened
+	schemaFile := filepath.Join(dir, "schema.json")
+	ioutil.WriteFile(schemaFile, []byte(`{"type":"object","required":["port"],"properties":{"port":{"type":"integer"}}}`), 0644)
+	configFile := filepath.Join(dir, "cb-event-forwarder.conf")
+	ioutil.WriteFile(configFile, iniFromMap(map[string]mapString{
+		"bridge": mapString{
+			"rabbit_mq_username": "cb",
+			"rabbit_mq_password": "password",
+			"cb_server_url":      "https://cbserver/",
+			"server_name":        "test",
+			"output_type":        "file",
+			"outfile":            filepath.Join(dir, "out.json"),
+			"schema_file":        schemaFile,
+			"additional_outputs": "siem",
+		},
+		"siem": mapString{
+			"output_type":           "file",
+			"outfile":               filepath.Join(dir, "siem.json"),
+			"output_format":         "leef",
+			"flatten":               "true",
+			"schema_file":           schemaFile,
+			"schema_stage":          "event",
+			"schema_failure_policy": "dead-letter",
+		},
+	}), 0644)
+	cfg, err := ParseConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventForwarder, err := forwarder.NewEventForwarderFromConfig(make(chan os.Signal, 1), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := filepath.Join(dir, "cases")
+	os.Mkdir(cases, 0755)
+	ioutil.WriteFile(filepath.Join(cases, "string_port.json"), []byte(`{"type":"ingress.event.netconn","port":"443"}`), 0644)
+	ioutil.WriteFile(filepath.Join(cases, "no_port.json"), []byte(`{"type":"ingress.event.procstart"}`), 0644)
+	for _, golden := range []string{"string_port.bridge", "string_port.siem", "no_port.bridge", "no_port.siem"} {
+		ioutil.WriteFile(filepath.Join(cases, golden+".golden"), nil, 0644)
+	}
+
+	report, err := eventForwarder.CheckGolden(cases, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems := make(map[string]string)
+	for _, failure := range report.Failures {
+		problems[failure.Case+"."+failure.Output] = failure.Problem
+	}
+	for name, expected := range map[string]string{
+		"string_port.bridge": "schema validation failed at /port: expected integer, got string",
+		"string_port.siem":   "schema validation failed at /port: expected integer, got string",
+		"no_port.bridge":     "schema validation failed at /: missing required property port",
+		"no_port.siem":       "schema validation failed at /: missing required property port",
+	} {
+		if !strings.Contains(problems[name], expected) {
+			t.Errorf("expected %q to be reported for %s, got %q", expected, name, problems[name])
+		}
+	}
+}
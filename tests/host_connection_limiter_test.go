@@ -0,0 +1,104 @@
+package tests
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+)
+
+func newDiscardingListener(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestHostConnectionLimiter(t *testing.T) {
+	listener := newDiscardingListener(t)
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	limiter := outputs.NewHostConnectionLimiter(2)
+	// both names resolve to the same host, which counts once for both
+	first, err := limiter.Dial(net.Dialer{}, "tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := limiter.Dial(net.Dialer{}, "tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	if _, err := limiter.Dial(net.Dialer{}, "tcp", listener.Addr().String()); err == nil || !strings.Contains(err.Error(), "max_connections_per_host") {
+		t.Fatalf("expected the third connection to be refused, got %v", err)
+	}
+	stats := limiter.Statistics()
+	if stats.Open["127.0.0.1"] != 2 || stats.Throttled["127.0.0.1"] != 1 || stats.ThrottledCount != 1 {
+		t.Errorf("unexpected statistics %+v", stats)
+	}
+
+	// closing a connection gives its slot back, once
+	first.Close()
+	first.Close()
+	third, err := limiter.Dial(net.Dialer{}, "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	if open := limiter.Statistics().Open["127.0.0.1"]; open != 2 {
+		t.Errorf("expected 2 open connections, got %d", open)
+	}
+
+	// failed connections don't keep a slot
+	unused := newDiscardingListener(t)
+	unused.Close()
+	if _, err := limiter.Dial(net.Dialer{}, "tcp", unused.Addr().String()); err == nil {
+		t.Fatal("expected the connection to fail")
+	}
+	if open := limiter.Statistics().Open["127.0.0.1"]; open != 2 {
+		t.Errorf("expected 2 open connections, got %d", open)
+	}
+}
+
+func TestNetOutputMaxConnectionsPerHost(t *testing.T) {
+	listener := newDiscardingListener(t)
+	defer listener.Close()
+
+	// connections left open by other tests count too
+	limiter := outputs.SharedHostConnectionLimiter()
+	limiter.SetLimit(limiter.Statistics().Open["127.0.0.1"] + 1)
+	defer limiter.SetLimit(0)
+
+	first := outputs.NewNetOutputfromConfig(&Configuration{})
+	if err := first.Initialize("tcp:" + listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	second := outputs.NewNetOutputfromConfig(&Configuration{})
+	if err := second.Initialize("tcp:" + listener.Addr().String()); err == nil || !strings.Contains(err.Error(), "max_connections_per_host") {
+		t.Fatalf("expected the connection to be throttled, got %v", err)
+	}
+
+	// a new connection of the same output replaces the old one
+	if err := first.Initialize("tcp:" + listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+}
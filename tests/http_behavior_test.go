@@ -1,12 +1,23 @@
 package tests
 
 import (
+	"compress/gzip"
 	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
 	"github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+	"github.com/google/go-cmp/cmp"
 	"golang.org/x/oauth2"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"reflect"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"text/template"
+	"time"
 )
 
 func TestCreateTransport(t *testing.T) {
@@ -41,3 +52,294 @@ func TestCreateTransport(t *testing.T) {
 		})
 	}
 }
+
+func TestHTTPOutputVerify(t *testing.T) {
+	for _, test := range []struct {
+		desc         string
+		status       int
+		expectError  bool
+		expectedBody string
+	}{
+		{desc: "accepted", status: http.StatusOK, expectedBody: `[{"type":"ingress.event.procstart"}]`},
+		{desc: "rejected", status: http.StatusServiceUnavailable, expectError: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			bodies := make(chan string, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				bodies <- string(body)
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+
+			tempDir, err := ioutil.TempDir("", "http-verify")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tempDir)
+
+			contentType := "application/json"
+			output := outputs.NewHTTPOutputFromConfig(&Configuration{
+				HTTPPostTemplate:    template.Must(template.New("post").Parse(`[{{range .Events}}{{.EventText}}{{end}}]`)),
+				HTTPContentType:     &contentType,
+				CommaSeparateEvents: true,
+				BundleSizeMax:       1024 * 1024,
+				BundleSendTimeout:   time.Minute,
+			})
+			if err := output.Initialize(tempDir + ":" + server.URL); err != nil {
+				t.Fatal(err)
+			}
+
+			err = output.Verify(`{"type":"ingress.event.procstart"}`)
+			if (err != nil) != test.expectError {
+				t.Fatalf("unexpected verification result: %v", err)
+			}
+			body := <-bodies
+			if !test.expectError {
+				if diff := cmp.Diff(test.expectedBody, body); diff != "" {
+					t.Errorf("body mismatch (-want +got):\n%s", diff)
+				}
+			}
+
+			// the test bundle is not left behind to be uploaded again
+			files, _ := ioutil.ReadDir(tempDir)
+			for _, file := range files {
+				if file.Name() != "event-forwarder" {
+					t.Errorf("unexpected file left in the temporary directory: %s", file.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPOutputFlush(t *testing.T) {
+	if outputs.FlushSignal == nil {
+		t.Skip("no flush signal on this platform")
+	}
+
+	bodies := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(body)
+	}))
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "http-flush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	contentType := "application/json"
+	output := outputs.NewHTTPOutputFromConfig(&Configuration{
+		HTTPPostTemplate:    template.Must(template.New("post").Parse(`[{{range .Events}}{{.EventText}}{{end}}]`)),
+		HTTPContentType:     &contentType,
+		CommaSeparateEvents: true,
+		BundleSizeMax:       1024 * 1024,
+		BundleSendTimeout:   time.Hour,
+	})
+	if err := output.Initialize(tempDir + ":" + server.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := make(chan string)
+	signals := make(chan os.Signal)
+	if err := output.Go(messages, signals, sync.NewCond(&sync.Mutex{})); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { signals <- syscall.SIGTERM }()
+
+	// the bundle is sent long before bundle_send_timeout
+	messages <- `{"type":"ingress.event.procstart"}`
+	signals <- outputs.FlushSignal
+	select {
+	case body := <-bodies:
+		if diff := cmp.Diff(`[{"type":"ingress.event.procstart"}]`, body); diff != "" {
+			t.Errorf("body mismatch (-want +got):\n%s", diff)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the bundle was not sent on flush")
+	}
+
+	// with nothing buffered, flushing does nothing
+	signals <- outputs.FlushSignal
+	select {
+	case body := <-bodies:
+		t.Errorf("unexpected bundle sent: %q", body)
+	case <-time.After(2 * time.Second):
+	}
+}
+
+func TestHTTPOutputRetryAfter(t *testing.T) {
+	for _, test := range []struct {
+		desc       string
+		retryAfter func() string
+	}{
+		{desc: "delta seconds", retryAfter: func() string { return "1" }},
+		{desc: "http date", retryAfter: func() string { return time.Now().Add(3 * time.Second).UTC().Format(http.TimeFormat) }},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			var mutex sync.Mutex
+			requests := 0
+			received := make(chan time.Time, 10)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ioutil.ReadAll(r.Body)
+				mutex.Lock()
+				defer mutex.Unlock()
+				if requests++; requests == 1 {
+					w.Header().Set("Retry-After", test.retryAfter())
+					w.WriteHeader(http.StatusTooManyRequests)
+				}
+				received <- time.Now()
+			}))
+			defer server.Close()
+
+			tempDir, err := ioutil.TempDir("", "http-retry-after")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tempDir)
+
+			contentType := "application/json"
+			output := outputs.NewHTTPOutputFromConfig(&Configuration{
+				HTTPPostTemplate:    template.Must(template.New("post").Parse(`[{{range .Events}}{{.EventText}}{{end}}]`)),
+				HTTPContentType:     &contentType,
+				HTTPHonorRetryAfter: true,
+				CommaSeparateEvents: true,
+				BundleSizeMax:       1024 * 1024,
+				BundleSendTimeout:   time.Second,
+			})
+			if err := output.Initialize(tempDir + ":" + server.URL); err != nil {
+				t.Fatal(err)
+			}
+			httpStatistics := func() outputs.HTTPStatistics {
+				return output.Statistics().(outputs.BundleStatistics).StorageStatistics.(outputs.HTTPStatistics)
+			}
+
+			messages := make(chan string)
+			signals := make(chan os.Signal)
+			if err := output.Go(messages, signals, sync.NewCond(&sync.Mutex{})); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { signals <- syscall.SIGTERM }()
+
+			messages <- `{"type":"ingress.event.procstart"}`
+			select {
+			case <-received:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the bundle was not sent")
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for !httpStatistics().Paused && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			stats := httpStatistics()
+			if !stats.Paused || stats.PausedUntil == nil || stats.PauseCount != 1 {
+				t.Fatalf("expected the output to be paused, got %+v", stats)
+			}
+
+			// no events are taken while paused
+			time.Sleep(100 * time.Millisecond)
+			select {
+			case messages <- `{"type":"ingress.event.procend"}`:
+				t.Error("the output took an event while paused")
+			case <-time.After(500 * time.Millisecond):
+			}
+
+			// the bundle is sent again once the pause is over
+			select {
+			case retried := <-received:
+				if retried.Before(*stats.PausedUntil) {
+					t.Errorf("the bundle was sent again at %s, before the end of the pause at %s", retried, *stats.PausedUntil)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("the bundle was not sent again")
+			}
+			select {
+			case messages <- `{"type":"ingress.event.procend"}`:
+			case <-time.After(5 * time.Second):
+				t.Error("the output doesn't take events after the pause")
+			}
+		})
+	}
+}
+
+func TestHTTPOutputCompression(t *testing.T) {
+	gunzip := func(r io.Reader) string {
+		gzr, err := gzip.NewReader(r)
+		if err != nil {
+			return "not gzip: " + err.Error()
+		}
+		b, _ := ioutil.ReadAll(gzr)
+		return string(b)
+	}
+
+	for _, test := range []struct {
+		desc          string
+		path          string
+		status        int
+		expectedError string
+	}{
+		{desc: "accepted", path: "/ingest", status: http.StatusOK},
+		// the body is compressed again when the request follows the redirect
+		{desc: "redirected", path: "/redirect", status: http.StatusOK},
+		{desc: "compressed error", path: "/ingest", status: http.StatusBadRequest, expectedError: "malformed bundle"},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			bodies := make(chan string, 2)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Content-Encoding") != "gzip" {
+					t.Errorf("expected a gzip request body, got Content-Encoding %q", r.Header.Get("Content-Encoding"))
+				}
+				bodies <- gunzip(r.Body)
+				if r.URL.Path == "/redirect" {
+					http.Redirect(w, r, "/ingest", http.StatusTemporaryRedirect)
+					return
+				}
+				if test.status != http.StatusOK {
+					w.Header().Set("Content-Encoding", "gzip")
+					w.WriteHeader(test.status)
+					gzw := gzip.NewWriter(w)
+					gzw.Write([]byte(test.expectedError))
+					gzw.Close()
+				}
+			}))
+			defer server.Close()
+
+			tempDir, err := ioutil.TempDir("", "http-compression")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tempDir)
+
+			contentType := "application/json"
+			output := outputs.NewHTTPOutputFromConfig(&Configuration{
+				HTTPPostTemplate:    template.Must(template.New("post").Parse(`[{{range .Events}}{{.EventText}}{{end}}]`)),
+				HTTPContentType:     &contentType,
+				CompressHTTPPayload: true,
+				CommaSeparateEvents: true,
+				BundleSizeMax:       1024 * 1024,
+				BundleSendTimeout:   time.Minute,
+			})
+			if err := output.Initialize(tempDir + ":" + server.URL + test.path); err != nil {
+				t.Fatal(err)
+			}
+
+			err = output.Verify(`{"type":"ingress.event.procstart"}`)
+			if test.expectedError == "" && err != nil {
+				t.Fatalf("unexpected verification error: %s", err)
+			}
+			if test.expectedError != "" && (err == nil || !strings.Contains(err.Error(), test.expectedError)) {
+				t.Fatalf("expected an error with the decompressed response, got %v", err)
+			}
+
+			close(bodies)
+			for body := range bodies {
+				if diff := cmp.Diff(`[{"type":"ingress.event.procstart"}]`, body); diff != "" {
+					t.Errorf("body mismatch (-want +got):\n%s", diff)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+//go:build linux
+// +build linux
+
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+	"github.com/google/go-cmp/cmp"
+)
+
+// parseJournalEntry decodes an entry in the journal native protocol.
+func parseJournalEntry(t *testing.T, entry []byte) map[string]string {
+	fields := make(map[string]string)
+	for len(entry) > 0 {
+		line := bytes.IndexByte(entry, '\n')
+		if line < 0 {
+			t.Fatalf("unterminated field in %q", entry)
+		}
+		if eq := bytes.IndexByte(entry[:line], '='); eq >= 0 {
+			fields[string(entry[:eq])] = string(entry[eq+1 : line])
+			entry = entry[line+1:]
+			continue
+		}
+		name := string(entry[:line])
+		size := binary.LittleEndian.Uint64(entry[line+1 : line+9])
+		fields[name] = string(entry[line+9 : line+9+int(size)])
+		entry = entry[line+9+int(size)+1:]
+	}
+	return fields
+}
+
+func TestJournaldOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journald")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socketPath := filepath.Join(dir, "socket")
+	journal, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	output := outputs.NewJournaldOutputFromConfig(&Configuration{
+		JournaldPriority:    4,
+		JournaldIdentifier:  "cb-event-forwarder",
+		JournaldFieldPrefix: "CB_",
+	})
+	if err := output.Initialize(socketPath); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := make(chan string)
+	signals := make(chan os.Signal)
+	if err := output.Go(messages, signals, sync.NewCond(&sync.Mutex{})); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { signals <- syscall.SIGTERM }()
+
+	event := `{"type":"alert.watchlist.hit.process","report_score":80,"process-name":"cmd.exe","docs":[{"a":1}],"cmdline":"line1\nline2"}`
+	messages <- event
+
+	journal.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 65536)
+	n, err := journal.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"MESSAGE":           event,
+		"PRIORITY":          "4",
+		"SYSLOG_IDENTIFIER": "cb-event-forwarder",
+		"CB_TYPE":           "alert.watchlist.hit.process",
+		"CB_REPORT_SCORE":   "80",
+		"CB_PROCESS_NAME":   "cmd.exe",
+		"CB_DOCS":           `[{"a":1}]`,
+		"CB_CMDLINE":        "line1\nline2",
+	}
+	if diff := cmp.Diff(expected, parseJournalEntry(t, buf[:n])); diff != "" {
+		t.Errorf("unexpected journal entry (-want +got):\n%s", diff)
+	}
+
+	// the entry is sent right after Go receives the event, before it reads the next one
+	messages <- `{}`
+	if stats := output.Statistics().(outputs.JournaldStatistics); stats.SentEventCount < 1 || !stats.Connected {
+		t.Errorf("unexpected statistics: %+v", stats)
+	}
+}
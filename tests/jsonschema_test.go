@@ -0,0 +1,107 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/carbonblack/cb-event-forwarder/pkg/jsonschema"
+)
+
+const testEventSchema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "event",
+	"type": "object",
+	"required": ["type", "sensor_id"],
+	"properties": {
+		"type": {"type": "string", "pattern": "^(ingress|alert)\\."},
+		"sensor_id": {"type": "integer", "minimum": 1},
+		"port": {"type": "integer", "exclusiveMaximum": 65536},
+		"direction": {"enum": ["inbound", "outbound"]},
+		"process": {"$ref": "#/definitions/process"},
+		"tags": {"type": "array", "items": {"type": "string", "minLength": 1}, "maxItems": 2},
+		"score": {"anyOf": [{"type": "null"}, {"type": "number", "maximum": 100}]}
+	},
+	"patternProperties": {"^x_": {"type": "string"}},
+	"additionalProperties": false,
+	"definitions": {
+		"process": {
+			"type": "object",
+			"properties": {
+				"name": {"type": "string", "format": "hostname"},
+				"parent": {"$ref": "#/definitions/process"}
+			},
+			"required": ["name"]
+		}
+	}
+}`
+
+func TestSchemaValidate(t *testing.T) {
+	schema, err := jsonschema.Compile([]byte(testEventSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		desc    string
+		event   string
+		keyword string
+		path    string
+	}{
+		{desc: "valid", event: `{"type":"ingress.event.netconn","sensor_id":3,"port":443,"direction":"inbound","x_site":"hq","score":null}`},
+		{desc: "integer with a zero fraction", event: `{"type":"alert.hit","sensor_id":3.0,"score":99.5}`},
+		{desc: "nested reference", event: `{"type":"alert.hit","sensor_id":3,"process":{"name":"cmd.exe","parent":{"name":"explorer.exe"}}}`},
+		{desc: "missing required", event: `{"type":"alert.hit"}`, keyword: "required"},
+		{desc: "wrong type", event: `{"type":"alert.hit","sensor_id":"3"}`, keyword: "type", path: "/sensor_id"},
+		{desc: "not an integer", event: `{"type":"alert.hit","sensor_id":3.5}`, keyword: "type", path: "/sensor_id"},
+		{desc: "below minimum", event: `{"type":"alert.hit","sensor_id":0}`, keyword: "minimum", path: "/sensor_id"},
+		{desc: "exclusive maximum", event: `{"type":"alert.hit","sensor_id":1,"port":65536}`, keyword: "exclusiveMaximum", path: "/port"},
+		{desc: "pattern", event: `{"type":"watchlist.hit","sensor_id":1}`, keyword: "pattern", path: "/type"},
+		{desc: "enum", event: `{"type":"alert.hit","sensor_id":1,"direction":"sideways"}`, keyword: "enum", path: "/direction"},
+		{desc: "additional property", event: `{"type":"alert.hit","sensor_id":1,"extra":true}`, keyword: "additionalProperties", path: "/extra"},
+		{desc: "pattern property", event: `{"type":"alert.hit","sensor_id":1,"x_site":1}`, keyword: "type", path: "/x_site"},
+		{desc: "item", event: `{"type":"alert.hit","sensor_id":1,"tags":["a",""]}`, keyword: "minLength", path: "/tags/1"},
+		{desc: "max items", event: `{"type":"alert.hit","sensor_id":1,"tags":["a","b","c"]}`, keyword: "maxItems", path: "/tags"},
+		{desc: "any of", event: `{"type":"alert.hit","sensor_id":1,"score":101}`, keyword: "anyOf", path: "/score"},
+		{desc: "recursive reference", event: `{"type":"alert.hit","sensor_id":1,"process":{"name":"a","parent":{}}}`, keyword: "required", path: "/process/parent"},
+		{desc: "not an object", event: `[1,2]`, keyword: "type"},
+		{desc: "not json", event: `type=alert.hit`, keyword: "json"},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			invalid := schema.ValidateJSON([]byte(test.event))
+			if test.keyword == "" {
+				if invalid != nil {
+					t.Errorf("unexpected failure: %s", invalid)
+				}
+				return
+			}
+			if invalid == nil {
+				t.Fatalf("expected a %s failure", test.keyword)
+			}
+			if invalid.Keyword != test.keyword || invalid.Path != test.path {
+				t.Errorf("expected a %s failure at %q, got %s at %q: %s", test.keyword, test.path, invalid.Keyword, invalid.Path, invalid)
+			}
+		})
+	}
+}
+
+func TestSchemaCompileErrors(t *testing.T) {
+	for _, test := range []struct {
+		schema   string
+		expected string
+	}{
+		{schema: `{"type":"object"`, expected: "invalid json"},
+		{schema: `"object"`, expected: "must be an object or a boolean"},
+		{schema: `{"type":"map"}`, expected: "#/type: unknown type map"},
+		{schema: `{"properties":{"a":{"uniqueItems":true}}}`, expected: "#/properties/a/uniqueItems: unsupported keyword"},
+		{schema: `{"pattern":"("}`, expected: "#/pattern"},
+		{schema: `{"minLength":-1}`, expected: "expected a non-negative integer"},
+		{schema: `{"$ref":"other.json#/definitions/a"}`, expected: "only references inside the schema"},
+		{schema: `{"$ref":"#/definitions/missing"}`, expected: "not found"},
+		{schema: `{"items":[{"type":"string"}]}`, expected: "arrays of item schemas are not supported"},
+	} {
+		_, err := jsonschema.Compile([]byte(test.schema))
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("expected an error containing %q for %s, got %v", test.expected, test.schema, err)
+		}
+	}
+}
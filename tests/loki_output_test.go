@@ -0,0 +1,178 @@
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+	"github.com/google/go-cmp/cmp"
+)
+
+type lokiPushRequest struct {
+	Streams []struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	} `json:"streams"`
+}
+
+// newTestLokiServer answers the pushes it receives with the given responses in turn, and 204 once
+// they run out, handing over the body of each push it accepts.
+func newTestLokiServer(t *testing.T, responses ...int) (*httptest.Server, <-chan lokiPushRequest) {
+	pushes := make(chan lokiPushRequest, 10)
+	var mutex sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/loki/api/v1/push" || r.Header.Get("X-Scope-OrgID") != "tenant1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mutex.Lock()
+		status := http.StatusNoContent
+		if len(responses) > 0 {
+			status, responses = responses[0], responses[1:]
+		}
+		mutex.Unlock()
+
+		switch status {
+		case http.StatusNoContent:
+			var push lokiPushRequest
+			body, _ := ioutil.ReadAll(r.Body)
+			if err := json.Unmarshal(body, &push); err != nil {
+				t.Errorf("invalid push %q: %s", body, err)
+			}
+			pushes <- push
+		case http.StatusBadRequest:
+			http.Error(w, "entry with timestamp 1970-01-01 00:00:00 ignored, reason: 'entry out of order',\ntotal ignored: 1 out of 3", status)
+			return
+		case http.StatusTooManyRequests:
+			// a date that has already passed, so the retry doesn't wait
+			w.Header().Set("Retry-After", time.Now().UTC().Format(http.TimeFormat))
+		}
+		w.WriteHeader(status)
+	}))
+	return server, pushes
+}
+
+func newTestLokiOutput(batchSize int) *outputs.LokiOutput {
+	return outputs.NewLokiOutputFromConfig(&Configuration{
+		LokiLabels:       []LokiLabel{{Name: "event_type", Field: "type"}, {Name: "process_name", Field: "process.name"}},
+		LokiStaticLabels: map[string]string{"job": "cb-event-forwarder"},
+		LokiHeaders:      http.Header{"X-Scope-Orgid": []string{"tenant1"}},
+		LokiBatchSize:    batchSize,
+		LokiBatchWait:    time.Hour,
+		LokiMaxRetries:   2,
+		TimeSource:       EventTimeSource,
+	})
+}
+
+func TestLokiOutput(t *testing.T) {
+	server, pushes := newTestLokiServer(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	defer server.Close()
+
+	output := newTestLokiOutput(4)
+	messages, signals := startTestOutput(t, output, server.URL)
+
+	// the batch is pushed once it holds 4 events, after being retried twice
+	for _, message := range []string{
+		`{"type":"ingress.event.procstart","timestamp":1600000002,"process":{"name":"cmd.exe"}}` + "\n",
+		`{"type":"ingress.event.netconn","timestamp":1600000001}` + "\n",
+		`{"type":"ingress.event.procstart","timestamp":1600000001,"process":{"name":"cmd.exe"}}` + "\n",
+		`not json`,
+	} {
+		messages <- message
+	}
+
+	var push lokiPushRequest
+	select {
+	case push = <-pushes:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the push")
+	}
+
+	type stream struct {
+		Labels map[string]string
+		Values [][2]string
+	}
+	var got []stream
+	for _, s := range push.Streams {
+		got = append(got, stream{Labels: s.Stream, Values: s.Values})
+	}
+	sort.Slice(got, func(i, j int) bool { return len(got[i].Labels) < len(got[j].Labels) })
+
+	expected := []stream{
+		{Labels: map[string]string{"job": "cb-event-forwarder"}},
+		{
+			Labels: map[string]string{"job": "cb-event-forwarder", "event_type": "ingress.event.netconn"},
+			Values: [][2]string{{"1600000001000000000", `{"type":"ingress.event.netconn","timestamp":1600000001}`}},
+		},
+		{
+			// sorted by timestamp within the stream
+			Labels: map[string]string{"job": "cb-event-forwarder", "event_type": "ingress.event.procstart", "process_name": "cmd.exe"},
+			Values: [][2]string{
+				{"1600000001000000000", `{"type":"ingress.event.procstart","timestamp":1600000001,"process":{"name":"cmd.exe"}}`},
+				{"1600000002000000000", `{"type":"ingress.event.procstart","timestamp":1600000002,"process":{"name":"cmd.exe"}}`},
+			},
+		},
+	}
+	// the event that isn't json is stamped with the time it was received
+	if len(got) != 3 || len(got[0].Values) != 1 || got[0].Values[0][1] != "not json" {
+		t.Fatalf("unexpected streams: %+v", got)
+	}
+	got[0].Values = nil
+	if diff := cmp.Diff(expected, got); diff != "" {
+		t.Errorf("push mismatch (-want +got):\n%s", diff)
+	}
+
+	// an event older than the last one of its stream goes right after it
+	messages <- `{"type":"ingress.event.netconn","timestamp":1500000000}`
+	signals <- outputs.FlushSignal
+	select {
+	case push = <-pushes:
+		if len(push.Streams) != 1 || push.Streams[0].Values[0][0] != "1600000001000000001" {
+			t.Errorf("unexpected push: %+v", push)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the flushed push")
+	}
+
+	// the push is counted once Loki answers it
+	stats := waitForStatistics(t, output, func(s interface{}) bool { return s.(outputs.LokiStatistics).PushedEventCount == 5 }).(outputs.LokiStatistics)
+	if stats.PushedEventCount != 5 || stats.RetryCount != 2 || stats.ReorderedEventCount != 1 || stats.FailedEventCount != 0 || stats.PendingEventCount != 0 {
+		t.Errorf("unexpected statistics: %+v", stats)
+	}
+}
+
+func TestLokiOutputRejections(t *testing.T) {
+	server, _ := newTestLokiServer(t, http.StatusBadRequest, http.StatusUnauthorized,
+		http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	defer server.Close()
+
+	output := newTestLokiOutput(1000)
+	if err := output.Initialize(server.URL + "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the event Loki refused for being out of order is not retried, nor are client errors
+	if err := output.Verify(`{"type":"ingress.event.netconn"}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := output.Verify(`{"type":"ingress.event.netconn"}`); err == nil {
+		t.Error("expected the unauthorized push to fail")
+	}
+	// server errors are retried up to max_retries times
+	if err := output.Verify(`{"type":"ingress.event.netconn"}`); err == nil {
+		t.Error("expected the push to fail after all retries")
+	}
+
+	stats := output.Statistics().(outputs.LokiStatistics)
+	if stats.OutOfOrderEventCount != 1 || stats.PushedEventCount != 0 || stats.FailedEventCount != 2 || stats.RetryCount != 2 {
+		t.Errorf("unexpected statistics: %+v", stats)
+	}
+}
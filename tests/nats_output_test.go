@@ -0,0 +1,333 @@
+package tests
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+	"github.com/google/go-cmp/cmp"
+)
+
+type natsPublication struct {
+	Subject string
+	MsgID   string
+	Payload string
+}
+
+// testNATSServer speaks enough of the NATS protocol for the output: it records what is published
+// and, with JetStream, acknowledges publications from stream EVENTS, but for the first refuse
+// ones, which it answers as if no stream captured their subject.
+type testNATSServer struct {
+	t         *testing.T
+	listener  net.Listener
+	jetStream bool
+	refuse    int
+
+	mutex        sync.Mutex
+	publications []natsPublication
+	connects     []map[string]interface{}
+	conns        []net.Conn
+	// sent once, after the first pong, for the output to choke on
+	garbage string
+}
+
+func newTestNATSServer(t *testing.T, jetStream bool, refuse int) *testNATSServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testNATSServer{t: t, listener: listener, jetStream: jetStream, refuse: refuse}
+	go server.accept()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *testNATSServer) URL() string {
+	return "nats://" + s.listener.Addr().String()
+}
+
+func (s *testNATSServer) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.conns = append(s.conns, conn)
+		s.mutex.Unlock()
+		go s.serve(conn)
+	}
+}
+
+func (s *testNATSServer) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprint(conn, `INFO {"server_id":"test","version":"2.10.0","headers":true,"max_payload":1024}`+"\r\n")
+
+	reader := bufio.NewReader(conn)
+	sid := ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+
+		switch args[0] {
+		case "CONNECT":
+			var options map[string]interface{}
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "CONNECT ")), &options)
+			s.mutex.Lock()
+			s.connects = append(s.connects, options)
+			s.mutex.Unlock()
+		case "PING":
+			fmt.Fprint(conn, "PONG\r\n")
+			s.mutex.Lock()
+			fmt.Fprint(conn, s.garbage)
+			s.garbage = ""
+			s.mutex.Unlock()
+		case "SUB":
+			sid = args[len(args)-1]
+		case "PUB", "HPUB":
+			headerSize := 0
+			if args[0] == "HPUB" {
+				headerSize, _ = strconv.Atoi(args[len(args)-2])
+			}
+			size, _ := strconv.Atoi(args[len(args)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return
+			}
+			publication := natsPublication{Subject: args[1], Payload: string(payload[headerSize:size])}
+			for _, header := range strings.Split(string(payload[:headerSize]), "\r\n") {
+				if strings.HasPrefix(header, "Nats-Msg-Id: ") {
+					publication.MsgID = strings.TrimPrefix(header, "Nats-Msg-Id: ")
+				}
+			}
+
+			s.mutex.Lock()
+			s.publications = append(s.publications, publication)
+			refused := s.refuse > 0
+			if refused {
+				s.refuse--
+			}
+			seq := len(s.publications)
+			s.mutex.Unlock()
+
+			if !s.jetStream || len(args) < 4 || (args[0] == "HPUB" && len(args) < 5) {
+				continue
+			}
+			reply := args[2]
+			if refused {
+				status := "NATS/1.0 503\r\n\r\n"
+				fmt.Fprintf(conn, "HMSG %s %s %d %d\r\n%s\r\n", reply, sid, len(status), len(status), status)
+			} else {
+				ack := fmt.Sprintf(`{"stream":"EVENTS","seq":%d}`, seq)
+				fmt.Fprintf(conn, "MSG %s %s %d\r\n%s\r\n", reply, sid, len(ack), ack)
+			}
+		}
+	}
+}
+
+func (s *testNATSServer) Publications() []natsPublication {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]natsPublication(nil), s.publications...)
+}
+
+// WaitForPublications waits for n events to be published.
+func (s *testNATSServer) WaitForPublications(n int) []natsPublication {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		publications := s.Publications()
+		if len(publications) >= n || time.Now().After(deadline) {
+			return publications
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// DropConnections closes the connections accepted so far, as a server restart would.
+func (s *testNATSServer) DropConnections() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testNATSServer) Close() {
+	s.listener.Close()
+	s.DropConnections()
+}
+
+func newTestNATSOutput(t *testing.T, jetStream bool) *outputs.NATSOutput {
+	subject, err := ParseNATSSubject(`cb.{{.Field "type"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return outputs.NewNATSOutputFromConfig(&Configuration{
+		NATSSubject:        subject,
+		NATSUser:           "forwarder",
+		NATSPassword:       "secret",
+		NATSJetStream:      jetStream,
+		NATSMaxPendingAcks: 10,
+		NATSAckTimeout:     time.Second,
+		NATSMaxRetries:     2,
+	})
+}
+
+func TestNATSSubject(t *testing.T) {
+	tmpl, err := ParseNATSSubject(`cb.{{.Field "type"}}.{{.Field "sensor_id"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		message  string
+		expected string
+	}{
+		{message: `{"type":"ingress.event.procstart","sensor_id":7}`, expected: "cb.ingress.event.procstart.7"},
+		{message: `{"type":"alert hit *","sensor_id":"a>b"}`, expected: "cb.alert_hit__.a_b"},
+		{message: `{"type":".x.","sensor_id":""}`, expected: "cb.unknown.x.unknown.unknown"},
+		{message: `not json`, expected: "cb.unknown.unknown"},
+	} {
+		subject, err := NATSSubject(tmpl, test.message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if subject != test.expected {
+			t.Errorf("expected %s for %s, got %s", test.expected, test.message, subject)
+		}
+	}
+
+	for _, invalid := range []string{"", "cb.*", "cb events", `{{.Missing}}`} {
+		if _, err := ParseNATSSubject(invalid); err == nil {
+			t.Errorf("expected an error for subject %q", invalid)
+		}
+	}
+}
+
+func TestNATSOutput(t *testing.T) {
+	server := newTestNATSServer(t, false, 0)
+	output := newTestNATSOutput(t, false)
+	// the first server refuses connections, so the output moves on to the next one
+	messages, _ := startTestOutput(t, output, "nats://127.0.0.1:1, "+server.URL())
+
+	messages <- `{"type":"ingress.event.netconn","sensor_id":1}` + "\n"
+	messages <- `{"type":"alert.watchlist.hit.query.binary"}` + "\n"
+	waitForStatistics(t, output, func(s interface{}) bool { return s.(outputs.NATSStatistics).PublishedEventCount == 2 })
+
+	// events published after the server restarts go through the new connection
+	server.DropConnections()
+	waitForStatistics(t, output, func(s interface{}) bool { return !s.(outputs.NATSStatistics).Connected })
+	messages <- `{"type":"ingress.event.procstart"}` + "\n"
+	statistics := waitForStatistics(t, output, func(s interface{}) bool { return s.(outputs.NATSStatistics).PublishedEventCount == 3 }).(outputs.NATSStatistics)
+
+	expected := []natsPublication{
+		{Subject: "cb.ingress.event.netconn", Payload: `{"type":"ingress.event.netconn","sensor_id":1}`},
+		{Subject: "cb.alert.watchlist.hit.query.binary", Payload: `{"type":"alert.watchlist.hit.query.binary"}`},
+		{Subject: "cb.ingress.event.procstart", Payload: `{"type":"ingress.event.procstart"}`},
+	}
+	if diff := cmp.Diff(expected, server.WaitForPublications(3)); diff != "" {
+		t.Errorf("unexpected publications (-want +got):\n%s", diff)
+	}
+	if statistics.ReconnectCount != 1 || statistics.FailedEventCount != 0 {
+		t.Errorf("unexpected statistics: %+v", statistics)
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if len(server.connects) != 2 || server.connects[0]["user"] != "forwarder" || server.connects[0]["pass"] != "secret" || server.connects[0]["headers"] != false {
+		t.Errorf("unexpected connect options: %v", server.connects)
+	}
+}
+
+func TestNATSOutputProtocolErrors(t *testing.T) {
+	for _, garbage := range []string{
+		"MSG\r\n",
+		"MSG inbox.1 1\r\n",
+		"MSG inbox.1 1 reply 2 5\r\n",
+		"MSG inbox.1 1 -1\r\n",
+		"MSG inbox.1 1 many\r\n",
+		// larger than the max_payload of the server
+		"MSG inbox.1 1 9999999999\r\n",
+		"HMSG inbox.1 1 5\r\n",
+		"HMSG inbox.1 1 10 5\r\n",
+		"HMSG inbox.1 1 -1 5\r\n",
+	} {
+		t.Run(strings.TrimSpace(garbage), func(t *testing.T) {
+			server := newTestNATSServer(t, false, 0)
+			server.mutex.Lock()
+			server.garbage = garbage
+			server.mutex.Unlock()
+
+			// the connection is dropped rather than the output reading a payload it can't trust
+			output := newTestNATSOutput(t, false)
+			startTestOutput(t, output, server.URL())
+			waitForStatistics(t, output, func(s interface{}) bool { return !s.(outputs.NATSStatistics).Connected })
+		})
+	}
+}
+
+func TestNATSOutputJetStream(t *testing.T) {
+	// the first publication is refused, and published again with the same message ID
+	server := newTestNATSServer(t, true, 1)
+	output := newTestNATSOutput(t, true)
+	output.Config.NATSStream = "EVENTS"
+	messages, _ := startTestOutput(t, output, server.URL())
+
+	messages <- `{"type":"ingress.event.procstart","sensor_id":1}`
+	messages <- `{"type":"ingress.event.procstart","sensor_id":2}`
+	statistics := waitForStatistics(t, output, func(s interface{}) bool { return s.(outputs.NATSStatistics).AckedEventCount == 2 }).(outputs.NATSStatistics)
+
+	if statistics.PublishedEventCount != 2 || statistics.RetryCount != 1 || statistics.AckPendingCount != 0 || statistics.FailedEventCount != 0 {
+		t.Errorf("unexpected statistics: %+v", statistics)
+	}
+	publications := server.Publications()
+	if len(publications) != 3 || publications[0].MsgID == "" || publications[2].MsgID != publications[0].MsgID || publications[1].MsgID == publications[0].MsgID {
+		t.Errorf("expected the first event to be published again with its message ID, got %+v", publications)
+	}
+}
+
+func TestNATSOutputVerify(t *testing.T) {
+	server := newTestNATSServer(t, true, 0)
+	output := newTestNATSOutput(t, true)
+	if err := output.Initialize(server.URL()); err != nil {
+		t.Fatal(err)
+	}
+	if err := output.Verify(`{"type":"ingress.event.procstart"}`); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// every publication is refused until the retries run out
+	server = newTestNATSServer(t, true, 10)
+	output = newTestNATSOutput(t, true)
+	if err := output.Initialize(server.URL()); err != nil {
+		t.Fatal(err)
+	}
+	if err := output.Verify(`{"type":"ingress.event.procstart"}`); err == nil {
+		t.Error("expected an error for an event that is never acknowledged")
+	}
+
+	// larger than the max_payload of the server
+	server = newTestNATSServer(t, false, 0)
+	output = newTestNATSOutput(t, false)
+	if err := output.Initialize(server.URL()); err != nil {
+		t.Fatal(err)
+	}
+	if err := output.Verify(`{"type":"` + strings.Repeat("x", 2000) + `"}`); err == nil {
+		t.Error("expected an error for an event larger than max_payload")
+	}
+}
@@ -0,0 +1,1493 @@
+package tests
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+	"github.com/google/go-cmp/cmp"
+)
+
+// newTestTLSListener returns a TLS listener with a self-signed certificate that discards
+// everything it receives.
+func newTestTLSListener(t *testing.T) net.Listener {
+	return newTestTLSListenerWithHandler(t, func(conn net.Conn) {
+		io.Copy(ioutil.Discard, conn)
+	})
+}
+
+// newTestTLSListenerWithHandler returns a TLS listener with a self-signed certificate that
+// passes every connection to handle, closing it once handle returns.
+func newTestTLSListenerWithHandler(t *testing.T, handle func(conn net.Conn)) net.Listener {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				handle(conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+// newTestCertificate returns a self-signed certificate for 127.0.0.1.
+func newTestCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestNetOutputTLSSessionResumption(t *testing.T) {
+	listener := newTestTLSListener(t)
+	defer listener.Close()
+
+	for _, test := range []struct {
+		desc            string
+		sessionCache    tls.ClientSessionCache
+		expectedResumed int64
+	}{
+		{desc: "with session cache", sessionCache: tls.NewLRUClientSessionCache(4), expectedResumed: 1},
+		{desc: "without session cache", expectedResumed: 0},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			cfg := &Configuration{
+				TCPUseTLS: true,
+				TLSConfig: &tls.Config{InsecureSkipVerify: true, ClientSessionCache: test.sessionCache},
+			}
+			output := outputs.NewNetOutputfromConfig(cfg)
+
+			for i := 0; i < 2; i++ {
+				if err := output.Initialize("tcp:" + listener.Addr().String()); err != nil {
+					t.Fatal(err)
+				}
+				// give the client a chance to receive the session ticket
+				time.Sleep(100 * time.Millisecond)
+			}
+
+			stats := output.Statistics().(outputs.NetStatistics)
+			if stats.TLSHandshakeCount != 2 {
+				t.Errorf("expected 2 handshakes, got %d", stats.TLSHandshakeCount)
+			}
+			if stats.TLSResumedCount != test.expectedResumed {
+				t.Errorf("expected %d resumed handshakes, got %d", test.expectedResumed, stats.TLSResumedCount)
+			}
+			if stats.TLSVersion != "TLS 1.3" || len(stats.TLSCipherSuite) == 0 || stats.TLSHandshakeSeconds <= 0 {
+				t.Errorf("expected the negotiated parameters of the last handshake, got %s, %s and %fs",
+					stats.TLSVersion, stats.TLSCipherSuite, stats.TLSHandshakeSeconds)
+			}
+		})
+	}
+}
+
+func TestNetOutputTLSRekey(t *testing.T) {
+	for _, test := range []struct {
+		desc   string
+		config Configuration
+		events int
+		// events received over each of the first connections
+		expected [][]string
+	}{
+		{
+			// each event takes 15 bytes with its line ending, so every connection gets two
+			desc:     "bytes",
+			config:   Configuration{TLSRekeyBytes: 20},
+			events:   4,
+			expected: [][]string{{`{"event":"0"}`, `{"event":"1"}`}, {`{"event":"2"}`, `{"event":"3"}`}},
+		},
+		{
+			desc:     "interval",
+			config:   Configuration{TLSRekeyInterval: time.Second},
+			events:   1,
+			expected: [][]string{{`{"event":"0"}`}},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			connections := make(chan []string, 10)
+			listener := newTestTLSListenerWithHandler(t, func(conn net.Conn) {
+				b, _ := ioutil.ReadAll(conn)
+				connections <- strings.Fields(string(b))
+			})
+			defer listener.Close()
+
+			cfg := test.config
+			cfg.TCPUseTLS = true
+			cfg.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+			output := outputs.NewNetOutputfromConfig(&cfg)
+			if err := output.Initialize("tcp:" + listener.Addr().String()); err != nil {
+				t.Fatal(err)
+			}
+
+			messages := make(chan string)
+			signals := make(chan os.Signal)
+			stopped := sync.NewCond(&sync.Mutex{})
+			if err := output.Go(messages, signals, stopped); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { signals <- syscall.SIGTERM }()
+
+			for i := 0; i < test.events; i++ {
+				messages <- fmt.Sprintf(`{"event":"%d"}`, i)
+			}
+
+			// connections are only reported once the output closes them
+			for i, expected := range test.expected {
+				select {
+				case received := <-connections:
+					if diff := cmp.Diff(expected, received); diff != "" {
+						t.Errorf("unexpected events over connection %d (-want +got):\n%s", i+1, diff)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("connection %d was not replaced", i+1)
+				}
+			}
+
+			stats := output.Statistics().(outputs.NetStatistics)
+			if stats.TLSRekeyCount != int64(len(test.expected)) || stats.RotationCount != 0 || stats.ReconnectCount != 0 {
+				t.Errorf("expected %d rekeys and no other reconnections, got %+v", len(test.expected), stats)
+			}
+			if stats.TLSHandshakeCount != stats.TLSRekeyCount+1 {
+				t.Errorf("expected a handshake for every connection, got %d handshakes and %d rekeys",
+					stats.TLSHandshakeCount, stats.TLSRekeyCount)
+			}
+		})
+	}
+}
+
+func TestNetOutputTLSPinning(t *testing.T) {
+	listener := newTestTLSListener(t)
+	defer listener.Close()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := TLSPublicKeyFingerprint(conn.ConnectionState())
+	conn.Close()
+	otherFingerprint := "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+
+	for _, test := range []struct {
+		desc        string
+		tcp         mapString
+		expectedErr string
+	}{
+		{
+			desc: "pinned key without chain validation",
+			tcp:  mapString{"tls_pinned_sha256": otherFingerprint + "," + fingerprint, "tls_pin_only": "true"},
+		},
+		{
+			desc:        "other key without chain validation",
+			tcp:         mapString{"tls_pinned_sha256": otherFingerprint, "tls_pin_only": "true"},
+			expectedErr: "TLS server public key sha256/" + fingerprint + " doesn't match any pinned key",
+		},
+		{
+			desc:        "pinned key with chain validation",
+			tcp:         mapString{"tls_pinned_sha256": fingerprint},
+			expectedErr: "certificate signed by unknown authority",
+		},
+		{
+			desc:        "other key with chain validation disabled",
+			tcp:         mapString{"tls_pinned_sha256": otherFingerprint, "tls_verify": "false"},
+			expectedErr: "doesn't match any pinned key",
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			test.tcp["use_tls"] = "true"
+			sections := map[string]mapString{
+				"bridge": {
+					"rabbit_mq_username": "cb",
+					"rabbit_mq_password": "password",
+					"cb_server_url":      "https://cbserver/",
+					"server_name":        "test",
+					"output_type":        "tcp",
+					"tcpout":             listener.Addr().String(),
+				},
+				"tcp": test.tcp,
+			}
+
+			file, err := ioutil.TempFile("", "cb-event-forwarder-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			file.Write(iniFromMap(sections))
+			file.Close()
+
+			config, err := ParseConfig(file.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			output := outputs.NewNetOutputfromConfig(&config)
+			err = output.Initialize("tcp:" + listener.Addr().String())
+			if test.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+				t.Fatalf("expected error containing %q, got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestNetOutputConnectionRotation(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	output := outputs.NewNetOutputfromConfig(&Configuration{MaxConnectionLifetime: time.Second})
+	if err := output.Initialize("tcp:" + listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := make(chan string)
+	signals := make(chan os.Signal)
+	stopped := sync.NewCond(&sync.Mutex{})
+	if err := output.Go(messages, signals, stopped); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { signals <- syscall.SIGTERM }()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-accepted:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("connection %d was not opened", i+1)
+		}
+	}
+
+	stats := output.Statistics().(outputs.NetStatistics)
+	if stats.RotationCount != 1 || stats.ReconnectCount != 0 || !stats.Connected {
+		t.Errorf("expected one rotation and no reconnects, got %+v", stats)
+	}
+	if stats.TLSVersion != "" || stats.TLSCipherSuite != "" || stats.TLSHandshakeSeconds != 0 {
+		t.Errorf("expected no TLS parameters without TLS, got %+v", stats)
+	}
+}
+
+func TestNetOutputIdleTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// every connection sends what it received once the forwarder closes it
+	received := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				b, _ := ioutil.ReadAll(conn)
+				conn.Close()
+				received <- string(b)
+			}()
+		}
+	}()
+	receive := func() string {
+		select {
+		case data := <-received:
+			return data
+		case <-time.After(5 * time.Second):
+			t.Fatal("the connection was not closed")
+			return ""
+		}
+	}
+
+	output := outputs.NewNetOutputfromConfig(&Configuration{IdleTimeout: time.Second})
+	if err := output.Initialize("tcp:" + listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := make(chan string)
+	signals := make(chan os.Signal)
+	stopped := sync.NewCond(&sync.Mutex{})
+	if err := output.Go(messages, signals, stopped); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { signals <- syscall.SIGTERM }()
+
+	messages <- "first"
+	if diff := cmp.Diff("first\r\n", receive()); diff != "" {
+		t.Errorf("unexpected data on the first connection, diff: %s", diff)
+	}
+	stats := output.Statistics().(outputs.NetStatistics)
+	if stats.IdleCloseCount != 1 || !stats.Idle || stats.Connected {
+		t.Errorf("expected the connection to be closed for being idle, got %+v", stats)
+	}
+
+	// the next event opens a new connection right away, without waiting for a reconnection
+	messages <- "second"
+	messages <- "third"
+	if diff := cmp.Diff("second\r\nthird\r\n", receive()); diff != "" {
+		t.Errorf("unexpected data on the second connection, diff: %s", diff)
+	}
+	stats = output.Statistics().(outputs.NetStatistics)
+	if stats.IdleCloseCount != 2 || stats.ReconnectCount != 0 || stats.DroppedEventCount != 0 || stats.SentEventCount != 3 {
+		t.Errorf("expected two idle closes and no reconnects or drops, got %+v", stats)
+	}
+}
+
+func TestNetOutputDisconnectFooter(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				b, _ := ioutil.ReadAll(conn)
+				conn.Close()
+				received <- string(b)
+			}()
+		}
+	}()
+	receive := func() string {
+		select {
+		case data := <-received:
+			return data
+		case <-time.After(5 * time.Second):
+			t.Fatal("the connection was not closed")
+			return ""
+		}
+	}
+
+	footer, err := ParseDisconnectFooter("BYE {{.EventCount}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := outputs.NewNetOutputfromConfig(&Configuration{IdleTimeout: time.Second, DisconnectFooter: footer})
+	if err := output.Initialize("tcp:" + listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := make(chan string)
+	signals := make(chan os.Signal)
+	stopped := sync.NewCond(&sync.Mutex{})
+	if err := output.Go(messages, signals, stopped); err != nil {
+		t.Fatal(err)
+	}
+
+	// closed for being idle
+	messages <- "a"
+	messages <- "b"
+	if diff := cmp.Diff("a\r\nb\r\nBYE 2\r\n", receive()); diff != "" {
+		t.Errorf("unexpected data on the first connection, diff: %s", diff)
+	}
+
+	// closed on shutdown, counting only the events of this connection
+	messages <- "c"
+	signals <- syscall.SIGTERM
+	if diff := cmp.Diff("c\r\nBYE 1\r\n", receive()); diff != "" {
+		t.Errorf("unexpected data on the second connection, diff: %s", diff)
+	}
+
+	if sent := output.Statistics().(outputs.NetStatistics).SentEventCount; sent != 3 {
+		t.Errorf("expected the footers not to be counted as events, got %d sent events", sent)
+	}
+}
+
+func TestNetOutputFlappingReconnectBackoff(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// a collector that accepts connections and resets them shortly after
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				conn.(*net.TCPConn).SetLinger(0)
+				conn.Close()
+			}()
+		}
+	}()
+
+	output := outputs.NewNetOutputfromConfig(&Configuration{MinHealthyConnection: time.Minute, ReconnectBackoffMax: time.Minute})
+	if err := output.Initialize("tcp:" + listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := make(chan string)
+	signals := make(chan os.Signal)
+	stopped := sync.NewCond(&sync.Mutex{})
+	if err := output.Go(messages, signals, stopped); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { signals <- syscall.SIGTERM }()
+
+	// writes until the reset is noticed, and the connection is dropped
+	waitForDrop := func(flapping int64) outputs.NetStatistics {
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			messages <- "event"
+			stats := output.Statistics().(outputs.NetStatistics)
+			if stats.FlappingReconnectCount == flapping && !stats.Connected {
+				return stats
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("expected %d flapping connections", flapping)
+		return outputs.NetStatistics{}
+	}
+
+	if stats := waitForDrop(1); stats.ReconnectBackoffSeconds != 5 {
+		t.Errorf("expected to reconnect after 5 seconds, got %v", stats.ReconnectBackoffSeconds)
+	}
+	// the reconnection flaps too, so the wait doubles
+	if stats := waitForDrop(2); stats.ReconnectBackoffSeconds != 10 || stats.ReconnectCount != 1 {
+		t.Errorf("expected one reconnection and to reconnect after 10 seconds, got %+v", stats)
+	}
+}
+
+func TestNetOutputReconnectCount(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+
+	// a collector that resets the only connection it accepts once an event comes, and goes away
+	go func() {
+		conn, err := listener.Accept()
+		listener.Close()
+		if err != nil {
+			return
+		}
+		conn.Read(make([]byte, 1))
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}()
+
+	output := outputs.NewNetOutputfromConfig(&Configuration{ReconnectBackoffMax: time.Minute})
+	if err := output.Initialize("tcp:" + address); err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan string)
+	signals := make(chan os.Signal)
+	if err := output.Go(messages, signals, sync.NewCond(&sync.Mutex{})); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { signals <- syscall.SIGTERM }()
+
+	// the failed attempt to reconnect doubles the wait, and is not counted as a reconnection
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		stats := output.Statistics().(outputs.NetStatistics)
+		if stats.ReconnectBackoffSeconds == 10 {
+			if stats.ReconnectCount != 0 || stats.Connected {
+				t.Errorf("expected no reconnection, got %+v", stats)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the attempt to reconnect: %+v", stats)
+		}
+		if stats.Connected {
+			messages <- "event"
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNetOutputDestinationAllowlist(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	for _, test := range []struct {
+		desc      string
+		allowed   string
+		expectErr bool
+	}{
+		{desc: "allowed range", allowed: "127.0.0.0/8"},
+		{desc: "allowed address", allowed: "10.0.0.0/8, 127.0.0.1"},
+		{desc: "rejected", allowed: "10.0.0.0/8,192.168.0.0/16", expectErr: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			allowed, err := ParseCIDRList(test.allowed)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			output := outputs.NewNetOutputfromConfig(&Configuration{DestinationAllowCIDRs: allowed})
+			err = output.Initialize("tcp:localhost:" + port)
+			if (err != nil) != test.expectErr {
+				t.Errorf("expected error: %v, got %v", test.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestNetOutputHalfClose(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	type serverResult struct {
+		received string
+		closedAt time.Time
+	}
+	results := make(chan serverResult, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		// reading until EOF only succeeds once the forwarder has shut down its side
+		received, _ := ioutil.ReadAll(conn)
+		time.Sleep(200 * time.Millisecond)
+		results <- serverResult{received: string(received), closedAt: time.Now()}
+		conn.Close()
+	}()
+
+	output := outputs.NewNetOutputfromConfig(&Configuration{TCPHalfClose: true, TCPHalfCloseTimeout: 5 * time.Second})
+	if err := output.Initialize("tcp:" + listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := make(chan string)
+	signals := make(chan os.Signal)
+	if err := output.Go(messages, signals, sync.NewCond(&sync.Mutex{})); err != nil {
+		t.Fatal(err)
+	}
+	messages <- `{"type":"last"}`
+	signals <- syscall.SIGTERM
+
+	// the output only closes once the collector has closed its side
+	for output.Statistics().(outputs.NetStatistics).Connected {
+		time.Sleep(10 * time.Millisecond)
+	}
+	disconnectedAt := time.Now()
+
+	var result serverResult
+	select {
+	case result = <-results:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the collector did not see the end of the stream")
+	}
+	if result.received != "{\"type\":\"last\"}\r\n" {
+		t.Errorf("unexpected data received: %q", result.received)
+	}
+	if disconnectedAt.Before(result.closedAt) {
+		t.Errorf("the output closed the connection before the collector did")
+	}
+}
+
+func TestNetOutputOversizeEvents(t *testing.T) {
+	event := `{"type":"ingress.event.procstart","cmdline":"` + strings.Repeat("x", 300) + `"}`
+
+	for _, test := range []struct {
+		desc           string
+		policy         OversizePolicy
+		expectedChunks int
+	}{
+		{desc: "chunk", policy: ChunkOversize, expectedChunks: 4},
+		{desc: "drop", policy: DropOversize},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			lines := make(chan []string, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				data, _ := ioutil.ReadAll(conn)
+				lines <- strings.Split(strings.TrimSuffix(string(data), "\r\n"), "\r\n")
+			}()
+
+			output := outputs.NewNetOutputfromConfig(&Configuration{MaxMessageSize: 128, OversizePolicy: test.policy})
+			if err := output.Initialize("tcp:" + listener.Addr().String()); err != nil {
+				t.Fatal(err)
+			}
+			messages := make(chan string)
+			signals := make(chan os.Signal)
+			if err := output.Go(messages, signals, sync.NewCond(&sync.Mutex{})); err != nil {
+				t.Fatal(err)
+			}
+			messages <- event
+			messages <- `{"type":"small"}`
+			signals <- syscall.SIGTERM
+
+			var received []string
+			select {
+			case received = <-lines:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the events")
+			}
+
+			var reassembled string
+			for i, line := range received[:len(received)-1] {
+				if len(line)+2 > 128 {
+					t.Errorf("chunk %d is %d bytes long", i+1, len(line)+2)
+				}
+				header := fmt.Sprintf("CBCHUNK 1 %d/%d ", i+1, test.expectedChunks)
+				if !strings.HasPrefix(line, header) {
+					t.Fatalf("expected chunk to start with %q, got %q", header, line)
+				}
+				reassembled += strings.TrimPrefix(line, header)
+			}
+
+			if test.expectedChunks > 0 && reassembled != event {
+				t.Errorf("reassembled event does not match, got %q", reassembled)
+			}
+			if diff := cmp.Diff(test.expectedChunks+1, len(received)); diff != "" {
+				t.Errorf("unexpected number of lines received (-want +got):\n%s", diff)
+			}
+			if last := received[len(received)-1]; last != `{"type":"small"}` {
+				t.Errorf("expected the small event to be sent as is, got %q", last)
+			}
+
+			stats := output.Statistics().(outputs.NetStatistics)
+			if test.policy == DropOversize && stats.OversizeDroppedCount != 1 {
+				t.Errorf("expected one oversize event dropped, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestNetOutputHandshakePSK(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// the collector only accepts the current key
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line := make([]byte, 64)
+				n, _ := conn.Read(line)
+				if string(line[:n]) == "AUTH key-2\r\n" {
+					conn.Write([]byte("OK\r\n"))
+					io.Copy(ioutil.Discard, conn)
+				} else {
+					conn.Write([]byte("DENIED\r\n"))
+				}
+			}()
+		}
+	}()
+
+	pskFile, err := ioutil.TempFile("", "psk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(pskFile.Name())
+	pskFile.Close()
+
+	output := outputs.NewNetOutputfromConfig(&Configuration{
+		HandshakePSKFile: pskFile.Name(),
+		HandshakeFormat:  "AUTH {psk}",
+		HandshakeAck:     "OK",
+		HandshakeTimeout: 5 * time.Second,
+	})
+
+	for _, test := range []struct {
+		key              string
+		expectErr        bool
+		expectedFailures int64
+	}{
+		{key: "key-1\n", expectErr: true, expectedFailures: 1},
+		// the key is read again on every connection
+		{key: "key-2\n", expectedFailures: 1},
+	} {
+		if err := ioutil.WriteFile(pskFile.Name(), []byte(test.key), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		err := output.Initialize("tcp:" + listener.Addr().String())
+		if (err != nil) != test.expectErr {
+			t.Errorf("key %q: expected error: %v, got %v", test.key, test.expectErr, err)
+		}
+
+		stats := output.Statistics().(outputs.NetStatistics)
+		if stats.HandshakeFailureCount != test.expectedFailures || stats.Connected == test.expectErr {
+			t.Errorf("key %q: unexpected statistics %+v", test.key, stats)
+		}
+	}
+}
+
+func TestNetOutputStartTLS(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// the collector agrees to start TLS on its first connection only, and hands over the first
+	// line received over TLS
+	certificate := newTestCertificate(t)
+	received := make(chan string, 1)
+	go func() {
+		for accepted := 0; ; accepted++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(first bool) {
+				defer conn.Close()
+				command, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil || command != "STARTTLS\r\n" || !first {
+					conn.Write([]byte("NO not now\r\n"))
+					return
+				}
+				conn.Write([]byte("OK begin TLS\r\n"))
+				tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{certificate}})
+				line, _ := bufio.NewReader(tlsConn).ReadString('\n')
+				received <- line
+			}(accepted == 0)
+		}
+	}()
+
+	output := outputs.NewNetOutputfromConfig(&Configuration{
+		TCPUseTLS:       true,
+		TLSConfig:       &tls.Config{InsecureSkipVerify: true},
+		StartTLSCommand: "STARTTLS",
+		StartTLSReply:   "OK",
+		StartTLSTimeout: 5 * time.Second,
+	})
+	if err := output.Initialize("tcp:" + listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := output.Verify(`{"type":"ingress.event.procstart"}`); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case line := <-received:
+		if line != `{"type":"ingress.event.procstart"}`+"\r\n" {
+			t.Errorf("unexpected event received over TLS: %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the event")
+	}
+	if stats := output.Statistics().(outputs.NetStatistics); stats.TLSHandshakeCount != 1 || stats.StartTLSFailureCount != 0 {
+		t.Errorf("unexpected statistics %+v", stats)
+	}
+
+	// a refusal aborts the connection
+	if err := output.Initialize("tcp:" + listener.Addr().String()); err == nil || !strings.Contains(err.Error(), "NO not now") {
+		t.Errorf("expected the refusal to fail the connection, got %v", err)
+	}
+	if stats := output.Statistics().(outputs.NetStatistics); stats.Connected || stats.StartTLSFailureCount != 1 || stats.TLSHandshakeCount != 1 {
+		t.Errorf("unexpected statistics %+v", stats)
+	}
+}
+
+func TestNetOutputDeliveryLatency(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		data, _ := ioutil.ReadAll(conn)
+		received <- string(data)
+	}()
+
+	output := outputs.NewNetOutputfromConfig(&Configuration{})
+	if err := output.Initialize("tcp:" + listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan string)
+	signals := make(chan os.Signal)
+	if err := output.Go(messages, signals, sync.NewCond(&sync.Mutex{})); err != nil {
+		t.Fatal(err)
+	}
+
+	// the forwarder passes the receive time of each event before handing it over, and takes it
+	// back for events that expire before the output takes them
+	output.DeliveryLatency().Received(time.Now().Add(-200 * time.Millisecond))
+	output.DeliveryLatency().Received(time.Now().Add(-time.Hour))
+	output.DeliveryLatency().Withdraw()
+	messages <- `{"type":"first"}`
+	messages <- `{"type":"second"}`
+	signals <- syscall.SIGTERM
+
+	select {
+	case data := <-received:
+		if data != "{\"type\":\"first\"}\r\n{\"type\":\"second\"}\r\n" {
+			t.Errorf("unexpected data received: %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the events")
+	}
+
+	// events without a receive time are not measured
+	latency := output.Statistics().(outputs.NetStatistics).DeliveryLatency
+	if latency.Count != 1 || latency.MaxMs < 200 || latency.MaxMs > 5000 {
+		t.Errorf("unexpected delivery latency %+v", latency)
+	}
+}
+
+func TestNetOutputBackpressure(t *testing.T) {
+	for _, test := range []struct {
+		desc   string
+		policy OverflowPolicy
+	}{
+		{desc: "block until the collector catches up", policy: BlockOnOverflow},
+		{desc: "drop under sustained pressure", policy: DropOnOverflow},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			// the collector doesn't read anything until it is resumed
+			resume := make(chan struct{})
+			received := make(chan int64, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				<-resume
+				n, _ := io.Copy(ioutil.Discard, conn)
+				received <- n
+			}()
+
+			output := outputs.NewNetOutputfromConfig(&Configuration{
+				BackpressureWriteTimeout: 20 * time.Millisecond,
+				BackpressurePause:        10 * time.Millisecond,
+				BackpressureMaxDuration:  200 * time.Millisecond,
+				OverflowPolicy:           test.policy,
+			})
+			if err := output.Initialize("tcp:" + listener.Addr().String()); err != nil {
+				t.Fatal(err)
+			}
+			messages := make(chan string)
+			signals := make(chan os.Signal, 1)
+			if err := output.Go(messages, signals, sync.NewCond(&sync.Mutex{})); err != nil {
+				t.Fatal(err)
+			}
+
+			// send events until they fill up the socket buffers
+			event := strings.Repeat("x", 64*1024)
+			sent := 0
+			deadline := time.After(10 * time.Second)
+			for !output.Statistics().(outputs.NetStatistics).Backpressured {
+				select {
+				case messages <- event:
+					sent++
+				case <-time.After(10 * time.Millisecond):
+				case <-deadline:
+					t.Fatal("the output never noticed the collector was not reading")
+				}
+			}
+
+			if test.policy == DropOnOverflow {
+				for output.Statistics().(outputs.NetStatistics).DroppedEventCount == 0 {
+					select {
+					case messages <- event:
+					case <-deadline:
+						t.Fatal("no event was dropped")
+					}
+				}
+				close(resume)
+				return
+			}
+
+			time.Sleep(300 * time.Millisecond)
+			close(resume)
+			signals <- syscall.SIGTERM
+			select {
+			case n := <-received:
+				if expected := int64(sent * (len(event) + 2)); n != expected {
+					t.Errorf("expected %d bytes, received %d", expected, n)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for the events")
+			}
+
+			stats := output.Statistics().(outputs.NetStatistics)
+			if stats.Backpressured || stats.BackpressureEvents != 1 || stats.DroppedEventCount != 0 || stats.ReconnectCount != 0 {
+				t.Errorf("unexpected statistics: %+v", stats)
+			}
+		})
+	}
+}
+
+func TestNetOutputBatching(t *testing.T) {
+	big := `{"type":"big","cmdline":"` + strings.Repeat("x", 40) + `"}`
+
+	for _, test := range []struct {
+		desc     string
+		config   Configuration
+		events   [][]string
+		expected []string
+		pending  string
+	}{
+		{
+			desc:   "event count",
+			config: Configuration{BatchMaxEvents: 2, BatchMaxWait: time.Minute},
+			events: [][]string{{`{"type":"a1"}`, `{"type":"a2"}`}, {`{"type":"a3"}`}},
+			// the last event stays in the batch until the output is stopped
+			expected: []string{"{\"type\":\"a1\"}\r\n{\"type\":\"a2\"}\r\n", ""},
+			pending:  "{\"type\":\"a3\"}\r\n",
+		},
+		{
+			desc:   "byte cap",
+			config: Configuration{BatchMaxEvents: 10, BatchMaxBytes: 40, BatchMaxWait: time.Minute},
+			events: [][]string{{`{"type":"a1"}`, `{"type":"a2"}`, `{"type":"a3"}`}, {big}, {`{"type":"a4"}`}},
+			// a batch is sent when the next event doesn't fit, and larger events are sent alone
+			expected: []string{"{\"type\":\"a1\"}\r\n{\"type\":\"a2\"}\r\n", "{\"type\":\"a3\"}\r\n" + big + "\r\n", ""},
+			pending:  "{\"type\":\"a4\"}\r\n",
+		},
+		{
+			desc:     "wait",
+			config:   Configuration{BatchMaxEvents: 10, BatchMaxWait: 50 * time.Millisecond},
+			events:   [][]string{{`{"type":"a1"}`}},
+			expected: []string{"{\"type\":\"a1\"}\r\n"},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			output := outputs.NewNetOutputfromConfig(&test.config)
+			if err := output.Initialize("tcp:" + listener.Addr().String()); err != nil {
+				t.Fatal(err)
+			}
+			conn, err := listener.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			messages := make(chan string)
+			signals := make(chan os.Signal)
+			if err := output.Go(messages, signals, sync.NewCond(&sync.Mutex{})); err != nil {
+				t.Fatal(err)
+			}
+
+			// reads what arrives until nothing more does for a while
+			read := func() string {
+				var data []byte
+				buf := make([]byte, 1024)
+				for {
+					conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+					n, err := conn.Read(buf)
+					data = append(data, buf[:n]...)
+					if err != nil {
+						return string(data)
+					}
+				}
+			}
+
+			for i, events := range test.events {
+				for _, event := range events {
+					messages <- event
+				}
+				if data := read(); data != test.expected[i] {
+					t.Errorf("step %d: expected %q, received %q", i+1, test.expected[i], data)
+				}
+			}
+
+			signals <- syscall.SIGTERM
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			data, _ := ioutil.ReadAll(conn)
+			if string(data) != test.pending {
+				t.Errorf("expected the pending batch %q on shutdown, received %q", test.pending, data)
+			}
+
+			stats := output.Statistics().(outputs.NetStatistics)
+			var sent int64
+			for _, events := range test.events {
+				sent += int64(len(events))
+			}
+			if stats.SentEventCount != sent || stats.DroppedEventCount != 0 {
+				t.Errorf("unexpected statistics: %+v", stats)
+			}
+		})
+	}
+}
+
+func TestNetOutputReplayOnReconnect(t *testing.T) {
+	collector := newTestCollector(t, "tcp", testCollectorOptions{})
+
+	output := outputs.NewNetOutputfromConfig(&Configuration{ReplayOnReconnect: 2})
+	if err := output.Initialize(collector.Destination()); err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan string)
+	signals := make(chan os.Signal)
+	if err := output.Go(messages, signals, sync.NewCond(&sync.Mutex{})); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { signals <- syscall.SIGTERM }()
+
+	// the collector resets the connection after receiving three events
+	for _, event := range []string{"e1", "e2", "e3"} {
+		messages <- event
+	}
+	collector.WaitForMessages(3, 10*time.Second)
+	collector.DropConnections()
+	time.Sleep(100 * time.Millisecond)
+
+	// the event that notices the reset is lost, and is not replayed
+	messages <- "e4"
+	collector.WaitForMessages(5, 10*time.Second)
+
+	messages <- "e5"
+	expected := []string{"e1", "e2", "e3", "CBREPLAY e2", "CBREPLAY e3", "e5"}
+	if diff := cmp.Diff(expected, collector.WaitForMessages(6, 10*time.Second)); diff != "" {
+		t.Errorf("unexpected events on the wire (-want +got):\n%s", diff)
+	}
+	if collector.Accepted() != 2 {
+		t.Errorf("expected the output to reconnect once, the collector accepted %d connections", collector.Accepted())
+	}
+
+	if stats := output.Statistics().(outputs.NetStatistics); stats.ReplayedEventCount != 2 || stats.SentEventCount != 4 {
+		t.Errorf("unexpected statistics: %+v", stats)
+	}
+}
+
+// TestNetOutputOnTheWire checks what the output writes to collectors end to end.
+func TestNetOutputOnTheWire(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		network  string
+		options  testCollectorOptions
+		config   Configuration
+		sent     []string
+		expected []string
+	}{
+		{
+			desc:     "udp datagrams",
+			network:  "udp",
+			expected: []string{`{"n":1}`, `{"n":2}`, `{"n":3}`},
+		},
+		{
+			desc:     "lines over tls",
+			network:  "tcp",
+			options:  testCollectorOptions{TLS: true},
+			config:   Configuration{TCPUseTLS: true, TLSConfig: &tls.Config{InsecureSkipVerify: true}},
+			expected: []string{`{"n":1}`, `{"n":2}`, `{"n":3}`},
+		},
+		{
+			desc:     "batches over tls",
+			network:  "tcp",
+			options:  testCollectorOptions{TLS: true},
+			config:   Configuration{TCPUseTLS: true, TLSConfig: &tls.Config{InsecureSkipVerify: true}, BatchMaxEvents: 3, BatchMaxWait: time.Minute},
+			expected: []string{`{"n":1}`, `{"n":2}`, `{"n":3}`},
+		},
+		{
+			desc:     "chunks over udp",
+			network:  "udp",
+			config:   Configuration{MaxMessageSize: 24, OversizePolicy: ChunkOversize},
+			sent:     []string{`{"n":1,"pad":"abcdefghij"}`},
+			expected: []string{`CBCHUNK 1 1/3 {"n":1,"pa`, `CBCHUNK 1 2/3 d":"abcdef`, `CBCHUNK 1 3/3 ghij"}`},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			collector := newTestCollector(t, test.network, test.options)
+
+			config := test.config
+			output := outputs.NewNetOutputfromConfig(&config)
+			if err := output.Initialize(collector.Destination()); err != nil {
+				t.Fatal(err)
+			}
+			messages := make(chan string)
+			signals := make(chan os.Signal)
+			if err := output.Go(messages, signals, sync.NewCond(&sync.Mutex{})); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { signals <- syscall.SIGTERM }()
+
+			sent := test.sent
+			if sent == nil {
+				sent = []string{`{"n":1}`, `{"n":2}`, `{"n":3}`}
+			}
+			for _, message := range sent {
+				messages <- message
+			}
+			if diff := cmp.Diff(test.expected, collector.WaitForMessages(len(test.expected), 5*time.Second)); diff != "" {
+				t.Errorf("unexpected messages on the wire (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNetOutputHeartbeat(t *testing.T) {
+	for _, test := range []struct {
+		desc          string
+		reply         bool
+		expectMissing bool
+	}{
+		{desc: "answered", reply: true},
+		{desc: "unanswered", expectMissing: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			collector := newTestCollector(t, "tcp", testCollectorOptions{Ack: func(message string) string {
+				if message == "PING" && test.reply {
+					// other lines from the collector are ignored
+					return "HELLO\r\nPONG"
+				}
+				return ""
+			}})
+
+			output := outputs.NewNetOutputfromConfig(&Configuration{
+				HeartbeatInterval: 100 * time.Millisecond,
+				HeartbeatTimeout:  200 * time.Millisecond,
+				HeartbeatPing:     "PING",
+				HeartbeatPong:     "PONG",
+			})
+			if err := output.Initialize(collector.Destination()); err != nil {
+				t.Fatal(err)
+			}
+			messages := make(chan string)
+			signals := make(chan os.Signal)
+			if err := output.Go(messages, signals, sync.NewCond(&sync.Mutex{})); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { signals <- syscall.SIGTERM }()
+
+			// events are interleaved with the heartbeats
+			for i := 0; i < 5; i++ {
+				messages <- fmt.Sprintf(`{"n":%d}`, i)
+				time.Sleep(100 * time.Millisecond)
+			}
+
+			stats := output.Statistics().(outputs.NetStatistics)
+			if test.expectMissing {
+				if stats.MissedHeartbeatReconnectCount != 1 || stats.Connected {
+					t.Errorf("expected a reconnection for the missing reply, got %+v", stats)
+				}
+				return
+			}
+
+			var events []string
+			for _, message := range collector.Messages() {
+				if message != "PING" {
+					events = append(events, message)
+				}
+			}
+			expected := []string{`{"n":0}`, `{"n":1}`, `{"n":2}`, `{"n":3}`, `{"n":4}`}
+			if diff := cmp.Diff(expected, events); diff != "" {
+				t.Errorf("unexpected events (-want +got):\n%s", diff)
+			}
+			if stats.HeartbeatCount < 3 || stats.MissedHeartbeatReconnectCount != 0 || !stats.Connected {
+				t.Errorf("expected answered heartbeats on the same connection, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestNetOutputRotationNotice(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// the lines received on each connection, sent once the collector closes it
+	connections := make(chan []string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var lines []string
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines = append(lines, scanner.Text())
+					// the collector finalizes and closes the connection without using all of the grace
+					if scanner.Text() == "ROTATING" {
+						break
+					}
+				}
+				connections <- lines
+			}()
+		}
+	}()
+
+	output := outputs.NewNetOutputfromConfig(&Configuration{
+		MaxConnectionLifetime: time.Second,
+		RotationNotice:        "ROTATING",
+		RotationNoticeGrace:   30 * time.Second,
+	})
+	if err := output.Initialize("tcp:" + listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan string)
+	signals := make(chan os.Signal)
+	if err := output.Go(messages, signals, sync.NewCond(&sync.Mutex{})); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { signals <- syscall.SIGTERM }()
+
+	messages <- `{"n":1}`
+	select {
+	case lines := <-connections:
+		if diff := cmp.Diff([]string{`{"n":1}`, "ROTATING"}, lines); diff != "" {
+			t.Errorf("unexpected lines before the rotation (-want +got):\n%s", diff)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the connection was not rotated")
+	}
+
+	stats := output.Statistics().(outputs.NetStatistics)
+	if stats.RotationNoticeCount != 1 || stats.RotationCount != 1 {
+		t.Errorf("expected one rotation with its notice, got %+v", stats)
+	}
+}
+
+func TestNetOutputLowThroughput(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	output := outputs.NewNetOutputfromConfig(&Configuration{MinEventsPerWindow: 2, ThroughputWindow: time.Second})
+	lowWindows := make(chan int64, 10)
+	output.OnLowThroughput = func(sent int64, window time.Duration) {
+		lowWindows <- sent
+	}
+	if err := output.Initialize("tcp:" + listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan string)
+	signals := make(chan os.Signal)
+	if err := output.Go(messages, signals, sync.NewCond(&sync.Mutex{})); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { signals <- syscall.SIGTERM }()
+
+	// a single event is sent while the first window is counted
+	time.Sleep(1100 * time.Millisecond)
+	messages <- `{"type":"ingress.event.procstart"}`
+
+	select {
+	case sent := <-lowWindows:
+		if sent > 1 {
+			t.Errorf("expected at most 1 event in the quiet window, got %d", sent)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for low throughput to be reported")
+	}
+	stats := output.Statistics().(outputs.NetStatistics)
+	if stats.LowThroughputCount < 1 || stats.LastWindowEventCount > 1 {
+		t.Errorf("unexpected statistics %+v", stats)
+	}
+}
+
+func TestParseNetConnection(t *testing.T) {
+	for _, test := range []struct {
+		netConn   string
+		protocol  string
+		address   string
+		expectErr bool
+	}{
+		{netConn: "tcp:10.0.0.1:514", protocol: "tcp", address: "10.0.0.1:514"},
+		{netConn: "udp:collector.example.com:514", protocol: "udp", address: "collector.example.com:514"},
+		{netConn: "tcp:[2001:db8::1]:514", protocol: "tcp", address: "[2001:db8::1]:514"},
+		{netConn: "tcp:[fe80::1%eth0]:514", protocol: "tcp", address: "[fe80::1%eth0]:514"},
+		{netConn: "tcp:srv:_collector._tcp.example.com", protocol: "tcp", address: "srv:_collector._tcp.example.com"},
+		{netConn: "tcp6:[::1]:65535", protocol: "tcp6", address: "[::1]:65535"},
+		{netConn: "udp4:10.0.0.1:1", protocol: "udp4", address: "10.0.0.1:1"},
+		{netConn: "tcp", expectErr: true},
+		{netConn: "http:10.0.0.1:514", expectErr: true},
+		{netConn: "TCP:10.0.0.1:514", expectErr: true},
+		{netConn: "unix:/var/run/collector.sock", expectErr: true},
+		{netConn: "tcp:srv:", expectErr: true},
+		{netConn: "tcp:10.0.0.1:syslog", expectErr: true},
+		{netConn: "tcp:10.0.0.1:0", expectErr: true},
+		{netConn: "tcp:10.0.0.1:65536", expectErr: true},
+		{netConn: "tcp:[::1]:-1", expectErr: true},
+		{netConn: ":10.0.0.1:514", expectErr: true},
+		{netConn: "tcp:10.0.0.1", expectErr: true},
+		{netConn: "tcp:10.0.0.1:", expectErr: true},
+		{netConn: "tcp:[fe80::1%eth0]", expectErr: true},
+		{netConn: "tcp:2001:db8::", expectErr: true},
+		// without brackets there is no telling where the address ends
+		{netConn: "udp:fe80::1%eth0:514", expectErr: true},
+		{netConn: "tcp:2001:db8::1:514", expectErr: true},
+		{netConn: "tcp:::1", expectErr: true},
+		{netConn: "tcp:collector:example:514", expectErr: true},
+	} {
+		protocol, address, err := outputs.ParseNetConnection(test.netConn)
+		if (err != nil) != test.expectErr {
+			t.Errorf("%s: expected error: %v, got %v", test.netConn, test.expectErr, err)
+			continue
+		}
+		// malformed strings are refused before dialing
+		if test.expectErr {
+			if initErr := outputs.NewNetOutputfromConfig(&Configuration{}).Initialize(test.netConn); initErr == nil || initErr.Error() != err.Error() {
+				t.Errorf("%s: expected Initialize to fail with %v, got %v", test.netConn, err, initErr)
+			}
+			continue
+		}
+		if protocol != test.protocol || address != test.address {
+			t.Errorf("%s: expected %s and %s, got %s and %s", test.netConn, test.protocol, test.address, protocol, address)
+		}
+	}
+}
+
+func TestNetOutputIPv6(t *testing.T) {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	// the loopback interface scopes the address the way a link-local one would be
+	var zone string
+	interfaces, _ := net.Interfaces()
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			zone = iface.Name
+		}
+	}
+
+	allowed, err := ParseCIDRList("::1/128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	netConns := []string{"tcp:[::1]:" + port}
+	if len(zone) > 0 {
+		netConns = append(netConns, "tcp:[::1%"+zone+"]:"+port)
+	}
+	for _, netConn := range netConns {
+		for _, config := range []*Configuration{{}, {DestinationAllowCIDRs: allowed}} {
+			output := outputs.NewNetOutputfromConfig(config)
+			if err := output.Initialize(netConn); err != nil {
+				t.Errorf("%s: %s", netConn, err)
+			}
+		}
+	}
+}
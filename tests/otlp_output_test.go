@@ -0,0 +1,431 @@
+package tests
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type otlpTestRecord struct {
+	Time       uint64
+	Body       string
+	Attributes map[string]interface{}
+}
+
+// otlpTestExport is what the test collector decodes of an ExportLogsServiceRequest.
+type otlpTestExport struct {
+	Resource map[string]interface{}
+	Scope    string
+	Records  []otlpTestRecord
+}
+
+// otlpTestResponse is how the test collector answers an export: an HTTP status, or a gRPC
+// status code, and how many of the records to reject. The zero value is a success.
+type otlpTestResponse struct {
+	status   int
+	rejected int64
+}
+
+type protoField struct {
+	num    protowire.Number
+	bytes  []byte
+	number uint64
+}
+
+func decodeProtoFields(b []byte) ([]protoField, bool) {
+	var fields []protoField
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, false
+		}
+		b = b[n:]
+		field := protoField{num: num}
+		switch typ {
+		case protowire.BytesType:
+			field.bytes, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			field.number, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			field.number, n = protowire.ConsumeFixed64(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return nil, false
+		}
+		b = b[n:]
+		fields = append(fields, field)
+	}
+	return fields, true
+}
+
+// decodeOTLPTestAnyValue decodes an AnyValue holding a string, bool, int64 or float64.
+func decodeOTLPTestAnyValue(b []byte) interface{} {
+	var value interface{}
+	fields, _ := decodeProtoFields(b)
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			value = string(field.bytes)
+		case 2:
+			value = field.number != 0
+		case 3:
+			value = int64(field.number)
+		case 4:
+			value = math.Float64frombits(field.number)
+		}
+	}
+	return value
+}
+
+func decodeOTLPTestKeyValue(b []byte) (string, interface{}) {
+	var key string
+	var value interface{}
+	fields, _ := decodeProtoFields(b)
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			key = string(field.bytes)
+		case 2:
+			value = decodeOTLPTestAnyValue(field.bytes)
+		}
+	}
+	return key, value
+}
+
+func decodeOTLPTestExport(b []byte) (otlpTestExport, bool) {
+	export := otlpTestExport{Resource: make(map[string]interface{})}
+	request, ok := decodeProtoFields(b)
+	for _, resourceLogs := range request {
+		fields, _ := decodeProtoFields(resourceLogs.bytes)
+		for _, field := range fields {
+			switch field.num {
+			case 1:
+				attributes, _ := decodeProtoFields(field.bytes)
+				for _, attribute := range attributes {
+					key, value := decodeOTLPTestKeyValue(attribute.bytes)
+					export.Resource[key] = value
+				}
+			case 2:
+				scopeLogs, _ := decodeProtoFields(field.bytes)
+				for _, scopeField := range scopeLogs {
+					if scopeField.num == 1 {
+						scope, _ := decodeProtoFields(scopeField.bytes)
+						export.Scope = string(scope[0].bytes)
+						continue
+					}
+					record := otlpTestRecord{Attributes: make(map[string]interface{})}
+					recordFields, _ := decodeProtoFields(scopeField.bytes)
+					for _, recordField := range recordFields {
+						switch recordField.num {
+						case 1:
+							record.Time = recordField.number
+						case 5:
+							record.Body, _ = decodeOTLPTestAnyValue(recordField.bytes).(string)
+						case 6:
+							key, value := decodeOTLPTestKeyValue(recordField.bytes)
+							record.Attributes[key] = value
+						}
+					}
+					export.Records = append(export.Records, record)
+				}
+			}
+		}
+	}
+	return export, ok
+}
+
+// encodeOTLPTestResponse encodes an ExportLogsServiceResponse rejecting some records.
+func encodeOTLPTestResponse(rejected int64) []byte {
+	if rejected == 0 {
+		return nil
+	}
+	var partialSuccess []byte
+	partialSuccess = protowire.AppendTag(partialSuccess, 1, protowire.VarintType)
+	partialSuccess = protowire.AppendVarint(partialSuccess, uint64(rejected))
+	partialSuccess = protowire.AppendTag(partialSuccess, 2, protowire.BytesType)
+	partialSuccess = protowire.AppendString(partialSuccess, "invalid record")
+	return protowire.AppendBytes(protowire.AppendTag(nil, 1, protowire.BytesType), partialSuccess)
+}
+
+// otlpTestHandler collects OTLP/HTTP or OTLP/gRPC exports, answering them with the given
+// responses in turn, and with success once they run out. The exports it takes are handed over.
+func otlpTestHandler(t *testing.T, grpc bool, responses ...otlpTestResponse) (http.Handler, <-chan otlpTestExport) {
+	exports := make(chan otlpTestExport, 10)
+	var mutex sync.Mutex
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := "/v1/logs"
+		if grpc {
+			path = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+		}
+		if r.URL.Path != path || r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if grpc {
+			if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+				t.Errorf("invalid gRPC message %q", body)
+				return
+			}
+			body = body[5:]
+		}
+
+		mutex.Lock()
+		var response otlpTestResponse
+		if len(responses) > 0 {
+			response, responses = responses[0], responses[1:]
+		}
+		mutex.Unlock()
+		if !grpc && response.status == 0 {
+			response.status = http.StatusOK
+		}
+
+		if grpc {
+			w.Header().Set("Content-Type", "application/grpc")
+			if response.status != 0 {
+				// a trailers-only response
+				w.Header().Set("Grpc-Status", strconv.Itoa(response.status))
+				w.Header().Set("Grpc-Message", "try%20again")
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+		} else if response.status != http.StatusOK {
+			if response.status == http.StatusServiceUnavailable {
+				w.Header().Set("Retry-After", "0")
+			}
+			w.Header().Set("Content-Type", "application/x-protobuf")
+			w.WriteHeader(response.status)
+			w.Write(protowire.AppendString(protowire.AppendTag(nil, 2, protowire.BytesType), "bad request"))
+			return
+		}
+
+		export, ok := decodeOTLPTestExport(body)
+		if !ok {
+			t.Errorf("invalid export request %q", body)
+		}
+		exports <- export
+
+		message := encodeOTLPTestResponse(response.rejected)
+		if grpc {
+			frame := make([]byte, 5)
+			binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+			w.Write(append(frame, message...))
+			w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(message)
+	}), exports
+}
+
+func newTestOTLPOutput(protocol string, batchSize int) *outputs.OTLPOutput {
+	return outputs.NewOTLPOutputFromConfig(&Configuration{
+		OTLPProtocol:           protocol,
+		OTLPAttributes:         []OTLPAttribute{{Name: "cb.event_type", Field: "type"}, {Name: "sensor_id", Field: "sensor_id"}, {Name: "process", Field: "process"}, {Name: "process.suspicious", Field: "process.suspicious"}, {Name: "score", Field: "score"}},
+		OTLPResourceAttributes: map[string]string{"service.name": "cb-event-forwarder"},
+		OTLPHeaders:            http.Header{"Authorization": []string{"Bearer secret"}},
+		OTLPBatchSize:          batchSize,
+		OTLPBatchWait:          time.Hour,
+		OTLPMaxRetries:         2,
+		TimeSource:             EventTimeSource,
+	})
+}
+
+// waitForOTLPExport waits for the test collector to take an export.
+func waitForOTLPExport(t *testing.T, exports <-chan otlpTestExport) otlpTestExport {
+	select {
+	case export := <-exports:
+		return export
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the export")
+	}
+	return otlpTestExport{}
+}
+
+func TestOTLPOutput(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		protocol string
+		// the first export fails with this response before being retried
+		failure otlpTestResponse
+		server  func(http.Handler) *httptest.Server
+	}{
+		{
+			desc:     "http",
+			protocol: OTLPHTTPProtocol,
+			failure:  otlpTestResponse{status: http.StatusServiceUnavailable},
+			server:   httptest.NewServer,
+		},
+		{
+			desc:     "grpc",
+			protocol: OTLPGRPCProtocol,
+			failure:  otlpTestResponse{status: 14},
+			server: func(handler http.Handler) *httptest.Server {
+				return httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+			},
+		},
+		{
+			desc:     "grpc with tls",
+			protocol: OTLPGRPCProtocol,
+			failure:  otlpTestResponse{status: 14},
+			server: func(handler http.Handler) *httptest.Server {
+				server := httptest.NewUnstartedServer(handler)
+				server.EnableHTTP2 = true
+				server.StartTLS()
+				return server
+			},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			handler, exports := otlpTestHandler(t, test.protocol == OTLPGRPCProtocol, test.failure, otlpTestResponse{rejected: 1})
+			server := test.server(handler)
+			defer server.Close()
+
+			output := newTestOTLPOutput(test.protocol, 3)
+			if server.TLS != nil {
+				output.Config.TLSConfig = &tls.Config{RootCAs: server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+			}
+			messages, _ := startTestOutput(t, output, server.URL)
+
+			// the batch is exported once it holds 3 events, after being retried once
+			before := uint64(time.Now().UnixNano())
+			for _, message := range []string{
+				`{"type":"ingress.event.procstart","timestamp":1600000001,"sensor_id":7,"process":{"name":"cmd.exe","suspicious":true}}` + "\n",
+				`{"type":"alert.watchlist.hit","timestamp":1600000002.5,"score":7.5}` + "\n",
+				`not json`,
+			} {
+				messages <- message
+			}
+
+			export := waitForOTLPExport(t, exports)
+			// the event that isn't json is stamped with the time it was received
+			if len(export.Records) != 3 || export.Records[2].Time < before {
+				t.Fatalf("unexpected records: %+v", export.Records)
+			}
+			export.Records[2].Time = 0
+
+			expected := otlpTestExport{
+				Resource: map[string]interface{}{"service.name": "cb-event-forwarder"},
+				Scope:    "cb-event-forwarder",
+				Records: []otlpTestRecord{
+					{
+						Time: 1600000001000000000,
+						Body: `{"type":"ingress.event.procstart","timestamp":1600000001,"sensor_id":7,"process":{"name":"cmd.exe","suspicious":true}}`,
+						Attributes: map[string]interface{}{
+							"cb.event_type":      "ingress.event.procstart",
+							"sensor_id":          int64(7),
+							"process":            `{"name":"cmd.exe","suspicious":true}`,
+							"process.suspicious": true,
+						},
+					},
+					{
+						Time:       1600000002500000000,
+						Body:       `{"type":"alert.watchlist.hit","timestamp":1600000002.5,"score":7.5}`,
+						Attributes: map[string]interface{}{"cb.event_type": "alert.watchlist.hit", "score": 7.5},
+					},
+					{Body: "not json", Attributes: map[string]interface{}{}},
+				},
+			}
+			if diff := cmp.Diff(expected, export); diff != "" {
+				t.Errorf("export mismatch (-want +got):\n%s", diff)
+			}
+
+			// the record the collector rejected is counted once the export is answered
+			stats := waitForStatistics(t, output, func(s interface{}) bool { return s.(outputs.OTLPStatistics).ExportedEventCount == 2 }).(outputs.OTLPStatistics)
+			if stats.ExportedEventCount != 2 || stats.FailedEventCount != 1 || stats.RejectedEventCount != 1 || stats.RetryCount != 1 || stats.PendingEventCount != 0 || stats.Protocol != test.protocol {
+				t.Errorf("unexpected statistics: %+v", stats)
+			}
+		})
+	}
+}
+
+func TestOTLPOutputFailures(t *testing.T) {
+	for _, test := range []struct {
+		desc      string
+		protocol  string
+		responses []otlpTestResponse
+		server    func(http.Handler) *httptest.Server
+	}{
+		{
+			desc:      "http",
+			protocol:  OTLPHTTPProtocol,
+			responses: []otlpTestResponse{{status: http.StatusBadRequest}, {status: 502}, {status: 502}, {status: 502}},
+			server:    httptest.NewServer,
+		},
+		{
+			// INVALID_ARGUMENT is not retried, UNAVAILABLE is
+			desc:      "grpc",
+			protocol:  OTLPGRPCProtocol,
+			responses: []otlpTestResponse{{status: 3}, {status: 14}, {status: 14}, {status: 14}},
+			server: func(handler http.Handler) *httptest.Server {
+				return httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+			},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			handler, _ := otlpTestHandler(t, test.protocol == OTLPGRPCProtocol, test.responses...)
+			server := test.server(handler)
+			defer server.Close()
+
+			output := newTestOTLPOutput(test.protocol, 1000)
+			if err := output.Initialize(server.URL); err != nil {
+				t.Fatal(err)
+			}
+			if err := output.Verify(`{"type":"ingress.event.netconn"}`); err == nil {
+				t.Error("expected the invalid export to fail")
+			}
+			// transient errors are retried up to max_retries times
+			if err := output.Verify(`{"type":"ingress.event.netconn"}`); err == nil {
+				t.Error("expected the export to fail after all retries")
+			}
+
+			stats := output.Statistics().(outputs.OTLPStatistics)
+			if stats.ExportedEventCount != 0 || stats.FailedEventCount != 2 || stats.RejectedEventCount != 0 || stats.RetryCount != 2 {
+				t.Errorf("unexpected statistics: %+v", stats)
+			}
+		})
+	}
+}
+
+func TestOTLPOutputEndpoint(t *testing.T) {
+	for _, test := range []struct {
+		protocol  string
+		endpoint  string
+		expected  string
+		expectErr bool
+	}{
+		{protocol: OTLPHTTPProtocol, endpoint: "http://otel:4318", expected: "otlp:http://otel:4318/v1/logs"},
+		{protocol: OTLPHTTPProtocol, endpoint: "https://otel:4318/custom/logs", expected: "otlp:https://otel:4318/custom/logs"},
+		{protocol: OTLPGRPCProtocol, endpoint: "https://otel:4317/", expected: "otlp:https://otel:4317/opentelemetry.proto.collector.logs.v1.LogsService/Export"},
+		{protocol: OTLPGRPCProtocol, endpoint: "http://otel:4317/v1/logs", expectErr: true},
+		{protocol: OTLPHTTPProtocol, endpoint: "grpc://otel:4317", expectErr: true},
+		{protocol: OTLPHTTPProtocol, endpoint: "otel:4318", expectErr: true},
+	} {
+		output := newTestOTLPOutput(test.protocol, 1)
+		err := output.Initialize(test.endpoint)
+		if (err != nil) != test.expectErr {
+			t.Errorf("%s: expected error: %v, got %v", test.endpoint, test.expectErr, err)
+			continue
+		}
+		if err == nil && output.Key() != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.endpoint, test.expected, output.Key())
+		}
+	}
+}
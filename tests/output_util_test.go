@@ -0,0 +1,49 @@
+package tests
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+)
+
+// startTestOutput initializes output with dest and runs it until the test ends, returning the
+// channels to send it messages and signals.
+func startTestOutput(t *testing.T, output outputs.Output, dest string) (chan<- string, chan<- os.Signal) {
+	t.Helper()
+	if err := output.Initialize(dest); err != nil {
+		t.Fatal(err)
+	}
+	return runTestOutput(t, output)
+}
+
+// runTestOutput runs an output that is already initialized until the test ends.
+func runTestOutput(t *testing.T, output outputs.Output) (chan<- string, chan<- os.Signal) {
+	t.Helper()
+	messages := make(chan string)
+	signals := make(chan os.Signal)
+	if err := output.Go(messages, signals, sync.NewCond(&sync.Mutex{})); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { signals <- syscall.SIGTERM })
+	return messages, signals
+}
+
+// waitForStatistics waits for the statistics of output to satisfy done, and returns them.
+func waitForStatistics(t *testing.T, output outputs.OutputKeys, done func(statistics interface{}) bool) interface{} {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		statistics := output.Statistics()
+		if done(statistics) {
+			return statistics
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the statistics of %s: %+v", output, statistics)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
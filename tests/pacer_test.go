@@ -0,0 +1,44 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/carbonblack/cb-event-forwarder/pkg/forwarder"
+)
+
+func TestPacer(t *testing.T) {
+	const eps = 200
+	interval := time.Second / eps
+	pacer := forwarder.NewPacer(eps)
+
+	start := time.Now()
+	for i := 0; i < 21; i++ {
+		pacer.Wait()
+	}
+	if elapsed := time.Since(start); elapsed < 20*interval {
+		t.Errorf("expected 21 events to take at least %s, took %s", 20*interval, elapsed)
+	}
+
+	// an idle period doesn't let a burst through afterwards
+	time.Sleep(20 * interval)
+	start = time.Now()
+	for i := 0; i < 5; i++ {
+		pacer.Wait()
+	}
+	if elapsed := time.Since(start); elapsed < 4*interval {
+		t.Errorf("expected 5 events after an idle period to take at least %s, took %s", 4*interval, elapsed)
+	}
+
+	for deadline := time.Now().Add(1200 * time.Millisecond); time.Now().Before(deadline); {
+		pacer.Wait()
+	}
+	if rate := pacer.EffectiveEPS(); rate < eps*0.75 || rate > eps*1.05 {
+		t.Errorf("expected an effective rate close to %d events per second, got %f", eps, rate)
+	}
+
+	time.Sleep(2 * time.Second)
+	if rate := pacer.EffectiveEPS(); rate != 0 {
+		t.Errorf("expected no effective rate after an idle period, got %f", rate)
+	}
+}
@@ -0,0 +1,43 @@
+package tests
+
+import (
+	"math"
+	"testing"
+
+	"github.com/carbonblack/cb-event-forwarder/pkg/forwarder"
+	"github.com/streadway/amqp"
+)
+
+func TestProcessorShardPicker(t *testing.T) {
+	const size = 3
+	pick := forwarder.NewProcessorShardPicker(size, true)
+
+	for _, test := range []struct {
+		desc      string
+		headers   amqp.Table
+		sameShard bool
+	}{
+		{desc: "min int64", headers: amqp.Table{"sensorId": int64(math.MinInt64)}, sameShard: true},
+		{desc: "min int64 string", headers: amqp.Table{"sensorId": "-9223372036854775808"}, sameShard: true},
+		{desc: "max int64", headers: amqp.Table{"sensorId": int64(math.MaxInt64)}, sameShard: true},
+		{desc: "negative", headers: amqp.Table{"sensorId": int32(-7)}, sameShard: true},
+		{desc: "missing", headers: amqp.Table{}},
+		{desc: "no headers", headers: nil},
+		{desc: "not numeric", headers: amqp.Table{"sensorId": "sensor"}},
+		{desc: "unknown type", headers: amqp.Table{"sensorId": 1.5}},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			// deliveries of a sensor always go to the same processor, the others round-robin
+			first := pick(test.headers)
+			for i := 0; i < size; i++ {
+				shard := pick(test.headers)
+				if shard < 0 || shard >= size {
+					t.Fatalf("shard %d out of range", shard)
+				}
+				if test.sameShard && shard != first {
+					t.Errorf("expected the deliveries of the sensor to go to shard %d, got %d", first, shard)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/carbonblack/cb-event-forwarder/pkg/forwarder"
+	"github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+	"github.com/google/go-cmp/cmp"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestOutputShutdownSummary(t *testing.T) {
+	routeStats := forwarder.OutputRouteStatistics{Backlog: 4, DroppedEventCount: 2}
+
+	for _, test := range []struct {
+		desc     string
+		stats    interface{}
+		expected log.Fields
+	}{
+		{
+			desc:     "net",
+			stats:    outputs.NetStatistics{SentEventCount: 10, DroppedEventCount: 1, ReconnectCount: 3},
+			expected: log.Fields{"sent": int64(10), "dropped": int64(1), "reconnects": int64(3)},
+		},
+		{
+			desc:     "kafka",
+			stats:    outputs.KafkaStatistics{EventSentCount: 10, DroppedEventCount: 1},
+			expected: log.Fields{"sent": int64(10), "dropped": int64(1)},
+		},
+		{
+			desc:     "otlp",
+			stats:    outputs.OTLPStatistics{ExportedEventCount: 10, FailedEventCount: 1},
+			expected: log.Fields{"sent": int64(10), "dropped": int64(1)},
+		},
+		{
+			desc:     "loki",
+			stats:    outputs.LokiStatistics{PushedEventCount: 10, FailedEventCount: 1},
+			expected: log.Fields{"sent": int64(10), "dropped": int64(1)},
+		},
+		{
+			desc:     "nats",
+			stats:    outputs.NATSStatistics{PublishedEventCount: 10, FailedEventCount: 1, ReconnectCount: 3},
+			expected: log.Fields{"sent": int64(10), "dropped": int64(1), "reconnects": int64(3)},
+		},
+		{
+			desc:     "sql",
+			stats:    outputs.SQLStatistics{InsertedRowCount: 10, FailedRowCount: 1},
+			expected: log.Fields{"sent": int64(10), "dropped": int64(1)},
+		},
+		{
+			desc:     "splunk_hec",
+			stats:    outputs.SplunkHECStatistics{SentEventCount: 10, FailedEventCount: 1},
+			expected: log.Fields{"sent": int64(10), "dropped": int64(1)},
+		},
+		{
+			desc:     "websocket",
+			stats:    outputs.WebSocketStatistics{SentMessageCount: 10, DroppedEventCount: 1, ReconnectCount: 3},
+			expected: log.Fields{"sent": int64(10), "dropped": int64(1), "reconnects": int64(3)},
+		},
+		{
+			// outputs that don't count their events only get the route's figures
+			desc:     "file",
+			stats:    outputs.FileStatistics{},
+			expected: log.Fields{},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			test.expected["output"] = "output"
+			test.expected["backlog"] = 7
+			test.expected["overflow_dropped"] = int64(2)
+
+			fields := forwarder.OutputShutdownSummary("output", 3, routeStats, test.stats)
+			if diff := cmp.Diff(test.expected, fields); diff != "" {
+				t.Errorf("unexpected summary (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestEventTypeCounter(t *testing.T) {
+	counter := forwarder.NewEventTypeCounter(4)
+	if counts := counter.Counts(); counts != nil {
+		t.Errorf("expected no counts, got %v", counts)
+	}
+
+	// once 3 types are counted, the events of new types are counted as other, in the last slot
+	for _, eventType := range []string{
+		"ingress.event.procstart", "ingress.event.netconn", "ingress.event.procstart", "",
+		"ingress.event.filemod", "alert.watchlist.hit", "ingress.event.netconn", "",
+	} {
+		counter.Add(eventType)
+	}
+	expected := map[string]int64{
+		"ingress.event.procstart": 2,
+		"ingress.event.netconn":   2,
+		"unknown":                 2,
+		"other":                   2,
+	}
+	counts := counter.Counts()
+	if diff := cmp.Diff(expected, counts); diff != "" {
+		t.Errorf("unexpected counts (-want +got):\n%s", diff)
+	}
+
+	// the counts returned are a copy
+	counts["other"] = 0
+	if counter.Counts()["other"] != 2 {
+		t.Error("expected the counts to be copied")
+	}
+}
@@ -1,11 +1,24 @@
 package tests
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
 	"github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+	"github.com/google/go-cmp/cmp"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var MockUploadOutput = s3manager.UploadOutput{Location: "MockOutputLocation", UploadID: "MockUploadID", VersionID: nil}
@@ -53,3 +66,338 @@ func TestS3GZ(t *testing.T) {
 	}
 	s3Publisher.Stop()
 }
+
+// newMockS3Server returns an S3 endpoint that fails the first failures object uploads. Multipart
+// uploads always fail on their first part, and aborted uploads are recorded in aborted.
+func newMockS3Server(failures int, aborted *int32) *httptest.Server {
+	var mutex sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		query := r.URL.Query()
+		_, initiate := query["uploads"]
+
+		switch {
+		case r.Method == http.MethodHead:
+		case r.Method == http.MethodPost && initiate:
+			fmt.Fprint(w, `<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>key</Key><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`)
+		case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+			atomic.AddInt32(aborted, 1)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPut && query.Get("partNumber") != "":
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<Error><Code>AccessDenied</Code><Message>denied</Message></Error>`)
+		case r.Method == http.MethodPut:
+			mutex.Lock()
+			defer mutex.Unlock()
+			if failures > 0 {
+				failures--
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, `<Error><Code>AccessDenied</Code><Message>denied</Message></Error>`)
+			}
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+}
+
+func TestS3BehaviorUploadRetries(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	dir, err := ioutil.TempDir("", "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		desc      string
+		failures  int
+		retries   int
+		size      int64
+		expectErr bool
+		expected  outputs.S3Statistics
+		aborted   int32
+	}{
+		{desc: "succeeds after retries", failures: 2, retries: 3, size: 100,
+			expected: outputs.S3Statistics{UploadAttempts: 3}},
+		{desc: "gives up", failures: 5, retries: 1, size: 100, expectErr: true,
+			expected: outputs.S3Statistics{UploadAttempts: 2, UploadFailures: 1}},
+		{desc: "aborts failed multipart upload", retries: 0, size: s3manager.MinUploadPartSize + 1, expectErr: true,
+			expected: outputs.S3Statistics{UploadAttempts: 1, UploadFailures: 1, MultipartUploads: 1}, aborted: 1},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			var aborted int32
+			server := newMockS3Server(test.failures, &aborted)
+			defer server.Close()
+
+			endpoint := strings.TrimPrefix(server.URL, "http://")
+			cfg := Configuration{
+				S3Endpoint:           &endpoint,
+				S3UploadRetries:      test.retries,
+				S3UploadRetryBackoff: time.Millisecond,
+				S3MultipartThreshold: s3manager.MinUploadPartSize,
+			}
+			behavior := &outputs.S3Behavior{Config: &cfg}
+			if err := behavior.Initialize("us-east-1:bucket"); err != nil {
+				t.Fatal(err)
+			}
+
+			fileName := filepath.Join(dir, "event-forwarder."+strings.Replace(test.desc, " ", "-", -1))
+			if err := ioutil.WriteFile(fileName, bytes.Repeat([]byte("x"), int(test.size)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			fp, err := os.Open(fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			status := behavior.Upload(fileName, fp)
+			stats := behavior.Statistics().(outputs.S3Statistics)
+			stats.BucketName, stats.Region = "", ""
+
+			if err := status.Err(); (err != nil) != test.expectErr {
+				t.Errorf("unexpected upload result: %v", err)
+			}
+			if diff := cmp.Diff(test.expected, stats); diff != "" {
+				t.Errorf("unexpected statistics, diff: %s", diff)
+			}
+			if aborted != test.aborted {
+				t.Errorf("expected %d aborted uploads, got %d", test.aborted, aborted)
+			}
+		})
+	}
+}
+
+// newMockS3ReplicaServer returns an S3 endpoint where the missing bucket does not exist and
+// the first failures uploads to the flaky bucket are denied. Successful uploads are counted by
+// bucket in uploads.
+func newMockS3ReplicaServer(failures int, uploads map[string]int) *httptest.Server {
+	var mutex sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		bucket := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch {
+		case r.Method == http.MethodHead:
+		case r.Method != http.MethodPut:
+			w.WriteHeader(http.StatusNotImplemented)
+		case bucket == "missing":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchBucket</Code><Message>no such bucket</Message></Error>`)
+		case bucket == "flaky" && failures > 0:
+			failures--
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<Error><Code>AccessDenied</Code><Message>denied</Message></Error>`)
+		default:
+			uploads[bucket]++
+		}
+	}))
+}
+
+func TestS3BehaviorReplicas(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	dir, err := ioutil.TempDir("", "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	uploads := make(map[string]int)
+	server := newMockS3ReplicaServer(2, uploads)
+	defer server.Close()
+
+	endpoint := strings.TrimPrefix(server.URL, "http://")
+	cfg := Configuration{
+		S3Endpoint:           &endpoint,
+		S3UploadRetryBackoff: time.Millisecond,
+		S3Replicas:           []string{"us-west-2:flaky", "eu-west-1:missing"},
+	}
+	behavior := &outputs.S3Behavior{Config: &cfg}
+	if err := behavior.Initialize("us-east-1:primary"); err != nil {
+		t.Fatal(err)
+	}
+
+	fileName := filepath.Join(dir, "event-forwarder.2021-01-01T00:00:00.000")
+	if err := ioutil.WriteFile(fileName, []byte(`{"type":"a"}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	upload := func() error {
+		fp, err := os.Open(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return behavior.Upload(fileName, fp).Err()
+	}
+
+	// the flaky bucket fails twice, and is the only one tried again
+	for i := 0; i < 2; i++ {
+		if err := upload(); err == nil {
+			t.Fatalf("expected upload %d to fail", i+1)
+		}
+	}
+	if err := upload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(map[string]int{"primary": 1, "flaky": 1}, uploads); diff != "" {
+		t.Errorf("unexpected uploads by bucket (-want +got):\n%s", diff)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "failed-uploads", "eu-west-1_missing", filepath.Base(fileName))); err != nil || string(b) != `{"type":"a"}`+"\n" {
+		t.Errorf("expected a copy of the file for the missing bucket: %q, %v", b, err)
+	}
+
+	expected := outputs.S3Statistics{
+		BucketName:     "primary",
+		Region:         "us-east-1",
+		UploadAttempts: 5,
+		UploadFailures: 3,
+		FallbackFiles:  1,
+		Targets: []outputs.S3TargetStatistics{
+			{BucketName: "primary", Region: "us-east-1", UploadAttempts: 1, FilesUploaded: 1},
+			{BucketName: "flaky", Region: "us-west-2", UploadAttempts: 3, UploadFailures: 2, FilesUploaded: 1},
+			{BucketName: "missing", Region: "eu-west-1", UploadAttempts: 1, UploadFailures: 1, FallbackFiles: 1},
+		},
+	}
+	if diff := cmp.Diff(expected, behavior.Statistics()); diff != "" {
+		t.Errorf("unexpected statistics (-want +got):\n%s", diff)
+	}
+}
+
+// recordingUploader reads every upload to the end and keeps its contents by object key.
+type recordingUploader struct {
+	sync.Mutex
+	objects map[string]string
+}
+
+func (uploader *recordingUploader) Upload(input *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	b, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	uploader.Lock()
+	defer uploader.Unlock()
+	uploader.objects[*input.Key] = string(b)
+	return &MockUploadOutput, nil
+}
+
+// partitionedObjects returns the partition and contents of every uploaded object, sorted.
+func (uploader *recordingUploader) partitionedObjects() []string {
+	uploader.Lock()
+	defer uploader.Unlock()
+
+	var objects []string
+	for key, contents := range uploader.objects {
+		objects = append(objects, path.Dir(key)+" "+contents)
+	}
+	sort.Strings(objects)
+	return objects
+}
+
+func TestS3PartitionedKeys(t *testing.T) {
+	tmpl, err := ParseS3KeyTemplate(`type={{.Field "type"}}/dt={{.Time.Format "2006-01-02"}}/hour={{.Time.Format "15"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := []string{
+		`{"type":"ingress.event.procstart","timestamp":1614379081}` + "\n",
+		`{"type":"alert/watchlist","timestamp":1614382681.5}` + "\n",
+		`{"type":"ingress.event.procstart","timestamp":1614379082}` + "\n",
+		`{"timestamp":1614379083}` + "\n",
+	}
+
+	for _, test := range []struct {
+		mode     S3PartitionMode
+		expected []string
+	}{
+		{
+			mode: BufferPerPartition,
+			expected: []string{
+				"prefix/type=__HIVE_DEFAULT_PARTITION__/dt=2021-02-26/hour=22 " + events[3],
+				"prefix/type=alert%2Fwatchlist/dt=2021-02-26/hour=23 " + events[1],
+				"prefix/type=ingress.event.procstart/dt=2021-02-26/hour=22 " + events[0] + events[2],
+			},
+		},
+		{
+			mode: RollOnPartitionChange,
+			expected: []string{
+				"prefix/type=__HIVE_DEFAULT_PARTITION__/dt=2021-02-26/hour=22 " + events[3],
+				"prefix/type=alert%2Fwatchlist/dt=2021-02-26/hour=23 " + events[1],
+				"prefix/type=ingress.event.procstart/dt=2021-02-26/hour=22 " + events[0],
+				"prefix/type=ingress.event.procstart/dt=2021-02-26/hour=22 " + events[2],
+			},
+		},
+	} {
+		t.Run(string(test.mode), func(t *testing.T) {
+			prefix := "prefix"
+			cfg := Configuration{
+				CompressionType: NOCOMPRESSION,
+				S3Concurrency:   1,
+				S3ObjectPrefix:  &prefix,
+				S3KeyTemplate:   tmpl,
+				S3PartitionMode: test.mode,
+				TimeSource:      EventTimeSource,
+				BundleSizeMax:   1024 * 1024,
+			}
+			uploader := &recordingUploader{objects: make(map[string]string)}
+			publisher := outputs.NewS3ChunkingPublisher(&cfg, uploader, "MockBucket")
+			if err := publisher.Start(); err != nil {
+				t.Fatal(err)
+			}
+			for _, event := range events {
+				publisher.Input <- event
+			}
+			publisher.Stop()
+
+			// object names are unique per millisecond and worker
+			if diff := cmp.Diff(len(test.expected), len(uploader.objects)); diff != "" {
+				t.Errorf("unexpected number of objects, diff: %s", diff)
+			}
+			if diff := cmp.Diff(test.expected, uploader.partitionedObjects()); diff != "" {
+				t.Errorf("unexpected objects, diff: %s", diff)
+			}
+		})
+	}
+
+	for _, invalid := range []string{`type={{.Field "type"`, `{{.Missing}}`, `{{.Time.Format}}`} {
+		if _, err := ParseS3KeyTemplate(invalid); err == nil {
+			t.Errorf("expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestS3PartitionTimeSource(t *testing.T) {
+	tmpl, err := ParseS3KeyTemplate(`dt={{.Time.Format "2006-01-02T15"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingest := time.Date(2021, 3, 1, 8, 30, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		source   TimeSource
+		message  string
+		expected string
+		fellBack bool
+	}{
+		{EventTimeSource, `{"timestamp":1614379081}`, "dt=2021-02-26T22", false},
+		{EventTimeSource, `{"timestamp":"yesterday"}`, "dt=2021-03-01T08", true},
+		{EventTimeSource, `{"type":"alert"}`, "dt=2021-03-01T08", true},
+		{EventTimeSource, `not json`, "dt=2021-03-01T08", true},
+		{IngestTimeSource, `{"timestamp":1614379081}`, "dt=2021-03-01T08", false},
+		{IngestTimeSource, `not json`, "dt=2021-03-01T08", false},
+	} {
+		partition, fellBack, err := S3Partition(tmpl, test.message, test.source, ingest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if partition != test.expected || fellBack != test.fellBack {
+			t.Errorf("%s time of %s: expected %s (fell back: %t), got %s (fell back: %t)",
+				test.source, test.message, test.expected, test.fellBack, partition, fellBack)
+		}
+	}
+}
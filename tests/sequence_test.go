@@ -0,0 +1,78 @@
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/carbonblack/cb-event-forwarder/pkg/forwarder"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSequenceCounter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sequence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sequence")
+
+	next := func(counter *forwarder.SequenceCounter, n int) []uint64 {
+		var numbers []uint64
+		for i := 0; i < n; i++ {
+			numbers = append(numbers, counter.Next())
+		}
+		return numbers
+	}
+	stateFile := func() string {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// without a state file, numbering starts from 0
+	counter, err := forwarder.NewSequenceCounter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]uint64{0, 1, 2}, next(counter, 3)); diff != "" {
+		t.Errorf("unexpected numbers, diff: %s", diff)
+	}
+	if diff := cmp.Diff("10000\n", stateFile()); diff != "" {
+		t.Errorf("expected a reservation to be saved, diff: %s", diff)
+	}
+
+	// a clean shutdown saves the next number
+	if err := counter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("3\n", stateFile()); diff != "" {
+		t.Errorf("expected the next number to be saved, diff: %s", diff)
+	}
+
+	// a restart resumes from it, and a crash skips the rest of the reservation
+	counter, err = forwarder.NewSequenceCounter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]uint64{3, 4}, next(counter, 2)); diff != "" {
+		t.Errorf("unexpected numbers after restart, diff: %s", diff)
+	}
+	counter, err = forwarder.NewSequenceCounter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]uint64{10003}, next(counter, 1)); diff != "" {
+		t.Errorf("unexpected numbers after crash, diff: %s", diff)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("garbage\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := forwarder.NewSequenceCounter(path); err == nil {
+		t.Error("expected an invalid state file to be rejected")
+	}
+}
@@ -0,0 +1,231 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+	"github.com/google/go-cmp/cmp"
+)
+
+type splunkHECEnvelope struct {
+	Time       json.Number     `json:"time"`
+	Host       string          `json:"host"`
+	Source     string          `json:"source"`
+	SourceType string          `json:"sourcetype"`
+	Index      string          `json:"index"`
+	Event      json.RawMessage `json:"event"`
+}
+
+// testSplunkHEC is a HEC endpoint answering the batches it receives with the given responses in
+// turn, and 200 once they run out. With indexer acknowledgement, it gives every accepted batch an
+// ack ID and acknowledges all of them but those in unacked.
+type testSplunkHEC struct {
+	t         *testing.T
+	ack       bool
+	responses []int
+	unacked   map[int64]bool
+
+	mutex    sync.Mutex
+	batches  [][]splunkHECEnvelope
+	channels map[string]bool
+	nextAck  int64
+}
+
+func newTestSplunkHEC(t *testing.T, ack bool, responses ...int) (*testSplunkHEC, *httptest.Server) {
+	hec := &testSplunkHEC{t: t, ack: ack, responses: responses, unacked: make(map[int64]bool), channels: make(map[string]bool)}
+	server := httptest.NewServer(hec)
+	t.Cleanup(server.Close)
+	return hec, server
+}
+
+func (h *testSplunkHEC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Splunk 00000000-0000-0000-0000-000000000000" {
+		http.Error(w, `{"text":"Invalid token","code":4}`, http.StatusForbidden)
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.ack {
+		h.channels[r.Header.Get("X-Splunk-Request-Channel")] = true
+	}
+
+	switch r.URL.Path {
+	case "/services/collector/event":
+		status := http.StatusOK
+		if len(h.responses) > 0 {
+			status, h.responses = h.responses[0], h.responses[1:]
+		}
+		if status != http.StatusOK {
+			// a date that has already passed, so the retry doesn't wait
+			w.Header().Set("Retry-After", time.Now().UTC().Format(http.TimeFormat))
+			http.Error(w, `{"text":"Server is busy","code":9}`, status)
+			return
+		}
+
+		var batch []splunkHECEnvelope
+		decoder := json.NewDecoder(r.Body)
+		for {
+			var event splunkHECEnvelope
+			if err := decoder.Decode(&event); err == io.EOF {
+				break
+			} else if err != nil {
+				h.t.Errorf("invalid batch: %s", err)
+				break
+			}
+			batch = append(batch, event)
+		}
+		h.batches = append(h.batches, batch)
+
+		if h.ack {
+			fmt.Fprintf(w, `{"text":"Success","code":0,"ackId":%d}`, h.nextAck)
+			h.nextAck++
+			return
+		}
+		fmt.Fprint(w, `{"text":"Success","code":0}`)
+
+	case "/services/collector/ack":
+		var query struct {
+			Acks []int64 `json:"acks"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+			h.t.Errorf("invalid ack query: %s", err)
+		}
+		acks := make(map[string]bool)
+		for _, id := range query.Acks {
+			acks[fmt.Sprint(id)] = !h.unacked[id]
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"acks": acks})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *testSplunkHEC) Batches() [][]splunkHECEnvelope {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([][]splunkHECEnvelope(nil), h.batches...)
+}
+
+func newTestSplunkHECOutput(batchSize int, ack bool) *outputs.SplunkHECOutput {
+	sourceTypes, _ := ParseEventTypeValues("alert.*=carbonblack:alert")
+	indexes, _ := ParseEventTypeValues("ingress.event.netconn=network,ingress.event.*=endpoint")
+	return outputs.NewSplunkHECOutputFromConfig(&Configuration{
+		SplunkHECToken:       "00000000-0000-0000-0000-000000000000",
+		SplunkHECSource:      "cb-event-forwarder",
+		SplunkHECSourceType:  DefaultSplunkHECSourceType,
+		SplunkHECIndex:       "main",
+		SplunkHECHostField:   "computer_name",
+		SplunkHECSourceTypes: sourceTypes,
+		SplunkHECIndexes:     indexes,
+		SplunkHECBatchSize:   batchSize,
+		SplunkHECBatchWait:   time.Hour,
+		SplunkHECMaxRetries:  2,
+		SplunkHECAck:         ack,
+		SplunkHECAckInterval: 10 * time.Millisecond,
+		SplunkHECAckTimeout:  300 * time.Millisecond,
+		TimeSource:           EventTimeSource,
+	})
+}
+
+func TestSplunkHECOutput(t *testing.T) {
+	hec, server := newTestSplunkHEC(t, false, http.StatusServiceUnavailable)
+	output := newTestSplunkHECOutput(3, false)
+	messages, _ := startTestOutput(t, output, server.URL)
+
+	// the batch is sent once it holds 3 events, after being retried once
+	for _, message := range []string{
+		`{"type":"ingress.event.netconn","timestamp":1600000001.5,"computer_name":"host1"}` + "\n",
+		`{"type":"alert.watchlist.hit.query.binary","timestamp":1600000002}` + "\n",
+		`not json`,
+	} {
+		messages <- message
+	}
+	statistics := waitForStatistics(t, output, func(s interface{}) bool { return s.(outputs.SplunkHECStatistics).SentEventCount == 3 }).(outputs.SplunkHECStatistics)
+
+	batches := hec.Batches()
+	if len(batches) != 1 {
+		t.Fatalf("expected a single batch, got %d", len(batches))
+	}
+	type event struct {
+		Time, Host, Source, SourceType, Index, Event string
+	}
+	var got []event
+	for _, e := range batches[0] {
+		got = append(got, event{Time: e.Time.String(), Host: e.Host, Source: e.Source, SourceType: e.SourceType, Index: e.Index, Event: string(e.Event)})
+	}
+	expected := []event{
+		{
+			Time: "1600000001.500", Host: "host1", Source: "cb-event-forwarder", SourceType: DefaultSplunkHECSourceType, Index: "network",
+			Event: `{"type":"ingress.event.netconn","timestamp":1600000001.5,"computer_name":"host1"}`,
+		},
+		{
+			Time: "1600000002.000", Source: "cb-event-forwarder", SourceType: "carbonblack:alert", Index: "main",
+			Event: `{"type":"alert.watchlist.hit.query.binary","timestamp":1600000002}`,
+		},
+		{Time: got[2].Time, Source: "cb-event-forwarder", SourceType: DefaultSplunkHECSourceType, Index: "main", Event: `"not json"`},
+	}
+	if diff := cmp.Diff(expected, got); diff != "" {
+		t.Errorf("unexpected events (-want +got):\n%s", diff)
+	}
+
+	if statistics.RetryCount != 1 || statistics.FailedEventCount != 0 || statistics.PendingEventCount != 0 {
+		t.Errorf("unexpected statistics: %+v", statistics)
+	}
+}
+
+func TestSplunkHECOutputIndexerAck(t *testing.T) {
+	hec, server := newTestSplunkHEC(t, true)
+	// the first batch is never acknowledged, and is sent again once the ack timeout passes
+	hec.unacked[0] = true
+	output := newTestSplunkHECOutput(1, true)
+	messages, _ := startTestOutput(t, output, server.URL+"/services/collector/event")
+
+	messages <- `{"type":"ingress.event.procstart","timestamp":1600000001}`
+	messages <- `{"type":"ingress.event.procstart","timestamp":1600000002}`
+	statistics := waitForStatistics(t, output, func(s interface{}) bool { return s.(outputs.SplunkHECStatistics).AckedEventCount == 2 }).(outputs.SplunkHECStatistics)
+
+	if statistics.SentEventCount != 3 || statistics.UnackedEventCount != 0 || statistics.AckTimeoutCount != 1 || statistics.RetryCount != 1 || statistics.FailedEventCount != 0 {
+		t.Errorf("unexpected statistics: %+v", statistics)
+	}
+
+	batches := hec.Batches()
+	if len(batches) != 3 || string(batches[2][0].Event) != string(batches[0][0].Event) {
+		t.Errorf("expected the first event to be sent again, got %+v", batches)
+	}
+	hec.mutex.Lock()
+	defer hec.mutex.Unlock()
+	if len(hec.channels) != 1 || hec.channels[""] {
+		t.Errorf("expected every request on the same channel, got %v", hec.channels)
+	}
+}
+
+func TestSplunkHECOutputVerify(t *testing.T) {
+	_, server := newTestSplunkHEC(t, true)
+	output := newTestSplunkHECOutput(100, true)
+	if err := output.Initialize(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if err := output.Verify(`{"type":"ingress.event.procstart"}`); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	hec, server := newTestSplunkHEC(t, true)
+	hec.unacked[0] = true
+	output = newTestSplunkHECOutput(100, true)
+	output.Config.SplunkHECMaxRetries = 0
+	if err := output.Initialize(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if err := output.Verify(`{"type":"ingress.event.procstart"}`); err == nil {
+		t.Error("expected an error for an event that is never acknowledged")
+	}
+}
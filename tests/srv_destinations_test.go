@@ -0,0 +1,206 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// mockSRVServer answers SRV queries over udp with its current records.
+type mockSRVServer struct {
+	conn net.PacketConn
+
+	sync.Mutex
+	records []dnsmessage.SRVResource
+}
+
+func newMockSRVServer(t *testing.T) *mockSRVServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &mockSRVServer{conn: conn}
+	go server.serve(t)
+	return server
+}
+
+func (s *mockSRVServer) setRecords(records ...dnsmessage.SRVResource) {
+	s.Lock()
+	defer s.Unlock()
+	s.records = records
+}
+
+// srvRecord returns a record for the port of a listener on localhost.
+func srvRecord(listener net.Addr, priority, weight uint16) dnsmessage.SRVResource {
+	return dnsmessage.SRVResource{
+		Priority: priority,
+		Weight:   weight,
+		Port:     uint16(listener.(*net.TCPAddr).Port),
+		Target:   dnsmessage.MustNewName("localhost."),
+	}
+}
+
+func (s *mockSRVServer) serve(t *testing.T) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var parser dnsmessage.Parser
+		header, err := parser.Start(buf[:n])
+		if err != nil {
+			continue
+		}
+		question, err := parser.Question()
+		if err != nil {
+			continue
+		}
+
+		builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true})
+		builder.EnableCompression()
+		builder.StartQuestions()
+		builder.Question(question)
+		builder.StartAnswers()
+		if question.Type == dnsmessage.TypeSRV {
+			s.Lock()
+			for _, record := range s.records {
+				builder.SRVResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 1}, record)
+			}
+			s.Unlock()
+		}
+		response, err := builder.Finish()
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		s.conn.WriteTo(response, addr)
+	}
+}
+
+// resolver returns a resolver that sends every query to the server.
+func (s *mockSRVServer) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "udp", s.conn.LocalAddr().String())
+		},
+	}
+}
+
+// newAcceptingListener returns a listener that reports every connection it accepts.
+func newAcceptingListener(t *testing.T) (net.Listener, <-chan struct{}) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan struct{}, 100)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			go func() {
+				b := make([]byte, 1024)
+				for {
+					if _, err := conn.Read(b); err != nil {
+						conn.Close()
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener, accepted
+}
+
+func localhostAddress(listener net.Listener) string {
+	return net.JoinHostPort("localhost", strconv.Itoa(listener.Addr().(*net.TCPAddr).Port))
+}
+
+func TestNetOutputSRVDestinations(t *testing.T) {
+	dns := newMockSRVServer(t)
+	defer dns.conn.Close()
+
+	// a port nothing listens on
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused.Close()
+
+	backup, backupAccepted := newAcceptingListener(t)
+	defer backup.Close()
+	unweighted, unweightedAccepted := newAcceptingListener(t)
+	defer unweighted.Close()
+	preferred, preferredAccepted := newAcceptingListener(t)
+	defer preferred.Close()
+
+	// the best target refuses connections, and the target without weight comes last
+	dns.setRecords(
+		srvRecord(refused.Addr(), 10, 1),
+		srvRecord(unweighted.Addr(), 20, 0),
+		srvRecord(backup.Addr(), 20, 5),
+	)
+
+	output := outputs.NewNetOutputfromConfig(&Configuration{
+		SRVResolver:        dns.resolver(),
+		SRVRefreshInterval: time.Second,
+	})
+	for i := 0; i < 5; i++ {
+		if err := output.Initialize("tcp:srv:_collector._tcp.example.test"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-backupAccepted:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("connection %d was not opened to the backup target", i+1)
+		}
+	}
+	select {
+	case <-unweightedAccepted:
+		t.Error("connected to the target without weight")
+	default:
+	}
+
+	stats := output.Statistics().(outputs.NetStatistics)
+	if stats.Destination != localhostAddress(backup) || len(stats.SRVTargets) != 3 {
+		t.Errorf("expected to be connected to %s out of 3 targets, got %+v", localhostAddress(backup), stats)
+	}
+
+	// a target of a better priority is picked up on the next lookup
+	dns.setRecords(
+		srvRecord(preferred.Addr(), 5, 1),
+		srvRecord(backup.Addr(), 20, 5),
+	)
+
+	messages := make(chan string)
+	signals := make(chan os.Signal)
+	if err := output.Go(messages, signals, sync.NewCond(&sync.Mutex{})); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { signals <- syscall.SIGTERM }()
+
+	select {
+	case <-preferredAccepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not move to the preferred target")
+	}
+
+	stats = output.Statistics().(outputs.NetStatistics)
+	if stats.Destination != localhostAddress(preferred) || stats.SRVSwitchCount != 1 || stats.SRVLookupErrors != 0 {
+		t.Errorf("expected to have moved to %s once, got %+v", localhostAddress(preferred), stats)
+	}
+}
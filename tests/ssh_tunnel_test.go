@@ -0,0 +1,252 @@
+package tests
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSSHServer forwards direct-tcpip channels for clients authenticating with clientKey.
+type testSSHServer struct {
+	listener net.Listener
+	hostKey  ssh.Signer
+
+	sync.Mutex
+	conns []net.Conn
+}
+
+func newTestSSHServer(t *testing.T, clientKey ssh.PublicKey) *testSSHServer {
+	hostKey, err := ssh.NewSignerFromKey(newTestECDSAKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientKey.Marshal()) {
+				return nil, io.EOF
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testSSHServer{listener: listener, hostKey: hostKey}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.Lock()
+			server.conns = append(server.conns, conn)
+			server.Unlock()
+			go server.serve(conn, config)
+		}
+	}()
+	return server
+}
+
+func (s *testSSHServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		var target struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if newChannel.ChannelType() != "direct-tcpip" || ssh.Unmarshal(newChannel.ExtraData(), &target) != nil {
+			newChannel.Reject(ssh.Prohibited, "only direct-tcpip is supported")
+			continue
+		}
+		targetConn, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			targetConn.Close()
+			continue
+		}
+		go ssh.DiscardRequests(channelRequests)
+		go func() {
+			io.Copy(targetConn, channel)
+			targetConn.Close()
+		}()
+		go func() {
+			io.Copy(channel, targetConn)
+			channel.Close()
+		}()
+	}
+}
+
+// dropConnections closes every SSH connection, as if the server had gone away.
+func (s *testSSHServer) dropConnections() {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func newTestECDSAKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func writeTempFile(t *testing.T, name string, data []byte) string {
+	file, err := ioutil.TempFile("", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func TestNetOutputSSHTunnel(t *testing.T) {
+	collector, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	lines := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := collector.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+
+	clientKey := newTestECDSAKey(t)
+	der, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := writeTempFile(t, "ssh-key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	defer os.Remove(keyFile)
+	clientPublicKey, err := ssh.NewPublicKey(&clientKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newTestSSHServer(t, clientPublicKey)
+	defer server.listener.Close()
+	sshAddress := server.listener.Addr().String()
+
+	knownHosts := writeTempFile(t, "known-hosts", []byte(knownhosts.Line([]string{sshAddress}, server.hostKey.PublicKey())+"\n"))
+	defer os.Remove(knownHosts)
+	otherHostKey, err := ssh.NewPublicKey(&newTestECDSAKey(t).PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongKnownHosts := writeTempFile(t, "known-hosts", []byte(knownhosts.Line([]string{sshAddress}, otherHostKey)+"\n"))
+	defer os.Remove(wrongKnownHosts)
+
+	config := Configuration{
+		SSHTunnelHost:           sshAddress,
+		SSHTunnelUser:           "forwarder",
+		SSHTunnelKeyFile:        keyFile,
+		SSHTunnelKnownHostsFile: wrongKnownHosts,
+	}
+	output := outputs.NewNetOutputfromConfig(&config)
+	if err := output.Initialize("tcp:" + collector.Addr().String()); err == nil {
+		t.Fatal("expected an unknown host key to be refused")
+	}
+
+	config.SSHTunnelKnownHostsFile = knownHosts
+	output = outputs.NewNetOutputfromConfig(&config)
+	if err := output.Initialize("tcp:" + collector.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := make(chan string)
+	signals := make(chan os.Signal)
+	if err := output.Go(messages, signals, sync.NewCond(&sync.Mutex{})); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { signals <- syscall.SIGTERM }()
+
+	expectLine := func(expected string) {
+		t.Helper()
+		select {
+		case line := <-lines:
+			if line != expected {
+				t.Errorf("expected %q, got %q", expected, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+	}
+
+	messages <- `{"type":"first"}`
+	expectLine(`{"type":"first"}`)
+
+	// once the output notices that the tunnel is gone, its next connection opens it again
+	server.dropConnections()
+	deadline := time.Now().Add(15 * time.Second)
+	for output.Statistics().(outputs.NetStatistics).Connected {
+		if time.Now().After(deadline) {
+			t.Fatal("the output did not notice that the tunnel was closed")
+		}
+		messages <- `{"type":"lost"}`
+		time.Sleep(50 * time.Millisecond)
+	}
+	for stats := output.Statistics().(outputs.NetStatistics); !stats.Connected; stats = output.Statistics().(outputs.NetStatistics) {
+		if time.Now().After(deadline) {
+			t.Fatalf("could not reconnect through the tunnel: %+v", stats)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	messages <- `{"type":"second"}`
+	expectLine(`{"type":"second"}`)
+
+	if stats := output.Statistics().(outputs.NetStatistics); stats.SSHTunnelConnectCount != 2 {
+		t.Errorf("expected the tunnel to be opened twice, got %+v", stats)
+	}
+}
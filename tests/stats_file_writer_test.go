@@ -0,0 +1,60 @@
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/carbonblack/cb-event-forwarder/pkg/forwarder"
+	"github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStatsFileWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "stats.json")
+	writer := forwarder.NewStatsFileWriter(path)
+
+	for _, sent := range []int64{10, 20} {
+		stats := map[string]interface{}{
+			"tcp:localhost:514": outputs.NetStatistics{SentEventCount: sent},
+		}
+		if err := writer.Write(stats); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var document struct {
+			Timestamp    string                            `json:"timestamp"`
+			OutputStatus map[string]map[string]interface{} `json:"output_status"`
+		}
+		if err := json.Unmarshal(b, &document); err != nil {
+			t.Fatal(err)
+		}
+		if document.Timestamp == "" {
+			t.Error("expected a timestamp")
+		}
+		if diff := cmp.Diff(float64(sent), document.OutputStatus["tcp:localhost:514"]["sent_event_count"]); diff != "" {
+			t.Errorf("unexpected sent_event_count, diff: %s", diff)
+		}
+	}
+
+	// only the stats file is left behind
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Mode().Perm() != 0644 {
+		t.Errorf("expected a single world-readable file, got %d files", len(files))
+	}
+}
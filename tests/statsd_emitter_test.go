@@ -0,0 +1,86 @@
+package tests
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/carbonblack/cb-event-forwarder/pkg/forwarder"
+	"github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+	"github.com/google/go-cmp/cmp"
+)
+
+type staticStatisticsOutput struct {
+	key   string
+	stats outputs.NetStatistics
+}
+
+func (o *staticStatisticsOutput) String() string          { return o.key }
+func (o *staticStatisticsOutput) Key() string             { return o.key }
+func (o *staticStatisticsOutput) Statistics() interface{} { return o.stats }
+
+func TestStatsdEmitterFlush(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	emitter, err := forwarder.NewStatsdEmitter(listener.LocalAddr().String(), "cb", []string{"env:test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer emitter.Close()
+
+	output := &staticStatisticsOutput{key: "tcp:localhost:514"}
+
+	read := func() []string {
+		buf := make([]byte, 2048)
+		listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := listener.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(string(buf[:n]), "\n")
+	}
+
+	for _, test := range []struct {
+		desc     string
+		stats    outputs.NetStatistics
+		expected []string
+	}{
+		{
+			desc:  "first flush sends totals",
+			stats: outputs.NetStatistics{Connected: true, DroppedEventCount: 2, SentEventCount: 10, BytesSent: 100, ReconnectCount: 1},
+			expected: []string{
+				"cb.output.tcp_localhost_514.connected:1|g|#env:test",
+				"cb.output.tcp_localhost_514.dropped:2|c|#env:test",
+				"cb.output.tcp_localhost_514.sent:10|c|#env:test",
+				"cb.output.tcp_localhost_514.bytes:100|c|#env:test",
+				"cb.output.tcp_localhost_514.reconnects:1|c|#env:test",
+			},
+		},
+		{
+			desc:  "later flushes send deltas",
+			stats: outputs.NetStatistics{Connected: false, DroppedEventCount: 5, SentEventCount: 10, BytesSent: 150, ReconnectCount: 1},
+			expected: []string{
+				"cb.output.tcp_localhost_514.connected:0|g|#env:test",
+				"cb.output.tcp_localhost_514.dropped:3|c|#env:test",
+				"cb.output.tcp_localhost_514.sent:0|c|#env:test",
+				"cb.output.tcp_localhost_514.bytes:50|c|#env:test",
+				"cb.output.tcp_localhost_514.reconnects:0|c|#env:test",
+			},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			output.stats = test.stats
+			if err := emitter.Flush([]outputs.OutputKeys{output}); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(read(), test.expected); diff != "" {
+				t.Errorf("statsd packet different from expected, diff: %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package tests
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+)
+
+// rfc5424Header matches the PRI, VERSION, TIMESTAMP, HOSTNAME, APP-NAME, PROCID and MSGID of an
+// RFC 5424 message, followed by its STRUCTURED-DATA and MSG.
+var rfc5424Header = regexp.MustCompile(`^<(\d{1,3})>1 (\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}\.\d{6}Z) ([!-~]{1,255}) ([!-~]{1,48}) ([!-~]{1,128}) ([!-~]{1,32}) (-|\[.*?[^\\]\]) `)
+
+func startSyslogOutput(t *testing.T, cfg *Configuration, netConn string) (*outputs.SyslogOutput, chan<- string) {
+	output := outputs.NewSyslogOutputFromConfig(cfg)
+	if err := output.Initialize(netConn); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := make(chan string)
+	signals := make(chan os.Signal)
+	if err := output.Go(messages, signals, sync.NewCond(&sync.Mutex{})); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { signals <- syscall.SIGTERM })
+	return output, messages
+}
+
+func parseRFC5424(t *testing.T, message string) (header []string, msg string) {
+	header = rfc5424Header.FindStringSubmatch(message)
+	if header == nil {
+		t.Fatalf("not an RFC 5424 message: %q", message)
+	}
+	return header, message[len(header[0]):]
+}
+
+func TestSyslogOutputRFC5424UDP(t *testing.T) {
+	collector, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	output, messages := startSyslogOutput(t, &Configuration{
+		SyslogRFC5424:              true,
+		SyslogFacility:             16,
+		SyslogDefaultSeverity:      5,
+		SyslogStructuredDataID:     DefaultSyslogStructuredDataID,
+		SyslogStructuredDataFields: []string{"type", "sensor_id", "missing", "cmdline"},
+		SyslogMaxMessageSize:       MinSyslogMaxMessageSize,
+	}, "udp:"+collector.LocalAddr().String())
+
+	buf := make([]byte, 65536)
+	read := func() string {
+		collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := collector.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	event := `{"type":"ingress.event.procstart","sensor_id":12,"cmdline":"say \"hi\" [x] \\ y"}`
+	messages <- event
+	header, msg := parseRFC5424(t, read())
+	if header[1] != strconv.Itoa(16<<3|5) {
+		t.Errorf("expected PRI %d, got %s", 16<<3|5, header[1])
+	}
+	if header[4] != "cb-event-forwarder" || header[6] != "ingress.event.procstart" {
+		t.Errorf("unexpected APP-NAME or MSGID: %q", header[0])
+	}
+	if expected := `[cb@32473 type="ingress.event.procstart" sensor_id="12" cmdline="say \"hi\" [x\] \\ y"]`; header[7] != expected {
+		t.Errorf("expected structured data %s, got %s", expected, header[7])
+	}
+	if msg != event {
+		t.Errorf("expected the event as MSG, got %q", msg)
+	}
+
+	// oversized events are cut to the datagram limit at a character boundary
+	messages <- `{"type":"x","cmdline":"` + strings.Repeat("é", 1000) + `"}`
+	datagram := read()
+	if len(datagram) > MinSyslogMaxMessageSize {
+		t.Errorf("expected at most %d bytes, got %d", MinSyslogMaxMessageSize, len(datagram))
+	}
+	if _, msg := parseRFC5424(t, datagram); !strings.HasPrefix(msg, `{"type":"x","cmdline":"éé`) || strings.HasSuffix(msg, "\xc3") {
+		t.Errorf("unexpected truncated MSG: %q", msg)
+	}
+
+	// the message is sent right after Go receives the event, before it reads the next one
+	messages <- `{}`
+	read()
+	if stats := output.Statistics().(outputs.SyslogStatistics); stats.TruncatedEventCount != 1 {
+		t.Errorf("expected 1 truncated event, got %d", stats.TruncatedEventCount)
+	}
+}
+
+func TestSyslogOutputRFC5424TCP(t *testing.T) {
+	collector, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	_, messages := startSyslogOutput(t, &Configuration{
+		SyslogRFC5424:         true,
+		SyslogDefaultSeverity: 6,
+	}, "tcp:"+collector.Addr().String())
+
+	conn, err := collector.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	events := []string{`{"type":"a"}`, "not json"}
+	for _, event := range events {
+		messages <- event
+	}
+	for _, event := range events {
+		// octet counting framing: MSG-LEN SP SYSLOG-MSG
+		length, err := reader.ReadString(' ')
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if err != nil {
+			t.Fatalf("invalid frame length %q", length)
+		}
+		message := make([]byte, n)
+		if _, err := io.ReadFull(reader, message); err != nil {
+			t.Fatal(err)
+		}
+
+		header, msg := parseRFC5424(t, string(message))
+		if header[1] != "6" || header[7] != "-" || msg != event {
+			t.Errorf("unexpected message %q", message)
+		}
+	}
+}
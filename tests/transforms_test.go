@@ -0,0 +1,274 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/carbonblack/cb-event-forwarder/pkg/transforms"
+	"github.com/google/go-cmp/cmp"
+)
+
+func decodeEvent(t *testing.T, s string) map[string]interface{} {
+	var event map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(s)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&event); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestTransformApply(t *testing.T) {
+	const input = `{"type": "alert.watchlist.hit.process", "report_score": 80, "computer_name": "HOST-1", "process": {"name": "CMD.EXE"}}`
+
+	for _, test := range []struct {
+		desc     string
+		script   string
+		expected string
+	}{
+		{
+			desc:     "set literal",
+			script:   `set severity = "high"`,
+			expected: `{"type": "alert.watchlist.hit.process", "report_score": 80, "computer_name": "HOST-1", "process": {"name": "CMD.EXE"}, "severity": "high"}`,
+		},
+		{
+			desc:     "rename and delete",
+			script:   "rename computer_name to hostname\ndelete process",
+			expected: `{"type": "alert.watchlist.hit.process", "report_score": 80, "hostname": "HOST-1"}`,
+		},
+		{
+			desc:     "nested paths and functions",
+			script:   `set process.name = lower(process.name); copy process.name to meta.process_name`,
+			expected: `{"type": "alert.watchlist.hit.process", "report_score": 80, "computer_name": "HOST-1", "process": {"name": "cmd.exe"}, "meta": {"process_name": "cmd.exe"}}`,
+		},
+		{
+			desc:     "arithmetic and concatenation",
+			script:   `set report_score = report_score + 5; set label = computer_name + "/" + process.name`,
+			expected: `{"type": "alert.watchlist.hit.process", "report_score": 85, "computer_name": "HOST-1", "process": {"name": "CMD.EXE"}, "label": "HOST-1/CMD.EXE"}`,
+		},
+		{
+			desc:     "conditions",
+			script:   "if report_score >= 50 and exists process.name then set severity = \"high\"\nif not exists missing or report_score < 10 then delete type",
+			expected: `{"report_score": 80, "computer_name": "HOST-1", "process": {"name": "CMD.EXE"}, "severity": "high"}`,
+		},
+		{
+			desc:     "false condition",
+			script:   `if type != "alert.watchlist.hit.process" then delete computer_name`,
+			expected: input,
+		},
+		{
+			desc:     "missing fields",
+			script:   `rename missing to other; delete missing.field; set x = coalesce(missing, "default")`,
+			expected: `{"type": "alert.watchlist.hit.process", "report_score": 80, "computer_name": "HOST-1", "process": {"name": "CMD.EXE"}, "x": "default"}`,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			program, err := transforms.Compile(test.script)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			event := decodeEvent(t, input)
+			if err := program.Apply(event); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(decodeEvent(t, test.expected), event); diff != "" {
+				t.Errorf("unexpected event (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTransformErrors(t *testing.T) {
+	for _, test := range []struct {
+		desc   string
+		script string
+	}{
+		{desc: "empty", script: " \n ; "},
+		{desc: "unknown statement", script: `assign x = 1`},
+		{desc: "missing value", script: `set x =`},
+		{desc: "reserved field name", script: `delete then`},
+		{desc: "unterminated string", script: `set x = "abc`},
+		{desc: "wrong argument count", script: `set x = lower(a, b)`},
+		{desc: "trailing tokens", script: `delete x y`},
+		{desc: "missing then", script: `if x == 1 delete x`},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			if _, err := transforms.Compile(test.script); err == nil {
+				t.Errorf("expected an error compiling %q", test.script)
+			}
+		})
+	}
+
+	t.Run("runtime error", func(t *testing.T) {
+		program, err := transforms.Compile(`set process.name.first = "x"`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := program.Apply(decodeEvent(t, `{"process": {"name": "cmd.exe"}}`)); err == nil {
+			t.Error("expected an error setting a field below a string")
+		}
+	})
+}
+
+func TestCoercionsApply(t *testing.T) {
+	for _, test := range []struct {
+		desc        string
+		fields      string
+		policy      transforms.CoercionFailurePolicy
+		input       string
+		expected    string
+		expectError bool
+	}{
+		{
+			desc:     "to string",
+			fields:   "port:string,enabled:string,name:string",
+			input:    `{"port": 443, "enabled": true, "name": "host"}`,
+			expected: `{"port": "443", "enabled": "true", "name": "host"}`,
+		},
+		{
+			desc:     "to int",
+			fields:   "a:int,b:int,c:int,d:int,e:int",
+			input:    `{"a": "443", "b": " 80 ", "c": 12.0, "d": true, "e": "1e3"}`,
+			expected: `{"a": 443, "b": 80, "c": 12, "d": 1, "e": 1000}`,
+		},
+		{
+			desc:     "to float",
+			fields:   "a:float,b:float,c:float",
+			input:    `{"a": "2.5", "b": 7, "c": false}`,
+			expected: `{"a": 2.5, "b": 7, "c": 0}`,
+		},
+		{
+			desc:     "to bool",
+			fields:   "a:bool,b:bool,c:bool,d:bool,e:bool",
+			input:    `{"a": "true", "b": "No", "c": 1, "d": 0, "e": false}`,
+			expected: `{"a": true, "b": false, "c": true, "d": false, "e": false}`,
+		},
+		{
+			desc:     "nested, missing and null fields",
+			fields:   "netconn.port:int,missing:int,empty:string",
+			input:    `{"netconn": {"port": "53"}, "empty": null}`,
+			expected: `{"netconn": {"port": 53}, "empty": null}`,
+		},
+		{
+			desc:        "failures are kept",
+			fields:      "a:int,b:bool,c:string,d:int",
+			policy:      transforms.KeepUncoercible,
+			input:       `{"a": "abc", "b": 2, "c": {"x": 1}, "d": "7"}`,
+			expected:    `{"a": "abc", "b": 2, "c": {"x": 1}, "d": 7}`,
+			expectError: true,
+		},
+		{
+			desc:        "failures are dropped",
+			fields:      "a:int,b:float,c:string,d:int",
+			policy:      transforms.DropUncoercible,
+			input:       `{"a": 1.5, "b": "NaN", "c": [1], "d": "7"}`,
+			expected:    `{"d": 7}`,
+			expectError: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			policy := test.policy
+			if len(policy) == 0 {
+				policy = transforms.KeepUncoercible
+			}
+			coercions, err := transforms.ParseCoercions(test.fields, policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			event := decodeEvent(t, test.input)
+			if err := coercions.Apply(event); (err != nil) != test.expectError {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			// compare the encoded values, since numbers are kept as json.Number
+			expected, _ := json.Marshal(decodeEvent(t, test.expected))
+			actual, _ := json.Marshal(event)
+			if diff := cmp.Diff(string(expected), string(actual)); diff != "" {
+				t.Errorf("unexpected event (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCoercionsErrors(t *testing.T) {
+	for _, spec := range []string{"", "port", "port:integer", "netconn..port:int", " , "} {
+		if _, err := transforms.ParseCoercions(spec, transforms.KeepUncoercible); err == nil {
+			t.Errorf("expected an error parsing %q", spec)
+		}
+	}
+}
+
+func TestConflictPolicy(t *testing.T) {
+	// the transform writes port, which coerce converts, and hostname, which a later stage writes
+	// again; setting tag twice in the same stage is not a conflict
+	program, err := transforms.Compile(`set port = "443"; rename host to hostname; set tag = "a"; set tag = "b"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coercions, err := transforms.ParseCoercions("port:int,pid:int", transforms.KeepUncoercible)
+	if err != nil {
+		t.Fatal(err)
+	}
+	override, err := transforms.Compile(`set hostname = "other"; set extra = 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		policy   transforms.ConflictPolicy
+		expected string
+		conflict *transforms.ConflictError
+	}{
+		{
+			policy:   transforms.LastWriteWins,
+			expected: `{"port": 443, "pid": 4, "hostname": "other", "tag": "b", "extra": 1}`,
+		},
+		{
+			policy:   transforms.FirstWriteWins,
+			expected: `{"port": "443", "pid": 4, "hostname": "host-1", "tag": "b", "extra": 1}`,
+		},
+		{
+			policy:   transforms.FailOnConflict,
+			conflict: &transforms.ConflictError{Field: "port", First: "transform", Second: "coerce"},
+		},
+	} {
+		t.Run(string(test.policy), func(t *testing.T) {
+			event := decodeEvent(t, `{"host": "host-1", "pid": "4"}`)
+			writes := transforms.NewFieldWrites(test.policy)
+
+			writes.Stage("transform")
+			err := program.ApplyTracked(event, writes)
+			if err == nil {
+				writes.Stage("coerce")
+				err = coercions.ApplyTracked(event, writes)
+			}
+			if err == nil {
+				writes.Stage("override")
+				err = override.ApplyTracked(event, writes)
+			}
+
+			if test.conflict != nil {
+				if diff := cmp.Diff(test.conflict, err); diff != "" {
+					t.Errorf("unexpected error (-want +got):\n%s", diff)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, _ := json.Marshal(decodeEvent(t, test.expected))
+			actual, _ := json.Marshal(event)
+			if diff := cmp.Diff(string(expected), string(actual)); diff != "" {
+				t.Errorf("unexpected event (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	if _, err := transforms.ConflictPolicyFromString("newest"); err == nil {
+		t.Error("expected an error parsing an unknown policy")
+	}
+}
@@ -0,0 +1,143 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/carbonblack/cb-event-forwarder/pkg/config"
+	"github.com/carbonblack/cb-event-forwarder/pkg/outputs"
+	"golang.org/x/net/websocket"
+)
+
+type receivedWebSocketMessage struct {
+	text        string
+	payloadType byte
+}
+
+// frameCodec receives a message along with its payload type
+var frameCodec = websocket.Codec{Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+	*v.(*receivedWebSocketMessage) = receivedWebSocketMessage{text: string(data), payloadType: payloadType}
+	return nil
+}}
+
+// newTestWebSocketServer accepts connections offering the events.v1 subprotocol with the
+// expected authorization header, and hands over every connection and message it receives.
+func newTestWebSocketServer(t *testing.T) (*httptest.Server, <-chan *websocket.Conn, <-chan receivedWebSocketMessage) {
+	conns := make(chan *websocket.Conn, 10)
+	messages := make(chan receivedWebSocketMessage, 10)
+
+	server := httptest.NewServer(websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				return websocket.ErrBadRequestMethod
+			}
+			for _, protocol := range config.Protocol {
+				if protocol == "events.v1" {
+					config.Protocol = []string{protocol}
+					return nil
+				}
+			}
+			return websocket.ErrBadWebSocketProtocol
+		},
+		Handler: func(ws *websocket.Conn) {
+			conns <- ws
+			for {
+				var message receivedWebSocketMessage
+				if err := frameCodec.Receive(ws, &message); err != nil {
+					return
+				}
+				messages <- message
+			}
+		},
+	})
+	return server, conns, messages
+}
+
+func TestWebSocketOutput(t *testing.T) {
+	server, conns, messages := newTestWebSocketServer(t)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/events"
+
+	newOutput := func(binary bool, subprotocols ...string) *outputs.WebSocketOutput {
+		return outputs.NewWebSocketOutputFromConfig(&Configuration{
+			WebSocketSubprotocols:   subprotocols,
+			WebSocketHeaders:        http.Header{"Authorization": []string{"Bearer secret"}},
+			WebSocketBinaryMessages: binary,
+			WebSocketPingInterval:   time.Second,
+		})
+	}
+
+	expectMessage := func(expected string, payloadType byte) {
+		t.Helper()
+		select {
+		case message := <-messages:
+			if message.text != expected || message.payloadType != payloadType {
+				t.Errorf("expected %q with payload type %d, got %+v", expected, payloadType, message)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+	}
+
+	t.Run("unsupported subprotocol", func(t *testing.T) {
+		if err := newOutput(false, "events.v0").Initialize(wsURL); err == nil {
+			t.Error("expected the handshake to fail")
+		}
+	})
+
+	t.Run("binary messages", func(t *testing.T) {
+		output := newOutput(true, "events.v1")
+		if err := output.Initialize(wsURL); err != nil {
+			t.Fatal(err)
+		}
+		if err := output.Verify(`{"type":"binary"}`); err != nil {
+			t.Fatal(err)
+		}
+		<-conns
+		expectMessage(`{"type":"binary"}`, websocket.BinaryFrame)
+	})
+
+	t.Run("reconnect after close", func(t *testing.T) {
+		output := newOutput(false, "events.v0", "events.v1")
+		if err := output.Initialize(wsURL); err != nil {
+			t.Fatal(err)
+		}
+		events := make(chan string)
+		signals := make(chan os.Signal)
+		if err := output.Go(events, signals, sync.NewCond(&sync.Mutex{})); err != nil {
+			t.Fatal(err)
+		}
+		defer func() { signals <- syscall.SIGTERM }()
+
+		events <- `{"type":"first"}`
+		expectMessage(`{"type":"first"}`, websocket.TextFrame)
+
+		// the collector goes away and the output connects again 5 seconds later
+		(<-conns).Close()
+		select {
+		case <-conns:
+		case <-time.After(10 * time.Second):
+			t.Fatal("the output did not reconnect")
+		}
+
+		events <- `{"type":"second"}`
+		expectMessage(`{"type":"second"}`, websocket.TextFrame)
+
+		// an idle connection is pinged every second
+		deadline := time.Now().Add(5 * time.Second)
+		for output.Statistics().(outputs.WebSocketStatistics).PingCount == 0 && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		stats := output.Statistics().(outputs.WebSocketStatistics)
+		if stats.SentMessageCount != 2 || stats.ReconnectCount != 1 || !stats.Connected || stats.PingCount == 0 {
+			t.Errorf("unexpected statistics: %+v", stats)
+		}
+	})
+}